@@ -0,0 +1,148 @@
+package pto3
+
+import (
+	"net/http"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// VisibilityMetadataKey is the metadata key holding an observation set's
+// visibility, which determines who may read it; see ReadableBy.
+const VisibilityMetadataKey = "_visibility"
+
+// ProjectMetadataKey is the metadata key holding the name of the project an
+// observation set with project visibility belongs to.
+const ProjectMetadataKey = "_project"
+
+// Visibilities of observation sets.
+const (
+	// Readable by anyone allowed to read observations; the default
+	VisibilityPublic = "public"
+	// Readable by the set's owner and clients allowed to read the set's project
+	VisibilityProject = "project"
+	// Readable only by the set's owner
+	VisibilityPrivate = "private"
+	// Readable only by the set's owner, but included in differentially
+	// private queries by anyone
+	VisibilityAggregate = "aggregate"
+)
+
+// ReadPrivatePermission allows a client to read every observation set,
+// whatever its visibility.
+const ReadPrivatePermission = "read_private_obs"
+
+// ProjectPermission returns the permission allowing a client to read
+// observation sets with project visibility belonging to the given project.
+func ProjectPermission(project string) string {
+	return "read_obs:" + project
+}
+
+// restrictedSetsClause selects the IDs of observation sets which are not
+// public, or have been deleted.
+const restrictedSetsClause = "SELECT id FROM observation_sets WHERE coalesce(metadata->>'" +
+	VisibilityMetadataKey + "', '" + VisibilityPublic + "') <> '" + VisibilityPublic + "' OR deleted IS NOT NULL"
+
+// privateQueryRestrictedSetsClause selects the IDs of observation sets which
+// may not be included in differentially private queries: those neither
+// public nor with aggregate visibility, and those which have been deleted.
+const privateQueryRestrictedSetsClause = "SELECT id FROM observation_sets WHERE coalesce(metadata->>'" +
+	VisibilityMetadataKey + "', '" + VisibilityPublic + "') NOT IN ('" + VisibilityPublic + "', '" +
+	VisibilityAggregate + "') OR deleted IS NOT NULL"
+
+// Visibility returns this ObservationSet's visibility, VisibilityPublic if it
+// has none.
+func (set *ObservationSet) Visibility() string {
+	if v := set.Metadata[VisibilityMetadataKey]; v != "" {
+		return v
+	}
+	return VisibilityPublic
+}
+
+// ValidateVisibility returns an error if this ObservationSet's visibility is
+// unknown, or if it has project visibility but names no project.
+func (set *ObservationSet) ValidateVisibility() error {
+	switch set.Visibility() {
+	case VisibilityPublic, VisibilityPrivate, VisibilityAggregate:
+		return nil
+	case VisibilityProject:
+		if set.Metadata[ProjectMetadataKey] == "" {
+			return PTOErrorf("observation set with project visibility needs a %s", ProjectMetadataKey).StatusIs(http.StatusBadRequest)
+		}
+		return nil
+	default:
+		return PTOErrorf("unknown set visibility %s", set.Visibility()).StatusIs(http.StatusBadRequest)
+	}
+}
+
+// ObservationSetAccess describes who may read an observation set.
+type ObservationSetAccess struct {
+	// ID of the set
+	ID int
+	// Visibility of the set
+	Visibility string
+	// Project the set belongs to, for project visibility
+	Project string
+	// Identifier of the client which created the set, see Submitter
+	Owner string
+	// True if the set has been deleted, see MarkDeleted
+	Deleted bool
+}
+
+// ReadableBy returns true if a client with the given identifier and
+// permissions may read the set. Public sets are readable by anyone, and all
+// sets by their owner and by clients with ReadPrivatePermission. Sets with
+// project visibility are also readable by clients with the project's
+// permission; sets with aggregate visibility are read only through
+// differentially private queries. Sets created without an identifiable
+// client have no owner. Deleted sets are readable by no one until restored.
+func (acc *ObservationSetAccess) ReadableBy(client string, hasPermission func(string) bool) bool {
+	switch {
+	case acc.Deleted:
+		return false
+	case acc.Visibility == VisibilityPublic:
+		return true
+	case acc.Owner != "" && acc.Owner != "default" && acc.Owner == client:
+		return true
+	case hasPermission(ReadPrivatePermission):
+		return true
+	case acc.Visibility == VisibilityProject && acc.Project != "":
+		return hasPermission(ProjectPermission(acc.Project))
+	default:
+		return false
+	}
+}
+
+// Access returns a description of who may read this ObservationSet, or a
+// not found error if it does not exist.
+func (set *ObservationSet) Access(db orm.DB) (*ObservationSetAccess, error) {
+	acc := ObservationSetAccess{ID: set.ID}
+	if _, err := db.QueryOne(pg.Scan(&acc.Visibility, &acc.Project, &acc.Owner, &acc.Deleted),
+		"SELECT coalesce(metadata->>?, ?), coalesce(metadata->>?, ''), coalesce(submitter, ''), deleted IS NOT NULL FROM observation_sets WHERE id = ?",
+		VisibilityMetadataKey, VisibilityPublic, ProjectMetadataKey, set.ID); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
+		}
+		return nil, PTOWrapError(err)
+	}
+	return &acc, nil
+}
+
+// RestrictedObservationSets returns descriptions of who may read each
+// observation set which is not public or has been deleted, by set ID.
+func RestrictedObservationSets(db orm.DB) (map[int]*ObservationSetAccess, error) {
+	var accs []ObservationSetAccess
+	if _, err := db.Query(&accs, `SELECT id, coalesce(metadata->>?, ?) AS visibility,
+		coalesce(metadata->>?, '') AS project, coalesce(submitter, '') AS owner,
+		deleted IS NOT NULL AS deleted
+		FROM observation_sets WHERE id IN (`+restrictedSetsClause+`)`,
+		VisibilityMetadataKey, VisibilityPublic, ProjectMetadataKey); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	out := make(map[int]*ObservationSetAccess)
+	for i := range accs {
+		out[accs[i].ID] = &accs[i]
+	}
+	return out, nil
+}
@@ -0,0 +1,215 @@
+package pto3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Access log formats, selected by AccessLogFormat in the configuration.
+const (
+	// AccessLogFormatPTO is the PTO's own format, read by ptoreplay: method,
+	// URL, response length, status, and duration, after a timestamp
+	AccessLogFormatPTO = "pto"
+	// AccessLogFormatCommon is the Common Log Format, with the API key ID as
+	// the user
+	AccessLogFormatCommon = "common"
+	// AccessLogFormatCombined is the Combined Log Format, the Common Log
+	// Format with referer and user agent
+	AccessLogFormatCombined = "combined"
+	// AccessLogFormatJSON writes each request as a JSON object on a line
+	AccessLogFormatJSON = "json"
+)
+
+// clfTimeFormat is the timestamp format of the Common Log Format.
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// AccessLogRecord describes a request handled by the web API, for the access
+// log.
+type AccessLogRecord struct {
+	// Time the request was received
+	Time time.Time
+	// Address of the client
+	RemoteAddr string
+	// Request method
+	Method string
+	// Request URL, as received by the server
+	URL string
+	// Request protocol, e.g. HTTP/1.1
+	Proto string
+	// Response status
+	Status int
+	// Length of the response body
+	Length int
+	// Time taken to handle the request
+	Duration time.Duration
+	// Identifier of the API key the request presented, never the key itself;
+	// default for requests without a key
+	APIKeyID string
+	// ID of the request, from the RequestIDHeader of the response
+	RequestID string
+	// Referer and User-Agent request headers
+	Referer   string
+	UserAgent string
+}
+
+// AccessLog writes records of requests handled by the web API in a
+// configured format, to standard error or to a file. A file is opened for
+// appending, and can be reopened with Reopen after it has been rotated.
+type AccessLog struct {
+	format string
+	path   string
+
+	lock   sync.Mutex
+	file   *os.File
+	out    io.Writer
+	logger *log.Logger
+}
+
+// NewAccessLog returns an access log in the given format, writing to the
+// file at the given path, or to standard error if the path is empty.
+func NewAccessLog(path string, format string) (*AccessLog, error) {
+	switch format {
+	case "":
+		format = AccessLogFormatPTO
+	case AccessLogFormatPTO, AccessLogFormatCommon, AccessLogFormatCombined, AccessLogFormatJSON:
+	default:
+		return nil, PTOErrorf("unknown access log format %s; must be %s, %s, %s, or %s", format,
+			AccessLogFormatPTO, AccessLogFormatCommon, AccessLogFormatCombined, AccessLogFormatJSON)
+	}
+
+	al := &AccessLog{format: format, path: path, out: os.Stderr}
+	if err := al.Reopen(); err != nil {
+		return nil, err
+	}
+
+	// the PTO format keeps the prefix it always had in separate files, so
+	// that existing logs and new ones read the same
+	prefix := ""
+	if path != "" {
+		prefix = "access: "
+	}
+	al.logger = log.New(al, prefix, log.LstdFlags)
+
+	return al, nil
+}
+
+// Format returns the format of this access log.
+func (al *AccessLog) Format() string {
+	return al.format
+}
+
+// Reopen closes and reopens the file this access log writes to, so that a
+// log rotated by moving the file continues in a new file at the configured
+// path. It does nothing for an access log writing to standard error.
+func (al *AccessLog) Reopen() error {
+	if al.path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	al.lock.Lock()
+	old := al.file
+	al.file = file
+	al.out = file
+	al.lock.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// Write writes a line to this access log's current output.
+func (al *AccessLog) Write(b []byte) (int, error) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	return al.out.Write(b)
+}
+
+// Log writes a record to this access log in its format.
+func (al *AccessLog) Log(rec *AccessLogRecord) {
+	if al.format == AccessLogFormatPTO {
+		al.logger.Printf("%s %s %d %d %v", rec.Method, rec.URL, rec.Length, rec.Status, rec.Duration)
+		return
+	}
+
+	line, err := rec.Format(al.format)
+	if err != nil {
+		log.Printf("cannot write access log record for %s %s: %v", rec.Method, rec.URL, err)
+		return
+	}
+	if _, err := al.Write(line); err != nil {
+		log.Printf("cannot write access log record for %s %s: %v", rec.Method, rec.URL, err)
+	}
+}
+
+// clfField returns a value for a field in the Common Log Format, - if empty.
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Format returns this record as a line of an access log in the given format,
+// other than AccessLogFormatPTO, which depends on the logger writing it.
+func (rec *AccessLogRecord) Format(format string) ([]byte, error) {
+	switch format {
+	case AccessLogFormatCommon, AccessLogFormatCombined:
+		length := "-"
+		if rec.Length > 0 {
+			length = fmt.Sprintf("%d", rec.Length)
+		}
+		line := fmt.Sprintf("%s - %s [%s] %q %d %s",
+			clfField(rec.RemoteAddr), clfField(rec.APIKeyID), rec.Time.Format(clfTimeFormat),
+			rec.Method+" "+rec.URL+" "+rec.Proto, rec.Status, length)
+		if format == AccessLogFormatCombined {
+			line += fmt.Sprintf(" %q %q", clfField(rec.Referer), clfField(rec.UserAgent))
+		}
+		return []byte(line + "\n"), nil
+
+	case AccessLogFormatJSON:
+		b, err := json.Marshal(struct {
+			Time       string  `json:"time"`
+			RemoteAddr string  `json:"remote_addr,omitempty"`
+			Method     string  `json:"method"`
+			URL        string  `json:"url"`
+			Proto      string  `json:"proto,omitempty"`
+			Status     int     `json:"status"`
+			Length     int     `json:"bytes"`
+			Duration   float64 `json:"duration_ms"`
+			APIKeyID   string  `json:"api_key,omitempty"`
+			RequestID  string  `json:"request_id,omitempty"`
+			Referer    string  `json:"referer,omitempty"`
+			UserAgent  string  `json:"user_agent,omitempty"`
+		}{
+			Time:       rec.Time.UTC().Format(time.RFC3339Nano),
+			RemoteAddr: rec.RemoteAddr,
+			Method:     rec.Method,
+			URL:        rec.URL,
+			Proto:      rec.Proto,
+			Status:     rec.Status,
+			Length:     rec.Length,
+			Duration:   float64(rec.Duration) / float64(time.Millisecond),
+			APIKeyID:   rec.APIKeyID,
+			RequestID:  rec.RequestID,
+			Referer:    rec.Referer,
+			UserAgent:  rec.UserAgent,
+		})
+		if err != nil {
+			return nil, PTOWrapError(err)
+		}
+		return append(b, '\n'), nil
+	}
+
+	return nil, PTOErrorf("cannot format access log record in format %s", format)
+}
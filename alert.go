@@ -0,0 +1,296 @@
+package pto3
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AlertMetadataKey is the query metadata key holding alerting rules for the
+// query, separated by semicolons.
+const AlertMetadataKey = "_alert"
+
+// Metrics alerting rules can test
+const (
+	// Number of rows in the result
+	AlertMetricRows = "rows"
+	// Observations with a given condition
+	AlertMetricObservations = "observations"
+	// Distinct paths with an observation of a given condition
+	AlertMetricPaths = "paths"
+)
+
+// AlertRule is a threshold on a metric computed from the results of a
+// selection query, written as "<metric>[:<condition>] <op> <threshold>[%]",
+// e.g. "paths:pto.ecn.blocked > 5%". With a percent sign, the threshold
+// applies to the share of all observations or paths in the result; without,
+// to the count.
+type AlertRule struct {
+	// Metric to compute: rows, observations, or paths
+	Metric string
+	// Condition observations or paths must show, for observations and paths
+	Condition string
+	// Comparison operator: >, >=, <, or <=
+	Op string
+	// Threshold to compare the metric to
+	Threshold float64
+	// True if the threshold is a percentage of all observations or paths
+	Percent bool
+}
+
+// ParseAlertRule parses an alerting rule from its string representation.
+func ParseAlertRule(s string) (*AlertRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return nil, PTOErrorf("alert rule %q must be of the form <metric>[:<condition>] <op> <threshold>[%%]", s).StatusIs(http.StatusBadRequest)
+	}
+
+	var rule AlertRule
+
+	metric := strings.SplitN(fields[0], ":", 2)
+	rule.Metric = metric[0]
+	if len(metric) == 2 {
+		rule.Condition = metric[1]
+	}
+
+	switch rule.Metric {
+	case AlertMetricRows:
+		if rule.Condition != "" {
+			return nil, PTOErrorf("alert rule %q: metric rows takes no condition", s).StatusIs(http.StatusBadRequest)
+		}
+	case AlertMetricObservations, AlertMetricPaths:
+		if rule.Condition == "" {
+			return nil, PTOErrorf("alert rule %q: metric %s requires a condition", s, rule.Metric).StatusIs(http.StatusBadRequest)
+		}
+	default:
+		return nil, PTOErrorf("alert rule %q: unknown metric %s", s, rule.Metric).StatusIs(http.StatusBadRequest)
+	}
+
+	switch fields[1] {
+	case ">", ">=", "<", "<=":
+		rule.Op = fields[1]
+	default:
+		return nil, PTOErrorf("alert rule %q: unknown operator %s", s, fields[1]).StatusIs(http.StatusBadRequest)
+	}
+
+	threshold := fields[2]
+	if strings.HasSuffix(threshold, "%") {
+		if rule.Metric == AlertMetricRows {
+			return nil, PTOErrorf("alert rule %q: metric rows cannot be a percentage", s).StatusIs(http.StatusBadRequest)
+		}
+		rule.Percent = true
+		threshold = threshold[:len(threshold)-1]
+	}
+
+	var err error
+	if rule.Threshold, err = strconv.ParseFloat(threshold, 64); err != nil {
+		return nil, PTOErrorf("alert rule %q: bad threshold %s", s, fields[2]).StatusIs(http.StatusBadRequest)
+	}
+
+	return &rule, nil
+}
+
+// ParseAlertRules parses a semicolon-separated list of alerting rules.
+func ParseAlertRules(s string) ([]AlertRule, error) {
+	out := make([]AlertRule, 0)
+	for _, rulestr := range strings.Split(s, ";") {
+		if strings.TrimSpace(rulestr) == "" {
+			continue
+		}
+		rule, err := ParseAlertRule(rulestr)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *rule)
+	}
+	return out, nil
+}
+
+func (rule *AlertRule) String() string {
+	metric := rule.Metric
+	if rule.Condition != "" {
+		metric += ":" + rule.Condition
+	}
+
+	threshold := strconv.FormatFloat(rule.Threshold, 'f', -1, 64)
+	if rule.Percent {
+		threshold += "%"
+	}
+
+	return fmt.Sprintf("%s %s %s", metric, rule.Op, threshold)
+}
+
+// breached returns true if the given value breaches this rule's threshold.
+func (rule *AlertRule) breached(value float64) bool {
+	switch rule.Op {
+	case ">":
+		return value > rule.Threshold
+	case ">=":
+		return value >= rule.Threshold
+	case "<":
+		return value < rule.Threshold
+	case "<=":
+		return value <= rule.Threshold
+	}
+	return false
+}
+
+// QueryAlert reports a breach of an alerting rule by the results of a query.
+type QueryAlert struct {
+	// Link to the query
+	Query string `json:"query"`
+	// Rule breached
+	Rule string `json:"rule"`
+	// Value of the rule's metric
+	Value float64 `json:"value"`
+	// Completion time of the execution which breached the rule
+	Time *time.Time `json:"time"`
+}
+
+// resultStats counts observations and paths, in total and by condition, in
+// the results of a selection query.
+type resultStats struct {
+	rows           int
+	paths          map[string]struct{}
+	conditionObs   map[string]int
+	conditionPaths map[string]map[string]struct{}
+}
+
+func (q *Query) scanResultStats() (*resultStats, error) {
+	in, err := q.ReadResultFile()
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	defer in.Close()
+
+	stats := resultStats{
+		paths:          make(map[string]struct{}),
+		conditionObs:   make(map[string]int),
+		conditionPaths: make(map[string]map[string]struct{}),
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		jslice, _, _, err := splitObservationJSON(scanner.Bytes())
+		if err != nil {
+			return nil, PTOErrorf("bad observation in query result: %s", scanner.Text())
+		}
+
+		path, condition := jslice[3], jslice[4]
+
+		stats.rows++
+		stats.paths[path] = struct{}{}
+		stats.conditionObs[condition]++
+		if stats.conditionPaths[condition] == nil {
+			stats.conditionPaths[condition] = make(map[string]struct{})
+		}
+		stats.conditionPaths[condition][path] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return &stats, nil
+}
+
+// value computes this rule's metric from result statistics.
+func (rule *AlertRule) value(stats *resultStats) float64 {
+	var count, total int
+
+	switch rule.Metric {
+	case AlertMetricRows:
+		return float64(stats.rows)
+	case AlertMetricObservations:
+		count, total = stats.conditionObs[rule.Condition], stats.rows
+	case AlertMetricPaths:
+		count, total = len(stats.conditionPaths[rule.Condition]), len(stats.paths)
+	}
+
+	if !rule.Percent {
+		return float64(count)
+	}
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(count) / float64(total)
+}
+
+// AlertRules returns the alerting rules in this query's metadata.
+func (q *Query) AlertRules() ([]AlertRule, error) {
+	return ParseAlertRules(q.Metadata[AlertMetadataKey])
+}
+
+// EvaluateAlerts evaluates this query's alerting rules against its results,
+// returning an alert for each rule breached. Only the results of selection
+// queries can be evaluated.
+func (q *Query) EvaluateAlerts() ([]QueryAlert, error) {
+	rules, err := q.AlertRules()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]QueryAlert, 0)
+	if len(rules) == 0 {
+		return out, nil
+	}
+
+	if !q.HasObservationResults() {
+		return nil, PTOErrorf("alert rules can only be evaluated on selection queries").StatusIs(http.StatusBadRequest)
+	}
+
+	stats, err := q.scanResultStats()
+	if err != nil {
+		return nil, err
+	}
+
+	link, _ := q.qc.config.LinkTo("query/" + q.Identifier)
+
+	for i := range rules {
+		value := rules[i].value(stats)
+		if rules[i].breached(value) {
+			out = append(out, QueryAlert{
+				Query: link,
+				Rule:  rules[i].String(),
+				Value: value,
+				Time:  q.Completed,
+			})
+		}
+	}
+
+	return out, nil
+}
+
+// notifyAlerts evaluates this query's alerting rules, and queues each alert
+// for delivery as JSON to the configured alert URL. Failed deliveries are
+// retried by the delivery queue.
+func (q *Query) notifyAlerts() {
+	alerts, err := q.EvaluateAlerts()
+	if err != nil {
+		log.Printf("error evaluating alert rules for query %s: %v", q.Identifier, err)
+		return
+	}
+
+	for i := range alerts {
+		alert := &alerts[i]
+		log.Printf("query %s breached alert rule %s with value %g", q.Identifier, alert.Rule, alert.Value)
+
+		if q.qc.config.AlertURL == "" {
+			continue
+		}
+
+		dq, err := q.qc.config.DeliveryQueue()
+		if err != nil {
+			log.Printf("error opening delivery queue for alert for query %s: %v", q.Identifier, err)
+			return
+		}
+
+		if err := dq.Enqueue(q.qc.config.AlertURL, "alert for query "+q.Identifier, alert); err != nil {
+			log.Printf("error queueing alert for query %s to %s: %v", q.Identifier, q.qc.config.AlertURL, err)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package pto3
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Condition aliases map alternative names to conditions, so that conditions
+// can be renamed, e.g. after a change of naming convention, without breaking
+// queries or analyzers using the old name. An alias may be used wherever a
+// condition name is: queries by either name select the same observations,
+// sets declaring an alias declare its condition instead, and observations
+// uploaded with an alias are stored under its condition. Renaming a condition
+// leaves its old name behind as an alias, and every rename and merge is
+// recorded, so that the names a condition was known by can be traced.
+
+// ConditionAlias maps an alternative name to a condition.
+type ConditionAlias struct {
+	// Alternative name
+	Alias string `json:"alias"`
+	// Name of the condition the alias stands for
+	Condition string `json:"condition"`
+}
+
+// ConditionRename records a change of the name of a condition.
+type ConditionRename struct {
+	// Name before the rename, now an alias
+	OldName string `json:"old_name"`
+	// Name of the condition after the rename
+	NewName string `json:"new_name"`
+	// True if the condition was merged into an existing condition of the new
+	// name, false if it was renamed in place
+	Merged bool `json:"merged"`
+	// Time of the rename
+	Renamed *time.Time `json:"renamed"`
+}
+
+// createConditionAliasTable creates the table mapping aliases to condition
+// IDs.
+func createConditionAliasTable(t *pg.Tx) error {
+	if _, err := t.Exec(`CREATE TABLE IF NOT EXISTS condition_aliases (
+		alias text PRIMARY KEY,
+		condition_id integer NOT NULL REFERENCES conditions (id) ON DELETE CASCADE)`); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// createConditionRenameTable creates the table recording the history of
+// condition renames.
+func createConditionRenameTable(t *pg.Tx) error {
+	if _, err := t.Exec(`CREATE TABLE IF NOT EXISTS condition_renames (
+		id serial PRIMARY KEY,
+		old_name text NOT NULL,
+		new_name text NOT NULL,
+		merged boolean NOT NULL,
+		renamed timestamptz NOT NULL DEFAULT now())`); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// recordConditionRename adds a rename to the history of condition renames.
+func recordConditionRename(db orm.DB, oldName string, newName string, merged bool) error {
+	if _, err := db.Exec("INSERT INTO condition_renames (old_name, new_name, merged) VALUES (?, ?, ?)",
+		oldName, newName, merged); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// ListConditionRenames returns the history of condition renames, oldest
+// first. If a condition name is given, only renames from or to that name are
+// returned, together with the renames of the names it was known by earlier
+// and later.
+func ListConditionRenames(db orm.DB, name string) ([]ConditionRename, error) {
+	var renames []ConditionRename
+	if _, err := db.Query(&renames, `SELECT old_name, new_name, merged, renamed
+		FROM condition_renames ORDER BY renamed, id`); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	if name == "" {
+		return renames, nil
+	}
+
+	// follow the chain of names in both directions
+	names := map[string]bool{name: true}
+	for grown := true; grown; {
+		grown = false
+		for _, cr := range renames {
+			if names[cr.OldName] != names[cr.NewName] {
+				names[cr.OldName] = true
+				names[cr.NewName] = true
+				grown = true
+			}
+		}
+	}
+
+	out := make([]ConditionRename, 0)
+	for _, cr := range renames {
+		if names[cr.OldName] {
+			out = append(out, cr)
+		}
+	}
+	return out, nil
+}
+
+// LoadConditionAliases returns the names of the conditions aliased, by alias.
+func LoadConditionAliases(db orm.DB) (map[string]string, error) {
+	var aliases []ConditionAlias
+	if _, err := db.Query(&aliases, `SELECT condition_aliases.alias, conditions.name AS condition
+		FROM condition_aliases JOIN conditions ON conditions.id = condition_aliases.condition_id`); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	out := make(map[string]string)
+	for _, ca := range aliases {
+		out[ca.Alias] = ca.Condition
+	}
+	return out, nil
+}
+
+// ListConditionAliases returns all condition aliases, sorted by alias.
+func ListConditionAliases(db orm.DB) ([]ConditionAlias, error) {
+	aliases, err := LoadConditionAliases(db)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]ConditionAlias, 0, len(aliases))
+	for alias, condition := range aliases {
+		out = append(out, ConditionAlias{Alias: alias, Condition: condition})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Alias < out[j].Alias })
+	return out, nil
+}
+
+// resolveConditionAlias returns the condition a name is an alias for, or the
+// name itself if it is not an alias.
+func resolveConditionAlias(db orm.DB, name string) (*Condition, error) {
+	c := Condition{Name: name}
+	if _, err := db.QueryOne(pg.Scan(&c.ID, &c.Name), `SELECT conditions.id, conditions.name
+		FROM condition_aliases JOIN conditions ON conditions.id = condition_aliases.condition_id
+		WHERE condition_aliases.alias = ?`, name); err != nil && err != pg.ErrNoRows {
+		return nil, PTOWrapError(err)
+	}
+	return NewConditionWithID(c.ID, c.Name), nil
+}
+
+// AliasCondition makes a name an alias for a condition, replacing any alias
+// of that name. The condition may be given by name or alias. If a condition
+// of the alias name exists, it is merged into the condition: its
+// observations, the sets declaring it, and its aliases are moved to the
+// condition, and it is removed. As merging would change the data of sealed
+// sets, which may have been archived, it returns a conflict error naming them
+// if the condition of the alias name appears in any sealed set. It returns
+// the number of observations moved. It should be run in a transaction.
+func AliasCondition(db orm.DB, alias string, condition string) (int, error) {
+	target, err := resolveConditionAlias(db, condition)
+	if err != nil {
+		return 0, err
+	}
+	if target.ID == 0 {
+		if _, err := db.QueryOne(pg.Scan(&target.ID), "SELECT id FROM conditions WHERE name = ?", target.Name); err == pg.ErrNoRows {
+			return 0, PTOErrorf("unknown condition %s", condition).StatusIs(http.StatusBadRequest)
+		} else if err != nil {
+			return 0, PTOWrapError(err)
+		}
+	}
+
+	if alias == "" || IsConditionWildcard(alias) {
+		return 0, PTOErrorf("bad condition alias %q", alias).StatusIs(http.StatusBadRequest)
+	}
+	if alias == target.Name {
+		return 0, PTOErrorf("condition %s cannot be an alias for itself", alias).StatusIs(http.StatusBadRequest)
+	}
+
+	// merge a condition of the alias name into the target
+	moved := 0
+	var aliasID int
+	if _, err := db.QueryOne(pg.Scan(&aliasID), "SELECT id FROM conditions WHERE name = ?", alias); err != nil && err != pg.ErrNoRows {
+		return 0, PTOWrapError(err)
+	}
+
+	if aliasID != 0 {
+		if err := checkNoSealedSetsWithCondition(db, alias, aliasID); err != nil {
+			return 0, err
+		}
+
+		if err := recordConditionRename(db, alias, target.Name, true); err != nil {
+			return 0, err
+		}
+
+		res, err := db.Exec("UPDATE observations SET condition_id = ? WHERE condition_id = ?", target.ID, aliasID)
+		if err != nil {
+			return 0, PTOWrapError(err)
+		}
+		moved = res.RowsAffected()
+
+		if err := mergeConditionRollups(db, aliasID, target.ID); err != nil {
+			return 0, err
+		}
+
+		if _, err := db.Exec(`INSERT INTO observation_set_conditions (observation_set_id, condition_id)
+			SELECT DISTINCT observation_set_id, ? FROM observation_set_conditions
+			WHERE condition_id = ? AND observation_set_id NOT IN
+				(SELECT observation_set_id FROM observation_set_conditions WHERE condition_id = ?)`,
+			target.ID, aliasID, target.ID); err != nil {
+			return 0, PTOWrapError(err)
+		}
+
+		// cached statistics count observations by condition name
+		if _, err := db.Exec(`UPDATE observation_sets SET stats = NULL WHERE id IN
+			(SELECT observation_set_id FROM observation_set_conditions WHERE condition_id = ?)`, aliasID); err != nil {
+			return 0, PTOWrapError(err)
+		}
+
+		for _, stmt := range []string{
+			"DELETE FROM observation_set_conditions WHERE condition_id = ?1",
+			"UPDATE condition_aliases SET condition_id = ?0 WHERE condition_id = ?1",
+			"DELETE FROM conditions WHERE id = ?1",
+		} {
+			if _, err := db.Exec(stmt, target.ID, aliasID); err != nil {
+				return 0, PTOWrapError(err)
+			}
+		}
+	}
+
+	if _, err := db.Exec(`INSERT INTO condition_aliases (alias, condition_id) VALUES (?, ?)
+		ON CONFLICT (alias) DO UPDATE SET condition_id = EXCLUDED.condition_id`, alias, target.ID); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	return moved, nil
+}
+
+// checkNoSealedSetsWithCondition returns a conflict error naming the sealed
+// observation sets declaring a condition, if there are any.
+func checkNoSealedSetsWithCondition(db orm.DB, name string, cid int) error {
+	var setIDs []int
+	if _, err := db.Query(&setIDs, `SELECT observation_sets.id FROM observation_sets
+		JOIN observation_set_conditions ON observation_set_conditions.observation_set_id = observation_sets.id
+		WHERE observation_set_conditions.condition_id = ? AND observation_sets.sealed IS NOT NULL
+		ORDER BY observation_sets.id`, cid); err != nil {
+		return PTOWrapError(err)
+	}
+	if len(setIDs) == 0 {
+		return nil
+	}
+
+	setNames := make([]string, len(setIDs))
+	for i, id := range setIDs {
+		setNames[i] = fmt.Sprintf("%x", id)
+	}
+	return PTOErrorf("condition %s can't be merged, as it appears in sealed observation sets %s",
+		name, strings.Join(setNames, ", ")).StatusIs(http.StatusConflict)
+}
+
+// RemoveConditionAlias removes a condition alias. Observations merged into
+// the condition when the alias was created are not moved back. It returns a
+// not found error if there is no such alias.
+func RemoveConditionAlias(db orm.DB, alias string) error {
+	res, err := db.Exec("DELETE FROM condition_aliases WHERE alias = ?", alias)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if res.RowsAffected() == 0 {
+		return PTONotFoundError("condition alias", alias)
+	}
+	return nil
+}
+
+// RenameCondition renames a condition, given by name or alias, and makes its
+// old name an alias for it, so that queries and analyzers using the old name
+// keep working. If a condition of the new name exists, or the new name is an
+// alias for another condition, the condition is merged into that condition
+// as by AliasCondition. The rename is recorded in the history of condition
+// renames. It returns the number of observations moved by a merge. It should
+// be run in a transaction.
+func RenameCondition(db orm.DB, from string, to string) (int, error) {
+	source, err := resolveConditionAlias(db, from)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.QueryOne(pg.Scan(&source.ID), "SELECT id FROM conditions WHERE name = ?", source.Name); err == pg.ErrNoRows {
+		return 0, PTOErrorf("unknown condition %s", from).StatusIs(http.StatusBadRequest)
+	} else if err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	if to == "" || IsConditionWildcard(to) {
+		return 0, PTOErrorf("bad condition name %q", to).StatusIs(http.StatusBadRequest)
+	}
+	if to == source.Name {
+		return 0, PTOErrorf("condition %s already has that name", to).StatusIs(http.StatusBadRequest)
+	}
+
+	target, err := resolveConditionAlias(db, to)
+	if err != nil {
+		return 0, err
+	}
+	if target.ID == 0 {
+		if _, err := db.QueryOne(pg.Scan(&target.ID), "SELECT id FROM conditions WHERE name = ?", target.Name); err != nil && err != pg.ErrNoRows {
+			return 0, PTOWrapError(err)
+		}
+	}
+
+	switch target.ID {
+	case 0:
+		// rename in place
+	case source.ID:
+		// renaming back to an earlier name, which stops being an alias
+		if _, err := db.Exec("DELETE FROM condition_aliases WHERE alias = ?", to); err != nil {
+			return 0, PTOWrapError(err)
+		}
+	default:
+		return AliasCondition(db, source.Name, to)
+	}
+
+	renamed := NewConditionWithID(source.ID, to)
+	if _, err := db.Exec("UPDATE conditions SET name = ?, feature = ?, aspect = ? WHERE id = ?",
+		renamed.Name, renamed.Feature, renamed.Aspect, renamed.ID); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	if _, err := db.Exec(`INSERT INTO condition_aliases (alias, condition_id) VALUES (?, ?)
+		ON CONFLICT (alias) DO UPDATE SET condition_id = EXCLUDED.condition_id`, source.Name, source.ID); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	// cached statistics count observations by condition name
+	if _, err := db.Exec(`UPDATE observation_sets SET stats = NULL WHERE id IN
+		(SELECT observation_set_id FROM observation_set_conditions WHERE condition_id = ?)`, source.ID); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	// the registry entry follows the condition, unless the new name has one
+	if _, err := db.Exec(`UPDATE registered_conditions SET name = ?0, modified = now()
+		WHERE name = ?1 AND NOT EXISTS (SELECT 1 FROM registered_conditions WHERE name = ?0)`,
+		renamed.Name, source.Name); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	return 0, recordConditionRename(db, source.Name, renamed.Name, false)
+}
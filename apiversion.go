@@ -0,0 +1,80 @@
+package pto3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The PTO API is versioned by path: every resource is served under a prefix
+// naming a version of the API, e.g. /v1/obs, and links generated by LinkTo
+// and LinkVia carry the current version. A new version is only introduced
+// for breaking changes to the API, the observation file format, or metadata
+// conventions. ptosrv serves every version in APIVersions side by side, and
+// handlers find the version a request was made to with
+// papi.APIVersionForRequest, so that clients written against an older
+// version keep working for as long as it is served.
+
+// APIVersion is the current version of the API, used in generated links.
+const APIVersion = 1
+
+// LegacyAPIVersion is the version of the API served at unversioned paths
+// before paths were versioned, to which requests to unversioned paths are
+// redirected.
+const LegacyAPIVersion = 1
+
+// APIVersions lists the versions of the API served, oldest first.
+var APIVersions = []int{1}
+
+// APIVersionPrefix returns the path segment naming a version of the API,
+// e.g. v1.
+func APIVersionPrefix(version int) string {
+	return fmt.Sprintf("v%d", version)
+}
+
+// ParseAPIVersionPrefix returns the version of the API named by a path
+// segment, and false if the segment does not name a version.
+func ParseAPIVersionPrefix(segment string) (int, bool) {
+	if !strings.HasPrefix(segment, "v") || len(segment) < 2 || segment[1] == '0' {
+		return 0, false
+	}
+
+	version, err := strconv.Atoi(segment[1:])
+	if err != nil || version < 1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// APIVersionSupported returns true if the given version of the API is
+// served.
+func APIVersionSupported(version int) bool {
+	for _, v := range APIVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// SplitAPIVersion splits a path relative to the root of the server into the
+// version of the API it names and the path relative to the root of that
+// version, which always starts with /. It returns false if the path does not
+// start with a version prefix, whether or not the version is supported.
+func SplitAPIVersion(path string) (int, string, bool) {
+	trimmed := strings.TrimPrefix(path, "/")
+	segment, rest := trimmed, ""
+	if i := strings.IndexByte(trimmed, '/'); i >= 0 {
+		segment, rest = trimmed[:i], trimmed[i:]
+	}
+
+	version, ok := ParseAPIVersionPrefix(segment)
+	if !ok {
+		return 0, path, false
+	}
+
+	if rest == "" {
+		rest = "/"
+	}
+	return version, rest, true
+}
@@ -0,0 +1,589 @@
+package pto3
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// A sealed observation set can be archived to the raw data store as a bundle:
+// an observation set file holding its metadata and all its observations,
+// with file metadata recording where it came from. Once archived, the set's
+// observations can be trimmed from the observation database to save space.
+// A trimmed set keeps its metadata, and its data is served from the bundle.
+
+// ObsBundleFiletype is the raw data filetype of observation set bundles.
+const ObsBundleFiletype = "obs-bundle-ndjson"
+
+// ObsBundleContentType is the content type of observation set bundles, that
+// of observation set files, unless configured otherwise.
+const ObsBundleContentType = "application/vnd.mami.ndjson"
+
+// Keys of the raw metadata of an observation set bundle, recording its
+// provenance.
+const (
+	// Link to the archived set
+	ArchivedSetMetadataKey = "_archived_set"
+	// UUID of the archived set
+	ArchivedUUIDMetadataKey = "_archived_uuid"
+	// Analyzer which produced the archived set
+	ArchivedAnalyzerMetadataKey = "_archived_analyzer"
+	// Sources of the archived set, separated by spaces
+	ArchivedSourcesMetadataKey = "_archived_sources"
+	// Number of observations in the bundle
+	ArchivedCountMetadataKey = "_archived_count"
+	// SHA-256 digest of the bundle, as a hex string
+	ArchivedSHA256MetadataKey = "_archived_sha256"
+	// Time the set was archived
+	ArchivedTimeMetadataKey = "_archived"
+)
+
+// ObservationSetArchive records the bundle an observation set was archived
+// to in the raw data store.
+type ObservationSetArchive struct {
+	SetID int `sql:",pk" json:"-"`
+	// Campaign holding the bundle
+	Campaign string `json:"campaign"`
+	// Name of the bundle file in the campaign
+	File string `json:"file"`
+	// Link to the bundle's metadata in the raw data store
+	Link string `sql:"-" json:"link,omitempty"`
+	// Number of observations in the bundle
+	Count int `json:"count"`
+	// SHA-256 digest of the bundle, as a hex string
+	SHA256 string `sql:"sha256" json:"sha256"`
+	// Time the set was archived
+	Archived *time.Time `json:"archived"`
+	// Time the set's observations were trimmed from the observation
+	// database, if they were
+	Trimmed *time.Time `json:"trimmed,omitempty"`
+}
+
+// createObservationSetArchiveTable creates the table recording the bundles
+// observation sets were archived to.
+func createObservationSetArchiveTable(t *pg.Tx) error {
+	if _, err := t.Exec(`CREATE TABLE IF NOT EXISTS observation_set_archives (
+		set_id bigint PRIMARY KEY REFERENCES observation_sets (id) ON DELETE CASCADE,
+		campaign text NOT NULL,
+		file text NOT NULL,
+		count bigint NOT NULL,
+		sha256 text NOT NULL,
+		archived timestamptz NOT NULL,
+		trimmed timestamptz)`); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// LinkVia fills in the link to this archive's bundle, given a configuration.
+func (arc *ObservationSetArchive) LinkVia(config *PTOConfiguration) {
+	arc.Link, _ = config.LinkTo(fmt.Sprintf("raw/%s/%s", arc.Campaign, arc.File))
+}
+
+// DataLink returns the link to the data of this archive's bundle, which must
+// have been linked with LinkVia.
+func (arc *ObservationSetArchive) DataLink() string {
+	if arc.Link == "" {
+		return ""
+	}
+	return arc.Link + "/data"
+}
+
+// Archive returns the record of the bundle this observation set was archived
+// to, or nil if it was not archived.
+func (set *ObservationSet) Archive(db orm.DB) (*ObservationSetArchive, error) {
+	var arc ObservationSetArchive
+	if _, err := db.QueryOne(&arc, `SELECT set_id, campaign, file, count, sha256, archived, trimmed
+		FROM observation_set_archives WHERE set_id = ?`, set.ID); err == pg.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return &arc, nil
+}
+
+// ObsBundleFilename returns the default name of the bundle an observation
+// set is archived to.
+func ObsBundleFilename(setid int) string {
+	return fmt.Sprintf("obs-%x.ndjson", setid)
+}
+
+// ArchiveToRawStore writes this sealed observation set as a bundle to the
+// given campaign in the raw data store, with the given filename, or
+// ObsBundleFilename if empty, and records the archive. It returns an error
+// with status 409 if the set is not sealed or is already archived, and with
+// status 404 if the campaign does not exist. If writing the bundle fails, the
+// set is left unarchived.
+func (set *ObservationSet) ArchiveToRawStore(db *pg.DB, config *PTOConfiguration, rds *RawDataStore, campaign string, filename string) (*ObservationSetArchive, error) {
+	if err := set.SelectByID(db); err == pg.ErrNoRows {
+		return nil, PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	set.LinkVia(config)
+
+	if set.Sealed == nil {
+		return nil, PTOErrorf("observation set %x must be sealed to be archived", set.ID).StatusIs(http.StatusConflict)
+	}
+	if arc, err := set.Archive(db); err != nil {
+		return nil, err
+	} else if arc != nil {
+		return nil, PTOErrorf("observation set %x is already archived to %s/%s", set.ID, arc.Campaign, arc.File).StatusIs(http.StatusConflict)
+	}
+
+	cam, err := rds.CampaignForName(campaign)
+	if err != nil {
+		return nil, err
+	}
+
+	if filename == "" {
+		filename = ObsBundleFilename(set.ID)
+	}
+
+	count, err := set.CountObservations(db)
+	if err != nil {
+		return nil, err
+	}
+	timeStart, timeEnd, err := set.TimeInterval(db)
+	if err != nil {
+		return nil, err
+	}
+	if timeStart == nil || timeEnd == nil {
+		return nil, PTOErrorf("observation set %x has no observations to archive", set.ID).StatusIs(http.StatusConflict)
+	}
+
+	now := time.Now().UTC()
+	arc := ObservationSetArchive{
+		SetID:    set.ID,
+		Campaign: campaign,
+		File:     filename,
+		Count:    count,
+		Archived: &now,
+	}
+
+	// the bundle's metadata must exist before its data can be written
+	md, err := set.bundleMetadata(&arc, timeStart, timeEnd)
+	if err != nil {
+		return nil, err
+	}
+	if err := cam.PutFileMetadata(filename, md); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	digest := sha256.New()
+	go func() {
+		pw.CloseWithError(set.CopyFileToStream(db, io.MultiWriter(pw, digest)))
+	}()
+	if err := cam.WriteFileDataFromStream(filename, false, pr); err != nil {
+		pr.CloseWithError(err)
+		return nil, err
+	}
+	arc.SHA256 = hex.EncodeToString(digest.Sum(nil))
+
+	// record the digest with the bundle and the set
+	if md, err = set.bundleMetadata(&arc, timeStart, timeEnd); err != nil {
+		return nil, err
+	}
+	if err := cam.PutFileMetadata(filename, md); err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(`INSERT INTO observation_set_archives (set_id, campaign, file, count, sha256, archived)
+		VALUES (?, ?, ?, ?, ?, ?)`, arc.SetID, arc.Campaign, arc.File, arc.Count, arc.SHA256, arc.Archived); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	arc.LinkVia(config)
+	return &arc, nil
+}
+
+// bundleMetadata returns the raw metadata of the bundle this observation set
+// is archived to.
+func (set *ObservationSet) bundleMetadata(arc *ObservationSetArchive, timeStart *time.Time, timeEnd *time.Time) (*RawMetadata, error) {
+	jmap := map[string]string{
+		"_file_type":                ObsBundleFiletype,
+		"_time_start":               timeStart.UTC().Format(time.RFC3339),
+		"_time_end":                 timeEnd.UTC().Format(time.RFC3339),
+		ArchivedSetMetadataKey:      set.Link(),
+		ArchivedAnalyzerMetadataKey: set.Analyzer,
+		ArchivedSourcesMetadataKey:  strings.Join(set.Sources, " "),
+		ArchivedCountMetadataKey:    strconv.Itoa(arc.Count),
+		ArchivedTimeMetadataKey:     arc.Archived.Format(time.RFC3339),
+	}
+	if uuid := set.UUID(); uuid != "" {
+		jmap[ArchivedUUIDMetadataKey] = uuid
+	}
+	if arc.SHA256 != "" {
+		jmap[ArchivedSHA256MetadataKey] = arc.SHA256
+	}
+
+	b, err := json.Marshal(jmap)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return RawMetadataFromReader(bytes.NewReader(b), nil)
+}
+
+// TrimArchived removes the observations of this archived observation set
+// from the observation database, in batches as for DeleteInBatches, keeping
+// the set's metadata, count, and time interval. Its data is then only
+// available from its bundle, and queries no longer see its observations. It
+// returns an error with status 409 if the set is not archived or is already
+// trimmed.
+func (set *ObservationSet) TrimArchived(db *pg.DB, opts *ObsDatabaseOptions, progress func(deleted int, total int)) (*ObservationSetArchive, error) {
+	arc, err := set.Archive(db)
+	if err != nil {
+		return nil, err
+	}
+	if arc == nil {
+		return nil, PTOErrorf("observation set %x must be archived to be trimmed", set.ID).StatusIs(http.StatusConflict)
+	}
+	if arc.Trimmed != nil {
+		return nil, PTOErrorf("observation set %x is already trimmed", set.ID).StatusIs(http.StatusConflict)
+	}
+
+	// cache the count and time interval, which can no longer be computed
+	if _, err := set.CountObservations(db); err != nil {
+		return nil, err
+	}
+	if _, _, err := set.TimeInterval(db); err != nil {
+		return nil, err
+	}
+
+	// mark the set trimmed first, so that its data is served from the bundle
+	// while its observations are deleted
+	now := time.Now().UTC()
+	if _, err := db.Exec("UPDATE observation_set_archives SET trimmed = ? WHERE set_id = ?", now, set.ID); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	arc.Trimmed = &now
+
+	if err := set.deleteObservationsInBatches(db, opts, arc.Count, progress); err != nil {
+		return nil, err
+	}
+
+	if err := set.refreshRollup(db); err != nil {
+		return nil, err
+	}
+
+	return arc, nil
+}
+
+// bundleReader reads the observations in an observation set bundle, while
+// computing its digest, so that it can be checked against the archive record
+// once the whole bundle has been read.
+type bundleReader struct {
+	*ObservationReader
+	arc    *ObservationSetArchive
+	in     io.ReadCloser
+	digest hash.Hash
+}
+
+// openBundle opens the bundle this archive record refers to in the given raw
+// data store, and reads its metadata, returning an error if it does not hold
+// the given set.
+func (arc *ObservationSetArchive) openBundle(rds *RawDataStore, set *ObservationSet, opts *ObsDatabaseOptions) (*bundleReader, error) {
+	cam, err := rds.CampaignForName(arc.Campaign)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := cam.ReadFileData(arc.File)
+	if err != nil {
+		return nil, err
+	}
+
+	br := &bundleReader{arc: arc, in: in, digest: sha256.New()}
+	br.ObservationReader = NewObservationReader(io.TeeReader(in, br.digest))
+	br.SetLoadOptions(opts)
+
+	md, err := br.ReadMetadata()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	if md.UUID() != set.UUID() {
+		in.Close()
+		return nil, PTOErrorf("bundle %s/%s holds observation set %s, not %s", arc.Campaign, arc.File, md.UUID(), set.UUID()).StatusIs(http.StatusConflict)
+	}
+
+	return br, nil
+}
+
+// verifyDigest returns an error if the digest of the bundle read so far is
+// not the one recorded when it was archived. It is called once the whole
+// bundle has been read.
+func (br *bundleReader) verifyDigest() error {
+	if sum := hex.EncodeToString(br.digest.Sum(nil)); sum != br.arc.SHA256 {
+		return PTOErrorf("bundle %s/%s has digest %s, not %s as archived", br.arc.Campaign, br.arc.File, sum, br.arc.SHA256).StatusIs(http.StatusConflict)
+	}
+	return nil
+}
+
+// Close closes the bundle file.
+func (br *bundleReader) Close() error {
+	return br.in.Close()
+}
+
+// RehydrateFromRawStore loads the observations of this trimmed observation
+// set back into the observation database from its bundle in the raw data
+// store, so that queries see them again. The set keeps its ID, UUID, and
+// metadata. The bundle must hold the set, with the UUID, number of
+// observations, and digest recorded when it was archived; otherwise nothing
+// is loaded. It returns an error with status 409 if the set is not archived
+// or not trimmed, including if it was rehydrated concurrently.
+func (set *ObservationSet) RehydrateFromRawStore(db *pg.DB, config *PTOConfiguration, rds *RawDataStore) (*ObservationSetArchive, error) {
+	if err := set.SelectByID(db); err == pg.ErrNoRows {
+		return nil, PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	set.LinkVia(config)
+
+	arc, err := set.Archive(db)
+	if err != nil {
+		return nil, err
+	}
+	if arc == nil {
+		return nil, PTOErrorf("observation set %x is not archived", set.ID).StatusIs(http.StatusConflict)
+	}
+	if arc.Trimmed == nil {
+		return nil, PTOErrorf("observation set %x is not trimmed", set.ID).StatusIs(http.StatusConflict)
+	}
+
+	br, err := arc.openBundle(rds, set, &config.ObsDatabase)
+	if err != nil {
+		return nil, err
+	}
+	defer br.Close()
+
+	cidCache, err := LoadConditionCache(db)
+	if err != nil {
+		return nil, err
+	}
+	pidCache := make(PathCache)
+
+	if _, err := set.loadDataFromReader(db, br.ObservationReader, cidCache, pidCache, false, func(t *pg.Tx) error {
+		if err := br.verifyDigest(); err != nil {
+			return err
+		}
+
+		var count int
+		if _, err := t.QueryOne(pg.Scan(&count), "SELECT count(*) FROM observations WHERE set_id = ?", set.ID); err != nil {
+			return PTOWrapError(err)
+		}
+		if count != arc.Count {
+			return PTOErrorf("observation set %x has %d observations after rehydration, not %d as archived", set.ID, count, arc.Count).StatusIs(http.StatusConflict)
+		}
+
+		// the row lock taken here makes concurrent rehydrations of the same
+		// set wait, then fail, rather than load its observations twice
+		res, err := t.Exec("UPDATE observation_set_archives SET trimmed = NULL WHERE set_id = ? AND trimmed IS NOT NULL", set.ID)
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		if res.RowsAffected() != 1 {
+			return PTOErrorf("observation set %x was rehydrated concurrently", set.ID).StatusIs(http.StatusConflict)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	arc.Trimmed = nil
+	arc.LinkVia(config)
+	return arc, nil
+}
+
+// RehydrateArchivedSets rehydrates every trimmed observation set which
+// observations in the given time range may belong to, restricted to the
+// given set IDs if any are given, as RehydrateFromRawStore. It returns the
+// IDs of the sets rehydrated. Sets rehydrated concurrently are skipped.
+func RehydrateArchivedSets(db *pg.DB, config *PTOConfiguration, rds *RawDataStore, start *time.Time, end *time.Time, setIDs []int) ([]int, error) {
+	trimmed, err := trimmedSetsInRange(db, start, end, setIDs, false)
+	if err != nil {
+		return nil, err
+	}
+
+	rehydrated := make([]int, 0, len(trimmed))
+	for _, setid := range trimmed {
+		set := ObservationSet{ID: setid}
+		if _, err := set.RehydrateFromRawStore(db, config, rds); err != nil {
+			if perr, ok := err.(*PTOError); ok && perr.Status() == http.StatusConflict {
+				if arc, aerr := set.Archive(db); aerr == nil && arc != nil && arc.Trimmed == nil {
+					continue
+				}
+			}
+			return rehydrated, err
+		}
+		rehydrated = append(rehydrated, setid)
+	}
+
+	return rehydrated, nil
+}
+
+// trimmedSetsInRange returns the IDs of the trimmed observation sets which
+// observations in the given time range may belong to, restricted to the
+// given set IDs if any are given. If lock is set, it locks their archive
+// records against rehydration until the end of the transaction.
+func trimmedSetsInRange(db orm.DB, start *time.Time, end *time.Time, setIDs []int, lock bool) ([]int, error) {
+	sql := `SELECT a.set_id FROM observation_set_archives AS a
+		JOIN observation_sets AS s ON s.id = a.set_id
+		WHERE a.trimmed IS NOT NULL AND s.time_end >= ? AND s.time_start <= ?`
+	params := []interface{}{start, end}
+	if len(setIDs) > 0 {
+		sql += " AND a.set_id IN (?)"
+		params = append(params, pg.In(setIDs))
+	}
+	sql += " ORDER BY a.set_id"
+	if lock {
+		sql += " FOR SHARE OF a"
+	}
+
+	var trimmed []int
+	if _, err := db.Query(&trimmed, sql, params...); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return trimmed, nil
+}
+
+// ScanArchivedSets streams the observations of every trimmed observation set
+// which observations in the given time range may belong to, restricted to
+// the given set IDs if any are given, from their bundles in the raw data
+// store into the given table, which has the columns of the observations
+// table, as part of the given transaction. Paths only in the bundles are
+// added to the paths table. The sets' archive records stay locked against
+// rehydration until the end of the transaction. It returns the IDs of the
+// sets scanned.
+func ScanArchivedSets(t *pg.Tx, config *PTOConfiguration, rds *RawDataStore, table string, start *time.Time, end *time.Time, setIDs []int) ([]int, error) {
+	trimmed, err := trimmedSetsInRange(t, start, end, setIDs, true)
+	if err != nil || len(trimmed) == 0 {
+		return trimmed, err
+	}
+
+	cidCache, err := LoadConditionCache(t)
+	if err != nil {
+		return nil, err
+	}
+	pidCache := make(PathCache)
+
+	aliases, err := LoadConditionAliases(t)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, setid := range trimmed {
+		set := ObservationSet{ID: setid}
+		if err := set.SelectByID(t); err != nil {
+			return nil, PTOWrapError(err)
+		}
+
+		arc, err := set.Archive(t)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := set.scanBundle(t, config, rds, arc, table, cidCache, pidCache, aliases); err != nil {
+			return nil, err
+		}
+	}
+
+	return trimmed, nil
+}
+
+// scanBundle streams the observations in this set's bundle into the given
+// table as part of the given transaction, for ScanArchivedSets, returning an
+// error if the bundle does not match its archive record.
+func (set *ObservationSet) scanBundle(
+	t *pg.Tx,
+	config *PTOConfiguration,
+	rds *RawDataStore,
+	arc *ObservationSetArchive,
+	table string,
+	cidCache ConditionCache,
+	pidCache PathCache,
+	aliases map[string]string) error {
+
+	if err := cidCache.FillConditionIDsInSet(t, set); err != nil {
+		return err
+	}
+
+	conditionDeclared := make(map[string]struct{})
+	for _, c := range set.Conditions {
+		conditionDeclared[c.Name] = struct{}{}
+	}
+
+	br, err := arc.openBundle(rds, set, &config.ObsDatabase)
+	if err != nil {
+		return err
+	}
+	defer br.Close()
+
+	batchSize := config.ObsDatabase.batchSize()
+	batch := make([]*Observation, 0, batchSize)
+	pathSet := make(map[string]struct{})
+	count := 0
+
+	flush := func() error {
+		if err := pidCache.CacheNewPaths(t, pathSet); err != nil {
+			return err
+		}
+		if err := set.streamObservationBatch(t, table, cidCache, pidCache, batch); err != nil {
+			return err
+		}
+		count += len(batch)
+		batch = batch[:0]
+		pathSet = make(map[string]struct{})
+		return nil
+	}
+
+	for {
+		obs, err := br.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if aliased, ok := aliases[obs.Condition.Name]; ok {
+			obs.Condition = NewCondition(aliased)
+		}
+		if _, ok := conditionDeclared[obs.Condition.Name]; !ok {
+			return PTOErrorf("observation at line %d of bundle %s/%s has condition %s not declared in set", br.Line(), arc.Campaign, arc.File, obs.Condition.Name).StatusIs(http.StatusConflict)
+		}
+
+		batch = append(batch, obs)
+		pathSet[obs.Path.String] = struct{}{}
+		if len(batch) == batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := br.verifyDigest(); err != nil {
+		return err
+	}
+	if count != arc.Count {
+		return PTOErrorf("bundle %s/%s holds %d observations, not %d as archived", arc.Campaign, arc.File, count, arc.Count).StatusIs(http.StatusConflict)
+	}
+	return nil
+}
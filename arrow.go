@@ -0,0 +1,283 @@
+package pto3
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// The Arrow IPC streaming format lets analytical tools (pyarrow, pandas,
+// polars, DuckDB, R's arrow package) read observations directly into
+// columnar memory, without parsing JSON or CSV. A stream is a schema message
+// followed by record batch messages, each holding a batch of rows as one
+// buffer per column, and an end-of-stream marker. Message metadata is a
+// FlatBuffer, as described in the Arrow columnar format specification.
+
+// Identifiers from the Arrow format's Message.fbs and Schema.fbs
+const (
+	arrowMetadataV5        = 4
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+	arrowTypeUtf8          = 5
+	arrowTypeTimestamp     = 10
+	arrowTimeUnitSecond    = 0
+	arrowEndianLittle      = 0
+)
+
+// arrowBatchRows is the largest number of observations in a record batch.
+const arrowBatchRows = 65536
+
+// arrowBatchBytes is the size of string data in a record batch above which
+// the batch is written, so string offsets fit in 32 bits.
+const arrowBatchBytes = 64 << 20
+
+// arrowContinuation precedes the length of each message in a stream.
+const arrowContinuation = 0xFFFFFFFF
+
+// arrowColumn holds the values of a column in the record batch being built:
+// times as seconds since the epoch, and other fields as UTF-8 strings.
+type arrowColumn struct {
+	field   int
+	times   []int64
+	offsets []int32
+	data    []byte
+}
+
+func (col *arrowColumn) isTime() bool {
+	name := ObservationFields[col.field]
+	return name == "time_start" || name == "time_end"
+}
+
+// arrowEncoder writes observations as an Arrow IPC stream, with columns
+// set_id, path, condition, and value as strings and time_start and time_end
+// as timestamps in seconds, UTC. Strings are formatted as in CSV.
+type arrowEncoder struct {
+	out         io.Writer
+	columns     []*arrowColumn
+	rows        int
+	wroteSchema bool
+}
+
+// NewArrowEncoder returns an encoder writing the given fields of observations
+// as an Arrow IPC stream.
+func NewArrowEncoder(out io.Writer, fields []int) ObservationEncoder {
+	if fields == nil {
+		fields = make([]int, len(ObservationFields))
+		for i := range fields {
+			fields[i] = i
+		}
+	}
+
+	enc := &arrowEncoder{out: out, columns: make([]*arrowColumn, len(fields))}
+	for i, f := range fields {
+		enc.columns[i] = &arrowColumn{field: f, offsets: []int32{0}}
+	}
+	return enc
+}
+
+// arrowPadding returns the number of bytes needed to pad a length to a
+// multiple of 8, as Arrow requires of buffers and messages.
+func arrowPadding(n int) int {
+	return -n & 7
+}
+
+// writeMessage writes a message with the given FlatBuffer metadata and body.
+func (enc *arrowEncoder) writeMessage(meta []byte, body []byte) error {
+	padding := arrowPadding(len(meta))
+
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[0:], arrowContinuation)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)+padding))
+
+	for _, b := range [][]byte{prefix[:], meta, make([]byte, padding), body} {
+		if _, err := enc.out.Write(b); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+	return nil
+}
+
+// finishArrowMessage builds the Message table around a header, and returns
+// the finished metadata.
+func finishArrowMessage(b *flatBuilder, headerType uint8, header int, bodyLength int) []byte {
+	b.startTable(5)
+	b.addInt64(3, int64(bodyLength))
+	b.addOffset(2, header)
+	b.addInt16(0, arrowMetadataV5)
+	b.addUint8(1, headerType)
+	return b.finish(b.endTable())
+}
+
+// writeSchema writes the schema message, if not yet written.
+func (enc *arrowEncoder) writeSchema() error {
+	if enc.wroteSchema {
+		return nil
+	}
+	enc.wroteSchema = true
+
+	b := newFlatBuilder()
+	fields := make([]int, len(enc.columns))
+	for i, col := range enc.columns {
+		name := b.createString(ObservationFields[col.field])
+
+		var typeType uint8
+		var typ int
+		if col.isTime() {
+			timezone := b.createString("UTC")
+			b.startTable(2)
+			b.addOffset(1, timezone)
+			b.addInt16(0, arrowTimeUnitSecond)
+			typeType, typ = arrowTypeTimestamp, b.endTable()
+		} else {
+			b.startTable(0)
+			typeType, typ = arrowTypeUtf8, b.endTable()
+		}
+
+		b.startVector(4, 0, 4)
+		children := b.endVector(0)
+
+		b.startTable(7)
+		b.addOffset(0, name)
+		b.addOffset(3, typ)
+		b.addOffset(5, children)
+		b.addUint8(1, 0) // not nullable
+		b.addUint8(2, typeType)
+		fields[i] = b.endTable()
+	}
+
+	b.startVector(4, len(fields), 4)
+	for i := len(fields) - 1; i >= 0; i-- {
+		b.prependOffset(fields[i])
+	}
+	fieldVector := b.endVector(len(fields))
+
+	b.startTable(4)
+	b.addOffset(1, fieldVector)
+	b.addInt16(0, arrowEndianLittle)
+	schema := b.endTable()
+
+	return enc.writeMessage(finishArrowMessage(b, arrowHeaderSchema, schema, 0), nil)
+}
+
+// arrowBuffer locates a buffer within the body of a record batch message.
+type arrowBuffer struct {
+	offset int
+	length int
+}
+
+// writeBatch writes the rows encoded so far as a record batch, if there are
+// any, and starts a new batch.
+func (enc *arrowEncoder) writeBatch() error {
+	if enc.rows == 0 {
+		return nil
+	}
+
+	// lay out the body: a validity bitmap, empty as no values are null, then
+	// values for times, or offsets and data for strings
+	var body []byte
+	buffers := make([]arrowBuffer, 0, 3*len(enc.columns))
+	appendBuffer := func(b []byte) {
+		buffers = append(buffers, arrowBuffer{offset: len(body), length: len(b)})
+		body = append(body, b...)
+		body = append(body, make([]byte, arrowPadding(len(b)))...)
+	}
+
+	for _, col := range enc.columns {
+		appendBuffer(nil)
+		if col.isTime() {
+			values := make([]byte, 8*len(col.times))
+			for i, t := range col.times {
+				binary.LittleEndian.PutUint64(values[8*i:], uint64(t))
+			}
+			appendBuffer(values)
+		} else {
+			offsets := make([]byte, 4*len(col.offsets))
+			for i, o := range col.offsets {
+				binary.LittleEndian.PutUint32(offsets[4*i:], uint32(o))
+			}
+			appendBuffer(offsets)
+			appendBuffer(col.data)
+		}
+	}
+
+	b := newFlatBuilder()
+
+	b.startVector(16, len(buffers), 8)
+	for i := len(buffers) - 1; i >= 0; i-- {
+		b.prep(8, 16)
+		b.placeInt64(int64(buffers[i].length))
+		b.placeInt64(int64(buffers[i].offset))
+	}
+	bufferVector := b.endVector(len(buffers))
+
+	// one node per column, giving its length and null count
+	b.startVector(16, len(enc.columns), 8)
+	for range enc.columns {
+		b.prep(8, 16)
+		b.placeInt64(0)
+		b.placeInt64(int64(enc.rows))
+	}
+	nodeVector := b.endVector(len(enc.columns))
+
+	b.startTable(4)
+	b.addInt64(0, int64(enc.rows))
+	b.addOffset(1, nodeVector)
+	b.addOffset(2, bufferVector)
+	batch := b.endTable()
+
+	if err := enc.writeMessage(finishArrowMessage(b, arrowHeaderRecordBatch, batch, len(body)), body); err != nil {
+		return err
+	}
+
+	enc.rows = 0
+	for _, col := range enc.columns {
+		col.times = col.times[:0]
+		col.offsets = col.offsets[:1]
+		col.data = col.data[:0]
+	}
+	return nil
+}
+
+func (enc *arrowEncoder) Encode(obs *Observation) error {
+	if err := enc.writeSchema(); err != nil {
+		return err
+	}
+
+	values := observationFieldValues(obs)
+	batchBytes := 0
+	for _, col := range enc.columns {
+		switch ObservationFields[col.field] {
+		case "time_start":
+			col.times = append(col.times, obs.TimeStart.Unix())
+		case "time_end":
+			col.times = append(col.times, obs.TimeEnd.Unix())
+		default:
+			col.data = append(col.data, values[col.field]...)
+			col.offsets = append(col.offsets, int32(len(col.data)))
+		}
+		if len(col.data) > batchBytes {
+			batchBytes = len(col.data)
+		}
+	}
+	enc.rows++
+
+	if enc.rows >= arrowBatchRows || batchBytes >= arrowBatchBytes {
+		return enc.writeBatch()
+	}
+	return nil
+}
+
+func (enc *arrowEncoder) Close() error {
+	if err := enc.writeSchema(); err != nil {
+		return err
+	}
+	if err := enc.writeBatch(); err != nil {
+		return err
+	}
+
+	var eos [8]byte
+	binary.LittleEndian.PutUint32(eos[0:], arrowContinuation)
+	if _, err := enc.out.Write(eos[:]); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
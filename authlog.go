@@ -0,0 +1,193 @@
+package pto3
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rules by which an authorization decision is made, as recorded in
+// AuthDecision.
+const (
+	// The permission was granted or denied to the API key presented
+	AuthRuleKey = "key"
+	// The permission was granted or denied to the default key, and the key
+	// presented, if any, does not mention it
+	AuthRuleDefault = "default"
+	// Neither the key presented nor the default key mention the permission,
+	// so it was denied
+	AuthRuleNone = "none"
+	// The Authorization header could not be read, so the request was denied
+	AuthRuleMalformed = "malformed"
+)
+
+// AuthDecision records a decision to allow or deny a request a permission,
+// for the authorization decision log.
+type AuthDecision struct {
+	// Time the decision was made
+	Time time.Time `json:"time"`
+	// Identifier of the API key the request presented, never the key itself;
+	// default for requests without a key
+	APIKeyID string `json:"api_key"`
+	// Permission requested, e.g. read_obs or read_raw:<campaign>
+	Permission string `json:"permission"`
+	// Method and path of the resource requested
+	Method   string `json:"method"`
+	Resource string `json:"resource"`
+	// True if the permission was granted
+	Allowed bool `json:"allowed"`
+	// Rule by which the decision was made, one of the AuthRule constants
+	Rule string `json:"rule"`
+	// ID of the request, if it has one
+	RequestID string `json:"request_id,omitempty"`
+	// Number of decisions with the same outcome this record stands for, 1
+	// unless decisions are sampled
+	Sampling int `json:"sampling"`
+}
+
+// AuthDecisionSink receives the authorization decisions logged to an
+// AuthLog, e.g. to write them to a file or forward them to an audit system.
+// Sinks must be safe for concurrent use.
+type AuthDecisionSink interface {
+	LogAuthDecision(d *AuthDecision) error
+}
+
+// AuthLogOptions configures the authorization decision log.
+type AuthLogOptions struct {
+	// Path to file to write decisions to, as JSON objects one per line;
+	// standard error if empty
+	Path string
+
+	// Log only one in this many decisions allowing a request; 0 or 1 to log
+	// all
+	AllowSampling int
+
+	// Log only one in this many decisions denying a request; 0 or 1 to log
+	// all
+	DenySampling int
+}
+
+// validate returns an error if a sampling control is negative.
+func (opts *AuthLogOptions) validate() error {
+	if opts.AllowSampling < 0 || opts.DenySampling < 0 {
+		return PTOErrorf("AuthLog AllowSampling and DenySampling may not be negative")
+	}
+	return nil
+}
+
+// AuthLog passes a sample of the authorization decisions it is given to a
+// sink. Decisions are sampled separately by outcome, so that denials, which
+// are usually rarer and of more interest, can be logged in full while
+// allowed requests are sampled.
+type AuthLog struct {
+	sink       AuthDecisionSink
+	allowEvery uint64
+	denyEvery  uint64
+
+	// numbers of decisions seen by outcome
+	allowed uint64
+	denied  uint64
+}
+
+// NewAuthLog returns an authorization decision log passing decisions to the
+// given sink, sampled as configured.
+func NewAuthLog(sink AuthDecisionSink, opts *AuthLogOptions) *AuthLog {
+	al := &AuthLog{sink: sink, allowEvery: 1, denyEvery: 1}
+	if opts.AllowSampling > 1 {
+		al.allowEvery = uint64(opts.AllowSampling)
+	}
+	if opts.DenySampling > 1 {
+		al.denyEvery = uint64(opts.DenySampling)
+	}
+	return al
+}
+
+// Log passes a decision to this log's sink if it is sampled. The first
+// decision of each outcome is always sampled.
+func (al *AuthLog) Log(d *AuthDecision) {
+	counter, every := &al.allowed, al.allowEvery
+	if !d.Allowed {
+		counter, every = &al.denied, al.denyEvery
+	}
+	if (atomic.AddUint64(counter, 1)-1)%every != 0 {
+		return
+	}
+
+	d.Sampling = int(every)
+	if err := al.sink.LogAuthDecision(d); err != nil {
+		log.Printf("cannot log authorization decision on %s for %s: %v", d.Permission, d.APIKeyID, err)
+	}
+}
+
+// Reopen reopens this log's sink, if it can be reopened, e.g. after a log
+// file has been rotated.
+func (al *AuthLog) Reopen() error {
+	if r, ok := al.sink.(interface{ Reopen() error }); ok {
+		return r.Reopen()
+	}
+	return nil
+}
+
+// AuthDecisionFile is an AuthDecisionSink writing decisions as JSON objects,
+// one per line, to standard error or to a file. A file is opened for
+// appending, and can be reopened with Reopen after it has been rotated.
+type AuthDecisionFile struct {
+	path string
+
+	lock sync.Mutex
+	file *os.File
+	out  io.Writer
+}
+
+// NewAuthDecisionFile returns a sink writing decisions to the file at the
+// given path, or to standard error if the path is empty.
+func NewAuthDecisionFile(path string) (*AuthDecisionFile, error) {
+	af := &AuthDecisionFile{path: path, out: os.Stderr}
+	if err := af.Reopen(); err != nil {
+		return nil, err
+	}
+	return af, nil
+}
+
+// Reopen closes and reopens the file this sink writes to. It does nothing for
+// a sink writing to standard error.
+func (af *AuthDecisionFile) Reopen() error {
+	if af.path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(af.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	af.lock.Lock()
+	old := af.file
+	af.file = file
+	af.out = file
+	af.lock.Unlock()
+
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
+
+// LogAuthDecision writes a decision to this sink's current output.
+func (af *AuthDecisionFile) LogAuthDecision(d *AuthDecision) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	af.lock.Lock()
+	defer af.lock.Unlock()
+	if _, err := af.out.Write(append(b, '\n')); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package pto3
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// CanonicalizeJSON returns the canonical serialization of a JSON value: no
+// insignificant whitespace, object keys sorted by their UTF-8 bytes, numbers
+// in shortest round-trip form (integers without fraction or exponent), and
+// strings escaped as encoding/json escapes them by default. Equal JSON values
+// have the same canonical bytes, independent of how they were produced, so
+// these can be hashed to get reproducible digests of metadata. The
+// serialization is implemented here rather than delegated to encoding/json,
+// so that it does not change between Go versions.
+func CanonicalizeJSON(b []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	if dec.More() {
+		return nil, PTOErrorf("trailing data after JSON value").StatusIs(http.StatusBadRequest)
+	}
+
+	var out bytes.Buffer
+	if err := appendCanonicalJSON(&out, v); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// MarshalCanonicalJSON serializes a value to JSON as json.Marshal does, then
+// canonicalizes it with CanonicalizeJSON.
+func MarshalCanonicalJSON(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return CanonicalizeJSON(b)
+}
+
+func appendCanonicalJSON(out *bytes.Buffer, v interface{}) error {
+	switch cv := v.(type) {
+	case nil:
+		out.WriteString("null")
+	case bool:
+		out.WriteString(strconv.FormatBool(cv))
+	case json.Number:
+		s, err := canonicalNumber(cv)
+		if err != nil {
+			return err
+		}
+		out.WriteString(s)
+	case string:
+		appendCanonicalString(out, cv)
+	case []interface{}:
+		out.WriteByte('[')
+		for i, ev := range cv {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := appendCanonicalJSON(out, ev); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(cv))
+		for k := range cv {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		out.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			appendCanonicalString(out, k)
+			out.WriteByte(':')
+			if err := appendCanonicalJSON(out, cv[k]); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	default:
+		panic("internal error: unexpected type decoding JSON")
+	}
+	return nil
+}
+
+// canonicalNumber formats a JSON number as JavaScript (and encoding/json
+// since Go 1.8) does: integers exactly, other numbers as the shortest decimal
+// that parses to the same float64, with an exponent only for very large and
+// very small magnitudes. Unlike JavaScript, integers written without a
+// fraction or exponent keep their literal digits even beyond the range of
+// int64, so that identifiers and counters are not rounded.
+func canonicalNumber(n json.Number) (string, error) {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return strconv.FormatInt(i, 10), nil
+	}
+	if isIntegerLiteral(string(n)) {
+		return string(n), nil
+	}
+
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil || math.IsInf(f, 0) {
+		return "", PTOErrorf("number %s out of range", n).StatusIs(http.StatusBadRequest)
+	}
+	if f == 0 {
+		// no negative zero
+		return "0", nil
+	}
+
+	abs := math.Abs(f)
+	if abs >= 1e21 || abs < 1e-6 {
+		// exponent without leading zeroes, e.g. 1e-7 rather than 1e-07
+		s := strconv.FormatFloat(f, 'e', -1, 64)
+		s = strings.Replace(s, "e-0", "e-", 1)
+		return strings.Replace(s, "e+0", "e+", 1), nil
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), nil
+}
+
+// isIntegerLiteral returns true if a JSON number is written as an integer,
+// without a fraction or exponent.
+func isIntegerLiteral(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendCanonicalString writes a JSON string, escaping control characters,
+// HTML special characters, and the JavaScript line separators as \u escapes
+// (except for \n, \r, and \t), and replacing invalid UTF-8 with U+FFFD.
+func appendCanonicalString(out *bytes.Buffer, s string) {
+	out.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		i += size
+
+		switch {
+		case r == '"' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r == '\n':
+			out.WriteString(`\n`)
+		case r == '\r':
+			out.WriteString(`\r`)
+		case r == '\t':
+			out.WriteString(`\t`)
+		case r < 0x20 || r == '<' || r == '>' || r == '&':
+			out.WriteString(`\u00`)
+			out.WriteByte(hexDigits[r>>4])
+			out.WriteByte(hexDigits[r&0xF])
+		case r == '\u2028' || r == '\u2029':
+			out.WriteString(`\u202`)
+			out.WriteByte(hexDigits[r&0xF])
+		default:
+			// invalid UTF-8 decodes as utf8.RuneError, written as U+FFFD
+			out.WriteRune(r)
+		}
+	}
+	out.WriteByte('"')
+}
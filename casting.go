@@ -44,6 +44,18 @@ func AsStringArray(v interface{}) ([]string, bool) {
 	}
 }
 
+// Bounds of the Unix epoch times accepted by ParseTime: the beginning of year
+// 0 and the end of year 9999, the range of four-digit years in RFC3339.
+const minEpochTime = -62167219200
+const maxEpochTime = 253402300799
+
+// inTimeRange returns true if a time's year in UTC has four digits, so that
+// it can be written as RFC3339 and parsed again.
+func inTimeRange(t time.Time) bool {
+	y := t.UTC().Year()
+	return y >= 0 && y <= 9999
+}
+
 // ParseTimeString takes a string and attempts to parse it as an ISO, PostgreSQL, or Unix epoch second string
 func ParseTime(s string) (time.Time, error) {
 	var t time.Time
@@ -51,25 +63,25 @@ func ParseTime(s string) (time.Time, error) {
 
 	// ISO
 	t, err = time.Parse(time.RFC3339, s)
-	if err == nil {
+	if err == nil && inTimeRange(t) {
 		return t, nil
 	}
 
 	// ISO Date
 	t, err = time.Parse(ISODate, s)
-	if err == nil {
+	if err == nil && inTimeRange(t) {
 		return t, nil
 	}
 
 	// PostgreSQL
 	t, err = time.Parse(PostgresTime, s)
-	if err == nil {
+	if err == nil && inTimeRange(t) {
 		return t, nil
 	}
 
-	// epoch seconds
+	// epoch seconds, limited to times that can be written as RFC3339
 	t64, err := strconv.ParseFloat(s, 64)
-	if err == nil {
+	if err == nil && t64 >= minEpochTime && t64 <= maxEpochTime {
 		s, ns := math.Modf(t64)
 		return time.Unix(int64(s), int64(ns*1e9)), nil
 	}
@@ -85,9 +97,9 @@ func AsTime(v interface{}) (time.Time, error) {
 	case string:
 		return ParseTime(cv)
 	case int64:
-		return time.Unix(cv, 0), nil
+		return ParseTime(strconv.FormatInt(cv, 10))
 	case int:
-		return time.Unix(int64(cv), 0), nil
+		return ParseTime(strconv.Itoa(cv))
 	default:
 		return ParseTime(AsString(cv))
 	}
@@ -0,0 +1,145 @@
+package pto3
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of campaign changes
+const (
+	// Data for a file was written
+	ChangeFileAdded = "file_added"
+	// Metadata for a file (or the campaign, if no file is given) was written
+	ChangeMetadataChanged = "metadata_changed"
+)
+
+// CampaignChangeRetention is the number of changes retained per campaign.
+const CampaignChangeRetention = 1000
+
+// CampaignChange describes a single change to a campaign in the raw data
+// store.
+type CampaignChange struct {
+	// Sequence number of the change, increasing by one per change
+	Seq int `json:"seq"`
+	// Type of change
+	Type string `json:"type"`
+	// File changed, empty for changes to the campaign itself
+	File string `json:"file,omitempty"`
+	// Time of the change
+	Time time.Time `json:"time"`
+}
+
+// changeLog keeps the most recent changes to a campaign in memory, and allows
+// clients to wait for new changes. Changes are kept in the RawDataStore, so
+// that they survive rescanning of campaigns, but not restarts.
+type changeLog struct {
+	// retained changes, oldest first
+	changes []CampaignChange
+
+	// sequence number of the most recent change
+	last int
+
+	// channel closed (and replaced) when a change is appended
+	notify chan struct{}
+
+	// lock on everything above
+	lock sync.Mutex
+}
+
+func newChangeLog() *changeLog {
+	return &changeLog{
+		changes: make([]CampaignChange, 0),
+		notify:  make(chan struct{}),
+	}
+}
+
+// append adds a change to the log, and wakes up anyone waiting for changes.
+func (cl *changeLog) append(changeType string, filename string) {
+	if cl == nil {
+		return
+	}
+
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	cl.last++
+	cl.changes = append(cl.changes, CampaignChange{
+		Seq:  cl.last,
+		Type: changeType,
+		File: filename,
+		Time: time.Now().UTC(),
+	})
+
+	if len(cl.changes) > CampaignChangeRetention {
+		cl.changes = cl.changes[len(cl.changes)-CampaignChangeRetention:]
+	}
+
+	close(cl.notify)
+	cl.notify = make(chan struct{})
+}
+
+// since returns changes after a given sequence number, and whether the client
+// missed changes (i.e., the sequence number is older than the oldest retained
+// change, or newer than the newest change because the server restarted), in
+// which case all retained changes are returned. If there are no changes, it
+// also returns a channel which will be closed on the next change.
+func (cl *changeLog) since(seq int) ([]CampaignChange, bool, <-chan struct{}) {
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+
+	reset := seq > cl.last || (len(cl.changes) > 0 && seq < cl.changes[0].Seq-1)
+	if reset {
+		seq = 0
+	}
+
+	out := make([]CampaignChange, 0)
+	for _, change := range cl.changes {
+		if change.Seq > seq {
+			out = append(out, change)
+		}
+	}
+
+	return out, reset, cl.notify
+}
+
+// ChangesSince returns the changes to this campaign after the given sequence
+// number, waiting up to the given timeout for a change if there are none. It
+// also returns the sequence number to use for the next call, and true if
+// changes have been missed, in which case the client should rescan the
+// campaign. Only changes made through this process since it started are
+// available.
+func (cam *Campaign) ChangesSince(seq int, timeout time.Duration) ([]CampaignChange, int, bool) {
+	changes, reset, notify := cam.changes.since(seq)
+
+	if len(changes) == 0 && !reset {
+		select {
+		case <-notify:
+			changes, reset, _ = cam.changes.since(seq)
+		case <-time.After(timeout):
+		}
+	}
+
+	next := seq
+	if reset {
+		next = 0
+	}
+	if len(changes) > 0 {
+		next = changes[len(changes)-1].Seq
+	}
+
+	return changes, next, reset
+}
+
+// changeLogFor returns the change log for the named campaign, creating it if
+// necessary.
+func (rds *RawDataStore) changeLogFor(camname string) *changeLog {
+	rds.changeLock.Lock()
+	defer rds.changeLock.Unlock()
+
+	cl, ok := rds.changeLogs[camname]
+	if !ok {
+		cl = newChangeLog()
+		rds.changeLogs[camname] = cl
+	}
+	return cl
+}
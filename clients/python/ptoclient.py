@@ -1,6 +1,9 @@
 import codecs
 import json
 import datetime
+import hashlib
+import os
+import tempfile
 import urllib.parse
 from collections import deque
 
@@ -70,6 +73,102 @@ def _headers_for_token(token):
 class PTOError(Exception):
     def __init__(self, status, text):
         super().__init__(str(status) + ": " + text)
+        self.status = status
+        self.code = None
+        self.request_id = None
+        try:
+            body = json.loads(text)
+            self.code = body.get("error")
+            self.request_id = body.get("request_id")
+        except (ValueError, AttributeError):
+            pass
+
+class PTOCache:
+    """
+    Caches responses for resources which change rarely but are fetched by
+    every job working with them (observation set metadata, the condition
+    list, and the condition tree) in memory and, if a directory is given, on
+    disk, so that jobs started many times a day can share them. Cached
+    responses are revalidated with their ETag before every use, so they are
+    never stale; the server only sends resources which have changed.
+    """
+    def __init__(self, directory=None):
+        super().__init__()
+        self._directory = directory
+        self._entries = {}
+
+        if directory is not None:
+            self._directory = os.path.expanduser(directory)
+            os.makedirs(self._directory, exist_ok=True)
+
+    def _path(self, key):
+        return os.path.join(self._directory, key + ".json")
+
+    def _load(self, key):
+        if key in self._entries or self._directory is None:
+            return self._entries.get(key)
+
+        try:
+            with open(self._path(key)) as f:
+                entry = json.load(f)
+        except (OSError, ValueError):
+            return None
+
+        self._entries[key] = entry
+        return entry
+
+    def _store(self, key, entry):
+        self._entries[key] = entry
+        if self._directory is None:
+            return
+
+        # replace atomically, as other jobs may be reading the directory;
+        # failing to write the cache only costs a refetch
+        try:
+            fd, tmp = tempfile.mkstemp(dir=self._directory, suffix=".tmp")
+            try:
+                with os.fdopen(fd, "w") as f:
+                    json.dump(entry, f)
+                os.replace(tmp, self._path(key))
+            except OSError:
+                os.remove(tmp)
+        except OSError:
+            pass
+
+    def get_json(self, url, token):
+        """
+        Retrieve the JSON resource at a URL, from the cache if unchanged.
+        """
+        # responses depend on the client's permissions, so are cached by token
+        key = hashlib.sha256((url + "\n" + str(token)).encode("utf-8")).hexdigest()
+        entry = self._load(key)
+
+        headers = _headers_for_token(token)
+        if entry is not None:
+            headers["If-None-Match"] = entry["etag"]
+
+        r = requests.get(url, headers=headers)
+
+        if r.status_code == 304 and entry is not None:
+            return entry["body"]
+        elif r.status_code != 200:
+            raise PTOError(r.status_code, r.text)
+
+        body = r.json()
+        if "ETag" in r.headers:
+            self._store(key, {"etag": r.headers["ETag"], "body": body})
+
+        return body
+
+def _get_json(url, token, cache):
+    if cache is not None:
+        return cache.get_json(url, token)
+
+    r = requests.get(url, headers = _headers_for_token(token))
+    if r.status_code != 200:
+        raise PTOError(r.status_code, r.text)
+
+    return r.json()
 
 class PTOQuerySpec:
     """
@@ -300,7 +399,7 @@ class PTOSet:
     """
     Represents a specific observation set in an instance of the PTO.
     """
-    def __init__(self, url=None, token=None, obsfile=None):
+    def __init__(self, url=None, token=None, obsfile=None, cache=None):
         super().__init__()
         
         if url is None and obsfile is None:
@@ -309,6 +408,7 @@ class PTOSet:
         self._url = url
         self._token = token
         self._obsfile = obsfile
+        self._cache = cache
         self._metadata = None
         self._obsdata = None
 
@@ -339,13 +439,7 @@ class PTOSet:
               }
                 
     def _reload_http_metadata(self):
-        r = requests.get(self._url,
-                         headers = _headers_for_token(self._token))   
-
-        if r.status_code == 200:
-            self._metadata = r.json()
-        else:
-            raise PTOError(r.status_code, r.text)
+        self._metadata = _get_json(self._url, self._token, self._cache)
         
         
     def metadata(self, reload=False):
@@ -389,15 +483,18 @@ class PTOSet:
       
 class PTOClient:
     """
-    Client for accessing observation sets and queries in specific instance of the PTO
+    Client for accessing observation sets and queries in specific instance of the PTO.
+    Set metadata and conditions are cached, in cache_dir if given, and
+    revalidated with the PTO before use.
     """
     
-    def __init__(self, baseurl, token):
+    def __init__(self, baseurl, token, cache_dir=None):
         super().__init__()
         if baseurl[-1] != "/":
             baseurl += "/"
         self._baseurl = baseurl
         self._token = token
+        self._cache = PTOCache(cache_dir)
     
     def sets_by_metadata(self, k=None, v=None, source=None, analyzer=None, condition=None):
         params = {}
@@ -451,10 +548,22 @@ class PTOClient:
         elif not url.startswith(self._baseurl):
             raise ValueError("This client cannot connect to {}",format(url))
 
-        ptoset = PTOSet(url, self._token)
+        ptoset = PTOSet(url, self._token, cache=self._cache)
         ptoset.metadata()
 
         return ptoset
+
+    def conditions(self):
+        """
+        Retrieve the list of conditions in the observatory, and their aliases
+        """
+        return self._cache.get_json(self._baseurl+"obs/conditions", self._token)
+
+    def condition_tree(self):
+        """
+        Retrieve the conditions in the observatory as a tree, with observation counts
+        """
+        return self._cache.get_json(self._baseurl+"obs/conditions/tree", self._token)
     
     def retrieve_query(self, url=None, queryid=None):
         """
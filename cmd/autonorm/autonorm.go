@@ -59,7 +59,7 @@ func main() {
 	}
 
 	// create a database connection
-	db := pg.Connect(&pconfig.ObsDatabase)
+	db := pg.Connect(&pconfig.ObsDatabase.Options)
 
 	// share pid and condition caches across all files in a single autonorm run
 	cidCache, err := pto3.LoadConditionCache(db)
@@ -65,7 +65,7 @@ func main() {
 		log.Fatal(err)
 	}
 
-	db := pg.Connect(&config.ObsDatabase)
+	db := pg.Connect(&config.ObsDatabase.Options)
 
 	for _, setID := range setIDs {
 		set := pto3.ObservationSet{ID: setID}
@@ -0,0 +1,194 @@
+// ptodb performs maintenance on a PTO observation database.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
+var ageFlag = flag.Duration("age", 30*24*time.Hour, "purge observation sets deleted at least this `duration` ago")
+var dryRunFlag = flag.Bool("n", false, "for purge, list the sets which would be purged without purging them")
+var fromFlag = flag.Int64("from", 1, "for replay, replay ingest log entries from this sequence `number` on")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: maintain a PTO observation database\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> command\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Commands:\n")
+		fmt.Fprintf(os.Stderr, "  init     create tables, functions, operators, and indexes\n")
+		fmt.Fprintf(os.Stderr, "  migrate  apply pending schema migrations to an existing database\n")
+		fmt.Fprintf(os.Stderr, "  version  print the schema version of the database\n")
+		fmt.Fprintf(os.Stderr, "  index    merge duplicate paths, add missing indexes, and apply configured indexes\n")
+		fmt.Fprintf(os.Stderr, "  sources  link all observation sets to their sources for provenance queries\n")
+		fmt.Fprintf(os.Stderr, "  purge    remove observation sets deleted longer ago than -age for good\n")
+		fmt.Fprintf(os.Stderr, "  replay   load the uploads in the ingest log from entry -from on\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *helpFlag {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	args := flag.Args()
+
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := pg.Connect(&config.ObsDatabase.Options)
+	defer db.Close()
+
+	switch args[0] {
+	case "init":
+		if err := pto3.CreateTables(db); err != nil {
+			log.Fatal("creating database tables: ", err)
+		}
+		partition(db, config)
+		index(db, config)
+	case "migrate":
+		from, err := pto3.SchemaVersion(db)
+		if err != nil {
+			log.Fatal("getting schema version: ", err)
+		}
+
+		applied, err := pto3.Migrate(db)
+		for _, m := range applied {
+			log.Printf("applied migration to schema version %d: %s", m.Version, m.Description)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(applied) == 0 {
+			log.Printf("schema version %d is up to date", from)
+		}
+		partition(db, config)
+		index(db, config)
+	case "version":
+		version, err := pto3.SchemaVersion(db)
+		if err != nil {
+			log.Fatal("getting schema version: ", err)
+		}
+		fmt.Printf("%d (latest %d)\n", version, pto3.LatestSchemaVersion())
+	case "index":
+		removed, err := pto3.DeduplicatePaths(db)
+		if err != nil {
+			log.Fatal("merging duplicate paths: ", err)
+		}
+		log.Printf("merged %d duplicate paths", removed)
+
+		if err := pto3.CreateIndexes(db); err != nil {
+			log.Fatal("creating indexes: ", err)
+		}
+		index(db, config)
+	case "sources":
+		setIds, err := pto3.AllObservationSetIDs(db)
+		if err != nil {
+			log.Fatal("listing observation sets: ", err)
+		}
+
+		linked := 0
+		for _, setid := range setIds {
+			set := pto3.ObservationSet{ID: setid}
+			err := db.RunInTransaction(func(t *pg.Tx) error {
+				if err := set.SelectByID(t); err != nil {
+					return err
+				}
+				return set.LinkSources(t, config, nil)
+			})
+			if err != nil {
+				log.Printf("cannot link observation set %x to its sources: %s", setid, err.Error())
+				continue
+			}
+			linked++
+		}
+		log.Printf("linked %d of %d observation sets to their sources", linked, len(setIds))
+	case "purge":
+		verb := "purged"
+		if *dryRunFlag {
+			verb = "would purge"
+		}
+
+		deletions, err := pto3.PurgeDeletedObservationSets(config, db, time.Now().Add(-*ageFlag), *dryRunFlag,
+			func(setid int, deleted int, total int) {
+				log.Printf("purging observation set %x: deleted %d of %d observations", setid, deleted, total)
+			})
+		for _, deletion := range deletions {
+			log.Printf("%s %s with %d observations", verb, deletion.Set, deletion.Observations)
+		}
+		if err != nil {
+			log.Fatal("purging deleted observation sets: ", err)
+		}
+		log.Printf("%s %d deleted observation sets", verb, len(deletions))
+	case "replay":
+		if config.IngestLogPath == "" {
+			log.Fatal("no IngestLogPath configured")
+		}
+
+		replayed := 0
+		err := pto3.ReplayIngestLog(db, config, config.IngestLogPath, *fromFlag,
+			func(seq int64, set *pto3.ObservationSet, created bool, loaded int) {
+				what := "loaded"
+				if created {
+					what = "created set and loaded"
+				}
+				log.Printf("replayed entry %d: %s %d observations into set %s", seq, what, loaded, set.UUID())
+				replayed++
+			})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("replayed %d ingest log entries", replayed)
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+// partition partitions the observations table as configured, if it is not
+// already.
+func partition(db *pg.DB, config *pto3.PTOConfiguration) {
+	if config.ObservationPartitioning == nil {
+		return
+	}
+
+	if err := pto3.PartitionObservations(db, config.ObservationPartitioning); err != nil {
+		log.Fatal("partitioning observations: ", err)
+	}
+}
+
+// index creates and drops configured indexes on the observations table to
+// match the configuration, if it configures any.
+func index(db *pg.DB, config *pto3.PTOConfiguration) {
+	if config.ObservationIndexes == nil {
+		return
+	}
+
+	created, dropped, err := pto3.ApplyObservationIndexes(db, config.ObservationIndexes)
+	for _, name := range dropped {
+		log.Printf("dropped index %s", name)
+	}
+	for _, name := range created {
+		log.Printf("created index %s", name)
+	}
+	if err != nil {
+		log.Fatal("applying configured indexes: ", err)
+	}
+}
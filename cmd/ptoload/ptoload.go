@@ -15,6 +15,7 @@ import (
 var helpFlag = flag.Bool("h", false, "display a help message")
 var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
 var initdbFlag = flag.Bool("initdb", false, "Create database tables on startup")
+var importFlag = flag.String("import", "", "`policy` for files with the UUID of an existing set: skip, update, or supersede (default: fail)")
 
 func main() {
 	flag.Usage = func() {
@@ -37,12 +38,17 @@ func main() {
 		os.Exit(1)
 	}
 
+	policy, err := pto3.ParseImportPolicy(*importFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	config, err := pto3.NewConfigWithDefault(*configFlag)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	db := pg.Connect(&config.ObsDatabase)
+	db := pg.Connect(&config.ObsDatabase.Options)
 	if *initdbFlag {
 		if err := pto3.CreateTables(db); err != nil {
 			log.Fatal("creating database tables: ", err)
@@ -58,16 +64,25 @@ func main() {
 	pidCache := make(pto3.PathCache)
 
 	for i, filename := range args {
-		var set *pto3.ObservationSet
-		set, err = pto3.CopySetFromObsFile(filename, db, cidCache, pidCache)
+		var res *pto3.ImportResult
+		res, err = pto3.ImportSetFromObsFile(filename, db, cidCache, pidCache, policy)
 		if err != nil {
 			log.Fatal("copying set from obs file: ", err)
 		}
 
+		set := res.Set
 		set.LinkVia(config)
 
-		log.Printf("%d/%d (%5.2f%%) done, created observation set 0x%x",
-			i+1, len(args), 100.0*float64(i+1)/float64(len(args)), set.ID)
+		// link a new or updated set to its sources; the set is loaded even if
+		// this fails
+		if res.Action != pto3.ImportUnchanged && res.Action != pto3.ImportSkipped {
+			if err := set.LinkSources(db, config, nil); err != nil {
+				log.Printf("cannot link observation set 0x%x to its sources: %s", set.ID, err.Error())
+			}
+		}
+
+		log.Printf("%d/%d (%5.2f%%) done, %s observation set 0x%x",
+			i+1, len(args), 100.0*float64(i+1)/float64(len(args)), res.Action, set.ID)
 		/* Previous debugging output:
 		 * b, _ := json.MarshalIndent(set, "  ", "  ")
 		 * os.Stderr.Write(b)
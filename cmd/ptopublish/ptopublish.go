@@ -0,0 +1,73 @@
+// ptopublish exports the public, sealed observation sets in a PTO observation
+// database for a given period into a static, checksummed snapshot directory,
+// for hosting on a plain web server or upload to a data archive.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file` with DB connection information")
+var startFlag = flag.String("start", "", "publish sets with observations at or after this RFC3339 `time`; unbounded if not given")
+var endFlag = flag.String("end", "", "publish sets with observations at or before this RFC3339 `time`; unbounded if not given")
+
+// parseTimeFlag parses an optional RFC3339 timestamp flag, returning nil if
+// it is not given.
+func parseTimeFlag(name string, value string) *time.Time {
+	if value == "" {
+		return nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		log.Fatalf("bad -%s %s: must be an RFC3339 timestamp", name, value)
+	}
+	return &t
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: publish a snapshot of public PTO observation sets\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> snapshot-directory\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	if *helpFlag || len(args) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	start := parseTimeFlag("start", *startFlag)
+	end := parseTimeFlag("end", *endFlag)
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db := pg.Connect(&config.ObsDatabase.Options)
+	defer db.Close()
+
+	catalog, err := pto3.PublishSnapshot(config, db, args[0], start, end)
+	if err != nil {
+		log.Fatal("publishing snapshot: ", err)
+	}
+
+	count := 0
+	for _, ss := range catalog.Sets {
+		count += ss.Count
+	}
+	log.Printf("published %d observation sets with %d observations to %s", len(catalog.Sets), count, args[0])
+}
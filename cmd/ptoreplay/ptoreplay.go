@@ -0,0 +1,100 @@
+// ptoreplay replays requests recorded in a PTO access log against another PTO
+// instance, verifying that it answers them as the recorded instance did, so
+// that upgrades can be validated under realistic load on a staging instance
+// before they are deployed.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var targetFlag = flag.String("target", "", "base `URL` of the PTO instance to replay requests against")
+var apiKeyFlag = flag.String("apikey", "", "API `key` to send with each request")
+var speedFlag = flag.Float64("speed", 1, "speedup relative to recorded timing; 0 sends requests as fast as possible")
+var concurrencyFlag = flag.Int("concurrency", 16, "maximum number of requests in flight")
+var timeoutFlag = flag.Duration("timeout", 5*time.Minute, "timeout for each request")
+var lengthFlag = flag.Bool("length", false, "also verify response lengths against the recording")
+var referenceFlag = flag.String("reference", "", "base `URL` of a PTO instance to compare response bodies with")
+var ignoreFlag = flag.String("ignore", "", "comma-separated `keys` of JSON objects to ignore when comparing bodies, in addition to timing and accounting keys")
+var verboseFlag = flag.Bool("v", false, "log every replayed request, not only mismatches")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: replay a PTO access log against a PTO instance\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags> access.log ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	if *helpFlag || *targetFlag == "" || len(args) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	rp, err := pto3.NewReplayer(*targetFlag, *apiKeyFlag, *speedFlag, *concurrencyFlag, *timeoutFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *referenceFlag != "" {
+		var ignoreKeys []string
+		if *ignoreFlag != "" {
+			ignoreKeys = strings.Split(*ignoreFlag, ",")
+		}
+		if err := rp.CompareWith(*referenceFlag, ignoreKeys); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	entries := make([]pto3.AccessLogEntry, 0)
+	for _, filename := range args {
+		in, err := os.Open(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fileEntries, skipped, err := pto3.ReadAccessLog(in)
+		in.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if skipped > 0 {
+			log.Printf("skipped %d lines in %s which are not access log entries", skipped, filename)
+		}
+
+		entries = append(entries, fileEntries...)
+	}
+
+	var summary pto3.ReplaySummary
+
+	skipped := rp.Replay(entries, func(rr pto3.ReplayResult) {
+		summary.Add(rr, *lengthFlag)
+
+		if mismatch := rr.Mismatch(*lengthFlag); mismatch != "" {
+			log.Printf("MISMATCH %s %s: %s", rr.Entry.Method, rr.Entry.URL, mismatch)
+		} else if *verboseFlag {
+			log.Printf("ok %s %s %d %d %v", rr.Entry.Method, rr.Entry.URL, rr.Length, rr.Status, rr.Duration)
+		}
+	})
+
+	if skipped > 0 {
+		log.Printf("skipped %d requests which can't be replayed (not GET or HEAD)", skipped)
+	}
+
+	log.Print(summary.String())
+
+	if summary.Mismatches > 0 || summary.Errors > 0 {
+		os.Exit(1)
+	}
+}
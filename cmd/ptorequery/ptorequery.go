@@ -14,6 +14,7 @@ import (
 var helpFlag = flag.Bool("h", false, "display a help message")
 var configFlag = flag.String("config", "", "path to PTO configuration file with DB connection information")
 var forceFlag = flag.Bool("force", false, "rerun query regardless of query state")
+var diffFlag = flag.Bool("diff", false, "rerun completed queries, comparing results with the previous run")
 
 func main() {
 
@@ -57,6 +58,26 @@ func main() {
 			oq, err := qc.ParseQueryFromURLEncoded(encoded)
 			if err != nil {
 				log.Printf("error parsing query %s: %v", encoded, err)
+				continue
+			}
+
+			// rerun completed queries, keeping the previous results to compare
+			if *diffFlag {
+				cq, err := qc.QueryByIdentifier(oq.Identifier)
+				if err != nil {
+					log.Printf("error fetching query %s: %v", encoded, err)
+					continue
+				}
+				if cq != nil && cq.Completed != nil {
+					donechan := make(chan struct{})
+					if err := cq.Rerun(donechan); err != nil {
+						log.Printf("error rerunning query %s: %v", encoded, err)
+						continue
+					}
+					donechans = append(donechans, donechan)
+					log.Printf("rerunning query %s with ID %s; diff will be at %s", cq.URLEncoded(), cq.Identifier, cq.DiffLink())
+					continue
+				}
 			}
 
 			var doPurge bool
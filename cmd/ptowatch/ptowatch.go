@@ -0,0 +1,71 @@
+// ptowatch monitors a drop directory populated by rsync, rclone, or similar
+// tools, and moves raw data files and their metadata into the raw data store,
+// for probes that cannot speak the PTO HTTP API.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+var helpFlag = flag.Bool("h", false, "display a help message")
+var configFlag = flag.String("config", "", "path to PTO configuration `file` with raw data store information")
+var dropFlag = flag.String("drop", "", "path to drop `directory` to watch")
+var rejectFlag = flag.String("reject", "", "path to `directory` to move rejected files to; leave them in place if not given")
+var intervalFlag = flag.Duration("interval", 30*time.Second, "time between scans of the drop directory")
+var settleFlag = flag.Duration("settle", 60*time.Second, "minimum time since last modification before ingesting a file")
+var campaignsFlag = flag.String("campaigns", "", "comma-separated list of campaigns this drop directory may write to; all if not given")
+var onceFlag = flag.Bool("once", false, "scan the drop directory once and exit")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s: move files from a drop directory into a PTO raw data store\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s <flags>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if *helpFlag || *dropFlag == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	config, err := pto3.NewConfigWithDefault(*configFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	rds, err := pto3.NewRawDataStore(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	di := pto3.NewDropIngester(rds, *dropFlag, *rejectFlag, *settleFlag)
+	if *campaignsFlag != "" {
+		di.RestrictCampaigns(strings.Split(*campaignsFlag, ","))
+	}
+
+	for {
+		n, err := di.Scan()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if n > 0 {
+			log.Printf("ingested %d files from %s", n, *dropFlag)
+		}
+
+		if *onceFlag {
+			break
+		}
+
+		time.Sleep(*intervalFlag)
+	}
+}
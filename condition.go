@@ -1,9 +1,16 @@
 package pto3
 
 import (
+	"encoding/csv"
+	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
 )
 
@@ -60,18 +67,126 @@ type ConditionCache map[string]int
 
 // FillConditionIDsInSet ensures all the conditions in a given observation set
 // have valid IDs. It keeps the condition cache synchronized with the database
-// if any new conditions have been added.
+// if any new conditions have been added. New conditions are inserted in bulk
+// via CacheNewConditions, after reloading the cache to pick up any conditions
+// added by other writers since it was loaded.
 func (cache ConditionCache) FillConditionIDsInSet(db orm.DB, set *ObservationSet) error {
 
+	conditionSet := make(map[string]struct{})
 	for _, c := range set.Conditions {
-		if err := cache.SetConditionID(db, &c); err != nil {
+		if cache[c.Name] == 0 {
+			conditionSet[c.Name] = struct{}{}
+		}
+	}
+
+	if len(conditionSet) > 0 {
+		if err := cache.Reload(db); err != nil {
 			return err
 		}
+
+		if err := cache.CacheNewConditions(db, conditionSet); err != nil {
+			return err
+		}
+	}
+
+	for i := range set.Conditions {
+		set.Conditions[i].ID = cache[set.Conditions[i].Name]
 	}
 
 	return nil
 }
 
+// CacheNewConditions takes a set of condition names, and adds those not
+// already appearing to the cache and the underlying database. It modifies the
+// conditionSet to contain only those conditions added. As with
+// PathCache.CacheNewPaths, it only checks the cache, not the database, before
+// adding, so the cache should be reloaded first if other writers may have
+// added conditions. The cache is only updated once the conditions are
+// inserted; if db is a transaction, which may yet be rolled back, the caller
+// should pass a clone of its cache, and merge the clone back once the
+// transaction commits.
+func (cache ConditionCache) CacheNewConditions(db orm.DB, conditionSet map[string]struct{}) error {
+	// first, reduce to conditions not already in the cache
+	for cs := range conditionSet {
+		if cache[cs] > 0 {
+			delete(conditionSet, cs)
+		}
+	}
+
+	if len(conditionSet) == 0 {
+		return nil
+	}
+
+	// reserve an ID for each new condition in the database, in one statement
+	// so that concurrent writers can't be given the same IDs
+	var cids []int
+	if _, err := db.QueryOne(pg.Scan(pg.Array(&cids)),
+		"SELECT array_agg(nextval('conditions_id_seq')) FROM generate_series(1, ?)", len(conditionSet)); err != nil {
+		return PTOWrapError(err)
+	}
+
+	added := make(ConditionCache)
+	for name := range conditionSet {
+		added[name] = cids[len(added)]
+	}
+
+	// now stream the new conditions into the database
+	streamerr := make(chan error, 1)
+	dbpipe, condpipe, err := os.Pipe()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	defer dbpipe.Close()
+
+	go func() {
+		out := csv.NewWriter(condpipe)
+		defer condpipe.Close()
+
+		for name, cid := range added {
+			c := NewConditionWithID(cid, name)
+			if err := out.Write([]string{fmt.Sprintf("%d", c.ID), c.Name, c.Feature, c.Aspect}); err != nil {
+				streamerr <- PTOWrapError(err)
+				return
+			}
+		}
+
+		out.Flush()
+		if err := out.Error(); err != nil {
+			streamerr <- PTOWrapError(err)
+			return
+		}
+		streamerr <- nil
+	}()
+
+	// copy from the goroutine to the database
+	if _, err = db.CopyFrom(dbpipe, "COPY conditions (id, name, feature, aspect) FROM STDIN WITH CSV"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// wait for goroutine to complete and check its error
+	if err := <-streamerr; err != nil {
+		return err
+	}
+
+	cache.merge(added)
+	return nil
+}
+
+// clone returns a copy of this cache, for use in a transaction which may add
+// conditions.
+func (cache ConditionCache) clone() ConditionCache {
+	out := make(ConditionCache, len(cache))
+	out.merge(cache)
+	return out
+}
+
+// merge adds the conditions in another cache to this one.
+func (cache ConditionCache) merge(other ConditionCache) {
+	for name, cid := range other {
+		cache[name] = cid
+	}
+}
+
 // SetConditionID ensures the given condition has a valid ID. It keeps the
 // condition cache synchronized with the database if the condition is new.
 func (cache ConditionCache) SetConditionID(db orm.DB, c *Condition) error {
@@ -94,6 +209,8 @@ func (cache ConditionCache) SetConditionID(db orm.DB, c *Condition) error {
 	return nil
 }
 
+// Reload replaces the contents of the cache with the conditions in the
+// database, dropping the names of conditions since renamed or removed.
 func (cache ConditionCache) Reload(db orm.DB) error {
 	var conditions []Condition
 
@@ -101,42 +218,250 @@ func (cache ConditionCache) Reload(db orm.DB) error {
 		return PTOWrapError(err)
 	}
 
+	names := make(map[string]struct{}, len(conditions))
 	for _, c := range conditions {
 		cache[c.Name] = c.ID
+		names[c.Name] = struct{}{}
+	}
+
+	for name := range cache {
+		if _, ok := names[name]; !ok {
+			delete(cache, name)
+		}
 	}
 
 	return nil
 }
 
+// conditionNameMatches returns true if a condition name matches a pattern.
+// Patterns may contain one or more '*' wildcards, each of which matches any
+// (possibly empty) sequence of characters, including dots.
+func conditionNameMatches(pattern string, name string) bool {
+	parts := strings.Split(pattern, "*")
+
+	// no wildcard, exact match only
+	if len(parts) == 1 {
+		return pattern == name
+	}
+
+	// anchor first and last parts
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	if len(name) < len(last) || !strings.HasSuffix(name, last) {
+		return false
+	}
+	name = name[:len(name)-len(last)]
+
+	// and look for the middle parts in order
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+
+	return true
+}
+
+// conditionIsDescendant returns true if a condition name is below a parent
+// in the hierarchy of dotted condition names; e.g. pto.ecn.negotiated is a
+// descendant of pto.ecn and pto.
+func conditionIsDescendant(parent string, name string) bool {
+	return strings.HasPrefix(name, parent+".")
+}
+
+// Enforcement of the condition naming convention, as given in the
+// ConditionNaming configuration key
+const (
+	// Accept any condition name; the default
+	ConditionNamingOff = ""
+	// Accept any condition name, but log those violating the convention
+	ConditionNamingWarn = "warn"
+	// Refuse condition names violating the convention
+	ConditionNamingStrict = "strict"
+)
+
+// conditionComponentRegexp matches a component of a condition name following
+// the naming convention.
+var conditionComponentRegexp = regexp.MustCompile(`^[a-z][a-z0-9_]*$`)
+
+// ValidateConditionName returns an error with status 400 if a condition name
+// does not follow the PTO naming convention: a dotted hierarchy of at least
+// two components, each made of lowercase letters, digits, and underscores and
+// beginning with a letter, e.g. pto.ecn.negotiated. If any prefixes are given,
+// the first component must be one of them.
+func ValidateConditionName(name string, prefixes []string) error {
+	components := strings.Split(name, ".")
+	if len(components) < 2 {
+		return PTOErrorf("condition %s must have at least two dot-separated components", name).StatusIs(http.StatusBadRequest)
+	}
+
+	for _, component := range components {
+		if !conditionComponentRegexp.MatchString(component) {
+			return PTOErrorf("condition %s has component %q, which must be lowercase letters, digits, and underscores, beginning with a letter",
+				name, component).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	if len(prefixes) == 0 {
+		return nil
+	}
+	for _, prefix := range prefixes {
+		if components[0] == prefix {
+			return nil
+		}
+	}
+	return PTOErrorf("condition %s does not begin with a registered prefix (%s)",
+		name, strings.Join(prefixes, ", ")).StatusIs(http.StatusBadRequest)
+}
+
+// CheckConditionNames checks the names of the conditions declared in an
+// observation set against the naming convention, as configured by
+// ConditionNaming: in strict mode, it returns the error for the first name
+// violating the convention, and in warn mode, it logs each such name.
+func (config *PTOConfiguration) CheckConditionNames(set *ObservationSet) error {
+	if config.ConditionNaming == ConditionNamingOff {
+		return nil
+	}
+
+	for _, c := range set.Conditions {
+		if err := ValidateConditionName(c.Name, config.ConditionPrefixes); err != nil {
+			if config.ConditionNaming == ConditionNamingStrict {
+				return err
+			}
+			log.Printf("accepting condition violating naming convention: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// IsConditionWildcard returns true if a condition name contains a wildcard.
+func IsConditionWildcard(conditionName string) bool {
+	return strings.Contains(conditionName, "*")
+}
+
+// ConditionsByName resolves a condition name to a slice of conditions, sorted
+// by name. Names without wildcards resolve to the condition of that name and
+// all its descendants in the condition hierarchy, so that e.g. pto.ecn
+// resolves to pto.ecn.negotiated and pto.ecn.not_negotiated, and aliases to
+// the condition they alias and its descendants; names containing
+// '*' wildcards (e.g. pto.ecn.*) resolve to all matching conditions in the
+// database. Unknown names and wildcards matching nothing return a
+// StatusBadRequest error. As the cache is reloaded to resolve wildcards and
+// names it lacks, it must not be used concurrently with ConditionsByName.
 func (cache ConditionCache) ConditionsByName(db orm.DB, conditionName string) ([]Condition, error) {
-	var out []Condition
+	pattern, err := resolveConditionPattern(db, conditionName)
+	if err != nil {
+		return nil, err
+	}
 
-	if strings.HasSuffix(conditionName, ".*") {
-		// Wildcard. Reload cache and find everything that matches.
+	// wildcards may match conditions added since the cache was loaded;
+	// other names need the database only if the cache lacks them
+	if IsConditionWildcard(pattern) {
 		if err := cache.Reload(db); err != nil {
 			return nil, err
 		}
-		out = make([]Condition, 0)
-		for cachedName := range cache {
-			if strings.HasPrefix(cachedName, conditionName[:len(conditionName)-1]) {
-				out = append(out, *NewConditionWithID(cache[cachedName], cachedName))
-			}
+	}
+
+	out := cache.matchConditions(pattern)
+	if len(out) == 0 && !IsConditionWildcard(pattern) {
+		if err := cache.Reload(db); err != nil {
+			return nil, err
+		}
+		out = cache.matchConditions(pattern)
+	}
+
+	if len(out) == 0 {
+		return nil, noConditionsError(pattern)
+	}
+	return out, nil
+}
+
+// resolveConditionPattern returns the pattern a condition name given to
+// ConditionsByName is matched with: the name itself if it contains
+// wildcards, and otherwise the name of the condition it aliases, if any.
+func resolveConditionPattern(db orm.DB, conditionName string) (string, error) {
+	if IsConditionWildcard(conditionName) {
+		return conditionName, nil
+	}
+
+	aliased, err := resolveConditionAlias(db, conditionName)
+	if err != nil {
+		return "", err
+	}
+	return aliased.Name, nil
+}
+
+// noConditionsError returns the error for a condition pattern matching no
+// conditions.
+func noConditionsError(pattern string) error {
+	if IsConditionWildcard(pattern) {
+		return PTOErrorf("no conditions match %s", pattern).StatusIs(http.StatusBadRequest)
+	}
+	return PTOErrorf("unknown condition %s", pattern).StatusIs(http.StatusBadRequest)
+}
+
+// matchConditions returns the cached conditions matching a pattern, sorted by
+// name: for wildcards, all conditions matching it, and otherwise the
+// condition of that name and all its descendants.
+func (cache ConditionCache) matchConditions(pattern string) []Condition {
+	out := make([]Condition, 0)
+	for cachedName, id := range cache {
+		var match bool
+		if IsConditionWildcard(pattern) {
+			match = conditionNameMatches(pattern, cachedName)
+		} else {
+			match = cachedName == pattern || conditionIsDescendant(pattern, cachedName)
+		}
+		if match {
+			out = append(out, *NewConditionWithID(id, cachedName))
 		}
-	} else {
-		// No wildcard, just look up by name.
-		if cache[conditionName] == 0 {
-			if err := cache.Reload(db); err != nil {
-				return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// ExpandConditionsInSet replaces any wildcard conditions declared in an
+// observation set with the existing conditions they match, and any aliases
+// with the conditions they alias, so that only concrete conditions are linked
+// to the set. Other conditions are left alone, and will be inserted along
+// with the set if new.
+func (cache ConditionCache) ExpandConditionsInSet(db orm.DB, set *ObservationSet) error {
+	out := make([]Condition, 0, len(set.Conditions))
+	seen := make(map[string]struct{})
+
+	aliases, err := LoadConditionAliases(db)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range set.Conditions {
+		expanded := []Condition{c}
+		if IsConditionWildcard(c.Name) {
+			var err error
+			if expanded, err = cache.ConditionsByName(db, c.Name); err != nil {
+				return err
 			}
+		} else if aliased, ok := aliases[c.Name]; ok {
+			expanded = []Condition{*NewCondition(aliased)}
 		}
-		if cache[conditionName] == 0 {
-			return nil, PTOErrorf("unknown condition %s", conditionName).StatusIs(http.StatusBadRequest)
+
+		for _, ec := range expanded {
+			if _, ok := seen[ec.Name]; !ok {
+				seen[ec.Name] = struct{}{}
+				out = append(out, ec)
+			}
 		}
-		out = make([]Condition, 1)
-		out[0] = *NewConditionWithID(cache[conditionName], conditionName)
 	}
 
-	return out, nil
+	set.Conditions = out
+	return nil
 }
 
 func (cache ConditionCache) Names() []string {
@@ -163,3 +488,84 @@ func LoadConditionCache(db orm.DB) (ConditionCache, error) {
 	return cache, nil
 
 }
+
+// ConditionNode is a node in the hierarchy of dotted condition names. Each
+// node is named by the full dotted prefix it represents; e.g. the node for
+// pto.ecn has a child named pto.ecn.negotiated.
+type ConditionNode struct {
+	// Full dotted name of the node
+	Name string `json:"name"`
+	// True if a condition with this name exists, false if the node is only a
+	// prefix of other conditions
+	Condition bool `json:"condition"`
+	// Number of observations of this condition and all its descendants
+	Count int `json:"count"`
+	// Child nodes, sorted by name
+	Children []*ConditionNode `json:"children,omitempty"`
+}
+
+// BuildConditionTree arranges conditions into a hierarchy by their dotted
+// names, given a map of condition names to observation counts. It returns
+// the top-level nodes, sorted by name.
+func BuildConditionTree(counts map[string]int) []*ConditionNode {
+	root := &ConditionNode{}
+	nodes := make(map[string]*ConditionNode)
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		parent := root
+		parts := strings.Split(name, ".")
+		for i := range parts {
+			prefix := strings.Join(parts[:i+1], ".")
+			node, ok := nodes[prefix]
+			if !ok {
+				node = &ConditionNode{Name: prefix}
+				nodes[prefix] = node
+				parent.Children = append(parent.Children, node)
+			}
+			node.Count += counts[name]
+			parent = node
+		}
+		parent.Condition = true
+	}
+
+	root.sortChildren()
+	return root.Children
+}
+
+func (node *ConditionNode) sortChildren() {
+	sort.Slice(node.Children, func(i, j int) bool { return node.Children[i].Name < node.Children[j].Name })
+	for _, child := range node.Children {
+		child.sortChildren()
+	}
+}
+
+// LoadConditionTree builds the hierarchy of all conditions in a given
+// database, with observation counts taken from the observation rollups of
+// public sets which have not been deleted.
+func LoadConditionTree(db orm.DB) ([]*ConditionNode, error) {
+	var results []struct {
+		Name  string
+		Count int
+	}
+
+	if _, err := db.Query(&results,
+		`SELECT conditions.name, coalesce(sum(observation_rollups.count), 0) AS count
+		 FROM conditions LEFT JOIN observation_rollups ON observation_rollups.condition_id = conditions.id
+		 AND observation_rollups.set_id NOT IN (`+restrictedSetsClause+`)
+		 GROUP BY conditions.name`); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Name] = result.Count
+	}
+
+	return BuildConditionTree(counts), nil
+}
@@ -4,16 +4,45 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 
 	"github.com/go-pg/pg"
 )
 
+// Names of features which can be enabled or disabled in the Features
+// configuration key.
+const (
+	// Query API and query cache under /query
+	FeatureQueryCache = "query_cache"
+	// Change journal and /changes
+	FeatureChangeJournal = "change_journal"
+	// Fetching raw data from URLs via /raw/<campaign>/fetch
+	FeatureFetch = "fetch"
+	// Condition registry under /obs/conditions/registry
+	FeatureConditionRegistry = "condition_registry"
+)
+
+// DefaultFeatures lists the features which can be enabled or disabled, and
+// whether each is enabled if not given in the configuration.
+var DefaultFeatures = map[string]bool{
+	FeatureQueryCache:        true,
+	FeatureChangeJournal:     true,
+	FeatureFetch:             true,
+	FeatureConditionRegistry: true,
+}
+
 // PTOConfiguration contains a configuration of a PTO server
 type PTOConfiguration struct {
-	// Address/port to bind to
+	// Addresses and ports to bind to, separated by commas or spaces; see
+	// ListenAddresses
 	BindTo string
 
 	// base URL of web service
@@ -33,6 +62,11 @@ type PTOConfiguration struct {
 	// Private key file path
 	PrivateKeyFile string
 
+	// Obtain and renew certificates automatically via ACME (e.g. Let's
+	// Encrypt) instead of reading CertificateFile and PrivateKeyFile; nil
+	// not to
+	ACME *ACMEOptions
+
 	// File to serve for / (empty == serve paths to enabled apps)
 	RootFile string
 
@@ -45,11 +79,35 @@ type PTOConfiguration struct {
 	// Filetype registry for RDS.
 	ContentTypes map[string]string
 
+	// Virtual metadata providers to run for raw data files, by filetype; see
+	// VirtualMetadataProvider
+	VirtualMetadata map[string][]string
+
 	// base path for query cache data store; empty for no query cache.
 	QueryCacheRoot string
 
-	// PostgreSQL options for connection to observation database; leave default for no OBS.
-	ObsDatabase pg.Options
+	// Store query results zstd-compressed in the query cache
+	CompressQueryCache bool
+
+	// PostgreSQL options for connection to observation database, and for
+	// loading observations into it; leave default for no OBS.
+	ObsDatabase ObsDatabaseOptions
+	obsHealth   *DBHealth
+
+	// PostgreSQL options for connection to a read-only replica of the
+	// observation database, to which queries and observation set downloads
+	// are routed, sparing the primary for loading observations; nil to run
+	// them against ObsDatabase.
+	ObsReplicaDatabase *pg.Options
+
+	// Partitioning of the observations table, applied by ptodb init and
+	// migrate; nil for an unpartitioned table
+	ObservationPartitioning *ObservationPartitioning
+
+	// Additional indexes on the observations table, applied by ptodb init,
+	// migrate, and index; nil to leave configured indexes alone, empty to
+	// drop them all
+	ObservationIndexes []ObservationIndex
 
 	// Page size for things that can be paginated
 	PageLength int
@@ -60,19 +118,166 @@ type PTOConfiguration struct {
 	// Number of concurrent queries
 	ConcurrentQueries int
 
+	// Lifetime of cached responses to requests with an Idempotency-Key, in seconds
+	IdempotencyKeyLifetime int
+
+	// Largest number of responses to requests with an Idempotency-Key cached
+	// by each API
+	IdempotencyCacheSize int
+
+	// Lifetime of the cached condition tree, in seconds
+	ConditionTreeLifetime int
+
+	// URL schemes the raw data store may fetch data from
+	FetchSchemes []string
+
+	// Maximum size of data fetched by the raw data store, in bytes
+	FetchMaxSize int64
+
+	// Maximum time to fetch data into the raw data store, in seconds
+	FetchTimeout int
+
+	// Networks, in CIDR notation, to which requests to URLs chosen by
+	// clients may be made even though their addresses are not public, e.g.
+	// for other PTOs on an internal network; see OutboundClient
+	OutboundNetworks       []string
+	outboundTransportValue *http.Transport
+	outboundTransportOnce  sync.Once
+
+	// API keys to present to other PTOs when fetching the metadata and data
+	// of external observation sets, by host
+	FederationAPIKeys map[string]string
+
+	// Proxy the data of external observation sets, instead of redirecting
+	// clients to the PTO it lives on
+	ProxyExternalSets bool
+
+	// Minimum size of raw data files stored compressed in the zstd seekable
+	// format, in bytes; 0 to store all files as uploaded
+	SeekableCompressionThreshold int64
+
+	// Path to a keyfile holding the key encryption keys for campaign data
+	// keys, 32 bytes in hex each, current key last; see NewLocalKeyWrapper
+	EncryptionKeyFile string
+
+	// Key management service holding the key encryption key for campaign
+	// data keys, instead of a keyfile
+	EncryptionKMS  *KMSOptions
+	keyWrapper     KeyWrapper
+	keyWrapperErr  error
+	keyWrapperOnce sync.Once
+
+	// Differentially private queries; nil to disable them. See
+	// PrivacyOptions.
+	DifferentialPrivacy *PrivacyOptions
+
+	// Ceilings on the resources used by each client's queries; nil not to
+	// limit or charge usage. See QueryLimitOptions.
+	QueryLimits *QueryLimitOptions
+
+	// Limits on the rate and concurrency of each client's requests; nil not
+	// to limit requests. See RateLimiter.
+	RateLimits      *RateLimitOptions
+	rateLimiter     *RateLimiter
+	rateLimiterOnce sync.Once
+
+	// Minimum number of distinct paths and vantage points a group in query
+	// results must refer to in order to be served to clients other than the
+	// query's submitter; 0 to serve all groups to everyone.
+	KAnonymity int
+
+	// Maximum rate of background data transfers, in bytes per second; 0 for
+	// no limit. See BackgroundLimiter.
+	BackgroundBandwidth   int64
+	backgroundLimiter     *BandwidthLimiter
+	backgroundLimiterOnce sync.Once
+
+	// URL to POST alerts to when query results breach alerting rules
+	AlertURL string
+
+	// Path to file in which to keep query callbacks and alerts until they
+	// have been delivered; empty to keep them in memory only. See
+	// DeliveryQueue.
+	DeliveryQueuePath string
+
+	// Number of attempts to deliver a callback or alert before giving up
+	DeliveryAttempts int
+
+	// Delay before retrying a failed delivery, in seconds, doubled for each
+	// further retry
+	DeliveryBackoff   int
+	deliveryQueue     *DeliveryQueue
+	deliveryQueueErr  error
+	deliveryQueueOnce sync.Once
+
+	// Path to change journal file; empty for no change journal.
+	ChangeJournalPath string
+	journal           *ChangeJournal
+	journalErr        error
+	journalOnce       sync.Once
+
+	// Directory in which to keep the ingest log of accepted observation
+	// uploads; empty for no ingest log.
+	IngestLogPath string
+	ingestLog     *IngestLog
+	ingestLogErr  error
+	ingestLogOnce sync.Once
+
+	// Interval between consistency checks of the observation database and
+	// raw data store, in seconds; 0 to check only on request. See
+	// ConsistencyChecker.
+	ConsistencyCheckInterval int
+
+	// Enforcement of the condition naming convention on conditions declared
+	// in uploaded observation sets: ConditionNamingOff, ConditionNamingWarn, or
+	// ConditionNamingStrict; see ValidateConditionName
+	ConditionNaming string
+
+	// Top-level condition name components allowed by the naming convention;
+	// empty to allow any
+	ConditionPrefixes []string
+
+	// Features to enable or disable, by name; see DefaultFeatures
+	Features map[string]bool
+
+	// Deprecated API features, by feature name; see Deprecation
+	Deprecations map[string]*Deprecation
+	deprecations *DeprecationTracker
+
 	// Access logging file path
 	AccessLogPath string
-	accessLogger  *log.Logger
+
+	// Access log format: pto (the default), common, combined, or json; see
+	// AccessLog
+	AccessLogFormat string
+	accessLog       *AccessLog
+
+	// Authorization decision log, for audited access; nil not to log
+	// decisions. See AuthLogOptions.
+	AuthLog *AuthLogOptions
+	authLog *AuthLog
 
 	// Path to configuration file
 	ConfigFilePath string
 }
 
-// LinkTo creates a link to a relative URL from the configuration's base URL
+// LinkTo creates a link to a URL relative to the root of the current version
+// of the API, under the configuration's base URL
 func (config *PTOConfiguration) LinkTo(relative string) (string, error) {
+	return config.LinkToVersion(APIVersion, relative)
+}
+
+// LinkToVersion creates a link to a URL relative to the root of a given
+// version of the API, under the configuration's base URL. A relative URL
+// which already starts with a version prefix is linked as it is.
+func (config *PTOConfiguration) LinkToVersion(version int, relative string) (string, error) {
 	// Make sure relative doesn't start with a '/'. See #119.
 	relative = strings.TrimPrefix(relative, "/")
 
+	if _, _, ok := SplitAPIVersion(relative); !ok {
+		relative = APIVersionPrefix(version) + "/" + relative
+	}
+
 	u, err := url.Parse(relative)
 	if err != nil {
 		return "", PTOWrapError(err)
@@ -81,9 +286,351 @@ func (config *PTOConfiguration) LinkTo(relative string) (string, error) {
 	return config.baseURL.ResolveReference(u).String(), nil
 }
 
-// AccessLogger returns a logger for the web API to log accesses to
-func (config *PTOConfiguration) AccessLogger() *log.Logger {
-	return config.accessLogger
+// apiPathForLink returns the path of a link relative to the root of the API,
+// without a leading '/'. Links from before paths were versioned are accepted
+// as well as links to any version. It returns false if the link is not
+// served from the configuration's base URL.
+func (config *PTOConfiguration) apiPathForLink(link string) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != config.baseURL.Scheme || u.Host != config.baseURL.Host {
+		return "", false
+	}
+
+	if !strings.HasPrefix(u.Path, config.baseURL.Path) {
+		return "", false
+	}
+
+	_, path, _ := SplitAPIVersion("/" + strings.TrimPrefix(u.Path, config.baseURL.Path))
+	return strings.TrimPrefix(path, "/"), true
+}
+
+// RawFileForLink returns the campaign and file names of a raw data file given
+// a link to its metadata from LinkTo, e.g. from an observation set's
+// _sources. It returns false if the link does not refer to a raw data file
+// served from the configuration's base URL.
+func (config *PTOConfiguration) RawFileForLink(link string) (string, string, bool) {
+	path, ok := config.apiPathForLink(link)
+	if !ok || !strings.HasPrefix(path, "raw/") {
+		return "", "", false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "raw/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// ObservationSetIDForLink returns the ID of an observation set given its
+// link, as generated by LinkForSetID. It returns false if the link does not
+// refer to an observation set served from the configuration's base URL.
+func (config *PTOConfiguration) ObservationSetIDForLink(link string) (int, bool) {
+	path, ok := config.apiPathForLink(link)
+	if !ok || !strings.HasPrefix(path, "obs/") {
+		return 0, false
+	}
+
+	setid, err := strconv.ParseUint(strings.TrimPrefix(path, "obs/"), 16, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return int(setid), true
+}
+
+// IdempotencyKeyLifetimeDuration returns the lifetime of cached responses to
+// requests with an Idempotency-Key as a duration.
+func (config *PTOConfiguration) IdempotencyKeyLifetimeDuration() time.Duration {
+	return time.Duration(config.IdempotencyKeyLifetime) * time.Second
+}
+
+// ConditionTreeLifetimeDuration returns the lifetime of the cached condition
+// tree as a duration.
+func (config *PTOConfiguration) ConditionTreeLifetimeDuration() time.Duration {
+	return time.Duration(config.ConditionTreeLifetime) * time.Second
+}
+
+// FeatureEnabled returns true if the named feature is enabled, either in the
+// configuration's Features or by default.
+func (config *PTOConfiguration) FeatureEnabled(feature string) bool {
+	if enabled, ok := config.Features[feature]; ok {
+		return enabled
+	}
+	return DefaultFeatures[feature]
+}
+
+// ChangeJournal returns the change journal, opening it on first use, or nil
+// if no change journal is configured or the change journal is disabled.
+func (config *PTOConfiguration) ChangeJournal() (*ChangeJournal, error) {
+	if config.ChangeJournalPath == "" || !config.FeatureEnabled(FeatureChangeJournal) {
+		return nil, nil
+	}
+
+	config.journalOnce.Do(func() {
+		config.journal, config.journalErr = OpenChangeJournal(config.ChangeJournalPath)
+	})
+
+	return config.journal, config.journalErr
+}
+
+// IngestLog returns the ingest log, opening it on first use, or nil if no
+// ingest log is configured.
+func (config *PTOConfiguration) IngestLog() (*IngestLog, error) {
+	if config.IngestLogPath == "" {
+		return nil, nil
+	}
+
+	config.ingestLogOnce.Do(func() {
+		config.ingestLog, config.ingestLogErr = OpenIngestLog(config.IngestLogPath)
+	})
+
+	return config.ingestLog, config.ingestLogErr
+}
+
+// BackgroundLimiter returns the bandwidth limiter shared by all background
+// data transfers using this configuration, i.e. fetching raw data from URLs
+// and publishing snapshots, which limits them together to the configured
+// BackgroundBandwidth. It returns nil if their bandwidth is not limited.
+func (config *PTOConfiguration) BackgroundLimiter() *BandwidthLimiter {
+	config.backgroundLimiterOnce.Do(func() {
+		config.backgroundLimiter = NewBandwidthLimiter(config.BackgroundBandwidth)
+	})
+
+	return config.backgroundLimiter
+}
+
+// RateLimiter returns the limiter admitting the requests of each client of
+// the web API within its configured RateLimits. It returns nil if requests
+// are not limited.
+func (config *PTOConfiguration) RateLimiter() *RateLimiter {
+	config.rateLimiterOnce.Do(func() {
+		config.rateLimiter = NewRateLimiter(config.RateLimits)
+	})
+
+	return config.rateLimiter
+}
+
+// KeyWrapper returns the KeyWrapper for campaign data keys, loading the key
+// encryption key on first use, or nil if none is configured.
+func (config *PTOConfiguration) KeyWrapper() (KeyWrapper, error) {
+	config.keyWrapperOnce.Do(func() {
+		if config.EncryptionKMS != nil {
+			config.keyWrapper, config.keyWrapperErr = NewKMSKeyWrapper(config.EncryptionKMS)
+		} else if config.EncryptionKeyFile != "" {
+			config.keyWrapper, config.keyWrapperErr = NewLocalKeyWrapper(config.EncryptionKeyFile)
+		}
+	})
+
+	return config.keyWrapper, config.keyWrapperErr
+}
+
+// DeliveryQueue returns the queue delivering query callbacks and alerts,
+// opening it and starting delivery on first use.
+func (config *PTOConfiguration) DeliveryQueue() (*DeliveryQueue, error) {
+	config.deliveryQueueOnce.Do(func() {
+		config.deliveryQueue, config.deliveryQueueErr = OpenDeliveryQueue(config.DeliveryQueuePath,
+			config.DeliveryAttempts, time.Duration(config.DeliveryBackoff)*time.Second,
+			config.OutboundClient(30*time.Second))
+	})
+
+	return config.deliveryQueue, config.deliveryQueueErr
+}
+
+// Deprecation returns the deprecation of the named API feature, or nil if
+// the feature is not deprecated.
+func (config *PTOConfiguration) Deprecation(feature string) *Deprecation {
+	return config.Deprecations[feature]
+}
+
+// DeprecationTracker returns the tracker counting uses of deprecated API
+// features.
+func (config *PTOConfiguration) DeprecationTracker() *DeprecationTracker {
+	return config.deprecations
+}
+
+// ObsDatabaseHealth returns the tracker of the health of the connections to
+// the observation database, shared by all its users in this process.
+func (config *PTOConfiguration) ObsDatabaseHealth() *DBHealth {
+	return config.obsHealth
+}
+
+// AccessLog returns the log for the web API to log accesses to
+func (config *PTOConfiguration) AccessLog() *AccessLog {
+	return config.accessLog
+}
+
+// AuthDecisionLog returns the log for the web API to log authorization
+// decisions to, or nil if decisions are not logged.
+func (config *PTOConfiguration) AuthDecisionLog() *AuthLog {
+	return config.authLog
+}
+
+// ObsDatabaseOptions configures the connection to the observation database,
+// with the keys of pg.Options, and how observations are loaded into it.
+type ObsDatabaseOptions struct {
+	pg.Options
+
+	// Number of observations inserted into the database at once when loading
+	// observation data; ObservationBatchSize if 0. Each upload is loaded in a
+	// single transaction however many batches it takes, so larger batches
+	// trade memory for fewer round trips.
+	BatchSize int
+
+	// synchronous_commit setting for transactions loading observation data,
+	// e.g. off to trade durability of the most recent uploads in a crash for
+	// throughput; empty for the database's setting.
+	SynchronousCommit string
+
+	// Number of consecutive failures to reach the database after which
+	// requests needing it fail fast for BreakerCooldown; 5 if 0, never if
+	// negative. See DBHealth.
+	BreakerThreshold int
+
+	// Seconds requests needing the database fail fast for once
+	// BreakerThreshold is reached; 30 if 0.
+	BreakerCooldown int
+
+	// Number of observations deleted at once, each batch in its own
+	// transaction, when purging an observation set whose observations are
+	// not in a partition of their own; ObservationDeleteBatchSize if 0.
+	DeleteBatchSize int
+
+	// Milliseconds to pause between batches of deleted observations, so that
+	// autovacuum and other writers can keep up; 0 not to pause.
+	DeletePause int
+
+	// Rehydrate the trimmed observation sets a query may select from their
+	// bundles in the raw data store before executing it, so that archived
+	// data stays queryable, at the cost of loading it back on demand.
+	RehydrateOnQuery bool
+
+	// Scan the bundles of the trimmed observation sets a query may select
+	// alongside the database while executing it, leaving the sets trimmed,
+	// so that archived data stays queryable without taking space in the
+	// database, at the cost of reading the bundles at every query.
+	QueryArchivedSets bool
+}
+
+// ConnectObsReplica connects to the read-only replica of the observation
+// database, if one is configured, or returns the given connection to the
+// primary otherwise.
+func (config *PTOConfiguration) ConnectObsReplica(primary *pg.DB) *pg.DB {
+	if config.ObsReplicaDatabase == nil || config.ObsReplicaDatabase.Database == "" {
+		return primary
+	}
+	return pg.Connect(config.ObsReplicaDatabase)
+}
+
+// ServesTLS returns true if this configuration has a certificate and private
+// key to serve HTTPS with, or obtains certificates via ACME.
+func (config *PTOConfiguration) ServesTLS() bool {
+	return (config.CertificateFile != "" && config.PrivateKeyFile != "") || config.ACME != nil
+}
+
+// ListenAddresses returns the addresses to listen on given in BindTo, each as
+// host:port. Addresses are separated by commas or spaces. An address without
+// a port, such as 192.0.2.1 or [2001:db8::1], listens on the default port,
+// 443 when serving TLS and 80 otherwise, and a bare port such as 8383 or
+// :8383 listens on all interfaces. Without any addresses, the server listens
+// on the default port on all interfaces. It returns an error if an address
+// is malformed or given twice.
+func (config *PTOConfiguration) ListenAddresses() ([]string, error) {
+	defaultPort := "80"
+	if config.ServesTLS() {
+		defaultPort = "443"
+	}
+
+	fields := strings.FieldsFunc(config.BindTo, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(fields) == 0 {
+		return []string{":" + defaultPort}, nil
+	}
+
+	out := make([]string, 0, len(fields))
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		var addr string
+		if _, err := strconv.ParseUint(strings.TrimPrefix(field, ":"), 10, 16); err == nil {
+			// bare port
+			addr = ":" + strings.TrimPrefix(field, ":")
+		} else if host, port, err := net.SplitHostPort(field); err == nil {
+			if port == "" {
+				port = defaultPort
+			}
+			addr = net.JoinHostPort(host, port)
+		} else if ip := net.ParseIP(strings.Trim(field, "[]")); ip != nil || !strings.ContainsAny(field, ":[]") {
+			// address or host name without port
+			addr = net.JoinHostPort(strings.Trim(field, "[]"), defaultPort)
+		} else {
+			return nil, PTOErrorf("bad address %s to bind to: %s", field, err.Error())
+		}
+
+		if seen[addr] {
+			return nil, PTOErrorf("address %s to bind to given twice", addr)
+		}
+		seen[addr] = true
+		out = append(out, addr)
+	}
+
+	return out, nil
+}
+
+// synchronousCommitSettings lists the values of PostgreSQL's
+// synchronous_commit setting.
+var synchronousCommitSettings = map[string]bool{
+	"on":           true,
+	"off":          true,
+	"local":        true,
+	"remote_write": true,
+	"remote_apply": true,
+}
+
+func (opts *ObsDatabaseOptions) validate() error {
+	if opts.BatchSize < 0 {
+		return PTOErrorf("ObsDatabase BatchSize may not be negative")
+	}
+	if opts.BreakerCooldown < 0 {
+		return PTOErrorf("ObsDatabase BreakerCooldown may not be negative")
+	}
+	if opts.DeleteBatchSize < 0 {
+		return PTOErrorf("ObsDatabase DeleteBatchSize may not be negative")
+	}
+	if opts.DeletePause < 0 {
+		return PTOErrorf("ObsDatabase DeletePause may not be negative")
+	}
+	if opts.SynchronousCommit != "" && !synchronousCommitSettings[opts.SynchronousCommit] {
+		return PTOErrorf("unknown ObsDatabase SynchronousCommit %s", opts.SynchronousCommit)
+	}
+	return nil
+}
+
+// batchSize returns the number of observations to insert at once, allowing
+// for nil options.
+func (opts *ObsDatabaseOptions) batchSize() int {
+	if opts == nil || opts.BatchSize == 0 {
+		return ObservationBatchSize
+	}
+	return opts.BatchSize
+}
+
+// deleteBatchSize returns the number of observations to delete at once,
+// allowing for nil options.
+func (opts *ObsDatabaseOptions) deleteBatchSize() int {
+	if opts == nil || opts.DeleteBatchSize == 0 {
+		return ObservationDeleteBatchSize
+	}
+	return opts.DeleteBatchSize
+}
+
+// deletePause returns the time to pause between batches of deleted
+// observations, allowing for nil options.
+func (opts *ObsDatabaseOptions) deletePause() time.Duration {
+	if opts == nil {
+		return 0
+	}
+	return time.Duration(opts.DeletePause) * time.Millisecond
 }
 
 func NewConfigFromJSON(b []byte) (*PTOConfiguration, error) {
@@ -104,14 +651,98 @@ func NewConfigFromJSON(b []byte) (*PTOConfiguration, error) {
 		return nil, err
 	}
 
-	if config.AccessLogPath == "" {
-		config.accessLogger = log.New(os.Stderr, "", log.LstdFlags)
-	} else {
-		accessLogFile, err := os.Open(config.AccessLogPath)
+	if config.accessLog, err = NewAccessLog(config.AccessLogPath, config.AccessLogFormat); err != nil {
+		return nil, err
+	}
+
+	if config.AuthLog != nil {
+		if err := config.AuthLog.validate(); err != nil {
+			return nil, err
+		}
+		sink, err := NewAuthDecisionFile(config.AuthLog.Path)
 		if err != nil {
 			return nil, err
 		}
-		config.accessLogger = log.New(accessLogFile, "access: ", log.LstdFlags)
+		config.authLog = NewAuthLog(sink, config.AuthLog)
+	}
+
+	config.deprecations = NewDeprecationTracker()
+
+	// warn about, but tolerate, flags for features this server doesn't know,
+	// so configurations can be shared with other versions
+	for feature := range config.Features {
+		if _, ok := DefaultFeatures[feature]; !ok {
+			log.Printf("ignoring unknown feature %s in configuration", feature)
+		}
+	}
+
+	switch config.ConditionNaming {
+	case ConditionNamingOff, ConditionNamingWarn, ConditionNamingStrict:
+	default:
+		return nil, PTOErrorf("unknown condition naming enforcement %s; must be %s or %s",
+			config.ConditionNaming, ConditionNamingWarn, ConditionNamingStrict)
+	}
+
+	if config.EncryptionKMS != nil && config.EncryptionKeyFile != "" {
+		return nil, PTOErrorf("only one of EncryptionKeyFile and EncryptionKMS may be configured")
+	}
+
+	if dp := config.DifferentialPrivacy; dp != nil && (dp.Budget <= 0 || dp.MaxEpsilon < 0 || dp.BudgetPeriod < 0) {
+		return nil, PTOErrorf("DifferentialPrivacy needs a positive Budget, and MaxEpsilon and BudgetPeriod may not be negative")
+	}
+
+	if config.QueryLimits != nil {
+		if err := config.QueryLimits.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.RateLimits != nil {
+		if err := config.RateLimits.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := config.ObsDatabase.validate(); err != nil {
+		return nil, err
+	}
+
+	for _, cidr := range config.OutboundNetworks {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, PTOErrorf("bad network %s in OutboundNetworks: %s", cidr, err.Error())
+		}
+	}
+
+	if config.FetchTimeout < 0 {
+		return nil, PTOErrorf("FetchTimeout may not be negative")
+	}
+
+	if config.ConsistencyCheckInterval < 0 {
+		return nil, PTOErrorf("ConsistencyCheckInterval may not be negative")
+	}
+
+	if config.KAnonymity < 0 {
+		return nil, PTOErrorf("KAnonymity may not be negative")
+	}
+
+	// virtual metadata providers are needed for every file of a filetype, so
+	// refuse to start without them
+	for filetype, names := range config.VirtualMetadata {
+		for _, name := range names {
+			if VirtualMetadataProviderByName(name) == nil {
+				return nil, PTOErrorf("unknown virtual metadata provider %s for filetype %s; available providers are %s",
+					name, filetype, strings.Join(VirtualMetadataProviderNames(), ", "))
+			}
+		}
+	}
+
+	// observation set bundles are served as observation set files unless
+	// configured otherwise
+	if config.ContentTypes == nil {
+		config.ContentTypes = make(map[string]string)
+	}
+	if _, ok := config.ContentTypes[ObsBundleFiletype]; !ok {
+		config.ContentTypes[ObsBundleFiletype] = ObsBundleContentType
 	}
 
 	// default page length is 1000
@@ -129,6 +760,47 @@ func NewConfigFromJSON(b []byte) (*PTOConfiguration, error) {
 		config.ConcurrentQueries = 8
 	}
 
+	// default idempotency key lifetime is one day
+	if config.IdempotencyKeyLifetime == 0 {
+		config.IdempotencyKeyLifetime = 86400
+	}
+
+	// default idempotency cache size is ten thousand responses
+	if config.IdempotencyCacheSize == 0 {
+		config.IdempotencyCacheSize = 10000
+	}
+
+	// default condition tree lifetime is five minutes
+	if config.ConditionTreeLifetime == 0 {
+		config.ConditionTreeLifetime = 300
+	}
+
+	// default fetch scheme is https only
+	if config.FetchSchemes == nil {
+		config.FetchSchemes = []string{"https"}
+	}
+
+	// default is eight delivery attempts, the last about two hours after the
+	// first
+	if config.DeliveryAttempts == 0 {
+		config.DeliveryAttempts = 8
+	}
+
+	// default delivery backoff is one minute
+	if config.DeliveryBackoff == 0 {
+		config.DeliveryBackoff = 60
+	}
+
+	// default maximum fetch size is 1 GiB
+	if config.FetchMaxSize == 0 {
+		config.FetchMaxSize = 1 << 30
+	}
+
+	// default fetch timeout is one hour
+	if config.FetchTimeout == 0 {
+		config.FetchTimeout = 3600
+	}
+
 	// default pool size is 20; if this is 0, pgo-pg will set the pool size
 	// to 10 times the number of processors. on the main machine which runs
 	// ptosrv, we have 56 processors, which means that calling pg.Connect
@@ -136,6 +808,24 @@ func NewConfigFromJSON(b []byte) (*PTOConfiguration, error) {
 	// which is 1024.
 	config.ObsDatabase.PoolSize = 20
 
+	// by default, queries failing because the database is unreachable are
+	// retried twice, with go-pg's default backoff; -1 disables retries
+	if config.ObsDatabase.MaxRetries == 0 {
+		config.ObsDatabase.MaxRetries = 2
+	} else if config.ObsDatabase.MaxRetries < 0 {
+		config.ObsDatabase.MaxRetries = 0
+	}
+
+	// by default, fail fast for 30 seconds after 5 consecutive failures
+	if config.ObsDatabase.BreakerThreshold == 0 {
+		config.ObsDatabase.BreakerThreshold = 5
+	}
+	if config.ObsDatabase.BreakerCooldown == 0 {
+		config.ObsDatabase.BreakerCooldown = 30
+	}
+	config.obsHealth = NewDBHealth(config.ObsDatabase.BreakerThreshold,
+		time.Duration(config.ObsDatabase.BreakerCooldown)*time.Second)
+
 	return &config, nil
 }
 
@@ -0,0 +1,370 @@
+package pto3
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// The observation database and the raw data store refer to each other, but
+// nothing keeps them consistent once files are removed from the raw data
+// store or rows from the database by hand, or a bundle is corrupted on disk.
+// A consistency check walks both stores and reports every reference which no
+// longer holds: observation set sources which do not resolve, provenance
+// which no longer matches _sources, bundles whose link back to their set is
+// broken, and cached counts and archived digests which do not match the data.
+
+// Kinds of discrepancy found by a consistency check.
+const (
+	// A source in an observation set's _sources refers to a raw data file or
+	// observation set on this PTO which does not exist
+	DiscrepancyUnresolvedSource = "unresolved_source"
+	// The provenance stored for an observation set does not match its
+	// _sources
+	DiscrepancyUnlinkedSources = "unlinked_sources"
+	// The cached observation count of a set does not match the observations
+	// in the database, or the count archived with its bundle
+	DiscrepancyCountMismatch = "count_mismatch"
+	// The bundle an observation set was archived to is not in the raw data
+	// store
+	DiscrepancyMissingBundle = "missing_bundle"
+	// The digest of a bundle is not the one recorded when it was archived
+	DiscrepancyDigestMismatch = "digest_mismatch"
+	// A raw data file names, in its _archived_set metadata, an observation
+	// set which does not exist or was not archived to it
+	DiscrepancyMissingDerivedSet = "missing_derived_set"
+)
+
+// Discrepancy describes a reference between the observation database and
+// the raw data store which does not hold.
+type Discrepancy struct {
+	// Kind of discrepancy, one of the Discrepancy constants
+	Kind string `json:"kind"`
+	// Link to the observation set or raw data file the discrepancy was found
+	// on
+	Subject string `json:"subject"`
+	// Description of the discrepancy
+	Detail string `json:"detail"`
+}
+
+// ConsistencyReport is the result of a consistency check.
+type ConsistencyReport struct {
+	// Time the check started
+	Started time.Time `json:"started"`
+	// Time the check finished, nil if it was stopped by an error
+	Finished *time.Time `json:"finished,omitempty"`
+	// Number of observation sets checked
+	SetsChecked int `json:"sets_checked"`
+	// Number of raw data files checked
+	RawFilesChecked int `json:"raw_files_checked"`
+	// Discrepancies found, in the order they were found
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	// Error which stopped the check before it was complete, if any
+	Error string `json:"error,omitempty"`
+}
+
+// add records a discrepancy in this report.
+func (cr *ConsistencyReport) add(kind string, subject string, format string, args ...interface{}) {
+	cr.Discrepancies = append(cr.Discrepancies, Discrepancy{Kind: kind, Subject: subject, Detail: fmt.Sprintf(format, args...)})
+}
+
+// CheckConsistency checks the references between the observation database
+// and the raw data store, and returns a report of the discrepancies found.
+// If no raw data store is given, only references within the observation
+// database are checked. An error stops the check; the report of what was
+// checked so far is returned along with it.
+func CheckConsistency(db orm.DB, config *PTOConfiguration, rds *RawDataStore) (*ConsistencyReport, error) {
+	cr := &ConsistencyReport{Started: time.Now().UTC(), Discrepancies: make([]Discrepancy, 0)}
+
+	setIds, err := AllObservationSetIDs(db)
+	if err != nil {
+		return cr, err
+	}
+
+	for _, setid := range setIds {
+		if err := cr.checkSet(db, config, rds, setid); err != nil {
+			return cr, err
+		}
+		cr.SetsChecked++
+	}
+
+	if rds != nil {
+		if err := rds.ScanCampaigns(); err != nil {
+			return cr, err
+		}
+
+		for _, camname := range rds.CampaignNames() {
+			if err := cr.checkCampaign(db, config, rds, camname); err != nil {
+				return cr, err
+			}
+		}
+	}
+
+	finished := time.Now().UTC()
+	cr.Finished = &finished
+	return cr, nil
+}
+
+// checkSet checks the sources, provenance, count, and archive of an
+// observation set.
+func (cr *ConsistencyReport) checkSet(db orm.DB, config *PTOConfiguration, rds *RawDataStore, setid int) error {
+	set := ObservationSet{ID: setid}
+	if err := set.SelectByID(db); err == pg.ErrNoRows {
+		// deleted since the check started
+		return nil
+	} else if err != nil {
+		return PTOWrapError(err)
+	}
+	set.LinkVia(config)
+
+	// every source on this PTO must exist
+	for _, link := range set.Sources {
+		if camname, filename, ok := config.RawFileForLink(link); ok {
+			if rds == nil {
+				continue
+			}
+			cam, err := rds.CampaignForName(camname)
+			if err == nil {
+				_, err = cam.GetFileMetadata(filename)
+			}
+			if err != nil {
+				cr.add(DiscrepancyUnresolvedSource, set.Link(), "source %s: %s", link, err.Error())
+			}
+		} else if sourceid, ok := config.ObservationSetIDForLink(link); ok {
+			count, err := db.Model(&ObservationSet{}).Where("id = ?", sourceid).Count()
+			if err != nil {
+				return PTOWrapError(err)
+			}
+			if count == 0 {
+				cr.add(DiscrepancyUnresolvedSource, set.Link(), "source %s: observation set %x not found", link, sourceid)
+			}
+		}
+	}
+
+	// and be stored as provenance, in order
+	var links []string
+	if _, err := db.QueryOne(pg.Scan(pg.Array(&links)),
+		"SELECT coalesce(array_agg(link ORDER BY position), '{}') FROM observation_set_sources WHERE observation_set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	if len(links) != len(set.Sources) {
+		cr.add(DiscrepancyUnlinkedSources, set.Link(), "%d sources, but %d stored as provenance", len(set.Sources), len(links))
+	} else {
+		for i := range links {
+			if links[i] != set.Sources[i] {
+				cr.add(DiscrepancyUnlinkedSources, set.Link(), "source %d is %s, but %s is stored as provenance", i, set.Sources[i], links[i])
+				break
+			}
+		}
+	}
+
+	arc, err := set.Archive(db)
+	if err != nil {
+		return err
+	}
+
+	// the cached count must match the observations in the database, unless
+	// they live elsewhere; a count of 0 is not cached yet
+	if set.External() == "" && (arc == nil || arc.Trimmed == nil) && set.Count != 0 {
+		count, err := db.Model(&Observation{}).Where("set_id = ?", set.ID).Count()
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		if count != set.Count {
+			cr.add(DiscrepancyCountMismatch, set.Link(), "count is %d, but %d observations are in the database", set.Count, count)
+		}
+	}
+
+	if arc == nil {
+		return nil
+	}
+
+	if set.Count != 0 && arc.Count != set.Count {
+		cr.add(DiscrepancyCountMismatch, set.Link(), "count is %d, but %d observations were archived", set.Count, arc.Count)
+	}
+
+	if rds == nil {
+		return nil
+	}
+
+	// the bundle must be there, as archived
+	arc.LinkVia(config)
+	cam, err := rds.CampaignForName(arc.Campaign)
+	if err != nil {
+		cr.add(DiscrepancyMissingBundle, set.Link(), "bundle %s: %s", arc.Link, err.Error())
+		return nil
+	}
+	md, err := cam.GetFileMetadata(arc.File)
+	if err != nil {
+		cr.add(DiscrepancyMissingBundle, set.Link(), "bundle %s: %s", arc.Link, err.Error())
+		return nil
+	}
+
+	if count := md.Get(ArchivedCountMetadataKey, false); count != strconv.Itoa(arc.Count) {
+		cr.add(DiscrepancyCountMismatch, set.Link(), "%d observations were archived, but bundle %s has %s %q", arc.Count, arc.Link, ArchivedCountMetadataKey, count)
+	}
+
+	digest, err := cam.digestFileData(arc.File)
+	if err != nil {
+		cr.add(DiscrepancyMissingBundle, set.Link(), "bundle %s data: %s", arc.Link, err.Error())
+	} else if digest != arc.SHA256 {
+		cr.add(DiscrepancyDigestMismatch, set.Link(), "bundle %s has digest %s, not %s as archived", arc.Link, digest, arc.SHA256)
+	}
+
+	return nil
+}
+
+// checkCampaign checks that every file in a campaign naming an archived
+// observation set refers to a set archived to it.
+func (cr *ConsistencyReport) checkCampaign(db orm.DB, config *PTOConfiguration, rds *RawDataStore, camname string) error {
+	cam, err := rds.CampaignForName(camname)
+	if err != nil {
+		return err
+	}
+
+	filenames, err := cam.FileNames()
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range filenames {
+		md, err := cam.GetFileMetadata(filename)
+		if err != nil {
+			return err
+		}
+		cr.RawFilesChecked++
+
+		setlink := md.Get(ArchivedSetMetadataKey, false)
+		if setlink == "" {
+			continue
+		}
+		filelink, _ := config.LinkTo(fmt.Sprintf("raw/%s/%s", camname, filename))
+
+		setid, ok := config.ObservationSetIDForLink(setlink)
+		if !ok {
+			cr.add(DiscrepancyMissingDerivedSet, filelink, "%s %s is not an observation set on this PTO", ArchivedSetMetadataKey, setlink)
+			continue
+		}
+
+		set := ObservationSet{ID: setid}
+		arc, err := set.Archive(db)
+		if err != nil {
+			return err
+		}
+		if arc != nil && arc.Campaign == camname && arc.File == filename {
+			continue
+		}
+
+		count, err := db.Model(&ObservationSet{}).Where("id = ?", setid).Count()
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		switch {
+		case count == 0:
+			cr.add(DiscrepancyMissingDerivedSet, filelink, "observation set %s not found", setlink)
+		case arc == nil:
+			cr.add(DiscrepancyMissingDerivedSet, filelink, "observation set %s is not archived", setlink)
+		default:
+			cr.add(DiscrepancyMissingDerivedSet, filelink, "observation set %s is archived to %s/%s", setlink, arc.Campaign, arc.File)
+		}
+	}
+
+	return nil
+}
+
+// ConsistencyChecker runs consistency checks in the background, one at a
+// time, and keeps the report of the most recent. Discrepancies found are
+// logged, and reports with discrepancies are queued for delivery to the
+// configured AlertURL.
+type ConsistencyChecker struct {
+	db     *pg.DB
+	config *PTOConfiguration
+	rds    *RawDataStore
+
+	// report of the check in progress, or of the last check
+	report *ConsistencyReport
+
+	// true while a check is in progress
+	running bool
+
+	// lock on the above
+	lock sync.Mutex
+}
+
+// NewConsistencyChecker creates a consistency checker for the given
+// observation database and raw data store, which may be nil.
+func NewConsistencyChecker(db *pg.DB, config *PTOConfiguration, rds *RawDataStore) *ConsistencyChecker {
+	return &ConsistencyChecker{db: db, config: config, rds: rds}
+}
+
+// Start starts a consistency check in the background, and returns false
+// without starting one if a check is already in progress.
+func (cc *ConsistencyChecker) Start() bool {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	if cc.running {
+		return false
+	}
+	cc.running = true
+
+	go cc.run()
+	return true
+}
+
+// RunEvery starts a consistency check in the background at the given
+// interval, skipping a check if the previous one is still in progress. It
+// returns immediately.
+func (cc *ConsistencyChecker) RunEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			cc.Start()
+		}
+	}()
+}
+
+// Report returns whether a consistency check is in progress, and the report
+// of the last check to finish, or nil if none has.
+func (cc *ConsistencyChecker) Report() (bool, *ConsistencyReport) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	return cc.running, cc.report
+}
+
+// run runs a consistency check, and reports its discrepancies.
+func (cc *ConsistencyChecker) run() {
+	cr, err := CheckConsistency(cc.db, cc.config, cc.rds)
+	if err != nil {
+		log.Printf("error checking consistency after %d observation sets and %d raw data files: %v", cr.SetsChecked, cr.RawFilesChecked, err)
+		cr.Error = err.Error()
+	}
+
+	for _, d := range cr.Discrepancies {
+		log.Printf("consistency check found %s on %s: %s", d.Kind, d.Subject, d.Detail)
+	}
+
+	cc.lock.Lock()
+	cc.report = cr
+	cc.running = false
+	cc.lock.Unlock()
+
+	if len(cr.Discrepancies) == 0 || cc.config.AlertURL == "" {
+		return
+	}
+
+	dq, err := cc.config.DeliveryQueue()
+	if err != nil {
+		log.Printf("error opening delivery queue for consistency report: %v", err)
+		return
+	}
+
+	if err := dq.Enqueue(cc.config.AlertURL, "consistency report", cr); err != nil {
+		log.Printf("error queueing consistency report to %s: %v", cc.config.AlertURL, err)
+	}
+}
@@ -0,0 +1,22 @@
+// +build linux
+
+package pto3
+
+import (
+	"syscall"
+	"time"
+)
+
+// rusageThread is RUSAGE_THREAD, which the syscall package does not define.
+const rusageThread = 1
+
+// threadCPUTime returns the user and system CPU time used by the calling
+// thread, so that the CPU time of a goroutine locked to its thread can be
+// measured.
+func threadCPUTime() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(rusageThread, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
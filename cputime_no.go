@@ -0,0 +1,9 @@
+// +build !linux
+
+package pto3
+
+import "time"
+
+func threadCPUTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,253 @@
+package pto3
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// Queries failing because the observation database is unreachable are
+// retried with backoff by go-pg, as configured by the MaxRetries,
+// MinRetryBackoff, and MaxRetryBackoff options of ObsDatabase. If the
+// database stays unreachable, a DBHealth watching its connections trips
+// after a number of consecutive failures, and requests needing the database
+// then fail fast with 503 Service Unavailable for a cooldown period, instead
+// of each waiting for its own connection attempts to time out. After the
+// cooldown, requests are let through again; the first success closes the
+// breaker, and the next failure opens it for another cooldown.
+
+// transientSQLStates lists the SQLSTATE codes, beyond the connection
+// exception class 08, of errors which say the server cannot currently serve
+// queries rather than that a query was wrong.
+var transientSQLStates = map[string]bool{
+	"53300": true, // too_many_connections
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// IsTransientDBError returns true if an error from the observation database
+// indicates that the database is unreachable or not accepting queries, so
+// that the same request may succeed later, rather than that the request was
+// bad.
+func IsTransientDBError(err error) bool {
+	switch err {
+	case nil:
+		return false
+	case io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+
+	if pgerr, ok := err.(pg.Error); ok {
+		code := pgerr.Field('C')
+		return strings.HasPrefix(code, "08") || transientSQLStates[code]
+	}
+
+	return strings.Contains(err.Error(), "connection pool timeout")
+}
+
+// DBHealth tracks the health of the connections to a database, acting as a
+// circuit breaker for requests needing it. A nil DBHealth considers the
+// database always available.
+type DBHealth struct {
+	threshold int
+	cooldown  time.Duration
+
+	lock        sync.Mutex
+	dbs         []*pg.DB
+	failures    int
+	lastFailure *time.Time
+	openUntil   time.Time
+}
+
+// NewDBHealth creates a DBHealth which trips after the given number of
+// consecutive transient failures, failing requests fast for the given
+// cooldown. If threshold is not positive, it never trips.
+func NewDBHealth(threshold int, cooldown time.Duration) *DBHealth {
+	return &DBHealth{threshold: threshold, cooldown: cooldown}
+}
+
+// dbHealthHook records the outcome of every query on a watched connection.
+type dbHealthHook struct {
+	h *DBHealth
+}
+
+func (hook *dbHealthHook) BeforeQuery(qe *pg.QueryEvent) {}
+
+func (hook *dbHealthHook) AfterQuery(qe *pg.QueryEvent) {
+	hook.h.record(qe.Error)
+}
+
+// Watch tracks the outcome of all queries on a database connection, and
+// includes its connection pool in the status.
+func (h *DBHealth) Watch(db *pg.DB) {
+	if h == nil {
+		return
+	}
+
+	h.lock.Lock()
+	h.dbs = append(h.dbs, db)
+	h.lock.Unlock()
+
+	db.AddQueryHook(&dbHealthHook{h})
+}
+
+func (h *DBHealth) record(err error) {
+	// errors in queries say nothing about the health of the database
+	if err != nil && !IsTransientDBError(err) {
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if err == nil {
+		if h.failures > 0 && h.threshold > 0 && h.failures >= h.threshold {
+			log.Printf("observation database available again after %d failures", h.failures)
+		}
+		h.failures = 0
+		h.openUntil = time.Time{}
+		return
+	}
+
+	now := time.Now()
+	h.failures++
+	h.lastFailure = &now
+	if h.threshold > 0 && h.failures >= h.threshold {
+		if h.failures == h.threshold {
+			log.Printf("observation database unavailable after %d failures, last %v; failing requests for %s",
+				h.failures, err, h.cooldown)
+		}
+		h.openUntil = now.Add(h.cooldown)
+	}
+}
+
+// Available returns nil if requests may use the database, or an error with
+// status 503 if it has failed too often recently.
+func (h *DBHealth) Available() error {
+	if h == nil {
+		return nil
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if time.Now().Before(h.openUntil) {
+		return PTOErrorf("observation database unavailable after %d consecutive failures; retry later",
+			h.failures).StatusIs(http.StatusServiceUnavailable)
+	}
+	return nil
+}
+
+// RetryAfter returns the time until requests will use the database again,
+// rounded up to the second, or 0 if they may now.
+func (h *DBHealth) RetryAfter() time.Duration {
+	if h == nil {
+		return 0
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	remain := time.Until(h.openUntil)
+	if remain <= 0 {
+		return 0
+	}
+	return remain.Truncate(time.Second) + time.Second
+}
+
+// Check runs a trivial query on every watched connection, recording the
+// outcome as for any other query, even while requests are failed fast. A
+// successful check therefore closes the breaker without waiting for the
+// cooldown.
+func (h *DBHealth) Check() error {
+	if h == nil {
+		return nil
+	}
+
+	h.lock.Lock()
+	dbs := append([]*pg.DB(nil), h.dbs...)
+	h.lock.Unlock()
+
+	for _, db := range dbs {
+		if _, err := db.Exec("SELECT 1"); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+	return nil
+}
+
+// DBPoolStatus summarizes the connection pools of the watched connections.
+type DBPoolStatus struct {
+	// Open connections
+	Connections uint32 `json:"connections"`
+	// Open connections not in use
+	Idle uint32 `json:"idle"`
+	// Connections closed for being idle too long
+	Stale uint32 `json:"stale"`
+	// Times a free connection was found in the pool
+	Hits uint32 `json:"hits"`
+	// Times no free connection was found in the pool
+	Misses uint32 `json:"misses"`
+	// Times waiting for a connection timed out
+	Timeouts uint32 `json:"timeouts"`
+}
+
+// DBHealthStatus describes the health of a database, as on a health check
+// endpoint.
+type DBHealthStatus struct {
+	// "ok", "degraded" if recent queries failed, or "unavailable" if
+	// requests are failed fast
+	Status string `json:"status"`
+	// Number of consecutive queries failed for transient reasons
+	ConsecutiveFailures int `json:"consecutive_failures"`
+	// Time of the last such failure, if any
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	// Time until which requests are failed fast, if they are
+	RetryAfter *time.Time `json:"retry_after,omitempty"`
+	// Connection pool statistics
+	Pool DBPoolStatus `json:"pool"`
+}
+
+// Status returns the health of the database and its connection pools.
+func (h *DBHealth) Status() *DBHealthStatus {
+	out := DBHealthStatus{Status: "ok"}
+	if h == nil {
+		return &out
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	out.ConsecutiveFailures = h.failures
+	out.LastFailure = h.lastFailure
+	if time.Now().Before(h.openUntil) {
+		out.Status = "unavailable"
+		retryAfter := h.openUntil
+		out.RetryAfter = &retryAfter
+	} else if h.failures > 0 {
+		out.Status = "degraded"
+	}
+
+	for _, db := range h.dbs {
+		ps := db.PoolStats()
+		out.Pool.Connections += ps.TotalConns
+		out.Pool.Idle += ps.IdleConns
+		out.Pool.Stale += ps.StaleConns
+		out.Pool.Hits += ps.Hits
+		out.Pool.Misses += ps.Misses
+		out.Pool.Timeouts += ps.Timeouts
+	}
+
+	return &out
+}
@@ -0,0 +1,358 @@
+package pto3
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Delivery is a notification POSTed as JSON to a client's URL: a query
+// callback, or an alert. Failed deliveries are retried with exponential
+// backoff; after the configured number of attempts, they are kept as dead
+// letters until retried or discarded through the admin API.
+type Delivery struct {
+	// Identifier of the delivery, for the admin API
+	ID string `json:"id"`
+	// URL to POST the notification to
+	URL string `json:"url"`
+	// What the notification is about, for logs and the admin API
+	Description string `json:"description"`
+	// Notification to POST, as JSON
+	Body json.RawMessage `json:"body"`
+	// Time the notification was queued
+	Created time.Time `json:"created"`
+	// Number of failed attempts so far
+	Attempts int `json:"attempts"`
+	// Time of the next attempt; nil for dead letters
+	NextAttempt *time.Time `json:"next_attempt,omitempty"`
+	// Reason the most recent attempt failed
+	LastError string `json:"last_error,omitempty"`
+	// True if the URL was given by a client, so that the notification is
+	// POSTed with the queue's outbound client
+	Outbound bool `json:"outbound,omitempty"`
+}
+
+// Dead returns true if this Delivery has failed too often to be retried
+// automatically.
+func (d *Delivery) Dead() bool {
+	return d.NextAttempt == nil
+}
+
+// DeliveryQueue holds outbound notifications until they have been delivered.
+// Deliveries are attempted in the background in order of their next
+// attempt. If a path is given, the queue is stored there as JSON after every
+// change, so that deliveries survive a restart; otherwise it is kept in
+// memory only.
+type DeliveryQueue struct {
+	// path to queue file; empty for no persistence
+	path string
+
+	// number of attempts before a delivery becomes a dead letter
+	maxAttempts int
+
+	// delay before the first retry, doubled for each further retry
+	backoff time.Duration
+
+	// client to POST with
+	client http.Client
+
+	// client to POST outbound deliveries with
+	outbound *http.Client
+
+	// queued deliveries, pending and dead
+	deliveries []*Delivery
+
+	// channel signaled when a delivery is queued or retried
+	wake chan struct{}
+
+	// lock on deliveries
+	lock sync.Mutex
+}
+
+// OpenDeliveryQueue opens the delivery queue stored at the given path,
+// creating it if necessary, or an in-memory queue if the path is empty, and
+// starts delivering in the background. Deliveries are attempted up to
+// maxAttempts times, waiting backoff before the first retry and twice as
+// long before each further retry. Deliveries to URLs given by clients, queued
+// with EnqueueOutbound, are POSTed with the outbound client, which should
+// refuse addresses clients may not reach through the server, such as one
+// returned by PTOConfiguration.OutboundClient; redirects are not followed for
+// them, but count as failures.
+func OpenDeliveryQueue(path string, maxAttempts int, backoff time.Duration, outbound *http.Client) (*DeliveryQueue, error) {
+	noRedirects := *outbound
+	noRedirects.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	dq := DeliveryQueue{
+		path:        path,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		client:      http.Client{Timeout: 30 * time.Second},
+		outbound:    &noRedirects,
+		deliveries:  make([]*Delivery, 0),
+		wake:        make(chan struct{}, 1),
+	}
+
+	if path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			if err := json.Unmarshal(b, &dq.deliveries); err != nil {
+				return nil, PTOErrorf("error loading delivery queue from %s: %v", path, err)
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, PTOWrapError(err)
+		}
+	}
+
+	go dq.run()
+
+	return &dq, nil
+}
+
+// save writes the queue to its file, if any. It must be called with the lock
+// held.
+func (dq *DeliveryQueue) save() error {
+	if dq.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(dq.deliveries)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	// write and rename, so that a crash leaves the old queue intact
+	temppath := dq.path + ".tmp"
+	if err := ioutil.WriteFile(temppath, b, 0644); err != nil {
+		return PTOWrapError(err)
+	}
+	if err := os.Rename(temppath, dq.path); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// signal wakes the delivery goroutine, if it is waiting.
+func (dq *DeliveryQueue) signal() {
+	select {
+	case dq.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue queues a notification for delivery to a URL configured on the
+// server, marshaling it as JSON. The first attempt is made immediately.
+func (dq *DeliveryQueue) Enqueue(url string, description string, notification interface{}) error {
+	return dq.enqueue(url, description, notification, false)
+}
+
+// EnqueueOutbound queues a notification for delivery to a URL given by a
+// client, as Enqueue does, to be POSTed with the queue's outbound client.
+func (dq *DeliveryQueue) EnqueueOutbound(url string, description string, notification interface{}) error {
+	return dq.enqueue(url, description, notification, true)
+}
+
+func (dq *DeliveryQueue) enqueue(url string, description string, notification interface{}, outbound bool) error {
+	b, err := json.Marshal(notification)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	idbytes := make([]byte, 8)
+	if _, err := rand.Read(idbytes); err != nil {
+		return PTOWrapError(err)
+	}
+
+	now := time.Now().UTC()
+	d := Delivery{
+		ID:          hex.EncodeToString(idbytes),
+		URL:         url,
+		Description: description,
+		Body:        b,
+		Created:     now,
+		NextAttempt: &now,
+		Outbound:    outbound,
+	}
+
+	dq.lock.Lock()
+	dq.deliveries = append(dq.deliveries, &d)
+	err = dq.save()
+	dq.lock.Unlock()
+
+	dq.signal()
+	return err
+}
+
+// Deliveries returns copies of the pending deliveries and of the dead
+// letters in the queue, in the order they were queued.
+func (dq *DeliveryQueue) Deliveries() ([]Delivery, []Delivery) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	pending := make([]Delivery, 0)
+	dead := make([]Delivery, 0)
+	for _, d := range dq.deliveries {
+		if d.Dead() {
+			dead = append(dead, *d)
+		} else {
+			pending = append(pending, *d)
+		}
+	}
+
+	return pending, dead
+}
+
+// find returns the index of the delivery with the given identifier, or -1.
+// It must be called with the lock held.
+func (dq *DeliveryQueue) find(id string) int {
+	for i, d := range dq.deliveries {
+		if d.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Retry schedules a delivery for an immediate attempt, resetting its count
+// of attempts; dead letters are revived. It returns a not found error if
+// there is no delivery with the given identifier.
+func (dq *DeliveryQueue) Retry(id string) error {
+	dq.lock.Lock()
+	i := dq.find(id)
+	if i < 0 {
+		dq.lock.Unlock()
+		return PTONotFoundError("delivery", id)
+	}
+
+	now := time.Now().UTC()
+	dq.deliveries[i].Attempts = 0
+	dq.deliveries[i].NextAttempt = &now
+	err := dq.save()
+	dq.lock.Unlock()
+
+	dq.signal()
+	return err
+}
+
+// Discard removes a delivery from the queue without delivering it. It
+// returns a not found error if there is no delivery with the given
+// identifier.
+func (dq *DeliveryQueue) Discard(id string) error {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	i := dq.find(id)
+	if i < 0 {
+		return PTONotFoundError("delivery", id)
+	}
+
+	dq.deliveries = append(dq.deliveries[:i], dq.deliveries[i+1:]...)
+	return dq.save()
+}
+
+// due returns copies of the deliveries whose next attempt is due, and the
+// time of the earliest attempt which is not yet due, or the zero time if
+// there is none.
+func (dq *DeliveryQueue) due(now time.Time) ([]Delivery, time.Time) {
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	out := make([]Delivery, 0)
+	var next time.Time
+	for _, d := range dq.deliveries {
+		switch {
+		case d.Dead():
+		case !d.NextAttempt.After(now):
+			out = append(out, *d)
+		case next.IsZero() || d.NextAttempt.Before(next):
+			next = *d.NextAttempt
+		}
+	}
+
+	return out, next
+}
+
+// run attempts deliveries as they become due, forever.
+func (dq *DeliveryQueue) run() {
+	for {
+		due, next := dq.due(time.Now())
+		for i := range due {
+			dq.attempt(&due[i])
+		}
+		if len(due) > 0 {
+			// attempts take time, and may have scheduled retries
+			continue
+		}
+
+		// wait for the next attempt, or for a new delivery
+		if next.IsZero() {
+			<-dq.wake
+			continue
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-dq.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt POSTs a delivery, then removes it from the queue if it succeeded,
+// or schedules a retry or makes it a dead letter if it failed.
+func (dq *DeliveryQueue) attempt(d *Delivery) {
+	client := &dq.client
+	if d.Outbound {
+		client = dq.outbound
+	}
+
+	var failure string
+	res, err := client.Post(d.URL, "application/json", bytes.NewReader(d.Body))
+	if err != nil {
+		failure = err.Error()
+	} else {
+		res.Body.Close()
+		if res.StatusCode >= 300 {
+			failure = res.Status
+		}
+	}
+
+	dq.lock.Lock()
+	defer dq.lock.Unlock()
+
+	// the delivery may have been discarded in the meantime
+	i := dq.find(d.ID)
+	if i < 0 {
+		return
+	}
+	queued := dq.deliveries[i]
+
+	if failure == "" {
+		dq.deliveries = append(dq.deliveries[:i], dq.deliveries[i+1:]...)
+	} else {
+		queued.Attempts++
+		queued.LastError = failure
+		if queued.Attempts >= dq.maxAttempts {
+			log.Printf("giving up delivering %s to %s after %d attempts: %s", d.Description, d.URL, queued.Attempts, failure)
+			queued.NextAttempt = nil
+		} else {
+			log.Printf("error delivering %s to %s, will retry: %s", d.Description, d.URL, failure)
+			next := time.Now().UTC().Add(dq.backoff << uint(queued.Attempts-1))
+			queued.NextAttempt = &next
+		}
+	}
+
+	if err := dq.save(); err != nil {
+		log.Printf("error saving delivery queue: %v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package pto3
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Deprecation describes a deprecated feature of the PTO API. Features are
+// named in the Deprecations configuration key: a route by its method and path
+// template, e.g. "GET /obs/by_metadata", and an output format by "format"
+// followed by its name, e.g. "format csv".
+type Deprecation struct {
+	// Time at which the feature was deprecated
+	Since time.Time
+	// Time after which the feature may be removed, if known
+	Sunset *time.Time
+	// URL of a document describing the deprecation and its replacement
+	Link string
+}
+
+// DeprecationUsage counts the uses of a deprecated feature by one client.
+type DeprecationUsage struct {
+	// Short hash of the client's API key, or "default" for requests without one
+	Client string `json:"client"`
+	// Number of requests using the feature
+	Count int64 `json:"count"`
+	// Time of the most recent request using the feature
+	LastUsed time.Time `json:"last_used"`
+}
+
+// DeprecationTracker counts uses of deprecated features per client, so that
+// operators can tell who still depends on a feature before removing it.
+// Counts are kept in memory, and reset when the server restarts.
+type DeprecationTracker struct {
+	lock  sync.Mutex
+	usage map[string]map[string]*DeprecationUsage
+}
+
+// NewDeprecationTracker creates a tracker with no recorded uses.
+func NewDeprecationTracker() *DeprecationTracker {
+	return &DeprecationTracker{usage: make(map[string]map[string]*DeprecationUsage)}
+}
+
+// Record counts a use of a deprecated feature by a client.
+func (dt *DeprecationTracker) Record(feature string, client string) {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+
+	clients := dt.usage[feature]
+	if clients == nil {
+		clients = make(map[string]*DeprecationUsage)
+		dt.usage[feature] = clients
+	}
+
+	u := clients[client]
+	if u == nil {
+		u = &DeprecationUsage{Client: client}
+		clients[client] = u
+	}
+
+	u.Count++
+	u.LastUsed = time.Now().UTC()
+}
+
+// Usage returns the uses of a deprecated feature, by client, with the most
+// frequent users first.
+func (dt *DeprecationTracker) Usage(feature string) []DeprecationUsage {
+	dt.lock.Lock()
+	defer dt.lock.Unlock()
+
+	out := make([]DeprecationUsage, 0, len(dt.usage[feature]))
+	for _, u := range dt.usage[feature] {
+		out = append(out, *u)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Client < out[j].Client
+	})
+
+	return out
+}
@@ -0,0 +1,9 @@
+// +build !windows,!plan9
+
+package pto3
+
+import "syscall"
+
+// dropOpenFlags are added to the flags used to open files in a drop
+// directory: don't follow symlinks, and don't block opening FIFOs.
+const dropOpenFlags = syscall.O_NOFOLLOW | syscall.O_NONBLOCK
@@ -0,0 +1,8 @@
+// +build windows plan9
+
+package pto3
+
+// dropOpenFlags are added to the flags used to open files in a drop
+// directory; this platform has no flags to refuse symlinks, so files are
+// only checked with Lstat before opening.
+const dropOpenFlags = 0
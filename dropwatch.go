@@ -0,0 +1,312 @@
+package pto3
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DropIngester moves raw data files deposited in a drop directory by rsync,
+// rclone, or similar tools into a raw data store, for probes that cannot
+// speak the HTTP API. The drop directory mirrors the layout of the raw data
+// store: each subdirectory is named after a campaign, and contains data files
+// along with their metadata in files with the FileMetadataSuffix. A campaign
+// metadata file in a subdirectory will be used to create the campaign if it
+// does not exist yet.
+type DropIngester struct {
+	// raw data store to ingest into
+	rds *RawDataStore
+
+	// path to drop directory
+	path string
+
+	// path to directory for rejected files, or empty to leave them in place
+	rejectPath string
+
+	// minimum time since last modification before a file is ingested
+	settle time.Duration
+
+	// campaigns this drop directory may write to, or nil for all
+	campaigns map[string]struct{}
+
+	// modification times of files that failed ingest and were left in place,
+	// so we don't retry them until they change.
+	failed map[string]time.Time
+}
+
+// NewDropIngester creates a new ingester for a given drop directory. Files
+// are not ingested until they have not been modified for the given settle
+// time, to avoid picking up transfers in progress. Files failing validation
+// or ingest are moved to rejectPath, if not empty.
+func NewDropIngester(rds *RawDataStore, path string, rejectPath string, settle time.Duration) *DropIngester {
+	return &DropIngester{
+		rds:        rds,
+		path:       path,
+		rejectPath: rejectPath,
+		settle:     settle,
+		failed:     make(map[string]time.Time),
+	}
+}
+
+// RestrictCampaigns limits this ingester to the named campaigns, so that a
+// drop directory belonging to a single partner (e.g. the chroot of an SFTP
+// account) cannot be used to write to other partners' campaigns.
+// Subdirectories for other campaigns are ignored.
+func (di *DropIngester) RestrictCampaigns(camnames []string) {
+	di.campaigns = make(map[string]struct{})
+	for _, camname := range camnames {
+		di.campaigns[camname] = struct{}{}
+	}
+}
+
+// campaignAllowed returns true if this ingester may write to a campaign.
+func (di *DropIngester) campaignAllowed(camname string) bool {
+	if di.campaigns == nil {
+		return true
+	}
+	_, ok := di.campaigns[camname]
+	return ok
+}
+
+// isDropTemporary returns true if a filename in the drop directory looks like
+// a transfer in progress: rsync writes to hidden temporary files, and rclone
+// to files with a .partial suffix.
+func isDropTemporary(filename string) bool {
+	return strings.HasPrefix(filename, ".") || strings.HasSuffix(filename, ".partial")
+}
+
+// settled returns the modification time of a file if it exists, is a regular
+// file, and has not been modified for the settle time, or nil otherwise.
+// Symlinks are not followed: whoever writes to the drop directory could
+// otherwise use them to ingest any file the ingester can read.
+func (di *DropIngester) settled(pathname string, now time.Time) *time.Time {
+	fi, err := os.Lstat(pathname)
+	if err != nil || !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	mtime := fi.ModTime()
+	if now.Sub(mtime) < di.settle {
+		return nil
+	}
+
+	return &mtime
+}
+
+// Scan makes a single pass over the drop directory, ingesting all settled
+// data and metadata pairs. It returns the number of files ingested. Errors
+// ingesting individual files are logged, and do not stop the scan.
+func (di *DropIngester) Scan() (int, error) {
+	direntries, err := ioutil.ReadDir(di.path)
+	if err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	count := 0
+	for _, direntry := range direntries {
+		if direntry.IsDir() && !isDropTemporary(direntry.Name()) && di.campaignAllowed(direntry.Name()) {
+			n, err := di.scanCampaign(direntry.Name())
+			if err != nil {
+				log.Printf("error scanning drop directory for campaign %s: %v", direntry.Name(), err)
+			}
+			count += n
+		}
+	}
+
+	return count, nil
+}
+
+// openDropFile opens a regular file in the drop directory for reading,
+// without following symlinks, and returns an error if it is not a regular
+// file.
+func openDropFile(pathname string) (*os.File, error) {
+	f, err := os.OpenFile(pathname, os.O_RDONLY|dropOpenFlags, 0)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, PTOWrapError(err)
+	}
+
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, PTOErrorf("%s is not a regular file", pathname).StatusIs(http.StatusBadRequest)
+	}
+
+	return f, nil
+}
+
+// readDropMetadata reads metadata from a file in the drop directory, bound to
+// an optional parent.
+func readDropMetadata(pathname string, parent *RawMetadata) (*RawMetadata, error) {
+	f, err := openDropFile(pathname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return RawMetadataFromReader(f, parent)
+}
+
+// campaignForDrop returns the campaign for a subdirectory of the drop
+// directory, creating it from a campaign metadata file in the subdirectory if
+// necessary.
+func (di *DropIngester) campaignForDrop(camname string) (*Campaign, error) {
+	cam, err := di.rds.CampaignForName(camname)
+	if err == nil {
+		return cam, nil
+	}
+
+	// the campaign may have been created since we last looked
+	if err := di.rds.ScanCampaigns(); err != nil {
+		return nil, err
+	}
+
+	if cam, err = di.rds.CampaignForName(camname); err == nil {
+		return cam, nil
+	}
+
+	mdpath := filepath.Join(di.path, camname, CampaignMetadataFilename)
+	if fi, serr := os.Lstat(mdpath); serr != nil || !fi.Mode().IsRegular() {
+		return nil, err
+	}
+
+	md, err := readDropMetadata(mdpath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cam, err = di.rds.CreateCampaign(camname, md)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("created campaign %s from drop directory", camname)
+	os.Remove(mdpath)
+	return cam, nil
+}
+
+func (di *DropIngester) scanCampaign(camname string) (int, error) {
+	campath := filepath.Join(di.path, camname)
+
+	direntries, err := ioutil.ReadDir(campath)
+	if err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	now := time.Now()
+	count := 0
+	var cam *Campaign
+
+	for _, direntry := range direntries {
+		// look for metadata files, and pair each with its data file
+		metafilename := direntry.Name()
+		if direntry.IsDir() || isDropTemporary(metafilename) || !strings.HasSuffix(metafilename, FileMetadataSuffix) {
+			continue
+		}
+		filename := metafilename[0 : len(metafilename)-len(FileMetadataSuffix)]
+		datapath := filepath.Join(campath, filename)
+		metapath := filepath.Join(campath, metafilename)
+
+		datatime := di.settled(datapath, now)
+		metatime := di.settled(metapath, now)
+		if datatime == nil || metatime == nil {
+			continue
+		}
+
+		// skip files that failed before and haven't changed since
+		if ftime, ok := di.failed[datapath]; ok && ftime.Equal(*datatime) {
+			continue
+		}
+
+		// get the campaign only once we have something to put in it
+		if cam == nil {
+			if cam, err = di.campaignForDrop(camname); err != nil {
+				return count, err
+			}
+		}
+
+		if err := di.ingestFile(cam, filename, datapath, metapath); err != nil {
+			log.Printf("error ingesting %s from drop directory: %v", datapath, err)
+			di.reject(camname, datapath, metapath, *datatime)
+			continue
+		}
+
+		delete(di.failed, datapath)
+		os.Remove(datapath)
+		os.Remove(metapath)
+		log.Printf("ingested %s/%s from drop directory", camname, filename)
+		count++
+	}
+
+	return count, nil
+}
+
+// ingestFile validates a data and metadata pair and writes it to the
+// campaign, using the same path as uploads via the API.
+func (di *DropIngester) ingestFile(cam *Campaign, filename, datapath, metapath string) error {
+	cammd, err := cam.GetCampaignMetadata()
+	if err != nil {
+		return err
+	}
+
+	md, err := readDropMetadata(metapath, cammd)
+	if err != nil {
+		return err
+	}
+
+	if err := md.validate(false); err != nil {
+		return err
+	}
+
+	// refuse files already in the campaign before touching their metadata;
+	// file metadata without data may be an upload via the API in progress
+	if _, err := cam.GetFileMetadata(filename); err == nil {
+		return PTOExistsError("file", filename)
+	}
+	if _, err := cam.dataFilePath(filename, false); err != nil {
+		return err
+	}
+
+	if err := cam.PutFileMetadata(filename, md); err != nil {
+		return err
+	}
+
+	in, err := openDropFile(datapath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return cam.WriteFileDataFromStream(filename, false, in)
+}
+
+// reject moves a failed data and metadata pair to the reject directory, if
+// configured, or remembers it so it is not retried until it changes.
+func (di *DropIngester) reject(camname, datapath, metapath string, datatime time.Time) {
+	if di.rejectPath == "" {
+		di.failed[datapath] = datatime
+		return
+	}
+
+	rejectdir := filepath.Join(di.rejectPath, camname)
+	if err := os.MkdirAll(rejectdir, 0755); err != nil {
+		log.Printf("error creating reject directory %s: %v", rejectdir, err)
+		di.failed[datapath] = datatime
+		return
+	}
+
+	for _, pathname := range []string{datapath, metapath} {
+		if err := os.Rename(pathname, filepath.Join(rejectdir, filepath.Base(pathname))); err != nil {
+			log.Printf("error rejecting %s: %v", pathname, err)
+			di.failed[datapath] = datatime
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package pto3
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObservationEncoder writes observations to a stream in some output format.
+type ObservationEncoder interface {
+	// Encode writes a single observation.
+	Encode(obs *Observation) error
+	// Close writes any trailing data and flushes the stream; it does not
+	// close the underlying writer.
+	Close() error
+}
+
+// ObservationFormat describes an output format for observations, used for
+// observation set data downloads and query results.
+type ObservationFormat struct {
+	// Short name of the format, used in the format parameter
+	Name string
+	// MIME type of the format, used in the Accept and Content-Type headers
+	ContentType string
+	// Function to create an encoder writing the given fields (see
+	// ParseObservationFields; nil for all fields) to a stream
+	NewEncoder func(out io.Writer, fields []int) ObservationEncoder
+	// Function to create an encoder as NewEncoder, formatting numbers, times,
+	// and headers as given; nil if the format does not support export
+	// options
+	NewFormattedEncoder func(out io.Writer, fields []int, opts *ExportOptions) ObservationEncoder
+}
+
+// CheckExportOptions returns an error with status 400 if export options other
+// than the defaults are given for this format, and it does not support them.
+func (format *ObservationFormat) CheckExportOptions(opts *ExportOptions) error {
+	if format.NewFormattedEncoder == nil && !opts.IsDefault() {
+		return PTOErrorf("format %s does not support export options", format.Name).StatusIs(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// Encoder returns an encoder writing the given fields of observations to a
+// stream in this format, with the given export options, or nil for the
+// defaults. It returns an error as CheckExportOptions.
+func (format *ObservationFormat) Encoder(out io.Writer, fields []int, opts *ExportOptions) (ObservationEncoder, error) {
+	if err := format.CheckExportOptions(opts); err != nil {
+		return nil, err
+	}
+	if format.NewFormattedEncoder != nil {
+		return format.NewFormattedEncoder(out, fields, opts), nil
+	}
+	return format.NewEncoder(out, fields), nil
+}
+
+// ObservationFields names the fields of an observation, in the order they
+// appear in observation set files.
+var ObservationFields = []string{"set_id", "time_start", "time_end", "path", "condition", "value"}
+
+// ParseObservationFields parses a comma-separated list of observation field
+// names, as given in the fields parameter, into a projection: a list of
+// indices into ObservationFields. It returns nil, selecting all fields, for
+// an empty list, and an error with status 400 for an unknown field.
+func ParseObservationFields(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	out := make([]int, 0)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		i := 0
+		for i < len(ObservationFields) && ObservationFields[i] != name {
+			i++
+		}
+		if i == len(ObservationFields) {
+			return nil, PTOErrorf("unknown field %s; available fields are %s",
+				name, strings.Join(ObservationFields, ", ")).StatusIs(http.StatusBadRequest)
+		}
+		out = append(out, i)
+	}
+	return out, nil
+}
+
+// ProjectObservationFields selects the given fields from a slice of all the
+// fields of an observation, in ObservationFields order. Missing trailing
+// fields (i.e., an empty value) are projected as empty strings. A nil
+// projection returns the fields unchanged.
+func ProjectObservationFields(all []string, fields []int) []string {
+	if fields == nil {
+		return all
+	}
+
+	out := make([]string, len(fields))
+	for i, f := range fields {
+		if f < len(all) {
+			out[i] = all[f]
+		}
+	}
+	return out
+}
+
+// observationFieldValues returns all the fields of an observation as strings,
+// in ObservationFields order.
+func observationFieldValues(obs *Observation) []string {
+	return []string{
+		fmt.Sprintf("%x", obs.SetID),
+		obs.TimeStart.UTC().Format(time.RFC3339),
+		obs.TimeEnd.UTC().Format(time.RFC3339),
+		obs.Path.String,
+		obs.Condition.Name,
+		obs.StringValue(),
+	}
+}
+
+// observationJSONValues returns the given fields of an observation for
+// encoding as a JSON array, given its first five fields as strings and its
+// value as JSON. The value keeps its JSON type; a missing value is given as
+// an empty string.
+func observationJSONValues(all []string, value json.RawMessage, fields []int) []interface{} {
+	out := make([]interface{}, len(fields))
+	for i, f := range fields {
+		switch {
+		case f < 5:
+			out[i] = all[f]
+		case len(value) > 0:
+			out[i] = value
+		default:
+			out[i] = ""
+		}
+	}
+	return out
+}
+
+// Names of built-in observation formats
+const (
+	ObservationFormatNDJSON  = "ndjson"
+	ObservationFormatCSV     = "csv"
+	ObservationFormatDict    = "dict"
+	ObservationFormatArrow   = "arrow"
+	ObservationFormatParquet = "parquet"
+)
+
+var observationFormats = make(map[string]*ObservationFormat)
+var observationFormatLock sync.RWMutex
+
+// RegisterObservationFormat registers an output format for observations,
+// replacing any format with the same name. Formats must be registered before
+// the server starts handling requests; the ndjson, csv, dict, arrow, and
+// parquet formats are registered by default.
+func RegisterObservationFormat(format *ObservationFormat) {
+	observationFormatLock.Lock()
+	defer observationFormatLock.Unlock()
+	observationFormats[format.Name] = format
+}
+
+// ObservationFormatByName returns the registered format with the given
+// name, or nil if there is none.
+func ObservationFormatByName(name string) *ObservationFormat {
+	observationFormatLock.RLock()
+	defer observationFormatLock.RUnlock()
+	return observationFormats[name]
+}
+
+// ObservationFormatByContentType returns the registered format with the
+// given MIME type, or nil if there is none.
+func ObservationFormatByContentType(contentType string) *ObservationFormat {
+	observationFormatLock.RLock()
+	defer observationFormatLock.RUnlock()
+	for _, format := range observationFormats {
+		if format.ContentType == contentType {
+			return format
+		}
+	}
+	return nil
+}
+
+// ObservationFormatNames returns the names of all registered formats, sorted.
+func ObservationFormatNames() []string {
+	observationFormatLock.RLock()
+	defer observationFormatLock.RUnlock()
+	out := make([]string, 0, len(observationFormats))
+	for name := range observationFormats {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// NegotiateObservationFormat selects an observation format for a request: by
+// name from the format parameter if given, otherwise from the first media
+// type in the Accept header naming a registered format. It returns nil if
+// neither selects a format, and an error with status 406 if the format
+// parameter names an unknown format.
+func NegotiateObservationFormat(r *http.Request) (*ObservationFormat, error) {
+	if name := r.FormValue("format"); name != "" {
+		format := ObservationFormatByName(name)
+		if format == nil {
+			return nil, PTOErrorf("unknown format %s; available formats are %s",
+				name, strings.Join(ObservationFormatNames(), ", ")).StatusIs(http.StatusNotAcceptable)
+		}
+		return format, nil
+	}
+
+	for _, mediaRange := range strings.Split(r.Header.Get("Accept"), ",") {
+		contentType := strings.TrimSpace(strings.SplitN(mediaRange, ";", 2)[0])
+		if format := ObservationFormatByContentType(contentType); format != nil {
+			return format, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ndjsonEncoder writes observations in observation set file format, one JSON
+// array per line.
+type ndjsonEncoder struct {
+	out    io.Writer
+	fields []int
+}
+
+// NewNDJSONEncoder returns an encoder writing observations in observation set
+// file format, or if fields are given, as JSON arrays of only those fields.
+func NewNDJSONEncoder(out io.Writer, fields []int) ObservationEncoder {
+	return &ndjsonEncoder{out: out, fields: fields}
+}
+
+func (enc *ndjsonEncoder) Encode(obs *Observation) error {
+	var b []byte
+	var err error
+	if enc.fields == nil {
+		b, err = obs.MarshalJSON()
+	} else {
+		b, err = json.Marshal(observationJSONValues(observationFieldValues(obs), obs.Value, enc.fields))
+	}
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := fmt.Fprintf(enc.out, "%s\n", b); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+func (enc *ndjsonEncoder) Close() error {
+	return nil
+}
+
+// csvEncoder writes observations as CSV with a header row.
+type csvEncoder struct {
+	out         *csv.Writer
+	fields      []int
+	opts        *ExportOptions
+	wroteHeader bool
+}
+
+// NewCSVEncoder returns an encoder writing the given fields of observations
+// as CSV, with a header row naming the columns.
+func NewCSVEncoder(out io.Writer, fields []int) ObservationEncoder {
+	return NewFormattedCSVEncoder(out, fields, nil)
+}
+
+// NewFormattedCSVEncoder returns an encoder writing the given fields of
+// observations as CSV, formatted as given by export options, or nil for the
+// defaults. With a decimal comma, fields are separated by semicolons, as
+// spreadsheets using a decimal comma expect.
+func NewFormattedCSVEncoder(out io.Writer, fields []int, opts *ExportOptions) ObservationEncoder {
+	enc := &csvEncoder{out: csv.NewWriter(out), fields: fields, opts: opts.withDefaults()}
+	if enc.opts.DecimalSeparator == ExportDecimalComma {
+		enc.out.Comma = ';'
+	}
+	return enc
+}
+
+func (enc *csvEncoder) writeHeader() error {
+	if !enc.wroteHeader {
+		enc.wroteHeader = true
+		if enc.opts.Header == ExportHeaderNone {
+			return nil
+		}
+		if err := enc.out.Write(ProjectObservationFields(enc.opts.headerNames(), enc.fields)); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+	return nil
+}
+
+func (enc *csvEncoder) Encode(obs *Observation) error {
+	if err := enc.writeHeader(); err != nil {
+		return err
+	}
+
+	if err := enc.out.Write(ProjectObservationFields(enc.opts.fieldValues(obs), enc.fields)); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+func (enc *csvEncoder) Close() error {
+	if err := enc.writeHeader(); err != nil {
+		return err
+	}
+
+	enc.out.Flush()
+	if err := enc.out.Error(); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// dictEncoder writes observations as newline-delimited JSON, replacing paths
+// and conditions with integer references into dictionaries defined in the
+// stream itself. Each path or condition is defined once, on a line of the
+// form {"dict":"path","id":0,"value":"..."} preceding the first observation
+// referring to it; observations are JSON arrays as in observation set file
+// format, with path and condition given by ID.
+type dictEncoder struct {
+	out        io.Writer
+	fields     []int
+	paths      map[string]int
+	conditions map[string]int
+}
+
+// NewDictEncoder returns an encoder writing the given fields of observations
+// with dictionary-encoded paths and conditions.
+func NewDictEncoder(out io.Writer, fields []int) ObservationEncoder {
+	return &dictEncoder{
+		out:        out,
+		fields:     fields,
+		paths:      make(map[string]int),
+		conditions: make(map[string]int),
+	}
+}
+
+// Kinds of dictionary defined in dictionary-encoded streams
+const (
+	DictPath      = "path"
+	DictCondition = "condition"
+)
+
+type dictEntry struct {
+	Dict  string `json:"dict"`
+	ID    int    `json:"id"`
+	Value string `json:"value"`
+}
+
+// reference returns the ID of a string in a dictionary, defining it in the
+// stream if it is not yet defined.
+func (enc *dictEncoder) reference(dict string, ids map[string]int, s string) (int, error) {
+	if id, ok := ids[s]; ok {
+		return id, nil
+	}
+
+	id := len(ids)
+	ids[s] = id
+
+	b, err := json.Marshal(&dictEntry{Dict: dict, ID: id, Value: s})
+	if err != nil {
+		return 0, PTOWrapError(err)
+	}
+	if _, err := fmt.Fprintf(enc.out, "%s\n", b); err != nil {
+		return 0, PTOWrapError(err)
+	}
+	return id, nil
+}
+
+func (enc *dictEncoder) Encode(obs *Observation) error {
+	fields := enc.fields
+	ref := obs.SourceRef()
+	if fields == nil {
+		// as in observation set file format, omit empty values unless
+		// followed by a source reference
+		fields = []int{0, 1, 2, 3, 4}
+		if obs.HasValue() || ref != nil {
+			fields = append(fields, 5)
+		}
+	}
+
+	values := observationFieldValues(obs)
+	row := observationJSONValues(values, obs.Value, fields)
+	for i, f := range fields {
+		var err error
+		switch ObservationFields[f] {
+		case "path":
+			row[i], err = enc.reference(DictPath, enc.paths, values[f])
+		case "condition":
+			row[i], err = enc.reference(DictCondition, enc.conditions, values[f])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if enc.fields == nil && ref != nil {
+		if !obs.HasValue() {
+			row[5] = nil
+		}
+		row = append(row, ref)
+	}
+
+	b, err := json.Marshal(row)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if _, err := fmt.Fprintf(enc.out, "%s\n", b); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+func (enc *dictEncoder) Close() error {
+	return nil
+}
+
+func init() {
+	RegisterObservationFormat(&ObservationFormat{
+		Name:        ObservationFormatNDJSON,
+		ContentType: "application/vnd.mami.ndjson",
+		NewEncoder:  NewNDJSONEncoder,
+	})
+	RegisterObservationFormat(&ObservationFormat{
+		Name:                ObservationFormatCSV,
+		ContentType:         "text/csv",
+		NewEncoder:          NewCSVEncoder,
+		NewFormattedEncoder: NewFormattedCSVEncoder,
+	})
+	RegisterObservationFormat(&ObservationFormat{
+		Name:        ObservationFormatDict,
+		ContentType: "application/vnd.mami.dict+ndjson",
+		NewEncoder:  NewDictEncoder,
+	})
+	RegisterObservationFormat(&ObservationFormat{
+		Name:        ObservationFormatArrow,
+		ContentType: "application/vnd.apache.arrow.stream",
+		NewEncoder:  NewArrowEncoder,
+	})
+	RegisterObservationFormat(&ObservationFormat{
+		Name:        ObservationFormatParquet,
+		ContentType: "application/vnd.apache.parquet",
+		NewEncoder:  NewParquetEncoder,
+	})
+}
@@ -0,0 +1,800 @@
+package pto3
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Raw data files in campaigns whose metadata sets EncryptedMetadataKey to
+// "true" are stored encrypted, using envelope encryption: each campaign has
+// its own randomly generated data key, which is stored in the campaign
+// directory wrapped (encrypted) by a key encryption key held either in a
+// local keyfile or in a key management service; see KeyWrapper. Data files
+// are encrypted with AES-256-GCM in chunks of EncryptedChunkSize bytes, each
+// authenticated separately, so that a reader can start at any offset by
+// decrypting only the chunk containing it. Files are decrypted transparently
+// when read through the raw data store, so downloads, excerpts, and digests
+// refer to the data as uploaded.
+
+// EncryptedMetadataKey is the campaign metadata key which, set to "true",
+// causes data files subsequently uploaded to the campaign to be stored
+// encrypted.
+const EncryptedMetadataKey = "_encrypted"
+
+// EncryptedSuffix is appended to the name of a data file stored encrypted.
+const EncryptedSuffix = ".enc"
+
+// CampaignKeyFilename is the name of the file in a campaign directory holding
+// the campaign's wrapped data key.
+const CampaignKeyFilename = "__pto_campaign_key.json"
+
+// EncryptedChunkSize is the amount of data encrypted into each chunk of an
+// encrypted data file.
+const EncryptedChunkSize = 64 << 10
+
+const (
+	encryptedMagic      = "PTOENC01"
+	encryptedPrefixSize = 8
+	encryptedHeaderSize = len(encryptedMagic) + encryptedPrefixSize
+	encryptedTagSize    = 16
+	dataKeySize         = 32
+)
+
+// KeyWrapper wraps and unwraps campaign data keys with a key encryption key
+// it holds. The context, the campaign name, is bound to the wrapped key where
+// the wrapper supports it, so that a wrapped key cannot be moved to another
+// campaign. Key encryption keys can be rotated: keys wrapped under an older
+// key encryption key can still be unwrapped, and are moved to the current
+// one by RawDataStore.RewrapDataKeys.
+type KeyWrapper interface {
+	// Name identifies the kind of wrapper, and is stored with wrapped keys
+	Name() string
+	// CurrentKeyID identifies the key encryption key data keys are wrapped
+	// with, or is empty if the wrapper keeps track of key versions itself
+	CurrentKeyID() string
+	// WrapKey encrypts a data key with the current key encryption key,
+	// returning the wrapped key and the identifier of the key encryption key
+	WrapKey(context string, key []byte) ([]byte, string, error)
+	// UnwrapKey decrypts a data key wrapped by WrapKey, given the identifier
+	// of the key encryption key it was wrapped with
+	UnwrapKey(context string, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// localKeyWrapper wraps keys with AES-256-GCM under key encryption keys read
+// from a local keyfile.
+type localKeyWrapper struct {
+	// ciphers for each key encryption key, by key identifier
+	aeads map[string]cipher.AEAD
+
+	// identifiers of the key encryption keys, oldest first
+	ids []string
+}
+
+// NewLocalKeyWrapper creates a KeyWrapper using the key encryption keys in
+// the given keyfile, which must contain one or more 32-byte keys encoded in
+// hex, one per line. Blank lines and lines starting with # are ignored. The
+// last key is the current key; to rotate keys, append a new one to the file,
+// keeping the older keys until all data keys have been rewrapped.
+func NewLocalKeyWrapper(keyfile string) (KeyWrapper, error) {
+	b, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	kw := localKeyWrapper{aeads: make(map[string]cipher.AEAD)}
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != dataKeySize {
+			return nil, PTOErrorf("line %d of keyfile %s must contain a %d-byte key in hex", i+1, keyfile, dataKeySize)
+		}
+
+		aead, err := newDataCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		// identify keys by digest, so that identifiers don't change when
+		// keys are added
+		digest := sha256.Sum256(key)
+		id := hex.EncodeToString(digest[:4])
+		if _, ok := kw.aeads[id]; ok {
+			return nil, PTOErrorf("duplicate key on line %d of keyfile %s", i+1, keyfile)
+		}
+		kw.aeads[id] = aead
+		kw.ids = append(kw.ids, id)
+	}
+
+	if len(kw.ids) == 0 {
+		return nil, PTOErrorf("keyfile %s contains no keys", keyfile)
+	}
+
+	return &kw, nil
+}
+
+func (kw *localKeyWrapper) Name() string {
+	return "local"
+}
+
+func (kw *localKeyWrapper) CurrentKeyID() string {
+	return kw.ids[len(kw.ids)-1]
+}
+
+func (kw *localKeyWrapper) WrapKey(context string, key []byte) ([]byte, string, error) {
+	id := kw.CurrentKeyID()
+	aead := kw.aeads[id]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", PTOWrapError(err)
+	}
+	return aead.Seal(nonce, nonce, key, []byte(context)), id, nil
+}
+
+func (kw *localKeyWrapper) UnwrapKey(context string, keyID string, wrapped []byte) ([]byte, error) {
+	// keys wrapped without an identifier may be wrapped with any key
+	ids := []string{keyID}
+	if keyID == "" {
+		ids = kw.ids
+	} else if _, ok := kw.aeads[keyID]; !ok {
+		return nil, PTOErrorf("cannot unwrap key for %s: key encryption key %s not in keyfile", context, keyID)
+	}
+
+	for _, id := range ids {
+		aead := kw.aeads[id]
+		if len(wrapped) < aead.NonceSize() {
+			return nil, PTOErrorf("wrapped key too short")
+		}
+		nonce := wrapped[:aead.NonceSize()]
+		if key, err := aead.Open(nil, nonce, wrapped[len(nonce):], []byte(context)); err == nil {
+			return key, nil
+		}
+	}
+
+	return nil, PTOErrorf("cannot unwrap key for %s: authentication failed", context)
+}
+
+// KMSOptions configures wrapping of campaign data keys by a key management
+// service implementing the HashiCorp Vault transit secrets engine API.
+type KMSOptions struct {
+	// URL of the transit secrets engine, e.g.
+	// https://vault.example.com:8200/v1/transit
+	URL string
+
+	// Name of the key encryption key in the transit engine
+	Key string
+
+	// Path to a file containing the token to authenticate with; if empty,
+	// the token is taken from the VAULT_TOKEN environment variable
+	TokenFile string
+}
+
+// kmsKeyWrapper wraps keys by having a Vault transit secrets engine encrypt
+// them.
+type kmsKeyWrapper struct {
+	opts   KMSOptions
+	token  string
+	client http.Client
+}
+
+// NewKMSKeyWrapper creates a KeyWrapper using a key management service. The
+// service versions its keys, and keeps the version in each wrapped key, so
+// keys are rotated with the service's own rotation operation.
+func NewKMSKeyWrapper(opts *KMSOptions) (KeyWrapper, error) {
+	if opts.URL == "" || opts.Key == "" {
+		return nil, PTOErrorf("key management service needs a URL and a key name")
+	}
+
+	token := os.Getenv("VAULT_TOKEN")
+	if opts.TokenFile != "" {
+		b, err := ioutil.ReadFile(opts.TokenFile)
+		if err != nil {
+			return nil, PTOWrapError(err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token == "" {
+		return nil, PTOErrorf("no token for key management service")
+	}
+
+	return &kmsKeyWrapper{
+		opts:   *opts,
+		token:  token,
+		client: http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (kw *kmsKeyWrapper) Name() string {
+	return "kms"
+}
+
+func (kw *kmsKeyWrapper) CurrentKeyID() string {
+	return ""
+}
+
+// call POSTs a request to an operation of the transit engine, and decodes
+// the data in the response.
+func (kw *kmsKeyWrapper) call(operation string, in interface{}, out interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(kw.opts.URL, "/")+"/"+operation+"/"+kw.opts.Key, bytes.NewReader(b))
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", kw.token)
+
+	res, err := kw.client.Do(req)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return PTOErrorf("key management service %s failed: %s", operation, res.Status)
+	}
+
+	response := struct {
+		Data interface{} `json:"data"`
+	}{Data: out}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+func (kw *kmsKeyWrapper) WrapKey(context string, key []byte) ([]byte, string, error) {
+	var out struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+	if err := kw.call("encrypt", map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(key),
+	}, &out); err != nil {
+		return nil, "", err
+	}
+	return []byte(out.Ciphertext), "", nil
+}
+
+func (kw *kmsKeyWrapper) UnwrapKey(context string, keyID string, wrapped []byte) ([]byte, error) {
+	var out struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := kw.call("decrypt", map[string]string{
+		"ciphertext": string(wrapped),
+	}, &out); err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(out.Plaintext)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return key, nil
+}
+
+// campaignKey is the content of a campaign key file.
+type campaignKey struct {
+	// Name of the KeyWrapper which wrapped the key
+	Wrapper string `json:"wrapper"`
+	// Identifier of the key encryption key, if the wrapper has one
+	KeyID string `json:"key_id,omitempty"`
+	// Wrapped data key
+	WrappedKey []byte `json:"wrapped_key"`
+	// Time the key was generated
+	Created time.Time `json:"created"`
+}
+
+// newDataCipher returns an AES-256-GCM cipher with the given key.
+func newDataCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return aead, nil
+}
+
+// IsEncrypted returns true if data files uploaded to this campaign are stored
+// encrypted.
+func (cam *Campaign) IsEncrypted() (bool, error) {
+	md, err := cam.GetCampaignMetadata()
+	if err != nil {
+		return false, err
+	}
+	return md.Get(EncryptedMetadataKey, false) == "true", nil
+}
+
+// checkEncryption returns an error if campaign metadata asks for encryption
+// which this server cannot provide.
+func (cam *Campaign) checkEncryption(md *RawMetadata) error {
+	switch md.Get(EncryptedMetadataKey, false) {
+	case "", "false":
+		return nil
+	case "true":
+	default:
+		return PTOErrorf("%s must be true or false", EncryptedMetadataKey).StatusIs(http.StatusBadRequest)
+	}
+
+	kw, err := cam.config.KeyWrapper()
+	if err != nil {
+		return err
+	}
+	if kw == nil {
+		return PTOErrorf("campaign %s cannot be encrypted: no key encryption key configured", cam.name()).StatusIs(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// dataKey returns this campaign's unwrapped data key, reading it from the
+// campaign key file, or generating it if create is true and the campaign has
+// no key yet.
+func (cam *Campaign) dataKey(create bool) ([]byte, error) {
+	cam.keyLock.Lock()
+	defer cam.keyLock.Unlock()
+
+	if cam.key != nil {
+		return cam.key, nil
+	}
+
+	kw, err := cam.keyWrapper()
+	if err != nil {
+		return nil, err
+	}
+
+	keypath := filepath.Join(cam.path, CampaignKeyFilename)
+	_, key, err := cam.readDataKey(kw, keypath)
+	if os.IsNotExist(err) && create {
+		return cam.generateDataKey(kw, keypath)
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	cam.key = key
+	return key, nil
+}
+
+// keyWrapper returns the configured KeyWrapper, or an error if there is none.
+func (cam *Campaign) keyWrapper() (KeyWrapper, error) {
+	kw, err := cam.config.KeyWrapper()
+	if err != nil {
+		return nil, err
+	}
+	if kw == nil {
+		return nil, PTOErrorf("no key encryption key configured for encrypted campaign %s", cam.name())
+	}
+	return kw, nil
+}
+
+// readDataKey reads and unwraps the data key in the campaign key file. It
+// returns the content of the key file along with the unwrapped key.
+func (cam *Campaign) readDataKey(kw KeyWrapper, keypath string) (*campaignKey, []byte, error) {
+	b, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ck campaignKey
+	if err := json.Unmarshal(b, &ck); err != nil {
+		return nil, nil, PTOErrorf("error loading key for campaign %s: %v", cam.name(), err)
+	}
+	if ck.Wrapper != kw.Name() {
+		return nil, nil, PTOErrorf("key for campaign %s was wrapped by %s, but %s is configured", cam.name(), ck.Wrapper, kw.Name())
+	}
+
+	key, err := kw.UnwrapKey(cam.name(), ck.KeyID, ck.WrappedKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(key) != dataKeySize {
+		return nil, nil, PTOErrorf("key for campaign %s has %d bytes, expected %d", cam.name(), len(key), dataKeySize)
+	}
+
+	return &ck, key, nil
+}
+
+// generateDataKey generates a data key for this campaign, and writes it
+// wrapped to the campaign key file. It must be called with the key lock held.
+func (cam *Campaign) generateDataKey(kw KeyWrapper, keypath string) ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	wrapped, keyID, err := kw.WrapKey(cam.name(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(campaignKey{Wrapper: kw.Name(), KeyID: keyID, WrappedKey: wrapped, Created: time.Now().UTC()})
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	// never replace an existing key, which would make its files unreadable
+	f, err := os.OpenFile(keypath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return nil, PTOWrapError(err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	cam.key = key
+	return key, nil
+}
+
+// RewrapDataKey wraps this campaign's data key again with the current key
+// encryption key, after the key encryption key has been rotated. The data
+// key itself, and so the campaign's data files, are unchanged. It returns
+// false if the campaign has no data key, or its key is already wrapped with
+// the current key encryption key.
+func (cam *Campaign) RewrapDataKey() (bool, error) {
+	cam.keyLock.Lock()
+	defer cam.keyLock.Unlock()
+
+	keypath := filepath.Join(cam.path, CampaignKeyFilename)
+	if _, err := os.Stat(keypath); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	kw, err := cam.keyWrapper()
+	if err != nil {
+		return false, err
+	}
+
+	ck, key, err := cam.readDataKey(kw, keypath)
+	if err != nil {
+		return false, PTOWrapError(err)
+	}
+	if current := kw.CurrentKeyID(); current != "" && ck.KeyID == current {
+		return false, nil
+	}
+
+	if ck.WrappedKey, ck.KeyID, err = kw.WrapKey(cam.name(), key); err != nil {
+		return false, err
+	}
+
+	b, err := json.Marshal(ck)
+	if err != nil {
+		return false, PTOWrapError(err)
+	}
+
+	// write and rename, so that a crash leaves the old key intact
+	temppath := keypath + ".tmp"
+	if err := ioutil.WriteFile(temppath, b, 0600); err != nil {
+		return false, PTOWrapError(err)
+	}
+	if err := os.Rename(temppath, keypath); err != nil {
+		os.Remove(temppath)
+		return false, PTOWrapError(err)
+	}
+
+	cam.key = key
+	return true, nil
+}
+
+// RewrapDataKeys wraps the data keys of all campaigns in this store again
+// with the current key encryption key; see Campaign.RewrapDataKey. It returns
+// the sorted names of the campaigns whose keys were rewrapped.
+func (rds *RawDataStore) RewrapDataKeys() ([]string, error) {
+	camnames := rds.CampaignNames()
+	sort.Strings(camnames)
+
+	rewrapped := make([]string, 0)
+	for _, camname := range camnames {
+		cam, err := rds.CampaignForName(camname)
+		if err != nil {
+			return rewrapped, err
+		}
+
+		ok, err := cam.RewrapDataKey()
+		if err != nil {
+			return rewrapped, err
+		}
+		if ok {
+			rewrapped = append(rewrapped, camname)
+		}
+	}
+
+	return rewrapped, nil
+}
+
+// EncryptedReader reads a data file stored encrypted. Reads and seeks refer
+// to the decrypted data.
+type EncryptedReader struct {
+	f      *os.File
+	aead   cipher.AEAD
+	name   string
+	prefix []byte
+	chunks int64
+	size   int64
+	pos    int64
+
+	// the most recently decrypted chunk, or -1
+	cur int64
+	buf []byte
+}
+
+// OpenEncrypted opens an encrypted data file for reading with the given key.
+// The name is the name of the data file as uploaded, which is authenticated
+// along with each chunk.
+func OpenEncrypted(pathname string, key []byte, name string) (*EncryptedReader, error) {
+	aead, err := newDataCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+
+	er := EncryptedReader{f: f, aead: aead, name: name, cur: -1}
+	if err := er.readHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &er, nil
+}
+
+// readHeader checks the file header, and computes the number of chunks and
+// the size of the decrypted data from the size of the file.
+func (er *EncryptedReader) readHeader() error {
+	fi, err := er.f.Stat()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	body := fi.Size() - int64(encryptedHeaderSize)
+	if body < encryptedTagSize {
+		return PTOErrorf("%s is too short to be an encrypted file", er.f.Name())
+	}
+
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := er.f.ReadAt(header, 0); err != nil {
+		return PTOWrapError(err)
+	}
+	if string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return PTOErrorf("%s is not an encrypted file", er.f.Name())
+	}
+	er.prefix = header[len(encryptedMagic):]
+
+	sealed := int64(EncryptedChunkSize + encryptedTagSize)
+	er.chunks = (body + sealed - 1) / sealed
+	if body-(er.chunks-1)*sealed < encryptedTagSize {
+		return PTOErrorf("%s has a truncated chunk", er.f.Name())
+	}
+	er.size = body - er.chunks*encryptedTagSize
+
+	return nil
+}
+
+// Size returns the size of the decrypted data.
+func (er *EncryptedReader) Size() int64 {
+	return er.size
+}
+
+// loadChunk decrypts chunk i into the chunk buffer, unless it is there
+// already.
+func (er *EncryptedReader) loadChunk(i int64) error {
+	if i == er.cur {
+		return nil
+	}
+
+	sealed := int64(EncryptedChunkSize + encryptedTagSize)
+	offset := int64(encryptedHeaderSize) + i*sealed
+	length := sealed
+	last := i == er.chunks-1
+	if last {
+		length = er.size - i*EncryptedChunkSize + encryptedTagSize
+	}
+
+	ciphertext := make([]byte, length)
+	if _, err := er.f.ReadAt(ciphertext, offset); err != nil {
+		return PTOWrapError(err)
+	}
+
+	er.cur = -1
+	buf, err := er.aead.Open(er.buf[:0], chunkNonce(er.prefix, i), ciphertext, chunkData(er.name, last))
+	if err != nil {
+		return PTOErrorf("chunk %d of %s failed authentication", i, er.f.Name())
+	}
+
+	er.buf = buf
+	er.cur = i
+	return nil
+}
+
+func (er *EncryptedReader) Read(p []byte) (int, error) {
+	if er.pos >= er.size {
+		return 0, io.EOF
+	}
+
+	i := er.pos / EncryptedChunkSize
+	if err := er.loadChunk(i); err != nil {
+		return 0, err
+	}
+
+	n := copy(p, er.buf[er.pos-i*EncryptedChunkSize:])
+	er.pos += int64(n)
+	return n, nil
+}
+
+func (er *EncryptedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += er.pos
+	case io.SeekEnd:
+		offset += er.size
+	default:
+		return er.pos, PTOErrorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return er.pos, PTOErrorf("negative position %d", offset)
+	}
+
+	er.pos = offset
+	return er.pos, nil
+}
+
+// Stat returns information about the underlying file, with the size of the
+// decrypted data.
+func (er *EncryptedReader) Stat() (os.FileInfo, error) {
+	fi, err := er.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return seekableFileInfo{fi, er.size}, nil
+}
+
+func (er *EncryptedReader) Close() error {
+	return er.f.Close()
+}
+
+// EncryptedWriter writes a data file encrypted. Data is buffered and
+// encrypted a chunk at a time; Close writes the final chunk, which is marked
+// as such so that truncation is detected, and must be called for the file to
+// be readable.
+type EncryptedWriter struct {
+	f      *os.File
+	aead   cipher.AEAD
+	name   string
+	prefix []byte
+	i      int64
+	buf    []byte
+	out    []byte
+}
+
+// CreateEncrypted creates an encrypted data file for writing with the given
+// key. The name is the name of the data file as uploaded, which is
+// authenticated along with each chunk.
+func CreateEncrypted(pathname string, key []byte, name string) (*EncryptedWriter, error) {
+	aead, err := newDataCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// a random prefix for each file keeps nonces unique under the same key
+	prefix := make([]byte, encryptedPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	f, err := os.OpenFile(pathname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := f.Write(append([]byte(encryptedMagic), prefix...)); err != nil {
+		f.Close()
+		return nil, PTOWrapError(err)
+	}
+
+	return &EncryptedWriter{
+		f:      f,
+		aead:   aead,
+		name:   name,
+		prefix: prefix,
+		buf:    make([]byte, 0, EncryptedChunkSize),
+	}, nil
+}
+
+// Name returns the path of the file being written.
+func (ew *EncryptedWriter) Name() string {
+	return ew.f.Name()
+}
+
+func (ew *EncryptedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only written once we know it is not the last
+		if len(ew.buf) == cap(ew.buf) {
+			if err := ew.writeChunk(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// writeChunk encrypts and writes the buffered data as a chunk.
+func (ew *EncryptedWriter) writeChunk(last bool) error {
+	ew.out = ew.aead.Seal(ew.out[:0], chunkNonce(ew.prefix, ew.i), ew.buf, chunkData(ew.name, last))
+	if _, err := ew.f.Write(ew.out); err != nil {
+		return PTOWrapError(err)
+	}
+
+	ew.i++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+// Close writes the final chunk, and syncs and closes the file.
+func (ew *EncryptedWriter) Close() error {
+	if err := ew.writeChunk(true); err != nil {
+		ew.f.Close()
+		return err
+	}
+
+	if err := ew.f.Sync(); err != nil {
+		ew.f.Close()
+		return PTOWrapError(err)
+	}
+
+	return ew.f.Close()
+}
+
+// chunkNonce returns the nonce for chunk i of a file with the given prefix.
+func chunkNonce(prefix []byte, i int64) []byte {
+	nonce := make([]byte, encryptedPrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptedPrefixSize:], uint32(i))
+	return nonce
+}
+
+// chunkData returns the additional data authenticated with each chunk: the
+// name of the file, and whether the chunk is the last.
+func chunkData(name string, last bool) []byte {
+	if last {
+		return append([]byte(name), 1)
+	}
+	return append([]byte(name), 0)
+}
@@ -1,21 +1,45 @@
 package pto3
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"runtime/debug"
+	"strings"
 	"time"
 )
 
-// PTOError represents an error with an associated status code (usually an HTTP status code)
+// PTOError represents an error with an associated status code (usually an
+// HTTP status code), and optionally a machine-readable error code.
 type PTOError struct {
-	e  string
-	s  int
-	at []byte
+	e    string
+	s    int
+	code string
+	at   []byte
 }
 
-// PTOWrapError creates a new PTO error wrapping a lower level error.
+// Error codes for errors clients are expected to handle programmatically.
+// Errors without one of these have a code derived from their status, or, for
+// errors about a subject of a given kind, from the kind; see ErrorCodeFor.
+const (
+	// Metadata is malformed or lacks a required key
+	ErrorCodeInvalidMetadata = "invalid_metadata"
+	// Internal error, logged on the server with the error's request ID
+	ErrorCodeInternal = "internal_error"
+	// The client's queries have reached a ceiling on their resource usage
+	ErrorCodeQueryLimit = "query_limit_reached"
+	// The request names a version of the API which is not served
+	ErrorCodeUnsupportedVersion = "unsupported_api_version"
+	// The client has exceeded the rate of requests it may make
+	ErrorCodeRateLimit = "rate_limited"
+	// The client has as many requests in progress as it may
+	ErrorCodeConcurrencyLimit = "concurrency_limit_reached"
+)
+
+// PTOWrapError creates a new PTO error wrapping a lower level error. Errors
+// indicating that the observation database is unavailable have status 503,
+// so that clients know to retry later; see IsTransientDBError.
 func PTOWrapError(err error) *PTOError {
 	if err == nil {
 		return nil
@@ -23,6 +47,9 @@ func PTOWrapError(err error) *PTOError {
 
 	e := new(PTOError)
 	e.s = http.StatusInternalServerError
+	if IsTransientDBError(err) {
+		e.s = http.StatusServiceUnavailable
+	}
 	e.e = err.Error()
 	e.at = debug.Stack()
 	return e
@@ -53,6 +80,41 @@ func (e *PTOError) Status() int {
 	return e.s
 }
 
+// CodeIs sets the machine-readable code of a PTOError, returning the error.
+func (e *PTOError) CodeIs(code string) *PTOError {
+	e.code = code
+	return e
+}
+
+// Code returns the machine-readable code of a PTOError, derived from its
+// status if none was set.
+func (e *PTOError) Code() string {
+	if e.code != "" {
+		return e.code
+	}
+	return ErrorCodeFor(e.s)
+}
+
+// ErrorCodeFor returns the machine-readable code of errors with the given
+// status and no more specific code, e.g. not_found for status 404.
+func ErrorCodeFor(status int) string {
+	if status == http.StatusInternalServerError {
+		return ErrorCodeInternal
+	}
+	if text := http.StatusText(status); text != "" {
+		return errorCodeSlug(text)
+	}
+	return "error"
+}
+
+// errorCodeSlug turns a phrase into an error code, in lowercase with words
+// separated by underscores.
+func errorCodeSlug(phrase string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(phrase), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	}), "_")
+}
+
 // Stack returns the stack backtrace associated with a PTOError
 func (e *PTOError) Stack() []byte {
 	return e.at
@@ -60,12 +122,12 @@ func (e *PTOError) Stack() []byte {
 
 // PTONotFoundError returns an error for a subject of a given type that does not exist
 func PTONotFoundError(kind string, subject string) *PTOError {
-	return PTOErrorf("%s %s not found", kind, subject).StatusIs(http.StatusNotFound)
+	return PTOErrorf("%s %s not found", kind, subject).StatusIs(http.StatusNotFound).CodeIs(errorCodeSlug(kind) + "_not_found")
 }
 
 // PTOExistsError returns an error for a subject of a given kind that already exists
 func PTOExistsError(kind string, subject string) *PTOError {
-	return PTOErrorf("%s %s already exists", kind, subject).StatusIs(http.StatusBadRequest)
+	return PTOErrorf("%s %s already exists", kind, subject).StatusIs(http.StatusBadRequest).CodeIs(errorCodeSlug(kind) + "_exists")
 }
 
 // PTOMediaTypeError returns an error for an unsupported MIME type for a given subject
@@ -75,7 +137,66 @@ func PTOMediaTypeError(subject string) *PTOError {
 
 // PTOMissingMetadataError returns an error for a missing metadata key in upload.
 func PTOMissingMetadataError(subject string) *PTOError {
-	return PTOErrorf("missing key %s in metadata", subject).StatusIs(http.StatusBadRequest)
+	return PTOErrorf("missing key %s in metadata", subject).StatusIs(http.StatusBadRequest).CodeIs(ErrorCodeInvalidMetadata)
+}
+
+// PTOInvalidMetadataError returns an error for metadata in an upload which
+// cannot be parsed.
+func PTOInvalidMetadataError(err error) *PTOError {
+	return PTOErrorf("invalid metadata: %s", err.Error()).StatusIs(http.StatusBadRequest).CodeIs(ErrorCodeInvalidMetadata)
+}
+
+// RequestIDHeader is the response header carrying the ID of the request it
+// responds to, included in error responses so that they can be traced in the
+// server log.
+const RequestIDHeader = "X-Request-Id"
+
+// ErrorResponse is the JSON body of every error response.
+type ErrorResponse struct {
+	// HTTP status of the response
+	Status int `json:"status"`
+	// Machine-readable error code, e.g. campaign_not_found
+	Code string `json:"error"`
+	// Human-readable error message
+	Message string `json:"message"`
+	// What the server was doing when the error occurred, if known
+	Detail string `json:"detail,omitempty"`
+	// ID of the request, from the RequestIDHeader of the response
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// WriteErrorHTTP writes an error response with the given status, code,
+// message, and optional detail to an HTTP response writer, as a JSON
+// ErrorResponse. The code is derived from the status if empty.
+func WriteErrorHTTP(w http.ResponseWriter, status int, code string, message string, detail string) {
+	if code == "" {
+		code = ErrorCodeFor(status)
+	}
+
+	b, err := json.Marshal(&ErrorResponse{
+		Status:    status,
+		Code:      code,
+		Message:   message,
+		Detail:    detail,
+		RequestID: w.Header().Get(RequestIDHeader),
+	})
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b)
+	w.Write([]byte("\n"))
+}
+
+// HTTPError writes an error response with the given message and status to an
+// HTTP response writer, as WriteErrorHTTP, with the code derived from the
+// status. It is a drop-in replacement for http.Error.
+func HTTPError(w http.ResponseWriter, message string, status int) {
+	WriteErrorHTTP(w, status, "", message, "")
 }
 
 func logtoken() string {
@@ -83,20 +204,24 @@ func logtoken() string {
 }
 
 func handleInternalServerErrorHTTP(w http.ResponseWriter, during string, errmsg string, stack []byte) {
-	token := logtoken()
+	token := w.Header().Get(RequestIDHeader)
+	if token == "" {
+		token = logtoken()
+	}
 	log.Printf("**********\ninternal error %s %s: %s **********\n", during, token, errmsg)
 	if stack != nil {
 		log.Printf("backtrace:\n%s", stack)
 	}
 
-	http.Error(w, fmt.Sprintf("internal error %s: refer to %s in server log", during, token),
-		http.StatusInternalServerError)
+	WriteErrorHTTP(w, http.StatusInternalServerError, ErrorCodeInternal,
+		fmt.Sprintf("internal error %s", during), fmt.Sprintf("refer to %s in server log", token))
 }
 
-// HandleErrorHTTP writes an appropriate error message to an HTTP response
-// writer. It automatically determines whether a PTOError was returned, and if
-// so, it extracts the status code therefrom. For internal server errors, it
-// writes the error along with a token to the server log.
+// HandleErrorHTTP writes an appropriate error response to an HTTP response
+// writer, as WriteErrorHTTP. It automatically determines whether a PTOError
+// was returned, and if so, it extracts the status and error codes therefrom.
+// For internal server errors, it writes the error along with a token to the
+// server log.
 func HandleErrorHTTP(w http.ResponseWriter, during string, err error) {
 	switch ev := err.(type) {
 	case *PTOError:
@@ -105,7 +230,7 @@ func HandleErrorHTTP(w http.ResponseWriter, during string, err error) {
 		if s == http.StatusInternalServerError {
 			handleInternalServerErrorHTTP(w, during, m, ev.Stack())
 		} else {
-			http.Error(w, m, s)
+			WriteErrorHTTP(w, s, ev.Code(), m, during)
 		}
 	default:
 		if err == nil {
@@ -0,0 +1,218 @@
+package pto3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Observations exported in tabular formats are formatted the same way
+// whatever the locale of the server or of the client: times are always in
+// UTC, and numbers never use digit grouping or exponents. Spreadsheets and
+// statistical tools differ in what they expect, though, so the decimal
+// separator, the time format, and the naming of columns can be chosen per
+// export with ExportOptions; the defaults suit tools expecting RFC 4180 CSV.
+
+// Decimal separators for exported numbers
+const (
+	// ExportDecimalPoint separates decimals with a point, e.g. 0.5; the
+	// default
+	ExportDecimalPoint = "point"
+	// ExportDecimalComma separates decimals with a comma, e.g. 0,5, and
+	// fields in CSV with a semicolon
+	ExportDecimalComma = "comma"
+)
+
+// Formats for exported times
+const (
+	// ExportTimeRFC3339 formats times as in observation set files, e.g.
+	// 2017-10-01T10:06:00Z; the default
+	ExportTimeRFC3339 = "rfc3339"
+	// ExportTimeDateTime formats times as date and time in UTC separated by
+	// a space, e.g. 2017-10-01 10:06:00, which spreadsheets recognize as
+	// times
+	ExportTimeDateTime = "datetime"
+	// ExportTimeUnix formats times as seconds since the Unix epoch
+	ExportTimeUnix = "unix"
+)
+
+// Namings of exported columns
+const (
+	// ExportHeaderFields names columns as in ObservationFields, e.g.
+	// time_start; the default
+	ExportHeaderFields = "fields"
+	// ExportHeaderTitles names columns with titles, e.g. Start Time
+	ExportHeaderTitles = "titles"
+	// ExportHeaderNone writes no header row
+	ExportHeaderNone = "none"
+)
+
+// exportDateTimeLayout is the layout of times formatted as ExportTimeDateTime.
+const exportDateTimeLayout = "2006-01-02 15:04:05"
+
+// ObservationFieldTitles names the fields of an observation for people, in
+// ObservationFields order, as in exports with ExportHeaderTitles.
+var ObservationFieldTitles = []string{"Set ID", "Start Time", "End Time", "Path", "Condition", "Value"}
+
+// defaultExportOptions are the export options selected by default.
+var defaultExportOptions = ExportOptions{
+	DecimalSeparator: ExportDecimalPoint,
+	TimeFormat:       ExportTimeRFC3339,
+	Header:           ExportHeaderFields,
+}
+
+// ExportOptions controls how observations are formatted in exports. The
+// zero value, like a nil *ExportOptions, selects the defaults.
+type ExportOptions struct {
+	// Decimal separator: ExportDecimalPoint or ExportDecimalComma
+	DecimalSeparator string
+	// Time format: ExportTimeRFC3339, ExportTimeDateTime, or ExportTimeUnix
+	TimeFormat string
+	// Column naming: ExportHeaderFields, ExportHeaderTitles, or
+	// ExportHeaderNone
+	Header string
+}
+
+// ParseExportOptions reads export options from the decimal, time_format,
+// and header parameters of a request. It returns an error with status 400
+// for an unknown value.
+func ParseExportOptions(form url.Values) (*ExportOptions, error) {
+	opts := ExportOptions{
+		DecimalSeparator: form.Get("decimal"),
+		TimeFormat:       form.Get("time_format"),
+		Header:           form.Get("header"),
+	}
+
+	check := func(param string, value string, allowed ...string) error {
+		if value == "" {
+			return nil
+		}
+		for _, a := range allowed {
+			if value == a {
+				return nil
+			}
+		}
+		return PTOErrorf("unknown %s %s; must be one of %s", param, value, strings.Join(allowed, ", ")).StatusIs(http.StatusBadRequest)
+	}
+
+	if err := check("decimal", opts.DecimalSeparator, ExportDecimalPoint, ExportDecimalComma); err != nil {
+		return nil, err
+	}
+	if err := check("time_format", opts.TimeFormat, ExportTimeRFC3339, ExportTimeDateTime, ExportTimeUnix); err != nil {
+		return nil, err
+	}
+	if err := check("header", opts.Header, ExportHeaderFields, ExportHeaderTitles, ExportHeaderNone); err != nil {
+		return nil, err
+	}
+
+	return opts.withDefaults(), nil
+}
+
+// withDefaults returns a copy of these options with the defaults filled in.
+func (opts *ExportOptions) withDefaults() *ExportOptions {
+	out := ExportOptions{}
+	if opts != nil {
+		out = *opts
+	}
+	if out.DecimalSeparator == "" {
+		out.DecimalSeparator = defaultExportOptions.DecimalSeparator
+	}
+	if out.TimeFormat == "" {
+		out.TimeFormat = defaultExportOptions.TimeFormat
+	}
+	if out.Header == "" {
+		out.Header = defaultExportOptions.Header
+	}
+	return &out
+}
+
+// IsDefault returns true if these options select the default formatting.
+func (opts *ExportOptions) IsDefault() bool {
+	return *opts.withDefaults() == defaultExportOptions
+}
+
+// URLEncoded returns the parameters selecting these options other than the
+// defaults, for use in links, or the empty string for the defaults.
+func (opts *ExportOptions) URLEncoded() string {
+	o := opts.withDefaults()
+	params := url.Values{}
+	if o.DecimalSeparator != defaultExportOptions.DecimalSeparator {
+		params.Set("decimal", o.DecimalSeparator)
+	}
+	if o.TimeFormat != defaultExportOptions.TimeFormat {
+		params.Set("time_format", o.TimeFormat)
+	}
+	if o.Header != defaultExportOptions.Header {
+		params.Set("header", o.Header)
+	}
+	return params.Encode()
+}
+
+// headerNames returns the names of all the columns of an export, in
+// ObservationFields order.
+func (opts *ExportOptions) headerNames() []string {
+	if opts.Header == ExportHeaderTitles {
+		return ObservationFieldTitles
+	}
+	return ObservationFields
+}
+
+// formatTime formats a time for export.
+func (opts *ExportOptions) formatTime(t *time.Time) string {
+	switch opts.TimeFormat {
+	case ExportTimeDateTime:
+		return t.UTC().Format(exportDateTimeLayout)
+	case ExportTimeUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	default:
+		return t.UTC().Format(time.RFC3339)
+	}
+}
+
+// formatValue formats an observation's value for export: numbers in plain
+// decimal notation with the selected separator, strings as they are, and
+// other values as compact JSON.
+func (opts *ExportOptions) formatValue(obs *Observation) string {
+	dec := json.NewDecoder(bytes.NewReader(obs.Value))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return obs.StringValue()
+	}
+
+	num, ok := v.(json.Number)
+	if !ok {
+		return obs.StringValue()
+	}
+
+	s := num.String()
+	if strings.ContainsAny(s, "eE") {
+		f, err := num.Float64()
+		if err != nil {
+			return s
+		}
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	if opts.DecimalSeparator == ExportDecimalComma {
+		s = strings.Replace(s, ".", ",", 1)
+	}
+	return s
+}
+
+// fieldValues returns all the fields of an observation formatted for export,
+// in ObservationFields order.
+func (opts *ExportOptions) fieldValues(obs *Observation) []string {
+	return []string{
+		fmt.Sprintf("%x", obs.SetID),
+		opts.formatTime(obs.TimeStart),
+		opts.formatTime(obs.TimeEnd),
+		obs.Path.String,
+		obs.Condition.Name,
+		opts.formatValue(obs),
+	}
+}
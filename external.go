@@ -0,0 +1,219 @@
+package pto3
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ExternalMetadataKey is the metadata key holding the link to an observation
+// set on another PTO, for sets registered here whose data lives there.
+// External sets have metadata and provenance on this PTO, so that local sets
+// can name them in _sources, but no observations: their data is linked to or
+// proxied from the other PTO, and cannot be uploaded here.
+const ExternalMetadataKey = "_external"
+
+// maxExternalMetadataSize is the largest external set metadata object
+// fetched, in bytes.
+const maxExternalMetadataSize = 1 << 20
+
+// External returns the link to this ObservationSet on another PTO, or the
+// empty string if its data is stored on this PTO.
+func (set *ObservationSet) External() string {
+	return set.Metadata[ExternalMetadataKey]
+}
+
+// ExternalDataLink returns the link to the data of this ObservationSet on
+// another PTO, or the empty string if its data is stored on this PTO.
+func (set *ObservationSet) ExternalDataLink() string {
+	if set.External() == "" {
+		return ""
+	}
+	return strings.TrimSuffix(set.External(), "/") + "/data"
+}
+
+// ValidateExternal returns an error if this ObservationSet's external link,
+// if any, is not an absolute URL with a scheme allowed by FetchSchemes, names
+// an address outbound requests may not be made to, or refers to an
+// observation set on this PTO.
+func (set *ObservationSet) ValidateExternal(config *PTOConfiguration) error {
+	link := set.External()
+	if link == "" {
+		return nil
+	}
+	return config.validateExternalLink(link)
+}
+
+func (config *PTOConfiguration) validateExternalLink(link string) error {
+	u, err := url.Parse(link)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return PTOErrorf("bad external set link %s", link).StatusIs(http.StatusBadRequest)
+	}
+	if err := config.checkOutboundURL(u); err != nil {
+		return err
+	}
+	if _, ok := config.ObservationSetIDForLink(link); ok {
+		return PTOErrorf("external set link %s refers to this PTO", link).StatusIs(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// getExternal GETs a resource on another PTO with the OutboundClient,
+// presenting the API key configured for its host, if any, unless the given
+// header already holds credentials. The resource and any redirects must be
+// at public addresses, or in OutboundNetworks, and have schemes allowed by
+// FetchSchemes. Responses other than 200 OK are returned as errors with
+// status 502 Bad Gateway, or 404 Not Found if the resource does not exist.
+func (config *PTOConfiguration) getExternal(link string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, PTOErrorf("bad external link %s: %s", link, err.Error()).StatusIs(http.StatusBadRequest)
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if key := config.FederationAPIKeys[u.Host]; key != "" && req.Header.Get("Authorization") == "" {
+		req.Header.Set("Authorization", "APIKEY "+key)
+	}
+
+	client := config.OutboundClient(5 * time.Minute)
+	checkRedirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if err := checkRedirect(req, via); err != nil {
+			return err
+		}
+		// keep the API key only on the host it is configured for
+		if req.URL.Host != u.Host {
+			req.Header.Del("Authorization")
+		}
+		return nil
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, outboundError(link, err)
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, PTOErrorf("%s not found", link).StatusIs(http.StatusNotFound)
+	default:
+		res.Body.Close()
+		return nil, PTOErrorf("error fetching %s: server returned %s", link, res.Status).StatusIs(http.StatusBadGateway)
+	}
+}
+
+// fetchRemoteSet fetches the metadata of an observation set on another PTO
+// given its link, dropping its slug, as it need not be unique here. Its
+// sources are kept as given, so they refer to the other PTO unless they
+// refer to this one.
+func (config *PTOConfiguration) fetchRemoteSet(link string, header http.Header) (*ObservationSet, error) {
+	if err := config.validateExternalLink(link); err != nil {
+		return nil, err
+	}
+
+	header.Set("Accept", "application/json")
+	res, err := config.getExternal(link, header)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(&fetchLimitReader{r: res.Body, remain: maxExternalMetadataSize, maxSize: maxExternalMetadataSize})
+	if err != nil {
+		return nil, err
+	}
+
+	var set ObservationSet
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, PTOErrorf("bad observation set metadata at %s: %s", link, err.Error()).StatusIs(http.StatusBadGateway)
+	}
+
+	delete(set.Metadata, SlugMetadataKey)
+	return &set, nil
+}
+
+// FetchExternalSet fetches the metadata of an observation set on another PTO
+// given its link, and returns an ObservationSet with that metadata, linked
+// to it as an external set, for insertion into the database.
+func (config *PTOConfiguration) FetchExternalSet(link string) (*ObservationSet, error) {
+	set, err := config.fetchRemoteSet(link, http.Header{})
+	if err != nil {
+		return nil, err
+	}
+
+	set.Metadata[ExternalMetadataKey] = link
+	return set, nil
+}
+
+// FetchImportedSet fetches the metadata of an observation set on another PTO
+// given its link, and returns an ObservationSet with that metadata and its
+// origin, for insertion into the database before its data is copied with
+// OpenImportedData. If apiKey is not empty, it is presented to the other PTO
+// instead of the key configured for it.
+func (config *PTOConfiguration) FetchImportedSet(link string, apiKey string) (*ObservationSet, error) {
+	set, err := config.fetchRemoteSet(link, importHeader(apiKey))
+	if err != nil {
+		return nil, err
+	}
+
+	// the imported set's data will live here
+	delete(set.Metadata, ExternalMetadataKey)
+	set.Metadata[OriginMetadataKey] = link
+	return set, nil
+}
+
+// OpenImportedData opens the data of an observation set on another PTO given
+// its link, in observation set file format, presenting apiKey as
+// FetchImportedSet does. It returns a nil response if the set has no
+// observations. The caller must close the response body.
+func (config *PTOConfiguration) OpenImportedData(link string, apiKey string) (*http.Response, error) {
+	header := importHeader(apiKey)
+	header.Set("Accept", "application/vnd.mami.ndjson")
+
+	res, err := config.getExternal(strings.TrimSuffix(link, "/")+"/data", header)
+	if ptoerr, ok := err.(*PTOError); ok && ptoerr.Status() == http.StatusNotFound {
+		// the metadata was found, so the set is empty
+		return nil, nil
+	}
+	return res, err
+}
+
+func importHeader(apiKey string) http.Header {
+	header := http.Header{}
+	if apiKey != "" {
+		header.Set("Authorization", "APIKEY "+apiKey)
+	}
+	return header
+}
+
+// OpenExternalData opens the data of an external ObservationSet on the PTO
+// it lives on, passing on the query parameters and the Accept header of a
+// request for it. The caller must close the response body.
+func (set *ObservationSet) OpenExternalData(config *PTOConfiguration, r *http.Request) (*http.Response, error) {
+	link := set.ExternalDataLink()
+	if link == "" {
+		return nil, PTOErrorf("observation set %x is not external", set.ID).StatusIs(http.StatusBadRequest)
+	}
+	if r.URL.RawQuery != "" {
+		link += "?" + r.URL.RawQuery
+	}
+
+	header := http.Header{}
+	if accept := r.Header.Get("Accept"); accept != "" {
+		header.Set("Accept", accept)
+	}
+
+	return config.getExternal(link, header)
+}
@@ -0,0 +1,81 @@
+package pto3
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// fetchLimitReader reads from an underlying reader, failing once more than a
+// maximum number of bytes have been read.
+type fetchLimitReader struct {
+	r       io.Reader
+	remain  int64
+	maxSize int64
+}
+
+func (lr *fetchLimitReader) Read(p []byte) (int, error) {
+	// read one byte past the limit, so we can tell if the limit was exceeded
+	if int64(len(p)) > lr.remain+1 {
+		p = p[0 : lr.remain+1]
+	}
+
+	n, err := lr.r.Read(p)
+	lr.remain -= int64(n)
+	if lr.remain < 0 {
+		return n, PTOErrorf("fetched data exceeds maximum size of %d bytes", lr.maxSize).StatusIs(http.StatusRequestEntityTooLarge)
+	}
+	return n, err
+}
+
+// fetchSchemeAllowed returns true if the configuration allows fetching data
+// from a URL.
+func (config *PTOConfiguration) fetchSchemeAllowed(u *url.URL) bool {
+	for _, scheme := range config.FetchSchemes {
+		if u.Scheme == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// FetchFileData downloads the data file associated with a filename on this
+// campaign from a URL, instead of requiring it to be uploaded. The URL's
+// scheme, and that of any redirect, must appear in the configured
+// FetchSchemes, and its host must have a public address, or one in the
+// configured OutboundNetworks; see OutboundClient. The data may not exceed
+// the configured FetchMaxSize, and must be fetched within FetchTimeout. The
+// download shares the configured BackgroundBandwidth with other background
+// transfers. As with WriteFileDataFromStream, the data is checked against the
+// campaign's manifest, if any. If force is true, replaces the data file if it
+// exists; otherwise, returns an error if the data file exists.
+func (cam *Campaign) FetchFileData(filename string, force bool, source string) error {
+	u, err := url.Parse(source)
+	if err != nil {
+		return PTOErrorf("bad URL %s: %s", source, err.Error()).StatusIs(http.StatusBadRequest)
+	}
+
+	if err := cam.config.checkOutboundURL(u); err != nil {
+		return err
+	}
+
+	client := cam.config.OutboundClient(time.Duration(cam.config.FetchTimeout) * time.Second)
+	res, err := client.Get(u.String())
+	if err != nil {
+		return outboundError(source, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return PTOErrorf("error fetching %s: server returned %s", source, res.Status).StatusIs(http.StatusBadGateway)
+	}
+
+	// fail early if the server tells us the data is too big
+	if res.ContentLength > cam.config.FetchMaxSize {
+		return PTOErrorf("data at %s exceeds maximum size of %d bytes", source, cam.config.FetchMaxSize).StatusIs(http.StatusRequestEntityTooLarge)
+	}
+
+	in := fetchLimitReader{r: cam.config.BackgroundLimiter().Reader(res.Body), remain: cam.config.FetchMaxSize, maxSize: cam.config.FetchMaxSize}
+	return cam.WriteFileDataFromStream(filename, force, &in)
+}
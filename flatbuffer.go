@@ -0,0 +1,177 @@
+package pto3
+
+import "encoding/binary"
+
+// flatBuilder builds a FlatBuffer, as used for the metadata of Arrow IPC
+// messages. Like the builders generated by flatc, it builds the buffer back
+// to front, so that objects are built before the objects referring to them;
+// offsets to objects are given as their distance from the end of the buffer.
+// Only what Arrow metadata needs is supported: tables of scalars, strings,
+// and offsets; vectors of offsets and of structs; no shared vtables.
+type flatBuilder struct {
+	// data is at buf[head:]
+	buf  []byte
+	head int
+
+	// largest alignment required so far
+	minAlign int
+
+	// offsets of the fields of the table being built, 0 if not present
+	vtable []int
+
+	// offset of the end of the table being built
+	tableEnd int
+}
+
+func newFlatBuilder() *flatBuilder {
+	return &flatBuilder{buf: make([]byte, 1024), head: 1024, minAlign: 1}
+}
+
+// offset returns the offset of the start of the data built so far.
+func (b *flatBuilder) offset() int {
+	return len(b.buf) - b.head
+}
+
+// reserve ensures there is room for n more bytes in front of the data.
+func (b *flatBuilder) reserve(n int) {
+	for b.head < n {
+		old := len(b.buf)
+		buf := make([]byte, 2*old)
+		copy(buf[old:], b.buf)
+		b.buf = buf
+		b.head += old
+	}
+}
+
+// prep pads the buffer so that a value of the given size will be aligned to
+// its size after additional bytes are written, and reserves room for both.
+func (b *flatBuilder) prep(size, additional int) {
+	if size > b.minAlign {
+		b.minAlign = size
+	}
+	pad := -(b.offset() + additional) & (size - 1)
+	b.reserve(pad + size + additional)
+	for i := 0; i < pad; i++ {
+		b.head--
+		b.buf[b.head] = 0
+	}
+}
+
+func (b *flatBuilder) placeUint8(v uint8) {
+	b.head--
+	b.buf[b.head] = v
+}
+
+func (b *flatBuilder) placeUint16(v uint16) {
+	b.head -= 2
+	binary.LittleEndian.PutUint16(b.buf[b.head:], v)
+}
+
+func (b *flatBuilder) placeUint32(v uint32) {
+	b.head -= 4
+	binary.LittleEndian.PutUint32(b.buf[b.head:], v)
+}
+
+func (b *flatBuilder) placeInt64(v int64) {
+	b.head -= 8
+	binary.LittleEndian.PutUint64(b.buf[b.head:], uint64(v))
+}
+
+// prependOffset writes a reference to an object built earlier.
+func (b *flatBuilder) prependOffset(off int) {
+	b.prep(4, 0)
+	b.placeUint32(uint32(b.offset() - off + 4))
+}
+
+// createString writes a string, and returns its offset.
+func (b *flatBuilder) createString(s string) int {
+	b.prep(4, len(s)+1)
+	b.placeUint8(0)
+	b.head -= len(s)
+	copy(b.buf[b.head:], s)
+	b.placeUint32(uint32(len(s)))
+	return b.offset()
+}
+
+// startVector prepares to write a vector of n elements of the given size,
+// which are then written last to first, and finished with endVector.
+func (b *flatBuilder) startVector(elemSize, n, alignment int) {
+	b.prep(4, elemSize*n)
+	b.prep(alignment, elemSize*n)
+}
+
+// endVector finishes a vector of n elements, and returns its offset.
+func (b *flatBuilder) endVector(n int) int {
+	b.placeUint32(uint32(n))
+	return b.offset()
+}
+
+// startTable prepares to write the fields of a table with the given number
+// of fields, which is then finished with endTable. Tables may not be nested:
+// anything a table refers to must be built before starting it.
+func (b *flatBuilder) startTable(numFields int) {
+	b.vtable = make([]int, numFields)
+	b.tableEnd = b.offset()
+}
+
+func (b *flatBuilder) addUint8(field int, v uint8) {
+	b.prep(1, 0)
+	b.placeUint8(v)
+	b.vtable[field] = b.offset()
+}
+
+func (b *flatBuilder) addInt16(field int, v int16) {
+	b.prep(2, 0)
+	b.placeUint16(uint16(v))
+	b.vtable[field] = b.offset()
+}
+
+func (b *flatBuilder) addInt64(field int, v int64) {
+	b.prep(8, 0)
+	b.placeInt64(v)
+	b.vtable[field] = b.offset()
+}
+
+func (b *flatBuilder) addOffset(field int, off int) {
+	b.prependOffset(off)
+	b.vtable[field] = b.offset()
+}
+
+// endTable writes the table being built and its vtable, and returns the
+// offset of the table.
+func (b *flatBuilder) endTable() int {
+	// placeholder for the offset to the vtable
+	b.prep(4, 0)
+	b.placeUint32(0)
+	table := b.offset()
+
+	// trailing absent fields may be left out of the vtable
+	n := len(b.vtable)
+	for n > 0 && b.vtable[n-1] == 0 {
+		n--
+	}
+	for i := n - 1; i >= 0; i-- {
+		var fieldOffset int
+		if b.vtable[i] != 0 {
+			fieldOffset = table - b.vtable[i]
+		}
+		b.prep(2, 0)
+		b.placeUint16(uint16(fieldOffset))
+	}
+	b.prep(2, 2)
+	b.placeUint16(uint16(table - b.tableEnd))
+	b.placeUint16(uint16((n + 2) * 2))
+
+	// the vtable precedes the table, at a positive offset back from it
+	binary.LittleEndian.PutUint32(b.buf[len(b.buf)-table:], uint32(b.offset()-table))
+	b.vtable = nil
+	return table
+}
+
+// finish writes a reference to the root table, and returns the finished
+// buffer, padded so that its contents are aligned.
+func (b *flatBuilder) finish(root int) []byte {
+	b.prep(b.minAlign, 4)
+	b.prependOffset(root)
+	return b.buf[b.head:]
+}
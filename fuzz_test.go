@@ -0,0 +1,100 @@
+//go:build go1.18
+// +build go1.18
+
+package pto3_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// These fuzz targets exercise the parsers for metadata and observations
+// uploaded by clients. Run them with e.g.
+//
+//	go test -run '^$' -fuzz FuzzObservationUnmarshalJSON
+//
+// Each target checks that its parser neither panics nor accepts input it
+// cannot serialize and parse again.
+
+// addSeedFiles adds the contents of test data files to a fuzz target's corpus.
+func addSeedFiles(f *testing.F, filenames ...string) {
+	for _, filename := range filenames {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+}
+
+func FuzzRawMetadataUnmarshalJSON(f *testing.F) {
+	addSeedFiles(f, "testdata/test_raw_metadata.json", "testdata/test_raw_campaign_metadata.json")
+	f.Add([]byte(`{"_owner": "ptotest@mami-project.eu", "_file_type": "test", "_time_start": "2017-12-05T14:00:00Z", "_time_end": 1512486000, "answer": 42}`))
+	f.Add([]byte(`{"_time_start": "0000-01-01T00:00:00+01:00", "_time_end": 253402300799.5}`))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var md pto3.RawMetadata
+		if err := md.UnmarshalJSON(b); err != nil {
+			return
+		}
+
+		out, err := md.DumpJSONObject(false)
+		if err != nil {
+			t.Fatalf("cannot serialize metadata parsed from %q: %v", b, err)
+		}
+
+		var md2 pto3.RawMetadata
+		if err := md2.UnmarshalJSON(out); err != nil {
+			t.Fatalf("cannot parse serialized metadata %q: %v", out, err)
+		}
+	})
+}
+
+func FuzzObservationSetUnmarshalJSON(f *testing.F) {
+	addSeedFiles(f, "testdata/test_obset_metadata.json")
+	f.Add([]byte(`{"_analyzer": "https://ptotest.mami-project.eu/analysis/fuzz", "_sources": [], "_conditions": ["pto.test.*"], "__link": 7}`))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var set pto3.ObservationSet
+		if err := set.UnmarshalJSON(b); err != nil {
+			return
+		}
+
+		out, err := json.Marshal(&set)
+		if err != nil {
+			t.Fatalf("cannot serialize set parsed from %q: %v", b, err)
+		}
+
+		var set2 pto3.ObservationSet
+		if err := set2.UnmarshalJSON(out); err != nil {
+			t.Fatalf("cannot parse serialized set %q: %v", out, err)
+		}
+	})
+}
+
+func FuzzObservationUnmarshalJSON(f *testing.F) {
+	f.Add([]byte(`["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`))
+	f.Add([]byte(`["", "2017-10-01T10:06:01Z", "2017-10-01T10:06:02Z", "10.0.0.1 AS1 * AS2 10.0.0.2", "pto.test.schroedinger", {"rtt": 12.5}]`))
+	f.Add([]byte(`["", "0000-01-01T00:00:00+01:00", "9999-12-31T23:00:00-05:00", "*", "pto.test.succeeded"]`))
+	f.Add([]byte(`["", "2017-10-01T10:06:07Z", "2017-10-01T10:06:11Z", "[2001:db8::33:a4] * [2001:db8:3]/64", "pto.test.succeeded", "42", {"index": 0, "offset": 1234}]`))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var obs pto3.Observation
+		if err := obs.UnmarshalJSON(b); err != nil {
+			return
+		}
+
+		out, err := obs.MarshalJSON()
+		if err != nil {
+			t.Fatalf("cannot serialize observation parsed from %q: %v", b, err)
+		}
+
+		var obs2 pto3.Observation
+		if err := obs2.UnmarshalJSON(out); err != nil {
+			t.Fatalf("cannot parse serialized observation %q: %v", out, err)
+		}
+	})
+}
@@ -0,0 +1,386 @@
+package pto3
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"sort"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// SupersedesMetadataKey is the metadata key holding the UUID of the
+// observation set a set supersedes, i.e. of which it is a newer version.
+const SupersedesMetadataKey = "_supersedes"
+
+// OriginMetadataKey is the metadata key holding the link to the observation
+// set on another PTO an observation set was imported from with its data.
+const OriginMetadataKey = "_origin"
+
+// ImportPolicy determines what happens when an observation set imported from
+// elsewhere, e.g. during a mirror run, has the UUID of a set which already
+// exists locally.
+type ImportPolicy string
+
+const (
+	// ImportRefuse refuses to import the set, as for any other duplicate UUID
+	ImportRefuse ImportPolicy = ""
+	// ImportSkip leaves the local set alone, whatever differs
+	ImportSkip ImportPolicy = "skip"
+	// ImportUpdate updates the metadata of the local set if only its metadata
+	// differs, and refuses to import the set if its data differs
+	ImportUpdate ImportPolicy = "update"
+	// ImportSupersede updates the metadata of the local set if only its
+	// metadata differs and it is not sealed, and otherwise keeps the imported
+	// set as a new version superseding the local set
+	ImportSupersede ImportPolicy = "supersede"
+)
+
+// ParseImportPolicy parses an import policy by name, returning an error with
+// status 400 for an unknown policy.
+func ParseImportPolicy(s string) (ImportPolicy, error) {
+	switch policy := ImportPolicy(s); policy {
+	case ImportRefuse, ImportSkip, ImportUpdate, ImportSupersede:
+		return policy, nil
+	default:
+		return ImportRefuse, PTOErrorf("unknown import policy %s", s).StatusIs(http.StatusBadRequest)
+	}
+}
+
+// ImportAction describes what was done with an imported observation set.
+type ImportAction string
+
+const (
+	// ImportCreated means the set was new, and was created
+	ImportCreated ImportAction = "created"
+	// ImportUnchanged means the local set had the same data and metadata
+	ImportUnchanged ImportAction = "unchanged"
+	// ImportSkipped means the local set differed, but was left alone
+	ImportSkipped ImportAction = "skipped"
+	// ImportUpdated means the metadata of the local set was updated
+	ImportUpdated ImportAction = "updated"
+	// ImportSuperseded means the imported set was kept as a new version
+	// superseding the local set
+	ImportSuperseded ImportAction = "superseded"
+)
+
+// ImportResult describes the outcome of importing an observation set.
+type ImportResult struct {
+	// What was done with the imported set
+	Action ImportAction
+	// The local set the import resulted in: the new set if created or
+	// superseded, otherwise the existing set
+	Set *ObservationSet
+}
+
+// StageImport prepares this ObservationSet, imported from elsewhere, for
+// loading under the given policy. If its UUID identifies a set which already
+// exists locally and the policy is not ImportRefuse, StageImport removes the
+// UUID from its metadata, so that it can be loaded as a new set to compare
+// with the existing one, and returns the removed UUID to pass to
+// ResolveImport once the set is loaded. Otherwise it returns an empty string,
+// and the set is imported as is.
+func (set *ObservationSet) StageImport(db orm.DB, policy ImportPolicy) (string, error) {
+	uuid := set.UUID()
+	if uuid == "" || policy == ImportRefuse {
+		return "", nil
+	}
+
+	if _, err := ObservationSetIDForUUID(db, uuid); err != nil {
+		if ptoerr, ok := err.(*PTOError); ok && ptoerr.Status() == http.StatusNotFound {
+			return "", nil
+		}
+		return "", err
+	}
+
+	delete(set.Metadata, UUIDMetadataKey)
+	return uuid, nil
+}
+
+// DataDigest computes a digest of the observations in this ObservationSet,
+// as a hex string. The digest covers the times, path, condition, value, and
+// source reference of each observation, but neither the set ID nor the order
+// of the observations, so that the same data loaded into different
+// observatories has the same digest.
+func (set *ObservationSet) DataDigest(db orm.DB) (string, error) {
+	var de dataDigestEncoder
+
+	count, err := set.CountObservations(db)
+	if err != nil {
+		return "", err
+	}
+
+	// the copy never finishes for an empty set, so don't start it
+	if count > 0 {
+		if _, err := copyObservationsToEncoder(db, &de, count, "WHERE set_id = ?", set.ID); err != nil {
+			return "", err
+		}
+	}
+
+	return de.digest(), nil
+}
+
+// dataDigestEncoder sums the digests of the observations encoded to it, so
+// that the result does not depend on their order.
+type dataDigestEncoder struct {
+	sum   [sha256.Size]byte
+	count uint64
+}
+
+func (de *dataDigestEncoder) Encode(obs *Observation) error {
+	o := *obs
+	o.SetID = 0
+
+	b, err := o.MarshalJSON()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	// values come back from the database normalized, so canonicalize them
+	cb, err := CanonicalizeJSON(b)
+	if err != nil {
+		return err
+	}
+
+	// add the digest to the sum as a big-endian integer
+	d := sha256.Sum256(cb)
+	carry := 0
+	for i := len(d) - 1; i >= 0; i-- {
+		s := int(de.sum[i]) + int(d[i]) + carry
+		de.sum[i] = byte(s)
+		carry = s >> 8
+	}
+
+	de.count++
+	return nil
+}
+
+func (de *dataDigestEncoder) Close() error {
+	return nil
+}
+
+func (de *dataDigestEncoder) digest() string {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, de.count)
+	h.Write(de.sum[:])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// MetadataDigest computes a digest of the metadata of this ObservationSet, as
+// a hex string. The digest covers its sources, analyzer, declared conditions,
+// and arbitrary metadata, except for its UUID and the UUID of the set it
+// supersedes, which identify rather than describe it.
+func (set *ObservationSet) MetadataDigest() (string, error) {
+	jmap := make(map[string]interface{})
+
+	for k, v := range set.Metadata {
+		if k != UUIDMetadataKey && k != SupersedesMetadataKey {
+			jmap[k] = v
+		}
+	}
+
+	sources := make([]string, len(set.Sources))
+	copy(sources, set.Sources)
+	sort.Strings(sources)
+	jmap["_sources"] = sources
+
+	jmap["_analyzer"] = set.Analyzer
+
+	conditionNames := make([]string, len(set.Conditions))
+	for i := range set.Conditions {
+		conditionNames[i] = set.Conditions[i].Name
+	}
+	sort.Strings(conditionNames)
+	jmap["_conditions"] = conditionNames
+
+	b, err := MarshalCanonicalJSON(jmap)
+	if err != nil {
+		return "", err
+	}
+
+	d := sha256.Sum256(b)
+	return hex.EncodeToString(d[:]), nil
+}
+
+// LatestVersion returns the newest version of this ObservationSet, following
+// the sets superseding it. It returns the set itself if it has not been
+// superseded. If a set was superseded more than once, the most recently
+// created successor is followed.
+func (set *ObservationSet) LatestVersion(db orm.DB) (*ObservationSet, error) {
+	latest := set
+	seen := map[int]bool{set.ID: true}
+
+	for {
+		setIds, err := ObservationSetIDsWithMetadataValue(db, SupersedesMetadataKey, latest.UUID())
+		if err != nil {
+			return nil, err
+		}
+		if len(setIds) == 0 || seen[setIds[len(setIds)-1]] {
+			return latest, nil
+		}
+
+		next := ObservationSet{ID: setIds[len(setIds)-1]}
+		if err := next.SelectByID(db); err != nil {
+			return nil, PTOWrapError(err)
+		}
+		seen[next.ID] = true
+		latest = &next
+	}
+}
+
+// SupersededSetIDs returns the IDs of the earlier versions of this
+// ObservationSet, following the UUIDs of the sets it supersedes, newest
+// first. Earlier versions which do not exist locally end the list.
+func (set *ObservationSet) SupersededSetIDs(db orm.DB) ([]int, error) {
+	out := make([]int, 0)
+	seen := map[int]bool{set.ID: true}
+
+	uuid := set.Metadata[SupersedesMetadataKey]
+	for uuid != "" {
+		setIds, err := ObservationSetIDsWithMetadataValue(db, UUIDMetadataKey, uuid)
+		if err != nil {
+			return nil, err
+		}
+		if len(setIds) == 0 || seen[setIds[0]] {
+			break
+		}
+
+		prev := ObservationSet{ID: setIds[0]}
+		if err := prev.SelectByID(db); err != nil {
+			return nil, PTOWrapError(err)
+		}
+		seen[prev.ID] = true
+		out = append(out, prev.ID)
+		uuid = prev.Metadata[SupersedesMetadataKey]
+	}
+
+	return out, nil
+}
+
+// ResolveImport decides what to do with an observation set imported under
+// the given policy, which StageImport found to have the UUID of an existing
+// local set. The imported set must have been loaded as a new set with its
+// data. ResolveImport compares the digests of its data and metadata with
+// those of the latest version of the existing set, and then removes the
+// imported set again, updates the metadata of the existing set from it, or
+// keeps it as a new version superseding the existing set, according to the
+// policy.
+func ResolveImport(db *pg.DB, imported *ObservationSet, uuid string, policy ImportPolicy) (*ImportResult, error) {
+	setid, err := ObservationSetIDForUUID(db, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	existing := ObservationSet{ID: setid}
+	if err := existing.SelectByID(db); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	// compare against the newest version, so repeated imports converge
+	current, err := existing.LatestVersion(db)
+	if err != nil {
+		return nil, err
+	}
+
+	currentData, err := current.DataDigest(db)
+	if err != nil {
+		return nil, err
+	}
+	importedData, err := imported.DataDigest(db)
+	if err != nil {
+		return nil, err
+	}
+
+	currentMetadata, err := current.MetadataDigest()
+	if err != nil {
+		return nil, err
+	}
+	importedMetadata, err := imported.MetadataDigest()
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := current.IsSealed(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var result ImportResult
+	dataSame := currentData == importedData
+
+	switch {
+	case dataSame && currentMetadata == importedMetadata:
+		result.Action = ImportUnchanged
+	case policy == ImportSkip:
+		result.Action = ImportSkipped
+	case dataSame && !sealed && (policy == ImportUpdate || policy == ImportSupersede):
+		result.Action = ImportUpdated
+	case policy == ImportSupersede:
+		result.Action = ImportSuperseded
+	case !dataSame:
+		return nil, discardImport(db, imported,
+			PTOErrorf("observation set %x with UUID %s has different data", current.ID, current.UUID()).StatusIs(http.StatusConflict))
+	default:
+		return nil, discardImport(db, imported,
+			PTOErrorf("observation set %x with UUID %s is sealed", current.ID, current.UUID()).StatusIs(http.StatusConflict))
+	}
+
+	switch result.Action {
+	case ImportSuperseded:
+		// keep the imported set as the newest version
+		imported.Metadata[SupersedesMetadataKey] = current.UUID()
+		if err := imported.Update(db); err != nil {
+			return nil, err
+		}
+		result.Set = imported
+	case ImportUpdated:
+		// take metadata from the imported set, keeping identifying keys
+		metadata := make(map[string]string)
+		for k, v := range imported.Metadata {
+			if k != SupersedesMetadataKey {
+				metadata[k] = v
+			}
+		}
+		metadata[UUIDMetadataKey] = current.UUID()
+		if supersedes, ok := current.Metadata[SupersedesMetadataKey]; ok {
+			metadata[SupersedesMetadataKey] = supersedes
+		}
+
+		current.Sources = imported.Sources
+		current.Analyzer = imported.Analyzer
+		current.Conditions = imported.Conditions
+		current.Metadata = metadata
+
+		if err := db.RunInTransaction(func(t *pg.Tx) error {
+			if err := current.Update(t); err != nil {
+				return err
+			}
+			_, err := imported.Delete(t, false)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		result.Set = current
+	default:
+		if err := discardImport(db, imported, nil); err != nil {
+			return nil, err
+		}
+		result.Set = current
+	}
+
+	return &result, nil
+}
+
+// discardImport removes an imported set which is not kept, returning the
+// error which caused it to be discarded, if any.
+func discardImport(db *pg.DB, imported *ObservationSet, cause error) error {
+	if err := db.RunInTransaction(func(t *pg.Tx) error {
+		_, err := imported.Delete(t, false)
+		return err
+	}); err != nil {
+		return err
+	}
+	return cause
+}
@@ -0,0 +1,161 @@
+package pto3
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-pg/pg"
+)
+
+// ConfiguredIndexPrefix prefixes the names of indexes on the observations
+// table created from ObservationIndexes in the configuration, so that they
+// can be told apart from the indexes the PTO always creates.
+const ConfiguredIndexPrefix = "observations_cfg_"
+
+// observationIndexColumns lists the columns of the observations table which
+// configured indexes may cover.
+var observationIndexColumns = map[string]bool{
+	"set_id":       true,
+	"condition_id": true,
+	"path_id":      true,
+	"time_start":   true,
+	"time_end":     true,
+}
+
+// ObservationIndex configures an additional index on the observations table,
+// so that deployments can tune indexes to their dominant mix of queries, e.g.
+// (condition_id, time_start) for counting conditions over time, or (path_id,
+// condition_id) for looking up conditions on paths.
+type ObservationIndex struct {
+	// Columns indexed, in order: set_id, condition_id, path_id, time_start,
+	// or time_end
+	Columns []string
+
+	// Index method, btree if empty, or brin for a small index on columns
+	// which grow with insertion order, such as times on large tables
+	Method string
+}
+
+// maxIndexNameLength is the length of the longest index name PostgreSQL
+// stores without truncating it.
+const maxIndexNameLength = 63
+
+// Validate returns an error if this index has no columns, an unknown or
+// repeated column, an unknown method, or so many columns that its name would
+// be truncated by the database.
+func (idx *ObservationIndex) Validate() error {
+	if len(idx.Columns) == 0 {
+		return PTOErrorf("observation index must have at least one column")
+	}
+
+	seen := make(map[string]bool)
+	for _, col := range idx.Columns {
+		if !observationIndexColumns[col] {
+			return PTOErrorf("cannot index unknown observation column %s", col)
+		}
+		if seen[col] {
+			return PTOErrorf("observation index repeats column %s", col)
+		}
+		seen[col] = true
+	}
+
+	switch idx.Method {
+	case "", "btree", "brin":
+	default:
+		return PTOErrorf("unsupported observation index method %s", idx.Method)
+	}
+
+	if name := idx.Name(); len(name) > maxIndexNameLength {
+		return PTOErrorf("observation index name %s too long; index fewer columns", name)
+	}
+	return nil
+}
+
+// Name returns the name of this index in the database, derived from its
+// columns and method, so that the same configuration always names the same
+// index.
+func (idx *ObservationIndex) Name() string {
+	name := ConfiguredIndexPrefix + strings.Join(idx.Columns, "_")
+	if idx.Method != "" && idx.Method != "btree" {
+		name += "_" + idx.Method
+	}
+	return name + "_idx"
+}
+
+func (idx *ObservationIndex) String() string {
+	method := idx.Method
+	if method == "" {
+		method = "btree"
+	}
+	return fmt.Sprintf("%s index on observations (%s)", method, strings.Join(idx.Columns, ", "))
+}
+
+// ListConfiguredIndexes returns the names of the indexes on the observations
+// table in the given database which were created from the configuration.
+func ListConfiguredIndexes(db *pg.DB) ([]string, error) {
+	names := make([]string, 0)
+	if _, err := db.Query(&names, `SELECT indexname FROM pg_indexes
+		WHERE schemaname = current_schema() AND tablename = 'observations' AND left(indexname, length(?0)) = ?0
+		ORDER BY indexname`, ConfiguredIndexPrefix); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return names, nil
+}
+
+// ApplyObservationIndexes makes the configured indexes on the observations
+// table of the given database match the given list: it creates those
+// missing, and drops those created from an earlier configuration which are
+// no longer in it. Indexes the PTO always creates are never dropped. It
+// returns the names of the indexes created and dropped. Creating an index on
+// a large table takes a long time, and blocks loading observations while it
+// runs.
+func ApplyObservationIndexes(db *pg.DB, indexes []ObservationIndex) ([]string, []string, error) {
+	configured := make(map[string]*ObservationIndex)
+	for i := range indexes {
+		if err := indexes[i].Validate(); err != nil {
+			return nil, nil, err
+		}
+		configured[indexes[i].Name()] = &indexes[i]
+	}
+
+	existing, err := ListConfiguredIndexes(db)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	present := make(map[string]bool)
+	created := make([]string, 0)
+	dropped := make([]string, 0)
+
+	for _, name := range existing {
+		present[name] = true
+		if configured[name] != nil {
+			continue
+		}
+		if _, err := db.Exec("DROP INDEX IF EXISTS " + name); err != nil {
+			return created, dropped, PTOWrapError(err)
+		}
+		dropped = append(dropped, name)
+	}
+
+	for i := range indexes {
+		idx := &indexes[i]
+		name := idx.Name()
+		if present[name] {
+			continue
+		}
+
+		method := idx.Method
+		if method == "" {
+			method = "btree"
+		}
+		if _, err := db.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON observations USING %s (%s)",
+			name, method, strings.Join(idx.Columns, ", "))); err != nil {
+			return created, dropped, PTOWrapError(err)
+		}
+		present[name] = true
+		created = append(created, name)
+	}
+
+	return created, dropped, nil
+}
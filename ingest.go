@@ -0,0 +1,387 @@
+package pto3
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// The ingest log keeps a copy of every observation upload accepted into the
+// observation database, so that the database can be recovered from it when
+// backups lag behind the raw data store. Each upload is an entry: an
+// observation set file in the ingest log directory, named by its sequence
+// number, whose metadata line is the set's metadata at the time of the upload
+// and whose observations are exactly those uploaded. Entries are replayed
+// into a database in sequence order by ReplayIngestLog.
+
+// ingestEntryExt is the extension of entry files in the ingest log directory.
+const ingestEntryExt = ".ndjson"
+
+// ingestTempPrefix is the prefix of files in the ingest log directory which
+// are not yet entries.
+const ingestTempPrefix = ".ingest-"
+
+// Keys added to the metadata of ingest log entries. Like all keys starting
+// with __, they are ignored when the entry is read as an observation set file.
+const (
+	ingestTimeKey           = "__ingest_time"
+	ingestSubmitterKey      = "__ingest_submitter"
+	ingestSkipDuplicatesKey = "__ingest_skip_duplicates"
+	ingestTimeOutliersKey   = "__ingest_time_outliers"
+)
+
+// IngestLog is a directory of observation uploads accepted into the
+// observation database, numbered in the order they were accepted, which can
+// be replayed into a fresh database. It must only be written by a single
+// process.
+type IngestLog struct {
+	// path to the ingest log directory
+	path string
+
+	// sequence number of the most recent entry
+	last int64
+
+	// lock on the above
+	lock sync.Mutex
+}
+
+// IngestEntry is an upload being copied into the ingest log, which becomes an
+// entry when committed.
+type IngestEntry struct {
+	il             *IngestLog
+	obsr           *ObservationReader
+	skipDuplicates bool
+
+	// file the observations are copied to as they are read
+	file *os.File
+	out  *bufio.Writer
+}
+
+// ingestEntryName returns the name of the entry file with the given sequence
+// number.
+func ingestEntryName(seq int64) string {
+	return fmt.Sprintf("%012d%s", seq, ingestEntryExt)
+}
+
+// IngestLogEntries returns the sequence numbers of the entries in the ingest
+// log directory at the given path, in order.
+func IngestLogEntries(path string) ([]int64, error) {
+	names, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	out := make([]int64, 0)
+	for _, fi := range names {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, ingestEntryExt) || strings.HasPrefix(name, ingestTempPrefix) {
+			continue
+		}
+		seq, err := strconv.ParseInt(strings.TrimSuffix(name, ingestEntryExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, seq)
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	return out, nil
+}
+
+// OpenIngestLog opens the ingest log directory at the given path, creating it
+// if necessary, and continuing its sequence numbers if it has entries. Files
+// left behind by uploads interrupted by a crash are removed.
+func OpenIngestLog(path string) (*IngestLog, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	temps, err := filepath.Glob(filepath.Join(path, ingestTempPrefix+"*"))
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	for _, temp := range temps {
+		if err := os.Remove(temp); err != nil {
+			return nil, PTOWrapError(err)
+		}
+	}
+
+	seqs, err := IngestLogEntries(path)
+	if err != nil {
+		return nil, err
+	}
+
+	il := IngestLog{path: path}
+	if len(seqs) > 0 {
+		il.last = seqs[len(seqs)-1]
+	}
+
+	return &il, nil
+}
+
+// Begin starts copying the observations read by an observation reader into a
+// new entry of this ingest log, to be committed once they have been loaded.
+// Beginning an entry in a nil ingest log returns a nil entry, whose methods do
+// nothing, so callers need not check whether an ingest log is configured.
+func (il *IngestLog) Begin(obsr *ObservationReader, skipDuplicates bool) (*IngestEntry, error) {
+	if il == nil {
+		return nil, nil
+	}
+
+	file, err := ioutil.TempFile(il.path, ingestTempPrefix)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	e := IngestEntry{
+		il:             il,
+		obsr:           obsr,
+		skipDuplicates: skipDuplicates,
+		file:           file,
+		out:            bufio.NewWriter(file),
+	}
+	obsr.RecordTo(e.out)
+
+	return &e, nil
+}
+
+// Commit makes the observations copied so far into an entry of the ingest
+// log, with the metadata of the set they were loaded into, and returns its
+// sequence number. The entry is synced to disk before it is given a sequence
+// number, so that an entry is never seen half written.
+func (e *IngestEntry) Commit(db orm.DB, set *ObservationSet) (int64, error) {
+	if e == nil {
+		return 0, nil
+	}
+	e.obsr.RecordTo(nil)
+	defer e.Abort()
+
+	if err := e.out.Flush(); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	// build the metadata line from the set, with how it was uploaded
+	b, err := set.MarshalJSON()
+	if err != nil {
+		return 0, err
+	}
+	var jmap map[string]interface{}
+	if err := json.Unmarshal(b, &jmap); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	submitter, err := set.Submitter(db)
+	if err != nil {
+		return 0, err
+	}
+
+	jmap[ingestTimeKey] = time.Now().UTC().Format(time.RFC3339)
+	jmap[ingestSkipDuplicatesKey] = e.skipDuplicates
+	if submitter != "" {
+		jmap[ingestSubmitterKey] = submitter
+	}
+	if outliers := e.obsr.TimeOutliers(); outliers > 0 {
+		jmap[ingestTimeOutliersKey] = outliers
+	}
+
+	if b, err = MarshalCanonicalJSON(jmap); err != nil {
+		return 0, err
+	}
+
+	// write the entry: metadata, then the observations copied
+	entry, err := ioutil.TempFile(e.il.path, ingestTempPrefix)
+	if err != nil {
+		return 0, PTOWrapError(err)
+	}
+	defer os.Remove(entry.Name())
+	defer entry.Close()
+
+	if _, err := entry.Write(append(b, '\n')); err != nil {
+		return 0, PTOWrapError(err)
+	}
+	if _, err := e.file.Seek(0, io.SeekStart); err != nil {
+		return 0, PTOWrapError(err)
+	}
+	if _, err := io.Copy(entry, e.file); err != nil {
+		return 0, PTOWrapError(err)
+	}
+	if err := entry.Sync(); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	// and number it
+	e.il.lock.Lock()
+	defer e.il.lock.Unlock()
+
+	seq := e.il.last + 1
+	if err := os.Rename(entry.Name(), filepath.Join(e.il.path, ingestEntryName(seq))); err != nil {
+		return 0, PTOWrapError(err)
+	}
+	e.il.last = seq
+
+	return seq, nil
+}
+
+// Abort discards the observations copied into an entry which will not be
+// committed, because they could not be loaded. It is safe to call after
+// Commit.
+func (e *IngestEntry) Abort() {
+	if e == nil || e.file == nil {
+		return
+	}
+	e.obsr.RecordTo(nil)
+	e.file.Close()
+	os.Remove(e.file.Name())
+	e.file = nil
+}
+
+// ReplayIngestLog loads the entries in the ingest log directory at the given
+// path into the observation database, in order, starting with the entry with
+// sequence number from. The set of each entry is created, with the UUID,
+// metadata, and submitter it had when the entry was logged, if no set has its
+// UUID. Observations are loaded like the upload they were logged from, except
+// that duplicates are skipped whenever the set already has observations, so
+// that entries already in a database restored from backup are not loaded
+// again. The progress function, if not nil, is called after each entry is
+// loaded.
+func ReplayIngestLog(db *pg.DB, config *PTOConfiguration, path string, from int64,
+	progress func(seq int64, set *ObservationSet, created bool, loaded int)) error {
+
+	seqs, err := IngestLogEntries(path)
+	if err != nil {
+		return err
+	}
+
+	cidCache, err := LoadConditionCache(db)
+	if err != nil {
+		return err
+	}
+	pidCache := make(PathCache)
+
+	for _, seq := range seqs {
+		if seq < from {
+			continue
+		}
+
+		set, created, loaded, err := replayIngestEntry(db, config, filepath.Join(path, ingestEntryName(seq)), cidCache, pidCache)
+		if err != nil {
+			return PTOErrorf("replaying ingest log entry %d: %s", seq, err.Error())
+		}
+
+		if progress != nil {
+			progress(seq, set, created, loaded)
+		}
+	}
+
+	return nil
+}
+
+// replayIngestEntry loads a single ingest log entry into the observation
+// database, returning its set, whether the set was created, and the number of
+// observations loaded.
+func replayIngestEntry(db *pg.DB, config *PTOConfiguration, filename string, cidCache ConditionCache, pidCache PathCache) (*ObservationSet, bool, int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, false, 0, PTOWrapError(err)
+	}
+	defer f.Close()
+
+	// the ingest keys are dropped when the metadata is read as a set, so
+	// read them separately
+	in := bufio.NewReader(f)
+	line, err := in.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, false, 0, PTOWrapError(err)
+	}
+	var header struct {
+		Submitter    string `json:"__ingest_submitter"`
+		TimeOutliers int    `json:"__ingest_time_outliers"`
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, false, 0, PTOErrorf("error in metadata of ingest log entry: %s", err.Error())
+	}
+
+	obsr := NewObservationReader(io.MultiReader(bytes.NewReader(line), in))
+	obsr.SetLoadOptions(&config.ObsDatabase)
+
+	set, err := obsr.ReadMetadata()
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	// find the set, or create it
+	created := false
+	if set.ID, err = ObservationSetIDForUUID(db, set.UUID()); err != nil {
+		if ptoerr, ok := err.(*PTOError); !ok || ptoerr.Status() != http.StatusNotFound {
+			return nil, false, 0, err
+		}
+
+		err = db.RunInTransaction(func(t *pg.Tx) error {
+			if err := set.Insert(t, true); err != nil {
+				return err
+			}
+			if err := set.LinkSources(t, config, nil); err != nil {
+				return err
+			}
+			return set.SetSubmitter(t, header.Submitter)
+		})
+		if err != nil {
+			return nil, false, 0, err
+		}
+		created = true
+	} else if err := set.SelectByID(db); err != nil {
+		return nil, false, 0, err
+	}
+
+	// load observations, skipping those already there
+	before := set.Count
+	if !created {
+		set.Count = 0
+		if before, err = set.CountObservations(db); err != nil {
+			return nil, false, 0, err
+		}
+	}
+
+	if before > 0 {
+		_, err = set.CopyDataFromReaderSkippingDuplicates(db, obsr, cidCache, pidCache)
+	} else {
+		err = set.CopyDataFromReader(db, obsr, cidCache, pidCache)
+	}
+	if err != nil {
+		return nil, false, 0, err
+	}
+
+	// update observation count and time interval, as after an upload
+	set.Count = 0
+	after, err := set.CountObservations(db)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	if _, _, err := set.TimeInterval(db); err != nil {
+		return nil, false, 0, err
+	}
+
+	// outliers were counted by the upload, so count them again only if the
+	// upload's observations were not already there
+	if header.TimeOutliers > 0 && after > before {
+		if err := set.AddTimeOutliers(db, header.TimeOutliers); err != nil {
+			return nil, false, 0, err
+		}
+	}
+
+	return set, created, after - before, nil
+}
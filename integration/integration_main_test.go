@@ -0,0 +1,355 @@
+//go:build integration
+// +build integration
+
+// Package integration_test exercises the PTO end to end: it starts
+// PostgreSQL in a Docker container, builds and starts ptosrv against it with
+// a temporary raw data store and query cache, and drives the server over
+// HTTP together with the command-line tools, as a deployment would. These
+// tests need Docker and a Go toolchain, take a while, and are therefore only
+// built with the integration tag:
+//
+//	go test -tags integration ./integration
+//
+// Set PTO_INTEGRATION_POSTGRES_IMAGE to test against another PostgreSQL
+// image, and PTO_INTEGRATION_KEEP to keep the temporary directory with the
+// server's configuration and log for inspection.
+package integration_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+const integrationAPIKey = "1a7e6ra7e"
+const integrationCampaign = "integration"
+const integrationDBPassword = "integration"
+
+// TestBaseURL is the base URL of the running ptosrv
+var TestBaseURL string
+
+// TestConfigPath is the path to the running ptosrv's configuration file,
+// for use with the command-line tools
+var TestConfigPath string
+
+// TestBinDir contains the PTO commands built for the test
+var TestBinDir string
+
+// dockerOutput runs a docker command and returns its trimmed standard output.
+func dockerOutput(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("docker", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %v: %s", strings.Join(args, " "), err, stderr.String())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// startPostgres starts a PostgreSQL container with a database for the PTO,
+// and returns its ID and the address it listens on.
+func startPostgres() (string, string, error) {
+	image := os.Getenv("PTO_INTEGRATION_POSTGRES_IMAGE")
+	if image == "" {
+		image = "postgres:11"
+	}
+
+	id, err := dockerOutput("run", "-d", "--rm",
+		"-e", "POSTGRES_USER=ptotest",
+		"-e", "POSTGRES_PASSWORD="+integrationDBPassword,
+		"-e", "POSTGRES_DB=ptotest",
+		"-p", "127.0.0.1::5432",
+		image)
+	if err != nil {
+		return "", "", err
+	}
+
+	addr, err := dockerOutput("port", id, "5432/tcp")
+	if err != nil {
+		stopContainer(id)
+		return "", "", err
+	}
+
+	// docker port may list several bindings; take the first
+	return id, strings.Split(addr, "\n")[0], nil
+}
+
+// stopContainer stops a container started with --rm, removing it.
+func stopContainer(id string) {
+	if _, err := dockerOutput("stop", id); err != nil {
+		log.Print(err)
+	}
+}
+
+// waitForPostgres waits until a database accepts queries.
+func waitForPostgres(opts *pg.Options, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		db := pg.Connect(opts)
+		_, err := db.Exec("SELECT 1")
+		db.Close()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("database at %s not ready after %v: %v", opts.Addr, timeout, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// buildCommands builds the PTO commands used by the tests into a directory.
+func buildCommands(bindir string) error {
+	for _, pkg := range []string{"papi/ptosrv", "cmd/ptonorm", "cmd/ptopass"} {
+		cmd := exec.Command("go", "build", "-o", filepath.Join(bindir, filepath.Base(pkg)), "../"+pkg)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("building %s: %v", pkg, err)
+		}
+	}
+	return nil
+}
+
+// freeAddr returns a local address with a port no one is listening on.
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// writeConfig writes a ptosrv configuration and API key file to a directory,
+// and returns the path to the configuration.
+func writeConfig(dir string, bindto string, dbaddr string) (string, error) {
+	for _, sub := range []string{"raw", "query"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			return "", err
+		}
+	}
+
+	keys := map[string]map[string]bool{
+		integrationAPIKey: {
+			"raw_metadata":                     true,
+			"read_raw:" + integrationCampaign:  true,
+			"write_raw:" + integrationCampaign: true,
+			"read_obs":                         true,
+			"read_obs_data":                    true,
+			"write_obs":                        true,
+			"submit_query_obs":                 true,
+			"submit_query_group":               true,
+			"read_query":                       true,
+			"update_query":                     true,
+		},
+	}
+
+	config := map[string]interface{}{
+		"BaseURL":        "http://" + bindto + "/",
+		"BindTo":         bindto,
+		"RawRoot":        filepath.Join(dir, "raw"),
+		"QueryCacheRoot": filepath.Join(dir, "query"),
+		"APIKeyFile":     filepath.Join(dir, "keys.json"),
+		"ContentTypes": map[string]string{
+			"obs": "application/vnd.mami.ndjson",
+		},
+		"ObsDatabase": map[string]string{
+			"Addr":     dbaddr,
+			"User":     "ptotest",
+			"Password": integrationDBPassword,
+			"Database": "ptotest",
+		},
+	}
+
+	for filename, content := range map[string]interface{}{"keys.json": keys, "ptoconfig.json": config} {
+		b, err := json.MarshalIndent(content, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, filename), b, 0644); err != nil {
+			return "", err
+		}
+	}
+
+	return filepath.Join(dir, "ptoconfig.json"), nil
+}
+
+// startServer initializes the database and starts ptosrv, logging to a file,
+// and waits until it answers requests.
+func startServer(logfile io.Writer) (*exec.Cmd, error) {
+	ptosrv := filepath.Join(TestBinDir, "ptosrv")
+
+	initdb := exec.Command(ptosrv, "-config", TestConfigPath, "-initdb")
+	initdb.Stdout = logfile
+	initdb.Stderr = logfile
+	if err := initdb.Run(); err != nil {
+		return nil, fmt.Errorf("initializing database: %v", err)
+	}
+
+	srv := exec.Command(ptosrv, "-config", TestConfigPath)
+	srv.Stdout = logfile
+	srv.Stderr = logfile
+	if err := srv.Start(); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		res, err := http.Get(TestBaseURL)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return srv, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			srv.Process.Kill()
+			srv.Wait()
+			return nil, fmt.Errorf("ptosrv not answering at %s", TestBaseURL)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func TestMain(m *testing.M) {
+	// inner anon function ensures that os.Exit doesn't keep deferred teardown from running
+	os.Exit(func() int {
+		dir, err := ioutil.TempDir("", "pto3-integration")
+		if err != nil {
+			log.Fatal(err)
+		}
+		if os.Getenv("PTO_INTEGRATION_KEEP") == "" {
+			defer os.RemoveAll(dir)
+		} else {
+			log.Printf("keeping integration test files in %s", dir)
+		}
+
+		TestBinDir = filepath.Join(dir, "bin")
+		if err := buildCommands(TestBinDir); err != nil {
+			log.Print(err)
+			return 1
+		}
+
+		containerID, dbaddr, err := startPostgres()
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer stopContainer(containerID)
+
+		bindto, err := freeAddr()
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		TestBaseURL = "http://" + bindto
+
+		TestConfigPath, err = writeConfig(dir, bindto, dbaddr)
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+
+		if err := waitForPostgres(&pg.Options{
+			Addr:     dbaddr,
+			User:     "ptotest",
+			Password: integrationDBPassword,
+			Database: "ptotest",
+		}, 60*time.Second); err != nil {
+			log.Print(err)
+			return 1
+		}
+
+		logfile, err := os.Create(filepath.Join(dir, "ptosrv.log"))
+		if err != nil {
+			log.Print(err)
+			return 1
+		}
+		defer logfile.Close()
+
+		srv, err := startServer(logfile)
+		if err != nil {
+			log.Printf("%v; see server log in %s", err, logfile.Name())
+			return 1
+		}
+		defer func() {
+			srv.Process.Kill()
+			srv.Wait()
+		}()
+
+		return m.Run()
+	}())
+}
+
+// executeRequest sends a request with the test API key to a URL relative to
+// the test server, or an absolute URL, and fails the test if the response
+// does not have the expected status.
+func executeRequest(t *testing.T, method string, url string, body io.Reader, contentType string, status int) []byte {
+	if strings.HasPrefix(url, "/") {
+		url = TestBaseURL + url
+	}
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "APIKEY "+integrationAPIKey)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != status {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", method, url, status, res.StatusCode, b)
+	}
+
+	return b
+}
+
+// executeWithJSON sends a JSON-encoded request as executeRequest does, and
+// decodes the JSON response into out, if not nil.
+func executeWithJSON(t *testing.T, method string, url string, in interface{}, out interface{}, status int) {
+	var body io.Reader
+	var contentType string
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body = bytes.NewReader(b)
+		contentType = "application/json"
+	}
+
+	b := executeRequest(t, method, url, body, contentType, status)
+
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			t.Fatalf("%s %s: %v in response %s", method, url, err, b)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+//go:build integration
+// +build integration
+
+package integration_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+type testCampaignMetadata struct {
+	FileType    string `json:"_file_type"`
+	Owner       string `json:"_owner"`
+	Description string `json:"description"`
+}
+
+type testFileMetadata struct {
+	TimeStart string `json:"_time_start"`
+	TimeEnd   string `json:"_time_end"`
+	DataURL   string `json:"__data"`
+	DataSize  int    `json:"__data_size"`
+}
+
+type testSetMetadata struct {
+	Link     string `json:"__link"`
+	Datalink string `json:"__data"`
+	Count    int    `json:"__obs_count"`
+}
+
+type testQueryMetadata struct {
+	Link   string `json:"__link"`
+	Result string `json:"__result"`
+	State  string `json:"__state"`
+	Error  string `json:"__error"`
+}
+
+type testResultSet struct {
+	Next string            `json:"next"`
+	Obs  []json.RawMessage `json:"obs"`
+}
+
+// observationKeys returns a sorted list of keys identifying the observations
+// in an observation file, ignoring set IDs and metadata.
+func observationKeys(t *testing.T, b []byte) []string {
+	out := make([]string, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] != '[' {
+			continue
+		}
+
+		var obs pto3.Observation
+		if err := obs.UnmarshalJSON(line); err != nil {
+			t.Fatalf("bad observation %s: %v", line, err)
+		}
+		out = append(out, fmt.Sprintf("%s|%s|%s|%s",
+			obs.TimeStart.Format(time.RFC3339), obs.TimeEnd.Format(time.RFC3339),
+			obs.Path.String, obs.Condition.Name))
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(out)
+	return out
+}
+
+// splitObservationFile separates the observations in an observation file
+// from its metadata, merging metadata lines.
+func splitObservationFile(t *testing.T, b []byte) ([]byte, map[string]interface{}) {
+	var obs bytes.Buffer
+	md := make(map[string]interface{})
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		switch {
+		case len(line) == 0:
+			continue
+		case line[0] == '{':
+			if err := json.Unmarshal(line, &md); err != nil {
+				t.Fatalf("bad metadata %s: %v", line, err)
+			}
+		default:
+			obs.Write(line)
+			obs.WriteByte('\n')
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return obs.Bytes(), md
+}
+
+// TestPipeline uploads raw data, normalizes it with ptopass, uploads the
+// resulting observation set, queries it, and downloads it again, checking
+// that the observations survive each step.
+func TestPipeline(t *testing.T) {
+	rawData, err := ioutil.ReadFile("../testdata/test_raw_data.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKeys := observationKeys(t, rawData)
+
+	// upload raw data
+	camlink := "/v1/raw/" + integrationCampaign
+	executeWithJSON(t, "PUT", camlink, testCampaignMetadata{
+		FileType:    "obs",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "integration test campaign",
+	}, nil, http.StatusCreated)
+
+	var fmd testFileMetadata
+	executeWithJSON(t, "PUT", camlink+"/pipeline.ndjson", testFileMetadata{
+		TimeStart: "2017-12-17T09:05:01Z",
+		TimeEnd:   "2017-12-17T11:04:57Z",
+	}, &fmd, http.StatusCreated)
+
+	executeRequest(t, "PUT", fmd.DataURL, bytes.NewReader(rawData), "application/vnd.mami.ndjson", http.StatusCreated)
+
+	executeWithJSON(t, "GET", camlink+"/pipeline.ndjson", nil, &fmd, http.StatusOK)
+	if fmd.DataSize != len(rawData) {
+		t.Fatalf("uploaded %d bytes of raw data, stored %d", len(rawData), fmd.DataSize)
+	}
+
+	// normalize it with the passthrough normalizer
+	normDir, err := ioutil.TempDir("", "pto3-integration-norm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(normDir)
+
+	normFile := filepath.Join(normDir, "pipeline.obs.ndjson")
+	norm := exec.Command(filepath.Join(TestBinDir, "ptonorm"), "-config", TestConfigPath, "-out", normFile,
+		filepath.Join(TestBinDir, "ptopass"), integrationCampaign, "pipeline.ndjson")
+	norm.Stderr = os.Stderr
+	if err := norm.Run(); err != nil {
+		t.Fatalf("normalizing: %v", err)
+	}
+
+	normData, err := ioutil.ReadFile(normFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	obsData, setmd := splitObservationFile(t, normData)
+
+	if sources, ok := setmd["_sources"].([]interface{}); !ok || len(sources) != 1 ||
+		sources[0] != TestBaseURL+camlink+"/pipeline.ndjson" {
+		t.Fatalf("normalized set has unexpected sources %v", setmd["_sources"])
+	}
+
+	// upload the normalized observation set
+	var set testSetMetadata
+	executeWithJSON(t, "POST", "/v1/obs/create", setmd, &set, http.StatusCreated)
+	executeRequest(t, "PUT", set.Datalink, bytes.NewReader(obsData), "application/vnd.mami.ndjson", http.StatusCreated)
+
+	executeWithJSON(t, "GET", set.Link, nil, &set, http.StatusOK)
+	if set.Count != len(rawKeys) {
+		t.Fatalf("expected %d observations in set, got %d", len(rawKeys), set.Count)
+	}
+
+	// query for the observations, waiting for the query to complete
+	var setid int
+	if _, err := fmt.Sscanf(set.Link, TestBaseURL+"/v1/obs/%x", &setid); err != nil {
+		t.Fatalf("bad set link %s: %v", set.Link, err)
+	}
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s", setid,
+		url.QueryEscape("2017-12-17T00:00:00Z"), url.QueryEscape("2017-12-18T00:00:00Z"))
+
+	var q testQueryMetadata
+	deadline := time.Now().Add(time.Minute)
+	for {
+		executeWithJSON(t, "GET", "/v1/query/submit?"+queryParams, nil, &q, http.StatusOK)
+		if q.State == "failed" {
+			t.Fatalf("query failed with error %s", q.Error)
+		} else if q.State == "complete" {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("query still %s after a minute", q.State)
+		}
+		time.Sleep(time.Second)
+	}
+
+	var queryObs bytes.Buffer
+	for resultLink := q.Result; resultLink != ""; {
+		var rs testResultSet
+		executeWithJSON(t, "GET", resultLink, nil, &rs, http.StatusOK)
+		for _, obs := range rs.Obs {
+			queryObs.Write(obs)
+			queryObs.WriteByte('\n')
+		}
+		resultLink = rs.Next
+	}
+
+	if queryKeys := observationKeys(t, queryObs.Bytes()); !equalKeys(queryKeys, rawKeys) {
+		t.Fatalf("query returned %d observations, expected the %d uploaded", len(queryKeys), len(rawKeys))
+	}
+
+	// download the set and compare with the raw data
+	downloaded := executeRequest(t, "GET", set.Datalink, nil, "", http.StatusOK)
+	if downloadedKeys := observationKeys(t, downloaded); !equalKeys(downloadedKeys, rawKeys) {
+		t.Fatalf("downloaded %d observations, expected the %d uploaded", len(downloadedKeys), len(rawKeys))
+	}
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,283 @@
+package pto3
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stores whose changes are recorded in the change journal
+const (
+	JournalStoreRaw   = "raw"
+	JournalStoreObs   = "obs"
+	JournalStoreQuery = "query"
+)
+
+// Types of changes recorded in the change journal
+const (
+	JournalCreate = "create"
+	JournalUpdate = "update"
+	JournalDelete = "delete"
+)
+
+// JournalRetention is the number of most recent journal entries kept in
+// memory; older entries are read from the journal file on demand.
+const JournalRetention = 10000
+
+// JournalEntry is a single change recorded in the change journal.
+type JournalEntry struct {
+	// Sequence number of the change, increasing by one per change
+	Seq int64 `json:"seq"`
+	// Time of the change
+	Time time.Time `json:"time"`
+	// Store changed: raw, obs, or query
+	Store string `json:"store"`
+	// Type of change: create, update, or delete
+	Type string `json:"type"`
+	// Link to the changed resource
+	Resource string `json:"resource"`
+}
+
+// ChangeJournal is an append-only log of changes to the raw data store,
+// observation store, and query cache, with monotonically increasing sequence
+// numbers, from which mirrors and caches can be updated incrementally. The
+// journal is stored as a newline-delimited JSON file, and must only be written
+// by a single process. Only changes made through the API are recorded: the
+// command-line tools, such as ptodb and ptoload, write to the stores directly
+// and bypass the journal, so mirrors must resynchronize after using them.
+type ChangeJournal struct {
+	// journal file, open for appending
+	file *os.File
+
+	// path to journal file, for reading older entries
+	path string
+
+	// length of the complete entries in the journal file
+	size int64
+
+	// sequence number of the most recent entry
+	last int64
+
+	// most recent entries, oldest first
+	recent []JournalEntry
+
+	// channel closed (and replaced) when an entry is appended
+	notify chan struct{}
+
+	// lock on everything above
+	lock sync.Mutex
+}
+
+// OpenChangeJournal opens the change journal at the given path, creating it
+// if necessary, and continuing its sequence numbers if it exists.
+func OpenChangeJournal(path string) (*ChangeJournal, error) {
+	j := ChangeJournal{
+		path:   path,
+		recent: make([]JournalEntry, 0),
+		notify: make(chan struct{}),
+	}
+
+	// load recent entries from an existing journal
+	size, err := scanJournal(path, -1, func(entry *JournalEntry) bool {
+		j.last = entry.Seq
+		j.recent = append(j.recent, *entry)
+		if len(j.recent) > JournalRetention {
+			j.recent = j.recent[1:]
+		}
+		return true
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, PTOWrapError(err)
+	}
+
+	if j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	// drop a partial entry left by a crash, so the next entry starts on a
+	// line of its own
+	if err := j.file.Truncate(size); err != nil {
+		j.file.Close()
+		return nil, PTOWrapError(err)
+	}
+	j.size = size
+
+	return &j, nil
+}
+
+// scanJournal calls a function for each complete entry in the first size
+// bytes of a journal file (the whole file if size is negative), in order,
+// until it returns false. A partial line at the end is ignored, as it is an
+// entry still being written, or one truncated by a crash. It returns the
+// length of the complete lines read.
+func scanJournal(path string, size int64, fn func(entry *JournalEntry) bool) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if size >= 0 {
+		r = io.LimitReader(f, size)
+	}
+
+	in := bufio.NewReader(r)
+	var offset int64
+	for {
+		line, err := in.ReadBytes('\n')
+		if err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, err
+		}
+		offset += int64(len(line))
+
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// skip entries corrupted by a crash
+			continue
+		}
+		if !fn(&entry) {
+			return offset, nil
+		}
+	}
+}
+
+// Record appends a change to the journal, and wakes up anyone waiting for
+// changes. Recording to a nil journal does nothing, so callers need not check
+// whether a journal is configured.
+func (j *ChangeJournal) Record(store string, changeType string, resource string) error {
+	if j == nil {
+		return nil
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	entry := JournalEntry{
+		Seq:      j.last + 1,
+		Time:     time.Now().UTC(),
+		Store:    store,
+		Type:     changeType,
+		Resource: resource,
+	}
+
+	b, err := json.Marshal(&entry)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	b = append(b, '\n')
+	if _, err := j.file.Write(b); err != nil {
+		// don't leave a partial entry for the next one to be appended to
+		j.file.Truncate(j.size)
+		return PTOWrapError(err)
+	}
+	j.size += int64(len(b))
+
+	j.last = entry.Seq
+	j.recent = append(j.recent, entry)
+	if len(j.recent) > JournalRetention {
+		j.recent = j.recent[len(j.recent)-JournalRetention:]
+	}
+
+	close(j.notify)
+	j.notify = make(chan struct{})
+
+	return nil
+}
+
+// since returns at most limit entries after the given sequence number, and
+// whether the sequence number is newer than the newest entry (i.e., the
+// journal has been replaced). If there are no entries, it also returns a
+// channel which will be closed on the next entry. Older entries are read
+// from the journal file as it was when called, without holding the lock, so
+// that reading them does not hold up recording changes.
+func (j *ChangeJournal) since(seq int64, limit int) ([]JournalEntry, bool, <-chan struct{}, error) {
+	j.lock.Lock()
+
+	if seq > j.last {
+		notify := j.notify
+		j.lock.Unlock()
+		return nil, true, notify, nil
+	}
+
+	out := make([]JournalEntry, 0)
+	notify := j.notify
+
+	if len(j.recent) == 0 || seq >= j.recent[0].Seq-1 {
+		// everything we need is in memory
+		for _, entry := range j.recent {
+			if len(out) >= limit {
+				break
+			}
+			if entry.Seq > seq {
+				out = append(out, entry)
+			}
+		}
+		j.lock.Unlock()
+		return out, false, notify, nil
+	}
+
+	// go to the file for older entries, up to the end of the last entry
+	// recorded so far
+	size := j.size
+	j.lock.Unlock()
+
+	_, err := scanJournal(j.path, size, func(entry *JournalEntry) bool {
+		if entry.Seq > seq {
+			out = append(out, *entry)
+		}
+		return len(out) < limit
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, false, nil, PTOWrapError(err)
+	}
+
+	return out, false, notify, nil
+}
+
+// Since returns at most limit entries in the journal after the given sequence
+// number, waiting up to the given timeout for an entry if there are none. It
+// also returns the sequence number to use for the next call, and true if the
+// given sequence number is newer than any in the journal (i.e., the journal
+// has been replaced), in which case the client should resynchronize and start
+// again from zero.
+func (j *ChangeJournal) Since(seq int64, limit int, timeout time.Duration) ([]JournalEntry, int64, bool, error) {
+	entries, reset, notify, err := j.since(seq, limit)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	if len(entries) == 0 && !reset {
+		select {
+		case <-notify:
+			if entries, reset, _, err = j.since(seq, limit); err != nil {
+				return nil, 0, false, err
+			}
+		case <-time.After(timeout):
+		}
+	}
+
+	if reset {
+		return make([]JournalEntry, 0), 0, true, nil
+	}
+
+	next := seq
+	if len(entries) > 0 {
+		next = entries[len(entries)-1].Seq
+	}
+
+	return entries, next, false, nil
+}
+
+// Close closes the journal file.
+func (j *ChangeJournal) Close() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.file.Close()
+}
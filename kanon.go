@@ -0,0 +1,124 @@
+package pto3
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Group query results may reveal properties of individual paths or vantage
+// points when a group is small. If the KAnonymity option is set, the size of
+// each group, the smaller of the number of distinct paths and of distinct
+// vantage points (path sources) its observations refer to, is stored with
+// the results of group queries, and groups smaller than KAnonymity are left
+// out of the results served to clients other than the query's submitter.
+
+func (qc *QueryCache) groupSizesPath(identifier string) string {
+	return filepath.Join(qc.config.QueryCacheRoot, fmt.Sprintf("%s.sizes.ndjson", identifier))
+}
+
+// recordsGroupSizes returns true if this query stores the sizes of its
+// groups with its results.
+func (q *Query) recordsGroupSizes() bool {
+	return len(q.groups) > 0 && q.qc.config.KAnonymity > 0
+}
+
+// groupSizeClause returns the column expression selecting the size of each
+// group, for queries which record group sizes.
+func (q *Query) groupSizeClause() string {
+	if !q.recordsGroupSizes() {
+		return ""
+	}
+	return ", least(count(distinct observation.path_id), count(distinct path.source)) as size"
+}
+
+// writeGroupSizesFile creates the file storing the size of each group in
+// this query's results, one per line in the order of the results, replacing
+// any sizes stored by an earlier execution. It returns nil if the query does
+// not record group sizes.
+func (q *Query) writeGroupSizesFile() (*os.File, error) {
+	filename := q.qc.groupSizesPath(q.Identifier)
+	if !q.recordsGroupSizes() {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return nil, PTOWrapError(err)
+		}
+		return nil, nil
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return f, nil
+}
+
+// suppressedGroups returns the indices of the result rows of this query to
+// leave out when serving its results to the given client: the groups
+// smaller than KAnonymity, unless the client submitted the query. It returns
+// an error with status 403 if the results must be guarded but were computed
+// without group sizes.
+func (q *Query) suppressedGroups(submitter string) (map[int]bool, error) {
+	k := q.qc.config.KAnonymity
+	if k <= 0 || len(q.groups) == 0 {
+		return nil, nil
+	}
+
+	// clients without an API key all share one identifier, so own nothing
+	if submitter == q.Submitter && submitter != "" && submitter != "default" {
+		return nil, nil
+	}
+
+	in, err := os.Open(q.qc.groupSizesPath(q.Identifier))
+	if os.IsNotExist(err) {
+		return nil, PTOErrorf("results of query %s predate k-anonymity and are only available to their submitter; purge and resubmit the query to share them",
+			q.Identifier).StatusIs(http.StatusForbidden)
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	defer in.Close()
+
+	out := make(map[int]bool)
+	row := 0
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		size, err := strconv.Atoi(scanner.Text())
+		if err != nil {
+			return nil, PTOErrorf("bad group size in results of query %s: %s", q.Identifier, scanner.Text())
+		}
+		if size < k {
+			out[row] = true
+		}
+		row++
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return out, nil
+}
+
+// ResultRowCountFor returns the number of rows in this query's results as
+// served to the given client, leaving out groups suppressed by KAnonymity.
+func (q *Query) ResultRowCountFor(submitter string) (int, error) {
+	suppressed, err := q.suppressedGroups(submitter)
+	if err != nil {
+		return 0, err
+	}
+	return q.ResultRowCount() - len(suppressed), nil
+}
+
+// PaginateResultObjectFor returns a page of results as
+// PaginateProjectedResultObject, as served to the given client: groups
+// smaller than KAnonymity are left out unless the client submitted the
+// query.
+func (q *Query) PaginateResultObjectFor(offset int, count int, fields []int, submitter string) (map[string]interface{}, bool, error) {
+	suppressed, err := q.suppressedGroups(submitter)
+	if err != nil {
+		return nil, false, err
+	}
+	return q.paginateResultObject(offset, count, fields, suppressed)
+}
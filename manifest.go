@@ -0,0 +1,176 @@
+package pto3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// CampaignManifestFilename is the name of the optional manifest file in each
+// campaign directory
+const CampaignManifestFilename = "__pto_campaign_manifest.json"
+
+// Manifest file states, as reported by Campaign.VerifyManifest
+const (
+	ManifestFileOK        = "ok"
+	ManifestFileMissing   = "missing"
+	ManifestFileCorrupted = "corrupted"
+)
+
+// CampaignManifest lists the files expected in a campaign along with their
+// SHA-256 digests, as hex strings. It allows bulk transfers performed with
+// external tools to be verified by the server as files arrive.
+type CampaignManifest struct {
+	Files map[string]string `json:"files"`
+}
+
+// ManifestReport gives the state of each file listed in a campaign's
+// manifest: ok, missing, or corrupted.
+type ManifestReport struct {
+	Files    map[string]string `json:"files"`
+	Missing  []string          `json:"missing"`
+	Corrupt  []string          `json:"corrupted"`
+	Complete bool              `json:"complete"`
+}
+
+// digestFile computes the SHA-256 digest of a file as a hex string.
+func digestFile(pathname string) (string, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// digestFileData returns the hex-encoded SHA-256 digest of the data file
+// associated with a filename on this campaign, as uploaded.
+func (cam *Campaign) digestFileData(filename string) (string, error) {
+	f, err := cam.ReadFileData(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// GetManifest returns this campaign's manifest, or nil if it has none.
+func (cam *Campaign) GetManifest() (*CampaignManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(cam.path, CampaignManifestFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, PTOWrapError(err)
+	}
+
+	var manifest CampaignManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return &manifest, nil
+}
+
+// PutManifest overwrites this campaign's manifest.
+func (cam *Campaign) PutManifest(manifest *CampaignManifest) error {
+	for filename, digest := range manifest.Files {
+		if err := checkFilename(filename); err != nil {
+			return err
+		}
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+			return PTOErrorf("bad SHA-256 digest %s for %s in manifest", digest, filename).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	cam.lock.Lock()
+	defer cam.lock.Unlock()
+
+	if err := ioutil.WriteFile(filepath.Join(cam.path, CampaignManifestFilename), b, 0644); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// VerifyManifest checks each file listed in this campaign's manifest against
+// its digest, returning a report of missing and corrupted files. It returns
+// a not found error if the campaign has no manifest.
+func (cam *Campaign) VerifyManifest() (*ManifestReport, error) {
+	manifest, err := cam.GetManifest()
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, PTONotFoundError("manifest for campaign", filepath.Base(cam.path))
+	}
+
+	report := ManifestReport{
+		Files:   make(map[string]string),
+		Missing: make([]string, 0),
+		Corrupt: make([]string, 0),
+	}
+
+	for filename, expected := range manifest.Files {
+		digest, err := cam.digestFileData(filename)
+		if os.IsNotExist(err) {
+			report.Files[filename] = ManifestFileMissing
+			report.Missing = append(report.Missing, filename)
+		} else if err != nil {
+			return nil, PTOWrapError(err)
+		} else if digest != expected {
+			report.Files[filename] = ManifestFileCorrupted
+			report.Corrupt = append(report.Corrupt, filename)
+		} else {
+			report.Files[filename] = ManifestFileOK
+		}
+	}
+
+	sort.Strings(report.Missing)
+	sort.Strings(report.Corrupt)
+	report.Complete = len(report.Missing) == 0 && len(report.Corrupt) == 0
+
+	return &report, nil
+}
+
+// verifyManifestDigest checks a digest for a newly written file against the
+// campaign's manifest, if any. Files not listed in the manifest always pass.
+func (cam *Campaign) verifyManifestDigest(filename string, digest string) error {
+	manifest, err := cam.GetManifest()
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		return nil
+	}
+
+	expected, ok := manifest.Files[filename]
+	if ok && expected != digest {
+		return PTOErrorf("digest %s for %s does not match manifest digest %s", digest, filename, expected).StatusIs(http.StatusBadRequest)
+	}
+
+	return nil
+}
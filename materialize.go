@@ -0,0 +1,174 @@
+package pto3
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/go-pg/pg"
+)
+
+// MaterializeResults stores the observations in the results of this query as
+// a new observation set, for second-order analysis. The new set's _analyzer is
+// the link to this query, its _sources are the sets the observations were
+// selected from, and it declares the conditions of those observations.
+// Metadata keys not starting with an underscore are copied to the set's
+// metadata. Source references are dropped, since the new set's sources are
+// observation sets rather than raw data. The set is linked to its sources for
+// provenance queries, recorded as created by the given submitter, and left
+// unsealed.
+func (q *Query) MaterializeResults(metadata map[string]string, submitter string) (*ObservationSet, error) {
+	if q.Completed == nil || q.ExecutionError != nil {
+		return nil, PTOErrorf("query %s has not completed successfully", q.Identifier).StatusIs(http.StatusConflict)
+	}
+
+	if !q.HasObservationResults() {
+		return nil, PTOErrorf("results of query %s are not observations", q.Identifier).StatusIs(http.StatusBadRequest)
+	}
+
+	// first pass: find the sets and conditions appearing in the results
+	setIDs, conditionNames, err := q.resultSetsAndConditions()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(setIDs) == 0 {
+		return nil, PTOErrorf("query %s has no results to materialize", q.Identifier).StatusIs(http.StatusBadRequest)
+	}
+
+	// ingest with a condition cache of our own, as the query cache's is
+	// shared with concurrent queries
+	cidCache, err := LoadConditionCache(q.qc.db)
+	if err != nil {
+		return nil, err
+	}
+
+	set := ObservationSet{
+		Sources:    make([]string, len(setIDs)),
+		Conditions: make([]Condition, len(conditionNames)),
+		Metadata:   make(map[string]string),
+	}
+
+	set.Analyzer, _ = q.qc.config.LinkTo("query/" + q.Identifier)
+	for i, setid := range setIDs {
+		set.Sources[i] = LinkForSetID(q.qc.config, setid)
+	}
+	for i, name := range conditionNames {
+		set.Conditions[i].Name = name
+	}
+	for k, v := range metadata {
+		if !strings.HasPrefix(k, "_") {
+			set.Metadata[k] = v
+		}
+	}
+	if set.Metadata["description"] == "" {
+		set.Metadata["description"] = fmt.Sprintf("Results of query %s", q.Identifier)
+	}
+
+	if err := q.qc.db.RunInTransaction(func(t *pg.Tx) error {
+		if err := set.Insert(t, true); err != nil {
+			return err
+		}
+		if err := set.LinkSources(t, q.qc.config, nil); err != nil {
+			return err
+		}
+		return set.SetSubmitter(t, submitter)
+	}); err != nil {
+		return nil, err
+	}
+
+	// second pass: copy the observations, without source references
+	resultFile, err := q.ReadResultFile()
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	defer resultFile.Close()
+
+	obspipe, resultpipe := io.Pipe()
+	go func() {
+		resultScanner := bufio.NewScanner(resultFile)
+		for resultScanner.Scan() {
+			var obs Observation
+			if err := obs.UnmarshalJSON(resultScanner.Bytes()); err != nil {
+				resultpipe.CloseWithError(PTOWrapError(err))
+				return
+			}
+			obs.SetSourceRef(nil)
+
+			b, err := json.Marshal(&obs)
+			if err != nil {
+				resultpipe.CloseWithError(PTOWrapError(err))
+				return
+			}
+			if _, err := resultpipe.Write(append(b, '\n')); err != nil {
+				return
+			}
+		}
+		resultpipe.CloseWithError(resultScanner.Err())
+	}()
+	defer obspipe.Close()
+
+	obsr := NewObservationReader(obspipe)
+	obsr.SetLoadOptions(&q.qc.config.ObsDatabase)
+	if err := set.CopyDataFromReader(q.qc.db, obsr, cidCache, make(PathCache)); err != nil {
+		// don't leave an empty set behind
+		q.qc.db.RunInTransaction(func(t *pg.Tx) error {
+			_, err := set.Delete(t, false)
+			return err
+		})
+		return nil, err
+	}
+
+	if _, err := set.CountObservations(q.qc.db); err != nil {
+		return nil, err
+	}
+	if _, _, err := set.TimeInterval(q.qc.db); err != nil {
+		return nil, err
+	}
+	set.LinkVia(q.qc.config)
+	return &set, nil
+}
+
+// resultSetsAndConditions returns the sorted IDs of the observation sets and
+// names of the conditions appearing in this query's observation results.
+func (q *Query) resultSetsAndConditions() ([]int, []string, error) {
+	resultFile, err := q.ReadResultFile()
+	if err != nil {
+		return nil, nil, PTOWrapError(err)
+	}
+	defer resultFile.Close()
+
+	setIDSet := make(map[int]struct{})
+	conditionSet := make(map[string]struct{})
+
+	resultScanner := bufio.NewScanner(resultFile)
+	for resultScanner.Scan() {
+		var obs Observation
+		if err := obs.UnmarshalJSON(resultScanner.Bytes()); err != nil {
+			return nil, nil, PTOWrapError(err)
+		}
+		setIDSet[obs.SetID] = struct{}{}
+		conditionSet[obs.Condition.Name] = struct{}{}
+	}
+	if err := resultScanner.Err(); err != nil {
+		return nil, nil, PTOWrapError(err)
+	}
+
+	setIDs := make([]int, 0, len(setIDSet))
+	for setid := range setIDSet {
+		setIDs = append(setIDs, setid)
+	}
+	sort.Ints(setIDs)
+
+	conditionNames := make([]string, 0, len(conditionSet))
+	for name := range conditionSet {
+		conditionNames = append(conditionNames, name)
+	}
+	sort.Strings(conditionNames)
+
+	return setIDs, conditionNames, nil
+}
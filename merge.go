@@ -0,0 +1,179 @@
+package pto3
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/go-pg/pg"
+)
+
+// MergeObservationSets creates a new observation set containing the
+// observations of the sets with the given IDs, e.g. to combine the per-vantage
+// point sets produced by an analyzer. If deduplicate is true, observations
+// identical in times, path, condition, and value to another in the merged set
+// are dropped.
+//
+// The new set's _sources and _conditions are the union of those of the merged
+// sets, and the source references of its observations are adjusted to match.
+// Its _analyzer is the analyzer of the merged sets, which must therefore all
+// have the same one, unless metadata contains an _analyzer to use instead.
+// Other metadata on which all merged sets agree is kept; metadata keys not
+// starting with an underscore then override it. The set is recorded as
+// created by the given submitter, and left unsealed.
+func MergeObservationSets(db *pg.DB, config *PTOConfiguration, setIDs []int, deduplicate bool, metadata map[string]string, submitter string) (*ObservationSet, error) {
+	// select the sets to merge, ignoring repetitions
+	sets := make([]ObservationSet, 0, len(setIDs))
+	seen := make(map[int]bool)
+	for _, setid := range setIDs {
+		if seen[setid] {
+			continue
+		}
+		seen[setid] = true
+
+		set := ObservationSet{ID: setid}
+		if err := set.SelectByID(db); err != nil {
+			if err == pg.ErrNoRows {
+				return nil, PTOErrorf("observation set %x not found", setid).StatusIs(http.StatusBadRequest)
+			}
+			return nil, PTOWrapError(err)
+		}
+		sets = append(sets, set)
+	}
+
+	if len(sets) < 2 {
+		return nil, PTOErrorf("at least two observation sets are needed to merge").StatusIs(http.StatusBadRequest)
+	}
+
+	merged := ObservationSet{
+		Sources:    make([]string, 0),
+		Conditions: make([]Condition, 0),
+		Metadata:   make(map[string]string),
+	}
+
+	// determine analyzer
+	if analyzer, ok := metadata["_analyzer"]; ok {
+		merged.Analyzer = analyzer
+	} else {
+		merged.Analyzer = sets[0].Analyzer
+		for _, set := range sets[1:] {
+			if set.Analyzer != merged.Analyzer {
+				return nil, PTOErrorf("observation sets %x and %x have different analyzers", sets[0].ID, set.ID).StatusIs(http.StatusBadRequest)
+			}
+		}
+	}
+
+	// union sources, mapping each set's source indices to the merged set's
+	sourceIndex := make(map[string]int)
+	sourceMaps := make([][]int, len(sets))
+	for i, set := range sets {
+		sourceMaps[i] = make([]int, len(set.Sources))
+		for j, source := range set.Sources {
+			k, ok := sourceIndex[source]
+			if !ok {
+				k = len(merged.Sources)
+				sourceIndex[source] = k
+				merged.Sources = append(merged.Sources, source)
+			}
+			sourceMaps[i][j] = k
+		}
+	}
+
+	// union conditions
+	hasCondition := make(map[int]bool)
+	for _, set := range sets {
+		for _, c := range set.Conditions {
+			if !hasCondition[c.ID] {
+				hasCondition[c.ID] = true
+				merged.Conditions = append(merged.Conditions, c)
+			}
+		}
+	}
+
+	// keep metadata all sets agree on, then apply given metadata
+	for k, v := range sets[0].Metadata {
+		if strings.HasPrefix(k, "_") {
+			continue
+		}
+		common := true
+		for _, set := range sets[1:] {
+			if sv, ok := set.Metadata[k]; !ok || sv != v {
+				common = false
+				break
+			}
+		}
+		if common {
+			merged.Metadata[k] = v
+		}
+	}
+
+	for k, v := range metadata {
+		if !strings.HasPrefix(k, "_") {
+			merged.Metadata[k] = v
+		}
+	}
+
+	if _, ok := metadata["description"]; !ok {
+		setNames := make([]string, len(sets))
+		for i, set := range sets {
+			setNames[i] = fmt.Sprintf("%x", set.ID)
+		}
+		merged.Metadata["description"] = fmt.Sprintf("Merge of observation sets %s", strings.Join(setNames, ", "))
+	}
+
+	if err := db.RunInTransaction(func(t *pg.Tx) error {
+		if err := merged.Insert(t, true); err != nil {
+			return err
+		}
+
+		for i, set := range sets {
+			if _, err := t.Exec(`
+				INSERT INTO observations (set_id, time_start, time_end, path_id, condition_id, value,
+					source_index, source_offset, source_record)
+				SELECT ?, time_start, time_end, path_id, condition_id, value,
+					(?::int[])[source_index + 1], source_offset, source_record
+				FROM observations WHERE set_id = ?`,
+				merged.ID, pg.Array(sourceMaps[i]), set.ID); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+
+		if deduplicate {
+			// keep the first of each group of identical observations
+			if _, err := t.Exec(`
+				DELETE FROM observations a USING observations b
+				WHERE a.set_id = ? AND b.set_id = a.set_id AND a.id > b.id
+				AND a.time_start = b.time_start AND a.time_end = b.time_end
+				AND a.path_id = b.path_id AND a.condition_id = b.condition_id
+				AND a.value IS NOT DISTINCT FROM b.value`, merged.ID); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+
+		if err := merged.refreshRollup(t); err != nil {
+			return err
+		}
+
+		if _, err := merged.CountObservations(t); err != nil {
+			return err
+		}
+
+		if _, _, err := merged.TimeInterval(t); err != nil {
+			return err
+		}
+
+		// the merged sets' sources were linked when they were stored; don't
+		// fail the merge if some have since disappeared
+		if err := merged.LinkSources(t, config, nil); err != nil {
+			log.Printf("cannot link merged observation set %x to its sources: %s", merged.ID, err.Error())
+		}
+
+		return merged.SetSubmitter(t, submitter)
+	}); err != nil {
+		return nil, err
+	}
+
+	merged.LinkVia(config)
+	return &merged, nil
+}
@@ -0,0 +1,366 @@
+package pto3
+
+import (
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// SchemaVersionTable is the name of the table recording the migrations
+// applied to an observation database.
+const SchemaVersionTable = "pto_schema_version"
+
+// A Migration upgrades an observation database from the previous schema
+// version to its own. Each migration runs in its own transaction, and is
+// recorded in the schema version table when complete.
+type Migration struct {
+	// Schema version after this migration has been applied
+	Version int
+
+	// Human-readable description of the migration
+	Description string
+
+	// Function to apply the migration
+	Up func(t *pg.Tx) error
+}
+
+// Migrations lists all schema migrations in order. To change the observation
+// model, append a migration here; never change or remove existing ones, as
+// they have already been applied to production databases. Since databases
+// created before migrations were introduced have no schema version, the
+// first migration must be safe to apply to any of them.
+var Migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create tables, functions, and operators",
+		Up:          createBaseTables,
+	},
+	{
+		Version:     2,
+		Description: "merge duplicate paths and create secondary indexes",
+		Up: func(t *pg.Tx) error {
+			if _, err := deduplicatePaths(t); err != nil {
+				return err
+			}
+			return execIndexStatements(t, baseIndexStatements)
+		},
+	},
+	{
+		Version:     3,
+		Description: "record the submitter of each observation set",
+		Up: func(t *pg.Tx) error {
+			if _, err := t.Exec("ALTER TABLE observation_sets ADD COLUMN IF NOT EXISTS submitter text"); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "record when each observation set was sealed",
+		Up: func(t *pg.Tx) error {
+			if _, err := t.Exec("ALTER TABLE observation_sets ADD COLUMN IF NOT EXISTS sealed timestamptz"); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "store observation values as JSON",
+		Up: func(t *pg.Tx) error {
+			// existing text values become JSON strings; to_jsonb leaves
+			// columns that are already jsonb unchanged
+			if _, err := t.Exec("ALTER TABLE observations ALTER COLUMN value TYPE jsonb USING to_jsonb(value)"); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     6,
+		Description: "store paths as arrays of normalized elements",
+		Up: func(t *pg.Tx) error {
+			return addPathElements(t)
+		},
+	},
+	{
+		Version:     7,
+		Description: "reference raw source data from observations",
+		Up: func(t *pg.Tx) error {
+			if _, err := t.Exec(`ALTER TABLE observations
+				ADD COLUMN IF NOT EXISTS source_index integer,
+				ADD COLUMN IF NOT EXISTS source_offset bigint,
+				ADD COLUMN IF NOT EXISTS source_record bigint`); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     8,
+		Description: "store path sources and targets as addresses",
+		Up: func(t *pg.Tx) error {
+			return addPathAddresses(t)
+		},
+	},
+	{
+		Version:     9,
+		Description: "attach notes to observation sets",
+		Up: func(t *pg.Tx) error {
+			if _, err := t.Exec("ALTER TABLE observation_sets ADD COLUMN IF NOT EXISTS notes text"); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     10,
+		Description: "create the condition registry",
+		Up: func(t *pg.Tx) error {
+			if err := t.CreateTable(&RegisteredCondition{}, &orm.CreateTableOptions{IfNotExists: true}); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     11,
+		Description: "link observation sets to their sources",
+		Up: func(t *pg.Tx) error {
+			if _, err := t.Exec(`CREATE TABLE IF NOT EXISTS observation_set_sources (
+				observation_set_id bigint NOT NULL REFERENCES observation_sets (id) ON DELETE CASCADE,
+				position integer NOT NULL,
+				link text NOT NULL,
+				campaign text,
+				file text,
+				source_set_id bigint REFERENCES observation_sets (id) ON DELETE SET NULL,
+				PRIMARY KEY (observation_set_id, position))`); err != nil {
+				return PTOWrapError(err)
+			}
+			if _, err := t.Exec("CREATE INDEX IF NOT EXISTS observation_set_sources_raw ON observation_set_sources (campaign, file)"); err != nil {
+				return PTOWrapError(err)
+			}
+			if _, err := t.Exec("CREATE INDEX IF NOT EXISTS observation_set_sources_set ON observation_set_sources (source_set_id)"); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     12,
+		Description: "cache observation set statistics",
+		Up: func(t *pg.Tx) error {
+			if _, err := t.Exec("ALTER TABLE observation_sets ADD COLUMN IF NOT EXISTS stats jsonb"); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     13,
+		Description: "maintain observation set time intervals",
+		Up: func(t *pg.Tx) error {
+			// time intervals were cached lazily, and metadata updates cleared
+			// them; fill in those not yet cached
+			if _, err := t.Exec(`UPDATE observation_sets
+				SET time_start = bounds.time_start, time_end = bounds.time_end
+				FROM (SELECT set_id, min(time_start) AS time_start, max(time_end) AS time_end
+					FROM observations GROUP BY set_id) AS bounds
+				WHERE bounds.set_id = observation_sets.id
+				AND (observation_sets.time_start IS NULL OR observation_sets.time_end IS NULL)`); err != nil {
+				return PTOWrapError(err)
+			}
+			return execIndexStatements(t, setTimeIndexStatements)
+		},
+	},
+	{
+		Version:     14,
+		Description: "identify observation sets by UUID",
+		Up: func(t *pg.Tx) error {
+			var setIds []int
+			if _, err := t.QueryOne(pg.Scan(pg.Array(&setIds)),
+				"SELECT array_agg(id) FROM observation_sets WHERE metadata->>? IS NULL", UUIDMetadataKey); err != nil {
+				return PTOWrapError(err)
+			}
+
+			for _, setid := range setIds {
+				uuid, err := NewSetUUID()
+				if err != nil {
+					return err
+				}
+				if _, err := t.Exec("UPDATE observation_sets SET metadata = coalesce(metadata, '{}'::jsonb) || jsonb_build_object(?::text, ?::text) WHERE id = ?",
+					UUIDMetadataKey, uuid, setid); err != nil {
+					return PTOWrapError(err)
+				}
+			}
+
+			return execIndexStatements(t, setUUIDIndexStatements)
+		},
+	},
+	{
+		Version:     15,
+		Description: "record partitioning of observations",
+		Up: func(t *pg.Tx) error {
+			return createPartitioningTable(t)
+		},
+	},
+	{
+		Version:     16,
+		Description: "record when each observation set was deleted",
+		Up: func(t *pg.Tx) error {
+			if _, err := t.Exec("ALTER TABLE observation_sets ADD COLUMN IF NOT EXISTS deleted timestamptz"); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     17,
+		Description: "count observations outside the time range of their sources",
+		Up: func(t *pg.Tx) error {
+			if _, err := t.Exec("ALTER TABLE observation_sets ADD COLUMN IF NOT EXISTS time_outliers integer"); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		},
+	},
+	{
+		Version:     18,
+		Description: "alias condition names",
+		Up:          createConditionAliasTable,
+	},
+	{
+		Version:     19,
+		Description: "index observations by path and time for path timelines",
+		Up: func(t *pg.Tx) error {
+			return execIndexStatements(t, pathTimeIndexStatements)
+		},
+	},
+	{
+		Version:     20,
+		Description: "record privacy budgets spent by differentially private queries",
+		Up:          createPrivacyBudgetTable,
+	},
+	{
+		Version:     21,
+		Description: "record the history of condition renames",
+		Up:          createConditionRenameTable,
+	},
+	{
+		Version:     22,
+		Description: "count observations per set, condition, and day in rollups",
+		Up:          createObservationRollupTable,
+	},
+	{
+		Version:     23,
+		Description: "bound the observation times counted in rollups",
+		Up:          addObservationRollupTimeBounds,
+	},
+	{
+		Version:     24,
+		Description: "record observation sets archived to the raw data store",
+		Up:          createObservationSetArchiveTable,
+	},
+	{
+		Version:     25,
+		Description: "record the resources used by each client's queries",
+		Up:          createQueryUsageTable,
+	},
+	{
+		Version:     26,
+		Description: "make observation set slugs unique",
+		Up: func(t *pg.Tx) error {
+			if err := checkUniqueSlugs(t); err != nil {
+				return err
+			}
+			return execIndexStatements(t, setSlugIndexStatements)
+		},
+	},
+}
+
+// LatestSchemaVersion returns the schema version after all migrations have
+// been applied.
+func LatestSchemaVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+func createSchemaVersionTable(db orm.DB) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + SchemaVersionTable + ` (
+		version integer PRIMARY KEY,
+		description text NOT NULL,
+		applied timestamptz NOT NULL DEFAULT now())`); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+func schemaVersion(db orm.DB) (int, error) {
+	var version int
+	if _, err := db.QueryOne(pg.Scan(&version), "SELECT coalesce(max(version), 0) FROM "+SchemaVersionTable); err != nil {
+		return 0, PTOWrapError(err)
+	}
+	return version, nil
+}
+
+// SchemaVersion returns the schema version of the given database; i.e., the
+// version of the last migration applied to it. Databases created before
+// migrations were introduced have schema version 0.
+func SchemaVersion(db *pg.DB) (int, error) {
+	if err := createSchemaVersionTable(db); err != nil {
+		return 0, err
+	}
+	return schemaVersion(db)
+}
+
+// Migrate applies all migrations not yet applied to the given database, in
+// order, returning those applied. It is safe to run concurrently against the
+// same database, as each migration locks the schema version table; it stops
+// at the first migration which fails.
+func Migrate(db *pg.DB) ([]Migration, error) {
+	if err := createSchemaVersionTable(db); err != nil {
+		return nil, err
+	}
+
+	applied := make([]Migration, 0)
+
+	for _, m := range Migrations {
+		didApply := false
+
+		err := db.RunInTransaction(func(t *pg.Tx) error {
+			if _, err := t.Exec("LOCK TABLE " + SchemaVersionTable + " IN EXCLUSIVE MODE"); err != nil {
+				return PTOWrapError(err)
+			}
+
+			version, err := schemaVersion(t)
+			if err != nil {
+				return err
+			}
+
+			// skip migrations already applied
+			if version >= m.Version {
+				return nil
+			}
+
+			if err := m.Up(t); err != nil {
+				return PTOErrorf("migrating to schema version %d (%s): %s", m.Version, m.Description, err.Error())
+			}
+
+			if _, err := t.Exec("INSERT INTO "+SchemaVersionTable+" (version, description) VALUES (?, ?)", m.Version, m.Description); err != nil {
+				return PTOWrapError(err)
+			}
+
+			didApply = true
+			return nil
+		})
+
+		if err != nil {
+			return applied, err
+		}
+
+		if didApply {
+			applied = append(applied, m)
+		}
+	}
+
+	return applied, nil
+}
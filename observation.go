@@ -2,16 +2,20 @@ package pto3
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
@@ -42,9 +46,15 @@ type ObservationSet struct {
 	TimeStart *time.Time
 	// Cached observation end time
 	TimeEnd *time.Time
+	// Time at which the set was sealed, after which its data and metadata
+	// can no longer be changed; nil while the set is still being written
+	Sealed *time.Time
 	// system metadata
-	datalink string
-	link     string
+	datalink     string
+	link         string
+	noteslink    string
+	hasNotes     bool
+	timeOutliers int
 }
 
 // ObservationSetCondition implements a linking table between observation sets
@@ -60,7 +70,13 @@ type ObservationSetCondition struct {
 func (set *ObservationSet) MarshalJSON() ([]byte, error) {
 	jmap := make(map[string]interface{})
 
-	jmap["_sources"] = set.Sources
+	// _sources and _conditions are required on upload, so always include
+	// them, even if empty, to allow the result to be uploaded again
+	if set.Sources != nil {
+		jmap["_sources"] = set.Sources
+	} else {
+		jmap["_sources"] = []string{}
+	}
 	jmap["_analyzer"] = set.Analyzer
 
 	if set.link != "" {
@@ -71,6 +87,10 @@ func (set *ObservationSet) MarshalJSON() ([]byte, error) {
 		jmap["__data"] = set.datalink
 	}
 
+	if set.noteslink != "" {
+		jmap["__notes"] = set.noteslink
+	}
+
 	if set.Count != 0 {
 		jmap["__obs_count"] = set.Count
 	}
@@ -91,19 +111,25 @@ func (set *ObservationSet) MarshalJSON() ([]byte, error) {
 		jmap["__modified"] = set.Modified.Format(time.RFC3339)
 	}
 
+	if set.Sealed != nil {
+		jmap["__sealed"] = set.Sealed.Format(time.RFC3339)
+	}
+
+	if set.timeOutliers != 0 {
+		jmap["__time_outliers"] = set.timeOutliers
+	}
+
 	conditionNames := make([]string, len(set.Conditions))
 	for i := range set.Conditions {
 		conditionNames[i] = set.Conditions[i].Name
 	}
-	if len(conditionNames) > 0 {
-		jmap["_conditions"] = conditionNames
-	}
+	jmap["_conditions"] = conditionNames
 
 	for k, v := range set.Metadata {
 		jmap[k] = v
 	}
 
-	return json.Marshal(jmap)
+	return MarshalCanonicalJSON(jmap)
 }
 
 // UnmarshalJSON fills in an ObservationSet from a JSON observation set
@@ -186,6 +212,11 @@ func (set *ObservationSet) Insert(db orm.DB, force bool) error {
 	}
 
 	if set.ID == 0 {
+		// keep the UUID of a set imported from elsewhere, or make a new one
+		if err := set.ensureUUID(db); err != nil {
+			return err
+		}
+
 		// set creation and modification timestamps
 		ctime := time.Now().UTC()
 		set.Created = &ctime
@@ -200,7 +231,13 @@ func (set *ObservationSet) Insert(db orm.DB, force bool) error {
 		// main insertion
 		if err := db.Insert(set); err != nil {
 			log.Printf("error inserting set: %v", err)
-			return PTOWrapError(err)
+			return set.wrapSlugError(err)
+		}
+
+		// make room for its observations
+		if err := ensureObservationPartition(db, set.ID); err != nil {
+			log.Printf("error creating observation partition for set: %v", err)
+			return err
 		}
 
 		// TODO file a bug against go-pg or its docs: this should be automatic.
@@ -224,6 +261,11 @@ func (set *ObservationSet) SelectByID(db orm.DB) error {
 		return err
 	}
 
+	if _, err := db.QueryOne(pg.Scan(&set.hasNotes, &set.timeOutliers),
+		"SELECT notes IS NOT NULL, coalesce(time_outliers, 0) FROM observation_sets WHERE id = ?", set.ID); err != nil {
+		return err
+	}
+
 	var conditionIDs []int
 	err := db.Model(&ObservationSetCondition{}).
 		ColumnExpr("array_agg(condition_id)").
@@ -248,9 +290,60 @@ func (set *ObservationSet) SelectByID(db orm.DB) error {
 	return nil
 }
 
+// ObservedConditionNames returns the sorted names of the conditions of all the
+// observations in this set in the database.
+func (set *ObservationSet) ObservedConditionNames(db orm.DB) ([]string, error) {
+	var names []string
+	if _, err := db.QueryOne(pg.Scan(pg.Array(&names)),
+		`SELECT array_agg(DISTINCT conditions.name ORDER BY conditions.name)
+		 FROM observations JOIN conditions ON conditions.id = observations.condition_id
+		 WHERE observations.set_id = ?`, set.ID); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	if names == nil {
+		names = make([]string, 0)
+	}
+	return names, nil
+}
+
 // Update updates this ObservationSet in the database by overwriting the DB's
-// values with its own, by ID.
+// values with its own, by ID. Every condition in the set's observations must
+// remain declared, and sealed sets cannot be updated.
 func (set *ObservationSet) Update(db orm.DB) error {
+	if err := set.checkUnsealed(db); err != nil {
+		return err
+	}
+
+	// check declared conditions against the data
+	observed, err := set.ObservedConditionNames(db)
+	if err != nil {
+		return err
+	}
+
+	conditionDeclared := make(map[string]struct{})
+	for _, c := range set.Conditions {
+		conditionDeclared[c.Name] = struct{}{}
+	}
+	for _, name := range observed {
+		if _, ok := conditionDeclared[name]; !ok {
+			return PTOErrorf("observation set %x contains observations with condition %s, which must remain declared", set.ID, name).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	// the UUID never changes, and is kept if not given
+	var uuid string
+	if _, err := db.QueryOne(pg.Scan(&uuid), "SELECT coalesce(metadata->>?, '') FROM observation_sets WHERE id = ?", UUIDMetadataKey, set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	if set.Metadata == nil {
+		set.Metadata = make(map[string]string)
+	}
+	if set.UUID() == "" && uuid != "" {
+		set.Metadata[UUIDMetadataKey] = uuid
+	} else if set.UUID() != uuid {
+		return PTOErrorf("observation set %x has UUID %s, which cannot be changed", set.ID, uuid).StatusIs(http.StatusBadRequest)
+	}
+
 	// set modified timestamp
 	mtime := time.Now().UTC()
 	set.Modified = &mtime
@@ -260,13 +353,14 @@ func (set *ObservationSet) Update(db orm.DB) error {
 		return err
 	}
 
-	// main update
-	if err := db.Update(set); err != nil {
-		return PTOWrapError(err)
+	// main update; the creation time and the cached count and time interval
+	// are maintained by the database, not by metadata updates
+	if _, err := db.Model(set).Column("sources", "analyzer", "metadata", "modified").WherePK().Update(); err != nil {
+		return set.wrapSlugError(err)
 	}
 
 	// now delete and restore conditions
-	_, err := db.Exec("DELETE FROM observation_set_conditions WHERE observation_set_id = ?", set.ID)
+	_, err = db.Exec("DELETE FROM observation_set_conditions WHERE observation_set_id = ?", set.ID)
 	if err != nil {
 		return PTOWrapError(err)
 	}
@@ -281,568 +375,2058 @@ func (set *ObservationSet) Update(db orm.DB) error {
 	return nil
 }
 
-// LinkForSetID generates a link from given PTO configuration and a set ID. Observation set
-// links are given by set ID as a hexadecimal string.
-func LinkForSetID(config *PTOConfiguration, setid int) string {
-	out, _ := config.LinkTo(fmt.Sprintf("obs/%x", setid))
-	return out
+// SetSubmitter records the identifier of the client which created this
+// ObservationSet, which is allowed to delete it. The submitter is kept out of
+// the set's metadata, so that it survives metadata updates.
+func (set *ObservationSet) SetSubmitter(db orm.DB, submitter string) error {
+	if _, err := db.Exec("UPDATE observation_sets SET submitter = ? WHERE id = ?", submitter, set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
 }
 
-// LinkVia sets this ObservationSet's link and datalink given a configuration
-func (set *ObservationSet) LinkVia(config *PTOConfiguration) {
-	set.link = LinkForSetID(config, set.ID)
-	set.datalink = set.link + "/data"
+// Submitter returns the identifier of the client which created this
+// ObservationSet, or the empty string if it is not known.
+func (set *ObservationSet) Submitter(db orm.DB) (string, error) {
+	var submitter string
+	if _, err := db.QueryOne(pg.Scan(&submitter), "SELECT coalesce(submitter, '') FROM observation_sets WHERE id = ?", set.ID); err != nil {
+		if err == pg.ErrNoRows {
+			return "", PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
+		}
+		return "", PTOWrapError(err)
+	}
+	return submitter, nil
 }
 
-func (set *ObservationSet) Link() string {
-	return set.link
-}
+// MaxNotesLength is the maximum length in bytes of the notes attached to an
+// observation set.
+const MaxNotesLength = 64 * 1024
 
-func (set *ObservationSet) TimeInterval(db orm.DB) (*time.Time, *time.Time, error) {
-	if set.TimeStart == nil || set.TimeEnd == nil {
-		// No start time or end time. Do we have any observations?
-		obscount, err := set.CountObservations(db)
-		if err != nil {
-			return nil, nil, err
-		}
+// SetNotes attaches a Markdown document with notes on this ObservationSet,
+// e.g. on its methodology or caveats, replacing any notes already attached,
+// or removes them if notes is empty. Like the submitter, notes are kept out of
+// the set's metadata, so that they survive metadata updates. Notes on sealed
+// sets cannot be changed.
+func (set *ObservationSet) SetNotes(db orm.DB, notes string) error {
+	if len(notes) > MaxNotesLength {
+		return PTOErrorf("notes on observation set %x too long: %d bytes, limit %d", set.ID, len(notes), MaxNotesLength).StatusIs(http.StatusRequestEntityTooLarge)
+	}
 
-		if obscount == 0 {
-			// no, we don't
-			return nil, nil, nil
-		}
+	if !utf8.ValidString(notes) {
+		return PTOErrorf("notes on observation set %x not valid UTF-8", set.ID).StatusIs(http.StatusBadRequest)
+	}
 
-		// No start time or end time. Try to select from database.
-		err = db.Model(&Observation{}).ColumnExpr("min(time_start)").Where("set_id = ?", set.ID).Select(&set.TimeStart)
-		if err != nil {
-			return nil, nil, PTOWrapError(err)
-		}
+	if err := set.checkUnsealed(db); err != nil {
+		return err
+	}
 
-		err = db.Model(&Observation{}).ColumnExpr("max(time_end)").Where("set_id = ?", set.ID).Select(&set.TimeEnd)
-		if err != nil {
-			return nil, nil, PTOWrapError(err)
-		}
+	var value interface{}
+	if notes != "" {
+		value = notes
+	}
+	if _, err := db.Exec("UPDATE observation_sets SET notes = ? WHERE id = ?", value, set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	set.hasNotes = notes != ""
 
-		// If we actually updated the time range, cache it by doing a simple update
-		if set.TimeStart != nil && set.TimeEnd != nil {
-			if err = db.Update(set); err != nil {
-				return nil, nil, PTOWrapError(err)
-			}
+	return nil
+}
+
+// Notes returns the Markdown document with notes attached to this
+// ObservationSet. It returns an error with status 404 if the set does not
+// exist or has no notes.
+func (set *ObservationSet) Notes(db orm.DB) (string, error) {
+	var notes *string
+	if _, err := db.QueryOne(pg.Scan(&notes), "SELECT notes FROM observation_sets WHERE id = ?", set.ID); err != nil {
+		if err == pg.ErrNoRows {
+			return "", PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
 		}
+		return "", PTOWrapError(err)
 	}
-
-	return set.TimeStart, set.TimeEnd, nil
+	if notes == nil {
+		return "", PTOErrorf("observation set %x has no notes", set.ID).StatusIs(http.StatusNotFound)
+	}
+	return *notes, nil
 }
 
-// CountObservations counts observations in the database for this ObservationSet,
-// caching the result and storing it in the database if appropriate
-func (set *ObservationSet) CountObservations(db orm.DB) (int, error) {
-	var err error
-	if set.Count == 0 {
-		set.Count, err = db.Model(&Observation{}).Where("set_id = ?", set.ID).Count()
-		if err != nil {
-			return 0, PTOWrapError(err)
+// IsSealed returns true if this ObservationSet is sealed in the database. It
+// returns an error with status 404 if the set does not exist.
+func (set *ObservationSet) IsSealed(db orm.DB) (bool, error) {
+	var sealed bool
+	if _, err := db.QueryOne(pg.Scan(&sealed), "SELECT sealed IS NOT NULL FROM observation_sets WHERE id = ?", set.ID); err != nil {
+		if err == pg.ErrNoRows {
+			return false, PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
 		}
+		return false, PTOWrapError(err)
+	}
+	return sealed, nil
+}
 
-		// if we actually updated the count, cache it by doing a simple update
-		if set.Count != 0 {
-			if err = db.Update(set); err != nil {
-				return 0, PTOWrapError(err)
-			}
+// checkUnsealed returns an error with status 409 if this ObservationSet is
+// sealed in the database. It locks the set's row until the end of the
+// transaction, so that the set cannot be sealed while it is being changed,
+// nor changed while it is being sealed.
+func (set *ObservationSet) checkUnsealed(db orm.DB) error {
+	var sealed bool
+	if _, err := db.QueryOne(pg.Scan(&sealed), "SELECT sealed IS NOT NULL FROM observation_sets WHERE id = ? FOR UPDATE", set.ID); err != nil {
+		if err == pg.ErrNoRows {
+			return PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
 		}
+		return PTOWrapError(err)
 	}
-	return set.Count, nil
+	if sealed {
+		return PTOErrorf("observation set %x is sealed", set.ID).StatusIs(http.StatusConflict)
+	}
+	return nil
 }
 
-func (set *ObservationSet) verifyConditionSet(conditionNames map[string]struct{}) error {
-	// make a set condition names declared in the condition set
-	conditionDeclared := make(map[string]struct{})
-	for _, c := range set.Conditions {
-		conditionDeclared[c.Name] = struct{}{}
+// Seal marks this ObservationSet as complete. Once sealed, a set's data and
+// metadata can no longer be changed, so it can be cited. Only sets with
+// observations can be sealed.
+func (set *ObservationSet) Seal(db orm.DB) error {
+	if err := set.checkUnsealed(db); err != nil {
+		return err
 	}
 
-	// look for name in condition names not declared in the set, raise error if so
-	for conditionName := range conditionNames {
-		if _, ok := conditionDeclared[conditionName]; !ok {
-			return PTOErrorf("observation has condition %s not declared in set", conditionName)
-		}
+	obscount, err := set.CountObservations(db)
+	if err != nil {
+		return err
+	}
+	if obscount == 0 {
+		return PTOErrorf("observation set %x has no observations to seal", set.ID).StatusIs(http.StatusConflict)
+	}
+
+	sealed := time.Now().UTC()
+	if _, err := db.Exec("UPDATE observation_sets SET sealed = ? WHERE id = ?", sealed, set.ID); err != nil {
+		return PTOWrapError(err)
 	}
+	set.Sealed = &sealed
 
 	return nil
 }
 
-// Observation represents a single observation, within an observation set
-type Observation struct {
-	ID          int `sql:",pk"`
-	SetID       int
-	Set         *ObservationSet
-	TimeStart   *time.Time
-	TimeEnd     *time.Time
-	PathID      int
-	Path        *Path
-	ConditionID int
-	Condition   *Condition
-	Value       string
+// ObservationSetDeletion counts the rows removed by deleting an observation
+// set.
+type ObservationSetDeletion struct {
+	// Link to the deleted set
+	Set string `json:"set"`
+	// Number of observations deleted
+	Observations int `json:"observations"`
+	// Number of conditions unlinked from the set
+	Conditions int `json:"conditions"`
+	// True if nothing was actually deleted
+	DryRun bool `json:"dry_run"`
+	// True if the set was removed for good, rather than marked deleted
+	Purged bool `json:"purged"`
 }
 
-// MarshalJSON turns this Observation into a JSON array suitable for use as a
-// line in an observation file.
-func (obs *Observation) MarshalJSON() ([]byte, error) {
-	jslice := []string{
-		fmt.Sprintf("%x", obs.SetID),
-		obs.TimeStart.UTC().Format(time.RFC3339),
-		obs.TimeEnd.UTC().Format(time.RFC3339),
-		obs.Path.String,
-		obs.Condition.Name,
-	}
+// Delete removes this ObservationSet, its observations, and its links to
+// conditions from the database, returning the number of rows affected. If
+// dryRun is set, it counts the rows that would be affected without deleting
+// anything. Conditions and paths are shared between sets, and are left in
+// place. Call Delete within a transaction, so that a failure does not leave a
+// partially deleted set behind.
+func (set *ObservationSet) Delete(db orm.DB, dryRun bool) (*ObservationSetDeletion, error) {
+	out := ObservationSetDeletion{Set: set.Link(), DryRun: dryRun}
 
-	if obs.Value != "" {
-		jslice = append(jslice, fmt.Sprintf("%s", obs.Value))
+	var err error
+	if out.Observations, err = db.Model(&Observation{}).Where("set_id = ?", set.ID).Count(); err != nil {
+		return nil, PTOWrapError(err)
 	}
 
-	return json.Marshal(&jslice)
-}
+	if out.Conditions, err = db.Model(&ObservationSetCondition{}).Where("observation_set_id = ?", set.ID).Count(); err != nil {
+		return nil, PTOWrapError(err)
+	}
 
-// unmarshalStringSlice fills in this observation from a string slice. This is used by both JSON unmarshaling and CSV unmarshaling (in CopyDataToStream)
-func (obs *Observation) unmarshalStringSlice(jslice []string, time_format string) error {
+	if dryRun {
+		return &out, nil
+	}
 
-	obs.ID = 0
-	if len(jslice[0]) > 0 {
-		setid, err := strconv.ParseUint(jslice[0], 16, 64) // fill in Set ID, will be ignored by force insert
-		if err != nil {
-			return PTOWrapError(err)
+	// dropping a partition is much faster than deleting its rows
+	dropped, err := dropObservationPartition(db, set.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !dropped {
+		if _, err := db.Exec("DELETE FROM observations WHERE set_id = ?", set.ID); err != nil {
+			return nil, PTOWrapError(err)
 		}
-		obs.SetID = int(setid)
-	} else {
-		obs.SetID = 0
 	}
 
-	starttime, err := time.Parse(time_format, jslice[1])
-	if err != nil {
-		return PTOWrapError(err)
+	if _, err := db.Exec("DELETE FROM observation_set_conditions WHERE observation_set_id = ?", set.ID); err != nil {
+		return nil, PTOWrapError(err)
 	}
-	obs.TimeStart = &starttime
 
-	endtime, err := time.Parse(time_format, jslice[2])
+	res, err := db.Exec("DELETE FROM observation_sets WHERE id = ?", set.ID)
 	if err != nil {
-		return PTOWrapError(err)
+		return nil, PTOWrapError(err)
+	}
+	if res.RowsAffected() == 0 {
+		return nil, PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
 	}
-	obs.TimeEnd = &endtime
 
-	obs.Path = &Path{String: jslice[3]}
-	obs.Path.Parse()
+	out.Purged = true
+	return &out, nil
+}
 
-	obs.Condition = NewCondition(jslice[4])
+// ObservationDeleteBatchSize is the number of observations deleted at once
+// by DeleteInBatches, unless configured otherwise.
+const ObservationDeleteBatchSize = 50000
+
+// DeleteInBatches removes this ObservationSet, its observations, and its
+// links to conditions from the database like Delete, but without holding a
+// single transaction open for as long as deleting a large set takes. If the
+// set's observations are in a partition of their own, it is dropped;
+// otherwise, they are deleted in batches of the configured size, each in its
+// own transaction, pausing between batches as configured. The set is marked
+// deleted first, so that clients and queries never see it partially deleted;
+// if deletion fails, it stays marked deleted, and can be purged again. If
+// progress is not nil, it is called after each batch with the number of
+// observations deleted so far and in total.
+func (set *ObservationSet) DeleteInBatches(db *pg.DB, opts *ObsDatabaseOptions, progress func(deleted int, total int)) (*ObservationSetDeletion, error) {
+	var out *ObservationSetDeletion
+	var dropped bool
+
+	err := db.RunInTransaction(func(t *pg.Tx) error {
+		var err error
+		if out, err = set.Delete(t, true); err != nil {
+			return err
+		}
 
-	if len(jslice) >= 6 {
-		obs.Value = jslice[5]
+		deleted, err := set.DeletedAt(t)
 		if err != nil {
 			return err
 		}
-	}
-
-	return nil
-}
-
-// UnmarshalJSON fills in this Observation from a JSON array line in an
-// observation file.
-func (obs *Observation) UnmarshalJSON(b []byte) error {
-	var jslice []string
+		if deleted == nil {
+			if err := set.MarkDeleted(t); err != nil {
+				return err
+			}
+		}
 
-	err := json.Unmarshal(b, &jslice)
-	if err != nil {
+		// dropping a partition is fast enough to finish in one transaction
+		if dropped, err = dropObservationPartition(t, set.ID); err != nil || !dropped {
+			return err
+		}
+		_, err = set.Delete(t, false)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	if len(jslice) < 5 {
-		return PTOErrorf("Observation requires at least five elements")
+	out.DryRun = false
+	if dropped {
+		out.Purged = true
+		return out, nil
 	}
 
-	return obs.unmarshalStringSlice(jslice, time.RFC3339)
-
-}
+	if err := set.deleteObservationsInBatches(db, opts, out.Observations, progress); err != nil {
+		return nil, err
+	}
 
-// CreateTables insures that the tables used by the ORM exist in the given
-// database. This is used for testing, and the (not yet implemented) ptodb init
-// command.
-func CreateTables(db *pg.DB) error {
-	opts := orm.CreateTableOptions{
-		IfNotExists:   true,
-		FKConstraints: true,
+	// remove the now empty set
+	if err := db.RunInTransaction(func(t *pg.Tx) error {
+		_, err := set.Delete(t, false)
+		return err
+	}); err != nil {
+		return nil, err
 	}
 
-	// Create functions first.
-	// EWW EWW
-	// PostgreSQL doesn't have IF NOT EXISTS for these,
-	// so just run them and ignore the error, since any error other than
-	// "exists" will probably cause later failures in the subsequent
-	// EWW EWW
-	db.Exec("create function like_rev (text, text) returns boolean as $$ select $2 like $1 $$ language SQL")
-	db.Exec("create operator ~~~~ (procedure = like_rev,  leftarg=text, rightarg=text)")
+	out.Purged = true
+	return out, nil
+}
 
-	return db.RunInTransaction(func(tx *pg.Tx) error {
-		if err := db.CreateTable(&Condition{}, &opts); err != nil {
+// deleteObservationsInBatches deletes the observations in this set in
+// batches of the configured size, each in its own transaction, pausing
+// between batches as configured, and calling progress, if not nil, after
+// each batch.
+func (set *ObservationSet) deleteObservationsInBatches(db *pg.DB, opts *ObsDatabaseOptions, total int, progress func(deleted int, total int)) error {
+	batchSize := opts.deleteBatchSize()
+	pause := opts.deletePause()
+
+	for deleted := 0; ; {
+		res, err := db.Exec(`DELETE FROM observations WHERE set_id = ?0 AND ctid = ANY(ARRAY(
+			SELECT ctid FROM observations WHERE set_id = ?0 LIMIT ?1))`, set.ID, batchSize)
+		if err != nil {
 			return PTOWrapError(err)
 		}
 
-		if err := db.CreateTable(&Path{}, &opts); err != nil {
-			return PTOWrapError(err)
+		deleted += res.RowsAffected()
+		if progress != nil {
+			progress(deleted, total)
 		}
 
-		if err := db.CreateTable(&ObservationSet{}, &opts); err != nil {
-			return PTOWrapError(err)
+		if res.RowsAffected() < batchSize {
+			return nil
 		}
+		time.Sleep(pause)
+	}
+}
 
-		if err := db.CreateTable(&ObservationSetCondition{}, &opts); err != nil {
-			return PTOWrapError(err)
-		}
+// MarkDeleted marks this ObservationSet as deleted, hiding it from clients
+// and queries as if it had been removed, but keeping it and its observations
+// in the database, so that it can be restored until it is purged with
+// Delete. It returns an error with status 404 if the set does not exist, and
+// with status 409 if it is already deleted.
+func (set *ObservationSet) MarkDeleted(db orm.DB) error {
+	deleted, err := set.DeletedAt(db)
+	if err != nil {
+		return err
+	}
+	if deleted != nil {
+		return PTOErrorf("observation set %x is already deleted", set.ID).StatusIs(http.StatusConflict)
+	}
 
-		if err := db.CreateTable(&Observation{}, &opts); err != nil {
-			return PTOWrapError(err)
-		}
+	if _, err := db.Exec("UPDATE observation_sets SET deleted = ? WHERE id = ?", time.Now().UTC(), set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
 
-		// index to select observations by set ID
-		if _, err := db.Exec("CREATE INDEX ON observations (set_id)"); err != nil {
-			return PTOWrapError(err)
-		}
+// Restore undoes MarkDeleted, making this ObservationSet visible again. It
+// returns an error with status 404 if the set does not exist, and with
+// status 409 if it is not deleted.
+func (set *ObservationSet) Restore(db orm.DB) error {
+	deleted, err := set.DeletedAt(db)
+	if err != nil {
+		return err
+	}
+	if deleted == nil {
+		return PTOErrorf("observation set %x is not deleted", set.ID).StatusIs(http.StatusConflict)
+	}
 
-		return nil
-	})
+	if _, err := db.Exec("UPDATE observation_sets SET deleted = NULL WHERE id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
 }
 
-// DropTables removes the tables used by the ORM from the database. Use this for
-// testing only, please.
-func DropTables(db *pg.DB) error {
-	return db.RunInTransaction(func(tx *pg.Tx) error {
-		if err := db.DropTable(&Observation{}, nil); err != nil {
-			return PTOWrapError(err)
+// DeletedAt returns the time at which this ObservationSet was marked deleted,
+// or nil if it is not deleted. It returns an error with status 404 if the
+// set does not exist.
+func (set *ObservationSet) DeletedAt(db orm.DB) (*time.Time, error) {
+	var deleted *time.Time
+	if _, err := db.QueryOne(pg.Scan(&deleted), "SELECT deleted FROM observation_sets WHERE id = ?", set.ID); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
 		}
+		return nil, PTOWrapError(err)
+	}
+	return deleted, nil
+}
 
-		if err := db.DropTable(&ObservationSetCondition{}, nil); err != nil {
-			return PTOWrapError(err)
-		}
+// PurgeDeletedObservationSets removes observation sets marked deleted before
+// the given time from the database for good, one at a time with
+// DeleteInBatches as configured, returning what was removed. If dryRun is
+// set, it counts the rows that would be removed without removing anything.
+// If progress is not nil, it is called after each batch of observations
+// deleted, with the ID of the set being purged.
+func PurgeDeletedObservationSets(config *PTOConfiguration, db *pg.DB, before time.Time, dryRun bool,
+	progress func(setid int, deleted int, total int)) ([]*ObservationSetDeletion, error) {
+	setIds, err := ObservationSetIDsDeletedBefore(db, &before)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*ObservationSetDeletion, 0, len(setIds))
+	for _, setid := range setIds {
+		set := ObservationSet{ID: setid}
+		set.LinkVia(config)
+
+		var deletion *ObservationSetDeletion
+		if dryRun {
+			err = db.RunInTransaction(func(t *pg.Tx) error {
+				deletion, err = set.Delete(t, true)
+				return err
+			})
+		} else {
+			var setProgress func(int, int)
+			if progress != nil {
+				setProgress = func(deleted int, total int) {
+					progress(setid, deleted, total)
+				}
+			}
+			deletion, err = set.DeleteInBatches(db, &config.ObsDatabase, setProgress)
+		}
+		if err != nil {
+			return out, err
+		}
+		out = append(out, deletion)
+	}
+
+	return out, nil
+}
+
+// LinkForSetID generates a link from given PTO configuration and a set ID. Observation set
+// links are given by set ID as a hexadecimal string.
+func LinkForSetID(config *PTOConfiguration, setid int) string {
+	out, _ := config.LinkTo(fmt.Sprintf("obs/%x", setid))
+	return out
+}
+
+// SlugMetadataKey is the metadata key holding an observation set's optional
+// human-friendly slug, used as an alias for the set's ID in routes.
+const SlugMetadataKey = "_slug"
+
+// Slug returns this ObservationSet's slug, or the empty string if it has none.
+func (set *ObservationSet) Slug() string {
+	return set.Metadata[SlugMetadataKey]
+}
+
+// ValidateSlug returns an error if this ObservationSet's slug, if present,
+// contains characters other than lowercase letters, digits, '-', '_' and
+// '.', or could be mistaken for a set ID.
+func (set *ObservationSet) ValidateSlug() error {
+	slug := set.Slug()
+	if slug == "" {
+		return nil
+	}
+
+	for _, c := range slug {
+		if !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.') {
+			return PTOErrorf("invalid character %q in set slug %s", c, slug).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	if _, err := strconv.ParseUint(slug, 16, 64); err == nil {
+		return PTOErrorf("set slug %s looks like a set ID", slug).StatusIs(http.StatusBadRequest)
+	}
+
+	return nil
+}
+
+// wrapSlugError wraps an error inserting or updating this ObservationSet,
+// reporting that its slug already exists if the error is due to another set
+// having taken the slug since it was checked.
+func (set *ObservationSet) wrapSlugError(err error) error {
+	if pgerr, ok := err.(pg.Error); ok && pgerr.Field('C') == "23505" && pgerr.Field('n') == setSlugIndex {
+		return PTOExistsError("set slug", set.Slug())
+	}
+	return PTOWrapError(err)
+}
+
+// ObservationSetIDForSlug returns the ID of the observation set with the
+// given slug, or a not found error if there is none. New versions of a set
+// keep the slug of the set they supersede, so this returns the newest set
+// with the slug.
+func ObservationSetIDForSlug(db orm.DB, slug string) (int, error) {
+	setIds, err := ObservationSetIDsWithMetadataValue(db, SlugMetadataKey, slug)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(setIds) == 0 {
+		return 0, PTONotFoundError("observation set", slug)
+	}
+
+	return setIds[len(setIds)-1], nil
+}
+
+// UUIDMetadataKey is the metadata key holding an observation set's globally
+// unique identifier. Unlike its numeric ID, a set's UUID is carried with its
+// metadata when the set is exported and imported into another observatory,
+// so the same logical set can be recognized wherever it appears.
+const UUIDMetadataKey = "_uuid"
+
+// UUID returns this ObservationSet's UUID, or the empty string if it has none
+// yet. Sets are given a UUID when inserted, if they do not already have one.
+func (set *ObservationSet) UUID() string {
+	return set.Metadata[UUIDMetadataKey]
+}
+
+// NewSetUUID generates a random (version 4) UUID for an observation set, as a
+// lowercase string.
+func NewSetUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", PTOWrapError(err)
+	}
+
+	// set version 4 and the RFC 4122 variant
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// ValidateUUID returns an error if this ObservationSet's UUID, if present, is
+// not a UUID in lowercase hex with hyphens.
+func (set *ObservationSet) ValidateUUID() error {
+	uuid := set.UUID()
+	if uuid == "" {
+		return nil
+	}
+
+	for i, c := range uuid {
+		if i == 8 || i == 13 || i == 18 || i == 23 {
+			if c != '-' {
+				return PTOErrorf("bad set UUID %s", uuid).StatusIs(http.StatusBadRequest)
+			}
+		} else if !((c >= '0' && c <= '9') || (c >= 'a' && c <= 'f')) {
+			return PTOErrorf("bad set UUID %s", uuid).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	if len(uuid) != 36 {
+		return PTOErrorf("bad set UUID %s", uuid).StatusIs(http.StatusBadRequest)
+	}
+
+	return nil
+}
+
+// ObservationSetIDForUUID returns the ID of the observation set with the
+// given UUID, or a not found error if there is none.
+func ObservationSetIDForUUID(db orm.DB, uuid string) (int, error) {
+	setIds, err := ObservationSetIDsWithMetadataValue(db, UUIDMetadataKey, uuid)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(setIds) == 0 {
+		return 0, PTONotFoundError("observation set", uuid)
+	}
+
+	return setIds[0], nil
+}
+
+// ensureUUID gives this ObservationSet a new UUID if it has none, or verifies
+// that its UUID is valid and not yet used by another set in the database.
+func (set *ObservationSet) ensureUUID(db orm.DB) error {
+	if set.Metadata == nil {
+		set.Metadata = make(map[string]string)
+	}
+
+	if set.UUID() == "" {
+		uuid, err := NewSetUUID()
+		if err != nil {
+			return err
+		}
+		set.Metadata[UUIDMetadataKey] = uuid
+		return nil
+	}
+
+	if err := set.ValidateUUID(); err != nil {
+		return err
+	}
+
+	setIds, err := ObservationSetIDsWithMetadataValue(db, UUIDMetadataKey, set.UUID())
+	if err != nil {
+		return err
+	}
+	for _, id := range setIds {
+		if id != set.ID {
+			return PTOExistsError("observation set with UUID", set.UUID())
+		}
+	}
+
+	return nil
+}
+
+// LinkVia sets this ObservationSet's link and datalink given a configuration
+func (set *ObservationSet) LinkVia(config *PTOConfiguration) {
+	set.link = LinkForSetID(config, set.ID)
+	set.datalink = set.link + "/data"
+	if set.hasNotes {
+		set.noteslink = set.link + "/notes"
+	} else {
+		set.noteslink = ""
+	}
+}
+
+func (set *ObservationSet) Link() string {
+	return set.link
+}
+
+func (set *ObservationSet) TimeInterval(db orm.DB) (*time.Time, *time.Time, error) {
+	if set.TimeStart == nil || set.TimeEnd == nil {
+		// No start time or end time. Do we have any observations?
+		obscount, err := set.CountObservations(db)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if obscount == 0 {
+			// no, we don't
+			return nil, nil, nil
+		}
+
+		// No start time or end time. Try to select from database.
+		err = db.Model(&Observation{}).ColumnExpr("min(time_start)").Where("set_id = ?", set.ID).Select(&set.TimeStart)
+		if err != nil {
+			return nil, nil, PTOWrapError(err)
+		}
+
+		err = db.Model(&Observation{}).ColumnExpr("max(time_end)").Where("set_id = ?", set.ID).Select(&set.TimeEnd)
+		if err != nil {
+			return nil, nil, PTOWrapError(err)
+		}
+
+		// If we actually updated the time range, cache it by doing a simple update
+		if set.TimeStart != nil && set.TimeEnd != nil {
+			if _, err = db.Model(set).Column("time_start", "time_end").WherePK().Update(); err != nil {
+				return nil, nil, PTOWrapError(err)
+			}
+		}
+	}
+
+	return set.TimeStart, set.TimeEnd, nil
+}
+
+// extendTimeInterval extends the time interval of this ObservationSet in the
+// database to cover the given interval, as observations within it are
+// inserted.
+func (set *ObservationSet) extendTimeInterval(db orm.DB, start *time.Time, end *time.Time) error {
+	if _, err := db.QueryOne(pg.Scan(&set.TimeStart, &set.TimeEnd),
+		`UPDATE observation_sets SET time_start = LEAST(time_start, ?), time_end = GREATEST(time_end, ?)
+		WHERE id = ? RETURNING time_start, time_end`, start, end, set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// updateTimeInterval recomputes the time interval of this ObservationSet in
+// the database from its observations.
+func (set *ObservationSet) updateTimeInterval(db orm.DB) error {
+	if _, err := db.QueryOne(pg.Scan(&set.TimeStart, &set.TimeEnd),
+		`UPDATE observation_sets SET
+			time_start = (SELECT min(time_start) FROM observations WHERE set_id = observation_sets.id),
+			time_end = (SELECT max(time_end) FROM observations WHERE set_id = observation_sets.id)
+		WHERE id = ? RETURNING time_start, time_end`, set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// CountObservations counts observations in the database for this ObservationSet,
+// caching the result and storing it in the database if appropriate
+func (set *ObservationSet) CountObservations(db orm.DB) (int, error) {
+	var err error
+	if set.Count == 0 {
+		set.Count, err = db.Model(&Observation{}).Where("set_id = ?", set.ID).Count()
+		if err != nil {
+			return 0, PTOWrapError(err)
+		}
+
+		// if we actually updated the count, cache it by doing a simple update
+		if set.Count != 0 {
+			if _, err = db.Model(set).Column("count").WherePK().Update(); err != nil {
+				return 0, PTOWrapError(err)
+			}
+		}
+	}
+	return set.Count, nil
+}
+
+// ObservationSetStats summarizes the observations in an observation set,
+// without the need to download them.
+type ObservationSetStats struct {
+	// Number of observations in the set
+	Count int `json:"count"`
+	// Earliest start time of an observation in the set
+	TimeStart *time.Time `json:"time_start,omitempty"`
+	// Latest end time of an observation in the set
+	TimeEnd *time.Time `json:"time_end,omitempty"`
+	// Number of observations in the set by condition name
+	Conditions map[string]int `json:"conditions"`
+	// Number of distinct paths in the set
+	PathCount int `json:"path_count"`
+}
+
+// Stats summarizes the observations in this ObservationSet using SQL
+// aggregates, caching the result in the database until observations are next
+// loaded into the set. Like the submitter, the cached summary is kept out of
+// the set's metadata.
+func (set *ObservationSet) Stats(db orm.DB) (*ObservationSetStats, error) {
+	var cached []byte
+	if _, err := db.QueryOne(pg.Scan(&cached), "SELECT stats FROM observation_sets WHERE id = ?", set.ID); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
+		}
+		return nil, PTOWrapError(err)
+	}
+
+	if cached != nil {
+		stats := new(ObservationSetStats)
+		if err := json.Unmarshal(cached, stats); err != nil {
+			return nil, PTOWrapError(err)
+		}
+		return stats, nil
+	}
+
+	if pgdb, ok := db.(*pg.DB); ok {
+		var stats *ObservationSetStats
+		err := pgdb.RunInTransaction(func(t *pg.Tx) error {
+			var err error
+			stats, err = set.computeStats(t)
+			return err
+		})
+		return stats, err
+	}
+	return set.computeStats(db)
+}
+
+// computeStats computes and caches the summary of this ObservationSet's
+// observations for Stats, in a transaction. The set's row is locked while the
+// summary is computed, so that observations loaded in the meantime invalidate
+// the summary only after it is stored, instead of it being replaced by a
+// summary computed without them.
+func (set *ObservationSet) computeStats(db orm.DB) (*ObservationSetStats, error) {
+	var cached []byte
+	if _, err := db.QueryOne(pg.Scan(&cached), "SELECT stats FROM observation_sets WHERE id = ? FOR UPDATE", set.ID); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
+		}
+		return nil, PTOWrapError(err)
+	}
+
+	// another client may have computed the summary while we waited
+	stats := new(ObservationSetStats)
+	if cached != nil {
+		if err := json.Unmarshal(cached, stats); err != nil {
+			return nil, PTOWrapError(err)
+		}
+		return stats, nil
+	}
+
+	if _, err := db.QueryOne(pg.Scan(&stats.Count, &stats.TimeStart, &stats.TimeEnd, &stats.PathCount),
+		`SELECT count(*), min(time_start), max(time_end), count(DISTINCT path_id)
+		FROM observations WHERE set_id = ?`, set.ID); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	var conditionCounts []struct {
+		Name  string
+		Count int
+	}
+	if _, err := db.Query(&conditionCounts,
+		`SELECT conditions.name AS name, count(*) AS count
+		FROM observations JOIN conditions ON conditions.id = observations.condition_id
+		WHERE observations.set_id = ? GROUP BY conditions.name`, set.ID); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	stats.Conditions = make(map[string]int)
+	for _, cc := range conditionCounts {
+		stats.Conditions[cc.Name] = cc.Count
+	}
+
+	// cache the summary on the set row
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	if _, err := db.Exec("UPDATE observation_sets SET stats = ? WHERE id = ?", string(b), set.ID); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return stats, nil
+}
+
+// invalidateStats removes the cached summary of this ObservationSet's
+// observations from the database, as observations are being loaded into it.
+func (set *ObservationSet) invalidateStats(db orm.DB) error {
+	if _, err := db.Exec("UPDATE observation_sets SET stats = NULL WHERE id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+func (set *ObservationSet) verifyConditionSet(conditionNames map[string]struct{}) error {
+	// make a set condition names declared in the condition set
+	conditionDeclared := make(map[string]struct{})
+	for _, c := range set.Conditions {
+		conditionDeclared[c.Name] = struct{}{}
+	}
+
+	// look for name in condition names not declared in the set, raise error if so
+	for conditionName := range conditionNames {
+		if _, ok := conditionDeclared[conditionName]; !ok {
+			return PTOErrorf("observation has condition %s not declared in set", conditionName)
+		}
+	}
+
+	return nil
+}
+
+// Observation represents a single observation, within an observation set
+type Observation struct {
+	ID          int `sql:",pk"`
+	SetID       int
+	Set         *ObservationSet
+	TimeStart   *time.Time
+	TimeEnd     *time.Time
+	PathID      int
+	Path        *Path
+	ConditionID int
+	Condition   *Condition
+	// Value of the observation as JSON; see HasValue and the typed accessors
+	Value json.RawMessage
+	// Reference to raw source data, if any; see SourceRef
+	SourceIndex  *int
+	SourceOffset *int64
+	SourceRecord *int64
+}
+
+// MarshalJSON turns this Observation into a JSON array suitable for use as a
+// line in an observation file.
+func (obs *Observation) MarshalJSON() ([]byte, error) {
+	jslice := []interface{}{
+		fmt.Sprintf("%x", obs.SetID),
+		obs.TimeStart.UTC().Format(time.RFC3339),
+		obs.TimeEnd.UTC().Format(time.RFC3339),
+		obs.Path.String,
+		obs.Condition.Name,
+	}
+
+	ref := obs.SourceRef()
+	if obs.HasValue() || ref != nil {
+		var value interface{}
+		if obs.HasValue() {
+			value = obs.Value
+		}
+		jslice = append(jslice, value)
+	}
+
+	if ref != nil {
+		jslice = append(jslice, ref)
+	}
+
+	return json.Marshal(&jslice)
+}
+
+// unmarshalStringSlice fills in this observation from a string slice of its
+// first five elements, its value as JSON, and its source reference. This is
+// used by both JSON unmarshaling and CSV unmarshaling (in
+// copyObservationsToEncoder)
+func (obs *Observation) unmarshalStringSlice(jslice []string, value json.RawMessage, ref *SourceRef, time_format string) error {
+
+	obs.ID = 0
+	if len(jslice[0]) > 0 {
+		setid, err := strconv.ParseUint(jslice[0], 16, 64) // fill in Set ID, will be ignored by force insert
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		obs.SetID = int(setid)
+	} else {
+		obs.SetID = 0
+	}
+
+	starttime, err := time.Parse(time_format, jslice[1])
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if !inTimeRange(starttime) {
+		return PTOErrorf("observation start time %s out of range", jslice[1])
+	}
+	obs.TimeStart = &starttime
+
+	endtime, err := time.Parse(time_format, jslice[2])
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if !inTimeRange(endtime) {
+		return PTOErrorf("observation end time %s out of range", jslice[2])
+	}
+	obs.TimeEnd = &endtime
+
+	obs.Path = &Path{String: jslice[3]}
+	obs.Path.Parse()
+
+	obs.Condition = NewCondition(jslice[4])
+
+	obs.Value = value
+	obs.SetSourceRef(ref)
+
+	return nil
+}
+
+// UnmarshalJSON fills in this Observation from a JSON array line in an
+// observation file. The value, if present, may be any JSON value.
+func (obs *Observation) UnmarshalJSON(b []byte) error {
+	jslice, value, ref, err := splitObservationJSON(b)
+	if err != nil {
+		return err
+	}
+
+	return obs.unmarshalStringSlice(jslice, value, ref, time.RFC3339)
+}
+
+// CreateTables insures that the tables, functions, and indexes used by the
+// ORM exist in the given database, by migrating it to the latest schema
+// version. This is used for testing, ptosrv -initdb, and the ptodb init
+// command.
+func CreateTables(db *pg.DB) error {
+	_, err := Migrate(db)
+	return err
+}
+
+// createBaseTables creates the tables, functions, and operators used by the
+// ORM, if they do not already exist. This is the first schema migration.
+func createBaseTables(t *pg.Tx) error {
+	opts := orm.CreateTableOptions{
+		IfNotExists:   true,
+		FKConstraints: true,
+	}
+
+	// PostgreSQL doesn't have IF NOT EXISTS for functions and operators, so
+	// replace the function and ignore duplicate operators.
+	if _, err := t.Exec("CREATE OR REPLACE FUNCTION like_rev (text, text) RETURNS boolean AS $$ SELECT $2 LIKE $1 $$ LANGUAGE SQL"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := t.Exec(`DO $$ BEGIN
+			CREATE OPERATOR ~~~~ (procedure = like_rev, leftarg = text, rightarg = text);
+		EXCEPTION WHEN duplicate_function THEN NULL;
+		END $$`); err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, model := range []interface{}{
+		&Condition{},
+		&Path{},
+		&ObservationSet{},
+		&ObservationSetCondition{},
+		&Observation{},
+	} {
+		if err := t.CreateTable(model, &opts); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// baseIndexStatements create the secondary indexes added by schema version
+// 2. Like the migrations applying them, the statements for each schema
+// version are never changed once released; new indexes go in the statements
+// of a new migration, which are added to indexStatements.
+var baseIndexStatements = []string{
+	// select observations by set, condition, and time
+	"CREATE INDEX IF NOT EXISTS observations_set_id_idx ON observations (set_id)",
+	"CREATE INDEX IF NOT EXISTS observations_condition_id_idx ON observations (condition_id)",
+	"CREATE INDEX IF NOT EXISTS observations_time_idx ON observations (time_start, time_end)",
+
+	// look up conditions and paths by name
+	"CREATE INDEX IF NOT EXISTS conditions_name_idx ON conditions (name)",
+	"CREATE UNIQUE INDEX IF NOT EXISTS paths_string_idx ON paths (string)",
+
+	// look up observation sets by metadata
+	"CREATE INDEX IF NOT EXISTS observation_sets_metadata_idx ON observation_sets USING GIN (metadata)",
+}
+
+// setTimeIndexStatements create the secondary indexes added by schema
+// version 13, to select observation sets by time interval.
+var setTimeIndexStatements = []string{
+	"CREATE INDEX IF NOT EXISTS observation_sets_time_idx ON observation_sets (time_start, time_end)",
+}
+
+// setUUIDIndexStatements create the secondary indexes added by schema
+// version 14, making set UUIDs unique.
+var setUUIDIndexStatements = []string{
+	"CREATE UNIQUE INDEX IF NOT EXISTS observation_sets_uuid_idx ON observation_sets ((metadata->>'_uuid'))",
+}
+
+// pathTimeIndexStatements create the secondary indexes added by schema
+// version 19, to select observations by path and time for path timelines.
+var pathTimeIndexStatements = []string{
+	"CREATE INDEX IF NOT EXISTS observations_path_time_idx ON observations (path_id, time_start)",
+}
+
+// setSlugIndex makes the slugs of observation sets unique, except among the
+// versions of a set, which share its slug: only the first version of each set
+// does not supersede another.
+const setSlugIndex = "observation_sets_slug_idx"
+
+// setSlugIndexStatements create the secondary indexes added by schema
+// version 26, making set slugs unique.
+var setSlugIndexStatements = []string{
+	"CREATE UNIQUE INDEX IF NOT EXISTS " + setSlugIndex + " ON observation_sets ((metadata->>'_slug')) " +
+		"WHERE metadata->>'_slug' IS NOT NULL AND metadata->>'_supersedes' IS NULL",
+}
+
+// checkUniqueSlugs returns an error naming the slugs shared by sets which
+// are not versions of each other. Slugs were only checked by the API before
+// schema version 26, so concurrent requests could give two sets the same
+// slug; these must be given new slugs before the index can be created.
+func checkUniqueSlugs(db orm.DB) error {
+	var dups []string
+	if _, err := db.QueryOne(pg.Scan(pg.Array(&dups)),
+		`SELECT array_agg(slug) FROM (SELECT metadata->>'_slug' AS slug FROM observation_sets
+		WHERE metadata->>'_slug' IS NOT NULL AND metadata->>'_supersedes' IS NULL
+		GROUP BY 1 HAVING count(*) > 1) AS dup`); err != nil {
+		return PTOWrapError(err)
+	}
+	if len(dups) > 0 {
+		return PTOErrorf("observation sets share the slugs %s; give all but one set with each a new slug first", strings.Join(dups, ", "))
+	}
+	return nil
+}
+
+// indexStatements create the secondary indexes used by the PTO, as created
+// by the migrations adding them. These are safe to run against a database
+// that already has some or all of them.
+var indexStatements = [][]string{
+	baseIndexStatements,
+	setTimeIndexStatements,
+	setUUIDIndexStatements,
+	pathTimeIndexStatements,
+	setSlugIndexStatements,
+}
+
+// CreateIndexes ensures that the secondary indexes used by the PTO exist in
+// the given database. It is called by ptodb to add indexes to databases
+// created before they were, and to recreate them on a newly partitioned
+// observations table. Since paths must be unique,
+// databases containing duplicate paths must first be cleaned up with
+// DeduplicatePaths; sets sharing a slug are reported as an error.
+func CreateIndexes(db orm.DB) error {
+	if err := checkUniqueSlugs(db); err != nil {
+		return err
+	}
+
+	for _, stmts := range indexStatements {
+		if err := execIndexStatements(db, stmts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execIndexStatements runs the given index creation statements. Migrations
+// use this with their own statements rather than CreateIndexes, so that what
+// they do does not change as indexes are added.
+func execIndexStatements(db orm.DB, stmts []string) error {
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+	return nil
+}
+
+// DeduplicatePaths merges paths with the same string in the given database,
+// which could be added by previous versions of PathCache.CacheNewPaths,
+// pointing observations at the path with the lowest ID. It returns the number
+// of duplicate paths removed.
+func DeduplicatePaths(db *pg.DB) (int, error) {
+	var removed int
+
+	err := db.RunInTransaction(func(t *pg.Tx) error {
+		var err error
+		removed, err = deduplicatePaths(t)
+		return err
+	})
+
+	return removed, err
+}
+
+func deduplicatePaths(db orm.DB) (int, error) {
+	if _, err := db.Exec(`UPDATE observations SET path_id = dup.keep_id
+		FROM (SELECT id, min(id) OVER (PARTITION BY string) AS keep_id FROM paths) AS dup
+		WHERE observations.path_id = dup.id AND dup.id <> dup.keep_id`); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	res, err := db.Exec("DELETE FROM paths USING paths AS keep WHERE paths.string = keep.string AND paths.id > keep.id")
+	if err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	return res.RowsAffected(), nil
+}
+
+// DropTables removes the tables used by the ORM from the database. Use this for
+// testing only, please.
+func DropTables(db *pg.DB) error {
+	return db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := db.DropTable(&Observation{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&ObservationSetCondition{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&ObservationSetSource{}, &orm.DropTableOptions{IfExists: true}); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if _, err := db.Exec("DROP TABLE IF EXISTS observation_set_archives"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if _, err := db.Exec("DROP TABLE IF EXISTS query_usage"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&ObservationSet{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&Condition{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&Path{}, nil); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if err := db.DropTable(&RegisteredCondition{}, &orm.DropTableOptions{IfExists: true}); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + PartitioningTable); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if _, err := db.Exec("DROP TABLE IF EXISTS " + SchemaVersionTable); err != nil {
+			return PTOWrapError(err)
+		}
+
+		return nil
+	})
+}
+
+type LoggingQueryHook struct{}
+
+func (lqh *LoggingQueryHook) BeforeQuery(qe *pg.QueryEvent) {
+	query, err := qe.FormattedQuery()
+	if err != nil {
+		panic(err)
+	}
+	log.Printf("%s", query)
+}
+
+func (lqh *LoggingQueryHook) AfterQuery(qe *pg.QueryEvent) {}
+
+func EnableQueryLogging(db *pg.DB) {
+	lqh := LoggingQueryHook{}
+	db.AddQueryHook(&lqh)
+}
+
+func WriteObservations(obsdat []Observation, out io.Writer) error {
+	for _, obs := range obsdat {
+		b, err := json.Marshal(&obs)
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		_, err = out.Write(b)
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		_, err = out.Write([]byte("\n"))
+		if err != nil {
+			return PTOWrapError(err)
+		}
+	}
+	return nil
+}
+
+// obsFileFirstPass scans a file, getting metadata (in the form of an observation set), a set of paths, and a set of conditions
+func obsFileFirstPass(r *os.File) (*ObservationSet, map[string]struct{}, map[string]struct{}, error) {
+	filename := r.Name()
+
+	// create an observation set to hold metadata
+	set := ObservationSet{}
+
+	// and maps to hold paths and conditions
+	pathSeen := make(map[string]struct{})
+	conditionSeen := make(map[string]struct{})
+
+	// now scan the file for metadata, paths, and conditions
+	var lineno = 0
+	in := bufio.NewScanner(r)
+	for in.Scan() {
+		lineno++
+		line := strings.TrimSpace(in.Text())
+		switch line[0] {
+		case '{':
+			if err := set.UnmarshalJSON([]byte(line)); err != nil {
+				return nil, nil, nil, PTOErrorf("error in metadata at %s line %d: %s", filename, lineno, err.Error())
+			}
+		case '[':
+			obs, _, _, err := splitObservationJSON([]byte(line))
+			if err != nil {
+				return nil, nil, nil, PTOErrorf("error looking for path at %s line %d: %s", filename, lineno, err.Error())
+			}
+			pathSeen[obs[3]] = struct{}{}
+			conditionSeen[obs[4]] = struct{}{}
+		}
+	}
+
+	// done
+	return &set, pathSeen, conditionSeen, nil
+}
+
+// writeObsToCSV writes an unparsed observation to a CSV writer, for COPY FROM
+// loading of observations into a PostgreSQL table.
+func writeObsToCSV(
+	set *ObservationSet,
+	cidCache ConditionCache,
+	pidCache PathCache,
+	line string,
+	out *csv.Writer) error {
+
+	fields, value, ref, err := splitObservationJSON([]byte(line))
+	if err != nil {
+		return err
+	}
+
+	if err := set.checkSourceRef(ref); err != nil {
+		return err
+	}
+
+	// add value as JSON, or NULL if missing, and source reference
+	jslice := append(fields, csvValue(value))
+	jslice = append(jslice, csvSourceRef(ref)...)
+
+	// replace set ID
+	jslice[0] = fmt.Sprintf("%d", set.ID)
+
+	// replace path string with path ID
+	jslice[3] = fmt.Sprintf("%d", pidCache[jslice[3]])
+
+	// replace condition name with condition ID
+	jslice[4] = fmt.Sprintf("%d", cidCache[jslice[4]])
+
+	// write as CSV to output writer
+	return out.Write(jslice)
+}
+
+func loadObservations(
+	cidCache ConditionCache,
+	pidCache PathCache,
+	t *pg.Tx,
+	set *ObservationSet,
+	r *os.File) error {
+
+	lineno := 0
+
+	dbpipe, obspipe, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer dbpipe.Close()
+
+	converr := make(chan error, 1)
+
+	// start a reader goroutine to convert observations to CSV
+	// and write them to a pipe we'll COPY FROM
+	go func() {
+		in := bufio.NewScanner(r)
+		out := csv.NewWriter(obspipe)
+		defer obspipe.Close()
+
+		for in.Scan() {
+			lineno++
+			line := strings.TrimSpace(in.Text())
+			if line[0] == '[' {
+				if err := writeObsToCSV(set, cidCache, pidCache, line, out); err != nil {
+					converr <- PTOWrapError(err)
+				}
+			}
+		}
+		out.Flush()
+		converr <- nil
+	}()
+
+	// now copy from the CSV pipe
+	if _, err := t.CopyFrom(dbpipe, "COPY observations (set_id, time_start, time_end, path_id, condition_id, value, source_index, source_offset, source_record) FROM STDIN WITH CSV"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// wait on the converter goroutine
+	if err := <-converr; err != nil {
+		return err
+	}
+
+	if err := set.updateTimeInterval(t); err != nil {
+		return err
+	}
+
+	if err := set.refreshRollup(t); err != nil {
+		return err
+	}
+
+	return set.invalidateStats(t)
+}
+
+// CopySetFromObsFile loads an observation file from a local path into the
+// database. It uses given caches to cache condition and path IDs, and creates the
+// ObservationSet from the metadata found in the file. This is used by ptoload
+// to load observation sets created by local analysis into the database.
+func CopySetFromObsFile(
+	filename string,
+	db *pg.DB,
+	cidCache ConditionCache,
+	pidCache PathCache) (*ObservationSet, error) {
+
+	set, _, err := copySetFromObsFile(filename, db, cidCache, pidCache, ImportRefuse)
+	return set, err
+}
+
+// ImportSetFromObsFile loads an observation file from a local path into the
+// database as CopySetFromObsFile does, but resolves conflicts with an
+// existing set with the same UUID according to the given policy, as described
+// for ResolveImport. This is used by ptoload to mirror observation sets
+// exported from another observatory.
+func ImportSetFromObsFile(
+	filename string,
+	db *pg.DB,
+	cidCache ConditionCache,
+	pidCache PathCache,
+	policy ImportPolicy) (*ImportResult, error) {
+
+	set, uuid, err := copySetFromObsFile(filename, db, cidCache, pidCache, policy)
+	if err != nil {
+		return nil, err
+	}
+
+	if uuid == "" {
+		return &ImportResult{Action: ImportCreated, Set: set}, nil
+	}
+
+	return ResolveImport(db, set, uuid, policy)
+}
+
+// copySetFromObsFile implements CopySetFromObsFile and ImportSetFromObsFile,
+// returning the UUID removed from the set by StageImport, if any.
+func copySetFromObsFile(
+	filename string,
+	db *pg.DB,
+	cidCache ConditionCache,
+	pidCache PathCache,
+	policy ImportPolicy) (*ObservationSet, string, error) {
+
+	obsfile, err := os.Open(filename)
+	if err != nil {
+		log.Printf("can't open \"%s\": %v", filename, err)
+		return nil, "", err
+	}
+	defer obsfile.Close()
+
+	// first pass: extract paths, conditions, and metadata
+	set, pathSet, conditionSet, err := obsFileFirstPass(obsfile)
+	if err != nil {
+		log.Printf("error on first pass of \"%s\": %v", filename, err)
+		return nil, "", err
+	}
+
+	// load a set which exists locally as a new one, to compare it later
+	uuid, err := set.StageImport(db, policy)
+	if err != nil {
+		log.Printf("error on staging import of \"%s\": %v", filename, err)
+		return nil, "", err
+	}
+
+	// ensure every condition is declared
+	if err := set.verifyConditionSet(conditionSet); err != nil {
+		log.Printf("error on verifying conditions of \"%s\": %v", filename, err)
+		return nil, "", err
+	}
 
-		if err := db.DropTable(&ObservationSet{}, nil); err != nil {
-			return PTOWrapError(err)
+	// now rewind for a second pass
+	if _, err := obsfile.Seek(0, 0); err != nil {
+		log.Printf("error on rewinding \"%s\": %v", filename, err)
+		return nil, "", PTOWrapError(err)
+	}
+
+	// conditions added in the transaction are only cached once it commits
+	txCidCache := cidCache.clone()
+
+	// spin up a transaction
+	err = db.RunInTransaction(func(t *pg.Tx) error {
+
+		// make sure conditions are inserted
+		if err := txCidCache.FillConditionIDsInSet(t, set); err != nil {
+			log.Printf("error on filling condition IDs of \"%s\": %v", filename, err)
+			return err
 		}
 
-		if err := db.DropTable(&Condition{}, nil); err != nil {
-			return PTOWrapError(err)
+		// make sure paths are inserted
+		if err := pidCache.CacheNewPaths(t, pathSet); err != nil {
+			log.Printf("error on inserting paths of \"%s\": %v", filename, err)
+			return err
 		}
 
-		if err := db.DropTable(&Path{}, nil); err != nil {
-			return PTOWrapError(err)
+		// insert the set
+		if err := set.Insert(t, true); err != nil {
+			log.Printf("error on inserting set of \"%s\": %v", filename, err)
+			return err
 		}
 
-		return nil
+		// now insert the observations
+		if err := loadObservations(txCidCache, pidCache, t, set, obsfile); err != nil {
+			log.Printf("error on loading observations of \"%s\": %v", filename, err)
+			return err
+		}
+
+		// Force the observation set count and time interval to update
+		if _, err := set.CountObservations(t); err != nil {
+			log.Printf("error on counting observations of \"%s\": %v", filename, err)
+			return err
+		}
+
+		_, _, err := set.TimeInterval(t)
+		if err != nil {
+			log.Printf("error on setting time interval of \"%s\": %v", filename, err)
+		}
+		return err
 	})
+
+	if err != nil {
+		log.Printf("error on running transaction for \"%s\": %v", filename, err)
+		return nil, "", err
+	}
+	cidCache.merge(txCidCache)
+
+	return set, uuid, nil
 }
 
-type LoggingQueryHook struct{}
+// CopyDataFromObsFile loads an observation file from a local path into the
+// database. It requires an ObservationSet to already exist in the database.
+// It uses given caches to cache condition and path IDs, and checks conditions
+// against those declared. This is used by ptoload to load observation sets
+// created by local analysis into the database.
+func CopyDataFromObsFile(
+	filename string,
+	db *pg.DB, set *ObservationSet,
+	cidCache ConditionCache,
+	pidCache PathCache) error {
 
-func (lqh *LoggingQueryHook) BeforeQuery(qe *pg.QueryEvent) {
-	query, err := qe.FormattedQuery()
+	obsfile, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return PTOWrapError(err)
 	}
-	log.Printf("%s", query)
-}
+	defer obsfile.Close()
 
-func (lqh *LoggingQueryHook) AfterQuery(qe *pg.QueryEvent) {}
+	// first pass: extract paths and conditions
+	_, pathSet, conditionSet, err := obsFileFirstPass(obsfile)
+	if err != nil {
+		return err
+	}
 
-func EnableQueryLogging(db *pg.DB) {
-	lqh := LoggingQueryHook{}
-	db.AddQueryHook(&lqh)
-}
+	// ensure every condition is declared
+	if err := set.verifyConditionSet(conditionSet); err != nil {
+		return err
+	}
 
-func WriteObservations(obsdat []Observation, out io.Writer) error {
-	for _, obs := range obsdat {
-		b, err := json.Marshal(&obs)
-		if err != nil {
-			return PTOWrapError(err)
-		}
-		_, err = out.Write(b)
-		if err != nil {
-			return PTOWrapError(err)
-		}
-		_, err = out.Write([]byte("\n"))
-		if err != nil {
-			return PTOWrapError(err)
-		}
+	// now rewind for a second pass
+	if _, err := obsfile.Seek(0, 0); err != nil {
+		return PTOWrapError(err)
 	}
-	return nil
+
+	// spin up a transaction
+	return db.RunInTransaction(func(t *pg.Tx) error {
+
+		// make sure paths are inserted
+		if err := pidCache.CacheNewPaths(t, pathSet); err != nil {
+			return err
+		}
+
+		// now insert the observations
+		return loadObservations(cidCache, pidCache, t, set, obsfile)
+	})
 }
 
-// obsFileFirstPass scans a file, getting metadata (in the form of an observation set), a set of paths, and a set of conditions
-func obsFileFirstPass(r *os.File) (*ObservationSet, map[string]struct{}, map[string]struct{}, error) {
-	filename := r.Name()
+// ObservationReader parses observations from an observation file one at a
+// time, so that arbitrarily large observation files can be processed in
+// bounded memory.
+type ObservationReader struct {
+	scanner *bufio.Scanner
+	lineno  int
+	set     *ObservationSet
+
+	// time range to check observations against; see CheckTimes
+	timeCheck    TimeCheck
+	checkStart   time.Time
+	checkEnd     time.Time
+	timeOutliers int
+
+	// how observations are loaded into the database; see SetLoadOptions
+	loadOptions *ObsDatabaseOptions
+
+	// where observation lines are copied as they are read; see RecordTo
+	record io.Writer
+}
 
-	// create an observation set to hold metadata
-	set := ObservationSet{}
+// NewObservationReader creates a new ObservationReader reading an observation
+// file from the given stream.
+func NewObservationReader(in io.Reader) *ObservationReader {
+	return &ObservationReader{scanner: bufio.NewScanner(in)}
+}
 
-	// and maps to hold paths and conditions
-	pathSeen := make(map[string]struct{})
-	conditionSeen := make(map[string]struct{})
+// Next returns the next observation in the stream, or io.EOF if there are no
+// more observations. Metadata lines are parsed as they are encountered, and
+// the most recent metadata is available through Set.
+func (obsr *ObservationReader) Next() (*Observation, error) {
+	for obsr.scanner.Scan() {
+		obsr.lineno++
+		line := bytes.TrimSpace(obsr.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
 
-	// now scan the file for metadata, paths, and conditions
-	var lineno = 0
-	in := bufio.NewScanner(r)
-	for in.Scan() {
-		lineno++
-		line := strings.TrimSpace(in.Text())
 		switch line[0] {
 		case '{':
-			if err := set.UnmarshalJSON([]byte(line)); err != nil {
-				return nil, nil, nil, PTOErrorf("error in metadata at %s line %d: %s", filename, lineno, err.Error())
+			obsr.set = new(ObservationSet)
+			if err := obsr.set.UnmarshalJSON(line); err != nil {
+				return nil, PTOErrorf("error in metadata at line %d: %s", obsr.lineno, err.Error()).StatusIs(http.StatusBadRequest)
 			}
 		case '[':
-			var obs []string
-			if err := json.Unmarshal([]byte(line), &obs); err != nil {
-				return nil, nil, nil, PTOErrorf("error looking for path at %s line %d: %s", filename, lineno, err.Error())
+			obs := new(Observation)
+			if err := obs.UnmarshalJSON(line); err != nil {
+				return nil, PTOErrorf("error in observation at line %d: %s", obsr.lineno, err.Error()).StatusIs(http.StatusBadRequest)
 			}
-			if len(obs) < 4 {
-				return nil, nil, nil, PTOErrorf("short observation looking for path at %s line %d", filename, lineno)
+			if err := obsr.checkTime(obs); err != nil {
+				return nil, err
 			}
-			pathSeen[obs[3]] = struct{}{}
-			conditionSeen[obs[4]] = struct{}{}
+			if obsr.record != nil {
+				// line is in the scanner's buffer, so don't append to it
+				if _, err := obsr.record.Write(line); err != nil {
+					return nil, PTOWrapError(err)
+				}
+				if _, err := obsr.record.Write([]byte{'\n'}); err != nil {
+					return nil, PTOWrapError(err)
+				}
+			}
+			return obs, nil
+		default:
+			return nil, PTOErrorf("unexpected content at line %d", obsr.lineno).StatusIs(http.StatusBadRequest)
 		}
 	}
 
-	// done
-	return &set, pathSeen, conditionSeen, nil
+	if err := obsr.scanner.Err(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return nil, io.EOF
 }
 
-// writeObsToCSV writes an unparsed observation to a CSV writer, for COPY FROM
-// loading of observations into a PostgreSQL table.
-func writeObsToCSV(
-	set *ObservationSet,
-	cidCache ConditionCache,
-	pidCache PathCache,
-	line string,
-	out *csv.Writer) error {
+// ReadMetadata reads the metadata line at the start of an observation set
+// file, as written by WriteObservationFile, and returns it. It returns an
+// error with status 400 if the next line in the stream is not metadata.
+func (obsr *ObservationReader) ReadMetadata() (*ObservationSet, error) {
+	for obsr.scanner.Scan() {
+		obsr.lineno++
+		line := bytes.TrimSpace(obsr.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
 
-	var jslice []string
+		if line[0] != '{' {
+			return nil, PTOErrorf("expected metadata at line %d", obsr.lineno).StatusIs(http.StatusBadRequest)
+		}
 
-	if err := json.Unmarshal([]byte(line), &jslice); err != nil {
-		return err
+		obsr.set = new(ObservationSet)
+		if err := obsr.set.UnmarshalJSON(line); err != nil {
+			return nil, PTOErrorf("error in metadata at line %d: %s", obsr.lineno, err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		return obsr.set, nil
 	}
 
-	// add zero value if missing
-	if len(jslice) == 5 {
-		jslice = append(jslice, "0")
+	if err := obsr.scanner.Err(); err != nil {
+		return nil, PTOWrapError(err)
 	}
 
-	// replace set ID
-	jslice[0] = fmt.Sprintf("%d", set.ID)
+	return nil, PTOErrorf("missing metadata in observation set file").StatusIs(http.StatusBadRequest)
+}
 
-	// replace path string with path ID
-	jslice[3] = fmt.Sprintf("%d", pidCache[jslice[3]])
+// SetLoadOptions makes CopyDataFromReader load the observations read by this
+// ObservationReader in batches of the given options' BatchSize, with their
+// SynchronousCommit setting. Without load options, observations are loaded
+// in batches of ObservationBatchSize with the database's setting.
+func (obsr *ObservationReader) SetLoadOptions(opts *ObsDatabaseOptions) {
+	obsr.loadOptions = opts
+}
 
-	// replace condition name with condition ID
-	jslice[4] = fmt.Sprintf("%d", cidCache[jslice[4]])
+// RecordTo makes this ObservationReader copy each observation line it returns
+// from Next to the given writer, so that exactly the observations loaded
+// from the stream can be kept elsewhere. Next fails if the copy cannot be
+// written.
+func (obsr *ObservationReader) RecordTo(w io.Writer) {
+	obsr.record = w
+}
 
-	// write as CSV to output writer
-	return out.Write(jslice)
+// Set returns the metadata most recently read from the stream, or nil if no
+// metadata has been read.
+func (obsr *ObservationReader) Set() *ObservationSet {
+	return obsr.set
 }
 
-func loadObservations(
+// Line returns the number of the line most recently read from the stream.
+func (obsr *ObservationReader) Line() int {
+	return obsr.lineno
+}
+
+// ReadObservationFile reads an observation set file which fully describes a
+// set: its first line is the set's metadata, and all following lines are its
+// observations. Unlike an ObservationReader, it refuses files in which
+// metadata is missing or appears after the first line. All observations are
+// read into memory, so use an ObservationReader for large files.
+func ReadObservationFile(in io.Reader) (*ObservationSet, []Observation, error) {
+	obsr := NewObservationReader(in)
+
+	set, err := obsr.ReadMetadata()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	obsdat := make([]Observation, 0)
+	for {
+		obs, err := obsr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		if obsr.Set() != set {
+			return nil, nil, PTOErrorf("unexpected metadata before line %d", obsr.Line()).StatusIs(http.StatusBadRequest)
+		}
+
+		obsdat = append(obsdat, *obs)
+	}
+
+	if obsr.Set() != set {
+		return nil, nil, PTOErrorf("unexpected metadata at end of file").StatusIs(http.StatusBadRequest)
+	}
+
+	return set, obsdat, nil
+}
+
+// WriteObservationFile writes an observation set file which fully describes a
+// set to the given stream: a line with the set's metadata, followed by a line
+// for each of the given observations. The result can be read with
+// ReadObservationFile.
+func WriteObservationFile(set *ObservationSet, obsdat []Observation, out io.Writer) error {
+	if err := writeMetadataLine(set, out); err != nil {
+		return err
+	}
+	return WriteObservations(obsdat, out)
+}
+
+// writeMetadataLine writes a set's metadata as a line in an observation set
+// file.
+func writeMetadataLine(set *ObservationSet, out io.Writer) error {
+	b, err := set.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(append(b, '\n')); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// ObservationBatchSize is the number of observations read into memory at once
+// by CopyDataFromStream, unless load options set another batch size.
+const ObservationBatchSize = 10000
+
+// streamObservationBatch streams a batch of observations in this set into
+// the given table, which has the columns of the observations table, with
+// COPY. The batch's conditions and paths must already be in the given caches.
+func (set *ObservationSet) streamObservationBatch(
+	t *pg.Tx,
+	table string,
 	cidCache ConditionCache,
 	pidCache PathCache,
-	t *pg.Tx,
-	set *ObservationSet,
-	r *os.File) error {
-
-	lineno := 0
+	batch []*Observation) error {
 
 	dbpipe, obspipe, err := os.Pipe()
 	if err != nil {
-		return err
+		return PTOWrapError(err)
 	}
 	defer dbpipe.Close()
 
 	converr := make(chan error, 1)
 
-	// start a reader goroutine to convert observations to CSV
-	// and write them to a pipe we'll COPY FROM
-	go func() {
-		in := bufio.NewScanner(r)
-		out := csv.NewWriter(obspipe)
-		defer obspipe.Close()
+	go func() {
+		out := csv.NewWriter(obspipe)
+		defer obspipe.Close()
+
+		for _, obs := range batch {
+			if err := out.Write(append([]string{
+				fmt.Sprintf("%d", set.ID),
+				obs.TimeStart.UTC().Format(time.RFC3339),
+				obs.TimeEnd.UTC().Format(time.RFC3339),
+				fmt.Sprintf("%d", pidCache[obs.Path.String]),
+				fmt.Sprintf("%d", cidCache[obs.Condition.Name]),
+				csvValue(obs.Value),
+			}, csvSourceRef(obs.SourceRef())...)); err != nil {
+				converr <- PTOWrapError(err)
+				return
+			}
+		}
+		out.Flush()
+		converr <- nil
+	}()
+
+	if _, err := t.CopyFrom(dbpipe, "COPY "+table+" (set_id, time_start, time_end, path_id, condition_id, value, source_index, source_offset, source_record) FROM STDIN WITH CSV"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return <-converr
+}
+
+// copyObservationBatch inserts a batch of observations into this set, adding
+// any paths not yet in the path cache. Conditions must already be in the
+// condition cache. If skipDuplicates is set, observations identical to one
+// already in the set, or earlier in the batch, are skipped; it returns the
+// number of observations skipped.
+func (set *ObservationSet) copyObservationBatch(
+	t *pg.Tx,
+	cidCache ConditionCache,
+	pidCache PathCache,
+	batch []*Observation,
+	skipDuplicates bool) (int, error) {
+
+	// collect new paths and make sure they're inserted, and find the batch's
+	// time interval
+	pathSet := make(map[string]struct{})
+	var start, end *time.Time
+	for _, obs := range batch {
+		pathSet[obs.Path.String] = struct{}{}
+		if start == nil || obs.TimeStart.Before(*start) {
+			start = obs.TimeStart
+		}
+		if end == nil || obs.TimeEnd.After(*end) {
+			end = obs.TimeEnd
+		}
+	}
+
+	if err := pidCache.CacheNewPaths(t, pathSet); err != nil {
+		return 0, err
+	}
+
+	// when skipping duplicates, stream the batch into a temporary table
+	// first, so it can be compared with the observations already in the set
+	table := "observations"
+	if skipDuplicates {
+		table = "incoming_observations"
+		if _, err := t.Exec(`CREATE TEMPORARY TABLE IF NOT EXISTS incoming_observations
+			(LIKE observations INCLUDING DEFAULTS) ON COMMIT DROP`); err != nil {
+			return 0, PTOWrapError(err)
+		}
+		if _, err := t.Exec("TRUNCATE incoming_observations"); err != nil {
+			return 0, PTOWrapError(err)
+		}
+	}
+
+	// now stream the batch into the database
+	if err := set.streamObservationBatch(t, table, cidCache, pidCache, batch); err != nil {
+		return 0, err
+	}
+
+	skipped := 0
+	if skipDuplicates {
+		// observations are identical if they differ at most in their source
+		// references, as when an analyzer is rerun over the same raw data
+		res, err := t.Exec(`
+			INSERT INTO observations (set_id, time_start, time_end, path_id, condition_id, value,
+				source_index, source_offset, source_record)
+			SELECT DISTINCT ON (time_start, time_end, path_id, condition_id, value)
+				set_id, time_start, time_end, path_id, condition_id, value,
+				source_index, source_offset, source_record
+			FROM incoming_observations i
+			WHERE NOT EXISTS (SELECT 1 FROM observations o
+				WHERE o.set_id = i.set_id
+				AND o.time_start = i.time_start AND o.time_end = i.time_end
+				AND o.path_id = i.path_id AND o.condition_id = i.condition_id
+				AND o.value IS NOT DISTINCT FROM i.value)
+			ORDER BY time_start, time_end, path_id, condition_id, value, id`)
+		if err != nil {
+			return 0, PTOWrapError(err)
+		}
+		skipped = len(batch) - res.RowsAffected()
+	}
+
+	if len(batch) > 0 {
+		if err := set.extendTimeInterval(t, start, end); err != nil {
+			return 0, err
+		}
+	}
+
+	return skipped, set.invalidateStats(t)
+}
+
+// CopyDataFromStream loads observations in observation file format from a
+// stream into this observation set, which must already exist in the database.
+// Unlike CopyDataFromObsFile, it reads the stream only once, in batches of
+// ObservationBatchSize observations, so it needs neither a local copy of the
+// stream nor memory proportional to its size. Observations are checked
+// against the conditions declared in the set, and are inserted in a single
+// transaction: if any observation fails to parse or verify, none are
+// inserted. Set IDs and metadata in the stream are ignored.
+func (set *ObservationSet) CopyDataFromStream(
+	db *pg.DB,
+	in io.Reader,
+	cidCache ConditionCache,
+	pidCache PathCache) error {
+	return set.CopyDataFromReader(db, NewObservationReader(in), cidCache, pidCache)
+}
+
+// CopyDataFromReader loads the remaining observations from an
+// ObservationReader into this observation set, as CopyDataFromStream. This
+// allows the metadata at the start of an observation set file to be read
+// with ReadMetadata before the observations are loaded.
+func (set *ObservationSet) CopyDataFromReader(
+	db *pg.DB,
+	obsr *ObservationReader,
+	cidCache ConditionCache,
+	pidCache PathCache) error {
+	_, err := set.copyDataFromReader(db, obsr, cidCache, pidCache, false)
+	return err
+}
+
+// CopyDataFromReaderSkippingDuplicates loads the remaining observations from
+// an ObservationReader into this observation set as CopyDataFromReader, but
+// skips observations identical to one already in the set or earlier in the
+// reader, ignoring source references. This allows the output of an analyzer
+// rerun to be loaded into the set holding the output of the earlier run
+// without doubling it. It returns the number of observations skipped.
+func (set *ObservationSet) CopyDataFromReaderSkippingDuplicates(
+	db *pg.DB,
+	obsr *ObservationReader,
+	cidCache ConditionCache,
+	pidCache PathCache) (int, error) {
+	return set.copyDataFromReader(db, obsr, cidCache, pidCache, true)
+}
 
-		for in.Scan() {
-			lineno++
-			line := strings.TrimSpace(in.Text())
-			if line[0] == '[' {
-				if err := writeObsToCSV(set, cidCache, pidCache, line, out); err != nil {
-					converr <- PTOWrapError(err)
-				}
-			}
-		}
-		out.Flush()
-		converr <- nil
-	}()
+func (set *ObservationSet) copyDataFromReader(
+	db *pg.DB,
+	obsr *ObservationReader,
+	cidCache ConditionCache,
+	pidCache PathCache,
+	skipDuplicates bool) (int, error) {
 
-	// now copy from the CSV pipe
-	if _, err := t.CopyFrom(dbpipe, "COPY observations (set_id, time_start, time_end, path_id, condition_id, value) FROM STDIN WITH CSV"); err != nil {
-		return PTOWrapError(err)
+	// no changes to sealed sets; checked again in the loading transaction,
+	// in case the set was sealed while loading
+	if err := set.checkUnsealed(db); err != nil {
+		return 0, err
 	}
 
-	// wait on the converter goroutine
-	return <-converr
+	return set.loadDataFromReader(db, obsr, cidCache, pidCache, skipDuplicates, func(t *pg.Tx) error {
+		return set.checkUnsealed(t)
+	})
 }
 
-// CopySetFromObsFile loads an observation file from a local path into the
-// database. It uses given caches to cache condition and path IDs, and creates the
-// ObservationSet from the metadata found in the file. This is used by ptoload
-// to load observation sets created by local analysis into the database.
-func CopySetFromObsFile(
-	filename string,
+// loadDataFromReader loads the remaining observations from an
+// ObservationReader into this observation set as copyDataFromReader, whether
+// or not the set is sealed. If finish is not nil, it is called in the loading
+// transaction after the last observation is inserted, and the transaction is
+// rolled back if it returns an error.
+func (set *ObservationSet) loadDataFromReader(
 	db *pg.DB,
+	obsr *ObservationReader,
 	cidCache ConditionCache,
-	pidCache PathCache) (*ObservationSet, error) {
+	pidCache PathCache,
+	skipDuplicates bool,
+	finish func(t *pg.Tx) error) (int, error) {
 
-	obsfile, err := os.Open(filename)
-	if err != nil {
-		log.Printf("can't open \"%s\": %v", filename, err)
-		return nil, err
+	// make sure the cache knows all the set's conditions
+	if err := cidCache.FillConditionIDsInSet(db, set); err != nil {
+		return 0, err
 	}
-	defer obsfile.Close()
 
-	// first pass: extract paths, conditions, and metadata
-	set, pathSet, conditionSet, err := obsFileFirstPass(obsfile)
-	if err != nil {
-		log.Printf("error on first pass of \"%s\": %v", filename, err)
-		return nil, err
+	conditionDeclared := make(map[string]struct{})
+	for _, c := range set.Conditions {
+		conditionDeclared[c.Name] = struct{}{}
 	}
 
-	// ensure every condition is declared
-	if err := set.verifyConditionSet(conditionSet); err != nil {
-		log.Printf("error on verifying conditions of \"%s\": %v", filename, err)
-		return nil, err
+	// values of registered conditions must have the registered type
+	registry, err := LoadConditionRegistry(db)
+	if err != nil {
+		return 0, err
 	}
 
-	// now rewind for a second pass
-	if _, err := obsfile.Seek(0, 0); err != nil {
-		log.Printf("error on rewinding \"%s\": %v", filename, err)
-		return nil, PTOWrapError(err)
+	// observations may name their condition by an alias
+	aliases, err := LoadConditionAliases(db)
+	if err != nil {
+		return 0, err
 	}
 
-	// spin up a transaction
-	err = db.RunInTransaction(func(t *pg.Tx) error {
+	batchSize := obsr.loadOptions.batchSize()
 
-		// make sure conditions are inserted
-		if err := cidCache.FillConditionIDsInSet(t, set); err != nil {
-			log.Printf("error on filling condition IDs of \"%s\": %v", filename, err)
-			return err
+	skipped := 0
+	err = db.RunInTransaction(func(t *pg.Tx) error {
+		if opts := obsr.loadOptions; opts != nil && opts.SynchronousCommit != "" {
+			if _, err := t.Exec("SET LOCAL synchronous_commit TO ?", opts.SynchronousCommit); err != nil {
+				return PTOWrapError(err)
+			}
 		}
 
-		// make sure paths are inserted
-		if err := pidCache.CacheNewPaths(t, pathSet); err != nil {
-			log.Printf("error on inserting paths of \"%s\": %v", filename, err)
-			return err
-		}
+		batch := make([]*Observation, 0, batchSize)
 
-		// insert the set
-		if err := set.Insert(t, true); err != nil {
-			log.Printf("error on inserting set of \"%s\": %v", filename, err)
-			return err
-		}
+		for {
+			obs, err := obsr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
 
-		// now insert the observations
-		if err := loadObservations(cidCache, pidCache, t, set, obsfile); err != nil {
-			log.Printf("error on loading observations of \"%s\": %v", filename, err)
-			return err
+			if aliased, ok := aliases[obs.Condition.Name]; ok {
+				obs.Condition = NewCondition(aliased)
+			}
+
+			if _, ok := conditionDeclared[obs.Condition.Name]; !ok {
+				return PTOErrorf("observation at line %d has condition %s not declared in set", obsr.Line(), obs.Condition.Name).StatusIs(http.StatusBadRequest)
+			}
+
+			if err := set.checkSourceRef(obs.SourceRef()); err != nil {
+				return PTOErrorf("observation at line %d: %s", obsr.Line(), err.Error()).StatusIs(http.StatusBadRequest)
+			}
+
+			if rc := registry[obs.Condition.Name]; rc != nil {
+				if err := rc.CheckValue(obs.Value); err != nil {
+					return PTOErrorf("observation at line %d: %s", obsr.Line(), err.Error()).StatusIs(http.StatusBadRequest)
+				}
+			}
+
+			batch = append(batch, obs)
+			if len(batch) == batchSize {
+				batchSkipped, err := set.copyObservationBatch(t, cidCache, pidCache, batch, skipDuplicates)
+				if err != nil {
+					return err
+				}
+				skipped += batchSkipped
+				batch = batch[:0]
+			}
 		}
 
-		// Force the observation set count and time interval to update
-		if _, err := set.CountObservations(t); err != nil {
-			log.Printf("error on counting observations of \"%s\": %v", filename, err)
-			return err
+		if len(batch) > 0 {
+			batchSkipped, err := set.copyObservationBatch(t, cidCache, pidCache, batch, skipDuplicates)
+			if err != nil {
+				return err
+			}
+			skipped += batchSkipped
 		}
 
-		_, _, err := set.TimeInterval(t)
-		if err != nil {
-			log.Printf("error on setting time interval of \"%s\": %v", filename, err)
+		if finish != nil {
+			if err := finish(t); err != nil {
+				return err
+			}
 		}
-		return err
-	})
 
+		return set.refreshRollup(t)
+	})
 	if err != nil {
-		log.Printf("error on running transaction for \"%s\": %v", filename, err)
-		return nil, err
+		return 0, err
 	}
 
-	return set, nil
+	return skipped, nil
 }
 
-// CopyDataFromObsFile loads an observation file from a local path into the
-// database. It requires an ObservationSet to already exist in the database.
-// It uses given caches to cache condition and path IDs, and checks conditions
-// against those declared. This is used by ptoload to load observation sets
-// created by local analysis into the database.
-func CopyDataFromObsFile(
-	filename string,
-	db *pg.DB, set *ObservationSet,
-	cidCache ConditionCache,
-	pidCache PathCache) error {
+// CopyDataToStream copies all the observations in this observation set in
+// observation file format to the given stream
+func (set *ObservationSet) CopyDataToStream(db orm.DB, out io.Writer) error {
+	enc := NewNDJSONEncoder(out, nil)
+	if err := set.CopyDataToEncoder(db, enc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
 
-	obsfile, err := os.Open(filename)
-	if err != nil {
-		return PTOWrapError(err)
+// CopyFileToStream copies this observation set to the given stream as an
+// observation set file which fully describes it: a line with its metadata,
+// followed by all its observations. Call LinkVia first to include links in
+// the metadata.
+func (set *ObservationSet) CopyFileToStream(db orm.DB, out io.Writer) error {
+	if err := writeMetadataLine(set, out); err != nil {
+		return err
 	}
-	defer obsfile.Close()
+	return set.CopyDataToStream(db, out)
+}
 
-	// first pass: extract paths and conditions
-	_, pathSet, conditionSet, err := obsFileFirstPass(obsfile)
+// CopyDataToEncoder copies all the observations in this observation set to
+// the given encoder. The caller must close the encoder. It only reads from
+// the database, so it may be given a read-only replica.
+func (set *ObservationSet) CopyDataToEncoder(db orm.DB, enc ObservationEncoder) error {
+
+	// COPY TO STDOUT doesn't seem to close the pipe, so we need to know when
+	// to stop. Count on the same connection rather than using or caching the
+	// set's count, which a lagging replica might not agree with yet.
+	obscount, err := db.Model(&Observation{}).Where("set_id = ?", set.ID).Count()
 	if err != nil {
-		return err
+		return PTOWrapError(err)
 	}
 
-	// ensure every condition is declared
-	if err := set.verifyConditionSet(conditionSet); err != nil {
+	_, err = copyObservationsToEncoder(db, enc, obscount, "WHERE set_id = ?", set.ID)
+	return err
+}
+
+// CopyDataPageToStream copies a page of at most limit observations in this
+// observation set in observation file format to the given stream, in order of
+// observation ID, starting after the observation with the given ID (0 for the
+// first page). Each page is streamed directly from the database, so sets of
+// any size can be downloaded in bounded memory on both ends.
+func (set *ObservationSet) CopyDataPageToStream(db orm.DB, out io.Writer, after int, limit int) error {
+	enc := NewNDJSONEncoder(out, nil)
+	if err := set.CopyDataPageToEncoder(db, enc, after, limit); err != nil {
 		return err
 	}
+	return enc.Close()
+}
 
-	// now rewind for a second pass
-	if _, err := obsfile.Seek(0, 0); err != nil {
+// CopyDataPageToEncoder copies a page of observations to the given encoder,
+// as CopyDataPageToStream. The caller must close the encoder.
+func (set *ObservationSet) CopyDataPageToEncoder(db orm.DB, enc ObservationEncoder, after int, limit int) error {
+
+	// COPY TO STDOUT doesn't close the pipe, so count the page first
+	var obscount int
+	if _, err := db.QueryOne(pg.Scan(&obscount),
+		"SELECT count(*) FROM (SELECT 1 FROM observations WHERE set_id = ? AND id > ? LIMIT ?) AS page",
+		set.ID, after, limit); err != nil {
 		return PTOWrapError(err)
 	}
 
-	// spin up a transaction
-	return db.RunInTransaction(func(t *pg.Tx) error {
+	if obscount == 0 {
+		return nil
+	}
 
-		// make sure paths are inserted
-		if err := pidCache.CacheNewPaths(t, pathSet); err != nil {
-			return err
-		}
+	_, err := copyObservationsToEncoder(db, enc, obscount,
+		"WHERE set_id = ? AND observations.id > ? ORDER BY observations.id LIMIT ?", set.ID, after, limit)
+	return err
+}
 
-		// now insert the observations
-		return loadObservations(cidCache, pidCache, t, set, obsfile)
-	})
+// NextDataPage returns the value of after to pass to CopyDataPageToStream to
+// retrieve the page following the one starting after the given observation
+// ID, and false if there is no following page.
+func (set *ObservationSet) NextDataPage(db orm.DB, after int, limit int) (int, bool, error) {
+	var nextIDs []int
+	if _, err := db.Query(&nextIDs,
+		"SELECT id FROM observations WHERE set_id = ? AND id > ? ORDER BY id OFFSET ? LIMIT 1",
+		set.ID, after, limit); err != nil {
+		return 0, false, PTOWrapError(err)
+	}
+
+	if len(nextIDs) == 0 {
+		return 0, false, nil
+	}
+
+	return nextIDs[0] - 1, true, nil
 }
 
-// CopyDataToStream copies all the observations in this observation set in
-// observation file format to the given stream
-func (set *ObservationSet) CopyDataToStream(db orm.DB, out io.Writer) error {
+// copyObservationsToEncoder copies obscount observations selected by a given
+// WHERE clause (and optional ordering) to the given encoder. It returns the
+// ID of the last observation copied.
+func copyObservationsToEncoder(db orm.DB, enc ObservationEncoder, obscount int, where string, params ...interface{}) (int, error) {
 
 	// create some pipes
 	obspipe, dbpipe, err := os.Pipe()
 	if err != nil {
-		return PTOWrapError(err)
+		return 0, PTOWrapError(err)
 	}
 	defer dbpipe.Close()
 
 	converr := make(chan error, 1)
+	var lastID int
 
 	// wrap a CSV reader around the read side
 	in := csv.NewReader(obspipe)
 
-	// COPY TO STDOUT doesn't seem to close the pipe, so we need to know when to stop.
-	obscount, err := set.CountObservations(db)
-	if err != nil {
-		return err
-	}
-
-	// set up goroutine to parse observations and dump them to the writer as JSON
+	// set up goroutine to parse observations and dump them to the encoder
 	go func() {
 		defer obspipe.Close()
 		var obs Observation
@@ -856,19 +2440,30 @@ func (set *ObservationSet) CopyDataToStream(db orm.DB, out io.Writer) error {
 				return
 			}
 
-			if err := obs.unmarshalStringSlice(cslice, PostgresTime); err != nil {
-				converr <- err
+			// first column is the observation ID, which isn't in the file format
+			if lastID, err = strconv.Atoi(cslice[0]); err != nil {
+				converr <- PTOWrapError(err)
 				return
 			}
 
-			b, err := obs.MarshalJSON()
+			var value json.RawMessage
+			if cslice[6] != "" {
+				value = json.RawMessage(cslice[6])
+			}
+
+			ref, err := sourceRefFromCSV(cslice[7:10])
 			if err != nil {
 				converr <- err
 				return
 			}
 
-			if _, err := fmt.Fprintf(out, "%s\n", b); err != nil {
-				converr <- PTOWrapError(err)
+			if err := obs.unmarshalStringSlice(cslice[1:6], value, ref, PostgresTime); err != nil {
+				converr <- err
+				return
+			}
+
+			if err := enc.Encode(&obs); err != nil {
+				converr <- err
 				return
 			}
 
@@ -883,12 +2478,13 @@ func (set *ObservationSet) CopyDataToStream(db orm.DB, out io.Writer) error {
 	}()
 
 	// now kick off a copy query
-	if _, err := db.CopyTo(dbpipe, "COPY (SELECT set_id, time_start, time_end, string, name, value from observations JOIN conditions ON conditions.id = observations.condition_id JOIN paths ON paths.id = observations.path_id WHERE set_id = ?) TO STDOUT WITH CSV", set.ID); err != nil {
-		return PTOWrapError(err)
+	if _, err := db.CopyTo(dbpipe, "COPY (SELECT observations.id, set_id, time_start, time_end, string, name, value, source_index, source_offset, source_record from observations JOIN conditions ON conditions.id = observations.condition_id JOIN paths ON paths.id = observations.path_id "+where+") TO STDOUT WITH CSV", params...); err != nil {
+		return 0, PTOWrapError(err)
 	}
 
 	// and wait for the copy goroutine to finish
-	return <-converr
+	err = <-converr
+	return lastID, err
 }
 
 // AllObservationSetIDs lists all observation set IDs in the database.
@@ -925,13 +2521,19 @@ func ObservationSetIDsWithMetadata(db orm.DB, k string) ([]int, error) {
 }
 
 // ObservationSetIDsWithMetadataValue lists all observation set IDs in the
-// database where a given metadata key has a given value.
+// database where a given metadata key has a given value, in ascending order.
 func ObservationSetIDsWithMetadataValue(db orm.DB, k string, v string) ([]int, error) {
 	var setIds []int
 
-	err := db.Model(&ObservationSet{}).
+	// use JSONB containment, so the lookup can use the metadata index
+	containment, err := json.Marshal(map[string]string{k: v})
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	err = db.Model(&ObservationSet{}).
 		ColumnExpr("array_agg(id)").
-		Where("metadata->? = ?", k, fmt.Sprintf("\"%s\"", v)).
+		Where("metadata @> ?::jsonb", string(containment)).
 		Select(pg.Array(&setIds))
 	if err == pg.ErrNoRows {
 		return make([]int, 0), nil
@@ -1015,3 +2617,104 @@ func ObservationSetIDsWithCondition(db orm.DB, cc ConditionCache, condition stri
 
 	return setIds, nil
 }
+
+// ObservationSetIDsSealed lists all observation set IDs in the database which
+// are sealed, or if sealed is false, which are not.
+func ObservationSetIDsSealed(db orm.DB, sealed bool) ([]int, error) {
+	var setIds []int
+
+	q := db.Model(&ObservationSet{}).ColumnExpr("array_agg(id)")
+	if sealed {
+		q = q.Where("sealed IS NOT NULL")
+	} else {
+		q = q.Where("sealed IS NULL")
+	}
+
+	err := q.Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
+
+// ObservationSetIDsDeletedBefore lists all observation set IDs in the
+// database marked deleted before the given time, or at any time if it is
+// nil.
+func ObservationSetIDsDeletedBefore(db orm.DB, before *time.Time) ([]int, error) {
+	var setIds []int
+
+	q := db.Model(&ObservationSet{}).ColumnExpr("array_agg(id)").Where("deleted IS NOT NULL")
+	if before != nil {
+		q = q.Where("deleted < ?", before)
+	}
+
+	err := q.Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
+
+// ObservationSetIDsOverlapping lists all observation set IDs in the database
+// containing observations in the interval between the given start and end
+// times, i.e. whose time interval overlaps it. Either time may be nil, leaving
+// that end of the interval open. Sets without observations never overlap.
+func ObservationSetIDsOverlapping(db orm.DB, start *time.Time, end *time.Time) ([]int, error) {
+	var setIds []int
+
+	q := db.Model(&ObservationSet{}).ColumnExpr("array_agg(id)").
+		Where("time_start IS NOT NULL AND time_end IS NOT NULL")
+	if start != nil {
+		q = q.Where("time_end >= ?", *start)
+	}
+	if end != nil {
+		q = q.Where("time_start <= ?", *end)
+	}
+
+	err := q.Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
+
+// ObservationSetIDsCreatedBetween lists all observation set IDs in the
+// database created at or after the given start time and before the given end
+// time. Either time may be nil, leaving that end of the interval open.
+func ObservationSetIDsCreatedBetween(db orm.DB, after *time.Time, before *time.Time) ([]int, error) {
+	var setIds []int
+
+	q := db.Model(&ObservationSet{}).ColumnExpr("array_agg(id)")
+	if after != nil {
+		q = q.Where("created >= ?", *after)
+	}
+	if before != nil {
+		q = q.Where("created < ?", *before)
+	}
+
+	err := q.Select(pg.Array(&setIds))
+	if err == pg.ErrNoRows {
+		return make([]int, 0), nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Slice(setIds, func(i, j int) bool { return setIds[i] < setIds[j] })
+
+	return setIds, nil
+}
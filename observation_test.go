@@ -1,8 +1,22 @@
 package pto3_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-pg/pg"
 	pto3 "github.com/mami-project/pto3-go"
 )
 
@@ -62,4 +76,1355 @@ func TestObsetQuery(t *testing.T) {
 		t.Fatalf("no sets found with none_more_black")
 	}
 
+	setIds, err = pto3.ObservationSetIDsWithCondition(TestDB, cidCache, "pto.*.none_more_*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(setIds) < 1 {
+		t.Fatalf("no sets found with pto.*.none_more_*")
+	}
+
+}
+
+func TestConditionsByName(t *testing.T) {
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatalf("condition cache load failed")
+	}
+
+	conditions, err := cidCache.ConditionsByName(TestDB, "pto.test.color.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conditions) != 8 {
+		t.Fatalf("expected 8 conditions for pto.test.color.*, got %d", len(conditions))
+	}
+
+	for i := 1; i < len(conditions); i++ {
+		if conditions[i-1].Name >= conditions[i].Name {
+			t.Fatalf("conditions for pto.test.color.* not sorted: %v", conditions)
+		}
+	}
+
+	conditions, err = cidCache.ConditionsByName(TestDB, "pto.test.color.red")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conditions) != 1 || conditions[0].ID == 0 {
+		t.Fatalf("unexpected result for pto.test.color.red: %v", conditions)
+	}
+
+	if _, err := cidCache.ConditionsByName(TestDB, "pto.test.no_such_thing.*"); err == nil {
+		t.Fatalf("wildcard matching no conditions should fail")
+	}
+
+	// parents resolve to all their descendants
+	conditions, err = cidCache.ConditionsByName(TestDB, "pto.test.color")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(conditions) != 8 {
+		t.Fatalf("expected 8 conditions for pto.test.color, got %d", len(conditions))
+	}
+
+	if _, err := cidCache.ConditionsByName(TestDB, "pto.test.col"); err == nil {
+		t.Fatalf("partial condition name component should not match")
+	}
+}
+
+func TestConditionTree(t *testing.T) {
+	tree := pto3.BuildConditionTree(map[string]int{
+		"pto.ecn.negotiated":     5,
+		"pto.ecn.not_negotiated": 3,
+		"pto.ecn":                1,
+		"pto.tfo.succeeded":      2,
+		"other":                  0,
+	})
+
+	if len(tree) != 2 || tree[0].Name != "other" || tree[1].Name != "pto" {
+		t.Fatalf("unexpected top level of condition tree: %v", tree)
+	}
+
+	pto := tree[1]
+	if pto.Condition || pto.Count != 11 || len(pto.Children) != 2 {
+		t.Fatalf("unexpected node for pto: %v", pto)
+	}
+
+	ecn := pto.Children[0]
+	if ecn.Name != "pto.ecn" || !ecn.Condition || ecn.Count != 9 || len(ecn.Children) != 2 {
+		t.Fatalf("unexpected node for pto.ecn: %v", ecn)
+	}
+
+	if ecn.Children[0].Name != "pto.ecn.negotiated" || ecn.Children[0].Count != 5 || len(ecn.Children[0].Children) != 0 {
+		t.Fatalf("unexpected node for pto.ecn.negotiated: %v", ecn.Children[0])
+	}
+
+	tfo := pto.Children[1]
+	if tfo.Name != "pto.tfo" || tfo.Condition || tfo.Count != 2 {
+		t.Fatalf("unexpected node for pto.tfo: %v", tfo)
+	}
+}
+
+func TestCacheNewConditions(t *testing.T) {
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatalf("condition cache load failed")
+	}
+
+	set := pto3.ObservationSet{
+		Conditions: []pto3.Condition{
+			*pto3.NewCondition("pto.test.color.red"),
+			*pto3.NewCondition("pto.test.bulk.one"),
+			*pto3.NewCondition("pto.test.bulk.two"),
+		},
+	}
+
+	if err := cidCache.FillConditionIDsInSet(TestDB, &set); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range set.Conditions {
+		if c.ID == 0 || cidCache[c.Name] != c.ID {
+			t.Fatalf("condition %s has bad ID %d (cached %d)", c.Name, c.ID, cidCache[c.Name])
+		}
+	}
+
+	// make sure the new conditions made it to the database
+	reloaded, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range set.Conditions {
+		if reloaded[c.Name] != c.ID {
+			t.Fatalf("condition %s has ID %d in database, expected %d", c.Name, reloaded[c.Name], c.ID)
+		}
+	}
+}
+
+func TestCacheNewConditionsConcurrently(t *testing.T) {
+	// writers adding conditions at the same time must get distinct IDs
+	added := make([]pto3.ConditionCache, 4)
+	errs := make(chan error, len(added))
+	for i := range added {
+		cidCache, err := pto3.LoadConditionCache(TestDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added[i] = cidCache
+
+		go func(i int) {
+			conditionSet := map[string]struct{}{
+				fmt.Sprintf("pto.test.concurrent.%d.one", i): {},
+				fmt.Sprintf("pto.test.concurrent.%d.two", i): {},
+			}
+			errs <- added[i].CacheNewConditions(TestDB, conditionSet)
+		}(i)
+	}
+	for range added {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[int]string)
+	for i, cidCache := range added {
+		for _, suffix := range []string{"one", "two"} {
+			name := fmt.Sprintf("pto.test.concurrent.%d.%s", i, suffix)
+			cid := cidCache[name]
+			if cid == 0 || reloaded[name] != cid {
+				t.Fatalf("condition %s has ID %d, %d in database", name, cid, reloaded[name])
+			}
+			if other, ok := seen[cid]; ok {
+				t.Fatalf("conditions %s and %s have the same ID %d", other, name, cid)
+			}
+			seen[cid] = name
+		}
+	}
+}
+
+func TestCacheNewPathsConcurrently(t *testing.T) {
+	// writers adding the same new paths at the same time must all succeed,
+	// and agree on their IDs
+	paths := []string{"10.77.0.1 * 10.77.0.2", "10.77.0.3 * 10.77.0.4"}
+
+	caches := make([]pto3.PathCache, 4)
+	errs := make(chan error, len(caches))
+	for i := range caches {
+		caches[i] = make(pto3.PathCache)
+
+		go func(i int) {
+			errs <- TestDB.RunInTransaction(func(tx *pg.Tx) error {
+				pathSet := make(map[string]struct{})
+				for _, ps := range paths {
+					pathSet[ps] = struct{}{}
+				}
+				return caches[i].CacheNewPaths(tx, pathSet)
+			})
+		}(i)
+	}
+	for range caches {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ps := range paths {
+		var count int
+		if _, err := TestDB.QueryOne(pg.Scan(&count), "SELECT count(*) FROM paths WHERE string = ?", ps); err != nil {
+			t.Fatal(err)
+		} else if count != 1 {
+			t.Fatalf("path %s stored %d times", ps, count)
+		}
+
+		for _, cache := range caches {
+			if cache[ps] == 0 || cache[ps] != caches[0][ps] {
+				t.Fatalf("path %s has ID %d, expected %d", ps, cache[ps], caches[0][ps])
+			}
+		}
+	}
+}
+
+func TestCopyDataFromStream(t *testing.T) {
+	// count observations in the query test data
+	in, err := os.Open("testdata/test_query.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+
+	obsr := pto3.NewObservationReader(in)
+	count := 0
+	for {
+		if _, err := obsr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+
+	if obsr.Set() == nil || len(obsr.Set().Conditions) != 8 {
+		t.Fatalf("missing or bad metadata in query test data: %v", obsr.Set())
+	}
+
+	// create a new set with the same metadata, and stream the data into it
+	set := obsr.Set()
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := in.Seek(0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := set.CopyDataFromStream(TestDB, in, cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+
+	obscount, err := set.CountObservations(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if obscount != count {
+		t.Fatalf("expected %d observations in streamed set, got %d", count, obscount)
+	}
+
+	// undeclared conditions should cause the whole upload to fail
+	bad := strings.NewReader(`["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.not_declared"]
+`)
+	if err := set.CopyDataFromStream(TestDB, bad, cidCache, make(pto3.PathCache)); err == nil {
+		t.Fatal("stream with undeclared condition inserted")
+	}
+
+	recount := pto3.ObservationSet{ID: set.ID}
+	if obscount, err = recount.CountObservations(TestDB); err != nil {
+		t.Fatal(err)
+	} else if obscount != count {
+		t.Fatalf("failed stream changed observation count from %d to %d", count, obscount)
+	}
+
+	// a failure after earlier batches were inserted still inserts nothing
+	obsr = pto3.NewObservationReader(strings.NewReader(`["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+["", "2017-12-05T14:31:27Z", "2017-12-05T14:31:27Z", "10.33.44.55 * 10.15.16.200", "pto.test.color.red"]
+["", "2017-12-05T14:31:28Z", "2017-12-05T14:31:28Z", "10.33.44.55 * 10.15.16.201", "pto.test.not_declared"]
+`))
+	obsr.SetLoadOptions(&pto3.ObsDatabaseOptions{BatchSize: 1, SynchronousCommit: "off"})
+	if err := set.CopyDataFromReader(TestDB, obsr, cidCache, make(pto3.PathCache)); err == nil {
+		t.Fatal("batched stream with undeclared condition inserted")
+	}
+
+	recount = pto3.ObservationSet{ID: set.ID}
+	if obscount, err = recount.CountObservations(TestDB); err != nil {
+		t.Fatal(err)
+	} else if obscount != count {
+		t.Fatalf("failed batched stream changed observation count from %d to %d", count, obscount)
+	}
+}
+
+func TestObservationFileRoundtrip(t *testing.T) {
+	in := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red","pto.test.color.blue"],"this_is_the_file_roundtrip_test_obset":"yes"}
+["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red", 42]
+["", "2017-12-05T14:31:27Z", "2017-12-05T14:31:27Z", "10.33.44.55 * 10.15.16.200", "pto.test.color.blue"]
+`
+
+	// read metadata, create a set from it, and load the rest of the file
+	obsr := pto3.NewObservationReader(strings.NewReader(in))
+	set, err := obsr.ReadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := set.CopyDataFromReader(TestDB, obsr, cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+
+	// write the set back out as a file, and make sure it describes the set
+	var out bytes.Buffer
+	if err := set.CopyFileToStream(TestDB, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	back, obsdat, err := pto3.ReadObservationFile(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Metadata["this_is_the_file_roundtrip_test_obset"] != "yes" || len(back.Conditions) != 2 {
+		t.Fatalf("metadata not preserved in observation set file: %v", back)
+	}
+	if len(obsdat) != 2 {
+		t.Fatalf("expected 2 observations in observation set file, got %d", len(obsdat))
+	}
+
+	// and that writing it again gives the same file
+	var again bytes.Buffer
+	if err := pto3.WriteObservationFile(back, obsdat, &again); err != nil {
+		t.Fatal(err)
+	}
+	if _, reobsdat, err := pto3.ReadObservationFile(&again); err != nil || len(reobsdat) != len(obsdat) {
+		t.Fatalf("rewritten observation set file changed: %d observations (%v)", len(reobsdat), err)
+	}
+
+	// metadata must be present, and only on the first line
+	for _, bad := range []string{
+		`["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]`,
+		`{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red"]}
+["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red"]}`,
+		``,
+	} {
+		if _, _, err := pto3.ReadObservationFile(strings.NewReader(bad)); err == nil {
+			t.Errorf("bad observation set file read without error: %s", bad)
+		}
+	}
+}
+
+func TestObservationSetStats(t *testing.T) {
+	in := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red","pto.test.color.blue"],"this_is_the_stats_test_obset":"yes"}
+["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:27Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+`
+
+	obsr := pto3.NewObservationReader(strings.NewReader(in))
+	set, err := obsr.ReadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := set.CopyDataFromReader(TestDB, obsr, cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := set.Stats(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 1 || stats.PathCount != 1 || stats.Conditions["pto.test.color.red"] != 1 {
+		t.Fatalf("unexpected statistics %+v", stats)
+	}
+
+	// loading more observations invalidates the cached statistics
+	more := `["", "2017-12-05T14:31:28Z", "2017-12-05T14:31:29Z", "10.33.44.56 * 10.15.16.199", "pto.test.color.blue"]`
+	if err := set.CopyDataFromStream(TestDB, strings.NewReader(more), cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = set.Stats(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 2 || stats.PathCount != 2 || stats.Conditions["pto.test.color.blue"] != 1 {
+		t.Fatalf("unexpected statistics after loading more observations %+v", stats)
+	}
+
+	// statistics computed while observations are being loaded are not
+	// cached once the load commits
+	if _, err := TestDB.Exec("UPDATE observation_sets SET stats = NULL WHERE id = ?", set.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := TestDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(`INSERT INTO observations (set_id, time_start, time_end, path_id, condition_id)
+		SELECT set_id, time_start + interval '1 hour', time_end + interval '1 hour', path_id, condition_id
+		FROM observations WHERE set_id = ? LIMIT 1`, set.ID); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("UPDATE observation_sets SET stats = NULL WHERE id = ?", set.ID); err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+
+	computed := make(chan error)
+	go func() {
+		_, err := set.Stats(TestDB)
+		computed <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-computed; err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = set.Stats(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 3 {
+		t.Fatalf("stale statistics cached while loading observations %+v", stats)
+	}
+}
+
+func TestDeleteInBatches(t *testing.T) {
+	in := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red"],"this_is_the_batch_delete_test_obset":"yes"}
+["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:27Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+["", "2017-12-05T14:31:28Z", "2017-12-05T14:31:29Z", "10.33.44.56 * 10.15.16.199", "pto.test.color.red"]
+["", "2017-12-05T14:31:30Z", "2017-12-05T14:31:31Z", "10.33.44.57 * 10.15.16.199", "pto.test.color.red"]
+["", "2017-12-05T14:31:32Z", "2017-12-05T14:31:33Z", "10.33.44.58 * 10.15.16.199", "pto.test.color.red"]
+["", "2017-12-05T14:31:34Z", "2017-12-05T14:31:35Z", "10.33.44.59 * 10.15.16.199", "pto.test.color.red"]
+`
+
+	obsr := pto3.NewObservationReader(strings.NewReader(in))
+	set, err := obsr.ReadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := set.CopyDataFromReader(TestDB, obsr, cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+
+	var progress []int
+	deletion, err := set.DeleteInBatches(TestDB, &pto3.ObsDatabaseOptions{DeleteBatchSize: 2}, func(deleted int, total int) {
+		if total != 5 {
+			t.Errorf("expected 5 observations in total, got %d", total)
+		}
+		progress = append(progress, deleted)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !deletion.Purged || deletion.DryRun || deletion.Observations != 5 || deletion.Conditions != 1 {
+		t.Fatalf("unexpected deletion %+v", deletion)
+	}
+	if fmt.Sprint(progress) != "[2 4 5]" {
+		t.Fatalf("expected progress [2 4 5], got %v", progress)
+	}
+
+	if _, err := set.DeletedAt(TestDB); err == nil {
+		t.Fatal("set still present after deletion")
+	}
+
+	var remaining int
+	if _, err := TestDB.QueryOne(pg.Scan(&remaining), "SELECT count(*) FROM observations WHERE set_id = ?", set.ID); err != nil {
+		t.Fatal(err)
+	} else if remaining != 0 {
+		t.Fatalf("%d observations left after deletion", remaining)
+	}
+}
+
+func TestObservationSetTimeInterval(t *testing.T) {
+	in := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red"],"this_is_the_time_interval_test_obset":"yes"}
+["", "2016-06-10T12:00:00Z", "2016-06-10T12:00:01Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+`
+
+	obsr := pto3.NewObservationReader(strings.NewReader(in))
+	set, err := obsr.ReadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := set.CopyDataFromReader(TestDB, obsr, cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+
+	// loading more observations extends the interval
+	more := `["", "2016-07-20T12:00:00Z", "2016-07-20T12:00:05Z", "10.33.44.56 * 10.15.16.199", "pto.test.color.red"]`
+	if err := set.CopyDataFromStream(TestDB, strings.NewReader(more), cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+
+	checkInterval := func(when string) {
+		var dbset pto3.ObservationSet
+		dbset.ID = set.ID
+		if err := dbset.SelectByID(TestDB); err != nil {
+			t.Fatal(err)
+		}
+		if dbset.TimeStart == nil || dbset.TimeStart.UTC().Format(time.RFC3339) != "2016-06-10T12:00:00Z" ||
+			dbset.TimeEnd == nil || dbset.TimeEnd.UTC().Format(time.RFC3339) != "2016-07-20T12:00:05Z" {
+			t.Fatalf("unexpected time interval %v to %v %s", dbset.TimeStart, dbset.TimeEnd, when)
+		}
+	}
+
+	checkInterval("after loading observations")
+
+	// updating metadata leaves the interval alone
+	set.Metadata["description"] = "An observation set with a time interval"
+	if err := set.Update(TestDB); err != nil {
+		t.Fatal(err)
+	}
+	checkInterval("after updating metadata")
+
+	// select sets by overlap with their interval
+	overlapping := map[string]bool{
+		"2016-06-01T00:00:00Z 2016-07-01T00:00:00Z": true,
+		"2016-07-20T12:00:05Z 2016-08-01T00:00:00Z": true,
+		"2016-05-01T00:00:00Z 2016-06-01T00:00:00Z": false,
+		"2016-08-01T00:00:00Z 2016-09-01T00:00:00Z": false,
+	}
+
+	for interval, expected := range overlapping {
+		bounds := strings.Fields(interval)
+		start, _ := time.Parse(time.RFC3339, bounds[0])
+		end, _ := time.Parse(time.RFC3339, bounds[1])
+
+		setIds, err := pto3.ObservationSetIDsOverlapping(TestDB, &start, &end)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, id := range setIds {
+			if id == set.ID {
+				found = true
+			}
+		}
+		if found != expected {
+			t.Errorf("set overlapping %s: expected %v, got %v", interval, expected, found)
+		}
+	}
+}
+
+func TestObservationSetUUID(t *testing.T) {
+	in := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red"],"this_is_the_uuid_test_obset":"yes"}`
+
+	readSet := func() *pto3.ObservationSet {
+		set, err := pto3.NewObservationReader(strings.NewReader(in)).ReadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return set
+	}
+
+	// a new set gets a UUID on insert
+	set := readSet()
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+	uuid := set.UUID()
+	if uuid == "" {
+		t.Fatal("no UUID assigned to new observation set")
+	}
+	if err := set.ValidateUUID(); err != nil {
+		t.Fatal(err)
+	}
+
+	if setid, err := pto3.ObservationSetIDForUUID(TestDB, uuid); err != nil {
+		t.Fatal(err)
+	} else if setid != set.ID {
+		t.Fatalf("UUID %s maps to set %x, expected %x", uuid, setid, set.ID)
+	}
+
+	// a second set with the same UUID is refused
+	dup := readSet()
+	dup.Metadata[pto3.UUIDMetadataKey] = uuid
+	if err := dup.Insert(TestDB, true); err == nil {
+		t.Fatalf("inserted second observation set with UUID %s", uuid)
+	}
+
+	// as is a malformed UUID
+	bad := readSet()
+	bad.Metadata[pto3.UUIDMetadataKey] = "not-a-uuid"
+	if err := bad.Insert(TestDB, true); err == nil {
+		t.Fatal("inserted observation set with malformed UUID")
+	}
+
+	// updating metadata without a UUID keeps the existing one
+	delete(set.Metadata, pto3.UUIDMetadataKey)
+	if err := set.Update(TestDB); err != nil {
+		t.Fatal(err)
+	}
+	var dbset pto3.ObservationSet
+	dbset.ID = set.ID
+	if err := dbset.SelectByID(TestDB); err != nil {
+		t.Fatal(err)
+	}
+	if dbset.UUID() != uuid {
+		t.Fatalf("UUID changed from %s to %s on update", uuid, dbset.UUID())
+	}
+
+	// but it can't be changed
+	other, err := pto3.NewSetUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.Metadata[pto3.UUIDMetadataKey] = other
+	if err := set.Update(TestDB); err == nil {
+		t.Fatalf("changed UUID of set %x from %s to %s", set.ID, uuid, other)
+	}
+
+	if _, err := pto3.ObservationSetIDForUUID(TestDB, other); err == nil {
+		t.Fatalf("found set for unused UUID %s", other)
+	}
+}
+
+func TestObservationSetDigests(t *testing.T) {
+	meta := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red", "pto.test.color.blue"],"this_is_the_digest_test_obset":"yes"}`
+	obs1 := `["", "2016-06-10T12:00:00Z", "2016-06-10T12:00:01Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red", {"b": 2, "a": 1}]`
+	obs2 := `["", "2016-06-10T12:00:02Z", "2016-06-10T12:00:03Z", "10.33.44.56 * 10.15.16.199", "pto.test.color.blue"]`
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadSet := func(in string) *pto3.ObservationSet {
+		obsr := pto3.NewObservationReader(strings.NewReader(in))
+		set, err := obsr.ReadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := set.Insert(TestDB, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := set.CopyDataFromReader(TestDB, obsr, cidCache, make(pto3.PathCache)); err != nil {
+			t.Fatal(err)
+		}
+		return set
+	}
+
+	digests := func(set *pto3.ObservationSet) (string, string) {
+		data, err := set.DataDigest(TestDB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata, err := set.MetadataDigest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data, metadata
+	}
+
+	// the same observations in a different order have the same digests
+	set1 := loadSet(meta + "\n" + obs1 + "\n" + obs2 + "\n")
+	set2 := loadSet(meta + "\n" + obs2 + "\n" + obs1 + "\n")
+
+	data1, metadata1 := digests(set1)
+	data2, metadata2 := digests(set2)
+	if data1 != data2 || metadata1 != metadata2 {
+		t.Fatalf("sets %x and %x with the same content have different digests", set1.ID, set2.ID)
+	}
+
+	// different observations don't
+	set3 := loadSet(meta + "\n" + obs1 + "\n")
+	if data3, _ := digests(set3); data3 == data1 {
+		t.Fatalf("sets %x and %x with different observations have the same data digest", set1.ID, set3.ID)
+	}
+
+	// and neither does different metadata
+	set1.Metadata["description"] = "A set with more metadata"
+	if _, metadata := digests(set1); metadata == metadata2 {
+		t.Fatalf("sets %x and %x with different metadata have the same metadata digest", set1.ID, set2.ID)
+	}
+}
+
+func TestPublishSnapshot(t *testing.T) {
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only public, sealed sets are published
+	setIDs := make(map[string]int)
+	for _, name := range []string{"public_sealed", "public_unsealed", "private_sealed"} {
+		public := strings.HasPrefix(name, "public")
+		in := fmt.Sprintf(`{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red"],"_public":"%v","snapshot_test_obset":"%s"}
+["", "2015-03-10T12:00:00Z", "2015-03-10T12:00:01Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+`, public, name)
+
+		obsr := pto3.NewObservationReader(strings.NewReader(in))
+		set, err := obsr.ReadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := set.Insert(TestDB, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := set.CopyDataFromReader(TestDB, obsr, cidCache, make(pto3.PathCache)); err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasSuffix(name, "_sealed") {
+			if err := set.Seal(TestDB); err != nil {
+				t.Fatal(err)
+			}
+		}
+		setIDs[name] = set.ID
+	}
+
+	dir, err := ioutil.TempDir("", "pto3-test-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start, _ := time.Parse(time.RFC3339, "2015-03-01T00:00:00Z")
+	end, _ := time.Parse(time.RFC3339, "2015-04-01T00:00:00Z")
+
+	catalog, err := pto3.PublishSnapshot(TestConfig, TestDB, dir, &start, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(catalog.Sets) != 1 || catalog.Sets[0].Link != pto3.LinkForSetID(TestConfig, setIDs["public_sealed"]) ||
+		catalog.Sets[0].Count != 1 {
+		t.Fatalf("expected only the public sealed set in snapshot, got %+v", catalog.Sets)
+	}
+
+	// the observation set file describes the set
+	f, err := os.Open(filepath.Join(dir, catalog.Sets[0].File))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	back, obsdat, err := pto3.ReadObservationFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Metadata["snapshot_test_obset"] != "public_sealed" || len(obsdat) != 1 {
+		t.Fatalf("unexpected snapshot set file %v with %d observations", back, len(obsdat))
+	}
+
+	// every other file is checksummed
+	sums, err := ioutil.ReadFile(filepath.Join(dir, pto3.SnapshotChecksumsFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(sums)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected checksums for 3 files, got %s", sums)
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		b, err := ioutil.ReadFile(filepath.Join(dir, fields[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest := sha256.Sum256(b); hex.EncodeToString(digest[:]) != fields[0] {
+			t.Errorf("bad checksum for %s", fields[1])
+		}
+	}
+
+	// snapshots are never mixed
+	if _, err := pto3.PublishSnapshot(TestConfig, TestDB, dir, &start, &end); err == nil {
+		t.Fatal("publishing into a non-empty snapshot directory should fail")
+	}
+}
+
+func TestObservationValues(t *testing.T) {
+	in := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_conditions":["pto.test.color.red"],"this_is_the_typed_value_test_obset":"yes"}
+["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red", 42.5]
+["", "2017-12-05T14:31:27Z", "2017-12-05T14:31:27Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red", "17"]
+["", "2017-12-05T14:31:28Z", "2017-12-05T14:31:28Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red", {"ttl":[64,128]}]
+["", "2017-12-05T14:31:29Z", "2017-12-05T14:31:29Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+["", "2017-12-05T14:31:30Z", "2017-12-05T14:31:30Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red", 0]
+`
+
+	// read metadata, then stream typed values into a new set
+	obsr := pto3.NewObservationReader(strings.NewReader(in))
+	if _, err := obsr.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	set := obsr.Set()
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := set.CopyDataFromStream(TestDB, strings.NewReader(in), cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := set.CopyDataToStream(TestDB, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	obsr = pto3.NewObservationReader(&out)
+	var back []*pto3.Observation
+	for {
+		o, err := obsr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		back = append(back, o)
+	}
+
+	if len(back) != 5 {
+		t.Fatalf("expected 5 observations back, got %d", len(back))
+	}
+	sort.Slice(back, func(i, j int) bool { return back[i].TimeStart.Before(*back[j].TimeStart) })
+
+	if f, err := back[0].FloatValue(); err != nil || f != 42.5 {
+		t.Errorf("expected numeric value 42.5, got %s (%v)", back[0].Value, err)
+	}
+	if string(back[1].Value) != `"17"` {
+		t.Errorf("expected string value \"17\", got %s", back[1].Value)
+	} else if i, err := back[1].IntValue(); err != nil || i != 17 {
+		t.Errorf("expected string value to parse as 17, got %d (%v)", i, err)
+	}
+	var ttl struct{ TTL []int }
+	if err := back[2].DecodeValue(&ttl); err != nil || len(ttl.TTL) != 2 || ttl.TTL[1] != 128 {
+		t.Errorf("expected object value, got %s (%v)", back[2].Value, err)
+	}
+	if back[3].HasValue() {
+		t.Errorf("expected no value, got %s", back[3].Value)
+	}
+
+	// zero is a value, not an absent one, and survives another round trip
+	if i, err := back[4].IntValue(); !back[4].HasValue() || err != nil || i != 0 {
+		t.Errorf("expected zero value, got %s (%v)", back[4].Value, err)
+	}
+	b, err := json.Marshal(back[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(b, []byte(`"pto.test.color.red",0]`)) {
+		t.Errorf("expected zero value in observation file line, got %s", b)
+	}
+}
+
+func TestRegisteredConditionValues(t *testing.T) {
+	checks := []struct {
+		valueType string
+		value     string
+		ok        bool
+	}{
+		{"", `{"anything":"goes"}`, true},
+		{"number", `42.5`, true},
+		{"number", `"17"`, true},
+		{"number", `"fast"`, false},
+		{"integer", `17`, true},
+		{"integer", `17.5`, false},
+		{"boolean", `true`, true},
+		{"boolean", `1`, false},
+		{"string", `"red"`, true},
+		{"string", `7`, false},
+		{"object", `{"ttl":64}`, true},
+		{"array", `{"ttl":64}`, false},
+		{"none", `1`, false},
+		{"none", ``, true},
+		{"integer", ``, true},
+	}
+
+	for _, check := range checks {
+		rc := pto3.RegisteredCondition{Name: "pto.test.registry.value", Description: "a value", ValueType: check.valueType}
+		if err := rc.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := rc.CheckValue(json.RawMessage(check.value)); (err == nil) != check.ok {
+			t.Errorf("value %q of type %q: expected ok %v, got %v", check.value, check.valueType, check.ok, err)
+		}
+	}
+
+	for _, name := range []string{"", "pto.test.*", "pto..test", "pto.test.has space"} {
+		rc := pto3.RegisteredCondition{Name: name, Description: "a bad name"}
+		if err := rc.Validate(); err == nil {
+			t.Errorf("condition name %q should not validate", name)
+		}
+	}
+
+	// register a condition, then upload a value of the wrong type
+	rc := pto3.RegisteredCondition{Name: "pto.test.registry.count", Description: "a count", ValueType: "integer"}
+	if err := TestDB.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := rc.Put(tx)
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Delete(TestDB)
+
+	in := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_conditions":["pto.test.registry.count"],"this_is_the_registry_test_obset":"yes"}
+["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.registry.count", 42]
+["", "2017-12-05T14:31:27Z", "2017-12-05T14:31:27Z", "10.33.44.55 * 10.15.16.199", "pto.test.registry.count", "many"]
+`
+
+	obsr := pto3.NewObservationReader(strings.NewReader(in))
+	if _, err := obsr.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	set := obsr.Set()
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = set.CopyDataFromStream(TestDB, strings.NewReader(in), cidCache, make(pto3.PathCache))
+	if perr, ok := err.(*pto3.PTOError); !ok || perr.Status() != http.StatusBadRequest {
+		t.Fatalf("expected upload of mistyped value to fail with status 400, got %v", err)
+	}
+}
+
+func TestObservationSourceRefs(t *testing.T) {
+	in := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":["https://localhost:8383/raw/test1/test1-0-obs.ndjson"],"_conditions":["pto.test.color.red"],"this_is_the_source_ref_test_obset":"yes"}
+["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red", null, {"source": 0, "record": 1774}]
+["", "2017-12-05T14:31:27Z", "2017-12-05T14:31:27Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red", 42, {"source": 0, "offset": 65536}]
+["", "2017-12-05T14:31:28Z", "2017-12-05T14:31:28Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+`
+
+	obsr := pto3.NewObservationReader(strings.NewReader(in))
+	if _, err := obsr.Next(); err != nil {
+		t.Fatal(err)
+	}
+
+	set := obsr.Set()
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// references to sources the set doesn't have should be rejected
+	bad := `["", "2017-12-05T14:31:26Z", "2017-12-05T14:31:26Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red", null, {"source": 1, "record": 0}]`
+	if err := set.CopyDataFromStream(TestDB, strings.NewReader(bad), cidCache, make(pto3.PathCache)); err == nil {
+		t.Fatal("observation with reference to missing source inserted")
+	}
+
+	if err := set.CopyDataFromStream(TestDB, strings.NewReader(in), cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := set.CopyDataToStream(TestDB, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	obsr = pto3.NewObservationReader(&out)
+	var back []*pto3.Observation
+	for {
+		o, err := obsr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		back = append(back, o)
+	}
+
+	if len(back) != 3 {
+		t.Fatalf("expected 3 observations back, got %d", len(back))
+	}
+	sort.Slice(back, func(i, j int) bool { return back[i].TimeStart.Before(*back[j].TimeStart) })
+
+	if ref := back[0].SourceRef(); ref == nil || ref.Record == nil || *ref.Record != 1774 || ref.Offset != nil || back[0].HasValue() {
+		t.Errorf("bad record reference on observation %v", back[0])
+	}
+	if ref := back[1].SourceRef(); ref == nil || ref.Offset == nil || *ref.Offset != 65536 || string(back[1].Value) != "42" {
+		t.Errorf("bad offset reference on observation %v", back[1])
+	} else if url, err := set.SourceURL(ref); err != nil || url != set.Sources[0] {
+		t.Errorf("bad source URL %s for reference (%v)", url, err)
+	}
+	if back[2].SourceRef() != nil {
+		t.Errorf("unexpected source reference on observation %v", back[2])
+	}
+}
+
+func TestCopyDataPageToStream(t *testing.T) {
+	set := pto3.ObservationSet{ID: TestQueryCacheSetID}
+
+	obscount, err := set.CountObservations(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// page through the set, making sure we see every observation once
+	var buf bytes.Buffer
+	after, pages := 0, 0
+	for {
+		if err := set.CopyDataPageToStream(TestDB, &buf, after, 1000); err != nil {
+			t.Fatal(err)
+		}
+		pages++
+
+		next, more, err := set.NextDataPage(TestDB, after, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !more {
+			break
+		}
+		after = next
+	}
+
+	if expected := (obscount + 999) / 1000; pages != expected {
+		t.Fatalf("expected %d pages, got %d", expected, pages)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != obscount {
+		t.Fatalf("expected %d observations in pages, got %d", obscount, len(lines))
+	}
+
+	var whole bytes.Buffer
+	if err := set.CopyDataToStream(TestDB, &whole); err != nil {
+		t.Fatal(err)
+	}
+
+	sortedLines := func(s string) []string {
+		out := strings.Split(strings.TrimSpace(s), "\n")
+		sort.Strings(out)
+		return out
+	}
+
+	paged, unpaged := sortedLines(buf.String()), sortedLines(whole.String())
+	for i := range paged {
+		if paged[i] != unpaged[i] {
+			t.Fatalf("paged download differs from full download at sorted line %d", i)
+		}
+	}
+}
+
+func TestCreateIndexes(t *testing.T) {
+	// indexes are created by CreateTables; creating them again must succeed
+	if err := pto3.CreateIndexes(TestDB); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, err := pto3.DeduplicatePaths(TestDB); err != nil {
+		t.Fatal(err)
+	} else if removed != 0 {
+		t.Fatalf("removed %d duplicate paths from database with unique paths", removed)
+	}
+}
+
+func TestObservationIndexes(t *testing.T) {
+	for _, bad := range []pto3.ObservationIndex{
+		{},
+		{Columns: []string{"condition_id", "nonsense"}},
+		{Columns: []string{"time_start", "time_start"}},
+		{Columns: []string{"time_start"}, Method: "gin"},
+		{Columns: []string{"set_id", "condition_id", "path_id", "time_start", "time_end"}, Method: "brin"},
+	} {
+		if _, _, err := pto3.ApplyObservationIndexes(TestDB, []pto3.ObservationIndex{bad}); err == nil {
+			t.Fatalf("applied invalid %s", &bad)
+		}
+	}
+
+	indexes := []pto3.ObservationIndex{
+		{Columns: []string{"condition_id", "time_start"}},
+		{Columns: []string{"time_start"}, Method: "brin"},
+	}
+
+	created, dropped, err := pto3.ApplyObservationIndexes(TestDB, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 2 || len(dropped) != 0 {
+		t.Fatalf("expected 2 indexes created and none dropped, got %v and %v", created, dropped)
+	}
+
+	// applying the same configuration again changes nothing
+	created, dropped, err = pto3.ApplyObservationIndexes(TestDB, indexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 0 || len(dropped) != 0 {
+		t.Fatalf("expected no changes reapplying indexes, got %v created and %v dropped", created, dropped)
+	}
+
+	// indexes no longer configured are dropped
+	created, dropped, err = pto3.ApplyObservationIndexes(TestDB, indexes[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(created) != 0 || len(dropped) != 1 || dropped[0] != "observations_cfg_time_start_brin_idx" {
+		t.Fatalf("expected only the brin index dropped, got %v created and %v dropped", created, dropped)
+	}
+
+	names, err := pto3.ListConfiguredIndexes(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "observations_cfg_condition_id_time_start_idx" {
+		t.Fatalf("unexpected configured indexes %v", names)
+	}
+
+	// an empty configuration drops all configured indexes
+	if _, dropped, err = pto3.ApplyObservationIndexes(TestDB, []pto3.ObservationIndex{}); err != nil {
+		t.Fatal(err)
+	} else if len(dropped) != 1 {
+		t.Fatalf("expected 1 index dropped, got %v", dropped)
+	}
+}
+
+func TestDBHealth(t *testing.T) {
+	serviceUnavailable := func(err error) bool {
+		ptoerr, ok := err.(*pto3.PTOError)
+		return ok && ptoerr.Status() == http.StatusServiceUnavailable
+	}
+
+	// nothing listens on the discard port
+	down := pg.Connect(&pg.Options{Addr: "127.0.0.1:9", User: "nobody", Database: "nothing"})
+	defer down.Close()
+
+	health := pto3.NewDBHealth(2, time.Minute)
+	health.Watch(down)
+
+	if err := health.Available(); err != nil {
+		t.Fatalf("expected available database before any failure, got %v", err)
+	}
+
+	// the breaker trips after two failures
+	for i := 0; i < 2; i++ {
+		if err := health.Check(); !serviceUnavailable(err) {
+			t.Fatalf("expected 503 checking unreachable database, got %v", err)
+		}
+	}
+	if err := health.Available(); !serviceUnavailable(err) {
+		t.Fatalf("expected 503 for tripped breaker, got %v", err)
+	}
+	if retry := health.RetryAfter(); retry <= 0 || retry > time.Minute {
+		t.Fatalf("unexpected retry after %s", retry)
+	}
+	if status := health.Status(); status.Status != "unavailable" || status.ConsecutiveFailures != 2 || status.RetryAfter == nil {
+		t.Fatalf("unexpected status of unreachable database %+v", status)
+	}
+
+	// errors in queries don't count against a reachable database
+	health = pto3.NewDBHealth(1, time.Minute)
+	health.Watch(TestDB)
+
+	if _, err := TestDB.Exec("SELECT no_such_column FROM no_such_table"); err == nil || serviceUnavailable(pto3.PTOWrapError(err)) {
+		t.Fatalf("expected non-transient error from bad query, got %v", err)
+	}
+	if err := health.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if status := health.Status(); status.Status != "ok" || status.ConsecutiveFailures != 0 {
+		t.Fatalf("unexpected status of reachable database %+v", status)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	// CreateTables migrates to the latest version, so there's nothing to do
+	version, err := pto3.SchemaVersion(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version != pto3.LatestSchemaVersion() {
+		t.Fatalf("expected schema version %d after CreateTables, got %d", pto3.LatestSchemaVersion(), version)
+	}
+
+	applied, err := pto3.Migrate(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 0 {
+		t.Fatalf("migrated already up to date database: %v", applied)
+	}
+}
+
+func TestIngestLog(t *testing.T) {
+	meta := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red", "pto.test.color.blue"],"this_is_the_ingest_test_obset":"yes"}`
+	obs1 := `["", "2016-06-10T12:00:00Z", "2016-06-10T12:00:01Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]`
+	obs2 := `["", "2016-06-10T12:00:02Z", "2016-06-10T12:00:03Z", "10.33.44.56 * 10.15.16.199", "pto.test.color.blue"]`
+
+	logdir, err := ioutil.TempDir("", "pto3-test-ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logdir)
+
+	il, err := pto3.OpenIngestLog(logdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(TestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// upload a set, logging its observations
+	obsr := pto3.NewObservationReader(strings.NewReader(meta + "\n" + obs1 + "\n" + obs2 + "\n"))
+	set, err := obsr.ReadMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.Insert(TestDB, true); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := il.Begin(obsr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := set.CopyDataFromReader(TestDB, obsr, cidCache, make(pto3.PathCache)); err != nil {
+		t.Fatal(err)
+	}
+	if seq, err := entry.Commit(TestDB, set); err != nil {
+		t.Fatal(err)
+	} else if seq != 1 {
+		t.Fatalf("first ingest log entry has sequence number %d", seq)
+	}
+
+	// an aborted upload leaves nothing behind
+	aborted, err := il.Begin(pto3.NewObservationReader(strings.NewReader(obs1)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted.Abort()
+
+	if files, err := ioutil.ReadDir(logdir); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 {
+		t.Fatalf("ingest log has %d files, expected 1", len(files))
+	}
+
+	// the entry is an observation set file with the set's UUID
+	entryfile := filepath.Join(logdir, "000000000001.ndjson")
+	f, err := os.Open(entryfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged, obsdat, err := pto3.ReadObservationFile(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logged.UUID() != set.UUID() {
+		t.Fatalf("ingest log entry has UUID %s, expected %s", logged.UUID(), set.UUID())
+	}
+	if len(obsdat) != 2 {
+		t.Fatalf("ingest log entry has %d observations, expected 2", len(obsdat))
+	}
+
+	// replaying it into the database it came from changes nothing
+	replay := func() (bool, int) {
+		var created bool
+		var loaded int
+		if err := pto3.ReplayIngestLog(TestDB, TestConfig, logdir, 1, func(seq int64, set *pto3.ObservationSet, c bool, l int) {
+			created, loaded = c, l
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return created, loaded
+	}
+
+	if created, loaded := replay(); created || loaded != 0 {
+		t.Fatalf("replay into existing set: created %v, loaded %d observations", created, loaded)
+	}
+
+	// but replaying it without the set recreates it
+	b, err := ioutil.ReadFile(entryfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := pto3.NewSetUUID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(entryfile, bytes.Replace(b, []byte(set.UUID()), []byte(other), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if created, loaded := replay(); !created || loaded != 2 {
+		t.Fatalf("replay of missing set: created %v, loaded %d observations", created, loaded)
+	}
+	if _, err := pto3.ObservationSetIDForUUID(TestDB, other); err != nil {
+		t.Fatal(err)
+	}
 }
@@ -0,0 +1,136 @@
+package pto3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// SourceRef refers to the raw data an observation was derived from: a byte
+// offset or a record number within one of the raw files listed in the
+// _sources metadata of the observation's set. Exactly one of Offset and Record
+// is set. In observation files, a source reference is an optional seventh
+// element of an observation array, e.g. {"source": 0, "record": 1774}; the
+// value element must then be present, but may be null.
+type SourceRef struct {
+	// Index of the source file in the set's _sources
+	Source int `json:"source"`
+	// Byte offset within the source file
+	Offset *int64 `json:"offset,omitempty"`
+	// Record number within the source file, counting from zero
+	Record *int64 `json:"record,omitempty"`
+}
+
+// parseSourceRef parses a source reference from an observation file,
+// returning nil if it is absent.
+func parseSourceRef(b json.RawMessage) (*SourceRef, error) {
+	if len(b) == 0 || bytes.Equal(b, []byte("null")) {
+		return nil, nil
+	}
+
+	var ref SourceRef
+	if err := json.Unmarshal(b, &ref); err != nil {
+		return nil, PTOErrorf("bad source reference %s: %s", b, err.Error())
+	}
+
+	if ref.Source < 0 {
+		return nil, PTOErrorf("bad source reference %s: negative source index", b)
+	}
+
+	if (ref.Offset == nil) == (ref.Record == nil) {
+		return nil, PTOErrorf("bad source reference %s: requires exactly one of offset and record", b)
+	}
+
+	if (ref.Offset != nil && *ref.Offset < 0) || (ref.Record != nil && *ref.Record < 0) {
+		return nil, PTOErrorf("bad source reference %s: negative position", b)
+	}
+
+	return &ref, nil
+}
+
+// SourceRef returns this observation's reference to its raw source data, or
+// nil if it has none.
+func (obs *Observation) SourceRef() *SourceRef {
+	if obs.SourceIndex == nil {
+		return nil
+	}
+	return &SourceRef{Source: *obs.SourceIndex, Offset: obs.SourceOffset, Record: obs.SourceRecord}
+}
+
+// SetSourceRef sets this observation's reference to its raw source data, or
+// removes it if ref is nil.
+func (obs *Observation) SetSourceRef(ref *SourceRef) {
+	if ref == nil {
+		obs.SourceIndex, obs.SourceOffset, obs.SourceRecord = nil, nil, nil
+		return
+	}
+
+	source := ref.Source
+	obs.SourceIndex, obs.SourceOffset, obs.SourceRecord = &source, ref.Offset, ref.Record
+}
+
+// checkSourceRef verifies that a source reference refers to one of this
+// set's sources.
+func (set *ObservationSet) checkSourceRef(ref *SourceRef) error {
+	if ref != nil && ref.Source >= len(set.Sources) {
+		return PTOErrorf("source reference to source %d, but set has %d sources", ref.Source, len(set.Sources)).StatusIs(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// SourceURL returns the link to the raw source file a source reference in
+// this set refers to.
+func (set *ObservationSet) SourceURL(ref *SourceRef) (string, error) {
+	if err := set.checkSourceRef(ref); err != nil {
+		return "", err
+	}
+	return set.Sources[ref.Source], nil
+}
+
+// csvSourceRef returns the representation of a source reference in the CSV
+// used to COPY observations into the database: source index, offset, and
+// record columns, empty (NULL) if not set.
+func csvSourceRef(ref *SourceRef) []string {
+	out := []string{"", "", ""}
+	if ref == nil {
+		return out
+	}
+
+	out[0] = fmt.Sprintf("%d", ref.Source)
+	if ref.Offset != nil {
+		out[1] = fmt.Sprintf("%d", *ref.Offset)
+	}
+	if ref.Record != nil {
+		out[2] = fmt.Sprintf("%d", *ref.Record)
+	}
+	return out
+}
+
+// sourceRefFromCSV parses the source index, offset, and record columns of
+// observations copied from the database as CSV, returning nil if they are
+// empty (NULL).
+func sourceRefFromCSV(cols []string) (*SourceRef, error) {
+	if cols[0] == "" {
+		return nil, nil
+	}
+
+	var ref SourceRef
+	var err error
+	if ref.Source, err = strconv.Atoi(cols[0]); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	for i, pos := range []**int64{&ref.Offset, &ref.Record} {
+		if cols[i+1] != "" {
+			n, err := strconv.ParseInt(cols[i+1], 10, 64)
+			if err != nil {
+				return nil, PTOWrapError(err)
+			}
+			*pos = &n
+		}
+	}
+
+	return &ref, nil
+}
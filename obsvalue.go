@@ -0,0 +1,129 @@
+package pto3
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// Observation values are arbitrary JSON values, stored in a JSONB column:
+// e.g. a number for an RTT in milliseconds, a string for a negotiated option,
+// or an object for structured results. Observation set files written before
+// values were typed give values as strings; these are kept as strings, and
+// the numeric accessors below parse them.
+
+// HasValue returns true if this observation has a value. Presence is
+// independent of the value itself: zero, false, and the empty string are
+// values like any other, and only a missing or null value is absent.
+func (obs *Observation) HasValue() bool {
+	return len(obs.Value) > 0 && !bytes.Equal(obs.Value, []byte("null"))
+}
+
+// SetValue sets this observation's value to the JSON encoding of v, or
+// removes it if v is nil.
+func (obs *Observation) SetValue(v interface{}) error {
+	if v == nil {
+		obs.Value = nil
+		return nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	obs.Value = b
+	return nil
+}
+
+// DecodeValue decodes this observation's value into v, as json.Unmarshal.
+func (obs *Observation) DecodeValue(v interface{}) error {
+	if !obs.HasValue() {
+		return PTOErrorf("observation has no value")
+	}
+	if err := json.Unmarshal(obs.Value, v); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// StringValue returns this observation's value as a string: string values
+// as is, other values as compact JSON, and an empty string if there is no
+// value.
+func (obs *Observation) StringValue() string {
+	var s string
+	if err := json.Unmarshal(obs.Value, &s); err == nil {
+		return s
+	}
+	return csvValue(obs.Value)
+}
+
+// FloatValue returns this observation's value as a number. Strings
+// containing numbers are parsed.
+func (obs *Observation) FloatValue() (float64, error) {
+	f, err := strconv.ParseFloat(obs.StringValue(), 64)
+	if err != nil {
+		return 0, PTOErrorf("observation value %s is not a number", obs.Value)
+	}
+	return f, nil
+}
+
+// IntValue returns this observation's value as an integer. Strings
+// containing integers are parsed.
+func (obs *Observation) IntValue() (int64, error) {
+	i, err := strconv.ParseInt(obs.StringValue(), 10, 64)
+	if err != nil {
+		return 0, PTOErrorf("observation value %s is not an integer", obs.Value)
+	}
+	return i, nil
+}
+
+// splitObservationJSON splits a JSON array line in an observation file into
+// its first five elements, which must be strings, its value, which may be
+// any JSON value and is nil if absent, and its source reference, if any.
+func splitObservationJSON(b []byte) ([]string, json.RawMessage, *SourceRef, error) {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(b, &elements); err != nil {
+		return nil, nil, nil, PTOWrapError(err)
+	}
+
+	if len(elements) < 5 {
+		return nil, nil, nil, PTOErrorf("Observation requires at least five elements")
+	}
+
+	fields := make([]string, 5)
+	for i := range fields {
+		if err := json.Unmarshal(elements[i], &fields[i]); err != nil {
+			return nil, nil, nil, PTOErrorf("Observation element %d is not a string", i)
+		}
+	}
+
+	var value json.RawMessage
+	if len(elements) >= 6 && !bytes.Equal(elements[5], []byte("null")) {
+		value = elements[5]
+	}
+
+	var ref *SourceRef
+	if len(elements) >= 7 {
+		var err error
+		if ref, err = parseSourceRef(elements[6]); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	return fields, value, ref, nil
+}
+
+// csvValue returns the representation of an observation value in the CSV
+// used to COPY observations into the database: JSON text, or an empty field
+// (NULL) if there is no value.
+func csvValue(value json.RawMessage) string {
+	if len(value) == 0 || bytes.Equal(value, []byte("null")) {
+		return ""
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, value); err != nil {
+		return string(value)
+	}
+	return compact.String()
+}
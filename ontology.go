@@ -0,0 +1,251 @@
+package pto3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// ConditionOntologyFormat is the version of the condition ontology document
+// format written by ExportConditionOntology. Documents in other formats are
+// refused on import.
+const ConditionOntologyFormat = 1
+
+// ConditionOntology is the condition registry as a document which can be
+// exchanged between observatories, so that they converge on a shared
+// vocabulary. The hierarchy of conditions is given by their dotted names.
+type ConditionOntology struct {
+	// Version of the document format; see ConditionOntologyFormat
+	Format int `json:"format"`
+	// Digest of the conditions in the document, identical for ontologies with
+	// the same registry entries wherever they were exported
+	Version string `json:"version"`
+	// Link to the registry the ontology was exported from
+	Source string `json:"source,omitempty"`
+	// Time the ontology was exported
+	Exported *time.Time `json:"exported,omitempty"`
+	// Registered conditions, sorted by name
+	Conditions []RegisteredCondition `json:"conditions"`
+}
+
+// ontologyVersion computes the digest of a list of registered conditions, as
+// a hex string. The digest covers the names, descriptions, value types,
+// units, and references of the conditions, independent of their order, but
+// not when they were registered.
+func ontologyVersion(rcs []RegisteredCondition) (string, error) {
+	entries := make(map[string]interface{})
+	for i := range rcs {
+		entries[rcs[i].Name] = []string{rcs[i].Description, rcs[i].ValueType, rcs[i].Units, rcs[i].Reference}
+	}
+
+	b, err := MarshalCanonicalJSON(entries)
+	if err != nil {
+		return "", err
+	}
+
+	d := sha256.Sum256(b)
+	return hex.EncodeToString(d[:]), nil
+}
+
+// ExportConditionOntology returns the condition registry in the given
+// database as a ConditionOntology, linked via the given configuration.
+func ExportConditionOntology(db *pg.DB, config *PTOConfiguration) (*ConditionOntology, error) {
+	rcs, err := ListRegisteredConditions(db, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := ontologyVersion(rcs)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range rcs {
+		rcs[i].LinkVia(config)
+	}
+
+	now := time.Now().UTC()
+	out := ConditionOntology{
+		Format:     ConditionOntologyFormat,
+		Version:    version,
+		Exported:   &now,
+		Conditions: rcs,
+	}
+	out.Source, _ = config.LinkTo("obs/conditions/registry")
+
+	return &out, nil
+}
+
+// OntologyConflict describes a field of a registered condition on which an
+// imported ontology and the local registry disagree.
+type OntologyConflict struct {
+	Name     string `json:"name"`
+	Field    string `json:"field"`
+	Local    string `json:"local"`
+	Imported string `json:"imported"`
+}
+
+// OntologyMergeReport describes the outcome of merging an imported ontology
+// into the local registry.
+type OntologyMergeReport struct {
+	// Conditions registered from the imported ontology
+	Added []string `json:"added"`
+	// Conditions whose registration was changed by the imported ontology
+	Updated []string `json:"updated"`
+	// Count of conditions in both left unchanged, including those kept on
+	// conflict
+	Unchanged int `json:"unchanged"`
+	// Fields on which the local registry and the imported ontology disagree
+	Conflicts []OntologyConflict `json:"conflicts"`
+	// Version of the local registry after the merge
+	Version string `json:"version"`
+}
+
+// OntologyMergePolicy determines how conflicts between an imported ontology
+// and the local registry are resolved.
+type OntologyMergePolicy string
+
+const (
+	// OntologyKeepLocal keeps the local registration of a field on conflict
+	OntologyKeepLocal OntologyMergePolicy = "keep"
+	// OntologyReplaceLocal takes the imported registration of a field on
+	// conflict
+	OntologyReplaceLocal OntologyMergePolicy = "replace"
+)
+
+// ParseOntologyMergePolicy parses an ontology merge policy by name,
+// defaulting to OntologyKeepLocal. It returns an error with status 400 for an
+// unknown policy.
+func ParseOntologyMergePolicy(s string) (OntologyMergePolicy, error) {
+	switch policy := OntologyMergePolicy(s); policy {
+	case "":
+		return OntologyKeepLocal, nil
+	case OntologyKeepLocal, OntologyReplaceLocal:
+		return policy, nil
+	default:
+		return OntologyKeepLocal, PTOErrorf("unknown ontology merge policy %s", s).StatusIs(http.StatusBadRequest)
+	}
+}
+
+// ParseConditionOntology parses a condition ontology document, returning an
+// error with status 400 if it is malformed, in an unknown format, or
+// contains an invalid or duplicate registration.
+func ParseConditionOntology(b []byte) (*ConditionOntology, error) {
+	var ont ConditionOntology
+	if err := json.Unmarshal(b, &ont); err != nil {
+		return nil, PTOErrorf("bad condition ontology: %s", err.Error()).StatusIs(http.StatusBadRequest)
+	}
+
+	if ont.Format != ConditionOntologyFormat {
+		return nil, PTOErrorf("unsupported condition ontology format %d; expected %d",
+			ont.Format, ConditionOntologyFormat).StatusIs(http.StatusBadRequest)
+	}
+
+	seen := make(map[string]bool)
+	for i := range ont.Conditions {
+		if err := ont.Conditions[i].Validate(); err != nil {
+			return nil, err
+		}
+		if seen[ont.Conditions[i].Name] {
+			return nil, PTOErrorf("condition %s appears twice in ontology", ont.Conditions[i].Name).StatusIs(http.StatusBadRequest)
+		}
+		seen[ont.Conditions[i].Name] = true
+	}
+
+	return &ont, nil
+}
+
+// MergeConditionOntology merges an imported ontology into the condition
+// registry in the given database. Conditions not registered locally are
+// added. For conditions registered in both, fields empty locally are filled
+// in from the imported ontology, and fields on which both disagree are
+// reported as conflicts and resolved according to the policy. If dryRun is
+// set, the registry is left unchanged, and the report describes what the
+// merge would do. Local registrations not in the imported ontology are
+// always kept.
+func MergeConditionOntology(db *pg.DB, ont *ConditionOntology, policy OntologyMergePolicy, dryRun bool) (*OntologyMergeReport, error) {
+	report := OntologyMergeReport{
+		Added:     make([]string, 0),
+		Updated:   make([]string, 0),
+		Conflicts: make([]OntologyConflict, 0),
+	}
+
+	err := db.RunInTransaction(func(t *pg.Tx) error {
+		local, err := LoadConditionRegistry(t)
+		if err != nil {
+			return err
+		}
+
+		for i := range ont.Conditions {
+			imported := ont.Conditions[i]
+
+			existing, ok := local[imported.Name]
+			if !ok {
+				report.Added = append(report.Added, imported.Name)
+				local[imported.Name] = &imported
+				if !dryRun {
+					if _, err := imported.Put(t); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+
+			merged := *existing
+			changed := false
+			for _, field := range []struct {
+				name     string
+				local    *string
+				imported string
+			}{
+				{"description", &merged.Description, imported.Description},
+				{"value_type", &merged.ValueType, imported.ValueType},
+				{"units", &merged.Units, imported.Units},
+				{"reference", &merged.Reference, imported.Reference},
+			} {
+				switch {
+				case *field.local == field.imported || field.imported == "":
+					continue
+				case *field.local != "":
+					report.Conflicts = append(report.Conflicts, OntologyConflict{
+						Name: imported.Name, Field: field.name, Local: *field.local, Imported: field.imported})
+					if policy != OntologyReplaceLocal {
+						continue
+					}
+				}
+				*field.local = field.imported
+				changed = true
+			}
+
+			if !changed {
+				report.Unchanged++
+				continue
+			}
+
+			report.Updated = append(report.Updated, imported.Name)
+			local[imported.Name] = &merged
+			if !dryRun {
+				if _, err := merged.Put(t); err != nil {
+					return err
+				}
+			}
+		}
+
+		// report the version the registry has, or would have
+		rcs := make([]RegisteredCondition, 0, len(local))
+		for _, rc := range local {
+			rcs = append(rcs, *rc)
+		}
+		report.Version, err = ontologyVersion(rcs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &report, nil
+}
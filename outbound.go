@@ -0,0 +1,179 @@
+package pto3
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// The PTO makes requests to URLs chosen by its clients: it fetches raw data
+// via /raw/<campaign>/fetch, fetches the metadata and data of sets on other
+// PTOs, and POSTs query callbacks. Such requests could otherwise reach
+// services only reachable from the server itself, e.g. cloud metadata
+// endpoints at 169.254.169.254, and hand their responses to the client. They
+// are therefore made with an outbound client, which refuses to connect to
+// addresses which are not public, checking every address it connects to
+// after name resolution, including for redirects, unless the network is
+// listed in the configuration's OutboundNetworks.
+
+// outboundDeniedNetworks lists the networks outbound requests may not
+// connect to unless allowed by OutboundNetworks: loopback, private,
+// link-local, shared, benchmarking, multicast, and reserved addresses.
+var outboundDeniedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// outboundDialTimeout is the time allowed to connect for outbound requests.
+const outboundDialTimeout = 30 * time.Second
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	out := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		out[i] = n
+	}
+	return out
+}
+
+// outboundAddressAllowed returns true if outbound requests may connect to
+// an IP address.
+func (config *PTOConfiguration) outboundAddressAllowed(ip net.IP) bool {
+	for _, cidr := range config.OutboundNetworks {
+		if _, n, err := net.ParseCIDR(cidr); err == nil && n.Contains(ip) {
+			return true
+		}
+	}
+	for _, n := range outboundDeniedNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// outboundAddressError returns an error for an outbound request to a denied
+// address.
+func outboundAddressError(host string) *PTOError {
+	return PTOErrorf("requests to %s not allowed: not a public address", host).StatusIs(http.StatusForbidden)
+}
+
+// checkOutboundHost returns an error if the host of a URL is an IP address
+// outbound requests may not connect to. Host names are checked once
+// resolved, as they are connected to.
+func (config *PTOConfiguration) checkOutboundHost(u *url.URL) error {
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !config.outboundAddressAllowed(ip) {
+		return outboundAddressError(u.Hostname())
+	}
+	return nil
+}
+
+// checkOutboundURL returns an error if an outbound request may not be made
+// to a URL: if its scheme is not allowed by FetchSchemes, or its host may
+// not be connected to.
+func (config *PTOConfiguration) checkOutboundURL(u *url.URL) error {
+	if !config.fetchSchemeAllowed(u) {
+		return PTOErrorf("requests to %s URLs not allowed", u.Scheme).StatusIs(http.StatusBadRequest)
+	}
+	return config.checkOutboundHost(u)
+}
+
+// CheckCallbackURL returns an error if notifications may not be POSTed to a
+// URL given by a client: if it is not an absolute http or https URL, or its
+// host may not be connected to.
+func (config *PTOConfiguration) CheckCallbackURL(link string) error {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return PTOErrorf("bad callback URL %s", link).StatusIs(http.StatusBadRequest)
+	}
+	return config.checkOutboundHost(u)
+}
+
+// outboundControl is the dialer control function of the outbound client,
+// refusing connections to addresses outbound requests may not connect to.
+func (config *PTOConfiguration) outboundControl(network string, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !config.outboundAddressAllowed(ip) {
+		return outboundAddressError(host)
+	}
+	return nil
+}
+
+// outboundTransport returns the transport shared by outbound clients, which
+// connects only to addresses allowed for outbound requests, and never uses a
+// proxy, which would connect on its behalf.
+func (config *PTOConfiguration) outboundTransport() *http.Transport {
+	config.outboundTransportOnce.Do(func() {
+		dialer := &net.Dialer{
+			Timeout:   outboundDialTimeout,
+			KeepAlive: 30 * time.Second,
+			Control:   config.outboundControl,
+		}
+
+		config.outboundTransportValue = &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: outboundDialTimeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		}
+	})
+
+	return config.outboundTransportValue
+}
+
+// OutboundClient returns an HTTP client for requests to URLs chosen by
+// clients, giving up on requests taking longer than the given timeout, or
+// never if it is zero. The client connects only to addresses allowed for
+// outbound requests, and follows at most ten redirects, only to URLs allowed
+// by checkOutboundURL.
+func (config *PTOConfiguration) OutboundClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: config.outboundTransport(),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return PTOErrorf("too many redirects fetching %s", via[0].URL).StatusIs(http.StatusBadGateway)
+			}
+			return config.checkOutboundURL(req.URL)
+		},
+	}
+}
+
+// outboundError returns an error for an outbound request which failed,
+// keeping the status of errors refusing the request, and otherwise with
+// status 502 Bad Gateway.
+func outboundError(link string, err error) error {
+	if uerr, ok := err.(*url.Error); ok {
+		err = uerr.Err
+	}
+	if operr, ok := err.(*net.OpError); ok {
+		err = operr.Err
+	}
+	if ptoerr, ok := err.(*PTOError); ok {
+		return ptoerr
+	}
+	return PTOErrorf("error fetching %s: %s", link, err.Error()).StatusIs(http.StatusBadGateway)
+}
@@ -0,0 +1,485 @@
+package papi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+type AdminAPI struct {
+	config *pto3.PTOConfiguration
+	azr    *APIKeyAuthorizer
+	rds    *pto3.RawDataStore
+	cc     *pto3.ConsistencyChecker
+}
+
+// campaignPermissions lists the permissions which are granted per campaign,
+// as <permission>:<campaign>.
+var campaignPermissions = map[string]bool{
+	"read_raw":  true,
+	"write_raw": true,
+}
+
+// permissionChangeRequest is a request to grant or revoke campaign
+// permissions for an API key across all campaigns matching a filter.
+type permissionChangeRequest struct {
+	// API key to change permissions for, or "default" for all clients
+	Key string `json:"key"`
+	// Either "grant" or "revoke"
+	Action string `json:"action"`
+	// Campaign permissions to change, e.g. "read_raw"
+	Permissions []string `json:"permissions"`
+	// Shell pattern campaign names must match; all campaigns if empty
+	Campaigns string `json:"campaigns"`
+	// Owner campaigns must have, if not empty
+	Owner string `json:"owner"`
+	// Metadata values campaigns must have
+	Metadata map[string]string `json:"metadata"`
+	// Report changes without making them
+	DryRun bool `json:"dry_run"`
+}
+
+type permissionChangeResult struct {
+	Key       string             `json:"key"`
+	Action    string             `json:"action"`
+	DryRun    bool               `json:"dry_run"`
+	Campaigns []string           `json:"campaigns"`
+	Changes   []PermissionChange `json:"changes"`
+}
+
+// matchingCampaigns returns the sorted names of the campaigns matching the
+// filter in a permission change request.
+func (aa *AdminAPI) matchingCampaigns(pcr *permissionChangeRequest) ([]string, error) {
+	if err := aa.rds.ScanCampaigns(); err != nil {
+		return nil, err
+	}
+
+	pattern := pcr.Campaigns
+	if pattern == "" {
+		pattern = "*"
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, pto3.PTOErrorf("bad campaign pattern %s", pattern).StatusIs(http.StatusBadRequest)
+	}
+
+	out := make([]string, 0)
+	for _, camname := range aa.rds.CampaignNames() {
+		if match, _ := path.Match(pattern, camname); !match {
+			continue
+		}
+
+		cam, err := aa.rds.CampaignForName(camname)
+		if err != nil {
+			return nil, err
+		}
+
+		md, err := cam.GetCampaignMetadata()
+		if err != nil {
+			return nil, err
+		}
+
+		if pcr.Owner != "" && md.Owner(false) != pcr.Owner {
+			continue
+		}
+
+		match := true
+		for k, v := range pcr.Metadata {
+			if md.Get(k, false) != v {
+				match = false
+				break
+			}
+		}
+
+		if match {
+			out = append(out, camname)
+		}
+	}
+
+	sort.Strings(out)
+	return out, nil
+}
+
+// handleChangePermissions handles POST /admin/permissions, granting or
+// revoking permissions for an API key across all campaigns matching a filter
+// in one operation. It requires a JSON object describing the change in the
+// request, and writes a JSON object with the matching campaigns and the
+// permissions changed to the response. With dry_run, it reports the
+// permissions which would be changed without changing them.
+func (aa *AdminAPI) handleChangePermissions(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !aa.azr.IsAuthorized(w, r, "admin_permissions") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for permission changes must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var pcr permissionChangeRequest
+	if err := json.Unmarshal(b, &pcr); err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if pcr.Key == "" {
+		pto3.HTTPError(w, "missing key", http.StatusBadRequest)
+		return
+	}
+
+	if pcr.Action != "grant" && pcr.Action != "revoke" {
+		pto3.HTTPError(w, fmt.Sprintf("bad action %s, must be grant or revoke", pcr.Action), http.StatusBadRequest)
+		return
+	}
+
+	if len(pcr.Permissions) == 0 {
+		pto3.HTTPError(w, "missing permissions", http.StatusBadRequest)
+		return
+	}
+
+	for _, permission := range pcr.Permissions {
+		if !campaignPermissions[permission] {
+			pto3.HTTPError(w, fmt.Sprintf("%s is not a campaign permission", permission), http.StatusBadRequest)
+			return
+		}
+	}
+
+	out := permissionChangeResult{Key: pcr.Key, Action: pcr.Action, DryRun: pcr.DryRun}
+
+	camnames, err := aa.matchingCampaigns(&pcr)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "selecting campaigns", err)
+		return
+	}
+
+	permissions := make([]string, 0, len(camnames)*len(pcr.Permissions))
+	out.Campaigns = make([]string, len(camnames))
+	for i, camname := range camnames {
+		out.Campaigns[i], _ = aa.config.LinkTo(fmt.Sprintf("raw/%s", camname))
+		for _, permission := range pcr.Permissions {
+			permissions = append(permissions, permission+":"+camname)
+		}
+	}
+
+	out.Changes, err = aa.azr.ChangePermissions(pcr.Key, permissions, pcr.Action == "grant", pcr.DryRun)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "changing permissions", err)
+		return
+	}
+
+	if !pcr.DryRun && len(out.Changes) > 0 {
+		log.Printf("%s %d permissions for API key %s", pcr.Action, len(out.Changes), pcr.Key)
+	}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling permission changes", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	aa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+type deprecationReport struct {
+	Feature string                  `json:"feature"`
+	Since   time.Time               `json:"since"`
+	Sunset  *time.Time              `json:"sunset,omitempty"`
+	Link    string                  `json:"link,omitempty"`
+	Usage   []pto3.DeprecationUsage `json:"usage"`
+}
+
+// handleDeprecations handles GET /admin/deprecations. It writes a JSON object
+// to the response with a single key, "deprecations", whose content is an
+// array of the deprecated features in the configuration, sorted by name, each
+// with the clients which used it since the server started.
+func (aa *AdminAPI) handleDeprecations(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !aa.azr.IsAuthorized(w, r, "read_deprecations") {
+		return
+	}
+
+	features := make([]string, 0, len(aa.config.Deprecations))
+	for feature := range aa.config.Deprecations {
+		features = append(features, feature)
+	}
+	sort.Strings(features)
+
+	out := struct {
+		D []deprecationReport `json:"deprecations"`
+	}{D: make([]deprecationReport, len(features))}
+
+	for i, feature := range features {
+		dep := aa.config.Deprecations[feature]
+		out.D[i] = deprecationReport{
+			Feature: feature,
+			Since:   dep.Since,
+			Sunset:  dep.Sunset,
+			Link:    dep.Link,
+			Usage:   aa.config.DeprecationTracker().Usage(feature),
+		}
+	}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling deprecations", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	aa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleListDeliveries handles GET /admin/deliveries. It writes a JSON object
+// to the response with the query callbacks and alerts awaiting delivery in
+// "pending", and those which failed too often to be retried automatically in
+// "dead", each in the order they were queued.
+func (aa *AdminAPI) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !aa.azr.IsAuthorized(w, r, "admin_deliveries") {
+		return
+	}
+
+	dq, err := aa.config.DeliveryQueue()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "opening delivery queue", err)
+		return
+	}
+
+	out := struct {
+		Pending []pto3.Delivery `json:"pending"`
+		Dead    []pto3.Delivery `json:"dead"`
+	}{}
+	out.Pending, out.Dead = dq.Deliveries()
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling deliveries", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	aa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleRetryDelivery handles POST /admin/deliveries/<id>/retry, scheduling
+// a pending delivery or a dead letter for an immediate attempt.
+func (aa *AdminAPI) handleRetryDelivery(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !aa.azr.IsAuthorized(w, r, "admin_deliveries") {
+		return
+	}
+
+	dq, err := aa.config.DeliveryQueue()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "opening delivery queue", err)
+		return
+	}
+
+	if err := dq.Retry(mux.Vars(r)["delivery"]); err != nil {
+		pto3.HandleErrorHTTP(w, "retrying delivery", err)
+		return
+	}
+
+	aa.additionalHeaders(w)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleDiscardDelivery handles DELETE /admin/deliveries/<id>, removing a
+// delivery from the queue without delivering it.
+func (aa *AdminAPI) handleDiscardDelivery(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !aa.azr.IsAuthorized(w, r, "admin_deliveries") {
+		return
+	}
+
+	dq, err := aa.config.DeliveryQueue()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "opening delivery queue", err)
+		return
+	}
+
+	if err := dq.Discard(mux.Vars(r)["delivery"]); err != nil {
+		pto3.HandleErrorHTTP(w, "discarding delivery", err)
+		return
+	}
+
+	aa.additionalHeaders(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRewrapKeys handles POST /admin/encryption/rewrap, wrapping the data
+// keys of all encrypted campaigns again with the current key encryption key
+// after it has been rotated. It writes a JSON object to the response with the
+// names of the campaigns whose keys were rewrapped in "rewrapped".
+func (aa *AdminAPI) handleRewrapKeys(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !aa.azr.IsAuthorized(w, r, "admin_encryption") {
+		return
+	}
+
+	if err := aa.rds.ScanCampaigns(); err != nil {
+		pto3.HandleErrorHTTP(w, "scanning campaigns", err)
+		return
+	}
+
+	out := struct {
+		Rewrapped []string `json:"rewrapped"`
+	}{}
+
+	var err error
+	out.Rewrapped, err = aa.rds.RewrapDataKeys()
+	if len(out.Rewrapped) > 0 {
+		log.Printf("rewrapped data keys for %d campaigns", len(out.Rewrapped))
+	}
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "rewrapping data keys", err)
+		return
+	}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling rewrapped campaigns", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	aa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleConsistencyReport handles GET /admin/consistency. It writes a JSON
+// object to the response with whether a consistency check is in progress in
+// "running", and the report of the last check to finish in "last".
+func (aa *AdminAPI) handleConsistencyReport(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !aa.azr.IsAuthorized(w, r, "admin_consistency") {
+		return
+	}
+
+	if aa.cc == nil {
+		pto3.HTTPError(w, "consistency checks are not enabled", http.StatusNotFound)
+		return
+	}
+
+	out := struct {
+		Running bool                    `json:"running"`
+		Last    *pto3.ConsistencyReport `json:"last"`
+	}{}
+	out.Running, out.Last = aa.cc.Report()
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling consistency report", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	aa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleStartConsistencyCheck handles POST /admin/consistency, starting a
+// consistency check in the background. It fails with status 409 if a check
+// is already in progress.
+func (aa *AdminAPI) handleStartConsistencyCheck(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !aa.azr.IsAuthorized(w, r, "admin_consistency") {
+		return
+	}
+
+	if aa.cc == nil {
+		pto3.HTTPError(w, "consistency checks are not enabled", http.StatusNotFound)
+		return
+	}
+
+	if !aa.cc.Start() {
+		pto3.HTTPError(w, "a consistency check is already in progress", http.StatusConflict)
+		return
+	}
+
+	log.Printf("started consistency check")
+
+	aa.additionalHeaders(w)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// EnableConsistencyChecks allows this API to check the consistency of the
+// observation database served by the given observation API with the raw
+// data store, if it has one, and starts checking it periodically if the
+// configuration has a ConsistencyCheckInterval.
+func (aa *AdminAPI) EnableConsistencyChecks(oa *ObsAPI) {
+	aa.cc = pto3.NewConsistencyChecker(oa.db, aa.config, aa.rds)
+	if aa.config.ConsistencyCheckInterval > 0 {
+		aa.cc.RunEvery(time.Duration(aa.config.ConsistencyCheckInterval) * time.Second)
+	}
+}
+
+func (aa *AdminAPI) additionalHeaders(w http.ResponseWriter) {
+	if aa.config.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", aa.config.AllowOrigin)
+	}
+}
+
+func (aa *AdminAPI) addRoutes(r *mux.Router) {
+	if aa.rds != nil {
+		r.HandleFunc("/admin/permissions", aa.handleChangePermissions).Methods("POST")
+		r.HandleFunc("/admin/encryption/rewrap", aa.handleRewrapKeys).Methods("POST")
+	}
+	r.HandleFunc("/admin/deprecations", aa.handleDeprecations).Methods("GET")
+	r.HandleFunc("/admin/deliveries", aa.handleListDeliveries).Methods("GET")
+	r.HandleFunc("/admin/deliveries/{delivery}/retry", aa.handleRetryDelivery).Methods("POST")
+	r.HandleFunc("/admin/deliveries/{delivery}", aa.handleDiscardDelivery).Methods("DELETE")
+	r.HandleFunc("/admin/consistency", aa.handleConsistencyReport).Methods("GET")
+	r.HandleFunc("/admin/consistency", aa.handleStartConsistencyCheck).Methods("POST")
+}
+
+// NewAdminAPI creates an API for reporting the use of deprecated features,
+// for inspecting the queue of query callbacks and alerts awaiting delivery,
+// for consistency checks once enabled with EnableConsistencyChecks, and, if
+// given a raw data API, for administering the permissions of API keys
+// for the campaigns in its raw data store and rewrapping their data keys.
+func NewAdminAPI(config *pto3.PTOConfiguration, azr *APIKeyAuthorizer, ra *RawAPI, r *mux.Router) *AdminAPI {
+	aa := new(AdminAPI)
+	aa.config = config
+	aa.azr = azr
+	if ra != nil {
+		aa.rds = ra.rds
+	}
+
+	aa.addRoutes(r)
+
+	return aa
+}
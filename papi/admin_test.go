@@ -0,0 +1,395 @@
+package papi_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+	"github.com/mami-project/pto3-go/papi"
+)
+
+type testPermissionChangeRequest struct {
+	Key         string            `json:"key"`
+	Action      string            `json:"action"`
+	Permissions []string          `json:"permissions"`
+	Campaigns   string            `json:"campaigns,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	DryRun      bool              `json:"dry_run"`
+}
+
+type testPermissionChangeResult struct {
+	Campaigns []string `json:"campaigns"`
+	Changes   []struct {
+		Permission string `json:"permission"`
+		Granted    bool   `json:"granted"`
+	} `json:"changes"`
+}
+
+func TestAdminPermissions(t *testing.T) {
+	// create campaigns with different owners
+	for camname, owner := range map[string]string{"permtest-a": "alice@mami-project.eu", "permtest-b": "bob@mami-project.eu"} {
+		if err := os.Mkdir(filepath.Join(TestConfig.RawRoot, camname), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := json.Marshal(testCampaignMetadata{FileType: "test", Owner: owner, Description: "A campaign to exercise bulk permission changes"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(filepath.Join(TestConfig.RawRoot, camname, pto3.CampaignMetadataFilename), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	changePermissions := func(pcr testPermissionChangeRequest, campaigns int, changes int) {
+		res := executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/admin/permissions", pcr, GoodAPIKey, http.StatusOK)
+
+		var result testPermissionChangeResult
+		if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result.Campaigns) != campaigns {
+			t.Fatalf("%s (dry run %v) expected %d campaigns, got %v", pcr.Action, pcr.DryRun, campaigns, result.Campaigns)
+		}
+
+		if len(result.Changes) != changes {
+			t.Fatalf("%s (dry run %v) expected %d changes, got %v", pcr.Action, pcr.DryRun, changes, result.Changes)
+		}
+
+		for _, change := range result.Changes {
+			if change.Granted != (pcr.Action == "grant") {
+				t.Fatalf("%s reported change %v", pcr.Action, change)
+			}
+		}
+	}
+
+	pcr := testPermissionChangeRequest{
+		Key:         OtherAPIKey,
+		Action:      "grant",
+		Permissions: []string{"read_raw", "write_raw"},
+		Campaigns:   "permtest-*",
+		DryRun:      true,
+	}
+
+	// dry runs don't change anything
+	changePermissions(pcr, 2, 4)
+	changePermissions(pcr, 2, 4)
+
+	// grant to campaigns by one owner
+	pcr.Owner = "alice@mami-project.eu"
+	pcr.DryRun = false
+	changePermissions(pcr, 1, 2)
+	changePermissions(pcr, 1, 0)
+
+	// now only the other campaign is left to grant
+	pcr.Owner = ""
+	pcr.DryRun = true
+	changePermissions(pcr, 2, 2)
+
+	// revoke one permission everywhere
+	pcr.Action = "revoke"
+	pcr.Permissions = []string{"write_raw"}
+	pcr.DryRun = false
+	changePermissions(pcr, 2, 1)
+	changePermissions(pcr, 2, 0)
+
+	pcr.Permissions = []string{"read_raw"}
+	changePermissions(pcr, 2, 1)
+
+	// bad requests
+	bad := pcr
+	bad.Action = "promote"
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/admin/permissions", bad, GoodAPIKey, http.StatusBadRequest)
+
+	bad = pcr
+	bad.Permissions = []string{"delete_obs"}
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/admin/permissions", bad, GoodAPIKey, http.StatusBadRequest)
+
+	bad = pcr
+	bad.Campaigns = "permtest-["
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/admin/permissions", bad, GoodAPIKey, http.StatusBadRequest)
+
+	bad = pcr
+	bad.Key = "0bad0bad0bad"
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/admin/permissions", bad, GoodAPIKey, http.StatusNotFound)
+
+	// only administrators can change permissions
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/admin/permissions", pcr, OtherAPIKey, http.StatusForbidden)
+}
+
+func TestChangePermissionsSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pto3-test-apikeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "apikeys.json")
+	if err := ioutil.WriteFile(filename, []byte(`{"default": {}, "`+OtherAPIKey+`": {"read_obs": true}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	azr, err := papi.LoadAPIKeys(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", TestAPIURL+"/", nil)
+	req.Header.Set("Authorization", "APIKEY "+OtherAPIKey)
+
+	// changes are saved, and take effect
+	if _, err := azr.ChangePermissions(OtherAPIKey, []string{"read_raw:test"}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if !azr.HasPermission(req, "read_raw:test") {
+		t.Fatal("granted permission not in effect")
+	}
+
+	saved, err := papi.LoadAPIKeys(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.APIKeys[OtherAPIKey]["read_raw:test"] {
+		t.Fatalf("granted permission not saved: %v", saved.APIKeys)
+	}
+
+	// changes which can't be saved don't take effect
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := azr.ChangePermissions(OtherAPIKey, []string{"read_raw:test"}, false, false); err == nil {
+		t.Fatal("changed permissions without saving them")
+	}
+	if !azr.HasPermission(req, "read_raw:test") {
+		t.Fatal("unsaved revocation in effect")
+	}
+}
+
+func TestDeprecations(t *testing.T) {
+	// the underscore form of the route is not deprecated
+	res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by_metadata?k=deprecation_test", nil, "", GoodAPIKey, http.StatusOK)
+	if res.Header().Get("Deprecation") != "" {
+		t.Fatalf("unexpected Deprecation header %s", res.Header().Get("Deprecation"))
+	}
+
+	// the hyphen form is, in the test configuration
+	for i := 0; i < 3; i++ {
+		res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by-metadata?k=deprecation_test", nil, "", OtherAPIKey, http.StatusOK)
+	}
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by-metadata?k=deprecation_test", nil, "", GoodAPIKey, http.StatusOK)
+
+	if dep := res.Header().Get("Deprecation"); dep != "@1767225600" {
+		t.Fatalf("expected Deprecation header @1767225600, got %s", dep)
+	}
+	if sunset := res.Header().Get("Sunset"); sunset != "Fri, 01 Jan 2027 00:00:00 GMT" {
+		t.Fatalf("unexpected Sunset header %s", sunset)
+	}
+	if link := res.Header().Get("Link"); link != "<https://ptotest.mami-project.eu/static/deprecations.html>; rel=\"deprecation\"" {
+		t.Fatalf("unexpected Link header %s", link)
+	}
+
+	// usage is reported by client, most frequent first
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/admin/deprecations", nil, "", GoodAPIKey, http.StatusOK)
+
+	var report struct {
+		Deprecations []struct {
+			Feature string                  `json:"feature"`
+			Usage   []pto3.DeprecationUsage `json:"usage"`
+		} `json:"deprecations"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Deprecations) != 1 || report.Deprecations[0].Feature != "GET /obs/by-metadata" {
+		t.Fatalf("unexpected deprecation report %v", report)
+	}
+	usage := report.Deprecations[0].Usage
+	otherHash := sha256.Sum256([]byte(OtherAPIKey))
+	if len(usage) != 2 || usage[0].Client != hex.EncodeToString(otherHash[:8]) || usage[0].Count != 3 || usage[1].Count != 1 {
+		t.Fatalf("unexpected deprecation usage %v", usage)
+	}
+
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/admin/deprecations", nil, "", OtherAPIKey, http.StatusForbidden)
+}
+
+type testDeliveryList struct {
+	Pending []struct {
+		ID string `json:"id"`
+	} `json:"pending"`
+	Dead []struct {
+		ID        string `json:"id"`
+		Attempts  int    `json:"attempts"`
+		LastError string `json:"last_error"`
+	} `json:"dead"`
+}
+
+func TestAdminDeliveries(t *testing.T) {
+	// a receiver which is down until told otherwise
+	var up int32
+	received := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		received <- string(b)
+	}))
+	defer srv.Close()
+
+	listDeliveries := func() testDeliveryList {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/admin/deliveries", nil, "", GoodAPIKey, http.StatusOK)
+
+		var list testDeliveryList
+		if err := json.Unmarshal(res.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+
+	dq, err := TestConfig.DeliveryQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dq.Enqueue(srv.URL, "test notification", map[string]string{"test": "delivery"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the test configuration allows a single attempt, after which the
+	// delivery is a dead letter
+	var list testDeliveryList
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if list = listDeliveries(); len(list.Dead) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed delivery not dead-lettered: %+v", list)
+		}
+	}
+
+	if len(list.Pending) != 0 || len(list.Dead) != 1 {
+		t.Fatalf("expected a single dead letter, got %+v", list)
+	}
+	if list.Dead[0].Attempts != 1 || !strings.Contains(list.Dead[0].LastError, "503") {
+		t.Fatalf("dead letter does not record failed attempt: %+v", list.Dead[0])
+	}
+
+	// retrying requires permission
+	id := list.Dead[0].ID
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/admin/deliveries/"+id+"/retry", nil, "", OtherAPIKey, http.StatusForbidden)
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/admin/deliveries/0000/retry", nil, "", GoodAPIKey, http.StatusNotFound)
+
+	atomic.StoreInt32(&up, 1)
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/admin/deliveries/"+id+"/retry", nil, "", GoodAPIKey, http.StatusAccepted)
+
+	select {
+	case body := <-received:
+		if body != `{"test":"delivery"}` {
+			t.Fatalf("unexpected delivery %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retried delivery not delivered")
+	}
+
+	// delivered notifications leave the queue
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if list = listDeliveries(); len(list.Pending) == 0 && len(list.Dead) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delivered notification still queued: %+v", list)
+		}
+	}
+
+	executeRequest(TestRouter, t, "DELETE", TestAPIURL+"/admin/deliveries/"+id, nil, "", GoodAPIKey, http.StatusNotFound)
+}
+
+type testConsistencyStatus struct {
+	Running bool `json:"running"`
+	Last    *struct {
+		Finished      *time.Time         `json:"finished"`
+		SetsChecked   int                `json:"sets_checked"`
+		Discrepancies []pto3.Discrepancy `json:"discrepancies"`
+	} `json:"last"`
+}
+
+func TestAdminConsistency(t *testing.T) {
+	// a bundle naming a set which does not exist
+	camdir := filepath.Join(TestConfig.RawRoot, "consistency-test")
+	if err := os.Mkdir(camdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(testCampaignMetadata{FileType: pto3.ObsBundleFiletype, Owner: "ptotest@mami-project.eu", Description: "A campaign to exercise consistency checks"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(camdir, pto3.CampaignMetadataFilename), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = json.Marshal(map[string]string{
+		"_time_start":               "2017-10-01T10:00:00Z",
+		"_time_end":                 "2017-10-01T11:00:00Z",
+		pto3.ArchivedSetMetadataKey: TestAPIURL + "/obs/fffffff",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(camdir, "orphan.ndjson"+pto3.FileMetadataSuffix), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(camdir, "orphan.ndjson"), []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// checking requires permission
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/admin/consistency", nil, "", OtherAPIKey, http.StatusForbidden)
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/admin/consistency", nil, "", OtherAPIKey, http.StatusForbidden)
+
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/admin/consistency", nil, "", GoodAPIKey, http.StatusAccepted)
+
+	var status testConsistencyStatus
+	for deadline := time.Now().Add(30 * time.Second); ; time.Sleep(50 * time.Millisecond) {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/admin/consistency", nil, "", GoodAPIKey, http.StatusOK)
+		status = testConsistencyStatus{}
+		if err := json.Unmarshal(res.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.Running && status.Last != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("consistency check did not finish: %s", res.Body.Bytes())
+		}
+	}
+
+	if status.Last.Finished == nil || status.Last.SetsChecked == 0 {
+		t.Fatalf("incomplete consistency report %+v", status.Last)
+	}
+
+	found := false
+	for _, d := range status.Last.Discrepancies {
+		if d.Kind == pto3.DiscrepancyMissingDerivedSet && d.Subject == TestAPIURL+"/raw/consistency-test/orphan.ndjson" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("orphaned bundle not reported: %+v", status.Last.Discrepancies)
+	}
+}
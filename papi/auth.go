@@ -7,7 +7,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
 )
 
 // For now, all capabilities are authorized.
@@ -22,24 +28,33 @@ import (
 
 type Authorizer interface {
 	IsAuthorized(http.ResponseWriter, *http.Request, string) bool
+
+	// HasPermission determines whether a HTTP request is authorized for a
+	// given permission, without filling in a response, e.g. to decide what
+	// to show the client rather than whether to serve it at all.
+	HasPermission(*http.Request, string) bool
 }
 
 type APIKeyAuthorizer struct {
 	// Map of API key strings to maps of permission strings to boolean permissions
 	APIKeys map[string]map[string]bool
+	// File API keys were loaded from, to which changes are saved
+	filename string
+	// Lock protecting API keys from concurrent changes
+	lock sync.RWMutex
+	// Log of authorization decisions, if they are logged
+	decisions *pto3.AuthLog
 }
 
-func (azr *APIKeyAuthorizer) IsAuthorized(w http.ResponseWriter, r *http.Request, permission string) bool {
+// decide determines whether the client making a request is granted a
+// permission: by the key the request presents, if any, if it mentions the
+// permission, otherwise by the default key. It returns the decision and the
+// pto3.AuthRule it was made by, and an error if the Authorization header is
+// malformed or of an unsupported type.
+func (azr *APIKeyAuthorizer) decide(r *http.Request, permission string) (bool, string, error) {
 
-	// load defaults from apikeys if present
-	perms := map[string]bool{}
-
-	defperms := azr.APIKeys["default"]
-	if defperms != nil {
-		for k, v := range defperms {
-			perms[k] = v
-		}
-	}
+	azr.lock.RLock()
+	defer azr.lock.RUnlock()
 
 	// look for an authorization header
 	authhdr := r.Header.Get("Authorization")
@@ -49,31 +64,92 @@ func (azr *APIKeyAuthorizer) IsAuthorized(w http.ResponseWriter, r *http.Request
 		authfield := strings.Fields(authhdr)
 
 		if len(authfield) < 2 {
-			http.Error(w, fmt.Sprintf("malformed Authorization header: %v", authhdr), http.StatusBadRequest)
-			return false
+			return false, pto3.AuthRuleMalformed, fmt.Errorf("malformed Authorization header: %v", authhdr)
 		} else if authfield[0] == "APIKEY" {
-			keyperms := azr.APIKeys[authfield[1]]
-			if keyperms != nil {
-				// update permissions with those for the presented key
-				for k, v := range keyperms {
-					perms[k] = v
-				}
+			// permissions for the presented key override the defaults
+			if granted, ok := azr.APIKeys[authfield[1]][permission]; ok {
+				return granted, pto3.AuthRuleKey, nil
 			}
 		} else {
-			http.Error(w, fmt.Sprintf("unsupported authorization type %s", authfield[0]), http.StatusBadRequest)
-			return false
+			return false, pto3.AuthRuleMalformed, fmt.Errorf("unsupported authorization type %s", authfield[0])
 		}
 	}
 
-	if perms[permission] {
+	if granted, ok := azr.APIKeys["default"][permission]; ok {
+		return granted, pto3.AuthRuleDefault, nil
+	}
+
+	return false, pto3.AuthRuleNone, nil
+}
+
+// clientForRequest identifies the client making a request as
+// submitterForRequest does, if it presents an API key known to this
+// authorizer, and otherwise as "default", so that clients cannot escape
+// limits on the default key by presenting made-up keys.
+func (azr *APIKeyAuthorizer) clientForRequest(r *http.Request) string {
+	authfield := strings.Fields(r.Header.Get("Authorization"))
+	if len(authfield) < 2 || authfield[0] != "APIKEY" || authfield[1] == "default" {
+		return "default"
+	}
+
+	azr.lock.RLock()
+	_, ok := azr.APIKeys[authfield[1]]
+	azr.lock.RUnlock()
+	if !ok {
+		return "default"
+	}
+
+	return submitterForRequest(r)
+}
+
+// LogDecisionsTo logs every authorization decision this authorizer makes to
+// the given authorization decision log, or stops logging them if nil.
+func (azr *APIKeyAuthorizer) LogDecisionsTo(al *pto3.AuthLog) {
+	azr.decisions = al
+}
+
+// logDecision logs an authorization decision, if decisions are logged.
+func (azr *APIKeyAuthorizer) logDecision(r *http.Request, permission string, allowed bool, rule string) {
+	if azr.decisions == nil {
+		return
+	}
+
+	azr.decisions.Log(&pto3.AuthDecision{
+		Time:       time.Now().UTC(),
+		APIKeyID:   submitterForRequest(r),
+		Permission: permission,
+		Method:     r.Method,
+		Resource:   r.URL.Path,
+		Allowed:    allowed,
+		Rule:       rule,
+		RequestID:  requestIDForRequest(r),
+	})
+}
+
+func (azr *APIKeyAuthorizer) IsAuthorized(w http.ResponseWriter, r *http.Request, permission string) bool {
+
+	allowed, rule, err := azr.decide(r, permission)
+	azr.logDecision(r, permission, allowed, rule)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+
+	if allowed {
 		return true
 	} else {
-		http.Error(w, fmt.Sprintf("not authorized for %s", permission), http.StatusForbidden)
+		pto3.HTTPError(w, fmt.Sprintf("not authorized for %s", permission), http.StatusForbidden)
 		return false
 	}
 
 }
 
+func (azr *APIKeyAuthorizer) HasPermission(r *http.Request, permission string) bool {
+	allowed, rule, err := azr.decide(r, permission)
+	azr.logDecision(r, permission, allowed, rule)
+	return err == nil && allowed
+}
+
 func LoadAPIKeys(filename string) (*APIKeyAuthorizer, error) {
 	var azr APIKeyAuthorizer
 
@@ -86,12 +162,123 @@ func LoadAPIKeys(filename string) (*APIKeyAuthorizer, error) {
 	if err != nil {
 		return nil, err
 	}
+	azr.filename = filename
 
 	return &azr, nil
 }
 
+// PermissionChange describes a permission granted to or revoked from an API
+// key by ChangePermissions.
+type PermissionChange struct {
+	Permission string `json:"permission"`
+	Granted    bool   `json:"granted"`
+}
+
+// ChangePermissions grants or revokes a set of permissions for an API key in
+// one operation, returning the permissions actually changed. Revoked
+// permissions are removed from the key, or explicitly denied if the default
+// key grants them. Unless dryRun is set, changes are saved to the file the API
+// keys were loaded from, if any, before they take effect, so that they take
+// effect only if saved.
+func (azr *APIKeyAuthorizer) ChangePermissions(key string, permissions []string, grant bool, dryRun bool) ([]PermissionChange, error) {
+	azr.lock.Lock()
+	defer azr.lock.Unlock()
+
+	keyperms, ok := azr.APIKeys[key]
+	if !ok {
+		return nil, pto3.PTONotFoundError("API key", key)
+	}
+
+	defperms := azr.APIKeys["default"]
+
+	// change a copy of the key's permissions
+	newperms := make(map[string]bool, len(keyperms))
+	for permission, granted := range keyperms {
+		newperms[permission] = granted
+	}
+
+	changes := make([]PermissionChange, 0)
+	for _, permission := range permissions {
+		granted := newperms[permission]
+		if _, ok := newperms[permission]; !ok && key != "default" {
+			granted = defperms[permission]
+		}
+		if granted == grant {
+			continue
+		}
+
+		changes = append(changes, PermissionChange{Permission: permission, Granted: grant})
+
+		if grant {
+			newperms[permission] = true
+		} else if key != "default" && defperms[permission] {
+			newperms[permission] = false
+		} else {
+			delete(newperms, permission)
+		}
+	}
+
+	if dryRun || len(changes) == 0 {
+		return changes, nil
+	}
+
+	if azr.filename != "" {
+		newkeys := make(map[string]map[string]bool, len(azr.APIKeys))
+		for k, perms := range azr.APIKeys {
+			newkeys[k] = perms
+		}
+		newkeys[key] = newperms
+
+		if err := azr.save(newkeys); err != nil {
+			return nil, pto3.PTOWrapError(err)
+		}
+	}
+
+	azr.APIKeys[key] = newperms
+	return changes, nil
+}
+
+// save writes the given API keys to the file API keys were loaded from,
+// replacing it atomically. The caller must hold the lock.
+func (azr *APIKeyAuthorizer) save(keys map[string]map[string]bool) error {
+	b, err := json.MarshalIndent(keys, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(azr.filename)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(azr.filename), ".apikeys")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(fi.Mode()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), azr.filename)
+}
+
 type NullAuthorizer struct{}
 
 func (azr *NullAuthorizer) IsAuthorized(w http.ResponseWriter, r *http.Request, permission string) bool {
 	return false
 }
+
+func (azr *NullAuthorizer) HasPermission(r *http.Request, permission string) bool {
+	return false
+}
@@ -0,0 +1,138 @@
+package papi
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+type ChangesAPI struct {
+	config  *pto3.PTOConfiguration
+	azr     Authorizer
+	journal *pto3.ChangeJournal
+}
+
+// recordChange records a change to a resource at the given path, relative to
+// the base URL, in the change journal, if one is configured. Since the change
+// has already been made, failure to record it is logged rather than returned
+// to the client.
+func recordChange(config *pto3.PTOConfiguration, store string, changeType string, relative string) {
+	journal, err := config.ChangeJournal()
+	if err != nil {
+		log.Printf("cannot open change journal: %s", err.Error())
+		return
+	}
+
+	link, _ := config.LinkTo(relative)
+	if err := journal.Record(store, changeType, link); err != nil {
+		log.Printf("cannot record %s of %s in change journal: %s", changeType, link, err.Error())
+	}
+}
+
+type journalList struct {
+	Changes []pto3.JournalEntry `json:"changes"`
+	Next    int64               `json:"next"`
+	Reset   bool                `json:"reset"`
+}
+
+// handleChanges handles GET /changes, returning changes to the raw data
+// store, observation store, and query cache after the sequence number given
+// in the since parameter, up to the number given in the limit parameter. If
+// there are none, it waits until there are, or until the number of seconds
+// given in the timeout parameter elapse. It writes a JSON object to the
+// response with the keys "changes", an array of changes; "next", the sequence
+// number to use as since in the next request; and "reset", true if the
+// journal has been replaced and the client should resynchronize from zero.
+func (ca *ChangesAPI) handleChanges(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !ca.azr.IsAuthorized(w, r, "read_changes") {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	var since int64
+	if sincestr := r.Form.Get("since"); sincestr != "" {
+		var err error
+		if since, err = strconv.ParseInt(sincestr, 10, 64); err != nil || since < 0 {
+			pto3.HTTPError(w, fmt.Sprintf("bad since %s", sincestr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := ca.config.PageLength
+	if limitstr := r.Form.Get("limit"); limitstr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitstr); err != nil || limit < 1 || limit > ca.config.PageLength {
+			pto3.HTTPError(w, fmt.Sprintf("bad limit %s, must be between 1 and %d", limitstr, ca.config.PageLength), http.StatusBadRequest)
+			return
+		}
+	}
+
+	timeout := defaultChangesTimeout
+	if timeoutstr := r.Form.Get("timeout"); timeoutstr != "" {
+		var err error
+		if timeout, err = strconv.Atoi(timeoutstr); err != nil || timeout < 0 || timeout > maxChangesTimeout {
+			pto3.HTTPError(w, fmt.Sprintf("bad timeout %s, must be between 0 and %d", timeoutstr, maxChangesTimeout), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var out journalList
+	var err error
+	out.Changes, out.Next, out.Reset, err = ca.journal.Since(since, limit, time.Duration(timeout)*time.Second)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "reading change journal", err)
+		return
+	}
+
+	b, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling changes", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ca.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func (ca *ChangesAPI) additionalHeaders(w http.ResponseWriter) {
+	if ca.config.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", ca.config.AllowOrigin)
+	}
+}
+
+func (ca *ChangesAPI) addRoutes(r *mux.Router) {
+	r.HandleFunc("/changes", ca.handleChanges).Methods("GET")
+}
+
+func NewChangesAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) (*ChangesAPI, error) {
+	journal, err := config.ChangeJournal()
+	if err != nil {
+		return nil, err
+	}
+	if journal == nil {
+		return nil, nil
+	}
+
+	ca := new(ChangesAPI)
+	ca.config = config
+	ca.azr = azr
+	ca.journal = journal
+
+	ca.addRoutes(r)
+
+	return ca, nil
+}
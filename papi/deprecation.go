@@ -0,0 +1,46 @@
+package papi
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// markDeprecated adds Deprecation, Sunset, and Link headers to the response
+// and counts the use if the named feature is deprecated in the
+// configuration. It must be called before the response header is written.
+func markDeprecated(config *pto3.PTOConfiguration, w http.ResponseWriter, r *http.Request, feature string) {
+	dep := config.Deprecation(feature)
+	if dep == nil {
+		return
+	}
+
+	// see RFC 9745 and RFC 8594
+	w.Header().Set("Deprecation", fmt.Sprintf("@%d", dep.Since.Unix()))
+	if dep.Sunset != nil {
+		w.Header().Set("Sunset", dep.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if dep.Link != "" {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"", dep.Link))
+	}
+
+	config.DeprecationTracker().Record(feature, submitterForRequest(r))
+}
+
+// DeprecationMiddleware returns middleware which marks requests to
+// deprecated routes, named by method and path template (e.g. "GET
+// /obs/by_metadata") in the configuration's Deprecations.
+func DeprecationMiddleware(config *pto3.PTOConfiguration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					markDeprecated(config, w, r, r.Method+" "+tmpl)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package papi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// etagFor returns a strong entity tag for a response body, derived from its
+// content.
+func etagFor(b []byte) string {
+	d := sha256.Sum256(b)
+	return "\"" + hex.EncodeToString(d[:16]) + "\""
+}
+
+// etagMatches returns true if an If-None-Match header value matches the given
+// entity tag. Weak tags match their strong counterparts, as RFC 7232 requires
+// for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeCacheable writes a response body with status 200 and an ETag derived
+// from its content, so that clients can cache the resource and revalidate it
+// with If-None-Match. If the request's If-None-Match matches, it writes status
+// 304 Not Modified without a body instead. Responses may be cached by the
+// client, but not by shared caches, and must be revalidated before reuse.
+// Other headers must be set before calling writeCacheable.
+func writeCacheable(w http.ResponseWriter, r *http.Request, b []byte) {
+	etag := etagFor(b)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
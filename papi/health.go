@@ -0,0 +1,39 @@
+package papi
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// obsDatabasePrefixes lists the path prefixes of the APIs which need the
+// observation database.
+var obsDatabasePrefixes = []string{"/obs", "/query", "/stats"}
+
+// ObsDatabaseMiddleware returns middleware which fails requests to the APIs
+// needing the observation database with 503 Service Unavailable and a
+// Retry-After header while the configuration's ObsDatabaseHealth considers
+// the database unavailable, rather than letting each request wait for its
+// own connection attempts to fail.
+func ObsDatabaseMiddleware(config *pto3.PTOConfiguration) mux.MiddlewareFunc {
+	health := config.ObsDatabaseHealth()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, prefix := range obsDatabasePrefixes {
+				if !strings.HasPrefix(r.URL.Path, prefix) {
+					continue
+				}
+				if err := health.Available(); err != nil {
+					w.Header().Set("Retry-After", fmt.Sprintf("%d", int(health.RetryAfter().Seconds())))
+					pto3.HandleErrorHTTP(w, "checking observation database", err)
+					return
+				}
+				break
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
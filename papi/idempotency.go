@@ -0,0 +1,231 @@
+package papi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// IdempotencyKeyHeader is the request header clients use to mark a write
+// request as safe to retry.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentResponse stores a response to a write request, for replay to
+// clients retrying the same request with the same idempotency key.
+type idempotentResponse struct {
+	fingerprint string
+	status      int
+	header      http.Header
+	body        []byte
+	done        bool
+	expires     time.Time
+}
+
+// RecordingResponseWriter wraps a ResponseWriter, keeping a copy of the
+// status and body written to it.
+type RecordingResponseWriter struct {
+	w      http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *RecordingResponseWriter) Header() http.Header {
+	return rw.w.Header()
+}
+
+func (rw *RecordingResponseWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.w.WriteHeader(status)
+}
+
+func (rw *RecordingResponseWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.w.Write(b)
+}
+
+// IdempotencyCache caches responses to write requests carrying an
+// Idempotency-Key header, so that a client retrying a request after a
+// timeout gets the original response instead of creating a duplicate set or
+// ingesting the same data twice. Only successful responses are cached;
+// failed requests may be retried with the same key.
+type IdempotencyCache struct {
+	// How long to keep responses around
+	lifetime time.Duration
+
+	// Largest number of responses kept, including requests in progress
+	size int
+
+	// Responses by scoped key
+	responses map[string]*idempotentResponse
+
+	// Lock on responses
+	lock sync.Mutex
+}
+
+// NewIdempotencyCache creates a new idempotency cache retaining at most size
+// responses for the given lifetime.
+func NewIdempotencyCache(lifetime time.Duration, size int) *IdempotencyCache {
+	return &IdempotencyCache{
+		lifetime:  lifetime,
+		size:      size,
+		responses: make(map[string]*idempotentResponse),
+	}
+}
+
+// scopedKey scopes an idempotency key to the credentials of the request, so
+// that different clients cannot collide.
+func scopedKey(r *http.Request, key string) string {
+	h := sha256.New()
+	h.Write([]byte(r.Header.Get("Authorization") + "\n" + key))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// teeReadCloser reads through a reader copying a body elsewhere, and closes
+// the body.
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// expire removes expired responses. Caller must hold the lock.
+func (ic *IdempotencyCache) expire(now time.Time) {
+	for k, resp := range ic.responses {
+		if resp.done && now.After(resp.expires) {
+			delete(ic.responses, k)
+		}
+	}
+}
+
+// evict removes the response which would expire first, to make room for
+// another, returning false if there is none as all requests are still in
+// progress. Caller must hold the lock.
+func (ic *IdempotencyCache) evict() bool {
+	var evictKey string
+	var evictResp *idempotentResponse
+	for k, resp := range ic.responses {
+		if resp.done && (evictResp == nil || resp.expires.Before(evictResp.expires)) {
+			evictKey, evictResp = k, resp
+		}
+	}
+	if evictResp == nil {
+		return false
+	}
+	delete(ic.responses, evictKey)
+	return true
+}
+
+// Idempotent wraps a handler for a write request. Requests without an
+// Idempotency-Key header are passed through unchanged. A request carrying a
+// key already seen replays the original response, if it has the same method,
+// path, query, and body as the original, and is refused with 422
+// Unprocessable Entity otherwise; one arriving while the original is still
+// in progress is refused with 409 Conflict. When the cache is full of
+// requests in progress, requests with a new key are refused with 503
+// Service Unavailable.
+func (ic *IdempotencyCache) Idempotent(handler HandlerFunc) HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			handler(w, r)
+			return
+		}
+		skey := scopedKey(r, key)
+
+		// fingerprint the request, so that reuse of a key for a different
+		// request can be detected
+		fingerprint := sha256.New()
+		io.WriteString(fingerprint, r.Method+"\n"+r.URL.RequestURI()+"\n")
+
+		ic.lock.Lock()
+		ic.expire(time.Now())
+		resp, ok := ic.responses[skey]
+		if !ok {
+			if len(ic.responses) >= ic.size && !ic.evict() {
+				ic.lock.Unlock()
+				w.Header().Set("Retry-After", "1")
+				pto3.HTTPError(w, "too many requests with an Idempotency-Key in progress", http.StatusServiceUnavailable)
+				return
+			}
+
+			// first time we've seen this key, reserve it
+			ic.responses[skey] = &idempotentResponse{}
+		}
+		ic.lock.Unlock()
+
+		if ok {
+			if !resp.done {
+				pto3.HTTPError(w, "request with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			}
+
+			if _, err := io.Copy(fingerprint, r.Body); err != nil {
+				pto3.HTTPError(w, "error reading request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if hex.EncodeToString(fingerprint.Sum(nil)) != resp.fingerprint {
+				pto3.HTTPError(w, "Idempotency-Key already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+
+			for k, v := range resp.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(resp.status)
+			w.Write(resp.body)
+			return
+		}
+
+		// release the reservation unless a response is stored, even if the
+		// handler panics, so that the client can retry
+		stored := false
+		defer func() {
+			if !stored {
+				ic.lock.Lock()
+				delete(ic.responses, skey)
+				ic.lock.Unlock()
+			}
+		}()
+
+		r.Body = teeReadCloser{io.TeeReader(r.Body, fingerprint), r.Body}
+		rw := RecordingResponseWriter{w: w}
+		handler(&rw, r)
+
+		// don't cache failures, let the client retry
+		if rw.status < 200 || rw.status >= 300 {
+			return
+		}
+
+		// fingerprint any of the body the handler didn't read
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			return
+		}
+
+		header := make(http.Header)
+		for k, v := range w.Header() {
+			header[k] = v
+		}
+
+		ic.lock.Lock()
+		ic.responses[skey] = &idempotentResponse{
+			fingerprint: hex.EncodeToString(fingerprint.Sum(nil)),
+			status:      rw.status,
+			header:      header,
+			body:        rw.body.Bytes(),
+			done:        true,
+			expires:     time.Now().Add(ic.lifetime),
+		}
+		ic.lock.Unlock()
+		stored = true
+	}
+}
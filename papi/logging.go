@@ -1,9 +1,16 @@
 package papi
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
+	"net"
 	"net/http"
 	"time"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
 )
 
 type LoggingResponseWriter struct {
@@ -31,12 +38,94 @@ func (lw *LoggingResponseWriter) Write(b []byte) (int, error) {
 
 type HandlerFunc func(http.ResponseWriter, *http.Request)
 
-func LogAccess(l *log.Logger, handler HandlerFunc) HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		lw := LoggingResponseWriter{w: w}
-		start := time.Now()
-		handler(&lw, r)
-		duration := time.Since(start)
-		l.Printf("%s %s %d %d %v", r.Method, r.URL.String(), lw.length, lw.status, duration)
+// AccessLogMiddleware returns middleware which logs every request to the
+// configuration's access log, in its configured format, once it has been
+// handled. It wraps the whole router, so that requests matching no route are
+// logged too.
+func AccessLogMiddleware(config *pto3.PTOConfiguration) func(http.Handler) http.Handler {
+	al := config.AccessLog()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			lw := LoggingResponseWriter{w: w}
+			start := time.Now()
+			next.ServeHTTP(&lw, r)
+			duration := time.Since(start)
+
+			// handlers which never call WriteHeader respond 200 implicitly
+			status := lw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			remote := r.RemoteAddr
+			if host, _, err := net.SplitHostPort(remote); err == nil {
+				remote = host
+			}
+
+			al.Log(&pto3.AccessLogRecord{
+				Time:       start,
+				RemoteAddr: remote,
+				Method:     r.Method,
+				URL:        r.URL.String(),
+				Proto:      r.Proto,
+				Status:     status,
+				Length:     lw.length,
+				Duration:   duration,
+				APIKeyID:   submitterForRequest(r),
+				RequestID:  w.Header().Get(pto3.RequestIDHeader),
+				Referer:    r.Referer(),
+				UserAgent:  r.UserAgent(),
+			})
+		})
+	}
+}
+
+// maxRequestIDLength is the length of the longest request ID accepted from a
+// client.
+const maxRequestIDLength = 64
+
+// validRequestID returns true if a request ID from a client is short and
+// plain enough to be echoed in responses and logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDKey is the request context key of the ID of a request.
+type requestIDKey struct{}
+
+// requestIDForRequest returns the ID RequestIDMiddleware identified a
+// request by, or the empty string if it did not pass through it.
+func requestIDForRequest(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDMiddleware returns middleware which identifies every request by
+// the ID in its X-Request-Id header, if it has a valid one, or by a new
+// random ID otherwise, and sets the header on the response, so that error
+// responses and server logs can be matched up. Handlers find the ID with
+// requestIDForRequest.
+func RequestIDMiddleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(pto3.RequestIDHeader)
+			if !validRequestID(id) {
+				b := make([]byte, 8)
+				if _, err := rand.Read(b); err != nil {
+					log.Printf("cannot generate request ID: %v", err)
+				}
+				id = hex.EncodeToString(b)
+			}
+			w.Header().Set(pto3.RequestIDHeader, id)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		})
 	}
 }
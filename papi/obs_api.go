@@ -1,14 +1,20 @@
 package papi
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/go-pg/pg"
 	"github.com/gorilla/mux"
@@ -19,6 +25,24 @@ type ObsAPI struct {
 	config *pto3.PTOConfiguration
 	azr    Authorizer
 	db     *pg.DB
+	ic     *IdempotencyCache
+	rds    *pto3.RawDataStore
+
+	// query cache whose conditions are reloaded when conditions are
+	// renamed or aliased, if any
+	qc *pto3.QueryCache
+
+	// connection for downloading observation data; the replica of the
+	// observation database if one is configured, otherwise db
+	replica *pg.DB
+
+	// cached condition tree, the time it was loaded, whether it is being
+	// loaded, and the number of times it has been invalidated
+	condTree        []*pto3.ConditionNode
+	condTreeLoaded  time.Time
+	condTreeLoading bool
+	condTreeGen     int
+	condTreeLock    sync.Mutex
 }
 
 func (oa *ObsAPI) writeMetadataResponse(w http.ResponseWriter, set *pto3.ObservationSet, status int) {
@@ -57,12 +81,91 @@ func (sl *setList) MarshalJSON() ([]byte, error) {
 		out["prev"] = sl.Prev
 	}
 
+	if sl.TotalCount != 0 {
+		out["total_count"] = sl.TotalCount
+	}
+
 	return json.Marshal(out)
 }
 
-func (oa *ObsAPI) writeSetListResponse(w http.ResponseWriter, setIds []int, pageVal string) {
+// pageLink returns a link to a given page of the resource requested, keeping
+// all other parameters, so that pages of filtered lists remain filtered.
+func (oa *ObsAPI) pageLink(r *http.Request, page int) string {
+	params := make(url.Values)
+	for k, v := range r.Form {
+		params[k] = v
+	}
+	params.Set("page", strconv.Itoa(page))
+
+	link, _ := oa.config.LinkTo(r.URL.Path + "?" + params.Encode())
+	return link
+}
+
+// setReadable returns a function determining whether the client making a
+// request may read an observation set, given who may read it.
+func (oa *ObsAPI) setReadable(r *http.Request) func(*pto3.ObservationSetAccess) bool {
+	client := submitterForRequest(r)
+	hasPermission := func(permission string) bool {
+		return oa.azr.HasPermission(r, permission)
+	}
+	return func(acc *pto3.ObservationSetAccess) bool {
+		return acc.ReadableBy(client, hasPermission)
+	}
+}
+
+// checkSetReadable returns true if the client making a request may read the
+// observation set with the given ID. Otherwise, it fills in a 404 response,
+// so that clients cannot tell sets they may not read from sets which do not
+// exist, and returns false.
+func (oa *ObsAPI) checkSetReadable(w http.ResponseWriter, r *http.Request, setid int) bool {
+	set := pto3.ObservationSet{ID: setid}
+	acc, err := set.Access(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "checking set visibility", err)
+		return false
+	}
+
+	if !oa.setReadable(r)(acc) {
+		pto3.HTTPError(w, fmt.Sprintf("Observation set %x not found", setid), http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// filterReadableSetIds returns the IDs of those of the given observation sets
+// which the client making a request may read.
+func (oa *ObsAPI) filterReadableSetIds(r *http.Request, setIds []int) ([]int, error) {
+	restricted, err := pto3.RestrictedObservationSets(oa.db)
+	if err != nil {
+		return nil, err
+	}
+
+	readable := oa.setReadable(r)
+	out := make([]int, 0, len(setIds))
+	for _, id := range setIds {
+		if acc, ok := restricted[id]; !ok || readable(acc) {
+			out = append(out, id)
+		}
+	}
+	return out, nil
+}
+
+func (oa *ObsAPI) writeSetListResponse(w http.ResponseWriter, r *http.Request, setIds []int) {
+	// list only sets the client may read
+	setIds, err := oa.filterReadableSetIds(r, setIds)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "filtering set list", err)
+		return
+	}
+
+	oa.writeSetList(w, r, setIds)
+}
+
+// writeSetList writes a page of links to the given sets to the response,
+// whether or not the client may read them.
+func (oa *ObsAPI) writeSetList(w http.ResponseWriter, r *http.Request, setIds []int) {
 	// slice the array based on page
-	page64, _ := strconv.ParseInt(pageVal, 10, 64)
+	page64, _ := strconv.ParseInt(r.Form.Get("page"), 10, 64)
 	page := int(page64)
 	offset := page * oa.config.PageLength
 
@@ -72,15 +175,19 @@ func (oa *ObsAPI) writeSetListResponse(w http.ResponseWriter, setIds []int, page
 	if page > 0 || len(setIds) > (page+1)*oa.config.PageLength {
 
 		if len(setIds) > (page+1)*oa.config.PageLength {
-			out.Next, _ = oa.config.LinkTo(fmt.Sprintf("/obs?page=%d", page+1))
+			out.Next = oa.pageLink(r, page+1)
 			out.TotalCount = len(setIds)
 		}
 
 		if page > 0 {
-			out.Prev, _ = oa.config.LinkTo(fmt.Sprintf("/obs?page=%d", page-1))
+			out.Prev = oa.pageLink(r, page-1)
 			out.TotalCount = len(setIds)
 		}
 
+		if offset > len(setIds) {
+			offset = len(setIds)
+		}
+
 		endOffset := offset + oa.config.PageLength
 		if endOffset > len(setIds) {
 			endOffset = len(setIds)
@@ -108,7 +215,8 @@ func (oa *ObsAPI) writeSetListResponse(w http.ResponseWriter, setIds []int, page
 }
 
 // handleListSets handles GET /obs.
-// It returns a JSON object with links to current observation sets in the sets key.
+// It returns a JSON object with links to current observation sets in the sets
+// key. The list can be filtered with the same parameters as /obs/by_metadata.
 func (oa *ObsAPI) handleListSets(w http.ResponseWriter, r *http.Request) {
 
 	// fail if not authorized
@@ -117,19 +225,30 @@ func (oa *ObsAPI) handleListSets(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+		pto3.HTTPError(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+		return
 	}
 
-	// select set IDs into an array
-	setIds, err := pto3.AllObservationSetIDs(oa.db)
+	// select filtered set IDs, if any filters are given
+	setIds, queryActive, err := oa.selectSetIds(r.Form)
 	if err != nil {
-		pto3.HandleErrorHTTP(w, "listing set IDs", err)
+		pto3.HandleErrorHTTP(w, "selecting set IDs", err)
 		return
 	}
 
-	oa.writeSetListResponse(w, setIds, r.Form.Get("page"))
+	// otherwise select all set IDs
+	if !queryActive {
+		if setIds, err = pto3.AllObservationSetIDs(oa.db); err != nil {
+			pto3.HandleErrorHTTP(w, "listing set IDs", err)
+			return
+		}
+	}
+
+	oa.writeSetListResponse(w, r, setIds)
 }
 
+// intersectSetIds returns the IDs in both a and b, in the order of b, or b
+// if there are no sets selected yet.
 func intersectSetIds(a []int, b []int, hasSets bool) []int {
 	if hasSets {
 		out := make([]int, 0)
@@ -148,75 +267,76 @@ func intersectSetIds(a []int, b []int, hasSets bool) []int {
 	}
 }
 
-// handleMetadataQuery handles GET/POST /obs/by_metadata. It requires two
-// URL/form parameters: 'k', the key to search for, and 'v', the value to
-// search for.
-
-func (oa *ObsAPI) handleMetadataQuery(w http.ResponseWriter, r *http.Request) {
-	// fail if not authorized
-	if !oa.azr.IsAuthorized(w, r, "read_obs") {
-		return
+// parseTimeParam parses an optional RFC3339 timestamp parameter, returning
+// nil if it is not present.
+func parseTimeParam(form url.Values, param string) (*time.Time, error) {
+	tstr := form.Get(param)
+	if tstr == "" {
+		return nil, nil
 	}
 
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+	t, err := time.Parse(time.RFC3339, tstr)
+	if err != nil {
+		return nil, pto3.PTOErrorf("bad %s %s: must be an RFC3339 timestamp", param, tstr).StatusIs(http.StatusBadRequest)
 	}
+	return &t, nil
+}
 
+// selectSetIds selects the IDs of sets matching all the filter parameters in
+// a form: source, analyzer, condition, k (and optionally v), created_after,
+// created_before, time_start, time_end, and sealed, sorted by ID. It also
+// returns false if no filter parameters were given.
+func (oa *ObsAPI) selectSetIds(form url.Values) ([]int, bool, error) {
 	setIds := make([]int, 0)
 	queryActive := false
 
-	source := r.Form.Get("source")
+	source := form.Get("source")
 	if source != "" {
 		// handle source query
 		sourceSetIds, err := pto3.ObservationSetIDsWithSource(oa.db, source)
 		if err != nil {
-			pto3.HandleErrorHTTP(w, "selecting set IDs by source", err)
-			return
+			return nil, false, err
 		}
 		setIds = intersectSetIds(setIds, sourceSetIds, queryActive)
 		queryActive = true
 	}
 
-	analyzer := r.Form.Get("analyzer")
+	analyzer := form.Get("analyzer")
 	if analyzer != "" {
 		// handle analyzer query
 		analyzerSetIds, err := pto3.ObservationSetIDsWithAnalyzer(oa.db, analyzer)
 		if err != nil {
-			pto3.HandleErrorHTTP(w, "selecting set IDs by analyzer", err)
-			return
+			return nil, false, err
 		}
 		setIds = intersectSetIds(setIds, analyzerSetIds, queryActive)
 		queryActive = true
 	}
 
-	condition := r.Form.Get("condition")
+	condition := form.Get("condition")
 	if condition != "" {
 		// create condition caches
 		cidCache, err := pto3.LoadConditionCache(oa.db)
 		if err != nil {
-			pto3.HandleErrorHTTP(w, "loading condition cache", err)
-			return
+			return nil, false, err
 		}
 
 		// handle condition query
 		conditionSetIds, err := pto3.ObservationSetIDsWithCondition(oa.db, cidCache, condition)
 		if err != nil {
-			pto3.HandleErrorHTTP(w, "selecting set IDs by condition", err)
-			return
+			return nil, false, err
 		}
 		setIds = intersectSetIds(setIds, conditionSetIds, queryActive)
 		queryActive = true
 	}
 
-	k := r.Form.Get("k")
+	k := form.Get("k")
 	if k != "" {
-		v := r.Form.Get("v")
+		v := form.Get("v")
 		if v != "" {
 			// handle metadata key equality query
 			equalitySetIds, err := pto3.ObservationSetIDsWithMetadataValue(oa.db, k, v)
 			if err != nil {
-				pto3.HandleErrorHTTP(w, "selecting set IDs by key equality", err)
-				return
+				return nil, false, err
 			}
 			setIds = intersectSetIds(setIds, equalitySetIds, queryActive)
 			queryActive = true
@@ -224,25 +344,101 @@ func (oa *ObsAPI) handleMetadataQuery(w http.ResponseWriter, r *http.Request) {
 			// handle metadata key presence query
 			presenceSetIds, err := pto3.ObservationSetIDsWithMetadata(oa.db, k)
 			if err != nil {
-				pto3.HandleErrorHTTP(w, "selecting set IDs by key existance", err)
-				return
+				return nil, false, err
 			}
 			setIds = intersectSetIds(setIds, presenceSetIds, queryActive)
 			queryActive = true
 		}
 	}
 
+	createdAfter, err := parseTimeParam(form, "created_after")
+	if err != nil {
+		return nil, false, err
+	}
+	createdBefore, err := parseTimeParam(form, "created_before")
+	if err != nil {
+		return nil, false, err
+	}
+	if createdAfter != nil || createdBefore != nil {
+		// handle creation time query
+		createdSetIds, err := pto3.ObservationSetIDsCreatedBetween(oa.db, createdAfter, createdBefore)
+		if err != nil {
+			return nil, false, err
+		}
+		setIds = intersectSetIds(setIds, createdSetIds, queryActive)
+		queryActive = true
+	}
+
+	timeStart, err := parseTimeParam(form, "time_start")
+	if err != nil {
+		return nil, false, err
+	}
+	timeEnd, err := parseTimeParam(form, "time_end")
+	if err != nil {
+		return nil, false, err
+	}
+	if timeStart != nil || timeEnd != nil {
+		// handle time interval overlap query
+		overlappingSetIds, err := pto3.ObservationSetIDsOverlapping(oa.db, timeStart, timeEnd)
+		if err != nil {
+			return nil, false, err
+		}
+		setIds = intersectSetIds(setIds, overlappingSetIds, queryActive)
+		queryActive = true
+	}
+
+	if sealedstr := form.Get("sealed"); sealedstr != "" {
+		sealed, err := strconv.ParseBool(sealedstr)
+		if err != nil {
+			return nil, false, pto3.PTOErrorf("bad sealed %s", sealedstr).StatusIs(http.StatusBadRequest)
+		}
+
+		// handle seal state query
+		sealedSetIds, err := pto3.ObservationSetIDsSealed(oa.db, sealed)
+		if err != nil {
+			return nil, false, err
+		}
+		setIds = intersectSetIds(setIds, sealedSetIds, queryActive)
+		queryActive = true
+	}
+
+	// each lookup sorts its IDs, and intersection keeps their order, but
+	// make sure, as clients rely on it to pick sets deterministically
+	sort.Ints(setIds)
+
+	return setIds, queryActive, nil
+}
+
+// handleMetadataQuery handles GET/POST /obs/by_metadata. It requires at least
+// one filter parameter; see selectSetIds.
+func (oa *ObsAPI) handleMetadataQuery(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	setIds, queryActive, err := oa.selectSetIds(r.Form)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "selecting set IDs", err)
+		return
+	}
+
 	if queryActive == false {
-		http.Error(w, "no query parameters given", http.StatusBadRequest)
+		pto3.HTTPError(w, "no query parameters given", http.StatusBadRequest)
 		return
 	}
 
-	oa.writeSetListResponse(w, setIds, r.Form.Get("page"))
+	oa.writeSetListResponse(w, r, setIds)
 }
 
-// handleConditionQuery handles GET /obs/conditions. It requires two
-// URL/form parameters: 'k', the key to search for, and 'v', the value to
-// search for.
+// handleConditionQuery handles GET /obs/conditions. It writes a JSON object
+// to the response with the names of all conditions under "conditions", and
+// the condition aliases under "aliases".
 
 func (oa *ObsAPI) handleConditionQuery(w http.ResponseWriter, r *http.Request) {
 	// fail if not authorized
@@ -257,10 +453,17 @@ func (oa *ObsAPI) handleConditionQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	aliases, err := pto3.ListConditionAliases(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving condition aliases", err)
+		return
+	}
+
 	// dump it to JSON
 	out := struct {
-		C []string `json:"conditions"`
-	}{C: condCache.Names()}
+		C []string              `json:"conditions"`
+		A []pto3.ConditionAlias `json:"aliases"`
+	}{C: condCache.Names(), A: aliases}
 
 	outb, err := json.Marshal(&out)
 	if err != nil {
@@ -270,282 +473,2588 @@ func (oa *ObsAPI) handleConditionQuery(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	oa.additionalHeaders(w)
-	w.WriteHeader(http.StatusOK)
-	w.Write(outb)
+	writeCacheable(w, r, outb)
 }
 
-// handleCreateSet handles POST /obs/create. It requires a JSON object with
-// observation set metadata in the request. It echoes back the metadata as a
-// JSON object in the response, with a link to the created object in the __link
-// metadata key.
-func (oa *ObsAPI) handleCreateSet(w http.ResponseWriter, r *http.Request) {
-	// fail if not authorized
-	if !oa.azr.IsAuthorized(w, r, "write_obs") {
-		return
+// conditionTree returns the condition tree, loading it from the database if
+// it is not cached or has expired. The tree is loaded without holding the
+// lock; while it is reloaded, other requests are served the expired tree.
+func (oa *ObsAPI) conditionTree() ([]*pto3.ConditionNode, error) {
+	oa.condTreeLock.Lock()
+	tree := oa.condTree
+	if tree != nil && (oa.condTreeLoading || time.Since(oa.condTreeLoaded) <= oa.config.ConditionTreeLifetimeDuration()) {
+		oa.condTreeLock.Unlock()
+		return tree, nil
 	}
+	oa.condTreeLoading = true
+	gen := oa.condTreeGen
+	oa.condTreeLock.Unlock()
 
-	// fail if not JSON
-	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
-			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
-		return
-	}
+	tree, err := pto3.LoadConditionTree(oa.db)
 
-	// fill in an observation set from supplied metadata
-	b, err := ioutil.ReadAll(r.Body)
+	oa.condTreeLock.Lock()
+	defer oa.condTreeLock.Unlock()
+	oa.condTreeLoading = false
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, err
 	}
 
-	var set pto3.ObservationSet
-	if err := json.Unmarshal(b, &set); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	// don't cache a tree loaded from before the last invalidation
+	if oa.condTreeGen == gen {
+		oa.condTree = tree
+		oa.condTreeLoaded = time.Now()
 	}
 
-	// now insert the set in the database
-	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
-		// then insert the set itself
-		return set.Insert(t, true)
-	})
-	if err != nil {
-		log.Print(err)
-		pto3.HandleErrorHTTP(w, "inserting set record", err)
-		return
-	}
+	return tree, nil
+}
 
-	oa.writeMetadataResponse(w, &set, http.StatusCreated)
+// invalidateConditionTree drops the cached condition tree, after conditions
+// have been renamed or merged. Observation counts are not invalidated as
+// observations are added or removed, but refreshed as the tree expires.
+func (oa *ObsAPI) invalidateConditionTree() {
+	oa.condTreeLock.Lock()
+	oa.condTree = nil
+	oa.condTreeGen++
+	oa.condTreeLock.Unlock()
 }
 
-// handleGetMetadata handles Get /obs/<set>. It writes a JSON object with
-// observation set metadata in the response.
-func (oa *ObsAPI) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
+// conditionsChanged drops the cached condition tree and reloads the
+// conditions of the query cache, if enabled, after conditions have been
+// renamed, aliased, or merged, so that queries no longer match them by
+// their old names.
+func (oa *ObsAPI) conditionsChanged() {
+	oa.invalidateConditionTree()
+	if oa.qc != nil {
+		if err := oa.qc.ReloadConditions(); err != nil {
+			log.Printf("error reloading query cache conditions: %v", err)
+		}
+	}
+}
+
+// handleConditionTree handles GET /obs/conditions/tree. It writes a JSON
+// object to the response with a single key, "conditions", whose content is
+// an array of the top-level nodes of the condition hierarchy, each with the
+// number of observations of the conditions below it, counting only public
+// sets which have not been deleted. The tree is cached, so counts lag behind
+// changes to observations by up to the configured ConditionTreeLifetime.
+func (oa *ObsAPI) handleConditionTree(w http.ResponseWriter, r *http.Request) {
 	// fail if not authorized
 	if !oa.azr.IsAuthorized(w, r, "read_obs") {
 		return
 	}
 
-	vars := mux.Vars(r)
-
-	// get set ID
-	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	tree, err := oa.conditionTree()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "retrieving condition tree", err)
 		return
 	}
 
-	set := pto3.ObservationSet{ID: int(setid)}
-	if err = set.SelectByID(oa.db); err != nil {
-		if err == pg.ErrNoRows {
-			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
-		} else {
-			pto3.HandleErrorHTTP(w, "retrieving set", err)
-		}
+	out := struct {
+		C []*pto3.ConditionNode `json:"conditions"`
+	}{C: tree}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling condition tree", err)
 		return
 	}
 
-	// force observation count (ignoring error)
-	set.CountObservations(oa.db)
-	// force interval update (ignoring error)
-	set.TimeInterval(oa.db)
-
-	oa.writeMetadataResponse(w, &set, http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	writeCacheable(w, r, outb)
 }
 
-// handlePutMetadata handles POST /obs/create. It requires a JSON object with
-// observation set metadata in the request. It echoes back the metadata as a
-// JSON object in the response,
-func (oa *ObsAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
+// handleConditionDaily handles GET /obs/conditions/daily. It requires a
+// condition parameter, which may be a wildcard or an alias and includes the
+// condition's descendants, and writes a JSON object to the response with the
+// number of observations of the matching conditions per day and campaign
+// under "days", from the observation rollups, counting only public sets
+// which have not been deleted. The campaign parameter
+// restricts the counts to sets derived from raw data in a campaign, and the
+// time_start and time_end parameters to days from and before the given
+// times.
+func (oa *ObsAPI) handleConditionDaily(w http.ResponseWriter, r *http.Request) {
 	// fail if not authorized
-	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
 		return
 	}
 
-	vars := mux.Vars(r)
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
 
-	// fill in set ID from URL
-	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	conditionName := r.Form.Get("condition")
+	if conditionName == "" {
+		pto3.HTTPError(w, "missing condition", http.StatusBadRequest)
+		return
+	}
+
+	cidCache, err := pto3.LoadConditionCache(oa.db)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "loading condition cache", err)
 		return
 	}
 
-	// fail if not JSON
-	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
-			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+	conditions, err := cidCache.ConditionsByName(oa.db, conditionName)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "looking up conditions", err)
 		return
 	}
 
-	// fill in an observation set from supplied metadata
-	b, err := ioutil.ReadAll(r.Body)
+	timeStart, err := parseTimeParam(r.Form, "time_start")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "parsing time_start", err)
+		return
+	}
+	timeEnd, err := parseTimeParam(r.Form, "time_end")
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing time_end", err)
 		return
 	}
 
-	var set pto3.ObservationSet
-	if err := json.Unmarshal(b, &set); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	days, err := pto3.ConditionDayCounts(oa.db, conditions, r.Form.Get("campaign"), timeStart, timeEnd)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "counting observations", err)
 		return
 	}
-	set.ID = int(setid)
 
-	// now update
-	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
-		return set.Update(t)
-	})
+	outb, err := json.Marshal(struct {
+		Days []pto3.ConditionDayCount `json:"days"`
+	}{days})
 	if err != nil {
-		if err == pg.ErrNoRows {
-			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
-		} else {
-			pto3.HandleErrorHTTP(w, "updating set metadata", err)
-		}
+		pto3.HandleErrorHTTP(w, "marshaling daily counts", err)
 		return
 	}
 
-	oa.writeMetadataResponse(w, &set, http.StatusCreated)
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	writeCacheable(w, r, outb)
 }
 
-// handleDownload handles GET /obs/<set>/data. It requires  Set IDs in the
-// input are ignored. It writes a response containing the all the observations
-// in the set as a newline-delimited JSON stream (of content-type
-// application/vnd.mami.ndjson) in observation set file format.
-
-func (oa *ObsAPI) handleDownload(w http.ResponseWriter, r *http.Request) {
+// handleListRegistry handles GET /obs/conditions/registry. It writes a JSON
+// object to the response with a single key, "conditions", whose content is an
+// array of registered conditions. The condition parameter restricts the list
+// to a condition and its descendants, and the q parameter to conditions whose
+// name or description contain a search string.
+func (oa *ObsAPI) handleListRegistry(w http.ResponseWriter, r *http.Request) {
 	// fail if not authorized
-	if !oa.azr.IsAuthorized(w, r, "read_obs_data") {
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
 		return
 	}
 
-	vars := mux.Vars(r)
-
-	// fill in set ID from URL
-	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	rcs, err := pto3.ListRegisteredConditions(oa.db, r.FormValue("condition"), r.FormValue("q"))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "listing registered conditions", err)
 		return
 	}
 
-	// retrieve set metadata
-	set := pto3.ObservationSet{ID: int(setid)}
-	if err = set.SelectByID(oa.db); err != nil {
-		if err == pg.ErrNoRows {
-			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
-		} else {
-			pto3.HandleErrorHTTP(w, "retrieving set", err)
-		}
-		return
+	for i := range rcs {
+		rcs[i].LinkVia(oa.config)
 	}
 
-	// fail if no observations exist
-	obscount, err := set.CountObservations(oa.db)
+	out := struct {
+		C []pto3.RegisteredCondition `json:"conditions"`
+	}{C: rcs}
+
+	outb, err := json.Marshal(&out)
 	if err != nil {
-		pto3.HandleErrorHTTP(w, "counting observations", err)
-		return
-	} else if obscount == 0 {
-		http.Error(w, fmt.Sprintf("Observation set %s has no observations", vars["set"]), http.StatusNotFound)
+		pto3.HandleErrorHTTP(w, "marshaling registered conditions", err)
 		return
 	}
 
-	w.Header().Set("Content-type", "application/vnd.mami.ndjson")
+	w.Header().Set("Content-Type", "application/json")
 	oa.additionalHeaders(w)
 	w.WriteHeader(http.StatusOK)
-	if err := set.CopyDataToStream(oa.db, w); err != nil {
-		pto3.HandleErrorHTTP(w, "downloading observation set", err)
-		w.Write([]byte("\n\"error during download\"\n"))
-	}
+	w.Write(outb)
 }
 
-// handleUpload handles PUT /obs/<set>/data. It requires a newline-delimited
-// JSON stream (of content-type application/vnd.mami.ndjson) in observation set
-// file format. Set IDs in the input are ignored. It writes a response
-// containing the set's metadata.
-func (oa *ObsAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
-	// fail if not authorized
-	if !oa.azr.IsAuthorized(w, r, "write_obs") {
-		return
-	}
-
-	vars := mux.Vars(r)
+// writeRegisteredConditionResponse writes a registered condition as a JSON
+// object to the response with the given status.
+func (oa *ObsAPI) writeRegisteredConditionResponse(w http.ResponseWriter, rc *pto3.RegisteredCondition, status int) {
+	rc.LinkVia(oa.config)
 
-	// fill in set ID from URL
-	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	outb, err := json.Marshal(rc)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "marshaling registered condition", err)
 		return
 	}
 
-	// retrieve set metadata
-	set := pto3.ObservationSet{ID: int(setid)}
-	if err := set.SelectByID(oa.db); err != nil {
-		if err == pg.ErrNoRows {
-			http.Error(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
-		} else {
-			pto3.HandleErrorHTTP(w, "retrieving set metadata", err)
-		}
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(status)
+	w.Write(outb)
+}
+
+// handleGetRegisteredCondition handles GET /obs/conditions/registry/{condition}.
+// It writes the registry entry for the condition as a JSON object to the
+// response.
+func (oa *ObsAPI) handleGetRegisteredCondition(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
 		return
 	}
 
-	// fail if observations exist
-	obscount, err := set.CountObservations(oa.db)
+	rc, err := pto3.SelectRegisteredCondition(oa.db, mux.Vars(r)["condition"])
 	if err != nil {
-		pto3.HandleErrorHTTP(w, "counting observations", err)
-		return
-	} else if obscount != 0 {
-		http.Error(w, fmt.Sprintf("Observation set %s already uploaded", vars["set"]), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "retrieving registered condition", err)
 		return
 	}
 
-	// create a temporary file to hold observations
-	tf, err := ioutil.TempFile("", "pto3_obs")
-	if err != nil {
-		pto3.HandleErrorHTTP(w, "creating temporary observation file", err)
+	oa.writeRegisteredConditionResponse(w, rc, http.StatusOK)
+}
+
+// handlePutRegisteredCondition handles PUT /obs/conditions/registry/{condition}.
+// It requires a JSON object with the registry entry in the request, and
+// registers the condition named in the URL, replacing any previous
+// registration. It echoes back the entry as a JSON object in the response.
+func (oa *ObsAPI) handlePutRegisteredCondition(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "admin_conditions") {
 		return
 	}
-	defer tf.Close()
-	defer os.Remove(tf.Name())
 
-	// copy observation data to the tempfile
-	if _, err := io.Copy(tf, r.Body); err != nil {
-		pto3.HandleErrorHTTP(w, "uploading to temporary observation file", err)
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for registered conditions must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var rc pto3.RegisteredCondition
+	if err := json.Unmarshal(b, &rc); err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the name in the URL wins
+	name := mux.Vars(r)["condition"]
+	if rc.Name != "" && rc.Name != name {
+		pto3.HTTPError(w, fmt.Sprintf("condition name %s does not match URL", rc.Name), http.StatusBadRequest)
+		return
+	}
+	rc.Name = name
+
+	var created bool
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		var err error
+		created, err = rc.Put(t)
+		return err
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "registering condition", err)
+		return
+	}
+
+	status := http.StatusOK
+	changeType := pto3.JournalUpdate
+	if created {
+		status = http.StatusCreated
+		changeType = pto3.JournalCreate
+	}
+	recordChange(oa.config, pto3.JournalStoreObs, changeType, "obs/conditions/registry/"+rc.Name)
+
+	oa.writeRegisteredConditionResponse(w, &rc, status)
+}
+
+// handleDeleteRegisteredCondition handles DELETE
+// /obs/conditions/registry/{condition}, removing the condition from the
+// registry. Observations of the condition are not affected.
+func (oa *ObsAPI) handleDeleteRegisteredCondition(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "admin_conditions") {
+		return
+	}
+
+	rc := pto3.RegisteredCondition{Name: mux.Vars(r)["condition"]}
+	if err := rc.Delete(oa.db); err != nil {
+		pto3.HandleErrorHTTP(w, "deleting registered condition", err)
+		return
+	}
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalDelete, "obs/conditions/registry/"+rc.Name)
+
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleExportOntology handles GET /obs/conditions/ontology. It writes the
+// condition registry to the response as a condition ontology document, for
+// import into another observatory.
+func (oa *ObsAPI) handleExportOntology(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	ont, err := pto3.ExportConditionOntology(oa.db, oa.config)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "exporting condition ontology", err)
+		return
+	}
+
+	outb, err := json.Marshal(ont)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling condition ontology", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleImportOntology handles POST /obs/conditions/ontology. It requires a
+// condition ontology document, as exported by another observatory, and
+// merges it into the condition registry, resolving conflicts according to
+// the policy parameter, or only reporting what would change if dry_run is
+// given. It writes the merge report to the response.
+func (oa *ObsAPI) handleImportOntology(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "admin_conditions") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for condition ontologies must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	policy, err := pto3.ParseOntologyMergePolicy(r.URL.Query().Get("policy"))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing merge policy", err)
+		return
+	}
+
+	var dryRun bool
+	if dryRunStr := r.URL.Query().Get("dry_run"); dryRunStr != "" {
+		if dryRun, err = strconv.ParseBool(dryRunStr); err != nil {
+			pto3.HTTPError(w, fmt.Sprintf("bad dry_run %s", dryRunStr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ont, err := pto3.ParseConditionOntology(b)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing condition ontology", err)
+		return
+	}
+
+	report, err := pto3.MergeConditionOntology(oa.db, ont, policy, dryRun)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "merging condition ontology", err)
+		return
+	}
+
+	if !dryRun {
+		for _, name := range report.Added {
+			recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalCreate, "obs/conditions/registry/"+name)
+		}
+		for _, name := range report.Updated {
+			recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, "obs/conditions/registry/"+name)
+		}
+	}
+
+	outb, err := json.Marshal(report)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling merge report", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handlePutConditionAlias handles PUT /obs/conditions/aliases/{alias}. It
+// requires a JSON object in the request with the name of the condition to
+// alias under "condition", and makes the name in the URL an alias for it,
+// merging any condition of that name into it. It writes a JSON object to the
+// response with the alias, the condition, and the number of observations
+// merged under "merged".
+func (oa *ObsAPI) handlePutConditionAlias(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "admin_conditions") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for condition aliases must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ca pto3.ConditionAlias
+	if err := json.Unmarshal(b, &ca); err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the alias in the URL wins
+	alias := mux.Vars(r)["alias"]
+	if ca.Alias != "" && ca.Alias != alias {
+		pto3.HTTPError(w, fmt.Sprintf("condition alias %s does not match URL", ca.Alias), http.StatusBadRequest)
+		return
+	}
+	ca.Alias = alias
+
+	var merged int
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		var err error
+		merged, err = pto3.AliasCondition(t, ca.Alias, ca.Condition)
+		return err
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "aliasing condition", err)
+		return
+	}
+
+	// a merge removes the condition of the alias name, even if it had no
+	// observations to move
+	oa.conditionsChanged()
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, "obs/conditions/aliases/"+ca.Alias)
+
+	out := struct {
+		pto3.ConditionAlias
+		Merged int `json:"merged"`
+	}{ca, merged}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling condition alias", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleDeleteConditionAlias handles DELETE /obs/conditions/aliases/{alias},
+// removing the alias. Observations merged when the alias was created are not
+// affected.
+func (oa *ObsAPI) handleDeleteConditionAlias(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "admin_conditions") {
+		return
+	}
+
+	alias := mux.Vars(r)["alias"]
+	if err := pto3.RemoveConditionAlias(oa.db, alias); err != nil {
+		pto3.HandleErrorHTTP(w, "deleting condition alias", err)
+		return
+	}
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalDelete, "obs/conditions/aliases/"+alias)
+
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRenameCondition handles POST /obs/conditions/rename. It requires a
+// JSON object in the request with the name of the condition to rename under
+// "from" and its new name under "to", renames the condition, leaving the old
+// name as an alias, and merges it into any condition already of the new
+// name. In strict naming mode, the new name must follow the naming
+// convention. It writes a JSON object to the response with the old and new
+// names and the number of observations merged under "merged".
+func (oa *ObsAPI) handleRenameCondition(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "admin_conditions") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for condition renames must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var in struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.Unmarshal(b, &in); err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// new names follow the naming convention, as new conditions must
+	if oa.config.ConditionNaming == pto3.ConditionNamingStrict {
+		if err := pto3.ValidateConditionName(in.To, oa.config.ConditionPrefixes); err != nil {
+			pto3.HandleErrorHTTP(w, "validating condition name", err)
+			return
+		}
+	}
+
+	var merged int
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		var err error
+		merged, err = pto3.RenameCondition(t, in.From, in.To)
+		return err
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "renaming condition", err)
+		return
+	}
+
+	oa.conditionsChanged()
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, "obs/conditions/aliases/"+in.From)
+
+	out := struct {
+		From   string `json:"from"`
+		To     string `json:"to"`
+		Merged int    `json:"merged"`
+	}{in.From, in.To, merged}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling condition rename", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleListConditionRenames handles GET /obs/conditions/renames. It writes a
+// JSON object to the response with the history of condition renames, oldest
+// first, under "renames". If a condition name is given in the "condition"
+// parameter, only the renames of the names that condition was known by are
+// listed.
+func (oa *ObsAPI) handleListConditionRenames(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	renames, err := pto3.ListConditionRenames(oa.db, r.URL.Query().Get("condition"))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "listing condition renames", err)
+		return
+	}
+
+	outb, err := json.Marshal(struct {
+		Renames []pto3.ConditionRename `json:"renames"`
+	}{renames})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling condition renames", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// setProvenance describes the sources an observation set was derived from.
+type setProvenance struct {
+	Link     string   `json:"__link"`
+	Sources  []string `json:"sources"`
+	Sets     []string `json:"sets"`
+	Raw      []string `json:"raw"`
+	External []string `json:"external"`
+}
+
+// handleProvenance handles GET /obs/{set}/provenance. It walks the sources of
+// an observation set and of all the sets it was derived from, and writes a
+// JSON object to the response with the set's own sources in "sources", the
+// observation sets it was derived from in "sets", the raw data files
+// underlying it in "raw", and sources not on this PTO in "external".
+func (oa *ObsAPI) handleProvenance(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.HTTPError(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	sources, err := set.UpstreamSources(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "walking provenance", err)
+		return
+	}
+
+	out := setProvenance{
+		Link:     pto3.LinkForSetID(oa.config, set.ID),
+		Sources:  set.Sources,
+		Sets:     make([]string, 0),
+		Raw:      make([]string, 0),
+		External: make([]string, 0),
+	}
+
+	seen := make(map[string]bool)
+	setIds := make([]int, 0)
+	for _, source := range sources {
+		if seen[source.Link] {
+			continue
+		}
+		seen[source.Link] = true
+
+		if source.SourceSetID != 0 {
+			setIds = append(setIds, source.SourceSetID)
+		} else if source.Campaign != "" {
+			link, _ := oa.config.LinkTo(fmt.Sprintf("raw/%s/%s", source.Campaign, source.File))
+			out.Raw = append(out.Raw, link)
+		} else {
+			out.External = append(out.External, source.Link)
+		}
+	}
+
+	// link only upstream sets the client may read
+	if setIds, err = oa.filterReadableSetIds(r, setIds); err != nil {
+		pto3.HandleErrorHTTP(w, "filtering upstream sets", err)
+		return
+	}
+	for _, id := range setIds {
+		out.Sets = append(out.Sets, pto3.LinkForSetID(oa.config, id))
+	}
+
+	outb, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling provenance", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleStats handles GET /obs/<set>/stats, writing a JSON object to the
+// response summarizing the observations in the set: their number, earliest
+// start and latest end times, number by condition, and number of distinct
+// paths.
+func (oa *ObsAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	stats, err := set.Stats(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "summarizing observations", err)
+		return
+	}
+
+	outb, err := json.Marshal(stats)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling statistics", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(outb)
+}
+
+// handleDerived handles GET /obs/derived. It requires a source parameter with
+// the link to a raw data file or observation set on this PTO, and writes a
+// list of links to the observation sets derived from it, directly or through
+// other sets, to the response as with GET /obs.
+func (oa *ObsAPI) handleDerived(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	source := r.Form.Get("source")
+
+	var setIds []int
+	var err error
+	if camname, filename, ok := oa.config.RawFileForLink(source); ok {
+		setIds, err = pto3.ObservationSetIDsDerivedFromRawFile(oa.db, camname, filename)
+	} else if setid, ok := oa.config.ObservationSetIDForLink(source); ok {
+		setIds, err = pto3.ObservationSetIDsDerivedFromSet(oa.db, setid)
+	} else {
+		pto3.HTTPError(w, fmt.Sprintf("source %s is not a raw data file or observation set on this PTO", source), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "selecting derived sets", err)
+		return
+	}
+
+	oa.writeSetListResponse(w, r, setIds)
+}
+
+// handleCreateSet handles POST /obs/create. It requires a JSON object with
+// observation set metadata in the request, or a complete observation set file
+// (of content-type application/vnd.mami.ndjson) whose first line is the set's
+// metadata, in which case the observations in the file are uploaded as well.
+// It echoes back the metadata as a JSON object in the response, with a link to
+// the created object in the __link metadata key.
+func (oa *ObsAPI) handleCreateSet(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	// observations given with the metadata may be deduplicated
+	skipDuplicates, err := skipDuplicatesParam(r)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing upload parameters", err)
+		return
+	}
+
+	// and sets imported from elsewhere may already exist
+	policy, err := pto3.ParseImportPolicy(r.URL.Query().Get("import"))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing upload parameters", err)
+		return
+	}
+
+	// and checked against the time range of the set's sources
+	timeCheck, err := pto3.ParseTimeCheck(r.URL.Query().Get("check_times"))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing upload parameters", err)
+		return
+	}
+
+	// fill in an observation set from supplied metadata
+	var set *pto3.ObservationSet
+	var obsr *pto3.ObservationReader
+
+	switch r.Header.Get("Content-Type") {
+	case "application/json":
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		set = new(pto3.ObservationSet)
+		if err := json.Unmarshal(b, set); err != nil {
+			pto3.HandleErrorHTTP(w, "parsing metadata", pto3.PTOInvalidMetadataError(err))
+			return
+		}
+	case "application/vnd.mami.ndjson":
+		// observations follow the metadata, and are loaded once the set exists
+		obsr = pto3.NewObservationReader(r.Body)
+		if set, err = obsr.ReadMetadata(); err != nil {
+			pto3.HandleErrorHTTP(w, "reading metadata", err)
+			return
+		}
+	default:
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for metadata must be application/json or application/vnd.mami.ndjson; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// expand wildcard conditions and aliases
+	if err := oa.expandSetConditions(set); err != nil {
+		pto3.HandleErrorHTTP(w, "expanding set conditions", err)
+		return
+	}
+
+	if err := oa.config.CheckConditionNames(set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking condition names", err)
+		return
+	}
+
+	if obsr != nil {
+		if err := oa.checkObservationTimes(set, obsr, timeCheck); err != nil {
+			pto3.HandleErrorHTTP(w, "checking observation times", err)
+			return
+		}
+	}
+
+	// external sets have no observations here
+	if err := set.ValidateExternal(oa.config); err != nil {
+		pto3.HandleErrorHTTP(w, "checking external set link", err)
+		return
+	}
+	if obsr != nil && set.External() != "" {
+		pto3.HTTPError(w, "observations cannot be uploaded to an external set", http.StatusBadRequest)
+		return
+	}
+
+	// load a set which exists locally as a new one, to compare it later
+	uuid, err := set.StageImport(oa.db, policy)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "staging import", err)
+		return
+	}
+
+	// make sure the slug is usable; a staged set shares its slug with the
+	// existing set until the import is resolved
+	if uuid == "" {
+		err = oa.checkSetSlug(set)
+	} else {
+		err = set.ValidateSlug()
+	}
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "checking set slug", err)
+		return
+	}
+
+	// make sure the visibility is usable
+	if err := oa.checkSetVisibility(r, set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking set visibility", err)
+		return
+	}
+
+	// now insert the set in the database
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		// then insert the set itself
+		if err := set.Insert(t, true); err != nil {
+			return err
+		}
+
+		// link it to its sources
+		if err := set.LinkSources(t, oa.config, oa.rds); err != nil {
+			return err
+		}
+
+		// and remember who created it, so they can delete it
+		return set.SetSubmitter(t, submitterForRequest(r))
+	})
+	if err != nil {
+		log.Print(err)
+		pto3.HandleErrorHTTP(w, "inserting set record", err)
+		return
+	}
+
+	// load observations given with the metadata, removing the set again if
+	// they can't be loaded, so that a failed upload can simply be retried
+	if obsr != nil {
+		skipped, err := oa.copySetData(set, obsr, skipDuplicates)
+		if err != nil {
+			oa.removeFailedSet(set)
+			pto3.HandleErrorHTTP(w, "inserting observations", err)
+			return
+		}
+
+		if skipDuplicates {
+			w.Header().Set(SkippedObservationsHeader, strconv.Itoa(skipped))
+		}
+		if timeCheck == pto3.TimeCheckFlag {
+			w.Header().Set(TimeOutliersHeader, strconv.Itoa(obsr.TimeOutliers()))
+		}
+	}
+
+	oa.writeCreatedSetResponse(w, set, uuid, policy, obsr != nil)
+}
+
+// removeFailedSet removes a newly created set whose observations could not
+// be loaded, so that a failed upload can simply be retried.
+func (oa *ObsAPI) removeFailedSet(set *pto3.ObservationSet) {
+	if _, err := set.DeleteInBatches(oa.db, &oa.config.ObsDatabase, nil); err != nil {
+		log.Printf("error removing set %x after failed upload: %s", set.ID, err.Error())
+	}
+}
+
+// writeCreatedSetResponse resolves the conflict between a newly created set
+// and the existing set with the UUID StageImport removed from it, if any,
+// records the changes, and writes the metadata of the resulting set to the
+// response.
+func (oa *ObsAPI) writeCreatedSetResponse(w http.ResponseWriter, set *pto3.ObservationSet, uuid string, policy pto3.ImportPolicy, withData bool) {
+	// resolve the conflict with the existing set, if any
+	if uuid != "" {
+		res, err := pto3.ResolveImport(oa.db, set, uuid, policy)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "resolving import", err)
+			return
+		}
+		w.Header().Set(ImportActionHeader, string(res.Action))
+
+		if res.Action != pto3.ImportSuperseded {
+			if res.Action == pto3.ImportUpdated {
+				if err := res.Set.LinkSources(oa.db, oa.config, oa.rds); err != nil {
+					pto3.HandleErrorHTTP(w, "linking set sources", err)
+					return
+				}
+				recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, fmt.Sprintf("obs/%x", res.Set.ID))
+			}
+			oa.writeMetadataResponse(w, res.Set, http.StatusOK)
+			return
+		}
+	} else if policy != pto3.ImportRefuse {
+		w.Header().Set(ImportActionHeader, string(pto3.ImportCreated))
+	}
+
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalCreate, fmt.Sprintf("obs/%x", set.ID))
+	if withData {
+		recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalCreate, fmt.Sprintf("obs/%x/data", set.ID))
+	}
+
+	oa.writeMetadataResponse(w, set, http.StatusCreated)
+}
+
+// handleMergeSets handles POST /obs/merge, creating a new observation set
+// from the observations of the sets whose links are given in a JSON object,
+// optionally dropping duplicate observations.
+func (oa *ObsAPI) handleMergeSets(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized to read the merged sets and their data, or to
+	// create the new one, which would otherwise expose their data
+	if !oa.azr.IsAuthorized(w, r, "read_obs") || !oa.azr.IsAuthorized(w, r, "read_obs_data") ||
+		!oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for merge request must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Sets        []string          `json:"sets"`
+		Deduplicate bool              `json:"deduplicate"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	setIDs := make([]int, len(req.Sets))
+	for i, link := range req.Sets {
+		setid, ok := oa.config.ObservationSetIDForLink(link)
+		if !ok {
+			pto3.HTTPError(w, fmt.Sprintf("%s is not an observation set on this PTO", link), http.StatusBadRequest)
+			return
+		}
+		if !oa.checkSetReadable(w, r, setid) {
+			return
+		}
+		setIDs[i] = setid
+	}
+
+	set, err := pto3.MergeObservationSets(oa.db, oa.config, setIDs, req.Deduplicate, req.Metadata, submitterForRequest(r))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "merging observation sets", err)
+		return
+	}
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalCreate, fmt.Sprintf("obs/%x", set.ID))
+
+	oa.writeMetadataResponse(w, set, http.StatusCreated)
+}
+
+// expandSetConditions replaces wildcard conditions and aliases declared in an
+// uploaded set's metadata with the concrete conditions they stand for.
+func (oa *ObsAPI) expandSetConditions(set *pto3.ObservationSet) error {
+	cidCache, err := pto3.LoadConditionCache(oa.db)
+	if err != nil {
+		return err
+	}
+
+	return cidCache.ExpandConditionsInSet(oa.db, set)
+}
+
+// checkSetSlug verifies that a set's slug, if present, is valid and not
+// already in use by another set.
+func (oa *ObsAPI) checkSetSlug(set *pto3.ObservationSet) error {
+	if err := set.ValidateSlug(); err != nil {
+		return err
+	}
+
+	slug := set.Slug()
+	if slug == "" {
+		return nil
+	}
+
+	setIds, err := pto3.ObservationSetIDsWithMetadataValue(oa.db, pto3.SlugMetadataKey, slug)
+	if err != nil {
+		return err
+	}
+
+	// earlier versions of the set may share its slug
+	supersededIds, err := set.SupersededSetIDs(oa.db)
+	if err != nil {
+		return err
+	}
+	superseded := make(map[int]bool)
+	for _, id := range supersededIds {
+		superseded[id] = true
+	}
+
+	for _, id := range setIds {
+		if id != set.ID && !superseded[id] {
+			return pto3.PTOExistsError("set slug", slug)
+		}
+	}
+
+	return nil
+}
+
+// checkSetVisibility returns an error if an uploaded set's visibility is
+// unknown or incomplete, or restricts who may read it without the client
+// being identifiable as its owner. For an existing set, it also returns an
+// error if the set's visibility or project changes, unless the client is the
+// set's owner or may read all sets anyway.
+func (oa *ObsAPI) checkSetVisibility(r *http.Request, set *pto3.ObservationSet) error {
+	if err := set.ValidateVisibility(); err != nil {
+		return err
+	}
+
+	client := submitterForRequest(r)
+	if set.Visibility() != pto3.VisibilityPublic && client == "default" {
+		return pto3.PTOErrorf("%s set needs an API key to identify its owner", set.Visibility()).StatusIs(http.StatusBadRequest)
+	}
+
+	if set.ID == 0 {
+		return nil
+	}
+
+	acc, err := set.Access(oa.db)
+	if err != nil {
+		return err
+	}
+
+	if acc.Visibility == set.Visibility() && acc.Project == set.Metadata[pto3.ProjectMetadataKey] {
+		return nil
+	}
+
+	if client != acc.Owner && !oa.azr.HasPermission(r, pto3.ReadPrivatePermission) {
+		return pto3.PTOErrorf("only the owner of observation set %x can change its visibility", set.ID).StatusIs(http.StatusForbidden)
+	}
+
+	return nil
+}
+
+// handleSetAlias handles /obs/by_id/<id>, /obs/by_slug/<slug>, and
+// /obs/by_uuid/<uuid>, with or without a trailing /data. It redirects to the
+// canonical link for the set identified by decimal ID, by slug, or by UUID.
+func (oa *ObsAPI) handleSetAlias(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	var setid int
+	if idstr, ok := vars["id"]; ok {
+		// set IDs are positive, and must fit an int
+		id, err := strconv.ParseInt(idstr, 10, 0)
+		if err != nil || id < 0 {
+			pto3.HTTPError(w, fmt.Sprintf("bad set ID %s", idstr), http.StatusBadRequest)
+			return
+		}
+		setid = int(id)
+	} else if uuid, ok := vars["uuid"]; ok {
+		var err error
+		if setid, err = pto3.ObservationSetIDForUUID(oa.db, uuid); err != nil {
+			pto3.HandleErrorHTTP(w, "looking up set UUID", err)
+			return
+		}
+	} else {
+		var err error
+		if setid, err = pto3.ObservationSetIDForSlug(oa.db, vars["slug"]); err != nil {
+			pto3.HandleErrorHTTP(w, "looking up set slug", err)
+			return
+		}
+	}
+
+	link := pto3.LinkForSetID(oa.config, setid)
+	if strings.HasSuffix(r.URL.Path, "/data") {
+		link += "/data"
+	}
+	if r.URL.RawQuery != "" {
+		link += "?" + r.URL.RawQuery
+	}
+
+	oa.additionalHeaders(w)
+	http.Redirect(w, r, link, http.StatusTemporaryRedirect)
+}
+
+// handleGetMetadata handles Get /obs/<set>. It writes a JSON object with
+// observation set metadata in the response.
+func (oa *ObsAPI) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.HTTPError(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	// force observation count and interval update
+	if _, err := set.CountObservations(oa.db); err != nil {
+		pto3.HandleErrorHTTP(w, "counting observations", err)
+		return
+	}
+	if _, _, err := set.TimeInterval(oa.db); err != nil {
+		pto3.HandleErrorHTTP(w, "updating time interval", err)
+		return
+	}
+
+	// metadata changes rarely, so let clients revalidate it cheaply
+	set.LinkVia(oa.config)
+	b, err := json.Marshal(&set)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling metadata", err)
+		return
+	}
+
+	oa.additionalHeaders(w)
+	writeCacheable(w, r, b)
+}
+
+// handlePutMetadata handles POST /obs/create. It requires a JSON object with
+// observation set metadata in the request. It echoes back the metadata as a
+// JSON object in the response,
+func (oa *ObsAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// fill in an observation set from supplied metadata
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var set pto3.ObservationSet
+	if err := json.Unmarshal(b, &set); err != nil {
+		pto3.HandleErrorHTTP(w, "parsing metadata", pto3.PTOInvalidMetadataError(err))
+		return
+	}
+	set.ID = int(setid)
+
+	// expand wildcard conditions and aliases
+	if err := oa.expandSetConditions(&set); err != nil {
+		pto3.HandleErrorHTTP(w, "expanding set conditions", err)
+		return
+	}
+
+	if err := oa.config.CheckConditionNames(&set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking condition names", err)
+		return
+	}
+
+	// make sure the slug is usable
+	if err := oa.checkSetSlug(&set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking set slug", err)
+		return
+	}
+
+	// make sure the visibility is usable, and changed only by the owner
+	if err := oa.checkSetVisibility(r, &set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking set visibility", err)
+		return
+	}
+
+	// sets with observations here cannot become external
+	if err := set.ValidateExternal(oa.config); err != nil {
+		pto3.HandleErrorHTTP(w, "checking external set link", err)
+		return
+	}
+	if set.External() != "" {
+		if obscount, err := set.CountObservations(oa.db); err != nil {
+			pto3.HandleErrorHTTP(w, "counting observations", err)
+			return
+		} else if obscount != 0 {
+			pto3.HTTPError(w, fmt.Sprintf("Observation set %s has observations, so cannot be external", vars["set"]), http.StatusConflict)
+			return
+		}
+	}
+
+	// now update
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		if err := set.Update(t); err != nil {
+			return err
+		}
+		return set.LinkSources(t, oa.config, oa.rds)
+	})
+	if err != nil {
+		if err == pg.ErrNoRows {
+			pto3.HTTPError(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "updating set metadata", err)
+		}
+		return
+	}
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, fmt.Sprintf("obs/%x", set.ID))
+
+	oa.writeMetadataResponse(w, &set, http.StatusCreated)
+}
+
+// handleSeal handles POST /obs/<set>/seal, marking an observation set with
+// observations as complete. Once sealed, the set's data and metadata can no
+// longer be changed. The set's submitter needs permission to write
+// observations to seal it; everyone else needs permission to delete
+// observations. It writes the set's metadata, including the time at which it
+// was sealed, to the response.
+func (oa *ObsAPI) handleSeal(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized to seal any set; whether this set may be sealed
+	// depends on its submitter
+	if !oa.azr.HasPermission(r, "delete_obs") && !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.HTTPError(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	// sealing is final, so owners need only write permission; everyone else
+	// needs delete permission
+	submitter, err := set.Submitter(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving set submitter", err)
+		return
+	}
+
+	permission := "delete_obs"
+	if submitter != "" && submitter != "default" && submitter == submitterForRequest(r) {
+		permission = "write_obs"
+	}
+
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, permission) {
+		return
+	}
+
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		return set.Seal(t)
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "sealing set", err)
+		return
+	}
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, fmt.Sprintf("obs/%x", set.ID))
+
+	oa.writeMetadataResponse(w, &set, http.StatusOK)
+}
+
+// handleExport handles POST /obs/<set>/export, archiving a sealed set as a
+// bundle to the raw data store, in the campaign given by the campaign
+// parameter, as the file given by the optional file parameter. With trim
+// set, it then removes the set's observations from the observation database;
+// the set's data is served from the bundle thereafter. It requires
+// permission to write observations and the campaign, and to delete
+// observations in order to trim, and writes the archive record to the
+// response.
+func (oa *ObsAPI) handleExport(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	if oa.rds == nil {
+		pto3.HTTPError(w, "no raw data store to export to", http.StatusNotFound)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	camname := r.Form.Get("campaign")
+	if camname == "" {
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
+		return
+	}
+
+	trim := false
+	if trimstr := r.Form.Get("trim"); trimstr != "" {
+		if trim, err = strconv.ParseBool(trimstr); err != nil {
+			pto3.HTTPError(w, fmt.Sprintf("bad trim %s", trimstr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !oa.azr.IsAuthorized(w, r, "write_raw:"+camname) {
+		return
+	}
+
+	// trimmed observations are gone from the database for good, so only
+	// those with delete permission can trim them
+	if trim && !oa.azr.IsAuthorized(w, r, "delete_obs") {
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	set.LinkVia(oa.config)
+
+	arc, err := set.ArchiveToRawStore(oa.db, oa.config, oa.rds, camname, r.Form.Get("file"))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "archiving set", err)
+		return
+	}
+	recordChange(oa.config, pto3.JournalStoreRaw, pto3.JournalCreate, fmt.Sprintf("raw/%s/%s", arc.Campaign, arc.File))
+
+	if trim {
+		trimmed, err := set.TrimArchived(oa.db, &oa.config.ObsDatabase, nil)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "trimming set", err)
+			return
+		}
+		arc.Trimmed = trimmed.Trimmed
+		recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, fmt.Sprintf("obs/%x", set.ID))
+	}
+
+	b, err := json.Marshal(arc)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling archive", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleRehydrate handles POST /obs/<set>/rehydrate, loading the
+// observations of a trimmed set back into the observation database from its
+// bundle in the raw data store. It requires permission to write observations
+// and read the bundle's campaign, and writes the archive record to the
+// response.
+func (oa *ObsAPI) handleRehydrate(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	if oa.rds == nil {
+		pto3.HTTPError(w, "no raw data store to rehydrate from", http.StatusNotFound)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	arc, err := set.Archive(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving set archive", err)
+		return
+	} else if arc == nil {
+		pto3.HTTPError(w, fmt.Sprintf("Observation set %s is not archived", vars["set"]), http.StatusConflict)
+		return
+	}
+
+	if !oa.azr.IsAuthorized(w, r, "read_raw:"+arc.Campaign) {
+		return
+	}
+
+	if arc, err = set.RehydrateFromRawStore(oa.db, oa.config, oa.rds); err != nil {
+		pto3.HandleErrorHTTP(w, "rehydrating set", err)
+		return
+	}
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, fmt.Sprintf("obs/%x/data", set.ID))
+
+	b, err := json.Marshal(arc)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling archive", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleGetNotes handles GET /obs/<set>/notes, writing the Markdown document
+// with notes attached to the set to the response.
+func (oa *ObsAPI) handleGetNotes(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	notes, err := set.Notes(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving set notes", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(notes))
+}
+
+// handlePutNotes handles PUT /obs/<set>/notes, attaching the Markdown
+// document in the request to the set, and DELETE /obs/<set>/notes, removing
+// it. It writes the set's metadata, with a link to the notes, to the
+// response.
+func (oa *ObsAPI) handlePutNotes(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	var notes []byte
+	if r.Method == "PUT" {
+		// fail if not Markdown or plain text
+		contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+		if contentType != "text/markdown" && contentType != "text/plain" {
+			pto3.HTTPError(w, fmt.Sprintf("Content-type for notes must be text/markdown; got %s instead",
+				r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		// read one byte more than allowed, to detect overlong notes
+		notes, err = ioutil.ReadAll(io.LimitReader(r.Body, pto3.MaxNotesLength+1))
+		if err != nil {
+			pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.HTTPError(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		return set.SetNotes(t, string(notes))
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "updating set notes", err)
+		return
+	}
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, fmt.Sprintf("obs/%x/notes", set.ID))
+
+	oa.writeMetadataResponse(w, &set, http.StatusOK)
+}
+
+// handleEvidence handles GET /obs/<set>/evidence, returning the excerpt of
+// raw data a source reference in the set points to. The reference is given by
+// the source parameter and either the record or the offset parameter; with
+// offset, the optional length parameter gives the number of bytes to return.
+// It requires permission to read both observation data and the raw data's
+// campaign, and writes a JSON object with the excerpt and links to the raw
+// data file.
+func (oa *ObsAPI) handleEvidence(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs_data") {
+		return
+	}
+
+	if oa.rds == nil {
+		pto3.HTTPError(w, "no raw data available for evidence", http.StatusNotFound)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	// parse source reference
+	var ref pto3.SourceRef
+	if ref.Source, err = strconv.Atoi(r.Form.Get("source")); err != nil || ref.Source < 0 {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing source %s", r.Form.Get("source")), http.StatusBadRequest)
+		return
+	}
+
+	for _, param := range []struct {
+		name string
+		pos  **int64
+	}{{"offset", &ref.Offset}, {"record", &ref.Record}} {
+		if s := r.Form.Get(param.name); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 0 {
+				pto3.HTTPError(w, fmt.Sprintf("bad %s %s", param.name, s), http.StatusBadRequest)
+				return
+			}
+			*param.pos = &n
+		}
+	}
+
+	if (ref.Offset == nil) == (ref.Record == nil) {
+		pto3.HTTPError(w, "evidence requires exactly one of offset and record", http.StatusBadRequest)
+		return
+	}
+
+	length := 0
+	if s := r.Form.Get("length"); s != "" {
+		if length, err = strconv.Atoi(s); err != nil || length < 0 || ref.Offset == nil {
+			pto3.HTTPError(w, fmt.Sprintf("bad length %s", s), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// find the raw data file the reference points to
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.HTTPError(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	source, err := set.SourceURL(&ref)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "resolving source reference", err)
+		return
+	}
+
+	camname, filename, ok := oa.config.RawFileForLink(source)
+	if !ok {
+		pto3.HTTPError(w, fmt.Sprintf("source %s is not raw data on this PTO", source), http.StatusNotFound)
+		return
+	}
+
+	if !oa.azr.IsAuthorized(w, r, "read_raw:"+camname) {
+		return
+	}
+
+	cam, err := oa.rds.CampaignForName(camname)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
+		return
+	}
+
+	excerpt, err := cam.ReadFileExcerpt(filename, &ref, length)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "reading evidence", err)
+		return
+	}
+
+	// return the excerpt as text if we can, otherwise as base64
+	out := map[string]interface{}{
+		"__source": source,
+		"__data":   source + "/data",
+		"source":   ref.Source,
+	}
+	if ref.Offset != nil {
+		out["offset"] = *ref.Offset
+	} else {
+		out["record"] = *ref.Record
+	}
+	if utf8.Valid(excerpt) {
+		out["excerpt"] = string(excerpt)
+	} else {
+		out["excerpt_base64"] = base64.StdEncoding.EncodeToString(excerpt)
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling evidence", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleDelete handles DELETE /obs/<set>, marking an observation set as
+// deleted, which hides it from clients and queries until it is restored or
+// purged. Sets may be deleted by the client which created them (identified
+// by API key) with the write_obs permission, or by any client with the
+// delete_obs permission. If the purge parameter is true, the set, its
+// observations, and its metadata are removed for good instead, which
+// requires the delete_obs permission, and works on deleted sets too. If the
+// dry_run parameter is true, nothing is deleted. It writes a JSON object to
+// the response with the number of observations and conditions deleted (or
+// which would be deleted by purging the set). Clients which may not read the
+// set get 404 Not Found, as if it did not exist.
+func (oa *ObsAPI) handleDelete(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized to delete any set, before revealing anything
+	// about this one; whether it may be deleted depends on its submitter
+	if !oa.azr.HasPermission(r, "delete_obs") && !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	dryRun := false
+	if dryrunstr := r.Form.Get("dry_run"); dryrunstr != "" {
+		if dryRun, err = strconv.ParseBool(dryrunstr); err != nil {
+			pto3.HTTPError(w, fmt.Sprintf("bad dry_run %s", dryrunstr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	purge := false
+	if purgestr := r.Form.Get("purge"); purgestr != "" {
+		if purge, err = strconv.ParseBool(purgestr); err != nil {
+			pto3.HTTPError(w, fmt.Sprintf("bad purge %s", purgestr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	set.LinkVia(oa.config)
+
+	if purge {
+		// purged sets are gone for good, so only those with delete
+		// permission can purge them
+		if !oa.azr.IsAuthorized(w, r, "delete_obs") {
+			return
+		}
+	} else {
+		if !oa.checkSetReadable(w, r, int(setid)) {
+			return
+		}
+
+		// owners need only write permission; everyone else needs delete permission
+		submitter, err := set.Submitter(oa.db)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "retrieving set submitter", err)
+			return
+		}
+
+		// sealed sets may be cited, so only those with delete permission can
+		// delete them
+		sealed, err := set.IsSealed(oa.db)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "checking whether set is sealed", err)
+			return
+		}
+
+		permission := "delete_obs"
+		if !sealed && submitter != "" && submitter != "default" && submitter == submitterForRequest(r) {
+			permission = "write_obs"
+		}
+
+		// fail if not authorized
+		if !oa.azr.IsAuthorized(w, r, permission) {
+			return
+		}
+	}
+
+	var deletion *pto3.ObservationSetDeletion
+	if purge && !dryRun {
+		// large sets are deleted in batches, so as not to block other writers
+		deletion, err = set.DeleteInBatches(oa.db, &oa.config.ObsDatabase, nil)
+	} else {
+		err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+			if purge {
+				deletion, err = set.Delete(t, true)
+				return err
+			}
+
+			// count what purging would remove, but only mark the set deleted
+			if deletion, err = set.Delete(t, true); err != nil || dryRun {
+				return err
+			}
+			deletion.DryRun = false
+			return set.MarkDeleted(t)
+		})
+	}
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "deleting set", err)
+		return
+	}
+
+	if !dryRun {
+		recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalDelete, fmt.Sprintf("obs/%x", set.ID))
+	}
+
+	b, err := json.Marshal(deletion)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling deletion", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleRestore handles POST /obs/<set>/restore, making an observation set
+// marked deleted visible again. It requires the delete_obs permission, and
+// writes the set's metadata to the response.
+func (oa *ObsAPI) handleRestore(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "delete_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// get set ID
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	set := pto3.ObservationSet{ID: int(setid)}
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		if err := set.Restore(t); err != nil {
+			return err
+		}
+		return set.SelectByID(t)
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "restoring set", err)
+		return
+	}
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalCreate, fmt.Sprintf("obs/%x", set.ID))
+
+	oa.writeMetadataResponse(w, &set, http.StatusOK)
+}
+
+// handleListDeleted handles GET /obs/deleted. It requires the delete_obs
+// permission, and lists the observation sets marked deleted, which may be
+// restored, as with GET /obs.
+func (oa *ObsAPI) handleListDeleted(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "delete_obs") {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("error parsing form: %s", err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	setIds, err := pto3.ObservationSetIDsDeletedBefore(oa.db, nil)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "listing deleted sets", err)
+		return
+	}
+
+	oa.writeSetList(w, r, setIds)
+}
+
+// handleDownload handles GET /obs/<set>/data. It writes a response containing
+// all the observations in the set as a newline-delimited JSON stream (of
+// content-type application/vnd.mami.ndjson) in observation set file format,
+// or in another registered format selected by the format parameter or the
+// Accept header. If a fields parameter is given, only those fields of each
+// observation are written. If limit or cursor parameters are given, it writes
+// only a page of observations, with a Link header to the next page if there is
+// one. If the metadata parameter is true, the set's metadata is written as the
+// first line of NDJSON output (or of its first page), so that the response
+// fully describes the set and can be uploaded to POST /obs/create. The data
+// of external sets is served by handleExternalDownload.
+
+func (oa *ObsAPI) handleDownload(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "read_obs_data") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	// retrieve set metadata
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err = set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.HTTPError(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set", err)
+		}
+		return
+	}
+
+	// the data of external sets lives elsewhere
+	if set.External() != "" {
+		oa.handleExternalDownload(w, r, &set)
+		return
+	}
+
+	// the data of trimmed sets lives in their bundles
+	if arc, err := set.Archive(oa.db); err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving set archive", err)
+		return
+	} else if arc != nil && arc.Trimmed != nil {
+		arc.LinkVia(oa.config)
+		oa.additionalHeaders(w)
+		http.Redirect(w, r, arc.DataLink(), http.StatusTemporaryRedirect)
+		return
+	}
+
+	// fail if no observations exist
+	obscount, err := set.CountObservations(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "counting observations", err)
+		return
+	} else if obscount == 0 {
+		pto3.HTTPError(w, fmt.Sprintf("Observation set %s has no observations", vars["set"]), http.StatusNotFound)
+		return
+	}
+
+	// parse pagination parameters
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	// select output format, default to observation set file format
+	format, err := pto3.NegotiateObservationFormat(r)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "selecting format", err)
+		return
+	}
+	if format == nil {
+		format = pto3.ObservationFormatByName(pto3.ObservationFormatNDJSON)
+	}
+	markDeprecated(oa.config, w, r, "format "+format.Name)
+
+	// select fields to return, if given
+	fields, err := pto3.ParseObservationFields(r.Form.Get("fields"))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing fields", err)
+		return
+	}
+
+	// format numbers, times, and headers as requested, if the format allows
+	exportOpts, err := pto3.ParseExportOptions(r.Form)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing export options", err)
+		return
+	}
+	if err := format.CheckExportOptions(exportOpts); err != nil {
+		pto3.HandleErrorHTTP(w, "selecting export options", err)
+		return
+	}
+
+	// include metadata in the output if requested
+	var withMetadata bool
+	if metadatastr := r.Form.Get("metadata"); metadatastr != "" {
+		if withMetadata, err = strconv.ParseBool(metadatastr); err != nil {
+			pto3.HTTPError(w, fmt.Sprintf("bad metadata %s", metadatastr), http.StatusBadRequest)
+			return
+		}
+	}
+	if withMetadata && format.Name != pto3.ObservationFormatNDJSON {
+		pto3.HTTPError(w, fmt.Sprintf("metadata cannot be included in format %s", format.Name), http.StatusBadRequest)
+		return
+	}
+
+	// metadata is written as the first line of the first page only
+	var metadataLine []byte
+	if withMetadata && r.Form.Get("cursor") == "" {
+		set.LinkVia(oa.config)
+		if metadataLine, err = json.Marshal(&set); err != nil {
+			pto3.HandleErrorHTTP(w, "marshaling metadata", err)
+			return
+		}
+		metadataLine = append(metadataLine, '\n')
+	}
+
+	if r.Form.Get("cursor") == "" && r.Form.Get("limit") == "" {
+		w.Header().Set("Content-type", format.ContentType)
+		oa.additionalHeaders(w)
+		w.WriteHeader(http.StatusOK)
+		w.Write(metadataLine)
+		enc, _ := format.Encoder(w, fields, exportOpts)
+		err := set.CopyDataToEncoder(oa.replica, enc)
+		if err == nil {
+			err = enc.Close()
+		}
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "downloading observation set", err)
+			w.Write([]byte("\n\"error during download\"\n"))
+		}
 		return
 	}
-	tf.Sync()
 
-	// create condition and path caches
-	cidCache, err := pto3.LoadConditionCache(oa.db)
+	var after uint64
+	if cursor := r.Form.Get("cursor"); cursor != "" {
+		if after, err = strconv.ParseUint(cursor, 16, 64); err != nil {
+			pto3.HTTPError(w, fmt.Sprintf("bad cursor %s", cursor), http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := oa.config.PageLength
+	if limitstr := r.Form.Get("limit"); limitstr != "" {
+		if limit, err = strconv.Atoi(limitstr); err != nil || limit <= 0 {
+			pto3.HTTPError(w, fmt.Sprintf("bad limit %s", limitstr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// link to the next page, if there is one
+	next, more, err := set.NextDataPage(oa.replica, int(after), limit)
 	if err != nil {
-		pto3.HandleErrorHTTP(w, "loading condition cache", err)
+		pto3.HandleErrorHTTP(w, "paginating observation set", err)
 		return
 	}
-	pidCache := make(pto3.PathCache)
 
-	// now insert the tempfile into the database
-	if err := pto3.CopyDataFromObsFile(tf.Name(), oa.db, &set, cidCache, pidCache); err != nil {
-		pto3.HandleErrorHTTP(w, "inserting observations", err)
+	if more {
+		nextLink, _ := oa.config.LinkTo(fmt.Sprintf("obs/%x/data?cursor=%x&limit=%d", set.ID, next, limit))
+		if r.Form.Get("format") != "" {
+			nextLink += "&format=" + url.QueryEscape(format.Name)
+		}
+		if fields != nil {
+			nextLink += "&fields=" + url.QueryEscape(r.Form.Get("fields"))
+		}
+		if params := exportOpts.URLEncoded(); params != "" {
+			nextLink += "&" + params
+		}
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"next\"", nextLink))
+	}
+
+	w.Header().Set("Content-type", format.ContentType)
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(metadataLine)
+	enc, _ := format.Encoder(w, fields, exportOpts)
+	err = set.CopyDataPageToEncoder(oa.replica, enc, int(after), limit)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "downloading observation set", err)
+		w.Write([]byte("\n\"error during download\"\n"))
+	}
+}
+
+// handleExternalDownload handles GET /obs/<set>/data for an external set,
+// redirecting the client to the set's data on the PTO it lives on, or, if
+// the server is configured to proxy external sets, fetching the data from
+// there and writing it to the response.
+func (oa *ObsAPI) handleExternalDownload(w http.ResponseWriter, r *http.Request, set *pto3.ObservationSet) {
+	if !oa.config.ProxyExternalSets {
+		link := set.ExternalDataLink()
+		if r.URL.RawQuery != "" {
+			link += "?" + r.URL.RawQuery
+		}
+		oa.additionalHeaders(w)
+		http.Redirect(w, r, link, http.StatusTemporaryRedirect)
+		return
+	}
+
+	res, err := set.OpenExternalData(oa.config, r)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching external set data", err)
 		return
 	}
+	defer res.Body.Close()
+
+	w.Header().Set("Content-type", res.Header.Get("Content-Type"))
+	oa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	if _, err := io.Copy(w, res.Body); err != nil {
+		log.Printf("error proxying data of external set %x: %v", set.ID, err)
+	}
+}
 
-	// now update observation count
-	if _, err = set.CountObservations(oa.db); err != nil {
-		pto3.HandleErrorHTTP(w, "updating observation count", err)
+// handleRegisterExternal handles POST /obs/external. It requires a JSON
+// object with the link to an observation set on another PTO in "url", and
+// registers that set here as an external set, with the metadata fetched
+// from the other PTO. Its data stays on the other PTO. It writes the new
+// set's metadata to the response.
+func (oa *ObsAPI) handleRegisterExternal(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
 		return
 	}
 
-	// update time interval
-	if _, _, err = set.TimeInterval(oa.db); err != nil {
-		pto3.HandleErrorHTTP(w, "updating time interval", err)
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for external set registration must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" {
+		pto3.HTTPError(w, "missing url", http.StatusBadRequest)
+		return
+	}
+
+	set, err := oa.config.FetchExternalSet(req.URL)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching external set metadata", err)
+		return
+	}
+
+	// expand wildcard conditions and aliases
+	if err := oa.expandSetConditions(set); err != nil {
+		pto3.HandleErrorHTTP(w, "expanding set conditions", err)
+		return
+	}
+
+	if err := oa.config.CheckConditionNames(set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking condition names", err)
+		return
+	}
+
+	// make sure the visibility is usable
+	if err := oa.checkSetVisibility(r, set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking set visibility", err)
+		return
+	}
+
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		if err := set.Insert(t, true); err != nil {
+			return err
+		}
+		if err := set.LinkSources(t, oa.config, oa.rds); err != nil {
+			return err
+		}
+		return set.SetSubmitter(t, submitterForRequest(r))
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "inserting set record", err)
+		return
+	}
+
+	recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalCreate, fmt.Sprintf("obs/%x", set.ID))
+
+	oa.writeMetadataResponse(w, set, http.StatusCreated)
+}
+
+// handleImportSet handles POST /obs/import. It requires a JSON object with
+// the link to an observation set on another PTO in "url", and optionally an
+// API key to present to the other PTO in "api_key" and an import policy in
+// "import". It copies the set's metadata and data into a new set here, whose
+// _origin links back to the other PTO, resolving conflicts with an existing
+// set with the same UUID as POST /obs/create does. It writes the resulting
+// set's metadata to the response.
+func (oa *ObsAPI) handleImportSet(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for set import must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var req struct {
+		URL    string `json:"url"`
+		APIKey string `json:"api_key"`
+		Import string `json:"import"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" {
+		pto3.HTTPError(w, "missing url", http.StatusBadRequest)
+		return
+	}
+
+	policy, err := pto3.ParseImportPolicy(req.Import)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing import policy", err)
+		return
+	}
+
+	set, err := oa.config.FetchImportedSet(req.URL, req.APIKey)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching remote set metadata", err)
+		return
+	}
+
+	// expand wildcard conditions and aliases
+	if err := oa.expandSetConditions(set); err != nil {
+		pto3.HandleErrorHTTP(w, "expanding set conditions", err)
+		return
+	}
+
+	if err := oa.config.CheckConditionNames(set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking condition names", err)
+		return
+	}
+
+	// load a set which exists locally as a new one, to compare it later
+	uuid, err := set.StageImport(oa.db, policy)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "staging import", err)
+		return
+	}
+
+	// make sure the visibility is usable
+	if err := oa.checkSetVisibility(r, set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking set visibility", err)
+		return
+	}
+
+	// open the data before creating the set, so an unreachable PTO leaves
+	// nothing behind
+	res, err := oa.config.OpenImportedData(req.URL, req.APIKey)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching remote set data", err)
+		return
+	}
+	if res != nil {
+		defer res.Body.Close()
+	}
+
+	err = oa.db.RunInTransaction(func(t *pg.Tx) error {
+		if err := set.Insert(t, true); err != nil {
+			return err
+		}
+		if err := set.LinkSources(t, oa.config, oa.rds); err != nil {
+			return err
+		}
+		return set.SetSubmitter(t, submitterForRequest(r))
+	})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "inserting set record", err)
+		return
+	}
+
+	if res != nil {
+		if _, err := oa.copySetData(set, pto3.NewObservationReader(res.Body), false); err != nil {
+			oa.removeFailedSet(set)
+			pto3.HandleErrorHTTP(w, "inserting observations", err)
+			return
+		}
+	}
+
+	oa.writeCreatedSetResponse(w, set, uuid, policy, res != nil)
+}
+
+// handleUpload handles PUT /obs/<set>/data. It requires a newline-delimited
+// JSON stream (of content-type application/vnd.mami.ndjson) in observation set
+// file format. Set IDs and metadata in the input are ignored, so a file
+// downloaded with its metadata can be uploaded to another set. Data can only
+// be uploaded once, unless skip_duplicates is given, in which case only
+// observations not yet in the set are added. It writes a response containing
+// the set's metadata.
+func (oa *ObsAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !oa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	// fill in set ID from URL
+	setid, err := strconv.ParseUint(vars["set"], 16, 64)
+	if err != nil {
+		pto3.HTTPError(w, fmt.Sprintf("bad or missing set ID %s: %s", vars["set"], err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if !oa.checkSetReadable(w, r, int(setid)) {
+		return
+	}
+
+	// retrieve set metadata
+	set := pto3.ObservationSet{ID: int(setid)}
+	if err := set.SelectByID(oa.db); err != nil {
+		if err == pg.ErrNoRows {
+			pto3.HTTPError(w, fmt.Sprintf("Observation set %s not found", vars["set"]), http.StatusNotFound)
+		} else {
+			pto3.HandleErrorHTTP(w, "retrieving set metadata", err)
+		}
+		return
+	}
+
+	// fail if sealed or external
+	if set.Sealed != nil {
+		pto3.HTTPError(w, fmt.Sprintf("Observation set %s is sealed", vars["set"]), http.StatusConflict)
+		return
+	}
+	if set.External() != "" {
+		pto3.HTTPError(w, fmt.Sprintf("Observation set %s is external; its data lives at %s", vars["set"], set.External()), http.StatusConflict)
+		return
+	}
+
+	// the set may predate enforcement of the naming convention
+	if err := oa.config.CheckConditionNames(&set); err != nil {
+		pto3.HandleErrorHTTP(w, "checking condition names", err)
+		return
+	}
+
+	skipDuplicates, err := skipDuplicatesParam(r)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing upload parameters", err)
+		return
+	}
+
+	timeCheck, err := pto3.ParseTimeCheck(r.URL.Query().Get("check_times"))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing upload parameters", err)
+		return
+	}
+
+	// fail if observations exist, unless only new observations are to be added
+	obscount, err := set.CountObservations(oa.db)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "counting observations", err)
+		return
+	} else if obscount != 0 && !skipDuplicates {
+		pto3.HTTPError(w, fmt.Sprintf("Observation set %s already uploaded", vars["set"]), http.StatusBadRequest)
+		return
+	}
+
+	obsr := pto3.NewObservationReader(r.Body)
+	if err := oa.checkObservationTimes(&set, obsr, timeCheck); err != nil {
+		pto3.HandleErrorHTTP(w, "checking observation times", err)
+		return
+	}
+
+	// now stream observations into the database
+	skipped, err := oa.copySetData(&set, obsr, skipDuplicates)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "inserting observations", err)
 		return
 	}
+	if obscount == 0 {
+		recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalCreate, fmt.Sprintf("obs/%x/data", set.ID))
+	} else {
+		recordChange(oa.config, pto3.JournalStoreObs, pto3.JournalUpdate, fmt.Sprintf("obs/%x/data", set.ID))
+	}
+
+	if skipDuplicates {
+		w.Header().Set(SkippedObservationsHeader, strconv.Itoa(skipped))
+	}
+	if timeCheck == pto3.TimeCheckFlag {
+		w.Header().Set(TimeOutliersHeader, strconv.Itoa(obsr.TimeOutliers()))
+	}
 
 	// and write
 	oa.writeMetadataResponse(w, &set, http.StatusCreated)
 }
 
+// copySetData loads the observations remaining in an observation reader into
+// a set, then updates the set's cached observation count and time interval,
+// and records the upload in the ingest log, if one is configured.
+// If skipDuplicates is set, observations already in the set are skipped, and
+// the number skipped is returned.
+func (oa *ObsAPI) copySetData(set *pto3.ObservationSet, obsr *pto3.ObservationReader, skipDuplicates bool) (int, error) {
+	// create condition and path caches
+	cidCache, err := pto3.LoadConditionCache(oa.db)
+	if err != nil {
+		return 0, err
+	}
+	pidCache := make(pto3.PathCache)
+
+	obsr.SetLoadOptions(&oa.config.ObsDatabase)
+
+	// copy the upload to the ingest log, if there is one; an upload which
+	// can't be logged is refused, as it could not be recovered
+	ingestLog, err := oa.config.IngestLog()
+	if err != nil {
+		return 0, err
+	}
+	entry, err := ingestLog.Begin(obsr, skipDuplicates)
+	if err != nil {
+		return 0, err
+	}
+	defer entry.Abort()
+
+	skipped := 0
+	if skipDuplicates {
+		skipped, err = set.CopyDataFromReaderSkippingDuplicates(oa.db, obsr, cidCache, pidCache)
+	} else {
+		err = set.CopyDataFromReader(oa.db, obsr, cidCache, pidCache)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// remember observations flagged as outside the time range of the sources
+	if outliers := obsr.TimeOutliers(); outliers > 0 {
+		if err := set.AddTimeOutliers(oa.db, outliers); err != nil {
+			return 0, err
+		}
+	}
+
+	// now update observation count, which is stale if the set already had
+	// observations
+	set.Count = 0
+	if _, err := set.CountObservations(oa.db); err != nil {
+		return 0, err
+	}
+
+	// and time interval
+	if _, _, err = set.TimeInterval(oa.db); err != nil {
+		return 0, err
+	}
+
+	// the observations are loaded, so failing to log them is only logged
+	if _, err := entry.Commit(oa.db, set); err != nil {
+		log.Printf("cannot record upload to observation set %s in ingest log: %s", set.UUID(), err.Error())
+	}
+
+	return skipped, nil
+}
+
+// skipDuplicatesParam parses the optional skip_duplicates parameter of a
+// request uploading observations.
+func skipDuplicatesParam(r *http.Request) (bool, error) {
+	skipstr := r.URL.Query().Get("skip_duplicates")
+	if skipstr == "" {
+		return false, nil
+	}
+
+	skip, err := strconv.ParseBool(skipstr)
+	if err != nil {
+		return false, pto3.PTOErrorf("bad skip_duplicates %s", skipstr).StatusIs(http.StatusBadRequest)
+	}
+	return skip, nil
+}
+
+// checkObservationTimes makes an observation reader check the times of the
+// observations it reads against the time range of the raw data sources of
+// the set they are loaded into, as requested by the check_times parameter.
+func (oa *ObsAPI) checkObservationTimes(set *pto3.ObservationSet, obsr *pto3.ObservationReader, check pto3.TimeCheck) error {
+	if check == pto3.TimeCheckNone {
+		return nil
+	}
+
+	start, end, err := set.SourceTimeRange(oa.config, oa.rds)
+	if err != nil {
+		return err
+	}
+
+	obsr.CheckTimes(start, end, check)
+	return nil
+}
+
+// SkippedObservationsHeader is the response header giving the number of
+// duplicate observations skipped by an upload with skip_duplicates.
+const SkippedObservationsHeader = "Skipped-Observations"
+
+// TimeOutliersHeader is the response header giving the number of uploaded
+// observations flagged as outside the time range of their set's sources by
+// an upload with check_times=flag.
+const TimeOutliersHeader = "Time-Outliers"
+
+// ImportActionHeader is the response header telling what was done with an
+// observation set created with the import parameter; see pto3.ImportAction.
+const ImportActionHeader = "Import-Action"
+
 func (oa *ObsAPI) CreateTables() error {
-	return pto3.CreateTables(oa.db)
+	if err := pto3.CreateTables(oa.db); err != nil {
+		return err
+	}
+	if oa.config.ObservationPartitioning != nil {
+		return pto3.PartitionObservations(oa.db, oa.config.ObservationPartitioning)
+	}
+	return nil
 }
 
 func (oa *ObsAPI) DropTables() error {
@@ -554,6 +3063,22 @@ func (oa *ObsAPI) DropTables() error {
 
 func (oa *ObsAPI) EnableQueryLogging() {
 	pto3.EnableQueryLogging(oa.db)
+	if oa.replica != oa.db {
+		pto3.EnableQueryLogging(oa.replica)
+	}
+}
+
+// EnableEvidence allows this API to return raw data excerpts for source
+// references from the raw data store served by the given raw data API.
+func (oa *ObsAPI) EnableEvidence(ra *RawAPI) {
+	oa.rds = ra.rds
+}
+
+// EnableConditionReloads makes this API reload the conditions queries served
+// by the given query API are resolved against when it renames or aliases
+// conditions.
+func (oa *ObsAPI) EnableConditionReloads(qa *QueryAPI) {
+	oa.qc = qa.qc
 }
 
 func (oa *ObsAPI) additionalHeaders(w http.ResponseWriter) {
@@ -562,15 +3087,51 @@ func (oa *ObsAPI) additionalHeaders(w http.ResponseWriter) {
 	}
 }
 
-func (oa *ObsAPI) addRoutes(r *mux.Router, l *log.Logger) {
-	r.HandleFunc("/obs", LogAccess(l, oa.handleListSets)).Methods("GET")
-	r.HandleFunc("/obs/by_metadata", LogAccess(l, oa.handleMetadataQuery)).Methods("GET", "POST")
-	r.HandleFunc("/obs/conditions", LogAccess(l, oa.handleConditionQuery)).Methods("GET")
-	r.HandleFunc("/obs/create", LogAccess(l, oa.handleCreateSet)).Methods("POST")
-	r.HandleFunc("/obs/{set}", LogAccess(l, oa.handleGetMetadata)).Methods("GET")
-	r.HandleFunc("/obs/{set}", LogAccess(l, oa.handlePutMetadata)).Methods("PUT")
-	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleDownload)).Methods("GET")
-	r.HandleFunc("/obs/{set}/data", LogAccess(l, oa.handleUpload)).Methods("PUT")
+func (oa *ObsAPI) addRoutes(r *mux.Router) {
+	r.HandleFunc("/obs", oa.handleListSets).Methods("GET")
+	r.HandleFunc("/obs/by_metadata", oa.handleMetadataQuery).Methods("GET", "POST")
+	r.HandleFunc("/obs/by-metadata", oa.handleMetadataQuery).Methods("GET", "POST")
+	r.HandleFunc("/obs/conditions", oa.handleConditionQuery).Methods("GET")
+	r.HandleFunc("/obs/conditions/tree", oa.handleConditionTree).Methods("GET")
+	r.HandleFunc("/obs/conditions/daily", oa.handleConditionDaily).Methods("GET")
+	r.HandleFunc("/obs/conditions/aliases/{alias}", oa.handlePutConditionAlias).Methods("PUT")
+	r.HandleFunc("/obs/conditions/aliases/{alias}", oa.handleDeleteConditionAlias).Methods("DELETE")
+	r.HandleFunc("/obs/conditions/rename", oa.handleRenameCondition).Methods("POST")
+	r.HandleFunc("/obs/conditions/renames", oa.handleListConditionRenames).Methods("GET")
+	if oa.config.FeatureEnabled(pto3.FeatureConditionRegistry) {
+		r.HandleFunc("/obs/conditions/registry", oa.handleListRegistry).Methods("GET")
+		r.HandleFunc("/obs/conditions/ontology", oa.handleExportOntology).Methods("GET")
+		r.HandleFunc("/obs/conditions/ontology", oa.handleImportOntology).Methods("POST")
+		r.HandleFunc("/obs/conditions/registry/{condition}", oa.handleGetRegisteredCondition).Methods("GET")
+		r.HandleFunc("/obs/conditions/registry/{condition}", oa.handlePutRegisteredCondition).Methods("PUT")
+		r.HandleFunc("/obs/conditions/registry/{condition}", oa.handleDeleteRegisteredCondition).Methods("DELETE")
+	}
+	r.HandleFunc("/obs/derived", oa.handleDerived).Methods("GET")
+	r.HandleFunc("/obs/deleted", oa.handleListDeleted).Methods("GET")
+	r.HandleFunc("/obs/create", oa.ic.Idempotent(oa.handleCreateSet)).Methods("POST")
+	r.HandleFunc("/obs/merge", oa.ic.Idempotent(oa.handleMergeSets)).Methods("POST")
+	r.HandleFunc("/obs/external", oa.ic.Idempotent(oa.handleRegisterExternal)).Methods("POST")
+	r.HandleFunc("/obs/import", oa.ic.Idempotent(oa.handleImportSet)).Methods("POST")
+	r.HandleFunc("/obs/by_id/{id}", oa.handleSetAlias)
+	r.HandleFunc("/obs/by_id/{id}/data", oa.handleSetAlias)
+	r.HandleFunc("/obs/by_slug/{slug}", oa.handleSetAlias)
+	r.HandleFunc("/obs/by_slug/{slug}/data", oa.handleSetAlias)
+	r.HandleFunc("/obs/by_uuid/{uuid}", oa.handleSetAlias)
+	r.HandleFunc("/obs/by_uuid/{uuid}/data", oa.handleSetAlias)
+	r.HandleFunc("/obs/{set}", oa.handleGetMetadata).Methods("GET")
+	r.HandleFunc("/obs/{set}", oa.handlePutMetadata).Methods("PUT")
+	r.HandleFunc("/obs/{set}", oa.handleDelete).Methods("DELETE")
+	r.HandleFunc("/obs/{set}/data", oa.handleDownload).Methods("GET")
+	r.HandleFunc("/obs/{set}/data", oa.ic.Idempotent(oa.handleUpload)).Methods("PUT")
+	r.HandleFunc("/obs/{set}/seal", oa.handleSeal).Methods("POST")
+	r.HandleFunc("/obs/{set}/export", oa.handleExport).Methods("POST")
+	r.HandleFunc("/obs/{set}/rehydrate", oa.handleRehydrate).Methods("POST")
+	r.HandleFunc("/obs/{set}/restore", oa.handleRestore).Methods("POST")
+	r.HandleFunc("/obs/{set}/evidence", oa.handleEvidence).Methods("GET")
+	r.HandleFunc("/obs/{set}/provenance", oa.handleProvenance).Methods("GET")
+	r.HandleFunc("/obs/{set}/stats", oa.handleStats).Methods("GET")
+	r.HandleFunc("/obs/{set}/notes", oa.handleGetNotes).Methods("GET")
+	r.HandleFunc("/obs/{set}/notes", oa.handlePutNotes).Methods("PUT", "DELETE")
 }
 
 func NewObsAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) *ObsAPI {
@@ -581,9 +3142,15 @@ func NewObsAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) *Ob
 	oa := new(ObsAPI)
 	oa.config = config
 	oa.azr = azr
-	oa.db = pg.Connect(&config.ObsDatabase)
+	oa.db = pg.Connect(&config.ObsDatabase.Options)
+	oa.replica = config.ConnectObsReplica(oa.db)
+	config.ObsDatabaseHealth().Watch(oa.db)
+	if oa.replica != oa.db {
+		config.ObsDatabaseHealth().Watch(oa.replica)
+	}
+	oa.ic = NewIdempotencyCache(config.IdempotencyKeyLifetimeDuration(), config.IdempotencyCacheSize)
 
-	oa.addRoutes(r, config.AccessLogger())
+	oa.addRoutes(r)
 
 	return oa
 }
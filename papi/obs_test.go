@@ -7,9 +7,15 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-pg/pg"
 	pto3 "github.com/mami-project/pto3-go"
 )
 
@@ -21,6 +27,15 @@ type ClientObservationSet struct {
 	Link        string   `json:"__link"`
 	Datalink    string   `json:"__data"`
 	Count       int      `json:"__obs_count"`
+	Sealed      string   `json:"__sealed"`
+	Notes       string   `json:"__notes"`
+	UUID        string   `json:"_uuid"`
+	Supersedes  string   `json:"_supersedes,omitempty"`
+	Visibility  string   `json:"_visibility,omitempty"`
+	Project     string   `json:"_project,omitempty"`
+	Outliers    int      `json:"__time_outliers"`
+	External    string   `json:"_external,omitempty"`
+	Origin      string   `json:"_origin,omitempty"`
 }
 
 type ClientSetList struct {
@@ -245,6 +260,22 @@ func TestObsRoundtrip(t *testing.T) {
 	if err := compareObservationSlices(observations_up, observations_down); err != nil {
 		t.Fatal(err)
 	}
+
+	// conditions in the data must remain declared in metadata updates
+	setUp = setDown
+	setUp.Conditions = []string{"pto.test.succeeded", "pto.test.failed"}
+	executeWithJSON(TestRouter, t, "PUT", setlink, setUp, GoodAPIKey, http.StatusBadRequest)
+
+	setUp.Conditions = []string{"pto.test.succeeded", "pto.test.failed", "pto.test.schroedinger", "pto.test.color.red"}
+	res = executeWithJSON(TestRouter, t, "PUT", setlink, setUp, GoodAPIKey, http.StatusCreated)
+
+	setDown = ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	if len(setDown.Conditions) != 4 {
+		t.Fatalf("expected 4 conditions after adding a declared condition, got %v", setDown.Conditions)
+	}
 }
 
 func TestObsQuery(t *testing.T) {
@@ -256,7 +287,7 @@ func TestObsQuery(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf("https://ptotest.mami-project.eu/obs/%x", TestQueryCacheSetID) {
+	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf(TestAPIURL+"/obs/%x", TestQueryCacheSetID) {
 		t.Fatalf("unexpected result for ?k=this_is_the_query_test_obset: %v", setlist.Sets)
 	}
 
@@ -266,7 +297,7 @@ func TestObsQuery(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf("https://ptotest.mami-project.eu/obs/%x", TestQueryCacheSetID) {
+	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf(TestAPIURL+"/obs/%x", TestQueryCacheSetID) {
 		t.Fatalf("unexpected result for ?k=test_obset_type&v=query: %v", setlist.Sets)
 	}
 
@@ -276,7 +307,7 @@ func TestObsQuery(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf("https://ptotest.mami-project.eu/obs/%x", TestQueryCacheSetID) {
+	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf(TestAPIURL+"/obs/%x", TestQueryCacheSetID) {
 		t.Fatalf("unexpected result for analyzer query: %v", setlist.Sets)
 	}
 
@@ -298,14 +329,2124 @@ func TestObsQuery(t *testing.T) {
 		t.Fatal("missing test condition in /obs/conditions")
 	}
 
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/conditions/tree", nil, "", GoodAPIKey, http.StatusOK)
+
+	var condtree struct {
+		Conditions []*pto3.ConditionNode `json:"conditions"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &condtree); err != nil {
+		t.Fatal(err)
+	}
+
+	// walk down to pto.test.color
+	nodes := condtree.Conditions
+	var color *pto3.ConditionNode
+	for _, name := range []string{"pto", "pto.test", "pto.test.color"} {
+		color = nil
+		for _, node := range nodes {
+			if node.Name == name {
+				color = node
+				break
+			}
+		}
+		if color == nil {
+			t.Fatalf("missing node %s in /obs/conditions/tree", name)
+		}
+		nodes = color.Children
+	}
+
+	if color.Condition || color.Count == 0 {
+		t.Fatalf("unexpected node for pto.test.color: %v", color)
+	}
+
+	childCount := 0
+	for _, child := range color.Children {
+		if !child.Condition {
+			t.Fatalf("expected condition at %s", child.Name)
+		}
+		childCount += child.Count
+	}
+	if childCount != color.Count {
+		t.Fatalf("pto.test.color count %d is not the sum of its children's counts %d", color.Count, childCount)
+	}
+
 	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs/by_metadata?k=this_is_the_query_test_obset&condition=pto.test.color.orange", nil, "", GoodAPIKey, http.StatusOK)
 
 	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
 		t.Fatal(err)
 	}
 
-	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf("https://ptotest.mami-project.eu/obs/%x", TestQueryCacheSetID) {
+	if len(setlist.Sets) != 1 || setlist.Sets[0] != fmt.Sprintf(TestAPIURL+"/obs/%x", TestQueryCacheSetID) {
 		t.Fatalf("unexpected result for ?k=this_is_the_query_test_obset&condition=pto.test.color.orange: %v", setlist.Sets)
 	}
 
 }
+
+func TestObsDelete(t *testing.T) {
+	// create a new observation set with some data
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/passthrough",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/test001.json"},
+		Conditions:  []string{"pto.test.succeeded", "pto.test.failed"},
+		Description: "An observation set to exercise observation set deletion",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	setDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	observations_up_bytes := []byte(`["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["e1337", "2017-10-01T10:06:03Z", "2017-10-01T10:06:05Z", "* AS2 10.0.0.0/24", "pto.test.failed"]`)
+
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink, bytes.NewBuffer(observations_up_bytes),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	// other clients can't delete the set
+	executeRequest(TestRouter, t, "DELETE", setDown.Link, nil, "", OtherAPIKey, http.StatusForbidden)
+
+	// a dry run counts but doesn't delete
+	res = executeRequest(TestRouter, t, "DELETE", setDown.Link+"?dry_run=true", nil, "", GoodAPIKey, http.StatusOK)
+
+	var deletion pto3.ObservationSetDeletion
+	if err := json.Unmarshal(res.Body.Bytes(), &deletion); err != nil {
+		t.Fatal(err)
+	}
+
+	if !deletion.DryRun || deletion.Observations != 2 || deletion.Conditions != 2 || deletion.Set != setDown.Link {
+		t.Fatalf("unexpected dry run deletion %+v", deletion)
+	}
+
+	executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", GoodAPIKey, http.StatusOK)
+
+	// the creator can delete the set
+	res = executeRequest(TestRouter, t, "DELETE", setDown.Link, nil, "", GoodAPIKey, http.StatusOK)
+
+	deletion = pto3.ObservationSetDeletion{}
+	if err := json.Unmarshal(res.Body.Bytes(), &deletion); err != nil {
+		t.Fatal(err)
+	}
+
+	if deletion.DryRun || deletion.Purged || deletion.Observations != 2 {
+		t.Fatalf("unexpected deletion %+v", deletion)
+	}
+
+	executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", GoodAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "DELETE", setDown.Link, nil, "", GoodAPIKey, http.StatusNotFound)
+
+	// clients which may not delete sets can't tell sets they can't read
+	// from sets which don't exist; nor can those which may
+	executeRequest(TestRouter, t, "DELETE", setDown.Link, nil, "", LimitedAPIKey, http.StatusForbidden)
+	executeRequest(TestRouter, t, "DELETE", TestAPIURL+"/obs/7fffffff", nil, "", LimitedAPIKey, http.StatusForbidden)
+	executeRequest(TestRouter, t, "DELETE", setDown.Link, nil, "", OtherAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "DELETE", TestAPIURL+"/obs/7fffffff", nil, "", OtherAPIKey, http.StatusNotFound)
+
+	// deleted sets are listed for admins, who can restore them
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/deleted", nil, "", AdminAPIKey, http.StatusOK)
+	var setlist ClientSetList
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	listed := false
+	for _, link := range setlist.Sets {
+		listed = listed || link == setDown.Link
+	}
+	if !listed {
+		t.Fatalf("expected deleted set %s listed, got %v", setDown.Link, setlist.Sets)
+	}
+
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/restore", nil, "", GoodAPIKey, http.StatusForbidden)
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/restore", nil, "", AdminAPIKey, http.StatusOK)
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/restore", nil, "", AdminAPIKey, http.StatusConflict)
+	executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", GoodAPIKey, http.StatusOK)
+
+	// only admins can purge sets for good
+	executeRequest(TestRouter, t, "DELETE", setDown.Link+"?purge=true", nil, "", GoodAPIKey, http.StatusForbidden)
+	res = executeRequest(TestRouter, t, "DELETE", setDown.Link+"?purge=true", nil, "", AdminAPIKey, http.StatusOK)
+
+	deletion = pto3.ObservationSetDeletion{}
+	if err := json.Unmarshal(res.Body.Bytes(), &deletion); err != nil {
+		t.Fatal(err)
+	}
+
+	if !deletion.Purged || deletion.Observations != 2 {
+		t.Fatalf("unexpected purge %+v", deletion)
+	}
+
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/restore", nil, "", AdminAPIKey, http.StatusNotFound)
+}
+
+func TestObsListFilters(t *testing.T) {
+	// note the time before creating sets, to filter on creation time
+	before := time.Now().UTC().Add(-1 * time.Second)
+
+	analyzer := "https://ptotest.mami-project.eu/analysis/filter_test"
+	for i := 0; i < 3; i++ {
+		setUp := ClientObservationSet{
+			Analyzer:    fmt.Sprintf("%s/%d", analyzer, i),
+			Sources:     []string{"https://ptotest.mami-project.eu/raw/filter_test.json"},
+			Conditions:  []string{"pto.test.succeeded"},
+			Description: "An observation set to exercise observation set list filtering",
+		}
+
+		executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+			setUp, GoodAPIKey, http.StatusCreated)
+	}
+
+	var setlist ClientSetList
+
+	// filter by analyzer prefix
+	res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?analyzer="+url.QueryEscape(analyzer), nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 3 {
+		t.Fatalf("expected 3 sets filtered by analyzer, got %v", setlist.Sets)
+	}
+
+	// filter by analyzer and creation time
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?analyzer="+url.QueryEscape(analyzer+"/1")+
+		"&created_after="+url.QueryEscape(before.Format(time.RFC3339)), nil, "", GoodAPIKey, http.StatusOK)
+	setlist = ClientSetList{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 1 {
+		t.Fatalf("expected 1 set filtered by analyzer and creation time, got %v", setlist.Sets)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?analyzer="+url.QueryEscape(analyzer)+
+		"&created_before="+url.QueryEscape(before.Format(time.RFC3339)), nil, "", GoodAPIKey, http.StatusOK)
+	setlist = ClientSetList{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 0 {
+		t.Fatalf("expected no sets created before test, got %v", setlist.Sets)
+	}
+
+	// bad timestamps are refused
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?created_after=yesterday", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsMetadataLookup(t *testing.T) {
+	analyzer := "https://ptotest.mami-project.eu/analysis/lookup_test"
+	days := []string{"2017-10-02", "2017-10-01", "2017-10-02", `a "quoted" day`}
+	links := make([]string, len(days))
+	for i, day := range days {
+		setUp := map[string]interface{}{
+			"_analyzer":   analyzer,
+			"_sources":    []string{"https://ptotest.mami-project.eu/raw/lookup_test.json"},
+			"_conditions": []string{"pto.test.succeeded"},
+			"campaign":    "lookup-test",
+			"day":         day,
+		}
+
+		res := executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/create", setUp, GoodAPIKey, http.StatusCreated)
+
+		var setDown ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+			t.Fatal(err)
+		}
+		links[i] = setDown.Link
+	}
+
+	// lookups return links sorted by set ID, i.e. in order of creation here
+	lookups := map[string][]string{
+		"k=campaign&v=lookup-test": links,
+		"k=day&v=2017-10-02":       {links[0], links[2]},
+		"k=day&v=2017-10-02&analyzer=" + url.QueryEscape(analyzer): {links[0], links[2]},
+		"k=day&v=" + url.QueryEscape(days[3]):                      {links[3]},
+		"k=day&v=2017-10-03":                                       {},
+	}
+	for query, expected := range lookups {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by_metadata?"+query, nil, "", GoodAPIKey, http.StatusOK)
+
+		var setlist ClientSetList
+		if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(setlist.Sets) != fmt.Sprint(expected) {
+			t.Fatalf("?%s returned %v, expected %v", query, setlist.Sets, expected)
+		}
+	}
+}
+
+func TestObsSeal(t *testing.T) {
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/seal_test",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/seal_test.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "An observation set to exercise sealing",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	setDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	// sets without data can't be sealed
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/seal", nil, "", GoodAPIKey, http.StatusConflict)
+
+	observations_up_bytes := []byte(`["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`)
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink, bytes.NewBuffer(observations_up_bytes),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	// only the creator, or clients which may delete it, may seal a set
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/seal", nil, "", OtherAPIKey, http.StatusForbidden)
+
+	res = executeRequest(TestRouter, t, "POST", setDown.Link+"/seal", nil, "", GoodAPIKey, http.StatusOK)
+
+	sealedDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &sealedDown); err != nil {
+		t.Fatal(err)
+	}
+	if sealedDown.Sealed == "" {
+		t.Fatal("missing __sealed in sealed set metadata")
+	}
+
+	// sealed sets can't be sealed again, changed, or deleted by their creator
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/seal", nil, "", GoodAPIKey, http.StatusConflict)
+
+	setUp = setDown
+	setUp.Description = "An attempt to change a sealed set"
+	executeWithJSON(TestRouter, t, "PUT", setDown.Link, setUp, GoodAPIKey, http.StatusConflict)
+
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink, bytes.NewBuffer(observations_up_bytes),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusConflict)
+
+	executeRequest(TestRouter, t, "DELETE", setDown.Link, nil, "", GoodAPIKey, http.StatusForbidden)
+
+	// sealed sets can be listed
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?sealed=true&analyzer="+
+		url.QueryEscape(setUp.Analyzer), nil, "", GoodAPIKey, http.StatusOK)
+
+	var setlist ClientSetList
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 1 || setlist.Sets[0] != setDown.Link {
+		t.Fatalf("expected only the sealed set, got %v", setlist.Sets)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/obs?sealed=false&analyzer="+
+		url.QueryEscape(setUp.Analyzer), nil, "", GoodAPIKey, http.StatusOK)
+
+	setlist = ClientSetList{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+		t.Fatal(err)
+	}
+	if len(setlist.Sets) != 0 {
+		t.Fatalf("expected no unsealed sets, got %v", setlist.Sets)
+	}
+}
+
+func TestObsNotes(t *testing.T) {
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/notes_test",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/notes_test.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "An observation set to exercise notes",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	setDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	if setDown.Notes != "" {
+		t.Fatalf("new set has notes link %s", setDown.Notes)
+	}
+
+	notesLink := setDown.Link + "/notes"
+	executeRequest(TestRouter, t, "GET", notesLink, nil, "", GoodAPIKey, http.StatusNotFound)
+
+	// attach notes
+	notes := "# Methodology\n\nTargets behind the *test* middlebox were excluded.\n"
+	executeRequest(TestRouter, t, "PUT", notesLink, bytes.NewBufferString(notes), "application/json", GoodAPIKey, http.StatusUnsupportedMediaType)
+	res = executeRequest(TestRouter, t, "PUT", notesLink, bytes.NewBufferString(notes), "text/markdown", GoodAPIKey, http.StatusOK)
+
+	setDown = ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	if setDown.Notes != notesLink {
+		t.Fatalf("expected notes link %s, got %s", notesLink, setDown.Notes)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", notesLink, nil, "", GoodAPIKey, http.StatusOK)
+	if res.Header().Get("Content-Type") != "text/markdown; charset=utf-8" {
+		t.Fatalf("notes should be text/markdown, got %s", res.Header().Get("Content-Type"))
+	}
+	if res.Body.String() != notes {
+		t.Fatalf("expected notes %q, got %q", notes, res.Body.String())
+	}
+
+	// notes survive metadata updates
+	setUp = setDown
+	setUp.Description = "An observation set with notes"
+	executeWithJSON(TestRouter, t, "PUT", setDown.Link, setUp, GoodAPIKey, http.StatusCreated)
+
+	res = executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", GoodAPIKey, http.StatusOK)
+	setDown = ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	if setDown.Notes != notesLink {
+		t.Fatalf("expected notes link %s after metadata update, got %s", notesLink, setDown.Notes)
+	}
+
+	// overlong notes are rejected
+	long := bytes.Repeat([]byte("x"), pto3.MaxNotesLength+1)
+	executeRequest(TestRouter, t, "PUT", notesLink, bytes.NewBuffer(long), "text/markdown", GoodAPIKey, http.StatusRequestEntityTooLarge)
+
+	// remove notes
+	executeRequest(TestRouter, t, "DELETE", notesLink, nil, "", GoodAPIKey, http.StatusOK)
+	executeRequest(TestRouter, t, "GET", notesLink, nil, "", GoodAPIKey, http.StatusNotFound)
+}
+
+func TestObsEvidence(t *testing.T) {
+	// create a raw data file to refer to
+	cmdUp := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign filled with uninteresting test data",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/test", cmdUp, GoodAPIKey, http.StatusCreated)
+
+	fmdUp := testFileMetadata{
+		TimeStart: "2010-01-01T00:00:00Z",
+		TimeEnd:   "2010-01-02T00:00:00Z",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/test/evidence.json", fmdUp, GoodAPIKey, http.StatusCreated)
+
+	raw := "{\"a\":1}\n{\"b\":2}\n{\"c\":3}\n"
+	executeRequest(TestRouter, t, "PUT", TestAPIURL+"/raw/test/evidence.json/data", bytes.NewBufferString(raw),
+		"application/json", GoodAPIKey, http.StatusCreated)
+
+	// and a set derived from it
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/evidence_test",
+		Sources:     []string{TestAPIURL + "/raw/test/evidence.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "An observation set to exercise evidence extraction",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	setDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, params := range []string{"source=0&record=1", "source=0&offset=8", "source=0&offset=8&length=7"} {
+		res = executeRequest(TestRouter, t, "GET", setDown.Link+"/evidence?"+params, nil, "", GoodAPIKey, http.StatusOK)
+
+		var evidence struct {
+			Data    string `json:"__data"`
+			Excerpt string `json:"excerpt"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &evidence); err != nil {
+			t.Fatal(err)
+		}
+		if evidence.Excerpt != "{\"b\":2}" || evidence.Data != TestAPIURL+"/raw/test/evidence.json/data" {
+			t.Fatalf("bad evidence for %s: %s", params, res.Body.Bytes())
+		}
+	}
+
+	executeRequest(TestRouter, t, "GET", setDown.Link+"/evidence?source=0&record=3", nil, "", GoodAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "GET", setDown.Link+"/evidence?source=1&record=0", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", setDown.Link+"/evidence?source=0&record=0&offset=0", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsExport(t *testing.T) {
+	cmdUp := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign filled with uninteresting test data",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/test", cmdUp, GoodAPIKey, http.StatusCreated)
+
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/export_test",
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/export_test.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "An observation set to exercise export to the raw data store",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", "https://ptotest.mami-project.eu/obs/create",
+		setUp, GoodAPIKey, http.StatusCreated)
+
+	setDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	observations_up_bytes := []byte(`["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`)
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink, bytes.NewBuffer(observations_up_bytes),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	// unsealed sets can't be exported
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/export?campaign=test", nil, "", GoodAPIKey, http.StatusConflict)
+
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/seal", nil, "", GoodAPIKey, http.StatusOK)
+
+	// exporting needs a campaign and permission to write it, and trimming
+	// needs permission to delete observations
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/export", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/export?campaign=other", nil, "", GoodAPIKey, http.StatusForbidden)
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/export?campaign=test&trim=true", nil, "", GoodAPIKey, http.StatusForbidden)
+
+	res = executeRequest(TestRouter, t, "POST", setDown.Link+"/export?campaign=test&file=export.ndjson", nil, "", GoodAPIKey, http.StatusOK)
+
+	var arc pto3.ObservationSetArchive
+	if err := json.Unmarshal(res.Body.Bytes(), &arc); err != nil {
+		t.Fatal(err)
+	}
+	if arc.Campaign != "test" || arc.File != "export.ndjson" || arc.Count != 1 || arc.SHA256 == "" ||
+		arc.Link != TestAPIURL+"/raw/test/export.ndjson" || arc.Trimmed != nil {
+		t.Fatalf("bad archive %s", res.Body.Bytes())
+	}
+
+	// sets are archived only once
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/export?campaign=test", nil, "", GoodAPIKey, http.StatusConflict)
+
+	// the bundle records where it came from, and holds the whole set
+	res = executeRequest(TestRouter, t, "GET", arc.Link, nil, "", GoodAPIKey, http.StatusOK)
+	var md map[string]interface{}
+	if err := json.Unmarshal(res.Body.Bytes(), &md); err != nil {
+		t.Fatal(err)
+	}
+	if md["_file_type"] != pto3.ObsBundleFiletype || md[pto3.ArchivedSetMetadataKey] != setDown.Link ||
+		md[pto3.ArchivedSHA256MetadataKey] != arc.SHA256 || md[pto3.ArchivedCountMetadataKey] != "1" {
+		t.Fatalf("bad bundle metadata %s", res.Body.Bytes())
+	}
+
+	res = executeRequest(TestRouter, t, "GET", arc.Link+"/data", nil, "", GoodAPIKey, http.StatusOK)
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], setDown.Link) || !strings.Contains(lines[1], "pto.test.succeeded") {
+		t.Fatalf("bad bundle data %q", res.Body.String())
+	}
+
+	// once trimmed, the set's data is served from the bundle
+	res = executeRequest(TestRouter, t, "POST", setDown.Link+"/export?campaign=test&trim=true", nil, "", ArchivistAPIKey, http.StatusConflict)
+
+	file := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/export_test", "_sources": ["https://ptotest.mami-project.eu/raw/export_test.json"], "_conditions": ["pto.test.succeeded"], "description": "An observation set to exercise trimming"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`
+
+	res = executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+	setDown = ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/seal", nil, "", GoodAPIKey, http.StatusOK)
+
+	res = executeRequest(TestRouter, t, "POST", setDown.Link+"/export?campaign=test&trim=true", nil, "", ArchivistAPIKey, http.StatusOK)
+	arc = pto3.ObservationSetArchive{}
+	if err := json.Unmarshal(res.Body.Bytes(), &arc); err != nil {
+		t.Fatal(err)
+	}
+	if arc.Trimmed == nil || arc.Count != 1 {
+		t.Fatalf("bad trimmed archive %s", res.Body.Bytes())
+	}
+
+	res = executeRequest(TestRouter, t, "GET", setDown.Datalink, nil, "", GoodAPIKey, http.StatusTemporaryRedirect)
+	if location := res.Header().Get("Location"); location != arc.Link+"/data" {
+		t.Fatalf("expected redirect to bundle data, got %s", location)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", GoodAPIKey, http.StatusOK)
+	metadataDown := ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &metadataDown); err != nil {
+		t.Fatal(err)
+	}
+	if metadataDown.Count != 1 {
+		t.Fatalf("expected trimmed set to keep its count, got %d", metadataDown.Count)
+	}
+
+	// queries over trimmed sets scan their bundles
+	queryParams := fmt.Sprintf("set=%s&time_start=%s&time_end=%s", path.Base(setDown.Link),
+		url.QueryEscape("2017-10-01T10:00:00Z"), url.QueryEscape("2017-10-01T11:00:00Z"))
+	q := new(testQueryMetadata)
+	for {
+		res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/query/submit?"+queryParams, nil, "", GoodAPIKey, http.StatusOK)
+		if err := json.Unmarshal(res.Body.Bytes(), q); err != nil {
+			t.Fatal(err)
+		}
+		if q.State == "failed" {
+			t.Fatalf("query over trimmed set failed with error %s", q.Error)
+		} else if q.State == "complete" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", q.Result, nil, "", GoodAPIKey, http.StatusOK)
+	qr := new(testResultSet)
+	if err := json.Unmarshal(res.Body.Bytes(), qr); err != nil {
+		t.Fatal(err)
+	}
+	if len(qr.Obs) != 1 || qr.Obs[0][3] != "10.0.0.1 * 10.0.0.2" {
+		t.Fatalf("expected the trimmed set's observation in query results, got %s", res.Body.Bytes())
+	}
+
+	// rehydrated sets are served from the database again
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/rehydrate", nil, "", OtherAPIKey, http.StatusForbidden)
+
+	res = executeRequest(TestRouter, t, "POST", setDown.Link+"/rehydrate", nil, "", GoodAPIKey, http.StatusOK)
+	arc = pto3.ObservationSetArchive{}
+	if err := json.Unmarshal(res.Body.Bytes(), &arc); err != nil {
+		t.Fatal(err)
+	}
+	if arc.Trimmed != nil {
+		t.Fatalf("expected rehydrated set not to be trimmed, got %s", res.Body.Bytes())
+	}
+
+	executeRequest(TestRouter, t, "POST", setDown.Link+"/rehydrate", nil, "", GoodAPIKey, http.StatusConflict)
+
+	res = executeRequest(TestRouter, t, "GET", setDown.Datalink, nil, "", GoodAPIKey, http.StatusOK)
+	if !strings.Contains(res.Body.String(), "pto.test.succeeded") {
+		t.Fatalf("bad rehydrated data %q", res.Body.String())
+	}
+}
+
+type testRegisteredCondition struct {
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	ValueType   string `json:"value_type,omitempty"`
+	Units       string `json:"units,omitempty"`
+	Reference   string `json:"reference,omitempty"`
+	Link        string `json:"__link,omitempty"`
+}
+
+func TestConditionRegistry(t *testing.T) {
+	regURL := TestAPIURL + "/obs/conditions/registry"
+	rttURL := regURL + "/pto.test.registry.rtt"
+
+	executeRequest(TestRouter, t, "GET", rttURL, nil, "", GoodAPIKey, http.StatusNotFound)
+
+	// register a condition
+	rcUp := testRegisteredCondition{
+		Description: "Round-trip time to the target",
+		ValueType:   "number",
+		Units:       "ms",
+		Reference:   "https://ptotest.mami-project.eu/doc/rtt",
+	}
+	res := executeWithJSON(TestRouter, t, "PUT", rttURL, rcUp, GoodAPIKey, http.StatusCreated)
+
+	var rcDown testRegisteredCondition
+	if err := json.Unmarshal(res.Body.Bytes(), &rcDown); err != nil {
+		t.Fatal(err)
+	}
+	if rcDown.Name != "pto.test.registry.rtt" || rcDown.Units != "ms" || rcDown.Link != rttURL {
+		t.Fatalf("unexpected registered condition %v", rcDown)
+	}
+
+	// update it, and register another
+	rcUp.Units = "us"
+	executeWithJSON(TestRouter, t, "PUT", rttURL, rcUp, GoodAPIKey, http.StatusOK)
+	executeWithJSON(TestRouter, t, "PUT", regURL+"/pto.test.registry.reachable",
+		testRegisteredCondition{Description: "Target answered at all", ValueType: "none"}, GoodAPIKey, http.StatusCreated)
+
+	res = executeRequest(TestRouter, t, "GET", rttURL, nil, "", GoodAPIKey, http.StatusOK)
+	rcDown = testRegisteredCondition{}
+	if err := json.Unmarshal(res.Body.Bytes(), &rcDown); err != nil {
+		t.Fatal(err)
+	}
+	if rcDown.Units != "us" {
+		t.Fatalf("expected units us after update, got %s", rcDown.Units)
+	}
+
+	// look up by hierarchy and by search
+	listRegistry := func(query string, expected int) {
+		res := executeRequest(TestRouter, t, "GET", regURL+"?"+query, nil, "", GoodAPIKey, http.StatusOK)
+		var list struct {
+			Conditions []testRegisteredCondition `json:"conditions"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Conditions) != expected {
+			t.Fatalf("%s: expected %d registered conditions, got %v", query, expected, list.Conditions)
+		}
+	}
+
+	listRegistry("condition=pto.test.registry", 2)
+	listRegistry("condition=pto.test.registry.rtt", 1)
+	listRegistry("condition=pto.test.reg", 0)
+	listRegistry("condition=pto.test.registry&q=ROUND-TRIP", 1)
+
+	// bad registrations
+	executeWithJSON(TestRouter, t, "PUT", rttURL, testRegisteredCondition{ValueType: "number"}, GoodAPIKey, http.StatusBadRequest)
+	executeWithJSON(TestRouter, t, "PUT", rttURL, testRegisteredCondition{Description: "RTT", ValueType: "duration"}, GoodAPIKey, http.StatusBadRequest)
+	executeWithJSON(TestRouter, t, "PUT", rttURL, testRegisteredCondition{Name: "pto.test.other", Description: "RTT"}, GoodAPIKey, http.StatusBadRequest)
+	executeWithJSON(TestRouter, t, "PUT", regURL+"/pto.test.*", testRegisteredCondition{Description: "RTT"}, GoodAPIKey, http.StatusBadRequest)
+
+	// only administrators can change the registry
+	executeWithJSON(TestRouter, t, "PUT", rttURL, rcUp, OtherAPIKey, http.StatusForbidden)
+	executeRequest(TestRouter, t, "DELETE", rttURL, nil, "", OtherAPIKey, http.StatusForbidden)
+	executeRequest(TestRouter, t, "GET", rttURL, nil, "", OtherAPIKey, http.StatusOK)
+
+	// unregister
+	executeRequest(TestRouter, t, "DELETE", rttURL, nil, "", GoodAPIKey, http.StatusNoContent)
+	executeRequest(TestRouter, t, "DELETE", rttURL, nil, "", GoodAPIKey, http.StatusNotFound)
+	listRegistry("condition=pto.test.registry", 1)
+}
+
+type testConditionOntology struct {
+	Format     int                       `json:"format"`
+	Version    string                    `json:"version,omitempty"`
+	Conditions []testRegisteredCondition `json:"conditions"`
+}
+
+type testOntologyMergeReport struct {
+	Added     []string `json:"added"`
+	Updated   []string `json:"updated"`
+	Unchanged int      `json:"unchanged"`
+	Conflicts []struct {
+		Name  string `json:"name"`
+		Field string `json:"field"`
+	} `json:"conflicts"`
+	Version string `json:"version"`
+}
+
+func TestConditionOntology(t *testing.T) {
+	regURL := TestAPIURL + "/obs/conditions/registry"
+	ontURL := TestAPIURL + "/obs/conditions/ontology"
+
+	executeWithJSON(TestRouter, t, "PUT", regURL+"/pto.test.ontology.loss",
+		testRegisteredCondition{Description: "Packet loss", ValueType: "number", Units: "%"}, GoodAPIKey, http.StatusCreated)
+
+	exportOntology := func() testConditionOntology {
+		res := executeRequest(TestRouter, t, "GET", ontURL, nil, "", OtherAPIKey, http.StatusOK)
+		var ont testConditionOntology
+		if err := json.Unmarshal(res.Body.Bytes(), &ont); err != nil {
+			t.Fatal(err)
+		}
+		return ont
+	}
+
+	importOntology := func(ont testConditionOntology, query string, expectstatus int) testOntologyMergeReport {
+		res := executeWithJSON(TestRouter, t, "POST", ontURL+query, ont, GoodAPIKey, expectstatus)
+		var report testOntologyMergeReport
+		if expectstatus == http.StatusOK {
+			if err := json.Unmarshal(res.Body.Bytes(), &report); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return report
+	}
+
+	exported := exportOntology()
+	if exported.Format != 1 || exported.Version == "" {
+		t.Fatalf("unexpected ontology format %d version %q", exported.Format, exported.Version)
+	}
+
+	// another observatory's ontology fills in and disagrees with ours
+	imported := testConditionOntology{Format: 1, Conditions: []testRegisteredCondition{
+		{Name: "pto.test.ontology.jitter", Description: "Jitter", Units: "ms"},
+		{Name: "pto.test.ontology.loss", Description: "Loss rate", ValueType: "number", Units: "%",
+			Reference: "https://ptotest.mami-project.eu/doc/loss"},
+	}}
+
+	report := importOntology(imported, "?dry_run=true", http.StatusOK)
+	if len(report.Added) != 1 || report.Added[0] != "pto.test.ontology.jitter" ||
+		len(report.Updated) != 1 || len(report.Conflicts) != 1 || report.Conflicts[0].Field != "description" {
+		t.Fatalf("unexpected dry run report %+v", report)
+	}
+	executeRequest(TestRouter, t, "GET", regURL+"/pto.test.ontology.jitter", nil, "", GoodAPIKey, http.StatusNotFound)
+
+	getLoss := func() testRegisteredCondition {
+		res := executeRequest(TestRouter, t, "GET", regURL+"/pto.test.ontology.loss", nil, "", GoodAPIKey, http.StatusOK)
+		var rc testRegisteredCondition
+		if err := json.Unmarshal(res.Body.Bytes(), &rc); err != nil {
+			t.Fatal(err)
+		}
+		return rc
+	}
+
+	// local registrations are kept on conflict unless replaced
+	importOntology(imported, "", http.StatusOK)
+	executeRequest(TestRouter, t, "GET", regURL+"/pto.test.ontology.jitter", nil, "", GoodAPIKey, http.StatusOK)
+	if rc := getLoss(); rc.Description != "Packet loss" || rc.Reference != "https://ptotest.mami-project.eu/doc/loss" {
+		t.Fatalf("unexpected registration after merge %+v", rc)
+	}
+
+	importOntology(imported, "?policy=replace", http.StatusOK)
+	if rc := getLoss(); rc.Description != "Loss rate" {
+		t.Fatalf("unexpected registration after replacing merge %+v", rc)
+	}
+
+	// importing our own ontology changes nothing
+	exported = exportOntology()
+	report = importOntology(exported, "", http.StatusOK)
+	if len(report.Added) != 0 || len(report.Updated) != 0 || len(report.Conflicts) != 0 || report.Version != exported.Version {
+		t.Fatalf("unexpected report %+v importing own ontology version %s", report, exported.Version)
+	}
+
+	// bad imports
+	importOntology(testConditionOntology{Format: 2}, "", http.StatusBadRequest)
+	importOntology(imported, "?policy=sideways", http.StatusBadRequest)
+	importOntology(testConditionOntology{Format: 1, Conditions: []testRegisteredCondition{{Name: "pto.test.ontology.empty"}}},
+		"", http.StatusBadRequest)
+	executeWithJSON(TestRouter, t, "POST", ontURL, imported, OtherAPIKey, http.StatusForbidden)
+}
+
+func TestObsConditionDaily(t *testing.T) {
+	// create a raw data file in a campaign to derive a set from
+	cmdUp := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign to exercise observation rollups",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/rollup", cmdUp, GoodAPIKey, http.StatusCreated)
+
+	fmdUp := testFileMetadata{
+		TimeStart: "2017-10-01T00:00:00Z",
+		TimeEnd:   "2017-10-03T00:00:00Z",
+	}
+	rawLink := TestAPIURL + "/raw/rollup/rollup.json"
+	executeWithJSON(TestRouter, t, "PUT", rawLink, fmdUp, GoodAPIKey, http.StatusCreated)
+
+	// one set derived from the campaign, one not, and two which are not
+	// counted: a private set, and a set which is then deleted
+	links := make([]string, 0)
+	for _, file := range []string{
+		`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["` + rawLink + `"], "_conditions": ["pto.test.rollup.a", "pto.test.rollup.b"], "description": "An observation set to exercise observation rollups"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.rollup.a"]
+	["e1337", "2017-10-01T23:59:59Z", "2017-10-02T00:00:01Z", "10.0.0.1 * 10.0.0.3", "pto.test.rollup.a"]
+	["e1337", "2017-10-02T10:06:00Z", "2017-10-02T10:06:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.rollup.b"]`,
+		`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.rollup.a"], "description": "Another observation set to exercise observation rollups"}
+	["e1337", "2017-10-01T12:00:00Z", "2017-10-01T12:00:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.rollup.a"]`,
+		`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.rollup.a"], "_visibility": "private", "description": "A private observation set to exercise observation rollups"}
+	["e1337", "2017-10-01T12:00:00Z", "2017-10-01T12:00:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.rollup.a"]`,
+		`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.rollup.a"], "description": "A deleted observation set to exercise observation rollups"}
+	["e1337", "2017-10-01T12:00:00Z", "2017-10-01T12:00:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.rollup.a"]`,
+	} {
+		res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+			"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+		var set ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &set); err != nil {
+			t.Fatal(err)
+		}
+		links = append(links, set.Link)
+	}
+	executeRequest(TestRouter, t, "DELETE", links[3], nil, "", GoodAPIKey, http.StatusOK)
+
+	type dayCount struct {
+		Day       string `json:"day"`
+		Condition string `json:"condition"`
+		Campaign  string `json:"campaign"`
+		Count     int    `json:"count"`
+	}
+
+	daily := func(params string) []dayCount {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/conditions/daily?"+params, nil, "", GoodAPIKey, http.StatusOK)
+
+		var out struct {
+			Days []dayCount `json:"days"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Days
+	}
+
+	checkDaily := func(params string, expected []dayCount) {
+		days := daily(params)
+		if len(days) != len(expected) {
+			t.Fatalf("expected %d daily counts for %s, got %+v", len(expected), params, days)
+		}
+		for i := range expected {
+			if days[i] != expected[i] {
+				t.Fatalf("expected daily count %+v for %s, got %+v", expected[i], params, days[i])
+			}
+		}
+	}
+
+	checkDaily("condition=pto.test.rollup.*", []dayCount{
+		{"2017-10-01", "pto.test.rollup.a", "", 1},
+		{"2017-10-01", "pto.test.rollup.a", "rollup", 2},
+		{"2017-10-02", "pto.test.rollup.b", "rollup", 1},
+	})
+	checkDaily("condition=pto.test.rollup&campaign=rollup", []dayCount{
+		{"2017-10-01", "pto.test.rollup.a", "rollup", 2},
+		{"2017-10-02", "pto.test.rollup.b", "rollup", 1},
+	})
+	checkDaily("condition=pto.test.rollup.a&time_start=2017-10-01T00:00:00Z&time_end=2017-10-02T00:00:00Z", []dayCount{
+		{"2017-10-01", "pto.test.rollup.a", "", 1},
+		{"2017-10-01", "pto.test.rollup.a", "rollup", 2},
+	})
+	checkDaily("condition=pto.test.rollup.b&time_start=2017-10-03T00:00:00Z", []dayCount{})
+
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/conditions/daily", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/conditions/daily?condition=pto.test.rollup.none", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/conditions/daily?condition=pto.test.rollup.a&time_start=yesterday", nil, "", GoodAPIKey, http.StatusBadRequest)
+
+	// the condition tree counts the same observations, once it is reloaded
+	lifetime := TestConfig.ConditionTreeLifetime
+	TestConfig.ConditionTreeLifetime = -1
+	defer func() { TestConfig.ConditionTreeLifetime = lifetime }()
+
+	res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/conditions/tree", nil, "", GoodAPIKey, http.StatusOK)
+
+	var condtree struct {
+		Conditions []*pto3.ConditionNode `json:"conditions"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &condtree); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := condtree.Conditions
+	var rollup *pto3.ConditionNode
+	for _, name := range []string{"pto", "pto.test", "pto.test.rollup", "pto.test.rollup.a"} {
+		rollup = nil
+		for _, node := range nodes {
+			if node.Name == name {
+				rollup = node
+				break
+			}
+		}
+		if rollup == nil {
+			t.Fatalf("missing node %s in /obs/conditions/tree", name)
+		}
+		nodes = rollup.Children
+	}
+
+	if rollup.Count != 3 {
+		t.Fatalf("expected 3 observations of pto.test.rollup.a in public sets, got %d", rollup.Count)
+	}
+}
+
+func TestObsProvenance(t *testing.T) {
+	// create a raw data file to derive sets from
+	cmdUp := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign filled with uninteresting test data",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/test", cmdUp, GoodAPIKey, http.StatusCreated)
+
+	fmdUp := testFileMetadata{
+		TimeStart: "2010-01-01T00:00:00Z",
+		TimeEnd:   "2010-01-02T00:00:00Z",
+	}
+	rawLink := TestAPIURL + "/raw/test/provenance.json"
+	executeWithJSON(TestRouter, t, "PUT", rawLink, fmdUp, GoodAPIKey, http.StatusCreated)
+
+	createSet := func(sources []string, status int) ClientObservationSet {
+		setUp := ClientObservationSet{
+			Analyzer:    "https://ptotest.mami-project.eu/analysis/provenance_test",
+			Sources:     sources,
+			Conditions:  []string{"pto.test.succeeded"},
+			Description: "An observation set to exercise provenance",
+		}
+		res := executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/create", setUp, GoodAPIKey, status)
+
+		var setDown ClientObservationSet
+		if status == http.StatusCreated {
+			if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return setDown
+	}
+
+	// a set derived from the raw file and an external source, and a set
+	// derived from that set in turn
+	external := "https://example.com/measurements/provenance.json"
+	first := createSet([]string{rawLink, external}, http.StatusCreated)
+	second := createSet([]string{first.Link}, http.StatusCreated)
+
+	// sources on this PTO must exist
+	createSet([]string{TestAPIURL + "/raw/test/nonexistent.json"}, http.StatusBadRequest)
+	createSet([]string{TestAPIURL + "/obs/7fffffff"}, http.StatusBadRequest)
+
+	// walk upstream
+	res := executeRequest(TestRouter, t, "GET", second.Link+"/provenance", nil, "", GoodAPIKey, http.StatusOK)
+
+	var prov struct {
+		Sources  []string `json:"sources"`
+		Sets     []string `json:"sets"`
+		Raw      []string `json:"raw"`
+		External []string `json:"external"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &prov); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(prov.Sources) != 1 || prov.Sources[0] != first.Link {
+		t.Fatalf("expected sources [%s], got %v", first.Link, prov.Sources)
+	}
+	if len(prov.Sets) != 1 || prov.Sets[0] != first.Link {
+		t.Fatalf("expected sets [%s], got %v", first.Link, prov.Sets)
+	}
+	if len(prov.Raw) != 1 || prov.Raw[0] != rawLink {
+		t.Fatalf("expected raw [%s], got %v", rawLink, prov.Raw)
+	}
+	if len(prov.External) != 1 || prov.External[0] != external {
+		t.Fatalf("expected external [%s], got %v", external, prov.External)
+	}
+
+	// walk downstream
+	derived := func(source string, expected ...string) {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/derived?source="+url.QueryEscape(source), nil, "", GoodAPIKey, http.StatusOK)
+
+		var sets struct {
+			Sets []string `json:"sets"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &sets); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(sets.Sets) != len(expected) {
+			t.Fatalf("expected sets %v derived from %s, got %v", expected, source, sets.Sets)
+		}
+		for i := range expected {
+			if sets.Sets[i] != expected[i] {
+				t.Fatalf("expected sets %v derived from %s, got %v", expected, source, sets.Sets)
+			}
+		}
+	}
+
+	derived(rawLink, first.Link, second.Link)
+	derived(first.Link, second.Link)
+	derived(second.Link)
+
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/derived?source="+url.QueryEscape(external), nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsMerge(t *testing.T) {
+	// create sets from two vantage points with an overlapping observation
+	createSet := func(analyzer string, source string, observations string) ClientObservationSet {
+		setUp := map[string]interface{}{
+			"_analyzer":   analyzer,
+			"_sources":    []string{"https://example.com/measurements/common.json", source},
+			"_conditions": []string{"pto.test.succeeded", "pto.test.failed"},
+			"description": "A per-vantage point observation set to exercise merging",
+			"campaign":    "merge_test",
+			"vantage":     source,
+		}
+		res := executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/create", setUp, GoodAPIKey, http.StatusCreated)
+
+		var setDown ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+			t.Fatal(err)
+		}
+
+		executeRequest(TestRouter, t, "PUT", setDown.Datalink, bytes.NewBufferString(observations),
+			"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+		return setDown
+	}
+
+	analyzer := "https://ptotest.mami-project.eu/analysis/merge_test"
+	first := createSet(analyzer, "https://example.com/measurements/vp1.json",
+		`["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+		["e1337", "2017-10-01T10:06:03Z", "2017-10-01T10:06:05Z", "* AS2 10.0.0.0/24", "pto.test.failed"]`)
+	second := createSet(analyzer, "https://example.com/measurements/vp2.json",
+		`["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+		["e1337", "2017-10-01T10:07:00Z", "2017-10-01T10:07:00Z", "10.0.0.3 * 10.0.0.2", "pto.test.succeeded"]`)
+
+	merge := func(sets []string, deduplicate bool, metadata map[string]string, status int) ClientObservationSet {
+		mergeUp := map[string]interface{}{
+			"sets":        sets,
+			"deduplicate": deduplicate,
+			"metadata":    metadata,
+		}
+		res := executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/merge", mergeUp, GoodAPIKey, status)
+
+		var setDown ClientObservationSet
+		if status == http.StatusCreated {
+			if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return setDown
+	}
+
+	// merging needs permission to read the merged sets' data
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/merge",
+		map[string]interface{}{"sets": []string{first.Link, second.Link}}, OtherAPIKey, http.StatusForbidden)
+
+	// without deduplication, all observations are kept
+	merged := merge([]string{first.Link, second.Link}, false, nil, http.StatusCreated)
+	if merged.Count != 4 {
+		t.Fatalf("expected 4 observations in merged set, got %d", merged.Count)
+	}
+
+	// with deduplication, the common observation appears once
+	merged = merge([]string{first.Link, second.Link}, true, map[string]string{"description": "all vantage points"}, http.StatusCreated)
+	if merged.Count != 3 {
+		t.Fatalf("expected 3 observations in deduplicated set, got %d", merged.Count)
+	}
+
+	if merged.Analyzer != analyzer {
+		t.Fatalf("expected analyzer %s, got %s", analyzer, merged.Analyzer)
+	}
+
+	expectedSources := []string{
+		"https://example.com/measurements/common.json",
+		"https://example.com/measurements/vp1.json",
+		"https://example.com/measurements/vp2.json",
+	}
+	if fmt.Sprint(merged.Sources) != fmt.Sprint(expectedSources) {
+		t.Fatalf("expected sources %v, got %v", expectedSources, merged.Sources)
+	}
+
+	if merged.Description != "all vantage points" {
+		t.Fatalf("got unexpected description %s", merged.Description)
+	}
+
+	// metadata the sets agree on is kept, and metadata they don't is dropped
+	res := executeRequest(TestRouter, t, "GET", merged.Link, nil, "", GoodAPIKey, http.StatusOK)
+	var mergedMetadata map[string]interface{}
+	if err := json.Unmarshal(res.Body.Bytes(), &mergedMetadata); err != nil {
+		t.Fatal(err)
+	}
+	if mergedMetadata["campaign"] != "merge_test" {
+		t.Fatalf("expected common metadata to be kept, got campaign %v", mergedMetadata["campaign"])
+	}
+	if _, ok := mergedMetadata["vantage"]; ok {
+		t.Fatalf("expected conflicting metadata to be dropped, got vantage %v", mergedMetadata["vantage"])
+	}
+
+	// sets from different analyzers need an explicit analyzer
+	other := createSet("https://ptotest.mami-project.eu/analysis/other", "https://example.com/measurements/vp3.json",
+		`["e1337", "2017-10-01T10:08:00Z", "2017-10-01T10:08:00Z", "10.0.0.4 * 10.0.0.2", "pto.test.failed"]`)
+	merge([]string{first.Link, other.Link}, false, nil, http.StatusBadRequest)
+	merged = merge([]string{first.Link, other.Link}, false, map[string]string{"_analyzer": analyzer}, http.StatusCreated)
+	if merged.Analyzer != analyzer || merged.Count != 3 {
+		t.Fatalf("unexpected merge of sets with different analyzers: analyzer %s, %d observations", merged.Analyzer, merged.Count)
+	}
+
+	// merging needs at least two sets, all on this PTO
+	merge([]string{first.Link, first.Link}, false, nil, http.StatusBadRequest)
+	merge([]string{first.Link, "https://example.com/obs/1"}, false, nil, http.StatusBadRequest)
+	merge([]string{first.Link, TestAPIURL + "/obs/7fffffff"}, false, nil, http.StatusBadRequest)
+}
+
+func TestObsSkipDuplicates(t *testing.T) {
+	// the second observation differs from the first only in its source reference
+	metadata := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded", "pto.test.failed"], "description": "An observation set uploaded twice"}`
+	data := `["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded", 1, {"source": 0, "record": 1}]
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded", 1, {"source": 0, "record": 2}]
+	["e1337", "2017-10-01T10:06:03Z", "2017-10-01T10:06:05Z", "* AS2 10.0.0.0/24", "pto.test.failed"]`
+
+	upload := func(method string, url string, body string, count int, skipped string) ClientObservationSet {
+		res := executeRequest(TestRouter, t, method, url, bytes.NewBufferString(body),
+			"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+		if res.Header().Get("Skipped-Observations") != skipped {
+			t.Fatalf("%s %s expected %s observations skipped, got %s", method, url, skipped, res.Header().Get("Skipped-Observations"))
+		}
+
+		var setDown ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+			t.Fatal(err)
+		}
+		if setDown.Count != count {
+			t.Fatalf("%s %s expected %d observations, got %d", method, url, count, setDown.Count)
+		}
+		return setDown
+	}
+
+	// duplicates within an upload are skipped
+	setDown := upload("POST", TestAPIURL+"/obs/create?skip_duplicates=true", metadata+"\n"+data, 2, "1")
+
+	// without skipping duplicates, data can only be uploaded once
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink, bytes.NewBufferString(data),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+
+	// with it, a rerun only adds new observations
+	rerun := data + `
+	["e1337", "2017-10-01T10:07:00Z", "2017-10-01T10:07:02Z", "* AS2 10.0.0.0/24", "pto.test.failed"]`
+	upload("PUT", setDown.Datalink+"?skip_duplicates=true", rerun, 3, "3")
+
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink+"?skip_duplicates=maybe", bytes.NewBufferString(data),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsFile(t *testing.T) {
+	// create a set and upload its data in a single observation set file
+	file := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded", "pto.test.failed"], "description": "An observation set uploaded as a single file"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["e1337", "2017-10-01T10:06:03Z", "2017-10-01T10:06:05Z", "* AS2 10.0.0.0/24", "pto.test.failed"]`
+
+	res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	if setDown.Count != 2 || setDown.Description != "An observation set uploaded as a single file" {
+		t.Fatalf("unexpected set created from observation set file: %v", setDown)
+	}
+
+	// download it again with its metadata, and use that to create a copy
+	res = executeRequest(TestRouter, t, "GET", setDown.Datalink+"?metadata=true", nil, "", GoodAPIKey, http.StatusOK)
+	set, obsdat, err := pto3.ReadObservationFile(bytes.NewReader(res.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.Metadata["description"] != setDown.Description || len(obsdat) != 2 {
+		t.Fatalf("downloaded observation set file doesn't describe set: %v with %d observations", set, len(obsdat))
+	}
+
+	if set.UUID() != setDown.UUID || setDown.UUID == "" {
+		t.Fatalf("downloaded observation set file has UUID %s, expected %s", set.UUID(), setDown.UUID)
+	}
+
+	// the file describes the same logical set, which can only exist once
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewReader(res.Body.Bytes()),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+
+	// without its UUID, it makes a copy
+	delete(set.Metadata, pto3.UUIDMetadataKey)
+	var copyFile bytes.Buffer
+	if err := pto3.WriteObservationFile(set, obsdat, &copyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	res = executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", &copyFile,
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var copyDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &copyDown); err != nil {
+		t.Fatal(err)
+	}
+	if copyDown.Link == setDown.Link || copyDown.Count != 2 || copyDown.Description != setDown.Description ||
+		copyDown.UUID == "" || copyDown.UUID == setDown.UUID {
+		t.Fatalf("unexpected copy of set from downloaded observation set file: %v", copyDown)
+	}
+
+	// metadata is only written in NDJSON, and is required on creation
+	executeRequest(TestRouter, t, "GET", setDown.Datalink+"?metadata=true&format=csv", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create",
+		bytes.NewBufferString(`["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+
+	// observations with undeclared conditions fail the whole creation
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create",
+		bytes.NewBufferString(strings.Replace(file, `"* AS2 10.0.0.0/24", "pto.test.failed"`, `"* AS2 10.0.0.0/24", "pto.test.undeclared"`, 1)),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsImport(t *testing.T) {
+	file := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded", "pto.test.failed"], "_slug": "import-test", "description": "An observation set to be mirrored"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["e1337", "2017-10-01T10:06:03Z", "2017-10-01T10:06:05Z", "* AS2 10.0.0.0/24", "pto.test.failed"]`
+
+	res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	// download it as a mirror would
+	res = executeRequest(TestRouter, t, "GET", setDown.Datalink+"?metadata=true", nil, "", GoodAPIKey, http.StatusOK)
+	set, obsdat, err := pto3.ReadObservationFile(bytes.NewReader(res.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	importSet := func(policy string, expectstatus int, expectaction string) *ClientObservationSet {
+		var buf bytes.Buffer
+		if err := pto3.WriteObservationFile(set, obsdat, &buf); err != nil {
+			t.Fatal(err)
+		}
+
+		res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create?import="+policy, &buf,
+			"application/vnd.mami.ndjson", GoodAPIKey, expectstatus)
+
+		if action := res.Header().Get("Import-Action"); action != expectaction {
+			t.Fatalf("import with policy %s: expected action %q, got %q", policy, expectaction, action)
+		}
+		if expectaction == "" {
+			return nil
+		}
+
+		var imported ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &imported); err != nil {
+			t.Fatal(err)
+		}
+		return &imported
+	}
+
+	// an unchanged set is left alone whatever the policy
+	for _, policy := range []string{"skip", "update", "supersede"} {
+		if imported := importSet(policy, http.StatusOK, "unchanged"); imported.Link != setDown.Link {
+			t.Fatalf("unchanged import resolved to %s, expected %s", imported.Link, setDown.Link)
+		}
+	}
+	importSet("sideways", http.StatusBadRequest, "")
+
+	// changed metadata is skipped or updated
+	set.Metadata["description"] = "An observation set mirrored with new metadata"
+	if imported := importSet("skip", http.StatusOK, "skipped"); imported.Description != setDown.Description {
+		t.Fatalf("skipped import changed description to %s", imported.Description)
+	}
+	if imported := importSet("update", http.StatusOK, "updated"); imported.Link != setDown.Link ||
+		imported.UUID != setDown.UUID || imported.Description != set.Metadata["description"] {
+		t.Fatalf("unexpected set after updating import: %v", imported)
+	}
+
+	// changed data can't be updated, but supersedes the existing set
+	var obs pto3.Observation
+	if err := json.Unmarshal([]byte(`["e1337", "2017-10-01T10:07:00Z", "2017-10-01T10:07:02Z", "* AS2 10.0.0.0/24", "pto.test.failed"]`), &obs); err != nil {
+		t.Fatal(err)
+	}
+	obsdat = append(obsdat, obs)
+
+	importSet("update", http.StatusConflict, "")
+	newVersion := importSet("supersede", http.StatusCreated, "superseded")
+	if newVersion.Link == setDown.Link || newVersion.UUID == setDown.UUID ||
+		newVersion.Supersedes != setDown.UUID || newVersion.Count != 3 {
+		t.Fatalf("unexpected new version of set after superseding import: %v", newVersion)
+	}
+
+	// importing again compares against the new version
+	if imported := importSet("supersede", http.StatusOK, "unchanged"); imported.Link != newVersion.Link {
+		t.Fatalf("repeated import resolved to %s, expected %s", imported.Link, newVersion.Link)
+	}
+
+	// and the slug follows the new version
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by_slug/import-test", nil, "", GoodAPIKey, http.StatusTemporaryRedirect)
+	if location := res.Header().Get("Location"); location != newVersion.Link {
+		t.Fatalf("slug redirects to %s, expected %s", location, newVersion.Link)
+	}
+
+	// without a policy, an existing UUID is still refused
+	importSet("", http.StatusBadRequest, "")
+}
+
+func TestObsAliases(t *testing.T) {
+	file := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded"], "_slug": "alias-test", "description": "An observation set with a slug"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`
+
+	res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	setid, err := strconv.ParseInt(path.Base(setDown.Link), 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redirects := map[string]string{
+		fmt.Sprintf("/obs/by_id/%d", setid):             setDown.Link,
+		fmt.Sprintf("/obs/by_id/%d/data?page=1", setid): setDown.Link + "/data?page=1",
+		"/obs/by_slug/alias-test":                       setDown.Link,
+		"/obs/by_slug/alias-test/data":                  setDown.Link + "/data",
+		"/obs/by_uuid/" + setDown.UUID:                  setDown.Link,
+	}
+	for alias, expected := range redirects {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+alias, nil, "", GoodAPIKey, http.StatusTemporaryRedirect)
+		if location := res.Header().Get("Location"); location != expected {
+			t.Fatalf("%s redirects to %s, expected %s", alias, location, expected)
+		}
+	}
+
+	// IDs which don't fit an int are refused rather than wrapped around
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by_id/99999999999999999999", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by_id/-1", nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by_slug/no-such-slug", nil, "", GoodAPIKey, http.StatusNotFound)
+
+	// another set can't take the slug
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsETags(t *testing.T) {
+	file := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded"], "description": "An observation set to be cached"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]`
+
+	res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	revalidate := func(url string, etag string, expectstatus int) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+		req.Header.Set("If-None-Match", etag)
+		res := httptest.NewRecorder()
+		TestHandler.ServeHTTP(res, req)
+
+		if res.Code != expectstatus {
+			t.Fatalf("GET %s with If-None-Match %s expected status %d but got %d", url, etag, expectstatus, res.Code)
+		}
+		if res.Header().Get("ETag") == "" {
+			t.Fatalf("GET %s returned no ETag", url)
+		}
+		return res
+	}
+
+	for _, url := range []string{setDown.Link, TestAPIURL + "/obs/conditions", TestAPIURL + "/obs/conditions/tree"} {
+		res := executeRequest(TestRouter, t, "GET", url, nil, "", GoodAPIKey, http.StatusOK)
+		etag := res.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("GET %s returned no ETag", url)
+		}
+
+		// unchanged resources need not be sent again
+		if res := revalidate(url, etag, http.StatusNotModified); res.Body.Len() != 0 {
+			t.Fatalf("GET %s not modified, but returned a body", url)
+		}
+		revalidate(url, `"0123", W/`+etag, http.StatusNotModified)
+		revalidate(url, `"0123"`, http.StatusOK)
+	}
+
+	// changed metadata gets a new ETag
+	res = executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", GoodAPIKey, http.StatusOK)
+	etag := res.Header().Get("ETag")
+
+	setDown.Description = "An observation set which has changed"
+	executeWithJSON(TestRouter, t, "PUT", setDown.Link, setDown, GoodAPIKey, http.StatusCreated)
+
+	res = revalidate(setDown.Link, etag, http.StatusOK)
+	if res.Header().Get("ETag") == etag {
+		t.Fatalf("ETag %s unchanged after changing metadata", etag)
+	}
+}
+
+func TestObsVisibility(t *testing.T) {
+	analyzer := "https://ptotest.mami-project.eu/analysis/visibility_test"
+	setUp := ClientObservationSet{
+		Analyzer:    analyzer,
+		Sources:     []string{"https://ptotest.mami-project.eu/raw/test001.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "An observation set not to be seen by everyone",
+		Visibility:  pto3.VisibilityPrivate,
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/create", setUp, GoodAPIKey, http.StatusCreated)
+
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := func(apikey string) bool {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs?analyzer="+url.QueryEscape(analyzer), nil, "", apikey, http.StatusOK)
+		var setlist ClientSetList
+		if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+			t.Fatal(err)
+		}
+		return len(setlist.Sets) == 1 && setlist.Sets[0] == setDown.Link
+	}
+
+	// private sets are only visible to their owner
+	executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", GoodAPIKey, http.StatusOK)
+	executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", OtherAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "GET", setDown.Link+"/stats", nil, "", OtherAPIKey, http.StatusNotFound)
+	executeWithJSON(TestRouter, t, "PUT", setDown.Link, setDown, OtherAPIKey, http.StatusNotFound)
+	if !listed(GoodAPIKey) {
+		t.Fatalf("private set %s not listed for its owner", setDown.Link)
+	}
+	if listed(OtherAPIKey) {
+		t.Fatalf("private set %s listed for another client", setDown.Link)
+	}
+
+	// project sets are visible to the project's members
+	setDown.Visibility = pto3.VisibilityProject
+	executeWithJSON(TestRouter, t, "PUT", setDown.Link, setDown, GoodAPIKey, http.StatusBadRequest)
+	setDown.Project = "collab"
+	executeWithJSON(TestRouter, t, "PUT", setDown.Link, setDown, GoodAPIKey, http.StatusCreated)
+
+	executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", OtherAPIKey, http.StatusOK)
+	if !listed(OtherAPIKey) {
+		t.Fatalf("project set %s not listed for a project member", setDown.Link)
+	}
+
+	// but only the owner can change who sees them
+	setDown.Visibility = pto3.VisibilityPublic
+	executeWithJSON(TestRouter, t, "PUT", setDown.Link, setDown, OtherAPIKey, http.StatusForbidden)
+	executeWithJSON(TestRouter, t, "PUT", setDown.Link, setDown, GoodAPIKey, http.StatusCreated)
+
+	// unknown visibilities are refused
+	setUp.Visibility = "secret"
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/create", setUp, GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsCheckTimes(t *testing.T) {
+	// create a raw data file with a time range to check against
+	cmdUp := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign filled with uninteresting test data",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/test", cmdUp, GoodAPIKey, http.StatusCreated)
+
+	fmdUp := testFileMetadata{
+		TimeStart: "2010-01-01T00:00:00Z",
+		TimeEnd:   "2010-01-02T00:00:00Z",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/test/timecheck.json", fmdUp, GoodAPIKey, http.StatusCreated)
+
+	setUp := ClientObservationSet{
+		Analyzer:    "https://ptotest.mami-project.eu/analysis/timecheck_test",
+		Sources:     []string{TestAPIURL + "/raw/test/timecheck.json"},
+		Conditions:  []string{"pto.test.succeeded"},
+		Description: "An observation set to exercise checking observation times",
+	}
+
+	res := executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/create", setUp, GoodAPIKey, http.StatusCreated)
+
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second observation is a year off
+	obs := `["e1337", "2010-01-01T10:00:00Z", "2010-01-01T10:00:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["e1337", "2011-01-01T10:00:00Z", "2011-01-01T10:00:01Z", "10.0.0.1 * 10.0.0.3", "pto.test.succeeded"]`
+
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink+"?check_times=sometimes", bytes.NewBufferString(obs),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink+"?check_times=reject", bytes.NewBufferString(obs),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+
+	res = executeRequest(TestRouter, t, "GET", setDown.Link, nil, "", GoodAPIKey, http.StatusOK)
+	setDown = ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	if setDown.Count != 0 {
+		t.Fatalf("rejected upload left %d observations", setDown.Count)
+	}
+
+	// flagged outliers are loaded, but counted
+	res = executeRequest(TestRouter, t, "PUT", setDown.Datalink+"?check_times=flag", bytes.NewBufferString(obs),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+	if outliers := res.Header().Get("Time-Outliers"); outliers != "1" {
+		t.Fatalf("expected 1 time outlier, got %s", outliers)
+	}
+
+	setDown = ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	if setDown.Count != 2 || setDown.Outliers != 1 {
+		t.Fatalf("expected 2 observations with 1 time outlier, got %d with %d", setDown.Count, setDown.Outliers)
+	}
+
+	// sets without raw data sources can't be checked
+	setUp.Sources = []string{"https://example.com/elsewhere.json"}
+	res = executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/create", setUp, GoodAPIKey, http.StatusCreated)
+	setDown = ClientObservationSet{}
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	executeRequest(TestRouter, t, "PUT", setDown.Datalink+"?check_times=flag", bytes.NewBufferString(obs),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestObsConditionNaming(t *testing.T) {
+	defer func(naming string, prefixes []string) {
+		TestConfig.ConditionNaming = naming
+		TestConfig.ConditionPrefixes = prefixes
+	}(TestConfig.ConditionNaming, TestConfig.ConditionPrefixes)
+
+	createSet := func(condition string, status int) *ClientObservationSet {
+		setUp := ClientObservationSet{
+			Analyzer:    "https://ptotest.mami-project.eu/analysis/naming_test",
+			Sources:     []string{"https://ptotest.mami-project.eu/raw/test/naming.json"},
+			Conditions:  []string{condition},
+			Description: "An observation set to exercise condition naming",
+		}
+
+		res := executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/create", setUp, GoodAPIKey, status)
+		if status != http.StatusCreated {
+			return nil
+		}
+
+		var setDown ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+			t.Fatal(err)
+		}
+		return &setDown
+	}
+
+	// a set created before the convention was enforced
+	legacy := createSet("pto.Test.legacy", http.StatusCreated)
+
+	TestConfig.ConditionNaming = pto3.ConditionNamingStrict
+	TestConfig.ConditionPrefixes = []string{"pto"}
+
+	createSet("pto.test.naming_ok2", http.StatusCreated)
+	for _, condition := range []string{"PTO.test.succeeded", "pto", "pto.test-x", "pto..test", "pto.2test", "ecn.negotiated"} {
+		createSet(condition, http.StatusBadRequest)
+	}
+
+	// data can't be uploaded to the legacy set either
+	obs := `["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:01Z", "10.0.0.1 * 10.0.0.2", "pto.Test.legacy"]`
+	executeRequest(TestRouter, t, "PUT", legacy.Datalink, bytes.NewBufferString(obs),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusBadRequest)
+
+	// warnings only
+	TestConfig.ConditionNaming = pto3.ConditionNamingWarn
+	createSet("ecn.Negotiated", http.StatusCreated)
+	executeRequest(TestRouter, t, "PUT", legacy.Datalink, bytes.NewBufferString(obs),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+}
+
+func TestObsConditionAliases(t *testing.T) {
+	createSet := func(condition string) string {
+		file := fmt.Sprintf(`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["%s"], "alias_test": "yes", "description": "An observation set to exercise condition aliases"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:01Z", "10.0.0.1 * 10.0.0.2", "%s"]`, condition, condition)
+
+		res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+			"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+		var setDown ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+			t.Fatal(err)
+		}
+		return setDown.Link
+	}
+
+	setsWithCondition := func(condition string) []string {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by_metadata?k=alias_test&condition="+condition, nil, "", GoodAPIKey, http.StatusOK)
+
+		var setlist struct {
+			Sets []string `json:"sets"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+			t.Fatal(err)
+		}
+		return setlist.Sets
+	}
+
+	oldSet := createSet("pto.test.alias.old_name")
+	newSet := createSet("pto.test.alias.new_name")
+
+	// aliases must name an existing condition
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/obs/conditions/aliases/pto.test.alias.old_name",
+		map[string]string{"condition": "pto.test.alias.no_such_name"}, GoodAPIKey, http.StatusBadRequest)
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/obs/conditions/aliases/pto.test.alias.old_name",
+		map[string]string{"condition": "pto.test.alias.new_name"}, OtherAPIKey, http.StatusForbidden)
+
+	// merge the old name into the new
+	res := executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/obs/conditions/aliases/pto.test.alias.old_name",
+		map[string]string{"condition": "pto.test.alias.new_name"}, GoodAPIKey, http.StatusOK)
+
+	var aliased struct {
+		Alias     string `json:"alias"`
+		Condition string `json:"condition"`
+		Merged    int    `json:"merged"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &aliased); err != nil {
+		t.Fatal(err)
+	}
+	if aliased.Alias != "pto.test.alias.old_name" || aliased.Condition != "pto.test.alias.new_name" || aliased.Merged != 1 {
+		t.Fatalf("unexpected alias result %+v", aliased)
+	}
+
+	// either name finds both sets
+	for _, condition := range []string{"pto.test.alias.old_name", "pto.test.alias.new_name"} {
+		sets := setsWithCondition(condition)
+		if len(sets) != 2 || sets[0] != oldSet || sets[1] != newSet {
+			t.Fatalf("unexpected sets with condition %s: %v", condition, sets)
+		}
+	}
+
+	// the alias is listed with the conditions, and the old condition is gone
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/conditions", nil, "", GoodAPIKey, http.StatusOK)
+
+	var conditions struct {
+		Conditions []string              `json:"conditions"`
+		Aliases    []pto3.ConditionAlias `json:"aliases"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &conditions); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range conditions.Conditions {
+		if c == "pto.test.alias.old_name" {
+			t.Fatalf("merged condition %s still listed", c)
+		}
+	}
+	found := false
+	for _, ca := range conditions.Aliases {
+		if ca.Alias == "pto.test.alias.old_name" && ca.Condition == "pto.test.alias.new_name" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("alias missing from condition list: %v", conditions.Aliases)
+	}
+
+	// new sets may still use the old name
+	createSet("pto.test.alias.old_name")
+	if sets := setsWithCondition("pto.test.alias.new_name"); len(sets) != 3 {
+		t.Fatalf("unexpected sets with condition pto.test.alias.new_name: %v", sets)
+	}
+
+	// remove the alias
+	executeRequest(TestRouter, t, "DELETE", TestAPIURL+"/obs/conditions/aliases/pto.test.alias.old_name", nil, "", GoodAPIKey, http.StatusNoContent)
+	executeRequest(TestRouter, t, "DELETE", TestAPIURL+"/obs/conditions/aliases/pto.test.alias.old_name", nil, "", GoodAPIKey, http.StatusNotFound)
+
+	// conditions in sealed sets can't be merged, as their data would change
+	sealedSet := createSet("pto.test.alias.sealed_name")
+	executeRequest(TestRouter, t, "POST", sealedSet+"/seal", nil, "", GoodAPIKey, http.StatusOK)
+
+	res = executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/obs/conditions/aliases/pto.test.alias.sealed_name",
+		map[string]string{"condition": "pto.test.alias.new_name"}, GoodAPIKey, http.StatusConflict)
+	if !strings.Contains(res.Body.String(), path.Base(sealedSet)) {
+		t.Fatalf("conflict does not name sealed set %s: %s", sealedSet, res.Body.String())
+	}
+	if sets := setsWithCondition("pto.test.alias.sealed_name"); len(sets) != 1 || sets[0] != sealedSet {
+		t.Fatalf("unexpected sets with condition pto.test.alias.sealed_name: %v", sets)
+	}
+}
+
+func TestObsConditionRenames(t *testing.T) {
+	createSet := func(condition string) string {
+		file := fmt.Sprintf(`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["%s"], "rename_test": "yes", "description": "An observation set to exercise condition renames"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:01Z", "10.0.0.1 * 10.0.0.2", "%s"]`, condition, condition)
+
+		res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+			"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+		var setDown ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+			t.Fatal(err)
+		}
+		return setDown.Link
+	}
+
+	setsWithCondition := func(condition string) []string {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/by_metadata?k=rename_test&condition="+condition, nil, "", GoodAPIKey, http.StatusOK)
+
+		var setlist struct {
+			Sets []string `json:"sets"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &setlist); err != nil {
+			t.Fatal(err)
+		}
+		return setlist.Sets
+	}
+
+	queryConditions := func(condition string) []string {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/query/submit?time_start=2017-10-01T00%3A00%3A00Z&time_end=2017-10-02T00%3A00%3A00Z&condition="+condition,
+			nil, "", GoodAPIKey, http.StatusOK)
+
+		var q struct {
+			Encoded string `json:"__encoded"`
+		}
+		if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+			t.Fatal(err)
+		}
+		form, err := url.ParseQuery(q.Encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return form["condition"]
+	}
+
+	type rename struct {
+		From   string `json:"from"`
+		To     string `json:"to"`
+		Merged int    `json:"merged"`
+	}
+
+	firstSet := createSet("pto.test.rename.first")
+	otherSet := createSet("pto.test.rename.other")
+
+	// queries select the conditions below a parent
+	if conditions := queryConditions("pto.test.rename"); len(conditions) != 2 || conditions[0] != "pto.test.rename.first" || conditions[1] != "pto.test.rename.other" {
+		t.Fatalf("unexpected conditions in query before rename: %v", conditions)
+	}
+
+	// only existing conditions may be renamed, by condition admins
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/conditions/rename",
+		rename{From: "pto.test.rename.no_such_name", To: "pto.test.rename.second"}, GoodAPIKey, http.StatusBadRequest)
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/conditions/rename",
+		rename{From: "pto.test.rename.first", To: "pto.test.rename.*"}, GoodAPIKey, http.StatusBadRequest)
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/conditions/rename",
+		rename{From: "pto.test.rename.first", To: "pto.test.rename.second"}, OtherAPIKey, http.StatusForbidden)
+
+	// rename in place
+	res := executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/conditions/rename",
+		rename{From: "pto.test.rename.first", To: "pto.test.rename.second"}, GoodAPIKey, http.StatusOK)
+
+	var renamed rename
+	if err := json.Unmarshal(res.Body.Bytes(), &renamed); err != nil {
+		t.Fatal(err)
+	}
+	if renamed.From != "pto.test.rename.first" || renamed.To != "pto.test.rename.second" || renamed.Merged != 0 {
+		t.Fatalf("unexpected rename result %+v", renamed)
+	}
+
+	// either name finds the set
+	for _, condition := range []string{"pto.test.rename.first", "pto.test.rename.second"} {
+		if sets := setsWithCondition(condition); len(sets) != 1 || sets[0] != firstSet {
+			t.Fatalf("unexpected sets with condition %s: %v", condition, sets)
+		}
+	}
+
+	// the set now declares the new name
+	res = executeRequest(TestRouter, t, "GET", firstSet, nil, "", GoodAPIKey, http.StatusOK)
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+	if len(setDown.Conditions) != 1 || setDown.Conditions[0] != "pto.test.rename.second" {
+		t.Fatalf("unexpected conditions in renamed set: %v", setDown.Conditions)
+	}
+
+	// and queries no longer select the old name
+	if conditions := queryConditions("pto.test.rename"); len(conditions) != 2 || conditions[0] != "pto.test.rename.other" || conditions[1] != "pto.test.rename.second" {
+		t.Fatalf("unexpected conditions in query after rename: %v", conditions)
+	}
+
+	// renaming into an existing condition merges
+	res = executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/obs/conditions/rename",
+		rename{From: "pto.test.rename.second", To: "pto.test.rename.other"}, GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &renamed); err != nil {
+		t.Fatal(err)
+	}
+	if renamed.Merged != 1 {
+		t.Fatalf("unexpected rename result %+v", renamed)
+	}
+
+	// all names find both sets
+	for _, condition := range []string{"pto.test.rename.first", "pto.test.rename.second", "pto.test.rename.other"} {
+		if sets := setsWithCondition(condition); len(sets) != 2 || sets[0] != firstSet || sets[1] != otherSet {
+			t.Fatalf("unexpected sets with condition %s: %v", condition, sets)
+		}
+	}
+
+	// the history traces the condition through both renames
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/conditions/renames?condition=pto.test.rename.first", nil, "", OtherAPIKey, http.StatusOK)
+
+	var history struct {
+		Renames []pto3.ConditionRename `json:"renames"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Renames) != 2 {
+		t.Fatalf("unexpected rename history %+v", history.Renames)
+	}
+	if cr := history.Renames[0]; cr.OldName != "pto.test.rename.first" || cr.NewName != "pto.test.rename.second" || cr.Merged || cr.Renamed == nil {
+		t.Fatalf("unexpected first rename %+v", cr)
+	}
+	if cr := history.Renames[1]; cr.OldName != "pto.test.rename.second" || cr.NewName != "pto.test.rename.other" || !cr.Merged {
+		t.Fatalf("unexpected second rename %+v", cr)
+	}
+}
+
+func TestObsDownloadCSV(t *testing.T) {
+	file := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded"], "description": "An observation set to exercise CSV download"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded", 42]
+	["e1337", "2017-10-01T10:06:03Z", "2017-10-01T10:06:05Z", "* AS2 10.0.0.0/24", "pto.test.succeeded", "slow, but ok"]`
+
+	res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	// CSV can be selected by media type as well as by name
+	req, err := http.NewRequest("GET", setDown.Datalink+"?fields=time_start,time_end,path,condition,value", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+	req.Header.Set("Accept", "text/csv, */*;q=0.8")
+	res = httptest.NewRecorder()
+	TestHandler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected %d for CSV download, got %d: %s", http.StatusOK, res.Code, res.Body.String())
+	} else if res.Header().Get("Content-Type") != "text/csv" {
+		t.Fatalf("unexpected content type %s for CSV download", res.Header().Get("Content-Type"))
+	}
+
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	if len(lines) != 3 || lines[0] != "time_start,time_end,path,condition,value" {
+		t.Fatalf("unexpected CSV download:\n%s", res.Body.String())
+	}
+	for _, row := range []string{
+		`2017-10-01T10:06:00Z,2017-10-01T10:06:01Z,10.0.0.1 * 10.0.0.2,pto.test.succeeded,42`,
+		`2017-10-01T10:06:03Z,2017-10-01T10:06:05Z,* AS2 10.0.0.0/24,pto.test.succeeded,"slow, but ok"`,
+	} {
+		if lines[1] != row && lines[2] != row {
+			t.Fatalf("missing row %s in CSV download:\n%s", row, res.Body.String())
+		}
+	}
+
+	res = executeRequest(TestRouter, t, "GET", setDown.Datalink+"?format=csv", nil, "", GoodAPIKey, http.StatusOK)
+	if lines = strings.Split(strings.TrimSpace(res.Body.String()), "\n"); len(lines) != 3 || lines[0] != "set_id,time_start,time_end,path,condition,value" {
+		t.Fatalf("unexpected CSV download:\n%s", res.Body.String())
+	}
+}
+
+func TestObsReplica(t *testing.T) {
+	file := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded", "pto.test.failed"], "description": "An observation set downloaded from the replica"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["e1337", "2017-10-01T10:06:01Z", "2017-10-01T10:06:01Z", "10.0.0.1 * 10.0.0.3", "pto.test.failed"]`
+
+	res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	setid, err := strconv.ParseInt(path.Base(setDown.Link), 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the replica refuses writes, so downloads must only read
+	for _, query := range []string{"", "?limit=1"} {
+		res = executeRequest(TestRouter, t, "GET", setDown.Datalink+query, nil, "", GoodAPIKey, http.StatusOK)
+		if lines := strings.Count(res.Body.String(), "\n"); query == "" && lines != 2 || query != "" && lines != 1 {
+			t.Fatalf("downloading %s%s returned %d observations", setDown.Datalink, query, lines)
+		}
+	}
+
+	// and the observations were copied out on the replica, not the primary
+	db := pg.Connect(&TestConfig.ObsDatabase.Options)
+	defer db.Close()
+
+	copied := func(onReplica bool) int {
+		var count int
+		if _, err := db.QueryOne(pg.Scan(&count), `SELECT count(*) FROM pg_stat_activity
+			WHERE (application_name = ?) = ? AND query LIKE ?`, TestReplicaApplicationName, onReplica,
+			fmt.Sprintf("COPY (SELECT observations.id%%WHERE set_id = %d%%", setid)); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	if copied(true) == 0 || copied(false) != 0 {
+		t.Fatalf("observations of set %x not copied on the replica only", setid)
+	}
+}
+
+func TestObsStats(t *testing.T) {
+	file := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded", "pto.test.failed"], "description": "An observation set to exercise statistics"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["e1337", "2017-10-01T10:06:03Z", "2017-10-01T10:06:05Z", "* AS2 10.0.0.0/24", "pto.test.succeeded"]
+	["e1337", "2017-10-01T10:06:02Z", "2017-10-01T10:06:09Z", "10.0.0.1 * 10.0.0.2", "pto.test.failed"]`
+
+	res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	var setDown ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &setDown); err != nil {
+		t.Fatal(err)
+	}
+
+	// ask twice, so the second answer comes from the cache
+	for i := 0; i < 2; i++ {
+		res = executeRequest(TestRouter, t, "GET", setDown.Link+"/stats", nil, "", GoodAPIKey, http.StatusOK)
+
+		var stats pto3.ObservationSetStats
+		if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+
+		if stats.Count != 3 || stats.PathCount != 2 ||
+			stats.Conditions["pto.test.succeeded"] != 2 || stats.Conditions["pto.test.failed"] != 1 {
+			t.Fatalf("unexpected statistics %s", res.Body.String())
+		}
+		if stats.TimeStart == nil || stats.TimeStart.UTC().Format(time.RFC3339) != "2017-10-01T10:06:00Z" ||
+			stats.TimeEnd == nil || stats.TimeEnd.UTC().Format(time.RFC3339) != "2017-10-01T10:06:09Z" {
+			t.Fatalf("unexpected time bounds in statistics %s", res.Body.String())
+		}
+	}
+
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs/7fffffff/stats", nil, "", GoodAPIKey, http.StatusNotFound)
+}
+
+func TestObsExternal(t *testing.T) {
+	// another PTO, requiring an API key
+	const remoteKey = "7e4073ba5e"
+	remoteData := `["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]` + "\n"
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "APIKEY "+remoteKey {
+			http.Error(w, "not authorized", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/obs/1a":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"_analyzer": "https://remote.example.com/analysis/passthrough",
+				"_sources": ["https://remote.example.com/raw/test/test001.json"],
+				"_conditions": ["pto.test.succeeded"], "_slug": "remote-set",
+				"description": "An observation set on another PTO",
+				"__link": "%s/obs/1a", "__obs_count": 1}`, "http://"+r.Host)
+		case "/obs/1a/data":
+			w.Header().Set("Content-Type", "application/vnd.mami.ndjson")
+			fmt.Fprint(w, remoteData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer remote.Close()
+
+	remoteURL, _ := url.Parse(remote.URL)
+	oldSchemes, oldKeys, oldNetworks := TestConfig.FetchSchemes, TestConfig.FederationAPIKeys, TestConfig.OutboundNetworks
+	TestConfig.FetchSchemes = []string{"http"}
+	TestConfig.FederationAPIKeys = map[string]string{remoteURL.Host: remoteKey}
+	TestConfig.OutboundNetworks = []string{"127.0.0.0/8"}
+	defer func() {
+		TestConfig.FetchSchemes, TestConfig.FederationAPIKeys, TestConfig.OutboundNetworks = oldSchemes, oldKeys, oldNetworks
+		TestConfig.ProxyExternalSets = false
+	}()
+
+	register := func(link string, expectstatus int) *ClientObservationSet {
+		b, _ := json.Marshal(map[string]string{"url": link})
+		res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/external", bytes.NewReader(b),
+			"application/json", GoodAPIKey, expectstatus)
+		if expectstatus != http.StatusCreated {
+			return nil
+		}
+
+		var set ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &set); err != nil {
+			t.Fatal(err)
+		}
+		return &set
+	}
+
+	// sets must exist on another PTO
+	register(remote.URL+"/obs/2b", http.StatusNotFound)
+	register(TestAPIURL+"/obs/1", http.StatusBadRequest)
+
+	set := register(remote.URL+"/obs/1a", http.StatusCreated)
+	if set.External != remote.URL+"/obs/1a" || set.Description != "An observation set on another PTO" ||
+		len(set.Conditions) != 1 || set.Sources[0] != "https://remote.example.com/raw/test/test001.json" {
+		t.Fatalf("unexpected external set metadata %+v", set)
+	}
+
+	// a local set can name the external set as a source
+	derived := fmt.Sprintf(`{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough",
+		"_sources": [%q], "_conditions": ["pto.test.succeeded"]}`, set.Link)
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(derived),
+		"application/json", GoodAPIKey, http.StatusCreated)
+
+	// data cannot be uploaded, and is redirected to or proxied from the other PTO
+	executeRequest(TestRouter, t, "PUT", set.Datalink, bytes.NewBufferString(remoteData),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusConflict)
+
+	res := executeRequest(TestRouter, t, "GET", set.Datalink, nil, "", GoodAPIKey, http.StatusTemporaryRedirect)
+	if loc := res.Header().Get("Location"); loc != remote.URL+"/obs/1a/data" {
+		t.Fatalf("external data redirected to %s", loc)
+	}
+
+	TestConfig.ProxyExternalSets = true
+	res = executeRequest(TestRouter, t, "GET", set.Datalink, nil, "", GoodAPIKey, http.StatusOK)
+	if res.Body.String() != remoteData {
+		t.Fatalf("unexpected proxied external data %q", res.Body.String())
+	}
+}
+
+func TestObsImportRemote(t *testing.T) {
+	// another PTO, requiring an API key
+	const remoteKey = "5f3c1e9a77"
+	remoteData := `["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:00Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]` + "\n" +
+		`["e1337", "2017-10-01T10:06:01Z", "2017-10-01T10:06:02Z", "10.0.0.1 * 10.0.0.3", "pto.test.failed"]` + "\n"
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "APIKEY "+remoteKey {
+			http.Error(w, "not authorized", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/obs/3c":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"_analyzer": "https://remote.example.com/analysis/passthrough",
+				"_sources": ["https://remote.example.com/raw/test/test001.json"],
+				"_conditions": ["pto.test.succeeded", "pto.test.failed"], "_slug": "remote-imported-set",
+				"_uuid": "0c6a1f3e-8b52-4d7e-9a41-2f5d3b7c9e10",
+				"description": "An observation set to import from another PTO",
+				"__link": "%s/obs/3c", "__obs_count": 2}`, "http://"+r.Host)
+		case "/obs/3c/data":
+			w.Header().Set("Content-Type", "application/vnd.mami.ndjson")
+			fmt.Fprint(w, remoteData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer remote.Close()
+
+	oldSchemes, oldNetworks := TestConfig.FetchSchemes, TestConfig.OutboundNetworks
+	TestConfig.FetchSchemes = []string{"http"}
+	defer func() {
+		TestConfig.FetchSchemes, TestConfig.OutboundNetworks = oldSchemes, oldNetworks
+	}()
+
+	importSet := func(req map[string]string, expectstatus int) (*ClientObservationSet, string) {
+		b, _ := json.Marshal(req)
+		res := executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/import", bytes.NewReader(b),
+			"application/json", GoodAPIKey, expectstatus)
+		if expectstatus != http.StatusCreated && expectstatus != http.StatusOK {
+			return nil, ""
+		}
+
+		var set ClientObservationSet
+		if err := json.Unmarshal(res.Body.Bytes(), &set); err != nil {
+			t.Fatal(err)
+		}
+		return &set, res.Header().Get("Import-Action")
+	}
+
+	// sets can only be imported from public addresses, unless the network is
+	// allowed, so internal services cannot be read through imports
+	importSet(map[string]string{"url": remote.URL + "/obs/3c", "api_key": remoteKey}, http.StatusForbidden)
+	importSet(map[string]string{"url": "http://169.254.169.254/latest/meta-data"}, http.StatusForbidden)
+	TestConfig.OutboundNetworks = []string{"127.0.0.0/8"}
+
+	// the other PTO must accept the credentials given
+	importSet(map[string]string{"url": remote.URL + "/obs/3c"}, http.StatusBadGateway)
+	importSet(map[string]string{"url": remote.URL + "/obs/4d", "api_key": remoteKey}, http.StatusNotFound)
+	importSet(map[string]string{"url": TestAPIURL + "/obs/1", "api_key": remoteKey}, http.StatusBadRequest)
+
+	set, _ := importSet(map[string]string{"url": remote.URL + "/obs/3c", "api_key": remoteKey}, http.StatusCreated)
+	if set.Origin != remote.URL+"/obs/3c" || set.External != "" || set.Count != 2 ||
+		set.Description != "An observation set to import from another PTO" ||
+		set.Sources[0] != "https://remote.example.com/raw/test/test001.json" {
+		t.Fatalf("unexpected imported set metadata %+v", set)
+	}
+
+	// the data now lives here
+	res := executeRequest(TestRouter, t, "GET", set.Datalink, nil, "", GoodAPIKey, http.StatusOK)
+	if lines := strings.Count(res.Body.String(), "\n"); lines != 2 {
+		t.Fatalf("imported set has %d observations, expected 2", lines)
+	}
+
+	// importing again changes nothing under an import policy
+	again, action := importSet(map[string]string{"url": remote.URL + "/obs/3c", "api_key": remoteKey, "import": "update"}, http.StatusOK)
+	if action != "unchanged" || again.Link != set.Link {
+		t.Fatalf("reimport was %s to %s, expected unchanged %s", action, again.Link, set.Link)
+	}
+}
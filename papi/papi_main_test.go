@@ -3,6 +3,8 @@ package papi_test
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,7 +14,9 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/go-pg/pg"
 	"github.com/gorilla/mux"
 	pto3 "github.com/mami-project/pto3-go"
 	"github.com/mami-project/pto3-go/papi"
@@ -26,13 +30,27 @@ const LogDatabase = false
 
 const TestBaseURL = "https://ptotest.mami-project.eu"
 
+// TestAPIURL is the root of the current version of the API, as in links
+const TestAPIURL = TestBaseURL + "/v1"
+
 var TestConfig *pto3.PTOConfiguration
 var TestRouter *mux.Router
 
+// TestHandler serves TestRouter under versioned paths, as ptosrv does
+var TestHandler http.Handler
+
 var TestRC int
 
 var TestQueryCacheSetID int
 
+// TestReplicaApplicationName identifies connections to the replica of the
+// observation database, which is the test database in a read-only session
+const TestReplicaApplicationName = "ptotest-replica"
+
+// TestBackgroundBandwidth limits background transfers, in bytes per second,
+// so that their pacing can be observed
+const TestBackgroundBandwidth = 64 << 10
+
 func setupRaw(config *pto3.PTOConfiguration, azr papi.Authorizer, r *mux.Router) *papi.RawAPI {
 	// create temporary RDS directory
 	var err error
@@ -163,22 +181,76 @@ func teardownStatic(config *pto3.PTOConfiguration) {
 
 const GoodAPIKey = "07e57ab18e70"
 
-func setupAZR() papi.Authorizer {
+// OtherAPIKey can write observation sets, but not delete those of others, and
+// read sets in project collab
+const OtherAPIKey = "07e57ab1e0a7"
+
+// AdminAPIKey can delete, restore, and purge any observation set, and
+// invalidate cached queries
+const AdminAPIKey = "07e57ab1ad31"
+
+// ArchivistAPIKey can archive observation sets to the test campaign, and trim
+// them
+const ArchivistAPIKey = "07e57ab1a4c1"
+
+// LimitedAPIKey can submit selection queries, until they have returned a
+// byte of results
+const LimitedAPIKey = "07e57ab11e7d"
+
+// WatcherAPIKey can submit and read selection queries, as a second client
+// of queries others have submitted
+const WatcherAPIKey = "07e57ab1ca11"
+
+func setupAZR() *papi.APIKeyAuthorizer {
 	return &papi.APIKeyAuthorizer{
 		APIKeys: map[string]map[string]bool{
 			"default": map[string]bool{
 				"raw_metadata": true,
 			},
 			GoodAPIKey: map[string]bool{
-				"read_raw:test":      true,
-				"write_raw:test":     true,
-				"read_obs":           true,
-				"read_obs_data":      true,
-				"write_obs":          true,
-				"submit_query_group": true,
-				"submit_query_obs":   true,
-				"read_query":         true,
-				"update_query":       true,
+				"read_raw:test":       true,
+				"write_raw:test":      true,
+				"read_raw:fetchtest":  true,
+				"write_raw:fetchtest": true,
+				"read_raw:pintest":    true,
+				"write_raw:pintest":   true,
+				"read_obs":            true,
+				"read_obs_data":       true,
+				"write_obs":           true,
+				"submit_query_group":  true,
+				"submit_query_obs":    true,
+				"read_query":          true,
+				"update_query":        true,
+				"admin_permissions":   true,
+				"admin_conditions":    true,
+				"read_deprecations":   true,
+				"admin_deliveries":    true,
+				"admin_consistency":   true,
+				"read_stats":          true,
+			},
+			OtherAPIKey: map[string]bool{
+				"read_obs":        true,
+				"write_obs":       true,
+				"read_obs:collab": true,
+			},
+			AdminAPIKey: map[string]bool{
+				"read_obs":    true,
+				"delete_obs":  true,
+				"purge_query": true,
+			},
+			ArchivistAPIKey: map[string]bool{
+				"read_obs":       true,
+				"write_obs":      true,
+				"delete_obs":     true,
+				"write_raw:test": true,
+			},
+			LimitedAPIKey: map[string]bool{
+				"submit_query_obs": true,
+				"read_query":       true,
+			},
+			WatcherAPIKey: map[string]bool{
+				"submit_query_obs": true,
+				"read_query":       true,
 			},
 		},
 	}
@@ -200,7 +272,12 @@ func executeRequest(r *mux.Router, t *testing.T, method string, url string, body
 	}
 
 	res := httptest.NewRecorder()
-	r.ServeHTTP(res, req)
+	papi.APIVersionMiddleware(TestConfig)(r).ServeHTTP(res, req)
+
+	// follow redirects from unversioned paths, as clients do
+	if res.Code == http.StatusPermanentRedirect && expectstatus != http.StatusPermanentRedirect {
+		return executeRequest(r, t, method, res.Header().Get("Location"), body, bodytype, apikey, expectstatus)
+	}
 
 	if res.Code != expectstatus {
 		errstr := fmt.Sprintf("%s %s expected status %d but got %d", method, url, expectstatus, res.Code)
@@ -272,7 +349,15 @@ func TestMain(m *testing.M) {
 		"User":     "ptotest",
 		"Database": "ptotest"
 	},
-	"PageLength": 50
+	"PageLength": 50,
+	"DeliveryAttempts": 1,
+	"Deprecations": {
+		"GET /obs/by-metadata": {
+			"Since": "2026-01-01T00:00:00Z",
+			"Sunset": "2027-01-01T00:00:00Z",
+			"Link": "https://ptotest.mami-project.eu/static/deprecations.html"
+		}
+	}
 }`)
 
 	var err error
@@ -281,14 +366,38 @@ func TestMain(m *testing.M) {
 		log.Fatal(err)
 	}
 
+	// limit the queries of the limited key, identified as in query metadata
+	limitedKeyHash := sha256.Sum256([]byte(LimitedAPIKey))
+	TestConfig.QueryLimits = &pto3.QueryLimitOptions{
+		Keys: map[string]pto3.QueryLimit{
+			hex.EncodeToString(limitedKeyHash[:8]): pto3.QueryLimit{BytesReturned: 1},
+		},
+	}
+
+	TestConfig.BackgroundBandwidth = TestBackgroundBandwidth
+
 	// Original password was "helpful guide sheep train"
 	TestConfig.ObsDatabase.Password, err = readPassword()
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// serve downloads and queries from a "replica" which, like a real one,
+	// refuses writes
+	replica := TestConfig.ObsDatabase.Options
+	replica.ApplicationName = TestReplicaApplicationName
+	replica.OnConnect = func(db *pg.DB) error {
+		_, err := db.Exec("SET SESSION CHARACTERISTICS AS TRANSACTION READ ONLY")
+		return err
+	}
+	TestConfig.ObsReplicaDatabase = &replica
+
 	// create a router
 	TestRouter = mux.NewRouter()
+	TestRouter.Use(papi.RequestIDMiddleware())
+	TestRouter.Use(papi.DeprecationMiddleware(TestConfig))
+	TestRouter.Use(papi.ObsDatabaseMiddleware(TestConfig))
+	TestHandler = papi.APIVersionMiddleware(TestConfig)(TestRouter)
 
 	// inner anon function ensures that os.Exit doesn't keep deferred teardown from running
 	os.Exit(func() int {
@@ -302,17 +411,26 @@ func TestMain(m *testing.M) {
 		papi.NewRootAPI(TestConfig, azr, TestRouter)
 
 		// build a raw data store  (and prepare to clean up after it)
-		setupRaw(TestConfig, azr, TestRouter)
+		rawapi := setupRaw(TestConfig, azr, TestRouter)
 		defer teardownRaw(TestConfig)
+		adminapi := papi.NewAdminAPI(TestConfig, azr, rawapi, TestRouter)
 
 		// build an observation store (and prepare to clean up after it)
 		obsapi := setupObs(TestConfig, azr, TestRouter)
 		defer teardownObs(obsapi)
+		obsapi.EnableEvidence(rawapi)
+		adminapi.EnableConsistencyChecks(obsapi)
+		papi.NewStatsAPI(TestConfig, azr, rawapi, obsapi, TestRouter)
 
 		// build an observation store (and prepare to clean up after it)
-		setupQuery(TestConfig, azr, TestRouter)
+		qapi := setupQuery(TestConfig, azr, TestRouter)
 		defer teardownQuery(TestConfig)
 
+		// queries scan trimmed sets from their bundles in the raw data store
+		TestConfig.ObsDatabase.QueryArchivedSets = true
+		qapi.EnableArchivedSets(rawapi)
+		obsapi.EnableConditionReloads(qapi)
+
 		TestRC = m.Run()
 		return TestRC
 	}())
@@ -320,7 +438,7 @@ func TestMain(m *testing.M) {
 
 func TestStatic(t *testing.T) {
 	// get index.html and make sure it's html
-	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/", nil, "", "", http.StatusOK)
+	res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/", nil, "", "", http.StatusOK)
 
 	if res.Header().Get("Content-Type") != "text/html" {
 		t.Fatalf("static root should be text/html, got %s", res.Header().Get("Content-Type"))
@@ -333,7 +451,7 @@ func TestStatic(t *testing.T) {
 	}
 
 	// now by the static path and make sure it's html
-	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/static/index.html", nil, "", "", http.StatusOK)
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/static/index.html", nil, "", "", http.StatusOK)
 
 	if res.Header().Get("Content-Type") != "text/html" {
 		t.Fatalf("static root should be text/html, got %s", res.Header().Get("Content-Type"))
@@ -342,5 +460,264 @@ func TestStatic(t *testing.T) {
 }
 
 func TestBadAuth(t *testing.T) {
-	executeRequest(TestRouter, t, "GET", TestBaseURL+"/obs", nil, "", "abadc0de", http.StatusForbidden)
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs", nil, "", "abadc0de", http.StatusForbidden)
+}
+
+func TestAPIVersions(t *testing.T) {
+	// unversioned paths are redirected to the legacy version
+	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/obs?page=1", nil, "", GoodAPIKey, http.StatusPermanentRedirect)
+	if location := res.Header().Get("Location"); location != TestAPIURL+"/obs?page=1" {
+		t.Fatalf("expected redirect to %s/obs?page=1, got %s", TestAPIURL, location)
+	}
+
+	// versioned paths are served, saying which version served them
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/obs", nil, "", GoodAPIKey, http.StatusOK)
+	if version := res.Header().Get(papi.APIVersionHeader); version != "1" {
+		t.Fatalf("expected API version 1, got %s", version)
+	}
+	if versions := res.Header().Get(papi.APIVersionsHeader); versions != "1" {
+		t.Fatalf("expected API versions 1, got %s", versions)
+	}
+
+	// versions not served are not found
+	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/v2/obs", nil, "", GoodAPIKey, http.StatusNotFound)
+	var er pto3.ErrorResponse
+	if err := json.Unmarshal(res.Body.Bytes(), &er); err != nil {
+		t.Fatal(err)
+	}
+	if er.Code != pto3.ErrorCodeUnsupportedVersion {
+		t.Fatalf("expected %s, got %s", pto3.ErrorCodeUnsupportedVersion, er.Code)
+	}
+}
+
+type testAuthDecisionSink []pto3.AuthDecision
+
+func (sink *testAuthDecisionSink) LogAuthDecision(d *pto3.AuthDecision) error {
+	*sink = append(*sink, *d)
+	return nil
+}
+
+func TestAuthDecisionLog(t *testing.T) {
+	var sink testAuthDecisionSink
+	azr := setupAZR()
+	azr.LogDecisionsTo(pto3.NewAuthLog(&sink, &pto3.AuthLogOptions{AllowSampling: 2}))
+
+	authorize := func(apikey string, permission string, expect bool) {
+		req, err := http.NewRequest("GET", TestAPIURL+"/obs", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if apikey != "" {
+			req.Header.Set("Authorization", "APIKEY "+apikey)
+		}
+		if allowed := azr.IsAuthorized(httptest.NewRecorder(), req, permission); allowed != expect {
+			t.Fatalf("%s for %s: expected %v, got %v", permission, apikey, expect, allowed)
+		}
+	}
+
+	// one in two allowed decisions is logged, but every denial
+	authorize(GoodAPIKey, "read_obs", true)
+	authorize(GoodAPIKey, "read_obs", true)
+	authorize("", "raw_metadata", true)
+	authorize(OtherAPIKey, "delete_obs", false)
+	authorize("", "read_obs", false)
+
+	goodHash := sha256.Sum256([]byte(GoodAPIKey))
+	otherHash := sha256.Sum256([]byte(OtherAPIKey))
+	expected := []pto3.AuthDecision{
+		{APIKeyID: hex.EncodeToString(goodHash[:8]), Permission: "read_obs", Allowed: true, Rule: pto3.AuthRuleKey, Sampling: 2},
+		{APIKeyID: "default", Permission: "raw_metadata", Allowed: true, Rule: pto3.AuthRuleDefault, Sampling: 2},
+		{APIKeyID: hex.EncodeToString(otherHash[:8]), Permission: "delete_obs", Allowed: false, Rule: pto3.AuthRuleNone, Sampling: 1},
+		{APIKeyID: "default", Permission: "read_obs", Allowed: false, Rule: pto3.AuthRuleNone, Sampling: 1},
+	}
+
+	if len(sink) != len(expected) {
+		t.Fatalf("expected %d logged decisions, got %+v", len(expected), sink)
+	}
+	for i, d := range sink {
+		if d.Time.IsZero() || d.Method != "GET" || d.Resource != "/v1/obs" {
+			t.Fatalf("decision %d does not record request: %+v", i, d)
+		}
+		d.Time, d.Method, d.Resource = time.Time{}, "", ""
+		if d != expected[i] {
+			t.Fatalf("decision %d: expected %+v, got %+v", i, expected[i], d)
+		}
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	goodHash := sha256.Sum256([]byte(GoodAPIKey))
+	config := &pto3.PTOConfiguration{
+		RateLimits: &pto3.RateLimitOptions{
+			Default: pto3.RateLimit{Concurrency: 1},
+			Keys: map[string]pto3.RateLimit{
+				hex.EncodeToString(goodHash[:8]): pto3.RateLimit{Rate: 0.01, Burst: 2},
+			},
+		},
+	}
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	r := mux.NewRouter()
+	r.Use(papi.RateLimitMiddleware(config, setupAZR()))
+	r.HandleFunc("/block", func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+	})
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	request := func(path string, apikey string, expectstatus int, expectcode string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", TestBaseURL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if apikey != "" {
+			req.Header.Set("Authorization", "APIKEY "+apikey)
+		}
+		res := httptest.NewRecorder()
+		r.ServeHTTP(res, req)
+		if res.Code != expectstatus {
+			t.Fatalf("GET %s with key %s: expected status %d, got %d: %s", path, apikey, expectstatus, res.Code, res.Body.String())
+		}
+		if expectcode != "" {
+			var er pto3.ErrorResponse
+			if err := json.Unmarshal(res.Body.Bytes(), &er); err != nil {
+				t.Fatal(err)
+			}
+			if er.Code != expectcode {
+				t.Fatalf("GET %s with key %s: expected %s, got %s", path, apikey, expectcode, er.Code)
+			}
+			if res.Header().Get("Retry-After") == "" {
+				t.Fatalf("GET %s with key %s: no Retry-After", path, apikey)
+			}
+		}
+		return res
+	}
+
+	// the good key may burst two requests, then must wait 100s for another
+	request("/", GoodAPIKey, http.StatusOK, "")
+	request("/", GoodAPIKey, http.StatusOK, "")
+	res := request("/", GoodAPIKey, http.StatusTooManyRequests, pto3.ErrorCodeRateLimit)
+	if retry := res.Header().Get("Retry-After"); retry != "100" {
+		t.Fatalf("expected Retry-After 100, got %s", retry)
+	}
+
+	// requests without a key may have one in progress at once, at any rate
+	blocked := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.ServeHTTP(blocked, httptest.NewRequest("GET", TestBaseURL+"/block", nil))
+	}()
+	<-entered
+	request("/", "", http.StatusTooManyRequests, pto3.ErrorCodeConcurrencyLimit)
+
+	// as may requests with keys we don't know, together with those without
+	request("/", "0ddba11", http.StatusTooManyRequests, pto3.ErrorCodeConcurrencyLimit)
+	request("/", "default", http.StatusTooManyRequests, pto3.ErrorCodeConcurrencyLimit)
+	close(unblock)
+	<-done
+	if blocked.Code != http.StatusOK {
+		t.Fatalf("expected blocking request to succeed, got %d", blocked.Code)
+	}
+	request("/", "", http.StatusOK, "")
+	request("/", "", http.StatusOK, "")
+}
+
+func TestIdempotency(t *testing.T) {
+	ic := papi.NewIdempotencyCache(time.Hour, 2)
+
+	calls := 0
+	created := ic.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		b, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "created %d from %s", calls, b)
+	})
+	failed := ic.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		pto3.HTTPError(w, "failed", http.StatusBadRequest)
+	})
+	panicked := ic.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		panic("handler failed")
+	})
+
+	request := func(handler papi.HandlerFunc, path string, key string, body string, expectstatus int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", TestBaseURL+path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+		req.Header.Set(papi.IdempotencyKeyHeader, key)
+		res := httptest.NewRecorder()
+		handler(res, req)
+		if res.Code != expectstatus {
+			t.Fatalf("POST %s with key %s: expected status %d, got %d: %s", path, key, expectstatus, res.Code, res.Body.String())
+		}
+		return res
+	}
+
+	// retries replay the original response
+	request(created, "/create", "one", "a", http.StatusCreated)
+	res := request(created, "/create", "one", "a", http.StatusCreated)
+	if res.Header().Get("Idempotent-Replayed") != "true" || res.Body.String() != "created 1 from a" || calls != 1 {
+		t.Fatalf("retry not replayed: %d calls, response %s", calls, res.Body.String())
+	}
+
+	// but not for different requests with the same key
+	request(created, "/create", "one", "b", http.StatusUnprocessableEntity)
+	request(created, "/other", "one", "a", http.StatusUnprocessableEntity)
+	request(created, "/create?force=true", "one", "a", http.StatusUnprocessableEntity)
+
+	// failures may be retried
+	request(failed, "/create", "two", "a", http.StatusBadRequest)
+	request(failed, "/create", "two", "a", http.StatusBadRequest)
+	if calls != 3 {
+		t.Fatalf("expected failed request to be retried, got %d calls", calls)
+	}
+
+	// as may requests whose handler panicked
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("handler did not panic")
+			}
+		}()
+		request(panicked, "/create", "three", "a", http.StatusOK)
+	}()
+	request(created, "/create", "three", "a", http.StatusCreated)
+	if calls != 5 {
+		t.Fatalf("expected panicked request to be retried, got %d calls", calls)
+	}
+
+	// the cache holds two responses, so a third evicts the one expiring first
+	request(created, "/create", "four", "a", http.StatusCreated)
+	request(created, "/create", "one", "a", http.StatusCreated)
+	if calls != 7 {
+		t.Fatalf("expected evicted request to be executed again, got %d calls", calls)
+	}
+
+	// when the cache is full of requests in progress, new keys are refused
+	ic = papi.NewIdempotencyCache(time.Hour, 1)
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	blocking := ic.Idempotent(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-unblock
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		blocking(httptest.NewRecorder(), func() *http.Request {
+			req := httptest.NewRequest("POST", TestBaseURL+"/block", nil)
+			req.Header.Set(papi.IdempotencyKeyHeader, "five")
+			return req
+		}())
+	}()
+	<-entered
+	res = request(blocking, "/block", "six", "", http.StatusServiceUnavailable)
+	if res.Header().Get("Retry-After") == "" {
+		t.Fatal("no Retry-After refusing request with full idempotency cache")
+	}
+	close(unblock)
+	<-done
 }
@@ -5,7 +5,11 @@ package main
 import (
 	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/gorilla/mux"
 	pto3 "github.com/mami-project/pto3-go"
@@ -16,6 +20,7 @@ import (
 var configPath = flag.String("config", "", "Path to PTO `config file`")
 var initdb = flag.Bool("initdb", false, "Create database tables on startup")
 var querylog = flag.Bool("querylog", false, "Log all database queries")
+var bindFlag = flag.String("bind", "", "comma-separated `addresses` to listen on, overriding BindTo in the configuration")
 var help = flag.Bool("help", false, "show usage message")
 
 func main() {
@@ -33,6 +38,20 @@ func main() {
 	}
 	log.Printf("ptosrv starting with configuration at %s...", *configPath)
 
+	if *bindFlag != "" {
+		config.BindTo = *bindFlag
+	}
+
+	// fail early on bad addresses, before touching any stores
+	addrs, err := config.ListenAddresses()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig, acmeManager, err := config.TLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// initialize database and exit if -initdb given
 	if *initdb {
 		azr := &papi.NullAuthorizer{}
@@ -59,9 +78,21 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if al := config.AuthDecisionLog(); al != nil {
+		azr.LogDecisionsTo(al)
+		log.Printf("...will log authorization decisions")
+	}
+
+	if config.RateLimits != nil {
+		log.Printf("...will limit the rate and concurrency of requests per API key")
+	}
 
 	// now hook up routes
 	r := mux.NewRouter()
+	r.Use(papi.RequestIDMiddleware())
+	r.Use(papi.RateLimitMiddleware(config, azr))
+	r.Use(papi.DeprecationMiddleware(config))
+	r.Use(papi.ObsDatabaseMiddleware(config))
 
 	papi.NewRootAPI(config, azr, r)
 
@@ -73,6 +104,24 @@ func main() {
 		log.Printf("...will serve /raw from %s", config.RawRoot)
 	}
 
+	// fail early on a missing or bad key encryption key
+	if kw, err := config.KeyWrapper(); err != nil {
+		log.Fatal(err)
+	} else if kw != nil {
+		log.Printf("...will encrypt campaigns with %s key encryption key", kw.Name())
+	}
+
+	adminapi := papi.NewAdminAPI(config, azr, rawapi, r)
+	log.Printf("...will serve /admin with API keys at %s", config.APIKeyFile)
+
+	// resume deliveries queued before a restart
+	if _, err := config.DeliveryQueue(); err != nil {
+		log.Fatal(err)
+	}
+	if config.DeliveryQueuePath != "" {
+		log.Printf("...will deliver callbacks and alerts queued at %s", config.DeliveryQueuePath)
+	}
+
 	obsapi := papi.NewObsAPI(config, azr, r)
 	if obsapi != nil {
 		log.Printf("...will serve /obs from postgresql://%s@%s/%s",
@@ -81,40 +130,112 @@ func main() {
 			log.Printf("...with query logging enabled")
 			obsapi.EnableQueryLogging()
 		}
+		if rawapi != nil {
+			obsapi.EnableEvidence(rawapi)
+		}
+		adminapi.EnableConsistencyChecks(obsapi)
+		if config.ConsistencyCheckInterval > 0 {
+			log.Printf("...will check consistency every %d seconds", config.ConsistencyCheckInterval)
+		}
 	}
 
+	papi.NewStatsAPI(config, azr, rawapi, obsapi, r)
+	log.Printf("...will serve /stats and /health")
+
 	qapi, err := papi.NewQueryAPI(config, azr, r)
 	if err != nil {
 		log.Fatal(err)
 	}
 	if qapi != nil {
 		log.Printf("...will serve /query from cache at %s", config.QueryCacheRoot)
+		if rawapi != nil && config.ObsDatabase.RehydrateOnQuery {
+			log.Printf("...with trimmed observation sets rehydrated on query")
+			qapi.EnableArchivedSets(rawapi)
+		} else if rawapi != nil && config.ObsDatabase.QueryArchivedSets {
+			log.Printf("...with trimmed observation sets scanned from their bundles on query")
+			qapi.EnableArchivedSets(rawapi)
+		}
+		if obsapi != nil {
+			obsapi.EnableConditionReloads(qapi)
+		}
 	}
 
-	bindto := config.BindTo
+	capi, err := papi.NewChangesAPI(config, azr, r)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if capi != nil {
+		log.Printf("...will serve /changes from journal at %s", config.ChangeJournalPath)
+	}
 
 	// tell CORS to go away, and that API keys are OK
 	c := cors.New(cors.Options{
-		AllowedMethods:   []string{"GET", "POST", "PUT", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"Authorization", papi.IdempotencyKeyHeader, pto3.RequestIDHeader},
+		ExposedHeaders:   []string{pto3.RequestIDHeader, papi.QueryUsageHeader, papi.ClientUsageHeader, papi.ClientLimitHeader, papi.APIVersionHeader, papi.APIVersionsHeader},
 		AllowCredentials: true,
 	})
+	handler := papi.AccessLogMiddleware(config)(c.Handler(papi.APIVersionMiddleware(config)(r)))
+	log.Printf("...will serve API versions %v under /v<version>, redirecting unversioned paths to /v%d", pto3.APIVersions, pto3.LegacyAPIVersion)
+	log.Printf("...will log requests in %s format", config.AccessLog().Format())
+
+	// reopen the access and authorization decision logs on SIGHUP, so that
+	// they can be rotated
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := config.AccessLog().Reopen(); err != nil {
+				log.Printf("cannot reopen access log: %v", err)
+			}
+			if al := config.AuthDecisionLog(); al != nil {
+				if err := al.Reopen(); err != nil {
+					log.Printf("cannot reopen authorization decision log: %v", err)
+				}
+			}
+		}
+	}()
+
+	// bind every address before serving any, so that a configuration with an
+	// unusable address fails as a whole
+	listeners := make([]net.Listener, len(addrs))
+	for i, addr := range addrs {
+		listeners[i], err = net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// if certificate and key are present, listen and serve over TLS.
-	// otherwise, go insecure.
-
-	if config.CertificateFile != "" && config.PrivateKeyFile != "" {
-		if bindto == "" {
-			bindto = ":443"
+	// with ACME, answer challenges and redirect plain HTTP to HTTPS
+	errs := make(chan error, len(listeners)+1)
+	if acmeManager != nil {
+		challengeAddr := config.ACMEChallengeAddress()
+		ln, err := net.Listen("tcp", challengeAddr)
+		if err != nil {
+			log.Fatal(err)
 		}
-		log.Printf("...listening on %s", bindto)
-		log.Fatal(http.ListenAndServeTLS(bindto,
-			config.CertificateFile, config.PrivateKeyFile, c.Handler(r)))
-	} else {
-		if bindto == "" {
-			bindto = ":80"
+		log.Printf("...answering ACME challenges on %s", challengeAddr)
+		go func() {
+			errs <- (&http.Server{Handler: acmeManager.HTTPHandler(nil)}).Serve(ln)
+		}()
+	}
+
+	// if certificate and key are present, or obtained via ACME, listen and
+	// serve over TLS. otherwise, go insecure.
+	for _, ln := range listeners {
+		srv := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+		if tlsConfig != nil {
+			log.Printf("...listening on %s", ln.Addr())
+			go func(ln net.Listener) {
+				errs <- srv.ServeTLS(ln, "", "")
+			}(ln)
+		} else {
+			log.Printf("...listening INSECURELY on %s; API keys will be sent in the clear", ln.Addr())
+			go func(ln net.Listener) {
+				errs <- srv.Serve(ln)
+			}(ln)
 		}
-		log.Printf("...listening INSECURELY on %s", bindto)
-		log.Fatal(http.ListenAndServe(bindto, c.Handler(r)))
 	}
+
+	log.Fatal(<-errs)
 }
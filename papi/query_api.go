@@ -1,13 +1,18 @@
 package papi
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	pto3 "github.com/mami-project/pto3-go"
@@ -19,7 +24,7 @@ type QueryAPI struct {
 	azr    Authorizer
 }
 
-func (qa *QueryAPI) queryResponse(w http.ResponseWriter, status int, q *pto3.Query) {
+func (qa *QueryAPI) queryResponse(w http.ResponseWriter, r *http.Request, status int, q *pto3.Query) {
 	b, err := json.Marshal(q)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "marshalling query", err)
@@ -28,6 +33,7 @@ func (qa *QueryAPI) queryResponse(w http.ResponseWriter, status int, q *pto3.Que
 
 	w.Header().Set("Content-Type", "application/json")
 	qa.additionalHeaders(w)
+	qa.usageHeaders(w, r, q)
 	w.WriteHeader(status)
 	w.Write(b)
 }
@@ -76,37 +82,91 @@ func (qa *QueryAPI) authorizedToSubmit(w http.ResponseWriter, r *http.Request, f
 		perm = "submit_query_group"
 	}
 
+	// differentially private queries may be granted more widely
+	if _, ok := form["epsilon"]; ok {
+		perm = "submit_query_private"
+	}
+
 	return qa.azr.IsAuthorized(w, r, perm)
 }
 
+// submitterForRequest returns an identifier for the client submitting a
+// request: a short hash of its API key, or "default" if none was given. The
+// key itself is never stored.
+func submitterForRequest(r *http.Request) string {
+	authfield := strings.Fields(r.Header.Get("Authorization"))
+	if len(authfield) < 2 {
+		return "default"
+	}
+
+	h := sha256.Sum256([]byte(authfield[1]))
+	return hex.EncodeToString(h[:8])
+}
+
 func (qa *QueryAPI) handleSubmit(w http.ResponseWriter, r *http.Request) {
 
 	// Parse the form (we need this to check authorization)
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
 	}
 
-	// fail if not authorized
-	if !qa.authorizedToSubmit(w, r, r.Form) {
+	// fail if not authorized, or if the client's queries used too much
+	if !qa.authorizedToSubmit(w, r, r.Form) || !qa.withinQueryLimits(w, r) {
 		return
 	}
 
 	// execute query, but don't wait for it beyond the immediate wait.
 	// This will give us an existing query if it's already in the cache.
-	q, _, err := qa.qc.ExecuteQueryFromForm(r.Form, make(chan struct{}))
+	q, _, err := qa.qc.ExecuteQueryFromFormAs(r.Form, submitterForRequest(r), make(chan struct{}))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing query", err)
+		return
+	}
+
+	qa.queryResponse(w, r, http.StatusOK, q)
+}
+
+// handleSubmitAsync handles POST /query. It submits a query for execution in
+// the background and returns immediately with 202 Accepted, with the query's
+// metadata in the response and its link in the Location header. Clients poll
+// the link for the query's state, or give a callback URL in the callback
+// parameter to be notified with the query's metadata on completion.
+func (qa *QueryAPI) handleSubmitAsync(w http.ResponseWriter, r *http.Request) {
+
+	// Parse the form (we need this to check authorization)
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	// fail if not authorized, or if the client's queries used too much
+	if !qa.authorizedToSubmit(w, r, r.Form) || !qa.withinQueryLimits(w, r) {
+		return
+	}
+
+	// submit the query; this will give us an existing query if cached
+	q, new, err := qa.qc.SubmitQueryFromFormAs(r.Form, submitterForRequest(r))
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "parsing query", err)
 		return
 	}
 
-	qa.queryResponse(w, http.StatusOK, q)
+	// start it running in the background if it's new
+	if new {
+		recordChange(qa.config, pto3.JournalStoreQuery, pto3.JournalCreate, "query/"+q.Identifier)
+		q.Execute(make(chan struct{}))
+	}
+
+	link, _ := qa.config.LinkTo("query/" + q.Identifier)
+	w.Header().Set("Location", link)
+	qa.queryResponse(w, r, http.StatusAccepted, q)
 }
 
 func (qa *QueryAPI) handleRetrieve(w http.ResponseWriter, r *http.Request) {
 
 	// Parse the form (we need this to check authorization)
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
 	}
 
 	// fail if not authorized
@@ -130,11 +190,67 @@ func (qa *QueryAPI) handleRetrieve(w http.ResponseWriter, r *http.Request) {
 
 	// 404 if no query
 	if oq == nil {
-		http.Error(w, "query not found", http.StatusNotFound)
+		pto3.HTTPError(w, "query not found", http.StatusNotFound)
+		return
+	}
+
+	qa.queryResponse(w, r, http.StatusOK, oq)
+}
+
+// handlePrivacyBudget handles GET /query/budget, writing the privacy budget
+// of the client making the request for differentially private queries to
+// the response as JSON.
+func (qa *QueryAPI) handlePrivacyBudget(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "read_query") {
+		return
+	}
+
+	budget, err := qa.qc.PrivacyBudget(submitterForRequest(r))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "reading privacy budget", err)
+		return
+	}
+
+	b, err := json.Marshal(budget)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling privacy budget", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleQueryUsage handles GET /query/usage, writing the resources used by
+// the queries of the client making the request in the current limit period,
+// and its ceilings, to the response as JSON.
+func (qa *QueryAPI) handleQueryUsage(w http.ResponseWriter, r *http.Request) {
+
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "read_query") {
+		return
+	}
+
+	usage, err := qa.qc.QueryUsage(submitterForRequest(r))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "reading query usage", err)
+		return
+	}
+
+	b, err := json.Marshal(usage)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling query usage", err)
 		return
 	}
 
-	qa.queryResponse(w, http.StatusOK, oq)
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
 }
 
 func (qa *QueryAPI) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
@@ -142,7 +258,7 @@ func (qa *QueryAPI) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
 
 	qid, ok := vars["query"]
 	if !ok {
-		http.Error(w, "missing query", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing query", http.StatusBadRequest)
 		return
 	}
 
@@ -158,19 +274,19 @@ func (qa *QueryAPI) handleGetMetadata(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	qa.queryResponse(w, http.StatusOK, q)
+	qa.queryResponse(w, r, http.StatusOK, q)
 }
 
 func (qa *QueryAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
 	}
 
 	qid, ok := vars["query"]
 	if !ok {
-		http.Error(w, "missing query", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing query", http.StatusBadRequest)
 		return
 	}
 
@@ -183,11 +299,16 @@ func (qa *QueryAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 	q, err := qa.qc.QueryByIdentifier(qid)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "fetching query", err)
+		return
+	}
+	if q == nil {
+		pto3.HTTPError(w, "query not found", http.StatusNotFound)
+		return
 	}
 
 	// fail if not JSON
 	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for query metadata must be application/json; got %s instead",
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for query metadata must be application/json; got %s instead",
 			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
 		return
 	}
@@ -195,7 +316,7 @@ func (qa *QueryAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 	// update query with JSON
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
 	}
 
 	if err := q.UpdateFromJSON(b); err != nil {
@@ -208,8 +329,52 @@ func (qa *QueryAPI) handlePutMetadata(w http.ResponseWriter, r *http.Request) {
 		pto3.HandleErrorHTTP(w, "writing query metadata", err)
 		return
 	}
+	recordChange(qa.config, pto3.JournalStoreQuery, pto3.JournalUpdate, "query/"+q.Identifier)
 
-	qa.queryResponse(w, http.StatusOK, q)
+	qa.queryResponse(w, r, http.StatusOK, q)
+}
+
+// handleDelete handles DELETE /query/<query>, invalidating a cached query
+// and its results.
+func (qa *QueryAPI) handleDelete(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	qid, ok := vars["query"]
+	if !ok {
+		pto3.HTTPError(w, "missing query", http.StatusBadRequest)
+		return
+	}
+
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "purge_query") {
+		return
+	}
+
+	// make sure the query exists
+	q, err := qa.qc.QueryByIdentifier(qid)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching query", err)
+		return
+	}
+	if q == nil {
+		pto3.HTTPError(w, "query not found", http.StatusNotFound)
+		return
+	}
+
+	// refuse to purge queries still running
+	if q.Executed != nil && q.Completed == nil {
+		pto3.HTTPError(w, "query is executing", http.StatusConflict)
+		return
+	}
+
+	if err := q.Purge(); err != nil {
+		pto3.HandleErrorHTTP(w, "purging query", err)
+		return
+	}
+	recordChange(qa.config, pto3.JournalStoreQuery, pto3.JournalDelete, "query/"+q.Identifier)
+
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (qa *QueryAPI) handleGetResults(w http.ResponseWriter, r *http.Request) {
@@ -217,12 +382,12 @@ func (qa *QueryAPI) handleGetResults(w http.ResponseWriter, r *http.Request) {
 
 	qid, ok := vars["query"]
 	if !ok {
-		http.Error(w, "missing query", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing query", http.StatusBadRequest)
 		return
 	}
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
 	}
 
 	// fail if not authorized
@@ -236,32 +401,78 @@ func (qa *QueryAPI) handleGetResults(w http.ResponseWriter, r *http.Request) {
 		pto3.HandleErrorHTTP(w, "fetching query", err)
 		return
 	}
+	if q == nil {
+		pto3.HTTPError(w, "query not found", http.StatusNotFound)
+		return
+	}
 
 	// verify that the query thinks that it's completed
 	if q.Completed == nil {
-		http.Error(w, "results not available", http.StatusNotFound)
+		pto3.HTTPError(w, "results not available", http.StatusNotFound)
+		return
+	}
+	qa.usageHeaders(w, r, q)
+
+	// select fields to return, if given
+	fields, err := pto3.ParseObservationFields(r.Form.Get("fields"))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "parsing fields", err)
+		return
+	}
+
+	// stream the whole result in another format if one was requested
+	format, err := pto3.NegotiateObservationFormat(r)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "negotiating result format", err)
+		return
+	}
+	if format != nil {
+		markDeprecated(qa.config, w, r, "format "+format.Name)
+		exportOpts, err := pto3.ParseExportOptions(r.Form)
+		if err == nil {
+			err = format.CheckExportOptions(exportOpts)
+		}
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "parsing export options", err)
+			return
+		}
+		qa.writeEncodedResults(w, r, q, format, fields, exportOpts)
+		return
 	}
 
 	// get page number from query, default to zero
 	page, _ := strconv.ParseInt(r.Form.Get("page"), 10, 64)
 
 	// retrieve and paginate result
-	robj, more, err := q.PaginateResultObject(int(page)*qa.config.PageLength, qa.config.PageLength)
+	// leaving out small groups for clients other than the submitter
+	submitter := submitterForRequest(r)
+	robj, more, err := q.PaginateResultObjectFor(int(page)*qa.config.PageLength, qa.config.PageLength, fields, submitter)
 	if err != nil {
 		pto3.HandleErrorHTTP(w, "retrieving result", err)
 		return
 	}
+	totalCount, err := q.ResultRowCountFor(submitter)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "counting results", err)
+		return
+	}
+
+	// keep the field selection in links to other pages
+	var fieldParam string
+	if fields != nil {
+		fieldParam = "&fields=" + url.QueryEscape(r.Form.Get("fields"))
+	}
 
 	if more {
-		nextLink, _ := qa.config.LinkTo(fmt.Sprintf("/query/%s/result?page=%d", q.Identifier, page+1))
+		nextLink, _ := qa.config.LinkTo(fmt.Sprintf("/query/%s/result?page=%d%s", q.Identifier, page+1, fieldParam))
 		robj["next"] = nextLink
-		robj["total_count"] = q.ResultRowCount()
+		robj["total_count"] = totalCount
 	}
 
 	if page > 0 {
-		prevLink, _ := qa.config.LinkTo(fmt.Sprintf("/query/%s/result?page=%d", q.Identifier, page-1))
+		prevLink, _ := qa.config.LinkTo(fmt.Sprintf("/query/%s/result?page=%d%s", q.Identifier, page-1, fieldParam))
 		robj["prev"] = prevLink
-		robj["total_count"] = q.ResultRowCount()
+		robj["total_count"] = totalCount
 	}
 
 	outb, err := json.Marshal(robj)
@@ -275,19 +486,286 @@ func (qa *QueryAPI) handleGetResults(w http.ResponseWriter, r *http.Request) {
 	w.Write(outb)
 }
 
+// acceptsEncoding returns true if the client accepts the given content
+// encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.SplitN(coding, ";", 2)
+		if strings.TrimSpace(parts[0]) != encoding {
+			continue
+		}
+		// e.g. zstd;q=0 explicitly refuses zstd
+		return len(parts) < 2 || strings.Replace(parts[1], " ", "", -1) != "q=0"
+	}
+	return false
+}
+
+// writeEncodedResults writes the given fields (nil for all) of the complete
+// results of a selection query to the response in the given format, with the
+// given export options, which the caller has checked the format supports.
+// Results stored compressed are sent without decompression if the client
+// accepts their content encoding and no conversion is necessary, and
+// decompressed on the fly otherwise.
+func (qa *QueryAPI) writeEncodedResults(w http.ResponseWriter, r *http.Request, q *pto3.Query, format *pto3.ObservationFormat, fields []int, exportOpts *pto3.ExportOptions) {
+	if !q.HasObservationResults() {
+		pto3.HTTPError(w, fmt.Sprintf("results of query %s are not observations, and are only available as JSON", q.Identifier), http.StatusNotAcceptable)
+		return
+	}
+
+	// send compressed NDJSON results as stored to clients which accept them
+	if format.Name == pto3.ObservationFormatNDJSON && fields == nil {
+		resultFile, encoding, err := q.ReadStoredResultFile()
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "opening result file", err)
+			return
+		}
+		defer resultFile.Close()
+
+		if encoding != "" {
+			w.Header().Set("Vary", "Accept-Encoding")
+		}
+		if encoding != "" && acceptsEncoding(r, encoding) {
+			w.Header().Set("Content-Type", format.ContentType)
+			w.Header().Set("Content-Encoding", encoding)
+			qa.additionalHeaders(w)
+			w.WriteHeader(http.StatusOK)
+			if _, err := io.Copy(w, resultFile); err != nil {
+				log.Printf("error sending results of query %s: %v", q.Identifier, err)
+			}
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", format.ContentType)
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+
+	enc, _ := format.Encoder(w, fields, exportOpts)
+	err := q.EncodeResults(enc)
+	if err == nil {
+		err = enc.Close()
+	}
+	if err != nil {
+		log.Printf("error encoding results of query %s as %s: %v", q.Identifier, format.Name, err)
+	}
+}
+
+// handleRerun handles POST /query/<query>/rerun, executing a completed query
+// again in the background and comparing its results with those of the
+// previous execution. It responds with 202 Accepted and the query metadata;
+// once the query completes again, the comparison is available at
+// /query/<query>/diff.
+func (qa *QueryAPI) handleRerun(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	qid, ok := vars["query"]
+	if !ok {
+		pto3.HTTPError(w, "missing query", http.StatusBadRequest)
+		return
+	}
+
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "update_query") {
+		return
+	}
+
+	q, err := qa.qc.QueryByIdentifier(qid)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching query", err)
+		return
+	}
+	if q == nil {
+		pto3.HTTPError(w, "query not found", http.StatusNotFound)
+		return
+	}
+
+	if err := q.Rerun(make(chan struct{})); err != nil {
+		pto3.HandleErrorHTTP(w, "rerunning query", err)
+		return
+	}
+	recordChange(qa.config, pto3.JournalStoreQuery, pto3.JournalUpdate, "query/"+q.Identifier)
+
+	qa.queryResponse(w, r, http.StatusAccepted, q)
+}
+
+// handleMaterialize handles POST /query/<query>/materialize, storing the
+// results of a completed selection query as a new observation set whose
+// _analyzer is the query and whose _sources are the sets the results came
+// from. It accepts an optional JSON object with metadata for the new set, and
+// writes the new set's metadata to the response.
+func (qa *QueryAPI) handleMaterialize(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	qid, ok := vars["query"]
+	if !ok {
+		pto3.HTTPError(w, "missing query", http.StatusBadRequest)
+		return
+	}
+
+	// fail if not authorized to read the query or create the set
+	if !qa.azr.IsAuthorized(w, r, "read_query") || !qa.azr.IsAuthorized(w, r, "write_obs") {
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metadata := make(map[string]string)
+	if len(b) > 0 {
+		if r.Header.Get("Content-Type") != "application/json" {
+			pto3.HTTPError(w, fmt.Sprintf("Content-type for set metadata must be application/json; got %s instead",
+				r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if err := json.Unmarshal(b, &metadata); err != nil {
+			pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	q, err := qa.qc.QueryByIdentifier(qid)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching query", err)
+		return
+	}
+	if q == nil {
+		pto3.HTTPError(w, "query not found", http.StatusNotFound)
+		return
+	}
+
+	set, err := q.MaterializeResults(metadata, submitterForRequest(r))
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "materializing query results", err)
+		return
+	}
+	recordChange(qa.config, pto3.JournalStoreObs, pto3.JournalCreate, fmt.Sprintf("obs/%x", set.ID))
+
+	outb, err := json.Marshal(set)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling set metadata", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(outb)
+}
+
+// handleGetDiff handles GET /query/<query>/diff, returning the difference
+// between the results of the most recent execution of a query and the one
+// before it, as a JSON object.
+func (qa *QueryAPI) handleGetDiff(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	qid, ok := vars["query"]
+	if !ok {
+		pto3.HTTPError(w, "missing query", http.StatusBadRequest)
+		return
+	}
+
+	// fail if not authorized
+	if !qa.azr.IsAuthorized(w, r, "read_query") {
+		return
+	}
+
+	q, err := qa.qc.QueryByIdentifier(qid)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "fetching query", err)
+		return
+	}
+	if q == nil {
+		pto3.HTTPError(w, "query not found", http.StatusNotFound)
+		return
+	}
+
+	b, err := q.ReadDiff()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving diff", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	qa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
 func (qa *QueryAPI) additionalHeaders(w http.ResponseWriter) {
 	if qa.config.AllowOrigin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", qa.config.AllowOrigin)
 	}
 }
 
-func (qa *QueryAPI) addRoutes(r *mux.Router, l *log.Logger) {
-	r.HandleFunc("/query", LogAccess(l, qa.handleList)).Methods("GET")
-	r.HandleFunc("/query/submit", LogAccess(l, qa.handleSubmit)).Methods("GET", "POST")
-	r.HandleFunc("/query/retrieve", LogAccess(l, qa.handleRetrieve)).Methods("GET", "POST")
-	r.HandleFunc("/query/{query}", LogAccess(l, qa.handleGetMetadata)).Methods("GET")
-	r.HandleFunc("/query/{query}", LogAccess(l, qa.handlePutMetadata)).Methods("PUT")
-	r.HandleFunc("/query/{query}/result", LogAccess(l, qa.handleGetResults)).Methods("GET")
+// Headers accounting for the resources used by queries.
+const (
+	// Usage of the query a response describes, at its last execution
+	QueryUsageHeader = "PTO-Query-Usage"
+	// Usage of the client's queries in the current limit period
+	ClientUsageHeader = "PTO-Client-Usage"
+	// Ceilings on the usage of the client's queries per limit period
+	ClientLimitHeader = "PTO-Client-Limit"
+)
+
+// usageHeaders adds headers accounting for the resources used by a query,
+// once executed, and, if query limits are enabled, by the queries of the
+// client making a request, to the response.
+func (qa *QueryAPI) usageHeaders(w http.ResponseWriter, r *http.Request, q *pto3.Query) {
+	if usage := q.Usage(); usage != nil {
+		w.Header().Set(QueryUsageHeader, usage.Header())
+	}
+
+	if qa.config.QueryLimits == nil {
+		return
+	}
+	usage, err := qa.qc.QueryUsage(submitterForRequest(r))
+	if err != nil {
+		log.Printf("error reading query usage for %s: %v", submitterForRequest(r), err)
+		return
+	}
+	w.Header().Set(ClientUsageHeader, usage.Used.Header())
+	w.Header().Set(ClientLimitHeader, usage.Limit.Header())
+}
+
+// withinQueryLimits returns true if the client making a request may submit
+// new queries. If its queries have reached a ceiling on their usage, it
+// returns false, and fills in a 429 response, with a Retry-After header if
+// the client's usage will be reset.
+func (qa *QueryAPI) withinQueryLimits(w http.ResponseWriter, r *http.Request) bool {
+	usage, err := qa.qc.CheckQueryLimits(submitterForRequest(r))
+	if err == nil {
+		return true
+	}
+
+	if usage != nil {
+		if usage.Reset != nil {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(time.Until(*usage.Reset).Seconds())+1))
+		}
+		w.Header().Set(ClientUsageHeader, usage.Used.Header())
+		w.Header().Set(ClientLimitHeader, usage.Limit.Header())
+	}
+	pto3.HandleErrorHTTP(w, "checking query limits", err)
+	return false
+}
+
+func (qa *QueryAPI) addRoutes(r *mux.Router) {
+	r.HandleFunc("/query", qa.handleList).Methods("GET")
+	r.HandleFunc("/query", qa.handleSubmitAsync).Methods("POST")
+	r.HandleFunc("/query/submit", qa.handleSubmit).Methods("GET", "POST")
+	r.HandleFunc("/query/retrieve", qa.handleRetrieve).Methods("GET", "POST")
+	r.HandleFunc("/query/budget", qa.handlePrivacyBudget).Methods("GET")
+	r.HandleFunc("/query/usage", qa.handleQueryUsage).Methods("GET")
+	r.HandleFunc("/query/{query}", qa.handleGetMetadata).Methods("GET")
+	r.HandleFunc("/query/{query}", qa.handlePutMetadata).Methods("PUT")
+	r.HandleFunc("/query/{query}", qa.handleDelete).Methods("DELETE")
+	r.HandleFunc("/query/{query}/result", qa.handleGetResults).Methods("GET")
+	r.HandleFunc("/query/{query}/rerun", qa.handleRerun).Methods("POST")
+	r.HandleFunc("/query/{query}/diff", qa.handleGetDiff).Methods("GET")
+	r.HandleFunc("/query/{query}/materialize", qa.handleMaterialize).Methods("POST")
 }
 
 func (qa *QueryAPI) LoadTestData(obsFilename string) (int, error) {
@@ -298,9 +776,16 @@ func (qa *QueryAPI) EnableQueryLogging() {
 	qa.qc.EnableQueryLogging()
 }
 
+// EnableArchivedSets allows queries to include the trimmed observation sets
+// they may select from the raw data served by the given API; see
+// RehydrateOnQuery and QueryArchivedSets.
+func (qa *QueryAPI) EnableArchivedSets(ra *RawAPI) {
+	qa.qc.EnableArchivedSets(ra.rds)
+}
+
 func NewQueryAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) (*QueryAPI, error) {
 
-	if config.QueryCacheRoot == "" {
+	if config.QueryCacheRoot == "" || !config.FeatureEnabled(pto3.FeatureQueryCache) {
 		return nil, nil
 	}
 
@@ -314,7 +799,7 @@ func NewQueryAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) (
 		return nil, err
 	}
 
-	qa.addRoutes(r, config.AccessLogger())
+	qa.addRoutes(r)
 
 	return qa, nil
 }
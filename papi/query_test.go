@@ -1,12 +1,20 @@
 package papi_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 type testQueryMetadata struct {
@@ -136,3 +144,406 @@ func TestQueryLifecycle(t *testing.T) {
 	}
 
 }
+
+// submitAndWait submits a query and waits until it completes, failing the
+// test if it fails.
+func submitAndWait(t *testing.T, queryParams string) *testQueryMetadata {
+	q := new(testQueryMetadata)
+	for {
+		res := executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+queryParams, nil, "", GoodAPIKey, http.StatusOK)
+
+		if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+			t.Fatal(err)
+		}
+
+		if q.State == "failed" {
+			t.Fatalf("Query failed with error %s", q.Error)
+		} else if q.State == "complete" {
+			return q
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func TestQueryCompressedResults(t *testing.T) {
+	TestConfig.CompressQueryCache = true
+	defer func() { TestConfig.CompressQueryCache = false }()
+
+	q := submitAndWait(t, fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.red", TestQueryCacheSetID,
+		url.QueryEscape("2017-12-05T15:00:00Z"), url.QueryEscape("2017-12-05T16:00:00Z")))
+
+	getResults := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", q.Result+"?format=ndjson", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		res := httptest.NewRecorder()
+		TestHandler.ServeHTTP(res, req)
+
+		if res.Code != http.StatusOK {
+			t.Fatalf("GET %s with Accept-Encoding %q expected status %d but got %d", q.Result, acceptEncoding, http.StatusOK, res.Code)
+		}
+		if res.Header().Get("Vary") != "Accept-Encoding" {
+			t.Fatalf("GET %s with Accept-Encoding %q does not vary by encoding", q.Result, acceptEncoding)
+		}
+		return res
+	}
+
+	// clients not accepting zstd get results decompressed on the fly
+	plain := getResults("gzip, deflate")
+	if plain.Header().Get("Content-Encoding") != "" || !bytes.Contains(plain.Body.Bytes(), []byte("pto.test.color.red")) {
+		t.Fatalf("unexpected results without zstd, encoded %q:\n%s", plain.Header().Get("Content-Encoding"), plain.Body.String())
+	}
+	if refused := getResults("zstd;q=0, gzip"); refused.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("results sent with encoding %s to client refusing zstd", refused.Header().Get("Content-Encoding"))
+	}
+
+	// and clients accepting it get them as stored
+	compressed := getResults("gzip, zstd")
+	if compressed.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatalf("results sent with encoding %q to client accepting zstd", compressed.Header().Get("Content-Encoding"))
+	}
+
+	zr, err := zstd.NewReader(compressed.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	decompressed, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(decompressed, []byte("pto.test.color.red")) ||
+		bytes.Count(decompressed, []byte("\n")) != bytes.Count(plain.Body.Bytes(), []byte("\n")) {
+		t.Fatalf("decompressed results differ from results sent uncompressed:\n%s\n%s", decompressed, plain.Body.String())
+	}
+}
+
+func TestQueryMaterialize(t *testing.T) {
+
+	timeParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s", TestQueryCacheSetID,
+		url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T15:00:00Z"))
+
+	// materialize a selection query's results into a new set
+	q := submitAndWait(t, timeParams+"&condition=pto.test.color.blue")
+
+	md := map[string]string{"description": "blue observations", "_analyzer": "ignored"}
+	res := executeWithJSON(TestRouter, t, "POST", q.Link+"/materialize", md, GoodAPIKey, http.StatusCreated)
+
+	var set ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+
+	if set.Analyzer != q.Link {
+		t.Fatalf("expected analyzer %s, got %s", q.Link, set.Analyzer)
+	}
+
+	sourceLink := fmt.Sprintf(TestAPIURL+"/obs/%x", TestQueryCacheSetID)
+	if len(set.Sources) != 1 || set.Sources[0] != sourceLink {
+		t.Fatalf("expected sources [%s], got %v", sourceLink, set.Sources)
+	}
+
+	if len(set.Conditions) != 1 || set.Conditions[0] != "pto.test.color.blue" {
+		t.Fatalf("expected conditions [pto.test.color.blue], got %v", set.Conditions)
+	}
+
+	if set.Description != "blue observations" {
+		t.Fatalf("got unexpected description %s", set.Description)
+	}
+
+	const expectedObsCount = 396
+	if set.Count != expectedObsCount {
+		t.Fatalf("expected %d observations, got %d", expectedObsCount, set.Count)
+	}
+
+	// the new set is derived from its source
+	res = executeRequest(TestRouter, t, "GET", set.Link+"/provenance", nil, "", GoodAPIKey, http.StatusOK)
+
+	var prov struct {
+		Sets []string `json:"sets"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &prov); err != nil {
+		t.Fatal(err)
+	}
+	if len(prov.Sets) != 1 || prov.Sets[0] != sourceLink {
+		t.Fatalf("expected provenance sets [%s], got %v", sourceLink, prov.Sets)
+	}
+
+	// group query results are not observations
+	gq := submitAndWait(t, timeParams+"&group=condition")
+	executeRequest(TestRouter, t, "POST", gq.Link+"/materialize", nil, "", GoodAPIKey, http.StatusBadRequest)
+
+	// nonexistent queries can't be materialized
+	executeRequest(TestRouter, t, "POST", "https://ptotest.mami-project.eu/query/nonexistent/materialize", nil, "", GoodAPIKey, http.StatusNotFound)
+}
+
+func TestQueryCompare(t *testing.T) {
+
+	timeParams := fmt.Sprintf("time_start=%s&time_end=%s",
+		url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T15:00:00Z"))
+
+	// make a set of the blue observations to compare with the whole set
+	q := submitAndWait(t, fmt.Sprintf("set=%x&%s&condition=pto.test.color.blue", TestQueryCacheSetID, timeParams))
+	res := executeWithJSON(TestRouter, t, "POST", q.Link+"/materialize", nil, GoodAPIKey, http.StatusCreated)
+
+	var set ClientObservationSet
+	if err := json.Unmarshal(res.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+
+	var blueSetID int
+	if _, err := fmt.Sscanf(set.Link, TestAPIURL+"/obs/%x", &blueSetID); err != nil {
+		t.Fatal(err)
+	}
+
+	compareParams := fmt.Sprintf("%s&compare_a=%x&compare_b=%x", timeParams, blueSetID, TestQueryCacheSetID)
+
+	expectedPathCounts := map[string]int{
+		"both":      362,
+		"changed":   238,
+		"unchanged": 124,
+		"only_a":    0,
+		"only_b":    1519,
+	}
+
+	for mode, expectedPathCount := range expectedPathCounts {
+		cq := submitAndWait(t, compareParams+"&compare="+mode)
+
+		pathCount := 0
+		for resultLink := cq.Result; resultLink != ""; {
+			res := executeRequest(TestRouter, t, "GET", resultLink, nil, "", GoodAPIKey, http.StatusOK)
+
+			var qr struct {
+				Next  string          `json:"next"`
+				Paths [][]interface{} `json:"paths"`
+			}
+			if err := json.Unmarshal(res.Body.Bytes(), &qr); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, path := range qr.Paths {
+				if len(path) != 3 {
+					t.Fatalf("%s comparison: malformed result row %v", mode, path)
+				}
+				conditionsA := path[1].([]interface{})
+				if mode == "changed" && (len(conditionsA) != 1 || conditionsA[0] != "pto.test.color.blue") {
+					t.Fatalf("changed comparison: expected only blue in first set, got %v", conditionsA)
+				}
+			}
+
+			pathCount += len(qr.Paths)
+			resultLink = qr.Next
+		}
+
+		if pathCount != expectedPathCount {
+			t.Fatalf("%s comparison: expected %d paths, got %d", mode, expectedPathCount, pathCount)
+		}
+	}
+
+	// comparisons need both sets, and can't be combined with set selection
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+timeParams+
+		fmt.Sprintf("&compare=both&compare_a=%x", blueSetID), nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+compareParams+
+		fmt.Sprintf("&compare=both&set=%x", blueSetID), nil, "", GoodAPIKey, http.StatusBadRequest)
+	executeRequest(TestRouter, t, "GET", "https://ptotest.mami-project.eu/query/submit?"+compareParams+
+		"&compare=sideways", nil, "", GoodAPIKey, http.StatusBadRequest)
+}
+
+func TestQueryUsage(t *testing.T) {
+	var usage struct {
+		Limit struct {
+			BytesReturned int64 `json:"bytes_returned"`
+		} `json:"limit"`
+		Used struct {
+			RowsScanned   int64 `json:"rows_scanned"`
+			BytesReturned int64 `json:"bytes_returned"`
+		} `json:"used"`
+		PeriodStart string `json:"period_start"`
+	}
+
+	res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/query/usage", nil, "", LimitedAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Limit.BytesReturned != 1 || usage.Used.BytesReturned != 0 || usage.PeriodStart != "" {
+		t.Fatalf("bad initial query usage %s", res.Body.Bytes())
+	}
+
+	// a query is accounted once executed, and charged to its submitter
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.blue",
+		TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:00:00Z"), url.QueryEscape("2017-12-05T14:30:00Z"))
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/query/submit?"+queryParams, nil, "", LimitedAPIKey, http.StatusOK)
+
+	var q struct {
+		Link  string `json:"__link"`
+		State string `json:"__state"`
+		Error string `json:"__error"`
+		Usage *struct {
+			RowsScanned   int64 `json:"rows_scanned"`
+			BytesReturned int64 `json:"bytes_returned"`
+		} `json:"__usage"`
+	}
+	for {
+		if err := json.Unmarshal(res.Body.Bytes(), &q); err != nil {
+			t.Fatal(err)
+		}
+		if q.State == "failed" {
+			t.Fatalf("query failed with error %s", q.Error)
+		} else if q.State == "complete" {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+		res = executeRequest(TestRouter, t, "GET", q.Link, nil, "", LimitedAPIKey, http.StatusOK)
+	}
+
+	if q.Usage == nil || q.Usage.RowsScanned == 0 || q.Usage.BytesReturned == 0 {
+		t.Fatalf("bad usage of completed query %s", res.Body.Bytes())
+	}
+	if header := res.Header().Get("PTO-Query-Usage"); !strings.Contains(header, fmt.Sprintf("bytes_returned=%d", q.Usage.BytesReturned)) {
+		t.Fatalf("bad query usage header %s", header)
+	}
+	if header := res.Header().Get("PTO-Client-Limit"); !strings.Contains(header, "bytes_returned=1") {
+		t.Fatalf("bad client limit header %s", header)
+	}
+
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/query/usage", nil, "", LimitedAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Used.BytesReturned != q.Usage.BytesReturned || usage.PeriodStart == "" {
+		t.Fatalf("bad query usage after query %s", res.Body.Bytes())
+	}
+
+	// once a ceiling is reached, the client may submit no new queries
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/query/submit?"+queryParams+"&option=sets_only", nil, "", LimitedAPIKey, http.StatusTooManyRequests)
+	if !strings.Contains(res.Body.String(), "query_limit_reached") {
+		t.Fatalf("expected query limit error, got %s", res.Body.Bytes())
+	}
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/query", strings.NewReader(queryParams+"&option=sets_only"),
+		"application/x-www-form-urlencoded", LimitedAPIKey, http.StatusTooManyRequests)
+}
+
+func TestQueryCallbacks(t *testing.T) {
+	// a receiver reporting the paths complete queries were POSTed to
+	received := make(chan string, 4)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var q testQueryMetadata
+		if err := json.NewDecoder(r.Body).Decode(&q); err != nil || q.State != "complete" {
+			received <- "incomplete"
+			return
+		}
+		received <- r.URL.Path
+	}))
+	defer receiver.Close()
+
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.blue",
+		TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:10:00Z"), url.QueryEscape("2017-12-05T14:50:00Z"))
+
+	submit := func(apikey string, callback string, expectstatus int) {
+		executeRequest(TestRouter, t, "POST", TestAPIURL+"/query",
+			strings.NewReader(queryParams+"&callback="+url.QueryEscape(callback)),
+			"application/x-www-form-urlencoded", apikey, expectstatus)
+	}
+
+	// callbacks must be http URLs at public addresses
+	defer func(networks []string) {
+		TestConfig.OutboundNetworks = networks
+	}(TestConfig.OutboundNetworks)
+	TestConfig.OutboundNetworks = nil
+	submit(GoodAPIKey, receiver.URL+"/good", http.StatusForbidden)
+	submit(GoodAPIKey, "http://169.254.169.254/latest/meta-data/", http.StatusForbidden)
+	submit(GoodAPIKey, "ftp://ptotest.mami-project.eu/callback", http.StatusBadRequest)
+
+	// every client submitting the same query is notified
+	TestConfig.OutboundNetworks = []string{"127.0.0.0/8"}
+	submit(GoodAPIKey, receiver.URL+"/good", http.StatusAccepted)
+	submit(WatcherAPIKey, receiver.URL+"/watcher", http.StatusAccepted)
+
+	paths := make(map[string]bool)
+	for len(paths) < 2 {
+		select {
+		case path := <-received:
+			if path == "incomplete" {
+				t.Fatal("callback received metadata of an incomplete query")
+			}
+			paths[path] = true
+		case <-time.After(10 * time.Second):
+			t.Fatalf("callbacks not delivered; received %v", paths)
+		}
+	}
+	if !paths["/good"] || !paths["/watcher"] {
+		t.Fatalf("unexpected callbacks %v", paths)
+	}
+}
+
+func TestQueryInvalidate(t *testing.T) {
+	queryParams := fmt.Sprintf("set=%x&time_start=%s&time_end=%s&condition=pto.test.color.blue",
+		TestQueryCacheSetID, url.QueryEscape("2017-12-05T14:20:00Z"), url.QueryEscape("2017-12-05T14:40:00Z"))
+
+	// complete queries record who submitted them, how long they took, and
+	// how many rows they returned
+	var md struct {
+		Link          string   `json:"__link"`
+		Result        string   `json:"__result"`
+		Submitter     string   `json:"__submitter"`
+		ExecutionTime *float64 `json:"__execution_time"`
+		RowCount      int      `json:"__row_count"`
+	}
+	checkMetadata := func(q *testQueryMetadata) {
+		res := executeRequest(TestRouter, t, "GET", q.Link, nil, "", GoodAPIKey, http.StatusOK)
+		if err := json.Unmarshal(res.Body.Bytes(), &md); err != nil {
+			t.Fatal(err)
+		}
+
+		keyHash := sha256.Sum256([]byte(GoodAPIKey))
+		if md.Submitter != hex.EncodeToString(keyHash[:8]) {
+			t.Fatalf("unexpected submitter %s", md.Submitter)
+		}
+		if md.ExecutionTime == nil || *md.ExecutionTime < 0 {
+			t.Fatalf("unexpected execution time %v", md.ExecutionTime)
+		}
+
+		rowCount := 0
+		for resultLink := md.Result; resultLink != ""; {
+			res := executeRequest(TestRouter, t, "GET", resultLink, nil, "", GoodAPIKey, http.StatusOK)
+
+			qr := new(testResultSet)
+			if err := json.Unmarshal(res.Body.Bytes(), &qr); err != nil {
+				t.Fatal(err)
+			}
+			rowCount += len(qr.Obs)
+			resultLink = qr.Next
+		}
+		if rowCount == 0 || md.RowCount != rowCount {
+			t.Fatalf("row count %d, but result has %d rows", md.RowCount, rowCount)
+		}
+	}
+
+	q := submitAndWait(t, queryParams)
+	checkMetadata(q)
+
+	// invalidating needs its own permission
+	executeRequest(TestRouter, t, "DELETE", q.Link, nil, "", GoodAPIKey, http.StatusForbidden)
+
+	// an invalidated query and its results are gone
+	executeRequest(TestRouter, t, "DELETE", q.Link, nil, "", AdminAPIKey, http.StatusNoContent)
+	executeRequest(TestRouter, t, "GET", q.Link, nil, "", GoodAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "GET", md.Result, nil, "", GoodAPIKey, http.StatusNotFound)
+	executeRequest(TestRouter, t, "DELETE", q.Link, nil, "", AdminAPIKey, http.StatusNotFound)
+
+	// and resubmitting it executes it again
+	executed := q.Executed
+	q = submitAndWait(t, queryParams)
+	if q.Link != md.Link {
+		t.Fatalf("resubmitted query has link %s, expected %s", q.Link, md.Link)
+	}
+	if q.Executed == "" || q.Executed < executed {
+		t.Fatalf("resubmitted query executed at %s, before %s", q.Executed, executed)
+	}
+	checkMetadata(q)
+}
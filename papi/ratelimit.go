@@ -0,0 +1,33 @@
+package papi
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// RateLimitMiddleware returns middleware which admits each request through
+// the configuration's RateLimiter, identifying clients by their API key as
+// queries do. Requests presenting no key, or a key the authorizer does not
+// know, are limited together as the default key. Requests beyond a client's
+// rate or concurrency limits are refused with 429 Too Many Requests and a
+// Retry-After header giving the number of seconds to wait; requests admitted
+// count against the client's concurrency until they have been served.
+func RateLimitMiddleware(config *pto3.PTOConfiguration, azr *APIKeyAuthorizer) mux.MiddlewareFunc {
+	rl := config.RateLimiter()
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			release, retry, err := rl.Admit(azr.clientForRequest(r))
+			if err != nil {
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Max(1, math.Ceil(retry.Seconds())))))
+				pto3.HandleErrorHTTP(w, "limiting requests", err)
+				return
+			}
+			defer release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/mami-project/pto3-go"
 
@@ -17,6 +17,7 @@ type RawAPI struct {
 	config *pto3.PTOConfiguration
 	rds    *pto3.RawDataStore
 	azr    Authorizer
+	ic     *IdempotencyCache
 }
 
 func (ra *RawAPI) rawMetadataResponse(w http.ResponseWriter, status int, cam *pto3.Campaign, filename string) {
@@ -124,13 +125,13 @@ func (ra *RawAPI) handleGetCampaignMetadata(w http.ResponseWriter, r *http.Reque
 	// get campaign name
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
 		return
 	}
 
 	// parse headers
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "error parsing form", http.StatusBadRequest)
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
 	}
 
 	// look up campaign
@@ -197,17 +198,28 @@ func (ra *RawAPI) handleGetCampaignMetadata(w http.ResponseWriter, r *http.Reque
 	w.Write(outb)
 }
 
+// campaignMetadataPreview is the response to a preview of a change to
+// campaign metadata, listing changes to the effective metadata of files by
+// filename.
+type campaignMetadataPreview struct {
+	Files map[string][]pto3.InheritedMetadataChange `json:"files"`
+}
+
 // handlePutCampaignMetadata handles PUT /raw/<campaign>, overwriting metadata for
 // a campaign, creating it if necessary. It requires a JSON object in the
 // request body containing campaign metadata. It echoes the written metadata
-// back in the response.
+// back in the response. If the preview parameter is true, it instead writes
+// nothing, and responds with the changes the new metadata would make to the
+// metadata files inherit from the campaign. If the pin parameter is true,
+// inherited values which would change are first written to the files
+// themselves, so that the files' effective metadata doesn't change.
 func (ra *RawAPI) handlePutCampaignMetadata(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
 	// get campaign name
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
 		return
 	}
 
@@ -218,7 +230,7 @@ func (ra *RawAPI) handlePutCampaignMetadata(w http.ResponseWriter, r *http.Reque
 
 	// fail if not JSON
 	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
 			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
 		return
 	}
@@ -226,7 +238,7 @@ func (ra *RawAPI) handlePutCampaignMetadata(w http.ResponseWriter, r *http.Reque
 	// read metadata from request
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -234,17 +246,41 @@ func (ra *RawAPI) handlePutCampaignMetadata(w http.ResponseWriter, r *http.Reque
 	var in pto3.RawMetadata
 	err = json.Unmarshal(b, &in)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "parsing metadata", pto3.PTOInvalidMetadataError(err))
 		return
 	}
 
+	// check for preview and pinning
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	var preview, pin bool
+	if previewstr := r.Form.Get("preview"); previewstr != "" {
+		if preview, err = strconv.ParseBool(previewstr); err != nil {
+			pto3.HTTPError(w, fmt.Sprintf("bad preview %s", previewstr), http.StatusBadRequest)
+			return
+		}
+	}
+	if pinstr := r.Form.Get("pin"); pinstr != "" {
+		if pin, err = strconv.ParseBool(pinstr); err != nil {
+			pto3.HTTPError(w, fmt.Sprintf("bad pin %s", pinstr), http.StatusBadRequest)
+			return
+		}
+	}
+
 	// now look up the campaig and create if necessary.
 	cam, err := ra.rds.CampaignForName(camname)
 	didCreateCampaign := false
 	if err != nil {
 		switch ev := err.(type) {
 		case *pto3.PTOError:
-			if ev.Status() == http.StatusNotFound {
+			if ev.Status() == http.StatusNotFound && preview {
+				// a new campaign has no files to change
+				ra.campaignPreviewResponse(w, make(map[string][]pto3.InheritedMetadataChange))
+				return
+			} else if ev.Status() == http.StatusNotFound {
 				// Campaign doesn't exist. We have to create it.
 				cam, err = ra.rds.CreateCampaign(camname, &in)
 				if err != nil {
@@ -263,17 +299,53 @@ func (ra *RawAPI) handlePutCampaignMetadata(w http.ResponseWriter, r *http.Reque
 	}
 
 	// overwrite metadata unless we created the campaign
-	if !didCreateCampaign {
+	if didCreateCampaign {
+		recordChange(ra.config, pto3.JournalStoreRaw, pto3.JournalCreate, "raw/"+camname)
+	} else if preview {
+		changes, err := cam.PreviewCampaignMetadata(&in)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "previewing metadata", err)
+			return
+		}
+		ra.campaignPreviewResponse(w, changes)
+		return
+	} else if pin {
+		pinned, err := cam.PutCampaignMetadataPinned(&in)
+		if err != nil {
+			pto3.HandleErrorHTTP(w, "writing metadata", err)
+			return
+		}
+		for filename := range pinned {
+			recordChange(ra.config, pto3.JournalStoreRaw, pto3.JournalUpdate, "raw/"+camname+"/"+filename)
+		}
+		recordChange(ra.config, pto3.JournalStoreRaw, pto3.JournalUpdate, "raw/"+camname)
+	} else {
 		err = cam.PutCampaignMetadata(&in)
 		if err != nil {
 			pto3.HandleErrorHTTP(w, "writing metadata", err)
 			return
 		}
+		recordChange(ra.config, pto3.JournalStoreRaw, pto3.JournalUpdate, "raw/"+camname)
 	}
 
 	ra.rawMetadataResponse(w, http.StatusCreated, cam, "")
 }
 
+// campaignPreviewResponse writes the changes previewed for a change to
+// campaign metadata to the response.
+func (ra *RawAPI) campaignPreviewResponse(w http.ResponseWriter, changes map[string][]pto3.InheritedMetadataChange) {
+	b, err := json.Marshal(&campaignMetadataPreview{Files: changes})
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshalling preview", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ra.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
 // handleGetFileMetadata handles GET /raw/<campaign>/<file>, returning
 // metadata for a file, including virtual metadata (file size and data URL) and
 // any metadata inherited from the campaign. It writes a JSON object to the
@@ -289,13 +361,13 @@ func (ra *RawAPI) handleGetFileMetadata(w http.ResponseWriter, r *http.Request)
 
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
 		return
 	}
 
 	filename, ok := vars["file"]
 	if !ok {
-		http.Error(w, "missing file", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing file", http.StatusBadRequest)
 		return
 	}
 
@@ -317,13 +389,13 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
 		return
 	}
 
 	filename, ok := vars["file"]
 	if !ok {
-		http.Error(w, "missing file", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing file", http.StatusBadRequest)
 		return
 	}
 
@@ -334,7 +406,7 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 
 	// fail if not JSON
 	if r.Header.Get("Content-Type") != "application/json" {
-		http.Error(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for metadata must be application/json; got %s instead",
 			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
 		return
 	}
@@ -342,7 +414,7 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 	// read metadata from request
 	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -350,7 +422,7 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 	var in pto3.RawMetadata
 	err = json.Unmarshal(b, &in)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		pto3.HandleErrorHTTP(w, "parsing metadata", pto3.PTOInvalidMetadataError(err))
 		return
 	}
 
@@ -367,6 +439,7 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 		pto3.HandleErrorHTTP(w, "writing file metadata", err)
 		return
 	}
+	recordChange(ra.config, pto3.JournalStoreRaw, pto3.JournalUpdate, "raw/"+camname+"/"+filename)
 
 	ra.rawMetadataResponse(w, http.StatusCreated, cam, filename)
 }
@@ -376,25 +449,27 @@ func (ra *RawAPI) handlePutFileMetadata(w http.ResponseWriter, r *http.Request)
 // Deletion is not yet fully specified or implemented, so this just returns a
 // StatusNotImplemented response for now.
 func (ra *RawAPI) handleDeleteFile(w http.ResponseWriter, r *http.Request) {
-	http.Error(w, "delete not implemented, come back later", http.StatusNotImplemented)
+	pto3.HTTPError(w, "delete not implemented, come back later", http.StatusNotImplemented)
 }
 
 // handleFileDownload handles GET /raw/<campaign>/<file>/data, returning a file's
 // content. It writes a response of the appropriate MIME type for the file (as
-// determined by the filetypes map and the _file_type metadata key).
+// determined by the filetypes map and the _file_type metadata key). Range
+// requests are supported, so that clients can fetch the raw data at a source
+// reference's byte offset without downloading the whole file.
 func (ra *RawAPI) handleFileDownload(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
 		return
 	}
 
 	filename, ok := vars["file"]
 	if !ok {
-		http.Error(w, "missing file", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing file", http.StatusBadRequest)
 		return
 	}
 
@@ -417,16 +492,24 @@ func (ra *RawAPI) handleFileDownload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// write MIME type to header
-	w.Header().Set("Content-Type", ft.ContentType)
-	ra.additionalHeaders(w)
-	w.WriteHeader(http.StatusOK)
+	// open the file
+	in, err := cam.ReadFileData(filename)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "opening data file", err)
+		return
+	}
+	defer in.Close()
 
-	// and copy the file
-	if err := cam.ReadFileDataToStream(filename, w); err != nil {
-		pto3.HandleErrorHTTP(w, "downloading data file", err)
-		w.Write([]byte("\n\"error during download\"\n"))
+	fi, err := in.Stat()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "opening data file", err)
+		return
 	}
+
+	// write MIME type to header, and serve the file or the requested range
+	w.Header().Set("Content-Type", ft.ContentType)
+	ra.additionalHeaders(w)
+	http.ServeContent(w, r, filename, fi.ModTime(), in)
 }
 
 // handleFileUpload handles PUT /raw/<campaign>/<file>/data. It requires a request of the appropriate MIME type for the file (as
@@ -436,13 +519,13 @@ func (ra *RawAPI) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 
 	camname, ok := vars["campaign"]
 	if !ok {
-		http.Error(w, "missing campaign", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
 		return
 	}
 
 	filename, ok := vars["file"]
 	if !ok {
-		http.Error(w, "missing file", http.StatusBadRequest)
+		pto3.HTTPError(w, "missing file", http.StatusBadRequest)
 		return
 	}
 
@@ -466,7 +549,7 @@ func (ra *RawAPI) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if ft.ContentType != r.Header.Get("Content-Type") {
-		http.Error(w, fmt.Sprintf("Content-Type for %s/%s must be %s", camname, filename, ft.ContentType), http.StatusBadRequest)
+		pto3.HTTPError(w, fmt.Sprintf("Content-Type for %s/%s must be %s", camname, filename, ft.ContentType), http.StatusBadRequest)
 		return
 	}
 
@@ -475,26 +558,279 @@ func (ra *RawAPI) handleFileUpload(w http.ResponseWriter, r *http.Request) {
 		pto3.HandleErrorHTTP(w, "writing uploaded data", err)
 		return
 	}
+	recordChange(ra.config, pto3.JournalStoreRaw, pto3.JournalCreate, "raw/"+camname+"/"+filename+"/data")
 
 	// and now a reply... return file metadata
 	ra.rawMetadataResponse(w, http.StatusCreated, cam, filename)
 }
 
+type fetchRequest struct {
+	File string `json:"file"`
+	URL  string `json:"url"`
+}
+
+// handleFetch handles POST /raw/<campaign>/fetch, which directs the server to
+// fetch a file's content from a URL instead of it being uploaded by the
+// client. It requires a JSON object in the request body with the keys "file",
+// naming a file in the campaign whose metadata has already been written, and
+// "url", the URL to fetch. It writes a response containing the file's
+// metadata.
+func (ra *RawAPI) handleFetch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	camname, ok := vars["campaign"]
+	if !ok {
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
+		return
+	}
+
+	// fail if not authorized
+	if !ra.azr.IsAuthorized(w, r, "write_raw:"+camname) {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for fetch request must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var in fetchRequest
+	if err := json.Unmarshal(b, &in); err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if in.File == "" || in.URL == "" {
+		pto3.HTTPError(w, "fetch request requires file and url", http.StatusBadRequest)
+		return
+	}
+
+	cam, err := ra.rds.CampaignForName(camname)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
+		return
+	}
+
+	// make sure the file's metadata exists
+	if ft := cam.GetFiletype(in.File); ft == nil {
+		pto3.HandleErrorHTTP(w, fmt.Sprintf("getting filetype for %s", in.File), nil)
+		return
+	}
+
+	if err := cam.FetchFileData(in.File, false, in.URL); err != nil {
+		pto3.HandleErrorHTTP(w, "fetching data", err)
+		return
+	}
+	recordChange(ra.config, pto3.JournalStoreRaw, pto3.JournalCreate, "raw/"+camname+"/"+in.File+"/data")
+
+	ra.rawMetadataResponse(w, http.StatusCreated, cam, in.File)
+}
+
+// Default and maximum time to wait for changes in GET /raw/<campaign>/changes
+const (
+	defaultChangesTimeout = 30
+	maxChangesTimeout     = 120
+)
+
+type changeList struct {
+	Changes []pto3.CampaignChange `json:"changes"`
+	Next    int                   `json:"next"`
+	Reset   bool                  `json:"reset"`
+}
+
+// handleChanges handles GET /raw/<campaign>/changes, returning changes to a
+// campaign after the sequence number given in the since parameter. If there
+// are none, it waits until there are, or until the number of seconds given in
+// the timeout parameter elapse. It writes a JSON object to the response with
+// the keys "changes", an array of changes; "next", the sequence number to
+// use as since in the next request; and "reset", true if changes were missed
+// and the client should rescan the campaign.
+func (ra *RawAPI) handleChanges(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	camname, ok := vars["campaign"]
+	if !ok {
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
+		return
+	}
+
+	// fail if not authorized
+	if !ra.azr.IsAuthorized(w, r, "read_raw:"+camname) {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		pto3.HTTPError(w, "error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	var since int
+	if sincestr := r.Form.Get("since"); sincestr != "" {
+		var err error
+		if since, err = strconv.Atoi(sincestr); err != nil || since < 0 {
+			pto3.HTTPError(w, fmt.Sprintf("bad since %s", sincestr), http.StatusBadRequest)
+			return
+		}
+	}
+
+	timeout := defaultChangesTimeout
+	if timeoutstr := r.Form.Get("timeout"); timeoutstr != "" {
+		var err error
+		if timeout, err = strconv.Atoi(timeoutstr); err != nil || timeout < 0 || timeout > maxChangesTimeout {
+			pto3.HTTPError(w, fmt.Sprintf("bad timeout %s, must be between 0 and %d", timeoutstr, maxChangesTimeout), http.StatusBadRequest)
+			return
+		}
+	}
+
+	cam, err := ra.rds.CampaignForName(camname)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
+		return
+	}
+
+	var out changeList
+	out.Changes, out.Next, out.Reset = cam.ChangesSince(since, time.Duration(timeout)*time.Second)
+
+	b, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling changes", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ra.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+func (ra *RawAPI) manifestResponse(w http.ResponseWriter, status int, cam *pto3.Campaign) {
+	report, err := cam.VerifyManifest()
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "verifying manifest", err)
+		return
+	}
+
+	b, err := json.Marshal(report)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling manifest report", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	ra.additionalHeaders(w)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// handleGetManifest handles GET /raw/<campaign>/manifest, verifying the files
+// in a campaign against the campaign's manifest. It writes a JSON object to
+// the response giving the state of each file listed in the manifest.
+func (ra *RawAPI) handleGetManifest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	camname, ok := vars["campaign"]
+	if !ok {
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
+		return
+	}
+
+	// fail if not authorized
+	if !ra.azr.IsAuthorized(w, r, "read_raw:"+camname) {
+		return
+	}
+
+	cam, err := ra.rds.CampaignForName(camname)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
+		return
+	}
+
+	ra.manifestResponse(w, http.StatusOK, cam)
+}
+
+// handlePutManifest handles PUT /raw/<campaign>/manifest, overwriting the
+// manifest for a campaign. It requires a JSON object in the request body with
+// a single key, "files", mapping filenames to SHA-256 digests as hex strings.
+// Files subsequently uploaded to the campaign are checked against the
+// manifest.
+func (ra *RawAPI) handlePutManifest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	camname, ok := vars["campaign"]
+	if !ok {
+		pto3.HTTPError(w, "missing campaign", http.StatusBadRequest)
+		return
+	}
+
+	// fail if not authorized
+	if !ra.azr.IsAuthorized(w, r, "write_raw:"+camname) {
+		return
+	}
+
+	// fail if not JSON
+	if r.Header.Get("Content-Type") != "application/json" {
+		pto3.HTTPError(w, fmt.Sprintf("Content-type for manifest must be application/json; got %s instead",
+			r.Header.Get("Content-Type")), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var manifest pto3.CampaignManifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		pto3.HTTPError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cam, err := ra.rds.CampaignForName(camname)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "retrieving campaign", err)
+		return
+	}
+
+	if err := cam.PutManifest(&manifest); err != nil {
+		pto3.HandleErrorHTTP(w, "writing manifest", err)
+		return
+	}
+	recordChange(ra.config, pto3.JournalStoreRaw, pto3.JournalUpdate, "raw/"+camname+"/manifest")
+
+	// and reply with the current state of the campaign
+	ra.manifestResponse(w, http.StatusCreated, cam)
+}
+
 func (ra *RawAPI) additionalHeaders(w http.ResponseWriter) {
 	if ra.config.AllowOrigin != "" {
 		w.Header().Set("Access-Control-Allow-Origin", ra.config.AllowOrigin)
 	}
 }
 
-func (ra *RawAPI) addRoutes(r *mux.Router, l *log.Logger) {
-	r.HandleFunc("/raw", LogAccess(l, ra.handleListCampaigns)).Methods("GET")
-	r.HandleFunc("/raw/{campaign}", LogAccess(l, ra.handleGetCampaignMetadata)).Methods("GET")
-	r.HandleFunc("/raw/{campaign}", LogAccess(l, ra.handlePutCampaignMetadata)).Methods("PUT")
-	r.HandleFunc("/raw/{campaign}/{file}", LogAccess(l, ra.handleGetFileMetadata)).Methods("GET")
-	r.HandleFunc("/raw/{campaign}/{file}", LogAccess(l, ra.handlePutFileMetadata)).Methods("PUT")
-	r.HandleFunc("/raw/{campaign}/{file}", LogAccess(l, ra.handleDeleteFile)).Methods("DELETE")
-	r.HandleFunc("/raw/{campaign}/{file}/data", LogAccess(l, ra.handleFileDownload)).Methods("GET")
-	r.HandleFunc("/raw/{campaign}/{file}/data", LogAccess(l, ra.handleFileUpload)).Methods("PUT")
+func (ra *RawAPI) addRoutes(r *mux.Router) {
+	r.HandleFunc("/raw", ra.handleListCampaigns).Methods("GET")
+	r.HandleFunc("/raw/{campaign}", ra.handleGetCampaignMetadata).Methods("GET")
+	r.HandleFunc("/raw/{campaign}", ra.handlePutCampaignMetadata).Methods("PUT")
+	r.HandleFunc("/raw/{campaign}/manifest", ra.handleGetManifest).Methods("GET")
+	r.HandleFunc("/raw/{campaign}/manifest", ra.handlePutManifest).Methods("PUT")
+	r.HandleFunc("/raw/{campaign}/changes", ra.handleChanges).Methods("GET")
+	if ra.config.FeatureEnabled(pto3.FeatureFetch) {
+		r.HandleFunc("/raw/{campaign}/fetch", ra.ic.Idempotent(ra.handleFetch)).Methods("POST")
+	}
+	r.HandleFunc("/raw/{campaign}/{file}", ra.handleGetFileMetadata).Methods("GET")
+	r.HandleFunc("/raw/{campaign}/{file}", ra.handlePutFileMetadata).Methods("PUT")
+	r.HandleFunc("/raw/{campaign}/{file}", ra.handleDeleteFile).Methods("DELETE")
+	r.HandleFunc("/raw/{campaign}/{file}/data", ra.handleFileDownload).Methods("GET")
+	r.HandleFunc("/raw/{campaign}/{file}/data", ra.ic.Idempotent(ra.handleFileUpload)).Methods("PUT")
 }
 
 func NewRawAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) (*RawAPI, error) {
@@ -507,11 +843,12 @@ func NewRawAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) (*R
 	ra := new(RawAPI)
 	ra.config = config
 	ra.azr = azr
+	ra.ic = NewIdempotencyCache(config.IdempotencyKeyLifetimeDuration(), config.IdempotencyCacheSize)
 	if ra.rds, err = pto3.NewRawDataStore(config); err != nil {
 		return nil, err
 	}
 
-	ra.addRoutes(r, config.AccessLogger())
+	ra.addRoutes(r)
 
 	return ra, nil
 }
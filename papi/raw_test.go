@@ -3,11 +3,14 @@ package papi_test
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	pto3 "github.com/mami-project/pto3-go"
 )
@@ -76,7 +79,7 @@ func TestScanCampaigns(t *testing.T) {
 	}
 
 	// list campaigns to force a rescan
-	res := executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw", nil, "", GoodAPIKey, http.StatusOK)
+	res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/raw", nil, "", GoodAPIKey, http.StatusOK)
 	checkContentType(t, res)
 
 	var camlist testCampaignList
@@ -91,7 +94,52 @@ func TestScanCampaigns(t *testing.T) {
 }
 
 func TestDefaultAuth(t *testing.T) {
-	executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw", nil, "", "", http.StatusOK)
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/raw", nil, "", "", http.StatusOK)
+}
+
+func TestRawErrors(t *testing.T) {
+	decodeError := func(res *httptest.ResponseRecorder) pto3.ErrorResponse {
+		checkContentType(t, res)
+		var er pto3.ErrorResponse
+		if err := json.Unmarshal(res.Body.Bytes(), &er); err != nil {
+			t.Fatalf("bad error response %q: %v", res.Body.String(), err)
+		}
+		if er.Status != res.Code || er.Message == "" || er.RequestID == "" || er.RequestID != res.Header().Get(pto3.RequestIDHeader) {
+			t.Fatalf("bad error response %s", res.Body.Bytes())
+		}
+		return er
+	}
+
+	// missing campaigns and invalid metadata can be told apart by code
+	res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/raw/no_such_campaign", nil, "", "", http.StatusNotFound)
+	if er := decodeError(res); er.Code != "campaign_not_found" {
+		t.Fatalf("expected campaign_not_found, got %s", er.Code)
+	}
+
+	res = executeRequest(TestRouter, t, "PUT", TestAPIURL+"/raw/test", bytes.NewBufferString(`{"_time_start": "yesterday"}`),
+		"application/json", GoodAPIKey, http.StatusBadRequest)
+	if er := decodeError(res); er.Code != pto3.ErrorCodeInvalidMetadata {
+		t.Fatalf("expected %s, got %s", pto3.ErrorCodeInvalidMetadata, er.Code)
+	}
+
+	// errors raised by handlers have codes derived from their status
+	res = executeRequest(TestRouter, t, "PUT", TestAPIURL+"/raw/test", bytes.NewBufferString(`{}`),
+		"application/json", "", http.StatusForbidden)
+	if er := decodeError(res); er.Code != "forbidden" {
+		t.Fatalf("expected forbidden, got %s", er.Code)
+	}
+
+	// clients can supply their own request IDs
+	req, err := http.NewRequest("GET", TestAPIURL+"/raw/no_such_campaign", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(pto3.RequestIDHeader, "client-request-1")
+	res = httptest.NewRecorder()
+	TestHandler.ServeHTTP(res, req)
+	if er := decodeError(res); er.RequestID != "client-request-1" {
+		t.Fatalf("expected client request ID, got %s", er.RequestID)
+	}
 }
 
 func TestRawRoundtrip(t *testing.T) {
@@ -102,11 +150,11 @@ func TestRawRoundtrip(t *testing.T) {
 		Description: "a campaign filled with uninteresting test data",
 	}
 
-	res := executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/test", cmd_up, GoodAPIKey, http.StatusCreated)
+	res := executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/test", cmd_up, GoodAPIKey, http.StatusCreated)
 
 	// check campaign metadata download
 	var cmd_down testCampaignFileList
-	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/test", nil, "", GoodAPIKey, 200)
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/raw/test", nil, "", GoodAPIKey, 200)
 	err := json.Unmarshal(res.Body.Bytes(), &cmd_down)
 	if err != nil {
 		t.Fatal(err)
@@ -121,7 +169,7 @@ func TestRawRoundtrip(t *testing.T) {
 		TimeStart: "2010-01-01T00:00:00Z",
 		TimeEnd:   "2010-01-02T00:00:00Z",
 	}
-	res = executeWithJSON(TestRouter, t, "PUT", TestBaseURL+"/raw/test/file001.json", fmd_up, GoodAPIKey, http.StatusCreated)
+	res = executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/test/file001.json", fmd_up, GoodAPIKey, http.StatusCreated)
 
 	// find the data link
 	var fmd_refl testRawMetadata
@@ -134,7 +182,7 @@ func TestRawRoundtrip(t *testing.T) {
 	}
 
 	// now download metadata
-	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/test/file001.json", nil, "", GoodAPIKey, 200)
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/raw/test/file001.json", nil, "", GoodAPIKey, 200)
 
 	var fmd_down testRawMetadata
 	if err = json.Unmarshal(res.Body.Bytes(), &fmd_down); err != nil {
@@ -158,7 +206,7 @@ func TestRawRoundtrip(t *testing.T) {
 	res = executeWithJSON(TestRouter, t, "PUT", fmd_refl.DataURL, data, GoodAPIKey, http.StatusCreated)
 
 	// retrieve file metadata and check file size
-	res = executeRequest(TestRouter, t, "GET", TestBaseURL+"/raw/test/file001.json", nil, "", GoodAPIKey, http.StatusOK)
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/raw/test/file001.json", nil, "", GoodAPIKey, http.StatusOK)
 	checkContentType(t, res)
 
 	err = json.Unmarshal(res.Body.Bytes(), &fmd_down)
@@ -178,4 +226,132 @@ func TestRawRoundtrip(t *testing.T) {
 	if !bytes.Equal(bytesup, bytesdown) {
 		t.Fatalf("file download content mismatch: sent %s got %s", bytesup, bytesdown)
 	}
+
+	// and download part of it, as when following a source reference
+	req, err := http.NewRequest("GET", fmd_refl.DataURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "APIKEY "+GoodAPIKey)
+	req.Header.Set("Range", "bytes=8-")
+	res = httptest.NewRecorder()
+	TestHandler.ServeHTTP(res, req)
+
+	if res.Code != http.StatusPartialContent {
+		t.Fatalf("expected %d for range download, got %d", http.StatusPartialContent, res.Code)
+	} else if !bytes.Equal(bytesup[8:], res.Body.Bytes()) {
+		t.Fatalf("range download content mismatch: expected %s got %s", bytesup[8:], res.Body.Bytes())
+	}
+}
+
+func TestRawFetch(t *testing.T) {
+	// serve three seconds' worth of background bandwidth
+	bytesup, err := json.Marshal([]string{strings.Repeat("x", 3*TestBackgroundBandwidth)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bytesup)
+	}))
+	defer server.Close()
+
+	defer func(schemes []string, networks []string) {
+		TestConfig.FetchSchemes = schemes
+		TestConfig.OutboundNetworks = networks
+	}(TestConfig.FetchSchemes, TestConfig.OutboundNetworks)
+	TestConfig.FetchSchemes = []string{"http"}
+	TestConfig.OutboundNetworks = []string{"127.0.0.0/8"}
+
+	cmd_up := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign with data fetched from elsewhere",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/fetchtest", cmd_up, GoodAPIKey, http.StatusCreated)
+
+	res := executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/fetchtest/fetched.json",
+		testFileMetadata{TimeStart: "2010-01-01T00:00:00Z", TimeEnd: "2010-01-02T00:00:00Z"}, GoodAPIKey, http.StatusCreated)
+
+	var fmd_refl testRawMetadata
+	if err := json.Unmarshal(res.Body.Bytes(), &fmd_refl); err != nil {
+		t.Fatal(err)
+	}
+
+	// after a second's worth of data in a burst, the rest is paced
+	start := time.Now()
+	executeWithJSON(TestRouter, t, "POST", TestAPIURL+"/raw/fetchtest/fetch",
+		map[string]string{"file": "fetched.json", "url": server.URL + "/fetched.json"}, GoodAPIKey, http.StatusCreated)
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Fatalf("fetched %d bytes in %v, faster than the background bandwidth of %d bytes per second",
+			len(bytesup), elapsed, TestBackgroundBandwidth)
+	}
+
+	// and arrives intact
+	res = executeRequest(TestRouter, t, "GET", fmd_refl.DataURL, nil, "", GoodAPIKey, http.StatusOK)
+	if !bytes.Equal(bytesup, res.Body.Bytes()) {
+		t.Fatalf("fetched data mismatch: served %d bytes, got %d", len(bytesup), res.Body.Len())
+	}
+}
+
+func TestCampaignMetadataPinning(t *testing.T) {
+	// create a campaign with two files, one with its own owner
+	cmd_up := testCampaignMetadata{
+		FileType:    "test",
+		Owner:       "ptotest@mami-project.eu",
+		Description: "a campaign whose metadata changes",
+	}
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/pintest", cmd_up, GoodAPIKey, http.StatusCreated)
+
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/pintest/inherits.json",
+		testFileMetadata{TimeStart: "2010-01-01T00:00:00Z", TimeEnd: "2010-01-02T00:00:00Z"}, GoodAPIKey, http.StatusCreated)
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/pintest/owned.json",
+		map[string]string{"_owner": "someone@mami-project.eu", "_time_start": "2010-01-01T00:00:00Z", "_time_end": "2010-01-02T00:00:00Z"},
+		GoodAPIKey, http.StatusCreated)
+
+	// preview a change of owner: only the inheriting file is affected
+	cmd_up.Owner = "someone.else@mami-project.eu"
+	res := executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/pintest?preview=true", cmd_up, GoodAPIKey, http.StatusOK)
+
+	var preview struct {
+		Files map[string][]pto3.InheritedMetadataChange `json:"files"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &preview); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []pto3.InheritedMetadataChange{{Key: "_owner", Old: "ptotest@mami-project.eu", New: "someone.else@mami-project.eu"}}
+	if len(preview.Files) != 1 || fmt.Sprint(preview.Files["inherits.json"]) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected preview %v", preview.Files)
+	}
+
+	// previewing changes nothing
+	var fmd_down testRawMetadata
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/raw/pintest/inherits.json", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &fmd_down); err != nil {
+		t.Fatal(err)
+	} else if fmd_down.Owner != "ptotest@mami-project.eu" {
+		t.Fatalf("preview changed owner to %s", fmd_down.Owner)
+	}
+
+	// pin the current owner while changing the campaign
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/pintest?pin=true", cmd_up, GoodAPIKey, http.StatusCreated)
+
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/raw/pintest/inherits.json", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &fmd_down); err != nil {
+		t.Fatal(err)
+	} else if fmd_down.Owner != "ptotest@mami-project.eu" {
+		t.Fatalf("pinning didn't keep owner, got %s", fmd_down.Owner)
+	}
+
+	// without pinning, the change is inherited immediately
+	cmd_up.Description = "a campaign whose metadata changes again"
+	executeWithJSON(TestRouter, t, "PUT", TestAPIURL+"/raw/pintest", cmd_up, GoodAPIKey, http.StatusCreated)
+
+	res = executeRequest(TestRouter, t, "GET", TestAPIURL+"/raw/pintest/inherits.json", nil, "", GoodAPIKey, http.StatusOK)
+	if err := json.Unmarshal(res.Body.Bytes(), &fmd_down); err != nil {
+		t.Fatal(err)
+	} else if fmd_down.Description != cmd_up.Description {
+		t.Fatalf("campaign metadata change not inherited, got description %s", fmd_down.Description)
+	}
 }
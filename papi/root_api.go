@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -64,10 +63,16 @@ func (ra *RootAPI) handleRootLinks(w http.ResponseWriter, r *http.Request) {
 		links["obs"], _ = ra.config.LinkTo("obs")
 	}
 
-	if ra.config.QueryCacheRoot != "" {
+	if ra.config.QueryCacheRoot != "" && ra.config.FeatureEnabled(pto3.FeatureQueryCache) {
 		links["query"], _ = ra.config.LinkTo("query")
 	}
 
+	if ra.config.ChangeJournalPath != "" && ra.config.FeatureEnabled(pto3.FeatureChangeJournal) {
+		links["changes"], _ = ra.config.LinkTo("changes")
+	}
+
+	links["stats"], _ = ra.config.LinkTo("stats")
+
 	linksj, err := json.Marshal(links)
 
 	if err != nil {
@@ -117,7 +122,7 @@ func (ra *RootAPI) handleStaticFile(w http.ResponseWriter, r *http.Request) {
 	file, err := os.Open(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
-			http.Error(w, "URL not found", http.StatusNotFound)
+			pto3.HTTPError(w, "URL not found", http.StatusNotFound)
 		} else {
 			pto3.HandleErrorHTTP(w, "serving static content", err)
 		}
@@ -130,21 +135,21 @@ func (ra *RootAPI) handleStaticFile(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, file)
 }
 
-func (ra *RootAPI) addRoutes(r *mux.Router, l *log.Logger) {
+func (ra *RootAPI) addRoutes(r *mux.Router) {
 	if ra.config.RootFile == "" {
-		r.HandleFunc("/", LogAccess(l, ra.handleRootLinks)).Methods("GET")
+		r.HandleFunc("/", ra.handleRootLinks).Methods("GET")
 	} else {
-		r.HandleFunc("/", LogAccess(l, ra.handleRootFile)).Methods("GET")
+		r.HandleFunc("/", ra.handleRootFile).Methods("GET")
 	}
 
 	if ra.config.StaticRoot != "" {
-		r.PathPrefix("/static/").Methods("GET").HandlerFunc(LogAccess(l, ra.handleStaticFile))
+		r.PathPrefix("/static/").Methods("GET").HandlerFunc(ra.handleStaticFile)
 	}
 }
 
 func NewRootAPI(config *pto3.PTOConfiguration, azr Authorizer, r *mux.Router) *RootAPI {
 	ra := new(RootAPI)
 	ra.config = config
-	ra.addRoutes(r, config.AccessLogger())
+	ra.addRoutes(r)
 	return ra
 }
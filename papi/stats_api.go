@@ -0,0 +1,122 @@
+package papi
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-pg/pg"
+	"github.com/gorilla/mux"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// StatsAPI summarizes the contents of the whole observatory, for use on
+// status pages.
+type StatsAPI struct {
+	config *pto3.PTOConfiguration
+	azr    Authorizer
+	rds    *pto3.RawDataStore
+	db     *pg.DB
+}
+
+func (sa *StatsAPI) additionalHeaders(w http.ResponseWriter) {
+	if sa.config.AllowOrigin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", sa.config.AllowOrigin)
+	}
+}
+
+func (sa *StatsAPI) handleStats(w http.ResponseWriter, r *http.Request) {
+	// fail if not authorized
+	if !sa.azr.IsAuthorized(w, r, "read_stats") {
+		return
+	}
+
+	stats := pto3.NewObservatoryStats()
+
+	if sa.rds != nil {
+		if err := stats.AddRawDataStats(sa.rds); err != nil {
+			pto3.HandleErrorHTTP(w, "summarizing raw data", err)
+			return
+		}
+	}
+
+	if sa.db != nil {
+		if err := stats.AddObservationStats(sa.db); err != nil {
+			pto3.HandleErrorHTTP(w, "summarizing observations", err)
+			return
+		}
+	}
+
+	b, err := json.Marshal(stats)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling observatory statistics", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	sa.additionalHeaders(w)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// handleHealth handles GET /health, for load balancers and monitoring. It
+// needs no authorization. It checks the connections to the observation
+// database, if the observatory has one, and writes a JSON object to the
+// response with the overall status under "status" and the health of the
+// observation database and its connection pools under "obs". The response
+// has status 503 Service Unavailable while requests needing the database
+// fail fast.
+func (sa *StatsAPI) handleHealth(w http.ResponseWriter, r *http.Request) {
+	out := struct {
+		Status string               `json:"status"`
+		Obs    *pto3.DBHealthStatus `json:"obs,omitempty"`
+	}{Status: "ok"}
+
+	status := http.StatusOK
+	if sa.db != nil {
+		// the outcome is recorded in the status
+		health := sa.config.ObsDatabaseHealth()
+		health.Check()
+
+		out.Obs = health.Status()
+		out.Status = out.Obs.Status
+		if out.Status == "unavailable" {
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	b, err := json.Marshal(&out)
+	if err != nil {
+		pto3.HandleErrorHTTP(w, "marshaling health status", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	sa.additionalHeaders(w)
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func (sa *StatsAPI) addRoutes(r *mux.Router) {
+	r.HandleFunc("/stats", sa.handleStats).Methods("GET")
+	r.HandleFunc("/health", sa.handleHealth).Methods("GET")
+}
+
+// NewStatsAPI creates an API summarizing the raw data store of the given raw
+// data API and the database of the given observation API, either of which
+// may be nil if the observatory does not serve it.
+func NewStatsAPI(config *pto3.PTOConfiguration, azr Authorizer, ra *RawAPI, oa *ObsAPI, r *mux.Router) *StatsAPI {
+	sa := new(StatsAPI)
+	sa.config = config
+	sa.azr = azr
+	if ra != nil {
+		sa.rds = ra.rds
+	}
+	if oa != nil {
+		sa.db = oa.db
+	}
+
+	sa.addRoutes(r)
+
+	return sa
+}
@@ -0,0 +1,94 @@
+package papi_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func TestObservatoryStats(t *testing.T) {
+	getStats := func() *pto3.ObservatoryStats {
+		res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/stats", nil, "", GoodAPIKey, http.StatusOK)
+
+		var stats pto3.ObservatoryStats
+		if err := json.Unmarshal(res.Body.Bytes(), &stats); err != nil {
+			t.Fatal(err)
+		}
+
+		// growth is sorted by month and never exceeds the totals
+		var rawFiles, sets, observations int
+		for i, g := range stats.Growth {
+			if i > 0 && stats.Growth[i-1].Month >= g.Month {
+				t.Fatalf("growth not sorted by month: %s before %s", stats.Growth[i-1].Month, g.Month)
+			}
+			rawFiles += g.RawFiles
+			sets += g.ObservationSets
+			observations += g.Observations
+		}
+		if rawFiles > stats.RawFiles || sets > stats.ObservationSets || observations > stats.Observations {
+			t.Fatalf("growth exceeds totals in %+v", stats)
+		}
+
+		return &stats
+	}
+
+	growthThisMonth := func(stats *pto3.ObservatoryStats) pto3.ObservatoryGrowth {
+		month := time.Now().UTC().Format("2006-01")
+		for _, g := range stats.Growth {
+			if g.Month == month {
+				return *g
+			}
+		}
+		return pto3.ObservatoryGrowth{Month: month}
+	}
+
+	before := getStats()
+
+	file := `{"_analyzer": "https://ptotest.mami-project.eu/analysis/passthrough", "_sources": ["https://ptotest.mami-project.eu/raw/test001.json"], "_conditions": ["pto.test.succeeded", "pto.test.failed"], "description": "An observation set to exercise observatory statistics"}
+	["e1337", "2017-10-01T10:06:00Z", "2017-10-01T10:06:01Z", "10.0.0.1 * 10.0.0.2", "pto.test.succeeded"]
+	["e1337", "2017-10-01T10:06:02Z", "2017-10-01T10:06:09Z", "10.0.0.1 * 10.0.0.2", "pto.test.failed"]`
+
+	executeRequest(TestRouter, t, "POST", TestAPIURL+"/obs/create", bytes.NewBufferString(file),
+		"application/vnd.mami.ndjson", GoodAPIKey, http.StatusCreated)
+
+	after := getStats()
+
+	if after.ObservationSets != before.ObservationSets+1 || after.Observations != before.Observations+2 {
+		t.Fatalf("expected one more set and two more observations, got %+v then %+v", before, after)
+	}
+	if after.Conditions < 2 || after.Paths < 1 {
+		t.Fatalf("expected at least two conditions and one path, got %+v", after)
+	}
+
+	gb, ga := growthThisMonth(before), growthThisMonth(after)
+	if ga.ObservationSets != gb.ObservationSets+1 || ga.Observations != gb.Observations+2 {
+		t.Fatalf("expected growth of one set and two observations in %s, got %+v then %+v", ga.Month, gb, ga)
+	}
+
+	// statistics need their own permission
+	executeRequest(TestRouter, t, "GET", TestAPIURL+"/stats", nil, "", OtherAPIKey, http.StatusForbidden)
+}
+
+func TestHealth(t *testing.T) {
+	// no API key is needed
+	res := executeRequest(TestRouter, t, "GET", TestAPIURL+"/health", nil, "", "", http.StatusOK)
+
+	var health struct {
+		Status string               `json:"status"`
+		Obs    *pto3.DBHealthStatus `json:"obs"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &health); err != nil {
+		t.Fatal(err)
+	}
+
+	if health.Status != "ok" || health.Obs == nil || health.Obs.Status != "ok" {
+		t.Fatalf("unexpected health %s", res.Body.String())
+	}
+	if health.Obs.Pool.Connections == 0 {
+		t.Fatalf("expected open connections to the observation database, got %+v", health.Obs.Pool)
+	}
+}
@@ -0,0 +1,90 @@
+package papi
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+// APIVersionHeader is the response header giving the version of the API a
+// request was served by.
+const APIVersionHeader = "PTO-API-Version"
+
+// APIVersionsHeader is the response header listing the versions of the API
+// served, so that clients can find out about newer versions.
+const APIVersionsHeader = "PTO-API-Versions"
+
+// apiVersionKey is the request context key of the version of the API a
+// request was made to.
+type apiVersionKey struct{}
+
+// APIVersionMiddleware returns middleware which serves each version of the
+// API in pto3.APIVersions under its prefix, e.g. /v1/obs. The prefix is
+// stripped before the request is routed, so that routes, deprecations, and
+// other middleware see paths relative to the root of the API, and the version
+// is kept for handlers to find with APIVersionForRequest. Requests to
+// unversioned paths are redirected to the same path in
+// pto3.LegacyAPIVersion, with 308 Permanent Redirect so that clients repeat
+// the method and body; requests to versions not served are not found. Like
+// AccessLogMiddleware, it wraps the whole router.
+func APIVersionMiddleware(config *pto3.PTOConfiguration) func(http.Handler) http.Handler {
+	versions := make([]string, len(pto3.APIVersions))
+	for i, version := range pto3.APIVersions {
+		versions[i] = strconv.Itoa(version)
+	}
+	served := strings.Join(versions, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(APIVersionsHeader, served)
+
+			version, path, ok := pto3.SplitAPIVersion(r.URL.Path)
+			if !ok {
+				link, err := config.LinkToVersion(pto3.LegacyAPIVersion, r.URL.Path)
+				if err != nil {
+					pto3.HandleErrorHTTP(w, "redirecting to versioned path", err)
+					return
+				}
+				if r.URL.RawQuery != "" {
+					link += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, link, http.StatusPermanentRedirect)
+				return
+			}
+
+			if !pto3.APIVersionSupported(version) {
+				pto3.HandleErrorHTTP(w, "negotiating API version",
+					pto3.PTOErrorf("API version %d is not served; versions served are %s", version, served).
+						StatusIs(http.StatusNotFound).CodeIs(pto3.ErrorCodeUnsupportedVersion))
+				return
+			}
+			w.Header().Set(APIVersionHeader, strconv.Itoa(version))
+
+			// route the rest of the path, as http.StripPrefix does
+			vr := r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version))
+			vr.URL = new(url.URL)
+			*vr.URL = *r.URL
+			vr.URL.Path = path
+			if r.URL.RawPath != "" {
+				_, vr.URL.RawPath, _ = pto3.SplitAPIVersion(r.URL.RawPath)
+			}
+
+			next.ServeHTTP(w, vr)
+		})
+	}
+}
+
+// APIVersionForRequest returns the version of the API a request was made to,
+// so that handlers can serve each version as it was defined. Requests which
+// did not pass through APIVersionMiddleware are taken to be made to
+// pto3.LegacyAPIVersion.
+func APIVersionForRequest(r *http.Request) int {
+	if version, ok := r.Context().Value(apiVersionKey{}).(int); ok {
+		return version
+	}
+	return pto3.LegacyAPIVersion
+}
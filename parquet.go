@@ -0,0 +1,284 @@
+package pto3
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Parquet files store observations by column, compactly and with a schema,
+// for loading into data warehouses and analytical tools that read Parquet
+// but not Arrow streams. A file is a sequence of row groups, each holding a
+// column chunk per column, followed by a footer describing the schema and
+// the location of every column chunk; as the footer comes last, a file can
+// be written as a stream, one row group at a time. Pages and the footer are
+// described by Thrift structures, as given in parquet.thrift in the Parquet
+// format specification.
+
+// Identifiers from parquet.thrift
+const (
+	parquetTypeInt64           = 2
+	parquetTypeByteArray       = 6
+	parquetRequired            = 0
+	parquetConvertedUTF8       = 0
+	parquetConvertedTimeMillis = 9
+	parquetEncodingPlain       = 0
+	parquetEncodingRLE         = 3
+	parquetUncompressed        = 0
+	parquetDataPage            = 0
+)
+
+// parquetMagic begins and ends every Parquet file.
+const parquetMagic = "PAR1"
+
+// parquetColumn holds the values of a column in the row group being built,
+// PLAIN encoded: times as milliseconds since the epoch, and other fields as
+// length-prefixed UTF-8 strings.
+type parquetColumn struct {
+	field int
+	data  []byte
+}
+
+func (col *parquetColumn) isTime() bool {
+	name := ObservationFields[col.field]
+	return name == "time_start" || name == "time_end"
+}
+
+// parquetChunk records where a column chunk was written, for the footer.
+type parquetChunk struct {
+	offset int64
+	size   int64
+}
+
+// parquetRowGroup records a row group written, for the footer.
+type parquetRowGroup struct {
+	rows   int
+	chunks []parquetChunk
+}
+
+// parquetEncoder writes observations as a Parquet file, with columns set_id,
+// path, condition, and value as strings and time_start and time_end as
+// timestamps in milliseconds, UTC. Strings are formatted as in CSV. Columns
+// are PLAIN encoded and uncompressed, as the repetition in paths and
+// conditions compresses well with HTTP compression.
+type parquetEncoder struct {
+	out       io.Writer
+	offset    int64
+	columns   []*parquetColumn
+	rows      int
+	rowGroups []parquetRowGroup
+}
+
+// NewParquetEncoder returns an encoder writing the given fields of
+// observations as a Parquet file.
+func NewParquetEncoder(out io.Writer, fields []int) ObservationEncoder {
+	if fields == nil {
+		fields = make([]int, len(ObservationFields))
+		for i := range fields {
+			fields[i] = i
+		}
+	}
+
+	enc := &parquetEncoder{out: out, columns: make([]*parquetColumn, len(fields))}
+	for i, f := range fields {
+		enc.columns[i] = &parquetColumn{field: f}
+	}
+	return enc
+}
+
+func (enc *parquetEncoder) write(b []byte) error {
+	n, err := enc.out.Write(b)
+	enc.offset += int64(n)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// writeRowGroup writes the rows encoded so far as a row group, with one data
+// page per column, if there are any, and starts a new row group.
+func (enc *parquetEncoder) writeRowGroup() error {
+	if enc.rows == 0 {
+		return nil
+	}
+
+	if enc.offset == 0 {
+		if err := enc.write([]byte(parquetMagic)); err != nil {
+			return err
+		}
+	}
+
+	rowGroup := parquetRowGroup{rows: enc.rows, chunks: make([]parquetChunk, len(enc.columns))}
+	for i, col := range enc.columns {
+		// required columns have no repetition or definition levels, so
+		// pages hold only values
+		var w thriftWriter
+		w.writeI32(1, parquetDataPage)
+		w.writeI32(2, int32(len(col.data)))
+		w.writeI32(3, int32(len(col.data)))
+		w.beginStruct(5)
+		w.writeI32(1, int32(enc.rows))
+		w.writeI32(2, parquetEncodingPlain)
+		w.writeI32(3, parquetEncodingRLE)
+		w.writeI32(4, parquetEncodingRLE)
+		w.endStruct()
+		header := w.bytes()
+
+		rowGroup.chunks[i] = parquetChunk{offset: enc.offset, size: int64(len(header) + len(col.data))}
+		if err := enc.write(header); err != nil {
+			return err
+		}
+		if err := enc.write(col.data); err != nil {
+			return err
+		}
+		col.data = col.data[:0]
+	}
+
+	enc.rowGroups = append(enc.rowGroups, rowGroup)
+	enc.rows = 0
+	return nil
+}
+
+// writeFooter writes the file metadata, giving the schema and the location
+// of every column chunk, and the closing magic number.
+func (enc *parquetEncoder) writeFooter() error {
+	if enc.offset == 0 {
+		if err := enc.write([]byte(parquetMagic)); err != nil {
+			return err
+		}
+	}
+
+	var w thriftWriter
+	totalRows := 0
+	for _, rowGroup := range enc.rowGroups {
+		totalRows += rowGroup.rows
+	}
+
+	w.writeI32(1, 1)
+
+	// the schema is a root with a child per column
+	w.beginList(2, thriftStruct, len(enc.columns)+1)
+	w.beginStruct(0)
+	w.writeString(4, "schema")
+	w.writeI32(5, int32(len(enc.columns)))
+	w.endStruct()
+	for _, col := range enc.columns {
+		w.beginStruct(0)
+		if col.isTime() {
+			w.writeI32(1, parquetTypeInt64)
+		} else {
+			w.writeI32(1, parquetTypeByteArray)
+		}
+		w.writeI32(3, parquetRequired)
+		w.writeString(4, ObservationFields[col.field])
+		if col.isTime() {
+			w.writeI32(6, parquetConvertedTimeMillis)
+			w.beginStruct(10)
+			w.beginStruct(8)
+			w.writeBool(1, true)
+			w.beginStruct(2)
+			w.beginStruct(1)
+			w.endStruct()
+			w.endStruct()
+			w.endStruct()
+			w.endStruct()
+		} else {
+			w.writeI32(6, parquetConvertedUTF8)
+			w.beginStruct(10)
+			w.beginStruct(1)
+			w.endStruct()
+			w.endStruct()
+		}
+		w.endStruct()
+	}
+
+	w.writeI64(3, int64(totalRows))
+
+	w.beginList(4, thriftStruct, len(enc.rowGroups))
+	for _, rowGroup := range enc.rowGroups {
+		var totalSize int64
+		for _, chunk := range rowGroup.chunks {
+			totalSize += chunk.size
+		}
+
+		w.beginStruct(0)
+		w.beginList(1, thriftStruct, len(enc.columns))
+		for i, col := range enc.columns {
+			chunk := rowGroup.chunks[i]
+			w.beginStruct(0)
+			w.writeI64(2, chunk.offset)
+			w.beginStruct(3)
+			if col.isTime() {
+				w.writeI32(1, parquetTypeInt64)
+			} else {
+				w.writeI32(1, parquetTypeByteArray)
+			}
+			w.beginList(2, thriftI32, 2)
+			w.elemI32(parquetEncodingPlain)
+			w.elemI32(parquetEncodingRLE)
+			w.beginList(3, thriftBinary, 1)
+			w.elemString(ObservationFields[col.field])
+			w.writeI32(4, parquetUncompressed)
+			w.writeI64(5, int64(rowGroup.rows))
+			w.writeI64(6, chunk.size)
+			w.writeI64(7, chunk.size)
+			w.writeI64(9, chunk.offset)
+			w.endStruct()
+			w.endStruct()
+		}
+		w.writeI64(2, totalSize)
+		w.writeI64(3, int64(rowGroup.rows))
+		w.endStruct()
+	}
+
+	footer := w.bytes()
+	var trailer [4]byte
+	binary.LittleEndian.PutUint32(trailer[:], uint32(len(footer)))
+
+	for _, b := range [][]byte{footer, trailer[:], []byte(parquetMagic)} {
+		if err := enc.write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (enc *parquetEncoder) Encode(obs *Observation) error {
+	values := observationFieldValues(obs)
+	batchBytes := 0
+	for _, col := range enc.columns {
+		switch ObservationFields[col.field] {
+		case "time_start":
+			col.data = appendParquetInt64(col.data, obs.TimeStart.UnixNano()/1e6)
+		case "time_end":
+			col.data = appendParquetInt64(col.data, obs.TimeEnd.UnixNano()/1e6)
+		default:
+			var length [4]byte
+			binary.LittleEndian.PutUint32(length[:], uint32(len(values[col.field])))
+			col.data = append(col.data, length[:]...)
+			col.data = append(col.data, values[col.field]...)
+		}
+		if len(col.data) > batchBytes {
+			batchBytes = len(col.data)
+		}
+	}
+	enc.rows++
+
+	// row groups follow record batches in size, so pages fit in 32 bits
+	if enc.rows >= arrowBatchRows || batchBytes >= arrowBatchBytes {
+		return enc.writeRowGroup()
+	}
+	return nil
+}
+
+func appendParquetInt64(b []byte, v int64) []byte {
+	var value [8]byte
+	binary.LittleEndian.PutUint64(value[:], uint64(v))
+	return append(b, value[:]...)
+}
+
+func (enc *parquetEncoder) Close() error {
+	if err := enc.writeRowGroup(); err != nil {
+		return err
+	}
+	return enc.writeFooter()
+}
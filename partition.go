@@ -0,0 +1,275 @@
+package pto3
+
+import (
+	"fmt"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// PartitioningTable is the name of the table recording how the observations
+// table is partitioned. It is empty if the table is not partitioned.
+const PartitioningTable = "pto_observation_partitioning"
+
+// Methods of partitioning the observations table by set ID; see
+// ObservationPartitioning.
+const (
+	// Partition by ranges of consecutive set IDs
+	PartitionByRange = "range"
+	// Partition by hash of set ID into a fixed number of partitions
+	PartitionByHash = "hash"
+)
+
+// ObservationPartitioning configures declarative partitioning of the
+// observations table by set ID, for deployments with so many observations
+// that scanning or deleting from a single table becomes too slow. It is
+// applied by ptodb init and ptodb migrate, and recorded in the database, so
+// that other commands and the server need not be configured with it.
+// Partitioning requires PostgreSQL 11 or later.
+type ObservationPartitioning struct {
+	// Partitioning method, PartitionByRange or PartitionByHash
+	Method string
+
+	// For range partitioning, the number of consecutive set IDs in each
+	// partition, which is created when the first of its sets is; with 1,
+	// each set has a partition of its own, dropped when the set is deleted.
+	// For hash partitioning, the number of partitions, all of which are
+	// created up front.
+	Size int
+}
+
+// Validate returns an error if this partitioning has an unknown method or
+// size less than 1.
+func (p *ObservationPartitioning) Validate() error {
+	if p.Method != PartitionByRange && p.Method != PartitionByHash {
+		return PTOErrorf("unknown observation partitioning method %s", p.Method)
+	}
+	if p.Size < 1 {
+		return PTOErrorf("observation partitioning size %d must be at least 1", p.Size)
+	}
+	return nil
+}
+
+func (p *ObservationPartitioning) String() string {
+	return fmt.Sprintf("%s partitioning of size %d", p.Method, p.Size)
+}
+
+// CurrentObservationPartitioning returns the partitioning of the observations
+// table in the given database, or nil if it is not partitioned.
+func CurrentObservationPartitioning(db orm.DB) (*ObservationPartitioning, error) {
+	var p ObservationPartitioning
+	if _, err := db.QueryOne(pg.Scan(&p.Method, &p.Size), "SELECT method, size FROM "+PartitioningTable+" LIMIT 1"); err == pg.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return &p, nil
+}
+
+// partitioningMinServerVersion is the earliest PostgreSQL server version, as
+// given by server_version_num, supporting the partitioning used here: hash
+// partitioning, and primary and foreign keys on partitioned tables.
+const partitioningMinServerVersion = 110000
+
+// CheckPartitioningSupported returns an error if the server behind the given
+// database is too old to partition the observations table.
+func CheckPartitioningSupported(db orm.DB) error {
+	var version string
+	var versionNum int
+	if _, err := db.QueryOne(pg.Scan(&version, &versionNum),
+		"SELECT current_setting('server_version'), current_setting('server_version_num')::integer"); err != nil {
+		return PTOWrapError(err)
+	}
+	if versionNum < partitioningMinServerVersion {
+		return PTOErrorf("observation partitioning requires PostgreSQL 11 or later, but the server is PostgreSQL %s", version)
+	}
+	return nil
+}
+
+// createPartitioningTable creates the table recording the partitioning of the
+// observations table, if it does not already exist.
+func createPartitioningTable(db orm.DB) error {
+	if _, err := db.Exec("CREATE TABLE IF NOT EXISTS " + PartitioningTable + ` (
+		method text NOT NULL,
+		size integer NOT NULL)`); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// rangePartition returns the name and the bounds of the range partition
+// holding the observations of the set with the given ID.
+func (p *ObservationPartitioning) rangePartition(setid int) (string, int, int) {
+	lo := setid - setid%p.Size
+	return fmt.Sprintf("observations_r%x", lo), lo, lo + p.Size
+}
+
+// PartitionObservations partitions the observations table of the given
+// database as configured, moving any existing observations into the new
+// partitions. It does nothing if the table is already partitioned that way,
+// and refuses to repartition a table partitioned differently. The conversion
+// runs in a single transaction, and rewrites every observation, so it may
+// take a long time on a large database.
+func PartitionObservations(db *pg.DB, p *ObservationPartitioning) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	if err := CheckPartitioningSupported(db); err != nil {
+		return err
+	}
+
+	return db.RunInTransaction(func(t *pg.Tx) error {
+		if err := createPartitioningTable(t); err != nil {
+			return err
+		}
+
+		if _, err := t.Exec("LOCK TABLE " + PartitioningTable + " IN EXCLUSIVE MODE"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		current, err := CurrentObservationPartitioning(t)
+		if err != nil {
+			return err
+		}
+		if current != nil {
+			if *current == *p {
+				return nil
+			}
+			return PTOErrorf("observations already have %s, and cannot be repartitioned to %s", current, p)
+		}
+
+		// replace the observations table with a partitioned one
+		if _, err := t.Exec("ALTER TABLE observations RENAME TO observations_unpartitioned"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		strategy := "RANGE"
+		if p.Method == PartitionByHash {
+			strategy = "HASH"
+		}
+		if _, err := t.Exec("CREATE TABLE observations (LIKE observations_unpartitioned INCLUDING DEFAULTS) PARTITION BY " + strategy + " (set_id)"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// keep the ID sequence when the old table is dropped
+		var seq string
+		if _, err := t.QueryOne(pg.Scan(&seq), "SELECT coalesce(pg_get_serial_sequence('observations_unpartitioned', 'id'), '')"); err != nil {
+			return PTOWrapError(err)
+		}
+		if seq != "" {
+			if _, err := t.Exec("ALTER SEQUENCE " + seq + " OWNED BY observations.id"); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+
+		if _, err := t.Exec("INSERT INTO "+PartitioningTable+" (method, size) VALUES (?, ?)", p.Method, p.Size); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// create partitions for all the sets there are
+		if p.Method == PartitionByHash {
+			for i := 0; i < p.Size; i++ {
+				if _, err := t.Exec(fmt.Sprintf("CREATE TABLE observations_h%d PARTITION OF observations FOR VALUES WITH (MODULUS %d, REMAINDER %d)",
+					i, p.Size, i)); err != nil {
+					return PTOWrapError(err)
+				}
+			}
+		} else {
+			setIds, err := AllObservationSetIDs(t)
+			if err != nil {
+				return err
+			}
+			for _, setid := range setIds {
+				if err := ensureObservationPartition(t, setid); err != nil {
+					return err
+				}
+			}
+		}
+
+		// move the observations over
+		if _, err := t.Exec("INSERT INTO observations SELECT * FROM observations_unpartitioned"); err != nil {
+			return PTOWrapError(err)
+		}
+		if _, err := t.Exec("DROP TABLE observations_unpartitioned"); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// restore constraints; unique keys must include the partition key
+		if _, err := t.Exec(`ALTER TABLE observations
+			ADD PRIMARY KEY (set_id, id),
+			ADD FOREIGN KEY (set_id) REFERENCES observation_sets (id),
+			ADD FOREIGN KEY (condition_id) REFERENCES conditions (id),
+			ADD FOREIGN KEY (path_id) REFERENCES paths (id)`); err != nil {
+			return PTOWrapError(err)
+		}
+
+		// and indexes, which PostgreSQL creates on each partition
+		return CreateIndexes(t)
+	})
+}
+
+// ensureObservationPartition creates the partition for the observations of
+// the set with the given ID, if the observations table is partitioned by
+// range and the partition does not yet exist.
+func ensureObservationPartition(db orm.DB, setid int) error {
+	p, err := CurrentObservationPartitioning(db)
+	if err != nil {
+		return err
+	}
+	if p == nil || p.Method != PartitionByRange {
+		return nil
+	}
+
+	// CREATE TABLE IF NOT EXISTS fails rather than doing nothing when another
+	// transaction creates the same table concurrently, so serialize creation
+	// of each partition with a lock held until the end of the transaction
+	name, lo, hi := p.rangePartition(setid)
+	create := func(t orm.DB) error {
+		if _, err := t.Exec("SELECT pg_advisory_xact_lock(hashtext(?))", name); err != nil {
+			return PTOWrapError(err)
+		}
+		if _, err := t.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF observations FOR VALUES FROM (%d) TO (%d)",
+			name, lo, hi)); err != nil {
+			return PTOWrapError(err)
+		}
+		return nil
+	}
+
+	if pgdb, ok := db.(*pg.DB); ok {
+		return pgdb.RunInTransaction(func(t *pg.Tx) error {
+			return create(t)
+		})
+	}
+	return create(db)
+}
+
+// dropObservationPartition drops the partition holding the observations of
+// the set with the given ID instead of deleting them row by row, if the
+// observations table is partitioned by range and no other set shares the
+// partition. It returns true if it dropped the partition.
+func dropObservationPartition(db orm.DB, setid int) (bool, error) {
+	p, err := CurrentObservationPartitioning(db)
+	if err != nil {
+		return false, err
+	}
+	if p == nil || p.Method != PartitionByRange {
+		return false, nil
+	}
+
+	name, lo, hi := p.rangePartition(setid)
+
+	var others int
+	if _, err := db.QueryOne(pg.Scan(&others),
+		"SELECT count(*) FROM observation_sets WHERE id >= ? AND id < ? AND id <> ?", lo, hi, setid); err != nil {
+		return false, PTOWrapError(err)
+	}
+	if others > 0 {
+		return false, nil
+	}
+
+	if _, err := db.Exec("DROP TABLE IF EXISTS " + name); err != nil {
+		return false, PTOWrapError(err)
+	}
+	return true, nil
+}
@@ -0,0 +1,138 @@
+package pto3_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-pg/pg"
+	pto3 "github.com/mami-project/pto3-go"
+)
+
+func TestPartitionObservations(t *testing.T) {
+	in := `{"_analyzer":"https://localhost:8383/query_test_analyzer.json","_sources":[],"_conditions":["pto.test.color.red"],"this_is_the_partition_test_obset":"yes"}
+["", "2016-06-10T12:00:00Z", "2016-06-10T12:00:01Z", "10.33.44.55 * 10.15.16.199", "pto.test.color.red"]
+["", "2016-06-10T12:00:02Z", "2016-06-10T12:00:03Z", "10.33.44.56 * 10.15.16.199", "pto.test.color.red"]
+`
+
+	if err := pto3.CheckPartitioningSupported(TestDB); err != nil {
+		t.Skip(err)
+	}
+
+	// partitioning can't be undone, so partition tables in a scratch schema
+	// rather than the tables shared with other tests
+	const schema = "pto_partition_test"
+	if _, err := TestDB.Exec("CREATE SCHEMA IF NOT EXISTS " + schema); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if _, err := TestDB.Exec("DROP SCHEMA " + schema + " CASCADE"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	opts := TestConfig.ObsDatabase.Options
+	opts.OnConnect = func(conn *pg.DB) error {
+		_, err := conn.Exec("SET search_path TO " + schema)
+		return err
+	}
+	db := pg.Connect(&opts)
+	defer db.Close()
+
+	if err := pto3.CreateTables(db); err != nil {
+		t.Fatal(err)
+	}
+
+	cidCache, err := pto3.LoadConditionCache(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loadSet := func() *pto3.ObservationSet {
+		obsr := pto3.NewObservationReader(strings.NewReader(in))
+		set, err := obsr.ReadMetadata()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := set.Insert(db, true); err != nil {
+			t.Fatal(err)
+		}
+		if err := set.CopyDataFromReader(db, obsr, cidCache, make(pto3.PathCache)); err != nil {
+			t.Fatal(err)
+		}
+		return set
+	}
+
+	countObservations := func() int {
+		var count int
+		if _, err := db.QueryOne(pg.Scan(&count), "SELECT count(*) FROM observations"); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	partitionExists := func(name string) bool {
+		var exists bool
+		if _, err := db.QueryOne(pg.Scan(&exists), "SELECT to_regclass(?) IS NOT NULL", name); err != nil {
+			t.Fatal(err)
+		}
+		return exists
+	}
+
+	// existing observations survive partitioning
+	before := loadSet()
+	count := countObservations()
+
+	p := pto3.ObservationPartitioning{Method: pto3.PartitionByRange, Size: 1}
+	if err := pto3.PartitionObservations(db, &p); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := countObservations(); after != count {
+		t.Fatalf("expected %d observations after partitioning, got %d", count, after)
+	}
+	if current, err := pto3.CurrentObservationPartitioning(db); err != nil {
+		t.Fatal(err)
+	} else if current == nil || *current != p {
+		t.Fatalf("expected %s, got %v", &p, current)
+	}
+	if !partitionExists(fmt.Sprintf("observations_r%x", before.ID)) {
+		t.Fatalf("no partition for set %x after partitioning", before.ID)
+	}
+
+	// partitioning again the same way does nothing, and otherwise fails
+	if err := pto3.PartitionObservations(db, &p); err != nil {
+		t.Fatal(err)
+	}
+	if err := pto3.PartitionObservations(db, &pto3.ObservationPartitioning{Method: pto3.PartitionByHash, Size: 4}); err == nil {
+		t.Fatal("repartitioned observations")
+	}
+	if err := pto3.PartitionObservations(db, &pto3.ObservationPartitioning{Method: "sideways", Size: 4}); err == nil {
+		t.Fatal("partitioned observations with unknown method")
+	}
+
+	// new sets get a partition of their own, dropped on deletion
+	set := loadSet()
+	partition := fmt.Sprintf("observations_r%x", set.ID)
+	if !partitionExists(partition) {
+		t.Fatalf("no partition for new set %x", set.ID)
+	}
+	if after := countObservations(); after != count+2 {
+		t.Fatalf("expected %d observations after loading set, got %d", count+2, after)
+	}
+
+	err = db.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := set.Delete(tx, false)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if partitionExists(partition) {
+		t.Fatalf("partition for set %x not dropped on deletion", set.ID)
+	}
+	if after := countObservations(); after != count {
+		t.Fatalf("expected %d observations after deleting set, got %d", count, after)
+	}
+}
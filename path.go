@@ -3,19 +3,102 @@ package pto3
 import (
 	"encoding/csv"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 
+	"github.com/go-pg/pg"
 	"github.com/go-pg/pg/orm"
 )
 
 // Path represents a PTO path: a sequence of path elements. Paths are
-// currently stored as white-space separated element lists in strings.
+// stored both as white-space separated element lists in strings, as they
+// appear in observation files, and as arrays of normalized elements, which
+// are indexed for containment queries. Sources and targets which are IP
+// addresses or prefixes are also stored as inet, for prefix queries.
 type Path struct {
-	ID     int
-	String string
-	Source string
-	Target string
+	ID         int
+	String     string
+	Source     string
+	Target     string
+	Elements   []string `sql:"type:text[]" pg:",array"`
+	SourceAddr string   `sql:"type:inet"`
+	TargetAddr string   `sql:"type:inet"`
+}
+
+// NormalizePathElement returns the canonical form of a path element, so that
+// equivalent forms of the same element compare equal: IPv4 and IPv6
+// addresses and prefixes are formatted as by RFC 5952, with IPv6 addresses in
+// brackets, and AS numbers are written with an uppercase AS prefix. Other
+// elements are returned unchanged.
+func NormalizePathElement(element string) string {
+	addr, prefix := element, ""
+	if i := strings.LastIndex(element, "/"); i >= 0 {
+		addr, prefix = element[:i], element[i:]
+		if _, err := strconv.Atoi(prefix[1:]); err != nil {
+			return element
+		}
+	}
+	addr = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+
+	if ip := net.ParseIP(addr); ip != nil {
+		if ip.To4() != nil {
+			return ip.String() + prefix
+		}
+		return "[" + ip.String() + "]" + prefix
+	}
+
+	if len(element) > 2 && strings.EqualFold(element[:2], "AS") {
+		if asn, err := strconv.ParseUint(element[2:], 10, 32); err == nil {
+			return fmt.Sprintf("AS%d", asn)
+		}
+	}
+
+	return element
+}
+
+// PathElementAddress returns the canonical text form of a path element which
+// is an IPv4 or IPv6 address or prefix, without brackets, as stored in the
+// database; or an empty string if the element is not an address or prefix.
+func PathElementAddress(element string) string {
+	addr := strings.Replace(strings.Replace(element, "[", "", 1), "]", "", 1)
+
+	if strings.Contains(addr, "/") {
+		ip, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return ""
+		}
+		ones, _ := ipnet.Mask.Size()
+		return fmt.Sprintf("%s/%d", ip.String(), ones)
+	}
+
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+
+	return ""
+}
+
+// extractElements splits a path string into normalized path elements.
+func extractElements(pathstring string) []string {
+	elements := strings.Fields(pathstring)
+	for i := range elements {
+		elements[i] = NormalizePathElement(elements[i])
+	}
+	return elements
+}
+
+// arrayLiteral formats a slice of strings as a PostgreSQL array literal, for
+// use with COPY.
+func arrayLiteral(elements []string) string {
+	quoted := make([]string, len(elements))
+	for i, e := range elements {
+		e = strings.Replace(e, `\`, `\\`, -1)
+		e = strings.Replace(e, `"`, `\"`, -1)
+		quoted[i] = `"` + e + `"`
+	}
+	return "{" + strings.Join(quoted, ",") + "}"
 }
 
 func extractSource(pathstring string) string {
@@ -41,10 +124,12 @@ type PathCache map[string]int
 
 // CacheNewPaths takes a set of path names, and adds those not already
 // appearing to the cache and the underlying database. It modifies the pathSet
-// to contain only those paths added. Note that duplicate paths may be added
-// to the database using this function: it only checks the cache, not the
-// database, before adding, for performance reasons.
-func (cache PathCache) CacheNewPaths(db orm.DB, pathSet map[string]struct{}) error {
+// to contain only those paths added. Paths not in the cache are looked up in
+// the database in a single query before adding, as path strings are unique.
+// Paths added by another writer in the meantime are skipped when inserting,
+// and their IDs looked up once the insertion is done, so writers uploading
+// the same new paths concurrently all succeed.
+func (cache PathCache) CacheNewPaths(t *pg.Tx, pathSet map[string]struct{}) error {
 	// first, reduce to paths not already in the cache
 	for ps := range pathSet {
 		if cache[ps] > 0 {
@@ -52,21 +137,28 @@ func (cache PathCache) CacheNewPaths(db orm.DB, pathSet map[string]struct{}) err
 		}
 	}
 
-	// allocate a range of IDs in the database
-	var nv struct {
-		Nextval int
+	if len(pathSet) == 0 {
+		return nil
 	}
 
-	if _, err := db.QueryOne(&nv, "SELECT nextval('paths_id_seq')"); err != nil {
-		return PTOWrapError(err)
+	// then fill in the cache from paths already in the database
+	if err := cache.selectPaths(t, pathSet); err != nil {
+		return err
+	}
+
+	if len(pathSet) == 0 {
+		return nil
 	}
-	pidseq := nv.Nextval
 
-	if _, err := db.Exec("SELECT setval('paths_id_seq', ?)", pidseq+len(pathSet)); err != nil {
+	// stream the new paths into a temporary table
+	if _, err := t.Exec(`CREATE TEMPORARY TABLE IF NOT EXISTS incoming_paths ON COMMIT DROP AS
+		SELECT string, source, target, elements, source_addr, target_addr FROM paths WITH NO DATA`); err != nil {
+		return PTOWrapError(err)
+	}
+	if _, err := t.Exec("TRUNCATE incoming_paths"); err != nil {
 		return PTOWrapError(err)
 	}
 
-	// now add entries to the path cache while streaming into the database
 	streamerr := make(chan error, 1)
 	dbpipe, pathpipe, err := os.Pipe()
 	if err != nil {
@@ -79,27 +171,89 @@ func (cache PathCache) CacheNewPaths(db orm.DB, pathSet map[string]struct{}) err
 		defer pathpipe.Close()
 
 		for pathstring := range pathSet {
-			p := []string{fmt.Sprintf("%d", pidseq), pathstring, extractSource(pathstring), extractTarget(pathstring)}
-			cache[pathstring] = pidseq
+			source, target := extractSource(pathstring), extractTarget(pathstring)
+			p := []string{pathstring, source, target,
+				arrayLiteral(extractElements(pathstring)),
+				PathElementAddress(source), PathElementAddress(target)}
 
 			if err := out.Write(p); err != nil {
 				streamerr <- PTOWrapError(err)
+				return
 			}
-
-			pidseq++
 		}
 
 		out.Flush()
+		if err := out.Error(); err != nil {
+			streamerr <- PTOWrapError(err)
+			return
+		}
 		streamerr <- nil
 	}()
 
 	// copy from the goroutine to the database
-	if _, err = db.CopyFrom(dbpipe, "COPY paths (id, string, source, target) FROM STDIN WITH CSV"); err != nil {
+	if _, err = t.CopyFrom(dbpipe, "COPY incoming_paths (string, source, target, elements, source_addr, target_addr) FROM STDIN WITH CSV"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// wait for goroutine to complete and check its error
+	if err := <-streamerr; err != nil {
+		return err
+	}
+
+	// now insert the paths not added by another writer in the meantime, in
+	// order, so that writers adding the same paths wait for each other
+	// rather than deadlocking
+	var inserted []Path
+	if _, err := t.Query(&inserted, `INSERT INTO paths (string, source, target, elements, source_addr, target_addr)
+		SELECT string, source, target, elements, source_addr, target_addr FROM incoming_paths ORDER BY string
+		ON CONFLICT (string) DO NOTHING
+		RETURNING id, string`); err != nil {
 		return PTOWrapError(err)
 	}
 
-	// wait for goroutine to complete and return its error
-	return <-streamerr
+	addedSet := make(map[string]struct{}, len(inserted))
+	for _, p := range inserted {
+		cache[p.String] = p.ID
+		addedSet[p.String] = struct{}{}
+		delete(pathSet, p.String)
+	}
+
+	// and look up the paths the other writers added
+	if len(pathSet) > 0 {
+		if err := cache.selectPaths(t, pathSet); err != nil {
+			return err
+		}
+		if len(pathSet) > 0 {
+			return PTOErrorf("%d paths neither inserted nor found", len(pathSet))
+		}
+	}
+
+	for ps := range addedSet {
+		pathSet[ps] = struct{}{}
+	}
+
+	return nil
+}
+
+// selectPaths adds the paths in pathSet which are in the database to the
+// cache, and removes them from pathSet.
+func (cache PathCache) selectPaths(db orm.DB, pathSet map[string]struct{}) error {
+	pathstrings := make([]string, 0, len(pathSet))
+	for ps := range pathSet {
+		pathstrings = append(pathstrings, ps)
+	}
+
+	var existing []Path
+	if _, err := db.Query(&existing, "SELECT id, string FROM paths WHERE string = ANY(?)", pg.Array(pathstrings)); err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, p := range existing {
+		cache[p.String] = p.ID
+		delete(pathSet, p.String)
+	}
+
+	return nil
 }
 
 func (p *Path) Parse() {
@@ -110,8 +264,13 @@ func (p *Path) Parse() {
 // InsertOnce retrieves a path's ID if it has already been inserted into the
 // database, inserting it into the database if it's not already there.
 func (p *Path) InsertOnce(db orm.DB) error {
-	// force source and target before insertion
+	// force source, target, elements, and addresses before insertion.
+	// Elements and addresses are only needed in the database, so Parse
+	// leaves them alone.
 	p.Parse()
+	p.Elements = extractElements(p.String)
+	p.SourceAddr = PathElementAddress(p.Source)
+	p.TargetAddr = PathElementAddress(p.Target)
 
 	if p.ID == 0 {
 		_, err := db.Model(p).
@@ -133,3 +292,106 @@ func NewPath(pathstring string) *Path {
 
 	return p
 }
+
+// pathElementStatements add support for path element queries: an inet
+// conversion of path elements that tolerates elements that are not
+// addresses, and indexes on path elements and on the sources and targets of
+// paths as addresses.
+var pathElementStatements = []string{
+	`CREATE OR REPLACE FUNCTION pto_path_inet (element text) RETURNS inet AS $$
+		BEGIN
+			RETURN replace(replace(element, '[', ''), ']', '')::inet;
+		EXCEPTION WHEN others THEN
+			RETURN NULL;
+		END $$ LANGUAGE plpgsql IMMUTABLE STRICT`,
+	"CREATE INDEX IF NOT EXISTS paths_elements_idx ON paths USING GIN (elements)",
+	"CREATE INDEX IF NOT EXISTS paths_source_inet_idx ON paths USING GIST (pto_path_inet(source) inet_ops)",
+	"CREATE INDEX IF NOT EXISTS paths_target_inet_idx ON paths USING GIST (pto_path_inet(target) inet_ops)",
+}
+
+// addPathElements adds the elements column to the paths table of a database
+// created before paths were stored as arrays, fills it in for existing
+// paths, and creates the functions and indexes used by path element queries.
+func addPathElements(db orm.DB) error {
+	if _, err := db.Exec("ALTER TABLE paths ADD COLUMN IF NOT EXISTS elements text[]"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := fillPaths(db, "elements IS NULL", []string{"elements"}, func(p *Path) {
+		p.Elements = extractElements(p.String)
+	}); err != nil {
+		return err
+	}
+
+	for _, stmt := range pathElementStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// pathAddressStatements index the source and target address columns of
+// paths, replacing indexes on the pto_path_inet conversion of sources and
+// targets used before these columns existed.
+var pathAddressStatements = []string{
+	"DROP INDEX IF EXISTS paths_source_inet_idx",
+	"DROP INDEX IF EXISTS paths_target_inet_idx",
+	"CREATE INDEX IF NOT EXISTS paths_source_addr_idx ON paths USING GIST (source_addr inet_ops)",
+	"CREATE INDEX IF NOT EXISTS paths_target_addr_idx ON paths USING GIST (target_addr inet_ops)",
+}
+
+// addPathAddresses adds the source and target address columns to the paths
+// table of a database created before they existed, fills them in for
+// existing paths, and indexes them.
+func addPathAddresses(db orm.DB) error {
+	if _, err := db.Exec(`ALTER TABLE paths
+		ADD COLUMN IF NOT EXISTS source_addr inet,
+		ADD COLUMN IF NOT EXISTS target_addr inet`); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := fillPaths(db, "source_addr IS NULL AND target_addr IS NULL", []string{"source_addr", "target_addr"}, func(p *Path) {
+		p.SourceAddr = PathElementAddress(extractSource(p.String))
+		p.TargetAddr = PathElementAddress(extractTarget(p.String))
+	}); err != nil {
+		return err
+	}
+
+	for _, stmt := range pathAddressStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// fillPaths fills in columns derived from path strings for existing paths
+// matching a condition, in batches in order of ID.
+func fillPaths(db orm.DB, where string, columns []string, fill func(p *Path)) error {
+	lastID := 0
+	for {
+		var paths []Path
+		if err := db.Model(&paths).Column("id", "string").
+			Where("id > ?", lastID).Where(where).
+			Order("id").Limit(1000).Select(); err != nil {
+			return PTOWrapError(err)
+		}
+
+		if len(paths) == 0 {
+			return nil
+		}
+
+		for i := range paths {
+			fill(&paths[i])
+		}
+
+		if _, err := db.Model(&paths).Column(columns...).Update(); err != nil {
+			return PTOWrapError(err)
+		}
+
+		lastID = paths[len(paths)-1].ID
+	}
+}
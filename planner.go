@@ -0,0 +1,256 @@
+package pto3
+
+import (
+	"fmt"
+
+	"github.com/go-pg/pg"
+)
+
+// Group queries are normally answered by grouping the observations they
+// select, which takes a scan of every selected observation. Many group
+// queries, such as those behind dashboards counting conditions per day,
+// only select by time, set, and condition, and group by condition and time
+// at a granularity of a day or more; these can be answered from the
+// observation rollups instead (see rollup.go). Before running a group query,
+// a planner estimates from the rollups how many of the selected observations
+// lie in rollups entirely within the query's time range, and chooses one of
+// three plans:
+//
+// - QueryPlanRollup, if all of them do, counts from the rollups alone;
+//
+// - QueryPlanRollupIndex, if most of them do, counts from the rollups within
+// the time range, and looks up the observations in rollups on its boundaries
+// by index;
+//
+// - QueryPlanScan groups the selected observations, as for any other query.
+//
+// All plans return the same results.
+
+const (
+	// QueryPlanScan answers a query by scanning the observations it selects
+	QueryPlanScan = "scan"
+	// QueryPlanRollup answers a group query from observation rollups alone
+	QueryPlanRollup = "rollup"
+	// QueryPlanRollupIndex answers a group query from observation rollups,
+	// looking up observations on the boundaries of its time range by index
+	QueryPlanRollupIndex = "rollup+index"
+)
+
+// maxRollupBoundaryFraction is the largest fraction of the observations
+// counted by the rollups a query overlaps which may lie in rollups on the
+// boundaries of its time range for the planner to choose
+// QueryPlanRollupIndex; above it, looking up the observations on the
+// boundaries costs about as much as a scan.
+const maxRollupBoundaryFraction = 0.5
+
+// rollupGroupColumns returns the expressions a group specification groups by
+// in rollups and in the observations counted in them, or false if rollups
+// cannot answer queries grouped by it.
+func rollupGroupColumns(gs GroupSpec) (string, string, bool) {
+	switch sgs := gs.(type) {
+	case *SimpleGroupSpec:
+		switch sgs.Name {
+		case "condition", "feature", "aspect":
+			return sgs.Column, sgs.Column, true
+		case "set":
+			return "to_hex(r.set_id)", "to_hex(r.set_id)", true
+		}
+	case *DateTruncGroupSpec:
+		switch sgs.Truncation {
+		case "day", "week", "month", "year":
+			// rollup days are UTC dates, so truncating them gives the same
+			// groups as truncating start times in a UTC session
+			return fmt.Sprintf("date_trunc('%s', r.day::timestamp AT TIME ZONE 'UTC')", sgs.Truncation),
+				fmt.Sprintf("date_trunc('%s', observation.time_start)", sgs.Truncation), true
+		}
+	}
+	return "", "", false
+}
+
+// usesRollups returns true if rollups can answer this query.
+func (q *Query) usesRollups() bool {
+	if len(q.groups) < 1 || len(q.groups) > 2 {
+		return false
+	}
+
+	// rollups count neither targets nor paths, and cannot be selected by
+	// path or value
+	if q.optionCountDistinctTargets || q.recordsGroupSizes() || q.selectsPaths() || len(q.selectValues) > 0 {
+		return false
+	}
+
+	for _, gs := range q.groups {
+		if _, _, ok := rollupGroupColumns(gs); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// rollupWhereClause returns the clause selecting the rollups of the
+// observations this query selects, other than by time, with its parameters,
+// numbered from the given index. The rollups table must be aliased as r, and
+// the conditions table joined as condition.
+func (q *Query) rollupWhereClause(first int) (string, []interface{}) {
+	var where string
+	if q.privacyEpsilon > 0 {
+		where = "r.set_id NOT IN (" + privateQueryRestrictedSetsClause + ")"
+	} else {
+		where = "r.set_id NOT IN (" + restrictedSetsClause + ")"
+	}
+	params := make([]interface{}, 0)
+
+	if len(q.selectSets) > 0 {
+		where += fmt.Sprintf(" AND r.set_id IN (?%d)", first+len(params))
+		params = append(params, pg.In(q.selectSets))
+	}
+
+	if len(q.selectConditions) > 0 {
+		cids := make([]int, len(q.selectConditions))
+		for i := range q.selectConditions {
+			cids[i] = q.selectConditions[i].ID
+		}
+		where += fmt.Sprintf(" AND r.condition_id IN (?%d)", first+len(params))
+		params = append(params, pg.In(cids))
+	}
+
+	if len(q.selectFeatures) > 0 {
+		where += fmt.Sprintf(" AND condition.feature IN (?%d)", first+len(params))
+		params = append(params, pg.In(q.selectFeatures))
+	}
+
+	if len(q.selectAspects) > 0 {
+		where += fmt.Sprintf(" AND condition.aspect IN (?%d)", first+len(params))
+		params = append(params, pg.In(q.selectAspects))
+	}
+
+	return where, params
+}
+
+// Plan returns the plan chosen to answer this group query at its last
+// execution, or the empty string for other queries and queries not yet
+// executed.
+func (q *Query) Plan() string {
+	return q.plan
+}
+
+// planQuery chooses the plan to answer this query with.
+func (q *Query) planQuery() (string, error) {
+	// rollups do not count the observations of archived sets being scanned
+	if !q.usesRollups() || len(q.archivedSets) > 0 {
+		return QueryPlanScan, nil
+	}
+
+	where, params := q.rollupWhereClause(2)
+
+	var estimate struct {
+		TimeZone string
+		Inside   int
+		Boundary int
+	}
+
+	if _, err := q.obsDB().QueryOne(&estimate, `SELECT current_setting('TimeZone') AS time_zone,
+			coalesce(sum(r.count) FILTER (WHERE r.time_start_min > ?0 AND r.time_end_max < ?1), 0) AS inside,
+			coalesce(sum(r.count) FILTER (WHERE NOT (r.time_start_min > ?0 AND r.time_end_max < ?1)), 0) AS boundary
+		FROM observation_rollups AS r
+		JOIN conditions AS condition ON condition.id = r.condition_id
+		WHERE r.time_end_max > ?0 AND r.time_start_min < ?1 AND `+where,
+		append([]interface{}{q.timeStart, q.timeEnd}, params...)...); err != nil {
+		return "", PTOWrapError(err)
+	}
+
+	switch {
+	case estimate.TimeZone != "UTC" && estimate.TimeZone != "Etc/UTC":
+		// rollup days would not match the groups of observation times
+		return QueryPlanScan, nil
+	case estimate.Inside == 0:
+		return QueryPlanScan, nil
+	case estimate.Boundary == 0:
+		return QueryPlanRollup, nil
+	case float64(estimate.Boundary) <= maxRollupBoundaryFraction*float64(estimate.Inside+estimate.Boundary):
+		return QueryPlanRollupIndex, nil
+	default:
+		return QueryPlanScan, nil
+	}
+}
+
+// selectAndStoreGroupsFromRollups selects groups responding to this query
+// from the rollups, looking up observations on the boundaries of the time
+// range if the plan requires it, and dumps them to the data file as for
+// selectAndStoreGroups.
+func (q *Query) selectAndStoreGroupsFromRollups(plan string) error {
+	rollupCols := make([]string, len(q.groups))
+	obsCols := make([]string, len(q.groups))
+	for i, gs := range q.groups {
+		rollupCols[i], obsCols[i], _ = rollupGroupColumns(gs)
+	}
+
+	where, params := q.rollupWhereClause(2)
+
+	var rollupSelect, obsSelect, groupBy string
+	for i := range q.groups {
+		rollupSelect += fmt.Sprintf("%s AS group%d, ", rollupCols[i], i)
+		obsSelect += fmt.Sprintf("%s AS group%d, ", obsCols[i], i)
+		if i > 0 {
+			groupBy += ", "
+		}
+		groupBy += fmt.Sprintf("group%d", i)
+	}
+
+	sql := `SELECT ` + groupBy + `, sum(n) AS count FROM (
+			SELECT ` + rollupSelect + `r.count AS n
+			FROM observation_rollups AS r
+			JOIN conditions AS condition ON condition.id = r.condition_id
+			WHERE r.time_start_min > ?0 AND r.time_end_max < ?1 AND ` + where
+	if plan == QueryPlanRollupIndex {
+		sql += `
+			UNION ALL
+			SELECT ` + obsSelect + `1 AS n
+			FROM observation_rollups AS r
+			JOIN conditions AS condition ON condition.id = r.condition_id
+			JOIN observations AS observation ON observation.set_id = r.set_id
+				AND observation.condition_id = r.condition_id
+				AND observation.time_start >= r.day::timestamp AT TIME ZONE 'UTC'
+				AND observation.time_start < (r.day + 1)::timestamp AT TIME ZONE 'UTC'
+			WHERE r.time_end_max > ?0 AND r.time_start_min < ?1
+				AND NOT (r.time_start_min > ?0 AND r.time_end_max < ?1)
+				AND observation.time_start > ?0 AND observation.time_end < ?1
+				AND ` + where
+	}
+	sql += `) AS g GROUP BY ` + groupBy
+
+	var results []struct {
+		Group0 string
+		Group1 string
+		Count  int
+	}
+
+	if _, err := q.obsDB().Query(&results, sql, append([]interface{}{q.timeStart, q.timeEnd}, params...)...); err != nil {
+		return PTOWrapError(err)
+	}
+
+	outfile, err := q.writeResultFile()
+	if err != nil {
+		return err
+	}
+	defer outfile.Close()
+
+	// rollup plans are never chosen for queries recording group sizes, but
+	// sizes left by an earlier execution must still be removed
+	if _, err := q.writeGroupSizesFile(); err != nil {
+		return err
+	}
+
+	rows := make([]groupRow, len(results))
+	for i, result := range results {
+		rows[i] = groupRow{groups: []string{result.Group0}, count: result.Count}
+		if len(q.groups) > 1 {
+			rows[i].groups = append(rows[i].groups, result.Group1)
+		}
+	}
+	if err := q.writeGroupRows(rows, outfile, nil); err != nil {
+		return err
+	}
+
+	return outfile.Close()
+}
@@ -0,0 +1,176 @@
+package pto3
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Differentially private queries are group queries whose counts have Laplace
+// noise added, so that their results reveal little about any single
+// observation. They may include observation sets with aggregate visibility,
+// which are otherwise not readable, allowing statistics derived from
+// sensitive sets to be published more widely. Each new private query spends
+// its epsilon from the privacy budget of the client submitting it. Results
+// are noised once, when the query is executed, and shared by every client
+// retrieving them, so retrieving cached results spends nothing.
+
+// PrivacyOptions configures differentially private queries.
+type PrivacyOptions struct {
+	// Total epsilon each client may spend per budget period
+	Budget float64
+
+	// Length of budget periods, in seconds; 0 for budgets never to be
+	// replenished
+	BudgetPeriod int
+
+	// Largest epsilon of a single query; the budget if 0
+	MaxEpsilon float64
+
+	// Groups with noised counts below this are left out of results, so that
+	// the presence of a group reveals little about rare observations
+	Threshold int
+}
+
+// PrivacyBudget describes a client's privacy budget.
+type PrivacyBudget struct {
+	// Total epsilon the client may spend per period
+	Budget float64 `json:"budget"`
+	// Epsilon spent so far in the current period
+	Spent float64 `json:"spent"`
+	// Time the current period started, nil if the client has spent nothing
+	PeriodStart *time.Time `json:"period_start,omitempty"`
+	// Time the budget is replenished, nil if never or if nothing was spent
+	Replenished *time.Time `json:"replenished,omitempty"`
+}
+
+// createPrivacyBudgetTable creates the table recording the privacy budget
+// spent by each client.
+func createPrivacyBudgetTable(t *pg.Tx) error {
+	if _, err := t.Exec(`CREATE TABLE IF NOT EXISTS privacy_budgets (
+		submitter text PRIMARY KEY,
+		spent double precision NOT NULL,
+		period_start timestamptz NOT NULL)`); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// validateEpsilon returns an error if a query may not spend the given
+// epsilon.
+func (opts *PrivacyOptions) validateEpsilon(epsilon float64) error {
+	max := opts.MaxEpsilon
+	if max == 0 || max > opts.Budget {
+		max = opts.Budget
+	}
+	if epsilon > max {
+		return PTOErrorf("epsilon %g exceeds the maximum of %g per query", epsilon, max).StatusIs(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// SpendPrivacyBudget spends epsilon from a client's privacy budget, starting
+// a new period if the current one has ended. It returns an error with status
+// 429 Too Many Requests, spending nothing, if the client's remaining budget
+// is less than epsilon.
+func SpendPrivacyBudget(db orm.DB, opts *PrivacyOptions, submitter string, epsilon float64) error {
+	if err := opts.validateEpsilon(epsilon); err != nil {
+		return err
+	}
+
+	// spend atomically, so that concurrent queries cannot overspend
+	res, err := db.Exec(`INSERT INTO privacy_budgets (submitter, spent, period_start) VALUES (?0, ?1, now())
+		ON CONFLICT (submitter) DO UPDATE SET
+			spent = CASE WHEN `+periodEndedClause+` THEN EXCLUDED.spent ELSE privacy_budgets.spent + EXCLUDED.spent END,
+			period_start = CASE WHEN `+periodEndedClause+` THEN EXCLUDED.period_start ELSE privacy_budgets.period_start END
+		WHERE `+periodEndedClause+` OR privacy_budgets.spent + EXCLUDED.spent <= ?2`,
+		submitter, epsilon, opts.Budget, opts.BudgetPeriod)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if res.RowsAffected() == 0 {
+		return PTOErrorf("privacy budget exhausted; %g requested", epsilon).StatusIs(http.StatusTooManyRequests)
+	}
+	return nil
+}
+
+// periodEndedClause is an SQL condition true if a row of the privacy budget
+// table belongs to a budget period which has ended, given the length of
+// budget periods as parameter 3.
+const periodEndedClause = "(?3 > 0 AND privacy_budgets.period_start + make_interval(secs => ?3) <= now())"
+
+// PrivacyBudgetFor returns a client's privacy budget.
+func PrivacyBudgetFor(db orm.DB, opts *PrivacyOptions, submitter string) (*PrivacyBudget, error) {
+	out := PrivacyBudget{Budget: opts.Budget}
+
+	var spent float64
+	var periodStart time.Time
+	if _, err := db.QueryOne(pg.Scan(&spent, &periodStart),
+		"SELECT spent, period_start FROM privacy_budgets WHERE submitter = ?", submitter); err == pg.ErrNoRows {
+		return &out, nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if opts.BudgetPeriod > 0 {
+		replenished := periodStart.Add(time.Duration(opts.BudgetPeriod) * time.Second)
+		if !replenished.After(time.Now()) {
+			return &out, nil
+		}
+		out.Replenished = &replenished
+	}
+
+	out.Spent = spent
+	out.PeriodStart = &periodStart
+	return &out, nil
+}
+
+// laplaceNoise returns a sample from the Laplace distribution centered on 0
+// with the given scale, using a cryptographic random source so that the
+// noise cannot be predicted.
+func laplaceNoise(scale float64) (float64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, PTOWrapError(err)
+	}
+
+	// uniform on (-0.5, 0.5), excluding the ends
+	u := (float64(binary.BigEndian.Uint64(b[:])>>11)+0.5)/(1<<53) - 0.5
+
+	if u < 0 {
+		return scale * math.Log(1+2*u), nil
+	}
+	return -scale * math.Log(1-2*u), nil
+}
+
+// noisyCount returns a count with noise added for a private query with the
+// given epsilon. Each observation contributes to one count, so the scale of
+// the noise is 1/epsilon. The result is rounded, and is never negative.
+func noisyCount(count int, epsilon float64) (int, error) {
+	noise, err := laplaceNoise(1 / epsilon)
+	if err != nil {
+		return 0, err
+	}
+
+	out := int(math.Round(float64(count) + noise))
+	if out < 0 {
+		out = 0
+	}
+	return out, nil
+}
+
+// PrivacyBudget returns the privacy budget of a client submitting queries to
+// this cache, or a not found error if differentially private queries are not
+// enabled.
+func (qc *QueryCache) PrivacyBudget(submitter string) (*PrivacyBudget, error) {
+	opts := qc.config.DifferentialPrivacy
+	if opts == nil {
+		return nil, PTOErrorf("differentially private queries are not enabled").StatusIs(http.StatusNotFound)
+	}
+	return PrivacyBudgetFor(qc.db, opts, submitter)
+}
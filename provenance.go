@@ -0,0 +1,146 @@
+package pto3
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// ObservationSetSource links an observation set to one of the sources in its
+// _sources metadata. Sources which refer to raw data files or observation sets
+// on this PTO are resolved, so that provenance can be walked in both
+// directions; other sources are kept by link only.
+type ObservationSetSource struct {
+	// ID of the observation set with this source
+	ObservationSetID int `sql:",pk"`
+	// Index of the source in the set's _sources
+	Position int `sql:",pk"`
+	// Source URL as given in _sources
+	Link string
+	// Campaign and file name of the source, if it is a raw data file
+	Campaign string
+	File     string
+	// ID of the source, if it is an observation set
+	SourceSetID int
+}
+
+// resolveSources resolves this ObservationSet's sources against the raw data
+// store, if given, and the observation sets in the database. It returns an
+// error with status 400 if a source refers to a raw data file or observation
+// set on this PTO that does not exist.
+func (set *ObservationSet) resolveSources(db orm.DB, config *PTOConfiguration, rds *RawDataStore) ([]ObservationSetSource, error) {
+	out := make([]ObservationSetSource, len(set.Sources))
+
+	for i, link := range set.Sources {
+		out[i] = ObservationSetSource{ObservationSetID: set.ID, Position: i, Link: link}
+
+		if camname, filename, ok := config.RawFileForLink(link); ok {
+			if rds != nil {
+				cam, err := rds.CampaignForName(camname)
+				if err == nil {
+					_, err = cam.GetFileMetadata(filename)
+				}
+				if err != nil {
+					return nil, PTOErrorf("source %s: %s", link, err.Error()).StatusIs(http.StatusBadRequest)
+				}
+			}
+			out[i].Campaign = camname
+			out[i].File = filename
+		} else if setid, ok := config.ObservationSetIDForLink(link); ok {
+			if setid == set.ID {
+				return nil, PTOErrorf("source %s: observation set cannot be its own source", link).StatusIs(http.StatusBadRequest)
+			}
+			count, err := db.Model(&ObservationSet{}).Where("id = ?", setid).Count()
+			if err != nil {
+				return nil, PTOWrapError(err)
+			}
+			if count == 0 {
+				return nil, PTOErrorf("source %s: observation set %x not found", link, setid).StatusIs(http.StatusBadRequest)
+			}
+			out[i].SourceSetID = setid
+		}
+	}
+
+	return out, nil
+}
+
+// LinkSources validates this ObservationSet's sources and stores them in the
+// database, replacing any previously stored. Sources referring to raw data
+// files are only checked for existence if a raw data store is given. Call
+// LinkSources within a transaction after inserting or updating the set.
+func (set *ObservationSet) LinkSources(db orm.DB, config *PTOConfiguration, rds *RawDataStore) error {
+	sources, err := set.resolveSources(db, config, rds)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("DELETE FROM observation_set_sources WHERE observation_set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if len(sources) > 0 {
+		if err := db.Insert(&sources); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return nil
+}
+
+// UpstreamSources returns the sources of this ObservationSet and, walking
+// through sources which are themselves observation sets, of all the sets it
+// was derived from, ordered by set ID and position.
+func (set *ObservationSet) UpstreamSources(db orm.DB) ([]ObservationSetSource, error) {
+	out := make([]ObservationSetSource, 0)
+
+	if _, err := db.Query(&out, `
+		WITH RECURSIVE upstream(set_id) AS (
+			SELECT ?::bigint
+			UNION
+			SELECT s.source_set_id FROM observation_set_sources s
+			JOIN upstream u ON s.observation_set_id = u.set_id
+			WHERE s.source_set_id IS NOT NULL
+		)
+		SELECT s.* FROM observation_set_sources s
+		JOIN upstream u ON s.observation_set_id = u.set_id
+		ORDER BY s.observation_set_id, s.position`, set.ID); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return out, nil
+}
+
+// derivedSetIDs returns the IDs of the observation sets with a source
+// matching a WHERE clause on observation_set_sources, and of all sets derived
+// from those in turn.
+func derivedSetIDs(db orm.DB, where string, params ...interface{}) ([]int, error) {
+	var setIds []int
+
+	if _, err := db.QueryOne(pg.Scan(pg.Array(&setIds)), `
+		WITH RECURSIVE derived(set_id) AS (
+			SELECT observation_set_id FROM observation_set_sources WHERE `+where+`
+			UNION
+			SELECT s.observation_set_id FROM observation_set_sources s
+			JOIN derived d ON s.source_set_id = d.set_id
+		)
+		SELECT coalesce(array_agg(set_id), '{}') FROM derived`, params...); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	sort.Ints(setIds)
+	return setIds, nil
+}
+
+// ObservationSetIDsDerivedFromRawFile returns the IDs of the observation sets
+// derived from a raw data file, either directly or through other sets.
+func ObservationSetIDsDerivedFromRawFile(db orm.DB, camname string, filename string) ([]int, error) {
+	return derivedSetIDs(db, "campaign = ? AND file = ?", camname, filename)
+}
+
+// ObservationSetIDsDerivedFromSet returns the IDs of the observation sets
+// derived from an observation set, either directly or through other sets.
+func ObservationSetIDsDerivedFromSet(db orm.DB, setid int) ([]int, error) {
+	return derivedSetIDs(db, "source_set_id = ?", setid)
+}
@@ -2,14 +2,19 @@ package pto3_test
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-pg/pg"
 	"github.com/mami-project/pto3-go"
@@ -61,7 +66,7 @@ func teardownRDS(config *pto3.PTOConfiguration) {
 
 func setupDB(config *pto3.PTOConfiguration) *pg.DB {
 	// create a DB connection
-	db := pg.Connect(&config.ObsDatabase)
+	db := pg.Connect(&config.ObsDatabase.Options)
 
 	// log everything
 	pto3.EnableQueryLogging(db)
@@ -178,6 +183,11 @@ func TestMain(m *testing.M) {
 		"test" : "application/json",
 		"osf" :  "applicaton/vnd.mami.ndjson"
 	},
+	"EncryptionKeyFile" : "testdata/test_encryption_key",
+	"DifferentialPrivacy" : {
+		"Budget" : 2,
+		"MaxEpsilon" : 1
+	},
 	"ObsDatabase" : {
 		"Addr":     "localhost:5432",
 		"User":     "ptotest",
@@ -217,3 +227,440 @@ func TestMain(m *testing.M) {
 		return TestRC
 	}())
 }
+
+func TestFeatureFlags(t *testing.T) {
+	config, err := pto3.NewConfigFromJSON([]byte(`{
+	"BaseURL": "https://ptotest.mami-project.eu",
+	"ChangeJournalPath": "/nonexistent/journal.ndjson",
+	"Features": {
+		"change_journal": false,
+		"federation": true
+	}
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !config.FeatureEnabled(pto3.FeatureQueryCache) {
+		t.Error("query cache should be enabled by default")
+	}
+
+	if config.FeatureEnabled(pto3.FeatureChangeJournal) {
+		t.Error("change journal should be disabled")
+	}
+
+	if config.FeatureEnabled("federation") {
+		t.Error("unknown features should never be enabled")
+	}
+
+	// a disabled journal is not opened
+	if journal, err := config.ChangeJournal(); journal != nil || err != nil {
+		t.Errorf("expected no change journal, got %v (%v)", journal, err)
+	}
+}
+
+func TestListenAddresses(t *testing.T) {
+	for _, tc := range []struct {
+		bindTo   string
+		tls      bool
+		expected []string
+	}{
+		{"", false, []string{":80"}},
+		{"", true, []string{":443"}},
+		{"8383", false, []string{":8383"}},
+		{":8383", true, []string{":8383"}},
+		{"127.0.0.1:8383, [::1]:8383", false, []string{"127.0.0.1:8383", "[::1]:8383"}},
+		{"192.0.2.1 2001:db8::1", true, []string{"192.0.2.1:443", "[2001:db8::1]:443"}},
+		{"localhost,[2001:db8::2]:", false, []string{"localhost:80", "[2001:db8::2]:80"}},
+	} {
+		config, err := pto3.NewConfigFromJSON([]byte(`{"BaseURL": "https://ptotest.mami-project.eu"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.BindTo = tc.bindTo
+		if tc.tls {
+			config.CertificateFile = "cert.pem"
+			config.PrivateKeyFile = "key.pem"
+		}
+
+		addrs, err := config.ListenAddresses()
+		if err != nil {
+			t.Fatalf("BindTo %q: %v", tc.bindTo, err)
+		}
+		if strings.Join(addrs, " ") != strings.Join(tc.expected, " ") {
+			t.Errorf("BindTo %q: expected %v, got %v", tc.bindTo, tc.expected, addrs)
+		}
+	}
+
+	for _, bad := range []string{"127.0.0.1:8383,127.0.0.1:8383", "2001:db8::zz", "host:port:more"} {
+		config := pto3.PTOConfiguration{BindTo: bad}
+		if addrs, err := config.ListenAddresses(); err == nil {
+			t.Errorf("BindTo %q: expected error, got %v", bad, addrs)
+		}
+	}
+}
+
+func TestAPIVersionLinks(t *testing.T) {
+	config, err := pto3.NewConfigFromJSON([]byte(`{"BaseURL": "https://ptotest.mami-project.eu/pto"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// links carry the current version, unless they have one
+	for relative, expected := range map[string]string{
+		"obs/1a":       "https://ptotest.mami-project.eu/pto/v1/obs/1a",
+		"/raw/c/f":     "https://ptotest.mami-project.eu/pto/v1/raw/c/f",
+		"":             "https://ptotest.mami-project.eu/pto/v1/",
+		"v1/query/abc": "https://ptotest.mami-project.eu/pto/v1/query/abc",
+	} {
+		if link, err := config.LinkTo(relative); err != nil {
+			t.Fatal(err)
+		} else if link != expected {
+			t.Errorf("expected link to %s to be %s, got %s", relative, expected, link)
+		}
+	}
+
+	// links from before versioning resolve like versioned ones
+	for _, link := range []string{
+		"https://ptotest.mami-project.eu/pto/obs/1a",
+		"https://ptotest.mami-project.eu/pto/v1/obs/1a",
+	} {
+		if setid, ok := config.ObservationSetIDForLink(link); !ok || setid != 0x1a {
+			t.Errorf("expected set 1a for %s, got %x (%v)", link, setid, ok)
+		}
+	}
+	for _, link := range []string{
+		"https://ptotest.mami-project.eu/pto/raw/c/f",
+		"https://ptotest.mami-project.eu/pto/v1/raw/c/f",
+	} {
+		if cam, file, ok := config.RawFileForLink(link); !ok || cam != "c" || file != "f" {
+			t.Errorf("expected raw file c/f for %s, got %s/%s (%v)", link, cam, file, ok)
+		}
+	}
+	if _, ok := config.ObservationSetIDForLink("https://other.example.com/pto/v1/obs/1a"); ok {
+		t.Error("resolved link to another PTO")
+	}
+
+	// only v followed by a number names a version
+	for segment, expected := range map[string]int{"v1": 1, "v12": 12, "v": 0, "v01": 0, "obs": 0, "v1a": 0} {
+		if version, ok := pto3.ParseAPIVersionPrefix(segment); version != expected || ok != (expected != 0) {
+			t.Errorf("expected version %d for %s, got %d (%v)", expected, segment, version, ok)
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "pto3-acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	newConfig := func(baseURL string) *pto3.PTOConfiguration {
+		config, err := pto3.NewConfigFromJSON([]byte(fmt.Sprintf(`{"BaseURL": %q}`, baseURL)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+
+	// without certificates, serve plain HTTP
+	config := newConfig("https://ptotest.mami-project.eu")
+	if tc, m, err := config.TLSConfig(); tc != nil || m != nil || err != nil {
+		t.Fatalf("expected no TLS configuration, got %v, %v, %v", tc, m, err)
+	}
+
+	// missing certificate files fail early
+	config.CertificateFile = "/nonexistent/cert.pem"
+	config.PrivateKeyFile = "/nonexistent/key.pem"
+	if _, _, err := config.TLSConfig(); err == nil {
+		t.Fatal("expected error loading missing certificate")
+	}
+
+	// certificate files and ACME are exclusive
+	config.ACME = &pto3.ACMEOptions{CacheDir: cacheDir}
+	if _, _, err := config.TLSConfig(); err == nil {
+		t.Fatal("expected error configuring both certificate files and ACME")
+	}
+
+	// ACME obtains certificates for the host name of the base URL
+	config = newConfig("https://ptotest.mami-project.eu")
+	config.ACME = &pto3.ACMEOptions{CacheDir: cacheDir}
+	tc, m, err := config.TLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc == nil || tc.GetCertificate == nil || m == nil {
+		t.Fatal("expected TLS configuration getting certificates via ACME")
+	}
+	if err := m.HostPolicy(context.Background(), "ptotest.mami-project.eu"); err != nil {
+		t.Errorf("expected certificate for base URL host, got %v", err)
+	}
+	if err := m.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("expected no certificate for other host")
+	}
+	if addr := config.ACMEChallengeAddress(); addr != ":80" {
+		t.Errorf("expected default challenge address :80, got %s", addr)
+	}
+	if addrs, err := config.ListenAddresses(); err != nil || len(addrs) != 1 || addrs[0] != ":443" {
+		t.Errorf("expected to listen on :443 with ACME, got %v (%v)", addrs, err)
+	}
+
+	// no certificates for IP addresses
+	config = newConfig("https://192.0.2.1:8383")
+	config.ACME = &pto3.ACMEOptions{CacheDir: cacheDir}
+	if _, _, err := config.TLSConfig(); err == nil {
+		t.Fatal("expected error obtaining certificate for IP address")
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	if _, err := pto3.NewAccessLog("", "apache"); err == nil {
+		t.Fatal("expected error for unknown access log format")
+	}
+
+	rec := pto3.AccessLogRecord{
+		Time:       time.Date(2018, 1, 15, 10, 0, 0, 0, time.UTC),
+		RemoteAddr: "192.0.2.1",
+		Method:     "GET",
+		URL:        "/obs?page=1",
+		Proto:      "HTTP/1.1",
+		Status:     http.StatusOK,
+		Length:     11,
+		Duration:   1500 * time.Microsecond,
+		APIKeyID:   "0123456789abcdef",
+		UserAgent:  "curl/7.58.0",
+	}
+
+	for format, expected := range map[string]string{
+		pto3.AccessLogFormatCommon:   `192.0.2.1 - 0123456789abcdef [15/Jan/2018:10:00:00 +0000] "GET /obs?page=1 HTTP/1.1" 200 11` + "\n",
+		pto3.AccessLogFormatCombined: `192.0.2.1 - 0123456789abcdef [15/Jan/2018:10:00:00 +0000] "GET /obs?page=1 HTTP/1.1" 200 11 "-" "curl/7.58.0"` + "\n",
+		pto3.AccessLogFormatJSON: `{"time":"2018-01-15T10:00:00Z","remote_addr":"192.0.2.1","method":"GET","url":"/obs?page=1","proto":"HTTP/1.1",` +
+			`"status":200,"bytes":11,"duration_ms":1.5,"api_key":"0123456789abcdef","user_agent":"curl/7.58.0"}` + "\n",
+	} {
+		line, err := rec.Format(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(line) != expected {
+			t.Fatalf("expected %s access log line %q, got %q", format, expected, line)
+		}
+	}
+
+	// the PTO format can still be replayed, from a file which can be rotated
+	dir, err := ioutil.TempDir("", "pto3-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/access.log"
+	al, err := pto3.NewAccessLog(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	al.Log(&rec)
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := al.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	al.Log(&rec)
+
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, skipped, err := pto3.ReadAccessLog(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if skipped != 0 || len(entries) != 1 || entries[0].URL != rec.URL || entries[0].Duration != rec.Duration {
+			t.Fatalf("unexpected entries %v in %s", entries, p)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	accessLog := `ptosrv starting with configuration at ptoconfig.json...
+access: 2018/01/15 10:00:00 GET /obs?page=1 11 200 1.5ms
+access: 2018/01/15 10:00:00 GET /obs/missing 19 404 300µs
+2018/01/15 10:00:01 POST /obs/create 120 201 20ms
+2018/01/15 10:00:01 GET /raw 2 0 800µs
+`
+
+	entries, skipped, err := pto3.ReadAccessLog(strings.NewReader(accessLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 1 || len(entries) != 4 {
+		t.Fatalf("expected 4 entries and 1 skipped line, got %d and %d", len(entries), skipped)
+	}
+	if entries[0].URL != "/obs?page=1" || entries[0].Length != 11 || entries[3].Status != http.StatusOK {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	// a target which has lost /raw
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "APIKEY testkey" {
+			http.Error(w, "not authorized", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/staging/obs":
+			w.Write([]byte("hello world"))
+		case "/staging/raw":
+			http.Error(w, "gone", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer target.Close()
+
+	rp, err := pto3.NewReplayer(target.URL+"/staging", "testkey", 0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var summary pto3.ReplaySummary
+	mismatched := make(map[string]string)
+	replaySkipped := rp.Replay(entries, func(rr pto3.ReplayResult) {
+		summary.Add(rr, true)
+		if mismatch := rr.Mismatch(true); mismatch != "" {
+			mismatched[rr.Entry.URL] = mismatch
+		}
+	})
+
+	if replaySkipped != 1 || summary.Requests != 3 {
+		t.Fatalf("expected 3 requests replayed and 1 skipped, got %d and %d", summary.Requests, replaySkipped)
+	}
+	if summary.Mismatches != 1 || summary.Errors != 0 || mismatched["/raw"] != "status 500, recorded 200" {
+		t.Fatalf("expected only /raw to mismatch, got %v", mismatched)
+	}
+
+	// compare bodies with a reference instance, ignoring timing, links to
+	// each instance, and an extra key
+	serveJSON := func(base string, elapsed string, count int) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"sets": ["%s/obs/1"], "__execution_time": %s, "count": %d, "host": %q}`,
+				base, elapsed, count, r.Host)
+		}
+	}
+
+	var refURL string
+	reference := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/obs":
+			serveJSON(refURL, "0.5", 1)(w, r)
+		case "/obs/missing":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "missing"}`))
+		default:
+			http.Error(w, "gone", http.StatusInternalServerError)
+		}
+	}))
+	defer reference.Close()
+	refURL = reference.URL
+
+	var targetURL string
+	changed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/staging/obs":
+			if r.URL.Query().Get("page") == "1" {
+				serveJSON(targetURL, "12.25", 1)(w, r)
+			} else {
+				serveJSON(targetURL, "12.25", 2)(w, r)
+			}
+		case "/staging/obs/missing":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{ "error" : "missing" }`))
+		default:
+			http.Error(w, "gone", http.StatusInternalServerError)
+		}
+	}))
+	defer changed.Close()
+	targetURL = changed.URL + "/staging"
+
+	rp, err = pto3.NewReplayer(targetURL, "testkey", 0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rp.CompareWith("not a URL", nil); err == nil {
+		t.Fatal("expected relative reference URL to be rejected")
+	}
+	if err := rp.CompareWith(refURL, []string{"host"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries = append(entries, pto3.AccessLogEntry{Method: "GET", URL: "/obs?page=2", Status: http.StatusOK})
+	mismatched = make(map[string]string)
+	rp.Replay(entries, func(rr pto3.ReplayResult) {
+		if mismatch := rr.Mismatch(false); mismatch != "" {
+			mismatched[rr.Entry.URL] = mismatch
+		}
+	})
+
+	if len(mismatched) != 2 || mismatched["/raw"] != "status 500, recorded 200" ||
+		!strings.HasPrefix(mismatched["/obs?page=2"], "body differs from reference at byte 9:") {
+		t.Fatalf("expected only /raw and /obs?page=2 to mismatch, got %v", mismatched)
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	canonicalForms := map[string]string{
+		` { "b": 1.0, "a": [1e2, -0.0, 1e-7, 0.1] } `:       `{"a":[100,0,1e-7,0.1],"b":1}`,
+		`{"z": {"y": true, "x": null}, "<&>": "x\u2028\t"}`: `{"\u003c\u0026\u003e":"x\u2028\t","z":{"x":null,"y":true}}`,
+		`[12345678901234567890, 1.5e300, -2, "é"]`:          `[12345678901234567890,1.5e+300,-2,"é"]`,
+		`{"a": 1, "a": 2}`: `{"a":2}`,
+		`[-98765432109876543210987, 1e25, 12345678901234567890.0]`: `[-98765432109876543210987,1e+25,12345678901234567000]`,
+	}
+
+	for in, expected := range canonicalForms {
+		out, err := pto3.CanonicalizeJSON([]byte(in))
+		if err != nil {
+			t.Fatalf("canonicalizing %s: %v", in, err)
+		}
+		if string(out) != expected {
+			t.Errorf("canonicalizing %s: expected %s, got %s", in, expected, out)
+		}
+
+		// canonical JSON is its own canonical form
+		if again, err := pto3.CanonicalizeJSON(out); err != nil || string(again) != string(out) {
+			t.Errorf("canonicalizing %s again: got %s (%v)", out, again, err)
+		}
+	}
+
+	for _, in := range []string{`{"a": 1} {}`, `1e400`, `{"a": `} {
+		if _, err := pto3.CanonicalizeJSON([]byte(in)); err == nil {
+			t.Errorf("canonicalizing %s should fail", in)
+		}
+	}
+
+	// metadata serializes identically regardless of input key order
+	var md1, md2 pto3.RawMetadata
+	if err := md1.UnmarshalJSON([]byte(`{"_owner": "ptotest@mami-project.eu", "b": "2", "a": "1", "_file_type": "test"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := md2.UnmarshalJSON([]byte(`{"a": "1", "_file_type": "test", "b": "2", "_owner": "ptotest@mami-project.eu"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	b1, err := md1.DumpJSONObject(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, err := md2.DumpJSONObject(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b1) != string(b2) {
+		t.Fatalf("metadata serialized differently: %s and %s", b1, b2)
+	}
+}
@@ -8,6 +8,9 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -29,8 +32,19 @@ type QueryCache struct {
 	// Database connection
 	db *pg.DB
 
-	// Cache of conditions
+	// Database connection for selecting query results; the replica of the
+	// observation database if one is configured, otherwise db
+	replica *pg.DB
+
+	// Cache of conditions, shared by all queries, and lock for it; the cache
+	// is replaced rather than changed when reloaded
 	cidCache ConditionCache
+	cidLock  sync.RWMutex
+
+	// Raw data store holding the bundles of trimmed observation sets, to
+	// rehydrate or scan them for queries which may select them; nil to
+	// leave them out of queries
+	rds *RawDataStore
 
 	// Path to result cache directory
 	path string
@@ -52,12 +66,18 @@ func NewQueryCache(config *PTOConfiguration) (*QueryCache, error) {
 
 	qc := QueryCache{
 		config:     config,
-		db:         pg.Connect(&config.ObsDatabase),
+		db:         pg.Connect(&config.ObsDatabase.Options),
 		path:       config.QueryCacheRoot,
 		query:      make(map[string]*Query),
 		exectokens: make(chan struct{}, config.ConcurrentQueries),
 	}
 
+	qc.replica = config.ConnectObsReplica(qc.db)
+	config.ObsDatabaseHealth().Watch(qc.db)
+	if qc.replica != qc.db {
+		config.ObsDatabaseHealth().Watch(qc.replica)
+	}
+
 	var err error
 	qc.cidCache, err = LoadConditionCache(qc.db)
 	if err != nil {
@@ -71,6 +91,9 @@ func NewQueryCache(config *PTOConfiguration) (*QueryCache, error) {
 // of the setup for testing the query cache, and should not be called in the
 // normal case.
 func (qc *QueryCache) LoadTestData(obsFilename string) (int, error) {
+	qc.cidLock.Lock()
+	defer qc.cidLock.Unlock()
+
 	pidCache := make(PathCache)
 	set, err := CopySetFromObsFile(obsFilename, qc.db, qc.cidCache, pidCache)
 	if err != nil {
@@ -80,8 +103,70 @@ func (qc *QueryCache) LoadTestData(obsFilename string) (int, error) {
 	}
 }
 
+// ReloadConditions replaces the query cache's conditions with those in the
+// database. It is called when a miss or wildcard in a query's conditions may
+// need conditions added since the cache was loaded, and should be called
+// when conditions are renamed, aliased, or removed.
+func (qc *QueryCache) ReloadConditions() error {
+	cidCache, err := LoadConditionCache(qc.db)
+	if err != nil {
+		return err
+	}
+
+	qc.cidLock.Lock()
+	qc.cidCache = cidCache
+	qc.cidLock.Unlock()
+	return nil
+}
+
+// conditionsByName resolves a condition name as ConditionCache's
+// ConditionsByName does, against the query cache's conditions, which may be
+// resolved against concurrently.
+func (qc *QueryCache) conditionsByName(conditionName string) ([]Condition, error) {
+	pattern, err := resolveConditionPattern(qc.db, conditionName)
+	if err != nil {
+		return nil, err
+	}
+
+	match := func() []Condition {
+		qc.cidLock.RLock()
+		defer qc.cidLock.RUnlock()
+		return qc.cidCache.matchConditions(pattern)
+	}
+
+	// as in ConditionsByName, wildcards always need a fresh cache, and other
+	// names only if they miss
+	var out []Condition
+	if !IsConditionWildcard(pattern) {
+		out = match()
+	}
+	if len(out) == 0 {
+		if err := qc.ReloadConditions(); err != nil {
+			return nil, err
+		}
+		out = match()
+	}
+
+	if len(out) == 0 {
+		return nil, noConditionsError(pattern)
+	}
+	return out, nil
+}
+
 func (qc *QueryCache) EnableQueryLogging() {
 	EnableQueryLogging(qc.db)
+	if qc.replica != qc.db {
+		EnableQueryLogging(qc.replica)
+	}
+}
+
+// EnableArchivedSets makes queries include the trimmed observation sets they
+// may select from their bundles in the given raw data store, rehydrating
+// them before they are executed if the configuration enables
+// RehydrateOnQuery, or scanning them as they are executed if it enables
+// QueryArchivedSets.
+func (qc *QueryCache) EnableArchivedSets(rds *RawDataStore) {
+	qc.rds = rds
 }
 
 func (qc *QueryCache) metadataPath(identifier string) string {
@@ -185,13 +270,19 @@ func (qc *QueryCache) CachedQueryLinks() ([]string, error) {
 	return out, nil
 }
 
+// Purge invalidates a cached query, removing its metadata and results from
+// disk and from the in-memory cache. The next submission of an identical
+// query will execute it again.
 func (qc *QueryCache) Purge(identifier string) error {
-	qc.lock.RLock()
-	defer qc.lock.RUnlock()
+	qc.lock.Lock()
+	defer qc.lock.Unlock()
 
-	if err := os.Remove(qc.dataPath(identifier)); err != nil {
-		if !os.IsNotExist(err) {
-			return PTOWrapError(err)
+	paths := append(storedPaths(qc.dataPath(identifier)), storedPaths(qc.previousDataPath(identifier))...)
+	for _, path := range append(paths, qc.diffPath(identifier), qc.groupSizesPath(identifier)) {
+		if err := os.Remove(path); err != nil {
+			if !os.IsNotExist(err) {
+				return PTOWrapError(err)
+			}
 		}
 	}
 
@@ -262,6 +353,68 @@ func (gs *DatePartGroupSpec) ColumnSpec() string {
 	return fmt.Sprintf("date_part('%s', %s)", gs.Part, gs.Column)
 }
 
+// PrefixGroupSpec groups a pg-go query by the network prefix of given length
+// containing the address in an inet column, with separate lengths for IPv4
+// and IPv6. Rows without an address fall into a group named by the empty
+// string.
+type PrefixGroupSpec struct {
+	Name     string
+	Column   string
+	Length4  int
+	Length6  int
+	ExtTable string
+}
+
+func (gs *PrefixGroupSpec) URLEncoded() string {
+	if gs.Length4 == gs.Length6 {
+		return fmt.Sprintf("%s/%d", gs.Name, gs.Length4)
+	}
+	return fmt.Sprintf("%s/%d/%d", gs.Name, gs.Length4, gs.Length6)
+}
+
+func (gs *PrefixGroupSpec) ColumnSpec() string {
+	return fmt.Sprintf("coalesce(network(set_masklen(%[1]s, CASE family(%[1]s) WHEN 4 THEN %[2]d ELSE %[3]d END))::text, '')",
+		gs.Column, gs.Length4, gs.Length6)
+}
+
+// parsePrefixGroupSpec parses a prefix group parameter of the form
+// name/length, or name/length4/length6 for different prefix lengths for IPv4
+// and IPv6. IPv4 prefix lengths longer than 32 bits are truncated.
+func parsePrefixGroupSpec(groupStr string, column string) (*PrefixGroupSpec, error) {
+	parts := strings.Split(groupStr, "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, PTOErrorf("bad prefix group %s: requires one or two prefix lengths", groupStr).StatusIs(http.StatusBadRequest)
+	}
+
+	lengths := make([]int, len(parts)-1)
+	for i := range lengths {
+		var err error
+		lengths[i], err = strconv.Atoi(parts[i+1])
+		if err != nil || lengths[i] < 0 || lengths[i] > 128 {
+			return nil, PTOErrorf("bad prefix length %s in group %s", parts[i+1], groupStr).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	gs := &PrefixGroupSpec{Name: parts[0], Column: column, Length4: lengths[0], Length6: lengths[len(lengths)-1], ExtTable: "paths"}
+	if gs.Length4 > 32 {
+		gs.Length4 = 32
+	}
+	return gs, nil
+}
+
+// groupExtTable returns the name of the table a group specification requires
+// to be joined, or the empty string if none.
+func groupExtTable(gs GroupSpec) string {
+	switch sgs := gs.(type) {
+	case *SimpleGroupSpec:
+		return sgs.ExtTable
+	case *PrefixGroupSpec:
+		return sgs.ExtTable
+	default:
+		return ""
+	}
+}
+
 type Query struct {
 	// Reference to cache containing query
 	qc *QueryCache
@@ -277,6 +430,31 @@ type Query struct {
 	// Result Row Count (cached)
 	resultRowCount int
 
+	// Plan chosen to answer the query at its last execution (see planner.go)
+	plan string
+
+	// Transaction the query is executing in; nil when not executing
+	tx *pg.Tx
+
+	// Trimmed observation sets scanned from their bundles alongside the
+	// database while the query is executing
+	archivedSets []int
+
+	// Resources used at the last execution, nil if unknown (see usage.go),
+	// and bytes of results written so far while executing
+	usage       *QueryUsage
+	resultBytes int64
+
+	// Completion time of the previous execution, when rerunning
+	previousCompleted *time.Time
+
+	// Identifier of the submitting client, if known
+	Submitter string
+
+	// URLs to POST query metadata to on completion, by identifier of the
+	// client which registered them
+	callbacks map[string][]string
+
 	// Errors, references, and sources
 	ExecutionError error
 	ExtRef         string
@@ -290,17 +468,31 @@ type Query struct {
 	timeEnd          *time.Time
 	selectSets       []int
 	selectOnPath     []string
+	selectPaths      []string
 	selectSources    []string
 	selectTargets    []string
+	selectElements   []string
+	selectSrcPrefix  []string
+	selectTgtPrefix  []string
 	selectConditions []Condition
 	selectFeatures   []string
 	selectAspects    []string
 	selectValues     []string
 	groups           []GroupSpec
 
+	// Set comparison parameters
+	compareMode string
+	compareSetA int
+	compareSetB int
+
 	// Query options
 	optionSetsOnly             bool
 	optionCountDistinctTargets bool
+	optionTimeline             bool
+	optionProportions          bool
+
+	// Epsilon of a differentially private query; 0 for exact results
+	privacyEpsilon float64
 }
 
 func (q *Query) populateFromForm(form url.Values) error {
@@ -346,26 +538,46 @@ func (q *Query) populateFromForm(form url.Values) error {
 
 	// Can't really validate path components, values, features, or aspects, so just store these slices directly from the form.
 	q.selectOnPath = form["on_path"]
+	q.selectPaths = form["path"]
 	q.selectSources = form["source"]
 	q.selectTargets = form["target"]
 	q.selectValues = form["value"]
 	q.selectFeatures = form["feature"]
 	q.selectAspects = form["aspect"]
 
+	// Normalize path elements, so that equivalent forms select the same paths
+	for _, element := range form["path_element"] {
+		q.selectElements = append(q.selectElements, NormalizePathElement(element))
+	}
+
+	// Validate source and target prefixes
+	for _, prefix := range form["source_prefix"] {
+		_, ipnet, err := net.ParseCIDR(strings.Trim(prefix, "[]"))
+		if err != nil {
+			return PTOErrorf("Error parsing source_prefix: %s", err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		q.selectSrcPrefix = append(q.selectSrcPrefix, ipnet.String())
+	}
+	for _, prefix := range form["target_prefix"] {
+		_, ipnet, err := net.ParseCIDR(strings.Trim(prefix, "[]"))
+		if err != nil {
+			return PTOErrorf("Error parsing target_prefix: %s", err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		q.selectTgtPrefix = append(q.selectTgtPrefix, ipnet.String())
+	}
+
 	// Validate and expand conditions
 	conditionStrs, ok := form["condition"]
 	if ok {
 
-		// don't panic on nil qc/cidcache (DEBUG)
+		// don't panic on nil qc (DEBUG)
 		if q.qc == nil {
 			return PTOErrorf("qc is nil expanding condition array %v", form["condition"])
-		} else if q.qc.cidCache == nil {
-			return PTOErrorf("cidCache is nil expanding condition array %v", form["condition"])
 		}
 
 		q.selectConditions = make([]Condition, 0)
 		for _, conditionStr := range conditionStrs {
-			conditions, err := q.qc.cidCache.ConditionsByName(q.qc.db, conditionStr)
+			conditions, err := q.qc.conditionsByName(conditionStr)
 			if err != nil {
 				return err
 			}
@@ -408,9 +620,49 @@ func (q *Query) populateFromForm(form url.Values) error {
 			case "target":
 				q.groups[i] = &SimpleGroupSpec{Name: "target", Column: "path.target", ExtTable: "paths"}
 			case "value":
-				q.groups[i] = &SimpleGroupSpec{Name: "value", Column: "value", ExtTable: ""}
+				q.groups[i] = &SimpleGroupSpec{Name: "value", Column: "(value #>> '{}')", ExtTable: ""}
+			case "set":
+				q.groups[i] = &SimpleGroupSpec{Name: "set", Column: "to_hex(observation.set_id)", ExtTable: ""}
 			default:
-				return PTOErrorf("unsupported group name %s", groupStr).StatusIs(http.StatusBadRequest)
+				var err error
+				switch {
+				case strings.HasPrefix(groupStr, "source_prefix/"):
+					q.groups[i], err = parsePrefixGroupSpec(groupStr, "path.source_addr")
+				case strings.HasPrefix(groupStr, "target_prefix/"):
+					q.groups[i], err = parsePrefixGroupSpec(groupStr, "path.target_addr")
+				default:
+					err = PTOErrorf("unsupported group name %s", groupStr).StatusIs(http.StatusBadRequest)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// parse set comparison
+	if compareMode := form.Get("compare"); compareMode != "" {
+		if _, ok := compareClauses[compareMode]; !ok {
+			return PTOErrorf("unsupported comparison %s", compareMode).StatusIs(http.StatusBadRequest)
+		}
+		if len(q.selectSets) > 0 || len(q.groups) > 0 {
+			return PTOErrorf("set comparison cannot be combined with set or group").StatusIs(http.StatusBadRequest)
+		}
+		q.compareMode = compareMode
+
+		for _, param := range []string{"compare_a", "compare_b"} {
+			setStr := form.Get(param)
+			if setStr == "" {
+				return PTOErrorf("Query missing mandatory %s parameter for set comparison", param).StatusIs(http.StatusBadRequest)
+			}
+			seti64, err := strconv.ParseInt(setStr, 16, 32)
+			if err != nil {
+				return PTOErrorf("Error parsing %s: %s", param, err.Error()).StatusIs(http.StatusBadRequest)
+			}
+			if param == "compare_a" {
+				q.compareSetA = int(seti64)
+			} else {
+				q.compareSetB = int(seti64)
 			}
 		}
 	}
@@ -424,10 +676,44 @@ func (q *Query) populateFromForm(form url.Values) error {
 				q.optionSetsOnly = true
 			case "count_targets":
 				q.optionCountDistinctTargets = true
+			case "timeline":
+				q.optionTimeline = true
+			case "proportions":
+				q.optionProportions = true
 			}
 		}
 	}
 
+	if q.optionSetsOnly && q.compareMode != "" {
+		return PTOErrorf("set comparison cannot be combined with option sets_only").StatusIs(http.StatusBadRequest)
+	}
+
+	if q.optionProportions && (len(q.groups) == 0 || q.optionSetsOnly || q.optionTimeline) {
+		return PTOErrorf("option proportions requires a group query, and cannot be combined with option sets_only or timeline").StatusIs(http.StatusBadRequest)
+	}
+
+	// differentially private queries only count observations
+	if epsilonStr := form.Get("epsilon"); epsilonStr != "" {
+		epsilon, err := strconv.ParseFloat(epsilonStr, 64)
+		if err != nil || epsilon <= 0 || math.IsInf(epsilon, 0) {
+			return PTOErrorf("epsilon must be a positive number").StatusIs(http.StatusBadRequest)
+		}
+		if len(q.groups) == 0 || q.optionSetsOnly || q.optionTimeline {
+			return PTOErrorf("epsilon requires a group query, and cannot be combined with option sets_only or timeline").StatusIs(http.StatusBadRequest)
+		}
+		q.privacyEpsilon = epsilon
+	}
+
+	// timelines are of selected paths, and are made of observations
+	if q.optionTimeline {
+		if !q.selectsPaths() {
+			return PTOErrorf("option timeline requires a path, source, target, on_path, path_element, or prefix selection").StatusIs(http.StatusBadRequest)
+		}
+		if len(q.groups) > 0 || q.compareMode != "" || q.optionSetsOnly {
+			return PTOErrorf("option timeline cannot be combined with group, set comparison, or option sets_only").StatusIs(http.StatusBadRequest)
+		}
+	}
+
 	// hash everything into an identifier
 	q.generateIdentifier()
 
@@ -461,11 +747,27 @@ func (qc *QueryCache) ParseQueryFromForm(form url.Values) (*Query, error) {
 // handle POST queries.
 
 func (qc *QueryCache) SubmitQueryFromForm(form url.Values) (*Query, bool, error) {
+	return qc.SubmitQueryFromFormAs(form, "")
+}
+
+// SubmitQueryFromFormAs submits a new query to a cache from an HTTP form,
+// recording the identifier of the submitting client in the query's metadata
+// if the query is new.
+func (qc *QueryCache) SubmitQueryFromFormAs(form url.Values, submitter string) (*Query, bool, error) {
 	// parse the query
 	q, err := qc.ParseQueryFromForm(form)
 	if err != nil {
 		return nil, false, err
 	}
+	q.Submitter = submitter
+
+	// validate callback, which is not part of the query itself
+	callback := form.Get("callback")
+	if callback != "" {
+		if err := qc.config.CheckCallbackURL(callback); err != nil {
+			return nil, false, err
+		}
+	}
 
 	// check to see if it's been cached
 	oq, err := qc.QueryByIdentifier(q.Identifier)
@@ -473,8 +775,33 @@ func (qc *QueryCache) SubmitQueryFromForm(form url.Values) (*Query, bool, error)
 		return nil, false, err
 	}
 	if oq != nil {
+		if callback != "" {
+			if err := oq.addCallback(submitter, callback); err != nil {
+				return nil, false, err
+			}
+		}
 		return oq, false, nil
 	}
+	if callback != "" {
+		if err := q.registerCallback(submitter, callback); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// new differentially private queries release new noisy results, so
+	// spend from the submitter's budget
+	if q.privacyEpsilon > 0 {
+		opts := qc.config.DifferentialPrivacy
+		if opts == nil {
+			return nil, false, PTOErrorf("differentially private queries are not enabled").StatusIs(http.StatusBadRequest)
+		}
+		if submitter == "" {
+			submitter = "default"
+		}
+		if err := SpendPrivacyBudget(qc.db, opts, submitter, q.privacyEpsilon); err != nil {
+			return nil, false, err
+		}
+	}
 
 	// nope, new query. set submitted timestamp.
 	t := time.Now()
@@ -496,9 +823,15 @@ func (qc *QueryCache) SubmitQueryFromForm(form url.Values) (*Query, bool, error)
 }
 
 func (qc *QueryCache) ExecuteQueryFromForm(form url.Values, done chan struct{}) (*Query, bool, error) {
+	return qc.ExecuteQueryFromFormAs(form, "", done)
+}
+
+// ExecuteQueryFromFormAs submits a query from an HTTP form on behalf of a
+// given submitter, and executes it if it is new.
+func (qc *QueryCache) ExecuteQueryFromFormAs(form url.Values, submitter string, done chan struct{}) (*Query, bool, error) {
 
 	// submit the query
-	q, new, err := qc.SubmitQueryFromForm(form)
+	q, new, err := qc.SubmitQueryFromFormAs(form, submitter)
 	if err != nil {
 		return nil, false, err
 	}
@@ -579,6 +912,14 @@ func (q *Query) URLEncoded() string {
 		out += fmt.Sprintf("&on_path=%s", q.selectOnPath[i])
 	}
 
+	// add sorted paths, which contain spaces
+	sort.SliceStable(q.selectPaths, func(i, j int) bool {
+		return q.selectPaths[i] < q.selectPaths[j]
+	})
+	for i := range q.selectPaths {
+		out += fmt.Sprintf("&path=%s", url.QueryEscape(q.selectPaths[i]))
+	}
+
 	// add sorted sources
 	sort.SliceStable(q.selectSources, func(i, j int) bool {
 		return q.selectSources[i] < q.selectSources[j]
@@ -595,6 +936,28 @@ func (q *Query) URLEncoded() string {
 		out += fmt.Sprintf("&target=%s", q.selectTargets[i])
 	}
 
+	// add sorted normalized path elements
+	sort.SliceStable(q.selectElements, func(i, j int) bool {
+		return q.selectElements[i] < q.selectElements[j]
+	})
+	for i := range q.selectElements {
+		out += fmt.Sprintf("&path_element=%s", q.selectElements[i])
+	}
+
+	// add sorted source and target prefixes
+	sort.SliceStable(q.selectSrcPrefix, func(i, j int) bool {
+		return q.selectSrcPrefix[i] < q.selectSrcPrefix[j]
+	})
+	for i := range q.selectSrcPrefix {
+		out += fmt.Sprintf("&source_prefix=%s", q.selectSrcPrefix[i])
+	}
+	sort.SliceStable(q.selectTgtPrefix, func(i, j int) bool {
+		return q.selectTgtPrefix[i] < q.selectTgtPrefix[j]
+	})
+	for i := range q.selectTgtPrefix {
+		out += fmt.Sprintf("&target_prefix=%s", q.selectTgtPrefix[i])
+	}
+
 	// add sorted conditions
 	sort.SliceStable(q.selectConditions, func(i, j int) bool {
 		return q.selectConditions[i].Name < q.selectConditions[j].Name
@@ -635,6 +998,11 @@ func (q *Query) URLEncoded() string {
 		out += fmt.Sprintf("&group=%s", q.groups[i].URLEncoded())
 	}
 
+	// add set comparison
+	if q.compareMode != "" {
+		out += fmt.Sprintf("&compare=%s&compare_a=%x&compare_b=%x", q.compareMode, q.compareSetA, q.compareSetB)
+	}
+
 	// add options
 	if q.optionSetsOnly {
 		out += "&option=sets_only"
@@ -642,6 +1010,17 @@ func (q *Query) URLEncoded() string {
 	if q.optionCountDistinctTargets {
 		out += "&option=count_targets"
 	}
+	if q.optionTimeline {
+		out += "&option=timeline"
+	}
+	if q.optionProportions {
+		out += "&option=proportions"
+	}
+
+	// add privacy parameter
+	if q.privacyEpsilon > 0 {
+		out += "&epsilon=" + strconv.FormatFloat(q.privacyEpsilon, 'g', -1, 64)
+	}
 
 	return out
 }
@@ -656,6 +1035,9 @@ func (q *Query) generateSources() error {
 	if len(q.selectSets) > 0 {
 		// Sets specified in query. Let's just use them.
 		q.Sources = q.selectSets
+	} else if q.compareMode != "" {
+		// Comparing two sets, which are the sources.
+		q.Sources = []int{q.compareSetA, q.compareSetB}
 	} else {
 		// We have to actually run a query here.
 		var err error
@@ -716,6 +1098,9 @@ func (q *Query) modificationTime() *time.Time {
 	}
 }
 
+// DumpJSONObject serializes a query's metadata to canonical JSON (see
+// CanonicalizeJSON). If toDisk is true, this includes the state stored in the
+// query cache; otherwise, it includes state derived for clients.
 func (q *Query) DumpJSONObject(toDisk bool) ([]byte, error) {
 
 	jobj := make(map[string]interface{})
@@ -739,6 +1124,42 @@ func (q *Query) DumpJSONObject(toDisk bool) ([]byte, error) {
 		jobj["__error"] = q.ExecutionError.Error()
 	}
 
+	// Store/emit plan
+	if q.plan != "" {
+		jobj["__plan"] = q.plan
+	}
+
+	// Store/emit submitter
+	if q.Submitter != "" {
+		jobj["__submitter"] = q.Submitter
+	}
+
+	// Store callbacks, as a JSON string, since metadata is read back as a
+	// string map
+	if toDisk && len(q.callbacks) > 0 {
+		b, err := json.Marshal(q.callbacks)
+		if err != nil {
+			return nil, PTOWrapError(err)
+		}
+		jobj["__callbacks"] = string(b)
+	}
+
+	// Store row count as a string, since metadata is read back as a string map
+	if toDisk && q.Completed != nil && q.ExecutionError == nil {
+		jobj["__row_count"] = strconv.Itoa(q.ResultRowCount())
+	}
+
+	// Store usage as strings too, and emit it as an object
+	if q.usage != nil {
+		if toDisk {
+			for k, v := range q.usageMetadata() {
+				jobj[k] = v
+			}
+		} else {
+			jobj["__usage"] = q.usage
+		}
+	}
+
 	// Store/emit arbitrary metadata
 	for k := range q.Metadata {
 		if !strings.HasPrefix(k, "__") {
@@ -766,6 +1187,11 @@ func (q *Query) DumpJSONObject(toDisk bool) ([]byte, error) {
 			jobj["__modified"] = q.modificationTime().Format(time.RFC3339)
 		}
 
+		// execution time in seconds
+		if q.Executed != nil && q.Completed != nil {
+			jobj["__execution_time"] = q.Completed.Sub(*q.Executed).Seconds()
+		}
+
 		// state, result, and row count
 		if q.Completed != nil {
 			if q.ExecutionError != nil {
@@ -779,12 +1205,18 @@ func (q *Query) DumpJSONObject(toDisk bool) ([]byte, error) {
 				jobj["__result"] = jobj["__link"].(string) + "/result"
 				jobj["__row_count"] = q.ResultRowCount()
 			}
+
+			if q.hasDiff() {
+				jobj["__diff"] = q.DiffLink()
+			}
+		} else if q.Executed != nil {
+			jobj["__state"] = "running"
 		} else {
 			jobj["__state"] = "pending"
 		}
 	}
 
-	return json.Marshal(jobj)
+	return MarshalCanonicalJSON(jobj)
 }
 
 func (q *Query) MarshalJSON() ([]byte, error) {
@@ -846,6 +1278,29 @@ func (q *Query) UnmarshalJSON(b []byte) error {
 		q.ExecutionError = errors.New(jmap["__error"])
 	}
 
+	q.plan = jmap["__plan"]
+	q.Submitter = jmap["__submitter"]
+	if jmap["__callbacks"] != "" {
+		if err := json.Unmarshal([]byte(jmap["__callbacks"]), &q.callbacks); err != nil {
+			return PTOWrapError(err)
+		}
+	} else if jmap["__callback"] != "" {
+		// written before callbacks were kept per client
+		q.callbacks = map[string][]string{q.Submitter: []string{jmap["__callback"]}}
+	}
+
+	if jmap["__row_count"] != "" {
+		rowCount, err := strconv.Atoi(jmap["__row_count"])
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		q.resultRowCount = rowCount
+	}
+
+	if err := q.setUsageFromMetadata(jmap); err != nil {
+		return err
+	}
+
 	q.setMetadata(jmap)
 
 	return nil
@@ -858,6 +1313,16 @@ func (q *Query) UpdateFromJSON(b []byte) error {
 		return PTOWrapError(err)
 	}
 
+	// refuse alerting rules we can't evaluate
+	if jmap[AlertMetadataKey] != "" {
+		if _, err := ParseAlertRules(jmap[AlertMetadataKey]); err != nil {
+			return err
+		}
+		if len(q.groups) > 0 || q.optionSetsOnly {
+			return PTOErrorf("alert rules can only be set on selection queries").StatusIs(http.StatusBadRequest)
+		}
+	}
+
 	q.setMetadata(jmap)
 
 	return nil
@@ -885,19 +1350,62 @@ func (q *Query) FlushMetadata() error {
 	return nil
 }
 
-func (qc *QueryCache) dataPath(identifier string) string {
-	return filepath.Join(qc.config.QueryCacheRoot, fmt.Sprintf("%s.ndjson", identifier))
+// HasObservationResults returns true if the results of this query are
+// observations; i.e., if it is a selection query.
+func (q *Query) HasObservationResults() bool {
+	return len(q.groups) == 0 && !q.optionSetsOnly && q.compareMode == ""
 }
 
-func (q *Query) writeResultFile() (*os.File, error) {
-	return os.Create(q.qc.dataPath(q.Identifier))
-}
+// EncodeResults writes the observations in the results of this query to the
+// given encoder. Only the results of selection queries are observations; it
+// returns an error for other queries. The caller must close the encoder.
+func (q *Query) EncodeResults(enc ObservationEncoder) error {
+	if !q.HasObservationResults() {
+		return PTOErrorf("results of query %s are not observations", q.Identifier).StatusIs(http.StatusNotAcceptable)
+	}
 
-func (q *Query) ReadResultFile() (*os.File, error) {
-	return os.Open(q.qc.dataPath(q.Identifier))
+	resultFile, err := q.ReadResultFile()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	defer resultFile.Close()
+
+	resultScanner := bufio.NewScanner(resultFile)
+	for resultScanner.Scan() {
+		var obs Observation
+		if err := obs.UnmarshalJSON(resultScanner.Bytes()); err != nil {
+			return PTOWrapError(err)
+		}
+		if err := enc.Encode(&obs); err != nil {
+			return err
+		}
+	}
+
+	if err := resultScanner.Err(); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
 }
 
 func (q *Query) PaginateResultObject(offset int, count int) (map[string]interface{}, bool, error) {
+	return q.PaginateProjectedResultObject(offset, count, nil)
+}
+
+// PaginateProjectedResultObject returns a page of results as
+// PaginateResultObject, with each observation reduced to the given fields
+// (see ParseObservationFields). Fields may only be given for queries with
+// observation results; nil selects all fields.
+func (q *Query) PaginateProjectedResultObject(offset int, count int, fields []int) (map[string]interface{}, bool, error) {
+	return q.paginateResultObject(offset, count, fields, nil)
+}
+
+// paginateResultObject implements PaginateProjectedResultObject, leaving out
+// the result rows with the given indices.
+func (q *Query) paginateResultObject(offset int, count int, fields []int, suppressed map[int]bool) (map[string]interface{}, bool, error) {
+	if fields != nil && !q.HasObservationResults() {
+		return nil, false, PTOErrorf("results of query %s are not observations, and have no fields to select", q.Identifier).StatusIs(http.StatusBadRequest)
+	}
 
 	// create output object
 	outData := make([]interface{}, 0)
@@ -911,8 +1419,13 @@ func (q *Query) PaginateResultObject(offset int, count int) (map[string]interfac
 
 	// attempt to seek to offset
 	lineno := 0
+	row := 0
 	resultScanner := bufio.NewScanner(resultFile)
 	for resultScanner.Scan() {
+		row++
+		if suppressed[row-1] {
+			continue
+		}
 		lineno++
 
 		if offset >= lineno {
@@ -923,11 +1436,19 @@ func (q *Query) PaginateResultObject(offset int, count int) (map[string]interfac
 		}
 
 		// unmarshal data from JSON and add to output
-		var lineData interface{}
-		if err := json.Unmarshal([]byte(resultScanner.Text()), &lineData); err != nil {
-			return nil, false, PTOWrapError(err)
+		if fields != nil {
+			lineData, value, _, err := splitObservationJSON(resultScanner.Bytes())
+			if err != nil {
+				return nil, false, err
+			}
+			outData = append(outData, observationJSONValues(lineData, value, fields))
+		} else {
+			var lineData interface{}
+			if err := json.Unmarshal([]byte(resultScanner.Text()), &lineData); err != nil {
+				return nil, false, PTOWrapError(err)
+			}
+			outData = append(outData, lineData)
 		}
-		outData = append(outData, lineData)
 	}
 
 	out := make(map[string]interface{})
@@ -940,6 +1461,14 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 	// time
 	pq = pq.Where("time_start > ?", q.timeStart).Where("time_end < ?", q.timeEnd)
 
+	// results are shared among clients, so only public sets are queried,
+	// and sets with aggregate visibility in differentially private queries
+	if q.privacyEpsilon > 0 {
+		pq = pq.Where("set_id NOT IN (" + privateQueryRestrictedSetsClause + ")")
+	} else {
+		pq = pq.Where("set_id NOT IN (" + restrictedSetsClause + ")")
+	}
+
 	// sets
 	if len(q.selectSets) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
@@ -984,12 +1513,24 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 	if len(q.selectValues) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
 			for _, val := range q.selectValues {
-				qq = qq.WhereOr("value = ?", val)
+				// match values by text, so that value=3 selects both 3 and "3"
+				qq = qq.WhereOr("(value #>> '{}') = ?", val)
 			}
 			return qq, nil
 		})
 	}
 
+	return q.pathWhereClauses(pq)
+}
+
+// pathWhereClauses adds the clauses selecting paths to a query, which must
+// have the paths table joined as path.
+func (q *Query) pathWhereClauses(pq *orm.Query) *orm.Query {
+	// paths
+	if len(q.selectPaths) > 0 {
+		pq = pq.Where("path.string IN (?)", pg.In(q.selectPaths))
+	}
+
 	// source
 	if len(q.selectSources) > 0 {
 		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
@@ -1020,6 +1561,29 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 		})
 	}
 
+	// path elements: paths containing any of the elements
+	if len(q.selectElements) > 0 {
+		pq = pq.Where("path.elements && ?::text[]", pg.Array(q.selectElements))
+	}
+
+	// source and target prefixes
+	if len(q.selectSrcPrefix) > 0 {
+		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
+			for _, prefix := range q.selectSrcPrefix {
+				qq = qq.WhereOr("path.source_addr <<= ?::inet", prefix)
+			}
+			return qq, nil
+		})
+	}
+	if len(q.selectTgtPrefix) > 0 {
+		pq = pq.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
+			for _, prefix := range q.selectTgtPrefix {
+				qq = qq.WhereOr("path.target_addr <<= ?::inet", prefix)
+			}
+			return qq, nil
+		})
+	}
+
 	return pq
 }
 
@@ -1028,7 +1592,7 @@ func (q *Query) whereClauses(pq *orm.Query) *orm.Query {
 func (q *Query) selectAndStoreObservations() error {
 	var obsdat []Observation
 
-	pq := q.qc.db.Model(&obsdat).Column("observation.*", "Condition", "Path")
+	pq := q.obsDB().Model(&obsdat).Column("observation.*", "Condition", "Path")
 	pq = q.whereClauses(pq)
 	if err := pq.Select(); err != nil {
 		return PTOWrapError(err)
@@ -1044,7 +1608,43 @@ func (q *Query) selectAndStoreObservations() error {
 		return err
 	}
 
-	return outfile.Sync()
+	return outfile.Close()
+}
+
+// selectAndStoreTimeline selects the observations of the paths selected by
+// this query, and dumps them to the data file for this query as an NDJSON
+// observation file, ordered by path and then by time across all sets, so
+// that each path's observations form a timeline.
+func (q *Query) selectAndStoreTimeline() error {
+	// select the paths first, so that their observations are found through
+	// the index on path and time, instead of by scanning the time range
+	var pathIDs []int
+	pp := q.obsDB().Model((*Path)(nil)).ColumnExpr("array_agg(path.id)")
+	if err := q.pathWhereClauses(pp).Select(pg.Array(&pathIDs)); err != nil && err != pg.ErrNoRows {
+		return PTOWrapError(err)
+	}
+
+	var obsdat []Observation
+	if len(pathIDs) > 0 {
+		pq := q.obsDB().Model(&obsdat).Column("observation.*", "Condition", "Path").
+			Where("observation.path_id = ANY(?)", pg.Array(pathIDs))
+		pq = q.whereClauses(pq).Order("path.string", "observation.time_start", "observation.set_id")
+		if err := pq.Select(); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	outfile, err := q.writeResultFile()
+	if err != nil {
+		return err
+	}
+	defer outfile.Close()
+
+	if err := WriteObservations(obsdat, outfile); err != nil {
+		return err
+	}
+
+	return outfile.Close()
 }
 
 // selectObservationSetIDs selects observation set IDs responding to
@@ -1052,7 +1652,7 @@ func (q *Query) selectAndStoreObservations() error {
 func (q *Query) selectObservationSetIDs() ([]int, error) {
 	var setids []int
 
-	pq := q.qc.db.Model(&setids).ColumnExpr("DISTINCT set_id")
+	pq := q.obsDB().Model(&setids).ColumnExpr("DISTINCT set_id")
 	pq = q.whereClauses(pq)
 	if err := pq.Select(); err != nil {
 		return nil, PTOWrapError(err)
@@ -1081,7 +1681,14 @@ func (q *Query) selectAndStoreObservationSetLinks() error {
 		}
 	}
 
-	return outfile.Sync()
+	return outfile.Close()
+}
+
+// selectsPaths returns true if this query selects observations by path, and
+// therefore needs the paths table joined.
+func (q *Query) selectsPaths() bool {
+	return len(q.selectPaths) > 0 || len(q.selectSources) > 0 || len(q.selectTargets) > 0 || len(q.selectOnPath) > 0 ||
+		len(q.selectElements) > 0 || len(q.selectSrcPrefix) > 0 || len(q.selectTgtPrefix) > 0
 }
 
 func joinGroupExtTable(q *orm.Query, extTable string) *orm.Query {
@@ -1103,6 +1710,7 @@ func (q *Query) selectAndStoreOneGroup() error {
 		tableName struct{} `sql:"observations,alias:observation"` // OMG this is a freaking hack
 		Group0    string
 		Count     int
+		Size      int
 	}
 
 	var countClause string
@@ -1112,19 +1720,18 @@ func (q *Query) selectAndStoreOneGroup() error {
 		countClause = "count(*)"
 	}
 
-	pq := q.qc.db.Model(&results).ColumnExpr(q.groups[0].ColumnSpec() + " as group0, " + countClause)
+	pq := q.obsDB().Model(&results).ColumnExpr(q.groups[0].ColumnSpec() + " as group0, " + countClause + q.groupSizeClause())
 
 	// add join clause if necessary
 	joinedPaths := false
-	if q.optionCountDistinctTargets {
+	if q.optionCountDistinctTargets || q.selectsPaths() || q.recordsGroupSizes() {
 		pq = joinGroupExtTable(pq, "paths")
 		joinedPaths = true
 	}
 
-	sgs, ok := q.groups[0].(*SimpleGroupSpec)
-	if ok && sgs.ExtTable != "" {
-		if sgs.ExtTable != "paths" || !joinedPaths {
-			pq = joinGroupExtTable(pq, sgs.ExtTable)
+	if extTable := groupExtTable(q.groups[0]); extTable != "" {
+		if extTable != "paths" || !joinedPaths {
+			pq = joinGroupExtTable(pq, extTable)
 		}
 	}
 
@@ -1140,22 +1747,29 @@ func (q *Query) selectAndStoreOneGroup() error {
 	}
 	defer outfile.Close()
 
-	for _, result := range results {
-		out := make([]interface{}, 2)
-		out[0] = result.Group0
-		out[1] = result.Count
+	sizes, err := q.writeGroupSizesFile()
+	if err != nil {
+		return err
+	}
+	if sizes != nil {
+		defer sizes.Close()
+	}
 
-		b, err := json.Marshal(out)
-		if err != nil {
-			return PTOWrapError(err)
-		}
+	rows := make([]groupRow, len(results))
+	for i, result := range results {
+		rows[i] = groupRow{groups: []string{result.Group0}, count: result.Count, size: result.Size}
+	}
+	if err := q.writeGroupRows(rows, outfile, sizes); err != nil {
+		return err
+	}
 
-		if _, err := fmt.Fprintf(outfile, "%s\n", b); err != nil {
+	if sizes != nil {
+		if err := sizes.Close(); err != nil {
 			return PTOWrapError(err)
 		}
 	}
 
-	return outfile.Sync()
+	return outfile.Close()
 }
 
 func (q *Query) selectAndStoreTwoGroups() error {
@@ -1165,6 +1779,7 @@ func (q *Query) selectAndStoreTwoGroups() error {
 		Group0    string
 		Group1    string
 		Count     int
+		Size      int
 	}
 
 	var countClause string
@@ -1174,21 +1789,20 @@ func (q *Query) selectAndStoreTwoGroups() error {
 		countClause = "count(*)"
 	}
 
-	pq := q.qc.db.Model(&results).ColumnExpr(
+	pq := q.obsDB().Model(&results).ColumnExpr(
 		q.groups[0].ColumnSpec() + " as group0, " +
-			q.groups[1].ColumnSpec() + "as group1, " + countClause)
+			q.groups[1].ColumnSpec() + "as group1, " + countClause + q.groupSizeClause())
 
 	// now join as necessary
 	extTableSet := make(map[string]struct{})
 
-	if q.optionCountDistinctTargets {
+	if q.optionCountDistinctTargets || q.selectsPaths() || q.recordsGroupSizes() {
 		extTableSet["paths"] = struct{}{}
 	}
 
 	for i := 0; i < 2; i++ {
-		sgs, ok := q.groups[i].(*SimpleGroupSpec)
-		if ok && sgs.ExtTable != "" {
-			extTableSet[sgs.ExtTable] = struct{}{}
+		if extTable := groupExtTable(q.groups[i]); extTable != "" {
+			extTableSet[extTable] = struct{}{}
 		}
 	}
 
@@ -1208,11 +1822,80 @@ func (q *Query) selectAndStoreTwoGroups() error {
 	}
 	defer outfile.Close()
 
-	for _, result := range results {
-		out := make([]interface{}, 3)
-		out[0] = result.Group0
-		out[1] = result.Group1
-		out[2] = result.Count
+	sizes, err := q.writeGroupSizesFile()
+	if err != nil {
+		return err
+	}
+	if sizes != nil {
+		defer sizes.Close()
+	}
+
+	rows := make([]groupRow, len(results))
+	for i, result := range results {
+		rows[i] = groupRow{groups: []string{result.Group0, result.Group1}, count: result.Count, size: result.Size}
+	}
+	if err := q.writeGroupRows(rows, outfile, sizes); err != nil {
+		return err
+	}
+
+	if sizes != nil {
+		if err := sizes.Close(); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return outfile.Close()
+}
+
+// groupRow is a group of observations selected by a group query: the values
+// of its groups, the number of observations, and, for queries recording
+// group sizes, its size.
+type groupRow struct {
+	groups []string
+	count  int
+	size   int
+}
+
+// writeGroupRows writes the rows of a group query's results, and their
+// sizes if sizes is not nil, adding noise to the counts of differentially
+// private queries and leaving out groups below the privacy threshold. For
+// queries with option proportions, each row also has the proportion of its
+// count in the total count of the rows with the same first group value, or
+// of all rows for one group. Proportions are computed from the counts as
+// stored, noisy for private queries, including those of groups left out, so
+// they cost no privacy budget beyond the query's epsilon.
+func (q *Query) writeGroupRows(rows []groupRow, outfile *resultWriter, sizes *os.File) error {
+	counts := make([]int, len(rows))
+	keep := make([]bool, len(rows))
+	totals := make(map[string]int)
+	for i, row := range rows {
+		var err error
+		if counts[i], keep[i], err = q.groupCount(row.count); err != nil {
+			return err
+		}
+		totals[proportionKey(row)] += counts[i]
+	}
+
+	for i, row := range rows {
+		if !keep[i] {
+			continue
+		}
+
+		if sizes != nil {
+			if _, err := fmt.Fprintf(sizes, "%d\n", row.size); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+
+		out := make([]interface{}, 0, len(row.groups)+2)
+		for _, group := range row.groups {
+			out = append(out, group)
+		}
+		out = append(out, counts[i])
+		if q.optionProportions {
+			// rows kept have nonzero counts, so nonzero totals
+			out = append(out, float64(counts[i])/float64(totals[proportionKey(row)]))
+		}
 
 		b, err := json.Marshal(out)
 		if err != nil {
@@ -1224,14 +1907,54 @@ func (q *Query) selectAndStoreTwoGroups() error {
 		}
 	}
 
-	return outfile.Sync()
+	return nil
+}
+
+// proportionKey returns the key of the total a group's proportion is of: the
+// value of its first group, for two-group queries.
+func proportionKey(row groupRow) string {
+	if len(row.groups) < 2 {
+		return ""
+	}
+	return row.groups[0]
+}
+
+// groupCount returns the count to store for a group of observations: the
+// count itself, or for a differentially private query, the count with noise
+// added. It returns false if a private query should leave the group out.
+func (q *Query) groupCount(count int) (int, bool, error) {
+	if q.privacyEpsilon == 0 {
+		return count, true, nil
+	}
+
+	noisy, err := noisyCount(count, q.privacyEpsilon)
+	if err != nil {
+		return 0, false, err
+	}
+
+	threshold := 1
+	if opts := q.qc.config.DifferentialPrivacy; opts != nil && opts.Threshold > threshold {
+		threshold = opts.Threshold
+	}
+	return noisy, noisy >= threshold, nil
 }
 
 // selectAndStoreGroups selects groups responding to this query and dumps them
 // to the data file as NDJSON, one line containing a JSON array per group,
 // with elements 0 to n-1 being group names, and element n being the count of
-// observations in the group.
+// observations in the group, with noise added for differentially private
+// queries.
 func (q *Query) selectAndStoreGroups() error {
+	plan, err := q.planQuery()
+	if err != nil {
+		return err
+	}
+	q.plan = plan
+
+	if plan != QueryPlanScan {
+		return q.selectAndStoreGroupsFromRollups(plan)
+	}
+
 	switch len(q.groups) {
 	case 0:
 		panic("Programmer error: Query.selectAndStoreGroups() called on a non-group query")
@@ -1244,11 +1967,95 @@ func (q *Query) selectAndStoreGroups() error {
 	}
 }
 
+// compareClauses maps set comparison modes to the SQL condition selecting
+// paths for that comparison, given the per-path conditions of the compared
+// sets as a and b.
+var compareClauses = map[string]string{
+	"both":      "a.path_id IS NOT NULL AND b.path_id IS NOT NULL",
+	"changed":   "a.conditions <> b.conditions",
+	"unchanged": "a.conditions = b.conditions",
+	"only_a":    "b.path_id IS NULL",
+	"only_b":    "a.path_id IS NULL",
+}
+
+// selectPathConditions returns a query selecting, for each path with
+// observations in the given set matching this query, the sorted names of the
+// conditions observed on it.
+func (q *Query) selectPathConditions(setid int) *orm.Query {
+	pq := q.obsDB().Model((*Observation)(nil)).
+		ColumnExpr("observation.path_id, array_agg(DISTINCT condition.name ORDER BY condition.name) AS conditions")
+	pq = joinGroupExtTable(pq, "conditions")
+	if q.selectsPaths() {
+		pq = joinGroupExtTable(pq, "paths")
+	}
+	return q.whereClauses(pq).Where("set_id = ?", setid).Group("observation.path_id")
+}
+
+// selectAndStoreComparison compares the paths observed in the two sets of a
+// set comparison query, and dumps the paths selected by the comparison to the
+// data file as NDJSON, one line per path containing a JSON array of the path,
+// the conditions observed on it in the first set, and the conditions observed
+// on it in the second set.
+func (q *Query) selectAndStoreComparison() error {
+	var results []struct {
+		Path        string
+		ConditionsA []string `pg:",array"`
+		ConditionsB []string `pg:",array"`
+	}
+
+	if _, err := q.obsDB().Query(&results, `
+		WITH a AS (?), b AS (?)
+		SELECT path.string AS path, a.conditions AS conditions_a, b.conditions AS conditions_b
+		FROM a FULL OUTER JOIN b ON b.path_id = a.path_id
+		JOIN paths AS path ON path.id = coalesce(a.path_id, b.path_id)
+		WHERE `+compareClauses[q.compareMode]+`
+		ORDER BY path.string`,
+		q.selectPathConditions(q.compareSetA), q.selectPathConditions(q.compareSetB)); err != nil {
+		return PTOWrapError(err)
+	}
+
+	outfile, err := q.writeResultFile()
+	if err != nil {
+		return err
+	}
+	defer outfile.Close()
+
+	for _, result := range results {
+		// paths missing from a set have no conditions in it
+		if result.ConditionsA == nil {
+			result.ConditionsA = []string{}
+		}
+		if result.ConditionsB == nil {
+			result.ConditionsB = []string{}
+		}
+
+		out := make([]interface{}, 3)
+		out[0] = result.Path
+		out[1] = result.ConditionsA
+		out[2] = result.ConditionsB
+
+		b, err := json.Marshal(out)
+		if err != nil {
+			return PTOWrapError(err)
+		}
+
+		if _, err := fmt.Fprintf(outfile, "%s\n", b); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+
+	return outfile.Close()
+}
+
 func (q *Query) executionFunc() func() error {
 	if len(q.groups) > 0 {
 		return q.selectAndStoreGroups
+	} else if q.compareMode != "" {
+		return q.selectAndStoreComparison
 	} else if q.optionSetsOnly {
 		return q.selectAndStoreObservationSetLinks
+	} else if q.optionTimeline {
+		return q.selectAndStoreTimeline
 	} else {
 		return q.selectAndStoreObservations
 	}
@@ -1257,6 +2064,8 @@ func (q *Query) executionFunc() func() error {
 func (q *Query) resultObjectLabel() string {
 	if len(q.groups) > 0 {
 		return "groups"
+	} else if q.compareMode != "" {
+		return "paths"
 	} else if q.optionSetsOnly {
 		return "sets"
 	} else {
@@ -1264,6 +2073,218 @@ func (q *Query) resultObjectLabel() string {
 	}
 }
 
+// maxCallbacksPerClient is the maximum number of callbacks each client may
+// register on a query.
+const maxCallbacksPerClient = 8
+
+// registerCallback registers a callback for a client on this query, unless
+// the client has already registered it. Clients are identified as
+// submitters are. It must be called with the cache lock held, or before the
+// query is cached.
+func (q *Query) registerCallback(client string, callback string) error {
+	if client == "" {
+		client = "default"
+	}
+	for _, registered := range q.callbacks[client] {
+		if registered == callback {
+			return nil
+		}
+	}
+	if len(q.callbacks[client]) >= maxCallbacksPerClient {
+		return PTOErrorf("too many callbacks on query %s; at most %d allowed", q.Identifier, maxCallbacksPerClient).StatusIs(http.StatusBadRequest)
+	}
+
+	if q.callbacks == nil {
+		q.callbacks = make(map[string][]string)
+	}
+	q.callbacks[client] = append(q.callbacks[client], callback)
+	return nil
+}
+
+// addCallback registers a callback for a client on a query that has already
+// been submitted, alongside those registered by other clients. If the query
+// has already completed, the callback is notified immediately instead.
+func (q *Query) addCallback(client string, callback string) error {
+	q.qc.lock.Lock()
+	completed := q.Completed != nil
+	var err error
+	if !completed {
+		err = q.registerCallback(client, callback)
+	}
+	q.qc.lock.Unlock()
+
+	if completed {
+		q.notifyCallback(callback)
+	}
+	return err
+}
+
+// notifyCallbacks queues this query's metadata for delivery to every
+// callback registered on it.
+func (q *Query) notifyCallbacks() {
+	q.qc.lock.RLock()
+	callbacks := make([]string, 0)
+	for _, registered := range q.callbacks {
+		callbacks = append(callbacks, registered...)
+	}
+	q.qc.lock.RUnlock()
+
+	for _, callback := range callbacks {
+		q.notifyCallback(callback)
+	}
+}
+
+// notifyCallback queues this query's metadata for delivery as JSON to a
+// callback URL, which is only POSTed to if it is at an address clients may
+// reach through the server; see OutboundClient. Failed deliveries are retried
+// by the delivery queue; clients can always poll.
+func (q *Query) notifyCallback(callback string) {
+	dq, err := q.qc.config.DeliveryQueue()
+	if err != nil {
+		log.Printf("error opening delivery queue for callback %s for query %s: %v", callback, q.Identifier, err)
+		return
+	}
+
+	if err := dq.EnqueueOutbound(callback, "callback for query "+q.Identifier, q); err != nil {
+		log.Printf("error queueing callback %s for query %s: %v", callback, q.Identifier, err)
+	}
+}
+
+// rehydrateArchivedSets rehydrates the trimmed observation sets this query
+// may select, if rehydration is enabled, so that its results are the same as
+// if they had never been trimmed.
+func (q *Query) rehydrateArchivedSets() error {
+	if q.qc.rds == nil || !q.qc.config.ObsDatabase.RehydrateOnQuery {
+		return nil
+	}
+
+	rehydrated, err := RehydrateArchivedSets(q.qc.db, q.qc.config, q.qc.rds, q.timeStart, q.timeEnd, q.selectSets)
+	for _, setid := range rehydrated {
+		log.Printf("rehydrated observation set %x for query %s", setid, q.Identifier)
+	}
+	return err
+}
+
+// obsDB returns the database connection to select this query's results
+// from: the transaction it is executing in, otherwise the replica.
+func (q *Query) obsDB() orm.DB {
+	if q.tx != nil {
+		return q.tx
+	}
+	return q.qc.replica
+}
+
+// archivedObservationsTable is the temporary table the observations of
+// trimmed sets are scanned into while a query executes.
+const archivedObservationsTable = "archived_observations"
+
+// executeInTransaction runs a function selecting this query's results in a
+// transaction, returning the number of rows the database read to answer the
+// query. The trimmed observation sets the query may select are scanned from
+// their bundles alongside the observations in the database, if scanning is
+// enabled and there are any such sets: their observations are streamed into
+// a temporary table, and a temporary view named observations, which the
+// query's statements find before the observations table, joins them to
+// those in the database. Queries scanning archived sets run on the primary
+// database, since a replica cannot hold temporary tables.
+func (q *Query) executeInTransaction(run func() error) (int64, error) {
+	db := q.qc.replica
+	scan := false
+
+	if q.qc.rds != nil && q.qc.config.ObsDatabase.QueryArchivedSets {
+		trimmed, err := trimmedSetsInRange(q.qc.db, q.timeStart, q.timeEnd, q.selectSets, false)
+		if err != nil {
+			return 0, err
+		}
+		if len(trimmed) > 0 {
+			db = q.qc.db
+			scan = true
+		}
+	}
+
+	var rows int64
+	err := db.RunInTransaction(func(t *pg.Tx) error {
+		q.tx = t
+		defer func() {
+			q.tx = nil
+			q.archivedSets = nil
+		}()
+
+		if scan {
+			if err := q.scanArchivedSets(t); err != nil {
+				return err
+			}
+		}
+
+		before, err := rowsScanned(t)
+		if err != nil {
+			return err
+		}
+
+		if err := run(); err != nil {
+			return err
+		}
+
+		after, err := rowsScanned(t)
+		if err != nil {
+			return err
+		}
+		rows = after - before
+
+		// the view is not dropped on commit like the table it depends on
+		if len(q.archivedSets) > 0 {
+			if _, err := t.Exec("DROP VIEW pg_temp.observations"); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+		return nil
+	})
+
+	return rows, err
+}
+
+// scanArchivedSets streams the observations of the trimmed observation sets
+// this query may select into a temporary table as part of the given
+// transaction, and creates the temporary view joining them to the
+// observations in the database, for executeInTransaction.
+func (q *Query) scanArchivedSets(t *pg.Tx) error {
+	var schema string
+	if _, err := t.QueryOne(pg.Scan(&schema), "SELECT current_schema()"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := t.Exec(`CREATE TEMPORARY TABLE ` + archivedObservationsTable + `
+		(LIKE observations INCLUDING DEFAULTS) ON COMMIT DROP`); err != nil {
+		return PTOWrapError(err)
+	}
+
+	scanned, err := ScanArchivedSets(t, q.qc.config, q.qc.rds, archivedObservationsTable, q.timeStart, q.timeEnd, q.selectSets)
+	if err != nil {
+		return err
+	}
+	if len(scanned) == 0 {
+		// rehydrated since they were listed
+		return nil
+	}
+	log.Printf("scanned %d archived observation sets for query %s", len(scanned), q.Identifier)
+
+	if _, err := t.Exec("ANALYZE " + archivedObservationsTable); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// observations of scanned sets left in the database by a trimming still
+	// in progress are counted only once, from the bundle
+	if _, err := t.Exec(`CREATE TEMPORARY VIEW observations AS
+		SELECT * FROM ?.observations WHERE set_id NOT IN (?)
+		UNION ALL SELECT * FROM pg_temp.`+archivedObservationsTable,
+		pg.F(schema), pg.In(scanned)); err != nil {
+		return PTOWrapError(err)
+	}
+
+	q.archivedSets = scanned
+	return nil
+}
+
 func (q *Query) ExecuteWaitImmediate(done chan struct{}) {
 	// start the immediate delay timer
 	itimer := time.NewTimer(time.Duration(q.qc.config.ImmediateQueryDelay) * time.Millisecond)
@@ -1291,20 +2312,45 @@ func (q *Query) Execute(done chan struct{}) {
 		// flush to disk
 		q.FlushMetadata()
 
-		// switch and run query
-		q.ExecutionError = q.executionFunc()()
+		// switch and run query, once the trimmed sets it may select are back
+		// or alongside them
+		q.ExecutionError = q.rehydrateArchivedSets()
+		if q.ExecutionError == nil {
+			q.ExecutionError = q.executeAccounted(q.executionFunc())
+		}
 
 		// mark query as done
 		endTime := time.Now()
 		q.Completed = &endTime
 
+		// compare with previous results if rerunning, then remove them
+		// whether or not they could be compared
+		if q.previousCompleted != nil {
+			if q.ExecutionError == nil {
+				if err := q.writeDiff(); err != nil {
+					log.Printf("error comparing results of query %s with previous execution: %v", q.Identifier, err)
+				}
+			}
+			q.removePreviousResults()
+			q.previousCompleted = nil
+		}
+
+		// check alerting rules, if any
+		if q.ExecutionError == nil && q.Metadata[AlertMetadataKey] != "" {
+			q.notifyAlerts()
+		}
+
 		// flush to disk
 		q.FlushMetadata()
 
 		// return the waitgroup token
 		<-q.qc.exectokens
 
-		// and notify that we're done
+		// notify that we're done
 		close(done)
+
+		// then queue deliveries to callbacks, if any, without holding up
+		// clients waiting for the query
+		q.notifyCallbacks()
 	}()
 }
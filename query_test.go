@@ -2,10 +2,20 @@ package pto3_test
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	pto3 "github.com/mami-project/pto3-go"
 )
@@ -68,6 +78,12 @@ func TestQueryParsing(t *testing.T) {
 		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&group=condition&group=week",
 		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&option=sets_only",
 		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*&value=0",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&path_element=AS3320&path_element=%5B2001%3Adb8%3A%3A1%5D",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&source_prefix=10.33.0.0%2F16&target_prefix=2001%3Adb8%3A%3A%2F32",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=set&group=target_prefix%2F24%2F48",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&path=10.33.44.55+*+10.13.14.15&option=timeline",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&epsilon=0.25",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=condition&group=week&option=proportions",
 	}
 
 	for i := range encodedTestQueries {
@@ -92,6 +108,93 @@ func TestQueryParsing(t *testing.T) {
 	}
 }
 
+func TestConcurrentQueryParsing(t *testing.T) {
+	encodedTestQueries := []string{
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color",
+		"time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&condition=pto.test.color.*",
+	}
+
+	// resolve conditions while the condition cache is reloaded; run with
+	// -race to check that the cache is shared safely
+	var wg sync.WaitGroup
+	errs := make(chan error, 17)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q, err := TestQueryCache.ParseQueryFromURLEncoded(encodedTestQueries[i%len(encodedTestQueries)])
+			if err == nil && !strings.Contains(q.URLEncoded(), "pto.test.color.red") {
+				err = pto3.PTOErrorf("query %s does not select pto.test.color.red", q.URLEncoded())
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := TestQueryCache.ReloadConditions(); err != nil {
+			errs <- err
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestPathElementNormalization(t *testing.T) {
+	equivalent := [][]string{
+		{"as3320", "AS3320", "AS03320"},
+		{"2001:DB8::1", "[2001:db8:0::1]", "[2001:db8::1]"},
+		{"[2001:db8::]/32", "2001:DB8::/32"},
+		{"10.13.14.206", "[10.13.14.206]"},
+	}
+
+	for _, forms := range equivalent {
+		for _, form := range forms[1:] {
+			if a, b := pto3.NormalizePathElement(forms[0]), pto3.NormalizePathElement(form); a != b {
+				t.Errorf("path elements %s and %s normalized to %s and %s", forms[0], form, a, b)
+			}
+		}
+	}
+
+	for _, element := range []string{"*", "foo|bar", "ASN", "10.13.14.206/x"} {
+		if n := pto3.NormalizePathElement(element); n != element {
+			t.Errorf("path element %s changed to %s by normalization", element, n)
+		}
+	}
+
+	if _, err := TestQueryCache.ParseQueryFromURLEncoded("time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&target_prefix=AS3320"); err == nil {
+		t.Error("query with bad target_prefix parsed")
+	}
+
+	for _, group := range []string{"target_prefix", "target_prefix/x", "source_prefix/129", "source_prefix/24/48/64"} {
+		if _, err := TestQueryCache.ParseQueryFromURLEncoded("time_start=2017-12-05T14%3A31%3A26Z&time_end=2017-12-05T16%3A31%3A53Z&group=" + group); err == nil {
+			t.Errorf("query with bad group %s parsed", group)
+		}
+	}
+
+	addresses := map[string]string{
+		"10.13.14.206":       "10.13.14.206",
+		"[2001:DB8:0::1]":    "2001:db8::1",
+		"2001:db8:e55:5::33": "2001:db8:e55:5::33",
+		"[2001:db8::]/32":    "2001:db8::/32",
+		"192.0.2.0/24":       "192.0.2.0/24",
+		"AS3320":             "",
+		"*":                  "",
+		"10.13.14.206/x":     "",
+	}
+	for element, address := range addresses {
+		if a := pto3.PathElementAddress(element); a != address {
+			t.Errorf("expected address %q for path element %s, got %q", address, element, a)
+		}
+	}
+}
+
 func TestSelectQueries(t *testing.T) {
 	testSelectQueries := []struct {
 		encoded string
@@ -99,10 +202,16 @@ func TestSelectQueries(t *testing.T) {
 	}{
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z", 601},
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&condition=pto.test.color.green&condition=pto.test.color.indigo", 124},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&condition=pto.test.color", 601},
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&feature=pto", 601},
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&aspect=pto.test.color", 601},
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&target=10.13.14.253", 0},
 		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&value=nonesuch", 0},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&path_element=10.13.14.206", 1},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&target_prefix=10.13.14.0%2F24", 72},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&target_prefix=%5B2001%3Adb8%3A%3A%5D%2F32", 0},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&source_prefix=2001%3Adb8%3A%3A%2F32", 147},
+		{"time_start=2017-12-05T15%3A00%3A00Z&time_end=2017-12-05T15%3A05%3A00Z&source_prefix=10.0.0.0%2F8", 454},
 	}
 
 	for i, qspec := range testSelectQueries {
@@ -161,6 +270,11 @@ func TestOneGroupQueries(t *testing.T) {
 		{"time_start=2017-12-05&time_end=2017-12-06&group=value", "0", 14400},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=feature", "pto", 14400},
 		{"time_start=2017-12-05&time_end=2017-12-06&group=aspect", "pto.test.color", 14400},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=set", fmt.Sprintf("%x", TestQueryCacheSetID), 14400},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=target_prefix/24", "10.11.12.0/24", 2303},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=target_prefix/24", "2001:d00::/24", 3273},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=source_prefix/16/48", "10.33.0.0/16", 11127},
+		{"time_start=2017-12-05&time_end=2017-12-06&group=source_prefix/16/48", "2001:db8:e55::/48", 3273},
 	}
 
 	for i, qspec := range testQueries {
@@ -278,3 +392,1002 @@ func TestTwoGroupQueries(t *testing.T) {
 		}
 	}
 }
+
+func TestQueryPlans(t *testing.T) {
+	execute := func(encoded string) (*pto3.Query, []groupQueryResult) {
+		done := make(chan struct{})
+		q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded+fmt.Sprintf("&set=%x", TestQueryCacheSetID), done)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if q.ExecutionError != nil {
+			t.Fatal(q.ExecutionError)
+		}
+
+		resfile, err := q.ReadResultFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resfile.Close()
+
+		results, err := parseGroupQueryResults(resfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q, results
+	}
+
+	for _, timeRange := range []string{
+		"time_start=2017-12-05&time_end=2017-12-06",
+		"time_start=2017-12-05T06:00:00Z&time_end=2017-12-05T18:30:00Z",
+	} {
+		// grouping by hour of day always requires a scan
+		scanned, hourly := execute(timeRange + "&group=condition&group=day_hour")
+		if scanned.Plan() != pto3.QueryPlanScan {
+			t.Fatalf("expected plan %s grouping by hour of day, got %s", pto3.QueryPlanScan, scanned.Plan())
+		}
+
+		expected := make(map[string]int)
+		for _, r := range hourly {
+			expected[r.groups[0]] += r.count
+		}
+
+		// grouping by condition may use rollups, but must count the same
+		planned, byCondition := execute(timeRange + "&group=condition")
+		switch planned.Plan() {
+		case pto3.QueryPlanScan, pto3.QueryPlanRollup, pto3.QueryPlanRollupIndex:
+		default:
+			t.Fatalf("unexpected plan %s grouping by condition", planned.Plan())
+		}
+
+		if len(byCondition) != len(expected) {
+			t.Fatalf("plan %s for %s: expected %d conditions, got %d", planned.Plan(), timeRange, len(expected), len(byCondition))
+		}
+		for _, r := range byCondition {
+			if r.count != expected[r.groups[0]] {
+				t.Fatalf("plan %s for %s: expected count %d for %s, got %d",
+					planned.Plan(), timeRange, expected[r.groups[0]], r.groups[0], r.count)
+			}
+		}
+	}
+}
+
+func TestQueryRerunDiff(t *testing.T) {
+	encoded := fmt.Sprintf("time_start=2017-12-05T15%%3A00%%3A00Z&time_end=2017-12-05T15%%3A05%%3A00Z&condition=pto.test.color.green&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	if _, err := q.ReadDiff(); err == nil {
+		t.Fatal("expected no diff before rerunning query")
+	}
+
+	// doctor the results of the first run: drop the first observation and
+	// add one on a path the query won't find again
+	resfile, err := q.ReadResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resfilename := resfile.Name()
+	b, err := ioutil.ReadAll(resfile)
+	resfile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.SplitAfter(string(b), "\n")
+	doctored := strings.Join(lines[1:], "") +
+		fmt.Sprintf("[\"%x\",\"2017-12-05T15:00:00Z\",\"2017-12-05T15:00:00Z\",\"10.99.99.99 * 10.98.98.98\",\"pto.test.color.green\"]\n", TestQueryCacheSetID)
+
+	if err := ioutil.WriteFile(resfilename, []byte(doctored), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// rerun and compare
+	done = make(chan struct{})
+	if err := q.Rerun(done); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	db, err := q.ReadDiff()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var diff pto3.QueryDiff
+	if err := json.Unmarshal(db, &diff); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(diff.NewObservations) != 1 || strings.TrimSpace(string(diff.NewObservations[0])) != strings.TrimSpace(lines[0]) {
+		t.Fatalf("expected new observation %s, got %v", lines[0], diff.NewObservations)
+	}
+
+	if diff.RemovedObservations != 1 {
+		t.Fatalf("expected 1 removed observation, got %d", diff.RemovedObservations)
+	}
+
+	if len(diff.DisappearedPaths) != 1 || diff.DisappearedPaths[0] != "10.99.99.99 * 10.98.98.98" {
+		t.Fatalf("unexpected disappeared paths %v", diff.DisappearedPaths)
+	}
+
+	if diff.Previous == nil || diff.Current == nil {
+		t.Fatal("missing execution times in diff")
+	}
+
+	// previous results and temporary files are removed once compared
+	leftovers, err := filepath.Glob(filepath.Join(TestConfig.QueryCacheRoot, q.Identifier+".*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leftover := range leftovers {
+		if strings.Contains(leftover, ".prev.") || strings.HasSuffix(leftover, ".tmp") {
+			t.Fatalf("left %s behind after rerunning query", leftover)
+		}
+	}
+	if temps, _ := filepath.Glob(filepath.Join(TestConfig.QueryCacheRoot, "diff.*.tmp")); len(temps) > 0 {
+		t.Fatalf("left %v behind after comparing results", temps)
+	}
+
+	// permanent queries can't be rerun
+	q.ExtRef = "https://example.com/permanent"
+	err = q.Rerun(make(chan struct{}))
+	q.ExtRef = ""
+	if err == nil {
+		t.Fatal("expected error rerunning permanent query")
+	}
+
+	// group queries can't be compared
+	done = make(chan struct{})
+	gq, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded+"&group=condition", done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if err := gq.Rerun(make(chan struct{})); err == nil {
+		t.Fatal("expected error rerunning group query for diff")
+	}
+}
+
+func TestQueryAlerts(t *testing.T) {
+	badRules := []string{
+		"rows",
+		"rows > 5%",
+		"rows:pto.test.color.green > 5",
+		"paths > 5",
+		"paths:pto.test.color.green ~ 5",
+		"paths:pto.test.color.green > lots",
+		"latency:pto.test.color.green > 5",
+	}
+
+	for _, rulestr := range badRules {
+		if _, err := pto3.ParseAlertRule(rulestr); err == nil {
+			t.Fatalf("expected error parsing alert rule %q", rulestr)
+		}
+	}
+
+	rule, err := pto3.ParseAlertRule("paths:pto.ecn.blocked >= 5.5%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Metric != pto3.AlertMetricPaths || rule.Condition != "pto.ecn.blocked" || rule.Op != ">=" || rule.Threshold != 5.5 || !rule.Percent {
+		t.Fatalf("unexpected parsed alert rule %+v", rule)
+	}
+	if rule.String() != "paths:pto.ecn.blocked >= 5.5%" {
+		t.Fatalf("unexpected alert rule string %s", rule.String())
+	}
+
+	// run a selection query and check rules against its results
+	encoded := fmt.Sprintf("time_start=2017-12-05T15%%3A00%%3A00Z&time_end=2017-12-05T15%%3A05%%3A00Z&condition=pto.test.color.green&condition=pto.test.color.indigo&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	if err := q.UpdateFromJSON([]byte(`{"_alert": "rows > lots"}`)); err == nil {
+		t.Fatal("expected error setting bad alert rule")
+	}
+
+	rules := "rows > 100; observations:pto.test.color.green < 100%; paths:pto.test.color.orange > 0"
+	if err := q.UpdateFromJSON([]byte(`{"_alert": "` + rules + `"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts, err := q.EvaluateAlerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(alerts) != 2 || alerts[0].Rule != "rows > 100" || alerts[0].Value != 124 ||
+		alerts[1].Rule != "observations:pto.test.color.green < 100%" {
+		t.Fatalf("unexpected alerts %+v", alerts)
+	}
+
+	// rules can't be set on group queries
+	done = make(chan struct{})
+	gq, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded+"&group=condition", done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if err := gq.UpdateFromJSON([]byte(`{"_alert": "rows > 100"}`)); err == nil {
+		t.Fatal("expected error setting alert rule on group query")
+	}
+}
+
+func TestQueryTimeline(t *testing.T) {
+	// timelines need a path selection
+	if _, err := TestQueryCache.ParseQueryFromURLEncoded("time_start=2017-12-05T14%3A00%3A00Z&time_end=2017-12-05T18%3A00%3A00Z&option=timeline"); err == nil {
+		t.Error("timeline query without path selection parsed")
+	}
+	if _, err := TestQueryCache.ParseQueryFromURLEncoded("time_start=2017-12-05T14%3A00%3A00Z&time_end=2017-12-05T18%3A00%3A00Z&target=10.13.14.15&option=timeline&group=condition"); err == nil {
+		t.Error("grouped timeline query parsed")
+	}
+
+	encoded := fmt.Sprintf("time_start=2017-12-05T14%%3A00%%3A00Z&time_end=2017-12-05T18%%3A00%%3A00Z"+
+		"&path=%s&path=%s&option=timeline&set=%x",
+		"10.33.44.55+*+10.13.14.15", "10.33.44.55+*+10.11.12.72", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	resfile, err := q.ReadResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resfile.Close()
+
+	// observations are ordered by path, then by time
+	var last pto3.Observation
+	counts := make(map[string]int)
+	resscan := bufio.NewScanner(resfile)
+	for resscan.Scan() {
+		var obs pto3.Observation
+		if err := obs.UnmarshalJSON(resscan.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		counts[obs.Path.String]++
+
+		if last.Path != nil {
+			if obs.Path.String < last.Path.String ||
+				(obs.Path.String == last.Path.String && obs.TimeStart.Before(*last.TimeStart)) {
+				t.Fatalf("timeline out of order: %s %s after %s %s",
+					obs.Path.String, obs.TimeStart, last.Path.String, last.TimeStart)
+			}
+		}
+		last = obs
+	}
+
+	if len(counts) != 2 || counts["10.33.44.55 * 10.13.14.15"] != 6 {
+		t.Fatalf("unexpected timeline observation counts %v", counts)
+	}
+}
+
+func TestPrivateQueries(t *testing.T) {
+	// private queries are group queries with a positive epsilon
+	badQueries := []string{
+		"time_start=2017-12-05&time_end=2017-12-06&epsilon=0.5",
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition&epsilon=0",
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition&epsilon=-1",
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition&epsilon=lots",
+	}
+	for _, encoded := range badQueries {
+		if _, err := TestQueryCache.ParseQueryFromURLEncoded(encoded); err == nil {
+			t.Errorf("bad private query %s parsed", encoded)
+		}
+	}
+
+	submit := func(encoded string) (*pto3.Query, bool, error) {
+		form, err := url.ParseQuery(encoded + fmt.Sprintf("&set=%x", TestQueryCacheSetID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return TestQueryCache.SubmitQueryFromFormAs(form, "test_private")
+	}
+
+	// queries may spend no more than the maximum epsilon
+	if _, _, err := submit("time_start=2017-12-05&time_end=2017-12-06&group=condition&epsilon=1.5"); err == nil {
+		t.Fatal("private query exceeding maximum epsilon submitted")
+	}
+
+	q, _, err := submit("time_start=2017-12-05&time_end=2017-12-06&group=condition&epsilon=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	q.Execute(done)
+	<-done
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	resfile, err := q.ReadResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resfile.Close()
+
+	groupResults, err := parseGroupQueryResults(resfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// counts are close to, but not necessarily, the exact counts
+	found := false
+	for _, gr := range groupResults {
+		if gr.groups[0] == "pto.test.color.red" {
+			found = true
+			if math.Abs(float64(gr.count-3195)) > 100 {
+				t.Fatalf("private count %d too far from exact count 3195", gr.count)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("private query results missing group pto.test.color.red")
+	}
+
+	// resubmitting a cached query spends nothing, new queries spend until
+	// the budget is exhausted
+	if _, new, err := submit("time_start=2017-12-05&time_end=2017-12-06&group=condition&epsilon=1"); err != nil || new {
+		t.Fatalf("resubmitting private query: new %v, error %v", new, err)
+	}
+	if _, _, err := submit("time_start=2017-12-05&time_end=2017-12-06&group=source&epsilon=1"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = submit("time_start=2017-12-05&time_end=2017-12-06&group=target&epsilon=1")
+	if perr, ok := err.(*pto3.PTOError); !ok || perr.Status() != http.StatusTooManyRequests {
+		t.Fatalf("expected exhausted privacy budget, got %v", err)
+	}
+
+	budget, err := TestQueryCache.PrivacyBudget("test_private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if budget.Budget != 2 || budget.Spent != 2 {
+		t.Fatalf("unexpected privacy budget %+v", budget)
+	}
+}
+
+func TestQueryProportions(t *testing.T) {
+	// proportions are only given for group queries
+	badQueries := []string{
+		"time_start=2017-12-05&time_end=2017-12-06&option=proportions",
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=proportions&option=sets_only",
+	}
+	for _, encoded := range badQueries {
+		if _, err := TestQueryCache.ParseQueryFromURLEncoded(encoded); err == nil {
+			t.Errorf("bad proportions query %s parsed", encoded)
+		}
+	}
+
+	testQueries := []string{
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=proportions",
+		"time_start=2017-12-05&time_end=2017-12-06&group=day_hour&group=condition&option=proportions",
+		"time_start=2017-12-05&time_end=2017-12-06&group=condition&option=proportions&epsilon=1",
+	}
+
+	for i, encoded := range testQueries {
+		form, err := url.ParseQuery(encoded + fmt.Sprintf("&set=%x", TestQueryCacheSetID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		q, _, err := TestQueryCache.ExecuteQueryFromFormAs(form, "test_proportions", done)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if q.ExecutionError != nil {
+			t.Fatalf("Query %d failed: %v", i, q.ExecutionError)
+		}
+
+		resfile, err := q.ReadResultFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resfile.Close()
+
+		// each row has its proportion after its count, and the proportions
+		// of the rows sharing a first group sum to at most one
+		sums := make(map[string]float64)
+		s := bufio.NewScanner(resfile)
+		for s.Scan() {
+			var row []interface{}
+			if err := json.Unmarshal(s.Bytes(), &row); err != nil {
+				t.Fatal(err)
+			}
+			proportion, ok := row[len(row)-1].(float64)
+			if !ok || proportion < 0 || proportion > 1 {
+				t.Fatalf("Query %d row %v has bad proportion", i, row)
+			}
+			key := ""
+			if len(row) == 4 {
+				key = row[0].(string)
+			}
+			sums[key] += proportion
+		}
+		if err := s.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if len(sums) == 0 {
+			t.Fatalf("Query %d has no results", i)
+		}
+		for key, sum := range sums {
+			if sum > 1.000001 {
+				t.Fatalf("Query %d proportions for %q sum to %f", i, key, sum)
+			}
+		}
+	}
+}
+
+func TestKAnonymousQueries(t *testing.T) {
+	TestConfig.KAnonymity = 2
+	defer func() { TestConfig.KAnonymity = 0 }()
+
+	execute := func(encoded string) *pto3.Query {
+		form, err := url.ParseQuery(encoded + fmt.Sprintf("&set=%x", TestQueryCacheSetID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		q, _, err := TestQueryCache.ExecuteQueryFromFormAs(form, "test_kanon", done)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if q.ExecutionError != nil {
+			t.Fatal(q.ExecutionError)
+		}
+		return q
+	}
+
+	groupsFor := func(q *pto3.Query, submitter string) map[string]bool {
+		robj, _, err := q.PaginateResultObjectFor(0, 1000, nil, submitter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make(map[string]bool)
+		for _, row := range robj["groups"].([]interface{}) {
+			out[row.([]interface{})[0].(string)] = true
+		}
+		return out
+	}
+
+	// each source is a single vantage point, so is only shown to the submitter
+	q := execute("time_start=2017-12-05&time_end=2017-12-07&group=source")
+	if !groupsFor(q, "test_kanon")["2001:db8:e55:5::33"] {
+		t.Fatal("source group missing from results for submitter")
+	}
+	for _, submitter := range []string{"other", "default"} {
+		if groups := groupsFor(q, submitter); len(groups) != 0 {
+			t.Fatalf("source groups %v shown to %s", groups, submitter)
+		}
+		if count, err := q.ResultRowCountFor(submitter); err != nil || count != 0 {
+			t.Fatalf("expected no rows for %s, got %d (error %v)", submitter, count, err)
+		}
+	}
+
+	// conditions are observed on many paths from many vantage points
+	q = execute("time_start=2017-12-05&time_end=2017-12-07&group=condition")
+	if !groupsFor(q, "other")["pto.test.color.red"] {
+		t.Fatal("condition group missing from results for other client")
+	}
+}
+
+func TestQueryEncodeResults(t *testing.T) {
+	csvFormat := pto3.ObservationFormatByName(pto3.ObservationFormatCSV)
+	if csvFormat == nil || pto3.ObservationFormatByContentType("text/csv") != csvFormat {
+		t.Fatal("csv format not registered")
+	}
+
+	encoded := fmt.Sprintf("time_start=2017-12-05T15%%3A00%%3A00Z&time_end=2017-12-05T15%%3A05%%3A00Z&condition=pto.test.color.green&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	var buf strings.Builder
+	enc := csvFormat.NewEncoder(&buf, nil)
+	if err := q.EncodeResults(enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if lines[0] != "set_id,time_start,time_end,path,condition,value" {
+		t.Fatalf("unexpected csv header %s", lines[0])
+	}
+	if len(lines)-1 != q.ResultRowCount() {
+		t.Fatalf("expected %d csv rows, got %d", q.ResultRowCount(), len(lines)-1)
+	}
+	for _, line := range lines[1:] {
+		if !strings.Contains(line, ",pto.test.color.green,") {
+			t.Fatalf("unexpected csv row %s", line)
+		}
+	}
+
+	// group query results are not observations
+	done = make(chan struct{})
+	gq, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded+"&group=condition", done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if gq.HasObservationResults() {
+		t.Fatal("group query claims observation results")
+	}
+	if err := gq.EncodeResults(pto3.NewNDJSONEncoder(ioutil.Discard, nil)); err == nil {
+		t.Fatal("expected error encoding group query results")
+	}
+}
+
+// exportTestObservations returns observations exercising export formatting:
+// a decimal value, a value in exponent notation with times outside UTC, a
+// string value containing separators, and no value.
+func exportTestObservations() []pto3.Observation {
+	cet := time.FixedZone("CET", 3600)
+	at := func(sec int, loc *time.Location) *time.Time {
+		t := time.Date(2017, 12, 5, 15, 0, sec, 0, time.UTC).In(loc)
+		return &t
+	}
+
+	return []pto3.Observation{
+		{SetID: 0x1a, TimeStart: at(0, time.UTC), TimeEnd: at(1, time.UTC),
+			Path: &pto3.Path{String: "* 192.0.2.1 *"}, Condition: &pto3.Condition{Name: "pto.test.rtt"}, Value: json.RawMessage("12.5")},
+		{SetID: 0x1a, TimeStart: at(2, cet), TimeEnd: at(3, cet),
+			Path: &pto3.Path{String: "* 192.0.2.2 *"}, Condition: &pto3.Condition{Name: "pto.test.rtt"}, Value: json.RawMessage("1.5e-05")},
+		{SetID: 0x1a, TimeStart: at(4, time.UTC), TimeEnd: at(5, time.UTC),
+			Path: &pto3.Path{String: "192.0.2.3 * 198.51.100.1"}, Condition: &pto3.Condition{Name: "pto.test.color.green"}, Value: json.RawMessage(`"a;b, c"`)},
+		{SetID: 0x1a, TimeStart: at(6, time.UTC), TimeEnd: at(7, time.UTC),
+			Path: &pto3.Path{String: "* 192.0.2.4 *"}, Condition: &pto3.Condition{Name: "pto.test.color.red"}},
+	}
+}
+
+func TestExportFormatting(t *testing.T) {
+	csvFormat := pto3.ObservationFormatByName(pto3.ObservationFormatCSV)
+
+	golden := []struct {
+		file   string
+		params string
+		fields string
+	}{
+		{"default.csv", "", ""},
+		{"comma_datetime_titles.csv", "decimal=comma&time_format=datetime&header=titles", ""},
+		{"unix_noheader_projected.csv", "time_format=unix&header=none", "time_start,value"},
+	}
+
+	for _, g := range golden {
+		form, err := url.ParseQuery(g.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := pto3.ParseExportOptions(form)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// options survive being encoded in links
+		reform, err := url.ParseQuery(opts.URLEncoded())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reopts, err := pto3.ParseExportOptions(reform); err != nil || *reopts != *opts {
+			t.Fatalf("export options %s encoded as %s", g.params, opts.URLEncoded())
+		}
+
+		fields, err := pto3.ParseObservationFields(g.fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var buf strings.Builder
+		enc, err := csvFormat.Encoder(&buf, fields, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, obs := range exportTestObservations() {
+			if err := enc.Encode(&obs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := enc.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected, err := ioutil.ReadFile(filepath.Join("testdata", "export", g.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != string(expected) {
+			t.Fatalf("export with %q does not match %s:\n%s", g.params, g.file, buf.String())
+		}
+	}
+
+	// unknown options are refused, as are options for formats without them
+	if _, err := pto3.ParseExportOptions(url.Values{"decimal": {"dot"}}); err == nil {
+		t.Fatal("expected error parsing unknown decimal separator")
+	}
+
+	ndjsonFormat := pto3.ObservationFormatByName(pto3.ObservationFormatNDJSON)
+	if err := ndjsonFormat.CheckExportOptions(&pto3.ExportOptions{Header: pto3.ExportHeaderFields}); err != nil {
+		t.Fatalf("default export options refused for ndjson: %v", err)
+	}
+	if err := ndjsonFormat.CheckExportOptions(&pto3.ExportOptions{DecimalSeparator: pto3.ExportDecimalComma}); err == nil {
+		t.Fatal("expected error for export options with ndjson")
+	}
+}
+
+func TestQueryResultFields(t *testing.T) {
+	if _, err := pto3.ParseObservationFields("time_start,start"); err == nil {
+		t.Fatal("expected error parsing unknown field")
+	}
+
+	fields, err := pto3.ParseObservationFields("time_start,condition")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encoded := fmt.Sprintf("time_start=2017-12-05T15%%3A00%%3A00Z&time_end=2017-12-05T15%%3A05%%3A00Z&condition=pto.test.color.green&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	robj, _, err := q.PaginateProjectedResultObject(0, 10, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := robj["obs"].([]interface{})
+	if len(rows) == 0 {
+		t.Fatal("no projected observations")
+	}
+	for _, row := range rows {
+		cols := row.([]string)
+		if len(cols) != 2 || cols[1] != "pto.test.color.green" {
+			t.Fatalf("unexpected projected observation %v", cols)
+		}
+	}
+
+	var buf strings.Builder
+	enc := pto3.NewNDJSONEncoder(&buf, fields)
+	if err := q.EncodeResults(enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(strings.SplitN(buf.String(), "\n", 2)[0], `,"pto.test.color.green"]`) {
+		t.Fatalf("unexpected projected ndjson %s", strings.SplitN(buf.String(), "\n", 2)[0])
+	}
+}
+
+func TestQueryDictResults(t *testing.T) {
+	encoded := fmt.Sprintf("time_start=2017-12-05T15%%3A00%%3A00Z&time_end=2017-12-05T15%%3A05%%3A00Z&condition=pto.test.color.green&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	var buf strings.Builder
+	enc := pto3.ObservationFormatByName(pto3.ObservationFormatDict).NewEncoder(&buf, nil)
+	if err := q.EncodeResults(enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// decode the stream, and make sure every reference is defined first
+	dicts := map[string][]string{pto3.DictPath: nil, pto3.DictCondition: nil}
+	rows := 0
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.HasPrefix(line, "{") {
+			var entry struct {
+				Dict  string
+				ID    int
+				Value string
+			}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.ID != len(dicts[entry.Dict]) {
+				t.Fatalf("dictionary entry out of order: %s", line)
+			}
+			dicts[entry.Dict] = append(dicts[entry.Dict], entry.Value)
+			continue
+		}
+
+		var row []interface{}
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			t.Fatal(err)
+		}
+		path, condition := int(row[3].(float64)), int(row[4].(float64))
+		if path >= len(dicts[pto3.DictPath]) || condition >= len(dicts[pto3.DictCondition]) {
+			t.Fatalf("observation refers to undefined dictionary entry: %s", line)
+		}
+		if dicts[pto3.DictCondition][condition] != "pto.test.color.green" {
+			t.Fatalf("unexpected condition in observation: %s", line)
+		}
+		rows++
+	}
+
+	if rows != q.ResultRowCount() {
+		t.Fatalf("expected %d observations, got %d", q.ResultRowCount(), rows)
+	}
+	if len(dicts[pto3.DictCondition]) != 1 {
+		t.Fatalf("expected one condition in dictionary, got %v", dicts[pto3.DictCondition])
+	}
+}
+
+// flatField returns the position of a field of a FlatBuffer table, or 0 if
+// it is absent.
+func flatField(buf []byte, table int, field int) int {
+	vtable := table - int(int32(binary.LittleEndian.Uint32(buf[table:])))
+	if entry := 4 + 2*field; entry < int(binary.LittleEndian.Uint16(buf[vtable:])) {
+		if off := int(binary.LittleEndian.Uint16(buf[vtable+entry:])); off != 0 {
+			return table + off
+		}
+	}
+	return 0
+}
+
+func TestQueryArrowResults(t *testing.T) {
+	encoded := fmt.Sprintf("time_start=2017-12-05T15%%3A00%%3A00Z&time_end=2017-12-05T15%%3A05%%3A00Z&condition=pto.test.color.green&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	var buf bytes.Buffer
+	enc := pto3.ObservationFormatByName(pto3.ObservationFormatArrow).NewEncoder(&buf, nil)
+	if err := q.EncodeResults(enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// walk the stream's messages: a schema, then record batches, then the
+	// end-of-stream marker, each aligned to 8 bytes
+	stream := buf.Bytes()
+	var headerTypes []byte
+	var rows int64
+	for {
+		if len(stream) < 8 || binary.LittleEndian.Uint32(stream) != 0xFFFFFFFF {
+			t.Fatalf("bad message prefix after %d messages", len(headerTypes))
+		}
+		metaLength := int(binary.LittleEndian.Uint32(stream[4:]))
+		if metaLength == 0 {
+			break
+		}
+		if metaLength%8 != 0 {
+			t.Fatalf("message metadata length %d not aligned", metaLength)
+		}
+
+		meta := stream[8 : 8+metaLength]
+		message := int(binary.LittleEndian.Uint32(meta))
+		headerType := meta[flatField(meta, message, 1)]
+		headerTypes = append(headerTypes, headerType)
+
+		var bodyLength int64
+		if pos := flatField(meta, message, 3); pos != 0 {
+			bodyLength = int64(binary.LittleEndian.Uint64(meta[pos:]))
+		}
+		if bodyLength%8 != 0 {
+			t.Fatalf("message body length %d not aligned", bodyLength)
+		}
+
+		// record batches give their row count first
+		if headerType == 3 {
+			pos := flatField(meta, message, 2)
+			batch := pos + int(binary.LittleEndian.Uint32(meta[pos:]))
+			rows += int64(binary.LittleEndian.Uint64(meta[flatField(meta, batch, 0):]))
+		}
+
+		stream = stream[8+int64(metaLength)+bodyLength:]
+	}
+
+	if len(stream) != 8 {
+		t.Fatalf("%d bytes after end of stream", len(stream)-8)
+	}
+	if len(headerTypes) < 2 || headerTypes[0] != 1 {
+		t.Fatalf("expected schema then record batches, got message types %v", headerTypes)
+	}
+	if rows != int64(q.ResultRowCount()) {
+		t.Fatalf("expected %d observations, got %d", q.ResultRowCount(), rows)
+	}
+}
+
+func TestQueryParquetResults(t *testing.T) {
+	encoded := fmt.Sprintf("time_start=2017-12-05T15%%3A00%%3A00Z&time_end=2017-12-05T15%%3A05%%3A00Z&condition=pto.test.color.green&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	var buf bytes.Buffer
+	enc := pto3.ObservationFormatByName(pto3.ObservationFormatParquet).NewEncoder(&buf, []int{3, 4})
+	if err := q.EncodeResults(enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a Parquet file begins and ends with its magic number, preceded by the
+	// length of the footer, which names the columns
+	file := buf.Bytes()
+	if len(file) < 12 || string(file[:4]) != "PAR1" || string(file[len(file)-4:]) != "PAR1" {
+		t.Fatalf("bad Parquet magic in %d byte file", len(file))
+	}
+	footerLength := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	if footerLength > len(file)-12 {
+		t.Fatalf("footer length %d exceeds %d byte file", footerLength, len(file))
+	}
+	footer := file[len(file)-8-footerLength : len(file)-8]
+	for _, name := range []string{"path", "condition"} {
+		if !bytes.Contains(footer, []byte(name)) {
+			t.Fatalf("column %s missing from footer", name)
+		}
+	}
+	if bytes.Contains(footer, []byte("time_start")) {
+		t.Fatal("unselected column time_start in footer")
+	}
+
+	// the data for every observation is in the file
+	if !bytes.Contains(file, []byte("pto.test.color.green")) {
+		t.Fatal("condition missing from file")
+	}
+}
+
+func TestCompressedQueryCache(t *testing.T) {
+	TestConfig.CompressQueryCache = true
+	defer func() { TestConfig.CompressQueryCache = false }()
+
+	encoded := fmt.Sprintf("time_start=2017-12-05T15%%3A00%%3A00Z&time_end=2017-12-05T15%%3A04%%3A00Z&condition=pto.test.color.blue&set=%x", TestQueryCacheSetID)
+
+	done := make(chan struct{})
+	q, _, err := TestQueryCache.ExecuteQueryFromURLEncoded(encoded, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	stored, encoding, err := q.ReadStoredResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Close()
+	if encoding != "zstd" {
+		t.Fatalf("query results not stored zstd-compressed, but with encoding %q", encoding)
+	}
+
+	resfile, err := q.ReadResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resfile.Close()
+
+	rows := 0
+	resscan := bufio.NewScanner(resfile)
+	for resscan.Scan() {
+		var obs pto3.Observation
+		if err := obs.UnmarshalJSON(resscan.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		if obs.Condition.Name != "pto.test.color.blue" {
+			t.Fatalf("unexpected observation in compressed results: %s", resscan.Text())
+		}
+		rows++
+	}
+	if err := resscan.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rows == 0 || rows != q.ResultRowCount() {
+		t.Fatalf("expected %d rows in compressed results, got %d", q.ResultRowCount(), rows)
+	}
+
+	// rerunning without compression replaces the compressed results
+	TestConfig.CompressQueryCache = false
+	done = make(chan struct{})
+	if err := q.Rerun(done); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if q.ExecutionError != nil {
+		t.Fatal(q.ExecutionError)
+	}
+
+	stored, encoding, err = q.ReadStoredResultFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored.Close()
+	if encoding != "" {
+		t.Fatalf("rerun query results still stored with encoding %q", encoding)
+	}
+
+	diff, err := q.ReadDiff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(diff), `"removed_observations":0`) {
+		t.Fatalf("unexpected diff between identical results: %s", diff)
+	}
+}
@@ -0,0 +1,480 @@
+package pto3
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// QueryDiff reports the difference between the results of two executions of
+// the same query, for monitoring changes in path impairments over time.
+type QueryDiff struct {
+	// Completion time of the previous execution
+	Previous *time.Time `json:"previous"`
+	// Completion time of the current execution
+	Current *time.Time `json:"current"`
+	// Observations in the current results but not the previous
+	NewObservations []json.RawMessage `json:"new_observations,omitempty"`
+	// Count of observations in the previous results but not the current
+	RemovedObservations int `json:"removed_observations"`
+	// Paths appearing in the current results but not the previous
+	NewPaths []string `json:"new_paths,omitempty"`
+	// Paths appearing in the previous results but not the current
+	DisappearedPaths []string `json:"disappeared_paths,omitempty"`
+	// Observation sets in the current results but not the previous
+	NewSets []string `json:"new_sets,omitempty"`
+	// Observation sets in the previous results but not the current
+	DisappearedSets []string `json:"disappeared_sets,omitempty"`
+}
+
+func (qc *QueryCache) previousDataPath(identifier string) string {
+	return filepath.Join(qc.config.QueryCacheRoot, fmt.Sprintf("%s.prev.ndjson", identifier))
+}
+
+func (qc *QueryCache) diffPath(identifier string) string {
+	return filepath.Join(qc.config.QueryCacheRoot, fmt.Sprintf("%s.diff.json", identifier))
+}
+
+// DiffLink generates a link to the difference between this query's results
+// and those of its previous execution.
+func (q *Query) DiffLink() string {
+	link, _ := q.qc.config.LinkTo(fmt.Sprintf("query/%s/diff", q.Identifier))
+	return link
+}
+
+// hasDiff returns true if a diff against a previous execution is available.
+func (q *Query) hasDiff() bool {
+	_, err := os.Stat(q.qc.diffPath(q.Identifier))
+	return err == nil
+}
+
+// Rerun executes a completed query again, keeping its previous results, and
+// once it completes, computes the difference between the previous and
+// current results, available from ReadDiff. Only observation and set queries
+// can be rerun this way; group and set comparison queries return an error,
+// as do permanent queries, whose results are referenced from outside the
+// query cache and must not change.
+func (q *Query) Rerun(done chan struct{}) error {
+	if len(q.groups) > 0 {
+		return PTOErrorf("cannot compute differences between results of group query %s", q.Identifier).StatusIs(http.StatusBadRequest)
+	}
+	if q.compareMode != "" {
+		return PTOErrorf("cannot compute differences between results of set comparison query %s", q.Identifier).StatusIs(http.StatusBadRequest)
+	}
+
+	q.qc.lock.Lock()
+	defer q.qc.lock.Unlock()
+
+	if q.ExtRef != "" {
+		return PTOErrorf("query %s is permanent, so its results cannot be replaced", q.Identifier).StatusIs(http.StatusConflict)
+	}
+	if q.Completed == nil {
+		return PTOErrorf("query %s has not completed", q.Identifier).StatusIs(http.StatusConflict)
+	}
+	if q.ExecutionError != nil {
+		return PTOErrorf("query %s failed, so there are no results to compare against", q.Identifier).StatusIs(http.StatusConflict)
+	}
+
+	// keep the previous results for comparison, compressed or not as stored.
+	// They are linked rather than moved, so that clients reading the results
+	// can continue to do so until the new results replace them.
+	current, previous := q.qc.dataPath(q.Identifier), q.qc.previousDataPath(q.Identifier)
+	if existing := existingPath(current); existing != current {
+		current, previous = existing, previous+strings.TrimPrefix(existing, current)
+	}
+	q.removePreviousResults()
+	if err := os.Link(current, previous); err != nil {
+		return PTOWrapError(err)
+	}
+
+	// a difference from an earlier execution no longer applies
+	if err := os.Remove(q.qc.diffPath(q.Identifier)); err != nil && !os.IsNotExist(err) {
+		return PTOWrapError(err)
+	}
+
+	q.previousCompleted = q.Completed
+	q.Executed = nil
+	q.Completed = nil
+	q.resultRowCount = 0
+
+	q.Execute(done)
+	return nil
+}
+
+// removePreviousResults removes the results of this query's previous
+// execution, kept while rerunning it, whether stored compressed or not.
+func (q *Query) removePreviousResults() {
+	previous := q.qc.previousDataPath(q.Identifier)
+	for _, filename := range storedPaths(previous) {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			log.Printf("error removing previous results of query %s: %v", q.Identifier, err)
+		}
+	}
+}
+
+// diffSortChunkLines is the number of result lines sorted in memory at once
+// when comparing results; larger results are sorted in chunks written to
+// temporary files, then merged.
+const diffSortChunkLines = 1 << 18
+
+// maxResultLineBytes is the length of the longest result line that can be
+// compared.
+const maxResultLineBytes = 16 << 20
+
+// diffKey returns the key of a result line to compare results by.
+type diffKey func(line string) (string, error)
+
+func lineKey(line string) (string, error) {
+	return line, nil
+}
+
+func observationPathKey(line string) (string, error) {
+	jslice, _, _, err := splitObservationJSON([]byte(line))
+	if err != nil {
+		return "", PTOErrorf("bad observation in query result: %s", line)
+	}
+	return jslice[3], nil
+}
+
+// createDiffTemp creates a temporary file for comparing results in dir.
+func createDiffTemp(dir string) (*os.File, error) {
+	f, err := ioutil.TempFile(dir, "diff.*.tmp")
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return f, nil
+}
+
+// writeSortedKeys writes keys, which must be sorted, to a temporary file in
+// dir, and returns its name.
+func writeSortedKeys(dir string, keys []string) (string, error) {
+	f, err := createDiffTemp(dir)
+	if err != nil {
+		return "", err
+	}
+
+	out := bufio.NewWriter(f)
+	for _, k := range keys {
+		out.WriteString(k)
+		out.WriteByte('\n')
+	}
+	if err := out.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", PTOWrapError(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", PTOWrapError(err)
+	}
+	return f.Name(), nil
+}
+
+// sortedLines reads lines from a sorted file, skipping duplicates.
+type sortedLines struct {
+	f       *os.File
+	scanner *bufio.Scanner
+	line    string
+	ok      bool
+}
+
+func openSortedLines(filename string) (*sortedLines, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	sl := &sortedLines{f: f, scanner: bufio.NewScanner(f)}
+	sl.scanner.Buffer(nil, maxResultLineBytes)
+	return sl, sl.next()
+}
+
+// next advances to the next distinct line; ok is false at the end.
+func (sl *sortedLines) next() error {
+	prev, hadPrev := sl.line, sl.ok
+	for sl.scanner.Scan() {
+		sl.line = sl.scanner.Text()
+		if !hadPrev || sl.line != prev {
+			sl.ok = true
+			return nil
+		}
+	}
+	sl.ok = false
+	if err := sl.scanner.Err(); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+func (sl *sortedLines) Close() error {
+	return sl.f.Close()
+}
+
+// sortResultKeys writes the distinct keys of the lines of a result file,
+// compressed or not, sorted, to a temporary file in dir, and returns its
+// name. The caller must remove the file.
+func sortResultKeys(dir string, filename string, key diffKey) (string, error) {
+	in, err := openResultFile(existingPath(filename))
+	if err != nil {
+		return "", PTOWrapError(err)
+	}
+	defer in.Close()
+
+	// sort in chunks, merging the chunks if there is more than one
+	var chunks []string
+	defer func() {
+		for _, chunk := range chunks {
+			os.Remove(chunk)
+		}
+	}()
+
+	keys := make([]string, 0)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, maxResultLineBytes)
+	for {
+		more := scanner.Scan()
+		if more {
+			k, err := key(scanner.Text())
+			if err != nil {
+				return "", err
+			}
+			keys = append(keys, k)
+		}
+
+		if len(keys) > 0 && (!more || len(keys) >= diffSortChunkLines) {
+			sort.Strings(keys)
+			chunk, err := writeSortedKeys(dir, keys)
+			if err != nil {
+				return "", err
+			}
+			chunks = append(chunks, chunk)
+			keys = keys[:0]
+		}
+
+		if !more {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", PTOWrapError(err)
+	}
+
+	switch len(chunks) {
+	case 0:
+		return writeSortedKeys(dir, nil)
+	case 1:
+		sorted := chunks[0]
+		chunks = nil
+		return sorted, nil
+	}
+
+	return mergeSortedFiles(dir, chunks)
+}
+
+// mergeSortedFiles merges sorted files into a temporary file in dir, without
+// duplicates, and returns its name.
+func mergeSortedFiles(dir string, filenames []string) (string, error) {
+	inputs := make([]*sortedLines, 0, len(filenames))
+	defer func() {
+		for _, in := range inputs {
+			in.Close()
+		}
+	}()
+	for _, filename := range filenames {
+		in, err := openSortedLines(filename)
+		if in != nil {
+			inputs = append(inputs, in)
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	f, err := createDiffTemp(dir)
+	if err != nil {
+		return "", err
+	}
+	out := bufio.NewWriter(f)
+
+	fail := func(err error) (string, error) {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	// there are few chunks, so find the least line by linear search
+	var last string
+	wrote := false
+	for {
+		var least *sortedLines
+		for _, in := range inputs {
+			if in.ok && (least == nil || in.line < least.line) {
+				least = in
+			}
+		}
+		if least == nil {
+			break
+		}
+
+		if !wrote || least.line != last {
+			out.WriteString(least.line)
+			out.WriteByte('\n')
+			last, wrote = least.line, true
+		}
+		if err := least.next(); err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := out.Flush(); err != nil {
+		return fail(PTOWrapError(err))
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", PTOWrapError(err)
+	}
+	return f.Name(), nil
+}
+
+// diffResultFiles compares the keys of the lines of two result files by
+// sorting each and merging them, calling added for each key found only in
+// the current results, and removed for each key found only in the previous
+// results, in order.
+func diffResultFiles(dir string, prevfile string, curfile string, key diffKey, added func(string) error, removed func(string) error) error {
+	prevsorted, err := sortResultKeys(dir, prevfile, key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(prevsorted)
+
+	cursorted, err := sortResultKeys(dir, curfile, key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(cursorted)
+
+	prev, err := openSortedLines(prevsorted)
+	if prev != nil {
+		defer prev.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	cur, err := openSortedLines(cursorted)
+	if cur != nil {
+		defer cur.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	for prev.ok || cur.ok {
+		switch {
+		case !cur.ok || (prev.ok && prev.line < cur.line):
+			if err := removed(prev.line); err != nil {
+				return err
+			}
+			err = prev.next()
+		case !prev.ok || cur.line < prev.line:
+			if err := added(cur.line); err != nil {
+				return err
+			}
+			err = cur.next()
+		default:
+			if err = prev.next(); err == nil {
+				err = cur.next()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unmarshalLink returns a function appending set links, stored as JSON
+// strings in result lines, to a list.
+func unmarshalLink(links *[]string) func(string) error {
+	return func(line string) error {
+		var link string
+		if err := json.Unmarshal([]byte(line), &link); err != nil {
+			return PTOWrapError(err)
+		}
+		*links = append(*links, link)
+		return nil
+	}
+}
+
+// writeDiff compares this query's current results with those of its previous
+// execution, and stores the difference in the query cache. Results are
+// compared by sorting and merging, so that neither needs to fit in memory.
+func (q *Query) writeDiff() error {
+	dir := q.qc.config.QueryCacheRoot
+	prevfile, curfile := q.qc.previousDataPath(q.Identifier), q.qc.dataPath(q.Identifier)
+
+	diff := QueryDiff{Previous: q.previousCompleted, Current: q.Completed}
+
+	if q.optionSetsOnly {
+		if err := diffResultFiles(dir, prevfile, curfile, lineKey,
+			unmarshalLink(&diff.NewSets), unmarshalLink(&diff.DisappearedSets)); err != nil {
+			return err
+		}
+	} else {
+		if err := diffResultFiles(dir, prevfile, curfile, lineKey,
+			func(line string) error {
+				diff.NewObservations = append(diff.NewObservations, json.RawMessage(line))
+				return nil
+			},
+			func(line string) error {
+				diff.RemovedObservations++
+				return nil
+			}); err != nil {
+			return err
+		}
+
+		if err := diffResultFiles(dir, prevfile, curfile, observationPathKey,
+			func(path string) error {
+				diff.NewPaths = append(diff.NewPaths, path)
+				return nil
+			},
+			func(path string) error {
+				diff.DisappearedPaths = append(diff.DisappearedPaths, path)
+				return nil
+			}); err != nil {
+			return err
+		}
+	}
+
+	b, err := json.Marshal(&diff)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	if err := ioutil.WriteFile(q.qc.diffPath(q.Identifier), b, 0644); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
+}
+
+// ReadDiff returns the difference between this query's results and those of
+// its previous execution, as a JSON object.
+func (q *Query) ReadDiff() ([]byte, error) {
+	b, err := ioutil.ReadFile(q.qc.diffPath(q.Identifier))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, PTOErrorf("no previous execution of query %s to compare against", q.Identifier).StatusIs(http.StatusNotFound)
+		}
+		return nil, PTOWrapError(err)
+	}
+	return b, nil
+}
@@ -0,0 +1,182 @@
+package pto3
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the requests a client may make to the web API.
+type RateLimit struct {
+	// Sustained rate of requests, per second; 0 for no limit
+	Rate float64
+	// Number of requests which may be made in a burst after being idle; 0
+	// for one second's worth at Rate, and at least one
+	Burst int
+	// Maximum number of requests in progress at once; 0 for no limit
+	Concurrency int
+}
+
+// burst returns the size of the token bucket for this limit.
+func (limit RateLimit) burst() float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return math.Max(1, math.Ceil(limit.Rate))
+}
+
+// RateLimitOptions configures limits on the requests each client may make
+// to the web API.
+type RateLimitOptions struct {
+	// Limits for clients without limits of their own
+	Default RateLimit
+
+	// Limits by client, identified by the ID of its API key, as in the access
+	// log and the __submitter of its queries
+	Keys map[string]RateLimit
+}
+
+// limitFor returns the limits on the requests of a client.
+func (opts *RateLimitOptions) limitFor(client string) RateLimit {
+	if limit, ok := opts.Keys[client]; ok {
+		return limit
+	}
+	return opts.Default
+}
+
+// validate returns an error if any limit is negative.
+func (opts *RateLimitOptions) validate() error {
+	check := func(who string, limit RateLimit) error {
+		if limit.Rate < 0 || limit.Burst < 0 || limit.Concurrency < 0 {
+			return PTOErrorf("RateLimits for %s may not be negative", who)
+		}
+		return nil
+	}
+	if err := check("default", opts.Default); err != nil {
+		return err
+	}
+	for key, limit := range opts.Keys {
+		if err := check(key, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rateLimiterSweepInterval is the minimum interval between sweeps of idle
+// clients from a RateLimiter.
+const rateLimiterSweepInterval = time.Minute
+
+// clientRate is the state of a client's requests in a RateLimiter.
+type clientRate struct {
+	avail    float64
+	last     time.Time
+	inFlight int
+}
+
+// RateLimiter admits the requests of each client while they are within its
+// RateLimit, so that no one client can monopolize the server. The rate of
+// requests is limited with a token bucket per client, refilled like a
+// BandwidthLimiter, and requests in progress are counted until released. A
+// nil RateLimiter admits every request.
+type RateLimiter struct {
+	opts *RateLimitOptions
+
+	lock      sync.Mutex
+	clients   map[string]*clientRate
+	lastSweep time.Time
+}
+
+// NewRateLimiter creates a limiter with the given options, or returns nil,
+// admitting every request, if the options are nil.
+func NewRateLimiter(opts *RateLimitOptions) *RateLimiter {
+	if opts == nil {
+		return nil
+	}
+
+	return &RateLimiter{
+		opts:      opts,
+		clients:   make(map[string]*clientRate),
+		lastSweep: time.Now(),
+	}
+}
+
+// Admit admits a request from the given client, returning a function to call
+// once the request has been served. If the client has exceeded its rate or
+// has as many requests in progress as it may, it returns an error with status
+// 429, and the time after which to retry.
+func (rl *RateLimiter) Admit(client string) (func(), time.Duration, error) {
+	if rl == nil {
+		return func() {}, 0, nil
+	}
+
+	limit := rl.opts.limitFor(client)
+	if limit.Rate == 0 && limit.Concurrency == 0 {
+		return func() {}, 0, nil
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	cr := rl.clients[client]
+	if cr == nil {
+		cr = &clientRate{avail: limit.burst(), last: now}
+		rl.clients[client] = cr
+	}
+
+	if limit.Concurrency > 0 && cr.inFlight >= limit.Concurrency {
+		return nil, time.Second, PTOErrorf("too many concurrent requests; at most %d allowed", limit.Concurrency).
+			StatusIs(http.StatusTooManyRequests).CodeIs(ErrorCodeConcurrencyLimit)
+	}
+
+	if limit.Rate > 0 {
+		// replenish the bucket for the time since the last request
+		cr.avail += now.Sub(cr.last).Seconds() * limit.Rate
+		if burst := limit.burst(); cr.avail > burst {
+			cr.avail = burst
+		}
+		cr.last = now
+
+		if cr.avail < 1 {
+			retry := time.Duration((1 - cr.avail) / limit.Rate * float64(time.Second))
+			return nil, retry, PTOErrorf("request rate exceeded; at most %g per second allowed", limit.Rate).
+				StatusIs(http.StatusTooManyRequests).CodeIs(ErrorCodeRateLimit)
+		}
+		cr.avail--
+	}
+
+	cr.inFlight++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rl.lock.Lock()
+			cr.inFlight--
+			rl.lock.Unlock()
+		})
+	}, 0, nil
+}
+
+// sweep forgets clients with no requests in progress whose buckets have been
+// refilled, so that the limiter does not grow with every client it has seen.
+// It must be called with the lock held.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+
+	for client, cr := range rl.clients {
+		if cr.inFlight > 0 {
+			continue
+		}
+		limit := rl.opts.limitFor(client)
+		if limit.Rate > 0 && cr.avail+now.Sub(cr.last).Seconds()*limit.Rate < limit.burst() {
+			continue
+		}
+		delete(rl.clients, client)
+	}
+}
@@ -1,6 +1,11 @@
 package pto3
 
 import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -53,6 +58,26 @@ type RawMetadata struct {
 	creatime *time.Time
 	// Metadata modification time
 	modtime *time.Time
+	// Other virtual metadata, from virtual metadata providers
+	virtual map[string]interface{}
+}
+
+// SetVirtual sets a virtual metadata key, which must begin with __, for use
+// by virtual metadata providers. Virtual metadata is not inherited.
+func (md *RawMetadata) SetVirtual(k string, v interface{}) {
+	if !strings.HasPrefix(k, "__") {
+		panic("virtual metadata key " + k + " must begin with __")
+	}
+	if md.virtual == nil {
+		md.virtual = make(map[string]interface{})
+	}
+	md.virtual[k] = v
+}
+
+// GetVirtual returns the value of a virtual metadata key set by a virtual
+// metadata provider, or nil if it is not set.
+func (md *RawMetadata) GetVirtual(k string) interface{} {
+	return md.virtual[k]
 }
 
 func (md *RawMetadata) Keys(inherit bool) []string {
@@ -140,7 +165,8 @@ func (md *RawMetadata) ModificationTime() *time.Time {
 
 // DumpJSONObject serializes a RawMetadata object to JSON. If inherit is true,
 // this inherits data and metadata items from the parent; if false, it only
-// dumps information in this object itself.
+// dumps information in this object itself. The result is canonical JSON (see
+// CanonicalizeJSON).
 func (md *RawMetadata) DumpJSONObject(inherit bool) ([]byte, error) {
 	jmap := make(map[string]interface{})
 
@@ -182,12 +208,16 @@ func (md *RawMetadata) DumpJSONObject(inherit bool) ([]byte, error) {
 		jmap["__modified"] = md.modtime.Format(time.RFC3339)
 	}
 
+	for k, v := range md.virtual {
+		jmap[k] = v
+	}
+
 	// dump arbitrary keys
 	for _, k := range md.Keys(inherit) {
 		jmap[k] = md.Get(k, inherit)
 	}
 
-	return json.Marshal(jmap)
+	return MarshalCanonicalJSON(jmap)
 }
 
 // MarshalJSON serializes a RawMetadata object to JSON. All values inherited
@@ -333,19 +363,30 @@ type Campaign struct {
 
 	// lock on metadata structures
 	lock sync.RWMutex
+
+	// recent changes to the campaign
+	changes *changeLog
+
+	// unwrapped data key for encrypted campaigns, once loaded
+	key []byte
+
+	// lock on data key
+	keyLock sync.Mutex
 }
 
 // newCampaign creates a new campaign object bound the path of a directory on
 // disk containing the campaign's files. If a pointer to metadata is given, it
 // creates a new campaign directory on disk with the given metadata. Error can
-// be ignored if metadata is nil.
-func newCampaign(config *PTOConfiguration, name string, md *RawMetadata) (*Campaign, error) {
+// be ignored if metadata is nil. Changes to the campaign are recorded in the
+// given change log.
+func newCampaign(config *PTOConfiguration, name string, md *RawMetadata, changes *changeLog) (*Campaign, error) {
 
 	cam := &Campaign{
 		config:       config,
 		path:         filepath.Join(config.RawRoot, name),
 		stale:        true,
 		fileMetadata: make(map[string]*RawMetadata),
+		changes:      changes,
 	}
 
 	// metadata means try to create new campaign
@@ -355,6 +396,9 @@ func newCampaign(config *PTOConfiguration, name string, md *RawMetadata) (*Campa
 		if err := md.validate(true); err != nil {
 			return nil, err
 		}
+		if err := cam.checkEncryption(md); err != nil {
+			return nil, err
+		}
 
 		// then check to see if the campaign directory exists
 		_, err := os.Stat(cam.path)
@@ -383,6 +427,11 @@ func newCampaign(config *PTOConfiguration, name string, md *RawMetadata) (*Campa
 
 }
 
+// name returns the name of this campaign.
+func (cam *Campaign) name() string {
+	return filepath.Base(cam.path)
+}
+
 // reloadMetadata reloads the metadata for this campaign and its files from disk
 func (cam *Campaign) reloadMetadata(force bool) error {
 	var err error
@@ -454,17 +503,199 @@ func (cam *Campaign) PutCampaignMetadata(md *RawMetadata) error {
 	if err := md.validate(true); err != nil {
 		return err
 	}
+	if err := cam.checkEncryption(md); err != nil {
+		return err
+	}
 
 	// write to campaign metadata file
 	if err := md.writeToFile(filepath.Join(cam.path, CampaignMetadataFilename)); err != nil {
 		return err
 	}
 
-	// update metadata cache
+	// update metadata cache, and make files inherit from the new metadata
 	cam.campaignMetadata = md
+	cam.changes.append(ChangeMetadataChanged, "")
+	return cam.reparentFiles()
+}
+
+// reparentFiles makes every file's metadata inherit from the current campaign
+// metadata, updating virtual metadata as the filetype may have changed. Not
+// concurrency safe: caller must hold the campaign lock.
+func (cam *Campaign) reparentFiles() error {
+	for filename, filemd := range cam.fileMetadata {
+		filemd.Parent = cam.campaignMetadata
+		if err := cam.updateFileVirtualMetadata(filename); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// InheritedMetadataChange describes a change to the effective value of a
+// metadata key a file inherits from its campaign. Values are given as they
+// appear in JSON metadata; an empty value means the key is not present.
+type InheritedMetadataChange struct {
+	Key string `json:"key"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// effectiveMetadata returns the values of all the keys in a metadata object,
+// including those inherited from its parent, as strings.
+func (md *RawMetadata) effectiveMetadata() map[string]string {
+	out := make(map[string]string)
+
+	if ft := md.Filetype(true); ft != "" {
+		out["_file_type"] = ft
+	}
+	if ow := md.Owner(true); ow != "" {
+		out["_owner"] = ow
+	}
+	if ts := md.TimeStart(true); ts != nil {
+		out["_time_start"] = ts.Format(time.RFC3339)
+	}
+	if te := md.TimeEnd(true); te != nil {
+		out["_time_end"] = te.Format(time.RFC3339)
+	}
+	for _, k := range md.Keys(true) {
+		if v := md.Get(k, true); v != "" {
+			out[k] = v
+		}
+	}
+
+	return out
+}
+
+// inheritedMetadataChanges returns the changes to the effective metadata of
+// each file in this campaign which would result from replacing the campaign
+// metadata with the given metadata, by filename. Files whose effective
+// metadata would not change are omitted. Not concurrency safe: caller must
+// hold the campaign lock.
+func (cam *Campaign) inheritedMetadataChanges(md *RawMetadata) map[string][]InheritedMetadataChange {
+	out := make(map[string][]InheritedMetadataChange)
+
+	for filename, filemd := range cam.fileMetadata {
+		before := filemd.effectiveMetadata()
+
+		reparented := *filemd
+		reparented.Parent = md
+		after := reparented.effectiveMetadata()
+
+		keys := make([]string, 0)
+		for k := range before {
+			if before[k] != after[k] {
+				keys = append(keys, k)
+			}
+		}
+		for k := range after {
+			if _, ok := before[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			out[filename] = append(out[filename], InheritedMetadataChange{Key: k, Old: before[k], New: after[k]})
+		}
+	}
+
+	return out
+}
+
+// PreviewCampaignMetadata returns the changes to the effective metadata of
+// each file in this campaign which would result from overwriting the metadata
+// for this campaign with the given metadata, by filename, without changing
+// anything. Files whose effective metadata would not change are omitted.
+func (cam *Campaign) PreviewCampaignMetadata(md *RawMetadata) (map[string][]InheritedMetadataChange, error) {
+	// reload if stale
+	if err := cam.reloadMetadata(false); err != nil {
+		return nil, err
+	}
+
+	cam.lock.RLock()
+	defer cam.lock.RUnlock()
+
+	if err := md.validate(true); err != nil {
+		return nil, err
+	}
+
+	return cam.inheritedMetadataChanges(md), nil
+}
+
+// PutCampaignMetadataPinned overwrites the metadata for this campaign with
+// the given metadata, as PutCampaignMetadata, but first pins the current
+// effective values of inherited keys which would change onto each affected
+// file, so that the files' effective metadata stays the same. It returns the
+// changes that were avoided by pinning, by filename. Keys which a file does
+// not have before the change cannot be pinned, so files still inherit keys
+// newly added to the campaign.
+func (cam *Campaign) PutCampaignMetadataPinned(md *RawMetadata) (map[string][]InheritedMetadataChange, error) {
+	// reload if stale
+	if err := cam.reloadMetadata(false); err != nil {
+		return nil, err
+	}
+
+	cam.lock.Lock()
+	defer cam.lock.Unlock()
+
+	if err := md.validate(true); err != nil {
+		return nil, err
+	}
+	if err := cam.checkEncryption(md); err != nil {
+		return nil, err
+	}
+
+	changes := cam.inheritedMetadataChanges(md)
+	pinned := make(map[string][]InheritedMetadataChange)
+
+	for filename, filechanges := range changes {
+		filemd := cam.fileMetadata[filename]
+		for _, change := range filechanges {
+			if change.Old == "" {
+				continue
+			}
+
+			switch change.Key {
+			case "_file_type":
+				filemd.filetype = change.Old
+			case "_owner":
+				filemd.owner = change.Old
+			case "_time_start":
+				filemd.timeStart = filemd.TimeStart(true)
+			case "_time_end":
+				filemd.timeEnd = filemd.TimeEnd(true)
+			default:
+				if filemd.Metadata == nil {
+					filemd.Metadata = make(map[string]string)
+				}
+				filemd.Metadata[change.Key] = change.Old
+			}
+			pinned[filename] = append(pinned[filename], change)
+		}
+
+		if _, ok := pinned[filename]; ok {
+			if err := filemd.writeToFile(filepath.Join(cam.path, filename+FileMetadataSuffix)); err != nil {
+				return nil, err
+			}
+			cam.changes.append(ChangeMetadataChanged, filename)
+		}
+	}
+
+	// write to campaign metadata file
+	if err := md.writeToFile(filepath.Join(cam.path, CampaignMetadataFilename)); err != nil {
+		return nil, err
+	}
+
+	// update metadata cache, and make files inherit from the new metadata
+	cam.campaignMetadata = md
+	cam.changes.append(ChangeMetadataChanged, "")
+	if err := cam.reparentFiles(); err != nil {
+		return nil, err
+	}
+
+	return pinned, nil
+}
+
 // FileNames returns a sorted  list of filenames currently in the campaign.
 func (cam *Campaign) FileNames() ([]string, error) {
 	// reload if stale
@@ -504,7 +735,8 @@ func (cam *Campaign) GetFileMetadata(filename string) (*RawMetadata, error) {
 	return filemd, nil
 }
 
-// updateFileVirtualMetadata fills in the system virtual metadata for a file.
+// updateFileVirtualMetadata fills in the system virtual metadata for a file,
+// by running the virtual metadata providers configured for its filetype.
 // Not concurrency safe: caller must hold the campaign lock.
 func (cam *Campaign) updateFileVirtualMetadata(filename string) error {
 	// get file metadata
@@ -513,42 +745,18 @@ func (cam *Campaign) updateFileVirtualMetadata(filename string) error {
 		return PTONotFoundError("file", filename)
 	}
 
-	// get file size and creation time
-	// file creation time is modification time of the datafile,
-	// since datafiles are immutable.
-	datafi, err := os.Stat(filepath.Join(cam.path, filename))
-	if err == nil {
-		md.datasize = int(datafi.Size())
-		modtime := datafi.ModTime()
-		md.creatime = &modtime
-	} else if os.IsNotExist(err) {
-		md.datasize = 0
-		md.creatime = nil
-	} else {
-		return err
-	}
-
-	// get modification time (from metadata file modification time)
-	metafi, err := os.Stat(filepath.Join(cam.path, filename+FileMetadataSuffix))
-	if err == nil {
-		modtime := metafi.ModTime()
-		md.modtime = &modtime
-
-		if md.creatime == nil {
-			// creation time is the same as modification time if there is no datafile yet
-			md.creatime = md.modtime
-		} else if md.creatime.Sub(*md.modtime) > 0 {
-			// modification time cannot be before creation time
-			md.modtime = md.creatime
+	// start over, so that stale virtuals don't survive changes to the file
+	md.virtual = nil
+	for i, provider := range cam.config.VirtualMetadataProvidersFor(md.Filetype(true)) {
+		if err := provider.Update(cam, filename, md); err != nil {
+			// only the file provider is essential; a file another provider
+			// can't handle shouldn't make its campaign unreadable
+			if i == 0 {
+				return err
+			}
+			log.Printf("error deriving %s virtual metadata for %s/%s: %s",
+				provider.Name, filepath.Base(cam.path), filename, err.Error())
 		}
-	} else {
-		return err
-	}
-
-	// generate data path
-	md.datalink, err = cam.config.LinkTo("raw/" + filepath.Base(cam.path) + "/" + filename + "/data")
-	if err != nil {
-		return err
 	}
 
 	return nil
@@ -581,6 +789,7 @@ func (cam *Campaign) PutFileMetadata(filename string, md *RawMetadata) error {
 
 	// update metadata cache
 	cam.fileMetadata[filename] = md
+	cam.changes.append(ChangeMetadataChanged, filename)
 
 	// and update virtuals
 	return cam.updateFileVirtualMetadata(filename)
@@ -608,16 +817,108 @@ func (cam *Campaign) GetFiletype(filename string) *RawFiletype {
 	return &RawFiletype{ftname, ctype}
 }
 
-// ReadFileData opens and returns the data file associated with a filename on this campaign for reading.
-func (cam *Campaign) ReadFileData(filename string) (*os.File, error) {
+// SeekableSuffix is appended to the name of a data file stored in the zstd
+// seekable format; see SeekableCompressionThreshold.
+const SeekableSuffix = ".zst"
+
+// RawDataFile is a data file opened for reading. Reads, seeks, and the size
+// returned by Stat refer to the data as uploaded, whether the file is stored
+// as is or compressed in the zstd seekable format.
+type RawDataFile interface {
+	io.ReadSeeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+// ReadFileData opens and returns the data file associated with a filename on
+// this campaign for reading, decompressing it if it is stored in the zstd
+// seekable format, and decrypting it if it is stored encrypted.
+func (cam *Campaign) ReadFileData(filename string) (RawDataFile, error) {
+	if err := checkFilename(filename); err != nil {
+		return nil, err
+	}
+
 	// build a local filesystem path and validate it
 	rawpath := filepath.Clean(filepath.Join(cam.path, filename))
 	if pathok, _ := filepath.Match(filepath.Join(cam.path, "*"), rawpath); !pathok {
 		return nil, PTOErrorf("path %s is not ok", rawpath).StatusIs(http.StatusInternalServerError)
 	}
 
-	// open the file
-	return os.Open(rawpath)
+	// open the file, falling back to a compressed or encrypted one
+	f, err := os.Open(rawpath)
+	if os.IsNotExist(err) {
+		if sr, serr := OpenSeekable(rawpath + SeekableSuffix); serr == nil {
+			return sr, nil
+		} else if !os.IsNotExist(serr) {
+			return nil, serr
+		}
+
+		if _, serr := os.Stat(rawpath + EncryptedSuffix); serr == nil {
+			key, kerr := cam.dataKey(false)
+			if kerr != nil {
+				return nil, kerr
+			}
+			return OpenEncrypted(rawpath+EncryptedSuffix, key, filename)
+		} else if !os.IsNotExist(serr) {
+			return nil, serr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// statFileData returns information about the data file associated with a
+// filename on this campaign, with the size of the data as uploaded.
+func (cam *Campaign) statFileData(filename string) (os.FileInfo, error) {
+	f, err := cam.ReadFileData(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Stat()
+}
+
+// compressFileData stores a data file in the zstd seekable format, replacing
+// the uncompressed file.
+func (cam *Campaign) compressFileData(filename string) error {
+	rawpath := filepath.Join(cam.path, filename)
+	in, err := os.Open(rawpath)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	defer in.Close()
+
+	// compress to a temporary file, so that a partial file is never read
+	temppath := rawpath + SeekableSuffix + ".tmp"
+	out, err := CreateSeekable(temppath)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(temppath)
+		return PTOWrapError(err)
+	}
+
+	if err := out.Close(); err != nil {
+		os.Remove(temppath)
+		return err
+	}
+
+	if err := os.Rename(temppath, rawpath+SeekableSuffix); err != nil {
+		os.Remove(temppath)
+		return PTOWrapError(err)
+	}
+
+	if err := os.Remove(rawpath); err != nil {
+		return PTOWrapError(err)
+	}
+
+	return nil
 }
 
 // ReadFileDataToStream copies data from the data file associated with a
@@ -637,21 +938,201 @@ func (cam *Campaign) ReadFileDataToStream(filename string, out io.Writer) error
 	return nil
 }
 
-// WriteDataFile creates, open and returns the data file associated with a
-// filename on this campaign for writing.If force is true, replaces the data
-// file if it exists; otherwise, returns an error if the data file exists.
-func (cam *Campaign) WriteFileData(filename string, force bool) (*os.File, error) {
+// MaxExcerptLength is the maximum length in bytes of an excerpt returned by
+// ReadFileExcerpt.
+const MaxExcerptLength = 1 << 20
+
+// ReadFileExcerpt returns the part of the data file associated with a
+// filename on this campaign that a source reference points to: for a record
+// reference, the record (line) with that number, counting from zero, and for
+// an offset reference, length bytes starting at that offset, or the rest of
+// the line if length is 0. Offsets and records in bzip2-compressed files
+// (those with filetypes ending in -bz2) refer to the uncompressed data; files
+// stored in the zstd seekable format are read from the frame containing the
+// offset. Excerpts are truncated to MaxExcerptLength bytes.
+func (cam *Campaign) ReadFileExcerpt(filename string, ref *SourceRef, length int) ([]byte, error) {
+	md, err := cam.GetFileMetadata(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := cam.ReadFileData(filename)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	defer f.Close()
+
+	var in io.Reader = f
+	compressed := strings.HasSuffix(md.Filetype(true), "-bz2")
+	if compressed {
+		in = bzip2.NewReader(f)
+	}
+
+	if ref.Offset != nil {
+		// seek if we can, otherwise skip decompressed data
+		if compressed {
+			if n, err := io.CopyN(ioutil.Discard, in, *ref.Offset); err == io.EOF {
+				return nil, PTOErrorf("offset %d beyond end of %s (%d bytes)", *ref.Offset, filename, n).StatusIs(http.StatusNotFound)
+			} else if err != nil {
+				return nil, PTOWrapError(err)
+			}
+		} else {
+			fi, err := f.Stat()
+			if err != nil {
+				return nil, PTOWrapError(err)
+			}
+			if *ref.Offset >= fi.Size() {
+				return nil, PTOErrorf("offset %d beyond end of %s (%d bytes)", *ref.Offset, filename, fi.Size()).StatusIs(http.StatusNotFound)
+			}
+			if _, err := f.Seek(*ref.Offset, io.SeekStart); err != nil {
+				return nil, PTOWrapError(err)
+			}
+		}
+
+		if length > 0 {
+			if length > MaxExcerptLength {
+				length = MaxExcerptLength
+			}
+			excerpt := make([]byte, length)
+			n, err := io.ReadFull(in, excerpt)
+			if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+				return nil, PTOWrapError(err)
+			}
+			return excerpt[:n], nil
+		}
+
+		excerpt, _, err := readExcerptLine(bufio.NewReader(in))
+		return excerpt, err
+	}
+
+	if ref.Record == nil {
+		return nil, PTOErrorf("source reference has neither offset nor record").StatusIs(http.StatusBadRequest)
+	}
+
+	// skip records up to the one we want
+	lines := bufio.NewReader(in)
+	for i := int64(0); i <= *ref.Record; i++ {
+		excerpt, eof, err := readExcerptLine(lines)
+		if err != nil {
+			return nil, err
+		}
+		if i == *ref.Record {
+			return excerpt, nil
+		}
+		if eof {
+			return nil, PTOErrorf("record %d beyond end of %s (%d records)", *ref.Record, filename, i+1).StatusIs(http.StatusNotFound)
+		}
+	}
+
+	return nil, nil
+}
+
+// readExcerptLine reads a line of at most MaxExcerptLength bytes, without
+// its line ending, skipping the rest of longer lines. It returns true if the
+// line was the last in the input.
+func readExcerptLine(r *bufio.Reader) ([]byte, bool, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if len(line) < MaxExcerptLength {
+			line = append(line, chunk...)
+		}
+
+		switch err {
+		case nil:
+			if len(line) > MaxExcerptLength {
+				line = line[:MaxExcerptLength]
+			}
+			line = bytes.TrimRight(line, "\r\n")
+			_, err := r.Peek(1)
+			return line, err == io.EOF, nil
+		case bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			if len(line) > MaxExcerptLength {
+				line = line[:MaxExcerptLength]
+			}
+			return line, true, nil
+		default:
+			return nil, false, PTOWrapError(err)
+		}
+	}
+}
+
+// checkFilename returns an error if a filename does not name a file directly
+// within a campaign directory: if it is empty, . or .., or contains a path
+// separator.
+func checkFilename(filename string) error {
+	if filename == "" || filename == "." || filename == ".." || strings.ContainsAny(filename, "/"+string(filepath.Separator)) {
+		return PTOErrorf("bad filename %s", filename).StatusIs(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// dataFilePath returns the local filesystem path of the data file associated
+// with a filename on this campaign, as uploaded. Unless force is true, it
+// returns an error if the data file exists in any form.
+func (cam *Campaign) dataFilePath(filename string, force bool) (string, error) {
+	if err := checkFilename(filename); err != nil {
+		return "", err
+	}
+
 	// build a local filesystem path and validate it
 	rawpath := filepath.Clean(filepath.Join(cam.path, filename))
 	if pathok, _ := filepath.Match(filepath.Join(cam.path, "*"), rawpath); !pathok {
-		return nil, PTOErrorf("path %s is not ok", rawpath).StatusIs(http.StatusInternalServerError)
+		return "", PTOErrorf("path %s is not ok", rawpath).StatusIs(http.StatusInternalServerError)
 	}
 
-	// ensure file isn't there unless we're forcing overwrite
+	// ensure file isn't there, stored any way, unless we're forcing
+	// overwrite
 	if !force {
-		_, err := os.Stat(rawpath)
-		if (err == nil) || !os.IsNotExist(err) {
-			return nil, PTOExistsError("file", filename)
+		for _, pathname := range []string{rawpath, rawpath + SeekableSuffix, rawpath + EncryptedSuffix} {
+			_, err := os.Stat(pathname)
+			if (err == nil) || !os.IsNotExist(err) {
+				return "", PTOExistsError("file", filename)
+			}
+		}
+	}
+
+	return rawpath, nil
+}
+
+// removeShadowingFiles removes any stored form of the data file at rawpath
+// other than the one at keeppath, as a compressed or encrypted file would
+// shadow a new plain one, and vice versa.
+func removeShadowingFiles(rawpath string, keeppath string) error {
+	for _, pathname := range []string{rawpath, rawpath + SeekableSuffix, rawpath + EncryptedSuffix} {
+		if pathname != keeppath {
+			if err := os.Remove(pathname); err != nil && !os.IsNotExist(err) {
+				return PTOWrapError(err)
+			}
+		}
+	}
+	return nil
+}
+
+// WriteDataFile creates, open and returns the data file associated with a
+// filename on this campaign for writing.If force is true, replaces the data
+// file if it exists; otherwise, returns an error if the data file exists.
+// Data written to the file is stored as is, so WriteFileData returns an error
+// for encrypted campaigns; use WriteFileDataFromStream instead.
+func (cam *Campaign) WriteFileData(filename string, force bool) (*os.File, error) {
+	encrypted, err := cam.IsEncrypted()
+	if err != nil {
+		return nil, err
+	}
+	if encrypted {
+		return nil, PTOErrorf("campaign %s is encrypted", cam.name())
+	}
+
+	rawpath, err := cam.dataFilePath(filename, force)
+	if err != nil {
+		return nil, err
+	}
+
+	if force {
+		if err := removeShadowingFiles(rawpath, rawpath); err != nil {
+			return nil, err
 		}
 	}
 
@@ -659,30 +1140,160 @@ func (cam *Campaign) WriteFileData(filename string, force bool) (*os.File, error
 	return os.Create(rawpath)
 }
 
+// rawDataWriter is a data file opened for writing. Close flushes the file to
+// disk.
+type rawDataWriter interface {
+	io.WriteCloser
+	Name() string
+}
+
+// syncedFile is a plain data file opened for writing, synced on close.
+type syncedFile struct {
+	*os.File
+}
+
+func (f syncedFile) Close() error {
+	if err := f.File.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
+
+// createFileData creates and opens a temporary file for writing the data
+// file associated with a filename on this campaign, encrypting it if the
+// campaign is encrypted. It returns the path of the data file as uploaded,
+// and the path the temporary file is to be installed at by installFileData
+// once written.
+func (cam *Campaign) createFileData(filename string, force bool) (rawDataWriter, string, string, error) {
+	encrypted, err := cam.IsEncrypted()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	rawpath, err := cam.dataFilePath(filename, force)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	datapath := rawpath
+	if encrypted {
+		datapath = rawpath + EncryptedSuffix
+	}
+
+	f, err := ioutil.TempFile(cam.path, filepath.Base(datapath)+".*.tmp")
+	if err != nil {
+		return nil, "", "", PTOWrapError(err)
+	}
+
+	if !encrypted {
+		if err := f.Chmod(0644); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, "", "", PTOWrapError(err)
+		}
+		return syncedFile{f}, rawpath, datapath, nil
+	}
+	f.Close()
+
+	key, err := cam.dataKey(true)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, "", "", err
+	}
+
+	out, err := CreateEncrypted(f.Name(), key, filename)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, "", "", err
+	}
+	return out, rawpath, datapath, nil
+}
+
+// installFileData moves a data file written to a temporary file into place
+// at datapath, and removes any other stored form of it. Unless force is
+// true, it returns an error if another data file was installed in the
+// meantime, rather than replacing it.
+func (cam *Campaign) installFileData(filename string, temppath string, rawpath string, datapath string, force bool) error {
+	if force {
+		if err := os.Rename(temppath, datapath); err != nil {
+			return PTOWrapError(err)
+		}
+	} else {
+		if err := os.Link(temppath, datapath); err != nil {
+			if os.IsExist(err) {
+				return PTOExistsError("file", filename)
+			}
+			return PTOWrapError(err)
+		}
+		os.Remove(temppath)
+	}
+
+	return removeShadowingFiles(rawpath, datapath)
+}
+
 // WriteFileDataFromStream copies data from a given reader to the data file
-// associated with a filename on this campaign. If force is true, replaces the
-// data file if it exists; otherwise, returns an error if the data file exists.
+// associated with a filename on this campaign, encrypting it if the campaign
+// is encrypted. If force is true, replaces the data file if it exists;
+// otherwise, returns an error if the data file exists.
 func (cam *Campaign) WriteFileDataFromStream(filename string, force bool, in io.Reader) error {
-	out, err := cam.WriteFileData(filename, force)
+	// write to a temporary file, so that existing data is only replaced
+	// once the new data has been verified
+	out, rawpath, datapath, err := cam.createFileData(filename, force)
 	if err != nil {
 		return err
 	}
-	defer out.Close()
 
-	// now copy from the reader until EOF
-	if _, err := io.Copy(out, in); err != nil {
+	// now copy from the reader until EOF, digesting as we go
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, digest), in)
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
 		return err
 	}
 
 	// flush file to disk
-	if err := out.Sync(); err != nil {
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
 		return PTOWrapError(err)
 	}
 
+	// check the file against the manifest, and throw it away if corrupted
+	if err := cam.verifyManifestDigest(filename, hex.EncodeToString(digest.Sum(nil))); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	if err := cam.installFileData(filename, out.Name(), rawpath, datapath, force); err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+
+	// store very large files compressed; files already compressed with bzip2
+	// are left as they are, and encrypted files are not compressed
+	_, encrypted := out.(*EncryptedWriter)
+	if threshold := cam.config.SeekableCompressionThreshold; threshold > 0 && size >= threshold && !encrypted {
+		md, err := cam.GetFileMetadata(filename)
+		if err != nil {
+			return err
+		}
+		if !strings.HasSuffix(md.Filetype(true), "-bz2") {
+			if err := cam.compressFileData(filename); err != nil {
+				return err
+			}
+		}
+	}
+
 	// update virtual metadata, as the underlying file size will have changed
 	cam.lock.Lock()
 	defer cam.lock.Unlock()
-	return cam.updateFileVirtualMetadata(filename)
+	if err := cam.updateFileVirtualMetadata(filename); err != nil {
+		return err
+	}
+
+	cam.changes.append(ChangeFileAdded, filename)
+	return nil
 }
 
 // A RawDataStore encapsulates a pile of PTO data and metadata files as a set of
@@ -699,6 +1310,12 @@ type RawDataStore struct {
 
 	// campaign cache
 	campaigns map[string]*Campaign
+
+	// change logs by campaign name, kept across rescans
+	changeLogs map[string]*changeLog
+
+	// lock on change logs
+	changeLock sync.Mutex
 }
 
 // ScanCampaigns updates the campaign cache in RawDataStore to reflect the
@@ -731,7 +1348,7 @@ func (rds *RawDataStore) ScanCampaigns() error {
 			}
 
 			// create a new (stale) campaign
-			cam, _ := newCampaign(rds.config, direntry.Name(), nil)
+			cam, _ := newCampaign(rds.config, direntry.Name(), nil, rds.changeLogFor(direntry.Name()))
 			rds.campaigns[direntry.Name()] = cam
 		}
 	}
@@ -741,7 +1358,7 @@ func (rds *RawDataStore) ScanCampaigns() error {
 
 // CreateCampaign creates a new campaign given a campaign name and initial metadata for the new campaign.
 func (rds *RawDataStore) CreateCampaign(camname string, md *RawMetadata) (*Campaign, error) {
-	cam, err := newCampaign(rds.config, camname, md)
+	cam, err := newCampaign(rds.config, camname, md, rds.changeLogFor(camname))
 	if err != nil {
 		return nil, err
 	}
@@ -785,7 +1402,7 @@ func (rds *RawDataStore) CampaignNames() []string {
 // NewRawDataStore encapsulates a raw data store, given a configuration object
 // pointing to a directory containing data and metadata organized into campaigns.
 func NewRawDataStore(config *PTOConfiguration) (*RawDataStore, error) {
-	rds := RawDataStore{config: config, path: config.RawRoot}
+	rds := RawDataStore{config: config, path: config.RawRoot, changeLogs: make(map[string]*changeLog)}
 
 	// scan the directory for campaigns
 	if err := rds.ScanCampaigns(); err != nil {
@@ -1,10 +1,18 @@
 package pto3_test
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -211,3 +219,944 @@ func TestRawRoundtrip(t *testing.T) {
 	}
 
 }
+
+func TestRawManifest(t *testing.T) {
+
+	// create a campaign with a manifest
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam, err := TestRDS.CreateCampaign("test_manifest", cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testbytes, err := ioutil.ReadFile("testdata/test_raw_data.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testhash := sha256.Sum256(testbytes)
+
+	manifest := pto3.CampaignManifest{Files: map[string]string{
+		"good.ndjson": hex.EncodeToString(testhash[:]),
+		"bad.ndjson":  hex.EncodeToString(make([]byte, sha256.Size)),
+	}}
+
+	if err := cam.PutManifest(&manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing uploaded yet, so everything is missing
+	report, err := cam.VerifyManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Complete || len(report.Missing) != 2 {
+		t.Fatalf("unexpected manifest report before upload: %v", report)
+	}
+
+	// upload the good file
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.PutFileMetadata("good.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.WriteFileDataFromStream("good.ndjson", false, bytes.NewReader(testbytes)); err != nil {
+		t.Fatal(err)
+	}
+
+	// uploading data not matching the manifest should fail
+	if err := cam.PutFileMetadata("bad.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.WriteFileDataFromStream("bad.ndjson", false, bytes.NewReader(testbytes)); err == nil {
+		t.Fatal("upload of file not matching manifest succeeded")
+	}
+
+	report, err = cam.VerifyManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Files["good.ndjson"] != pto3.ManifestFileOK || report.Files["bad.ndjson"] != pto3.ManifestFileMissing {
+		t.Fatalf("unexpected manifest report after upload: %v", report)
+	}
+
+	// forcing an upload of corrupted data over good data should fail, and
+	// leave the good data in place
+	if err := cam.WriteFileDataFromStream("good.ndjson", true, strings.NewReader("corrupted\n")); err == nil {
+		t.Fatal("forced upload of file not matching manifest succeeded")
+	}
+
+	var buf bytes.Buffer
+	if err := cam.ReadFileDataToStream("good.ndjson", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), testbytes) {
+		t.Fatal("failed forced upload replaced good data")
+	}
+
+	// manifests may only list files in the campaign
+	for _, filename := range []string{"../test_other/good.ndjson", "..", "sub/good.ndjson"} {
+		manifest := pto3.CampaignManifest{Files: map[string]string{filename: hex.EncodeToString(testhash[:])}}
+		err := cam.PutManifest(&manifest)
+		if ptoerr, ok := err.(*pto3.PTOError); !ok || ptoerr.Status() != http.StatusBadRequest {
+			t.Fatalf("manifest listing %s: expected 400 Bad Request, got %v", filename, err)
+		}
+	}
+}
+
+func TestRawVirtualMetadata(t *testing.T) {
+	// derive extra virtual metadata for two test filetypes, one with a
+	// provider registered by the test
+	pto3.RegisterVirtualMetadataProvider(&pto3.VirtualMetadataProvider{
+		Name: "test_owner",
+		Update: func(cam *pto3.Campaign, filename string, md *pto3.RawMetadata) error {
+			md.SetVirtual("__owner_domain", strings.SplitN(md.Owner(true), "@", 2)[1])
+			return nil
+		},
+	})
+
+	defer func(virtualMetadata map[string][]string) {
+		TestConfig.VirtualMetadata = virtualMetadata
+	}(TestConfig.VirtualMetadata)
+	TestConfig.VirtualMetadata = map[string][]string{
+		"virtual-test": {pto3.VirtualMetadataSHA256, pto3.VirtualMetadataRecords, "test_owner"},
+		"virtual-pcap": {pto3.VirtualMetadataPcap},
+	}
+
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam, err := TestRDS.CreateCampaign("test_virtual", cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putFile := func(filename string, filetype string, data []byte) *pto3.RawMetadata {
+		filemd, err := pto3.RawMetadataFromReader(strings.NewReader(`{"_file_type": "`+filetype+`"}`), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cam.PutFileMetadata(filename, filemd); err != nil {
+			t.Fatal(err)
+		}
+		if err := cam.WriteFileDataFromStream(filename, false, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		filemd, err = cam.GetFileMetadata(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filemd
+	}
+
+	testbytes := []byte("{\"a\":1}\n{\"b\":2}\n{\"c\":3}\n")
+	testhash := sha256.Sum256(testbytes)
+
+	filemd := putFile("virtual.ndjson", "virtual-test", testbytes)
+	if filemd.GetVirtual("__data_sha256") != hex.EncodeToString(testhash[:]) {
+		t.Errorf("bad __data_sha256 %v", filemd.GetVirtual("__data_sha256"))
+	}
+	if filemd.GetVirtual("__record_count") != 3 {
+		t.Errorf("bad __record_count %v", filemd.GetVirtual("__record_count"))
+	}
+	if filemd.GetVirtual("__owner_domain") != "trammell.ch" {
+		t.Errorf("bad __owner_domain %v", filemd.GetVirtual("__owner_domain"))
+	}
+
+	b, err := filemd.DumpJSONObject(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"__record_count":3`) {
+		t.Errorf("virtual metadata missing from %s", b)
+	}
+
+	// a little-endian pcap file with two packets
+	pcap := []byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0, 0, 1, 0, 0, 0}
+	for _, packet := range [][]byte{{1, 2, 3, 4}, {5, 6}} {
+		record := make([]byte, 16)
+		record[8] = byte(len(packet))
+		record[12] = byte(len(packet))
+		pcap = append(append(pcap, record...), packet...)
+	}
+
+	filemd = putFile("virtual.pcap", "virtual-pcap", pcap)
+	if filemd.GetVirtual("__packet_count") != 2 {
+		t.Errorf("bad __packet_count %v", filemd.GetVirtual("__packet_count"))
+	}
+	if filemd.GetVirtual("__record_count") != nil {
+		t.Errorf("unexpected __record_count %v for pcap file", filemd.GetVirtual("__record_count"))
+	}
+
+	// files a provider can't handle are still stored, without its metadata
+	filemd = putFile("broken.pcap", "virtual-pcap", testbytes)
+	if filemd.GetVirtual("__packet_count") != nil {
+		t.Errorf("unexpected virtual metadata for broken pcap file: %v", filemd)
+	}
+
+	// unknown providers are refused in configuration
+	if _, err := pto3.NewConfigFromJSON([]byte(`{"VirtualMetadata": {"test": ["no_such_provider"]}}`)); err == nil {
+		t.Error("configuration with unknown virtual metadata provider loaded")
+	}
+}
+
+func TestRawFileExcerpt(t *testing.T) {
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam, err := TestRDS.CreateCampaign("test_excerpt", cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.PutFileMetadata("excerpt.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.WriteFileDataFromStream("excerpt.ndjson", false, bytes.NewReader([]byte("{\"a\":1}\n{\"b\":2}\r\n{\"c\":3}"))); err != nil {
+		t.Fatal(err)
+	}
+
+	n := func(i int64) *int64 { return &i }
+	excerpts := []struct {
+		ref     pto3.SourceRef
+		length  int
+		excerpt string
+	}{
+		{pto3.SourceRef{Record: n(0)}, 0, `{"a":1}`},
+		{pto3.SourceRef{Record: n(1)}, 0, `{"b":2}`},
+		{pto3.SourceRef{Record: n(2)}, 0, `{"c":3}`},
+		{pto3.SourceRef{Offset: n(8)}, 0, `{"b":2}`},
+		{pto3.SourceRef{Offset: n(8)}, 4, `{"b"`},
+		{pto3.SourceRef{Offset: n(23)}, 100, `}`},
+	}
+
+	for _, e := range excerpts {
+		excerpt, err := cam.ReadFileExcerpt("excerpt.ndjson", &e.ref, e.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(excerpt) != e.excerpt {
+			t.Errorf("expected excerpt %s, got %s", e.excerpt, excerpt)
+		}
+	}
+
+	for _, ref := range []pto3.SourceRef{{Record: n(3)}, {Offset: n(24)}} {
+		if _, err := cam.ReadFileExcerpt("excerpt.ndjson", &ref, 0); err == nil {
+			t.Errorf("excerpt beyond end of file for %v", ref)
+		}
+	}
+}
+
+func TestRawSeekable(t *testing.T) {
+	defer func(threshold int64) {
+		TestConfig.SeekableCompressionThreshold = threshold
+	}(TestConfig.SeekableCompressionThreshold)
+	TestConfig.SeekableCompressionThreshold = 1024
+
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam, err := TestRDS.CreateCampaign("test_seekable", cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.PutFileMetadata("large.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	// enough records to span several frames
+	var data bytes.Buffer
+	for i := 0; data.Len() < 3*pto3.SeekableFrameSize; i++ {
+		fmt.Fprintf(&data, "{\"record\":%d}\n", i)
+	}
+	testbytes := data.Bytes()
+
+	if err := cam.WriteFileDataFromStream("large.ndjson", false, bytes.NewReader(testbytes)); err != nil {
+		t.Fatal(err)
+	}
+
+	campath := filepath.Join(TestConfig.RawRoot, "test_seekable")
+	if _, err := os.Stat(filepath.Join(campath, "large.ndjson"+pto3.SeekableSuffix)); err != nil {
+		t.Fatalf("large file not stored compressed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(campath, "large.ndjson")); !os.IsNotExist(err) {
+		t.Fatalf("uncompressed large file left in campaign: %v", err)
+	}
+
+	// reading, seeking, and stat refer to the data as uploaded
+	datafile, err := cam.ReadFileData("large.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer datafile.Close()
+
+	fi, err := datafile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(testbytes)) {
+		t.Fatalf("compressed file has size %d, expected %d", fi.Size(), len(testbytes))
+	}
+
+	databytes, err := ioutil.ReadAll(datafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(databytes, testbytes) {
+		t.Fatal("compressed file does not match uploaded data")
+	}
+
+	offset := int64(2*pto3.SeekableFrameSize - 5)
+	if _, err := datafile.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, 10)
+	if _, err := io.ReadFull(datafile, chunk); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chunk, testbytes[offset:offset+10]) {
+		t.Fatalf("read across frame boundary got %q, expected %q", chunk, testbytes[offset:offset+10])
+	}
+
+	// excerpts are read from the middle of the file
+	offset = int64(bytes.LastIndexByte(testbytes[:len(testbytes)-1], '\n') + 1)
+	excerpt, err := cam.ReadFileExcerpt("large.ndjson", &pto3.SourceRef{Offset: &offset}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strings.TrimSpace(string(testbytes[offset:])); string(excerpt) != expected {
+		t.Fatalf("expected excerpt %s, got %s", expected, excerpt)
+	}
+
+	// small files are stored as uploaded
+	if err := cam.PutFileMetadata("small.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.WriteFileDataFromStream("small.ndjson", false, bytes.NewReader(testbytes[:100])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(campath, "small.ndjson")); err != nil {
+		t.Fatalf("small file not stored as uploaded: %v", err)
+	}
+}
+
+func TestRawEncrypted(t *testing.T) {
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// encryption is on or off
+	cammd.Metadata[pto3.EncryptedMetadataKey] = "maybe"
+	if _, err := TestRDS.CreateCampaign("test_encrypted", cammd); err == nil {
+		t.Fatal("created campaign with bad encryption setting")
+	}
+
+	cammd.Metadata[pto3.EncryptedMetadataKey] = "true"
+	cam, err := TestRDS.CreateCampaign("test_encrypted", cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.PutFileMetadata("secret.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	// enough records to span several chunks
+	var data bytes.Buffer
+	for i := 0; data.Len() < 3*pto3.EncryptedChunkSize; i++ {
+		fmt.Fprintf(&data, "{\"secret_record\":%d}\n", i)
+	}
+	testbytes := data.Bytes()
+
+	if err := cam.WriteFileDataFromStream("secret.ndjson", false, bytes.NewReader(testbytes)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data is stored encrypted, with a key for the campaign
+	campath := filepath.Join(TestConfig.RawRoot, "test_encrypted")
+	if _, err := os.Stat(filepath.Join(campath, "secret.ndjson")); !os.IsNotExist(err) {
+		t.Fatalf("plaintext file left in campaign: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(campath, pto3.CampaignKeyFilename)); err != nil {
+		t.Fatalf("no key for encrypted campaign: %v", err)
+	}
+	stored, err := ioutil.ReadFile(filepath.Join(campath, "secret.ndjson"+pto3.EncryptedSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("secret_record")) {
+		t.Fatal("encrypted file contains plaintext")
+	}
+
+	// reading, seeking, and stat refer to the data as uploaded
+	datafile, err := cam.ReadFileData("secret.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer datafile.Close()
+
+	fi, err := datafile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(testbytes)) {
+		t.Fatalf("encrypted file has size %d, expected %d", fi.Size(), len(testbytes))
+	}
+
+	databytes, err := ioutil.ReadAll(datafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(databytes, testbytes) {
+		t.Fatal("encrypted file does not match uploaded data")
+	}
+
+	offset := int64(2*pto3.EncryptedChunkSize - 5)
+	if _, err := datafile.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	chunk := make([]byte, 10)
+	if _, err := io.ReadFull(datafile, chunk); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chunk, testbytes[offset:offset+10]) {
+		t.Fatalf("read across chunk boundary got %q, expected %q", chunk, testbytes[offset:offset+10])
+	}
+
+	// truncated files fail authentication
+	if err := os.Truncate(filepath.Join(campath, "secret.ndjson"+pto3.EncryptedSuffix), int64(len(stored)-17)); err != nil {
+		t.Fatal(err)
+	}
+	truncated, err := cam.ReadFileData("secret.ndjson")
+	if err == nil {
+		defer truncated.Close()
+		if _, err := ioutil.ReadAll(truncated); err == nil {
+			t.Fatal("read truncated encrypted file")
+		}
+	}
+}
+
+func TestRawRewrapKeys(t *testing.T) {
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cammd.Metadata[pto3.EncryptedMetadataKey] = "true"
+
+	cam, err := TestRDS.CreateCampaign("test_rewrap", cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cam.PutFileMetadata("secret.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	testbytes := []byte("{\"secret_record\":0}\n")
+	if err := cam.WriteFileDataFromStream("secret.ndjson", false, bytes.NewReader(testbytes)); err != nil {
+		t.Fatal(err)
+	}
+
+	keypath := filepath.Join(TestConfig.RawRoot, "test_rewrap", pto3.CampaignKeyFilename)
+	before, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rotate by appending a new key to a copy of the keyfile
+	oldkey, err := ioutil.ReadFile("testdata/test_encryption_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyfile, err := ioutil.TempFile("", "pto3-test-keyring")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyfile.Name())
+	fmt.Fprintf(keyfile, "# rotated keys\n%s\n%x\n", strings.TrimSpace(string(oldkey)), sha256.Sum256([]byte("test_rewrap")))
+	keyfile.Close()
+
+	config, err := pto3.NewConfigFromJSON([]byte(fmt.Sprintf(`{"RawRoot": %q, "EncryptionKeyFile": %q}`,
+		TestConfig.RawRoot, keyfile.Name())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rds, err := pto3.NewRawDataStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := rds.RewrapDataKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, camname := range rewrapped {
+		found = found || camname == "test_rewrap"
+	}
+	if !found {
+		t.Fatalf("test_rewrap not rewrapped, got %v", rewrapped)
+	}
+
+	after, err := ioutil.ReadFile(keypath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(before, after) {
+		t.Fatal("campaign key unchanged by rewrapping")
+	}
+
+	// data remains readable with the rotated keys, and keys are only
+	// rewrapped once
+	rcam, err := rds.CampaignForName("test_rewrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	datafile, err := rcam.ReadFileData("secret.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer datafile.Close()
+	databytes, err := ioutil.ReadAll(datafile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(databytes, testbytes) {
+		t.Fatal("rewrapped campaign data does not match uploaded data")
+	}
+
+	if rewrapped, err := rds.RewrapDataKeys(); err != nil {
+		t.Fatal(err)
+	} else if len(rewrapped) != 0 {
+		t.Fatalf("keys rewrapped twice: %v", rewrapped)
+	}
+}
+
+func TestRawDropIngest(t *testing.T) {
+
+	// create a drop directory with a new campaign in it
+	droppath, err := ioutil.TempDir("", "pto3-test-drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(droppath)
+
+	campath := filepath.Join(droppath, "test_drop")
+	if err := os.Mkdir(campath, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	copies := map[string]string{
+		"testdata/test_raw_campaign_metadata.json": pto3.CampaignMetadataFilename,
+		"testdata/test_raw_metadata.json":          "test001.ndjson" + pto3.FileMetadataSuffix,
+		"testdata/test_raw_data.ndjson":            "test001.ndjson",
+		// data without metadata should be left alone
+		"testdata/test_raw_init/test0/test0-0-obs.ndjson": "test002.ndjson",
+	}
+
+	for from, to := range copies {
+		b, err := ioutil.ReadFile(from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(campath, to), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a symlink to a file outside the drop directory should not be followed
+	secretpath, err := ioutil.TempDir("", "pto3-test-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(secretpath)
+
+	if err := ioutil.WriteFile(filepath.Join(secretpath, "secret"), []byte("{\"secret\": true}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(secretpath, "secret"), filepath.Join(campath, "test003.ndjson")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(campath, "test001.ndjson"+pto3.FileMetadataSuffix), filepath.Join(campath, "test003.ndjson"+pto3.FileMetadataSuffix)); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing should be ingested before files settle
+	di := pto3.NewDropIngester(TestRDS, droppath, "", time.Hour)
+	if n, err := di.Scan(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("ingested %d unsettled files", n)
+	}
+
+	// nothing should be ingested into campaigns we may not write to
+	di = pto3.NewDropIngester(TestRDS, droppath, "", 0)
+	di.RestrictCampaigns([]string{"test_other"})
+	if n, err := di.Scan(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("ingested %d files into disallowed campaign", n)
+	}
+
+	di = pto3.NewDropIngester(TestRDS, droppath, "", 0)
+	di.RestrictCampaigns([]string{"test_drop"})
+	if n, err := di.Scan(); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("expected to ingest 1 file, ingested %d", n)
+	}
+
+	// file should now be in the campaign, and gone from the drop directory
+	cam, err := TestRDS.CampaignForName("test_drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filemd, err := cam.GetFileMetadata("test001.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filemd.Owner(true) != "brian@trammell.ch" {
+		t.Fatalf("bad owner on ingested file, found %s", filemd.Owner(true))
+	}
+
+	if _, err := os.Stat(filepath.Join(campath, "test001.ndjson")); !os.IsNotExist(err) {
+		t.Fatalf("ingested file still in drop directory")
+	}
+
+	if _, err := os.Stat(filepath.Join(campath, "test002.ndjson")); err != nil {
+		t.Fatalf("data file without metadata missing from drop directory: %v", err)
+	}
+
+	if _, err := cam.GetFileMetadata("test003.ndjson"); err == nil {
+		t.Fatalf("ingested symlink from drop directory")
+	}
+
+	// a file colliding with one already in the campaign should be refused
+	// without overwriting its metadata
+	collisions := map[string]string{
+		"test001.ndjson" + pto3.FileMetadataSuffix: `{"_time_start": "2017-12-17T09:05:01Z", "_time_end": "2017-12-17T11:04:57Z", "_owner": "mallory@example.com"}`,
+		"test001.ndjson": "{}\n",
+	}
+	for to, content := range collisions {
+		if err := ioutil.WriteFile(filepath.Join(campath, to), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := di.Scan(); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("ingested %d files colliding with existing files", n)
+	}
+
+	filemd, err = cam.GetFileMetadata("test001.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filemd.Owner(true) != "brian@trammell.ch" {
+		t.Fatalf("colliding file overwrote metadata, owner now %s", filemd.Owner(true))
+	}
+}
+
+func TestRawFetch(t *testing.T) {
+
+	testbytes, err := ioutil.ReadFile("testdata/test_raw_data.ndjson")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testbytes)
+	}))
+	defer srv.Close()
+
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam, err := TestRDS.CreateCampaign("test_fetch", cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{"fetched.ndjson", "toobig.ndjson"} {
+		if err := cam.PutFileMetadata(filename, filemd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// test server is http only, which isn't allowed by default
+	if err := cam.FetchFileData("fetched.ndjson", false, srv.URL); err == nil {
+		t.Fatal("fetch from http URL succeeded without http in FetchSchemes")
+	}
+
+	defer func(schemes []string, maxSize int64, networks []string) {
+		TestConfig.FetchSchemes = schemes
+		TestConfig.FetchMaxSize = maxSize
+		TestConfig.OutboundNetworks = networks
+	}(TestConfig.FetchSchemes, TestConfig.FetchMaxSize, TestConfig.OutboundNetworks)
+	TestConfig.FetchSchemes = []string{"http"}
+
+	// the test server is on loopback, which isn't public, nor are link-local
+	// metadata services, whether named directly or redirected to
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	TestConfig.OutboundNetworks = nil
+	for _, source := range []string{srv.URL, "http://169.254.169.254/latest/meta-data/", "http://[::1]/"} {
+		err := cam.FetchFileData("fetched.ndjson", false, source)
+		if ptoerr, ok := err.(*pto3.PTOError); !ok || ptoerr.Status() != http.StatusForbidden {
+			t.Fatalf("fetch from %s: expected 403 Forbidden, got %v", source, err)
+		}
+	}
+
+	TestConfig.OutboundNetworks = []string{"127.0.0.0/8"}
+	err = cam.FetchFileData("fetched.ndjson", false, redirector.URL)
+	if ptoerr, ok := err.(*pto3.PTOError); !ok || ptoerr.Status() != http.StatusForbidden {
+		t.Fatalf("fetch redirected to link-local address: expected 403 Forbidden, got %v", err)
+	}
+
+	if err := cam.FetchFileData("fetched.ndjson", false, srv.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := cam.ReadFileDataToStream("fetched.ndjson", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(buf.Bytes(), testbytes) {
+		t.Fatal("fetched data does not match served data")
+	}
+
+	// data exceeding the maximum size should be rejected and removed
+	TestConfig.FetchMaxSize = int64(len(testbytes) - 1)
+	if err := cam.FetchFileData("toobig.ndjson", false, srv.URL); err == nil {
+		t.Fatal("fetch of data exceeding FetchMaxSize succeeded")
+	}
+
+	if _, err := cam.ReadFileData("toobig.ndjson"); !os.IsNotExist(err) {
+		t.Fatalf("data exceeding FetchMaxSize left in campaign: %v", err)
+	}
+}
+
+func TestRawChanges(t *testing.T) {
+
+	cammd, err := pto3.RawMetadataFromFile("testdata/test_raw_campaign_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cam, err := TestRDS.CreateCampaign("test_changes", cammd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// creating the campaign writes its metadata
+	changes, next, reset := cam.ChangesSince(0, 0)
+	if reset || len(changes) != 1 || changes[0].Type != pto3.ChangeMetadataChanged || changes[0].File != "" {
+		t.Fatalf("unexpected changes after campaign creation: %v (reset %v)", changes, reset)
+	}
+
+	// no changes yet, so this should time out
+	if changes, _, _ = cam.ChangesSince(next, 10*time.Millisecond); len(changes) != 0 {
+		t.Fatalf("unexpected changes: %v", changes)
+	}
+
+	// wait for a change while uploading a file
+	done := make(chan []pto3.CampaignChange)
+	go func() {
+		changes, _, _ := cam.ChangesSince(next, 10*time.Second)
+		done <- changes
+	}()
+
+	filemd, err := pto3.RawMetadataFromFile("testdata/test_raw_metadata.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cam.PutFileMetadata("changed.ndjson", filemd); err != nil {
+		t.Fatal(err)
+	}
+
+	changes = <-done
+	if len(changes) < 1 || changes[0].Type != pto3.ChangeMetadataChanged || changes[0].File != "changed.ndjson" {
+		t.Fatalf("unexpected changes after file metadata upload: %v", changes)
+	}
+
+	if err := cam.WriteFileDataFromStream("changed.ndjson", false, bytes.NewReader([]byte("{}\n"))); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, next, _ = cam.ChangesSince(changes[0].Seq, 0)
+	if len(changes) != 1 || changes[0].Type != pto3.ChangeFileAdded || changes[0].File != "changed.ndjson" {
+		t.Fatalf("unexpected changes after file data upload: %v", changes)
+	}
+
+	// changes survive a campaign rescan
+	if err := TestRDS.ScanCampaigns(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cam, err = TestRDS.CampaignForName("test_changes"); err != nil {
+		t.Fatal(err)
+	}
+
+	// asking for changes from the future means we missed some
+	if _, _, reset = cam.ChangesSince(next+100, 0); !reset {
+		t.Fatal("expected reset when asking for changes after last change")
+	}
+
+	if changes, _, reset = cam.ChangesSince(next, 0); reset || len(changes) != 0 {
+		t.Fatalf("unexpected changes after rescan: %v (reset %v)", changes, reset)
+	}
+}
+
+func TestChangeJournal(t *testing.T) {
+	journalDir, err := ioutil.TempDir("", "pto3-journal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(journalDir)
+
+	journalPath := filepath.Join(journalDir, "journal.ndjson")
+
+	journal, err := pto3.OpenChangeJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty journal has no changes
+	changes, next, reset, err := journal.Since(0, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if reset || len(changes) != 0 || next != 0 {
+		t.Fatalf("unexpected changes in empty journal: %v (next %d reset %v)", changes, next, reset)
+	}
+
+	// wait for a change
+	done := make(chan []pto3.JournalEntry)
+	go func() {
+		changes, _, _, _ := journal.Since(0, 10, 10*time.Second)
+		done <- changes
+	}()
+
+	if err := journal.Record(pto3.JournalStoreRaw, pto3.JournalCreate, "https://localhost/raw/test"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes = <-done
+	if len(changes) != 1 || changes[0].Seq != 1 || changes[0].Store != pto3.JournalStoreRaw || changes[0].Type != pto3.JournalCreate {
+		t.Fatalf("unexpected changes after create: %v", changes)
+	}
+
+	if err := journal.Record(pto3.JournalStoreObs, pto3.JournalUpdate, "https://localhost/obs/1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Record(pto3.JournalStoreQuery, pto3.JournalDelete, "https://localhost/query/abc"); err != nil {
+		t.Fatal(err)
+	}
+
+	// limit the number of changes returned
+	changes, next, _, err = journal.Since(0, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 2 || next != 2 {
+		t.Fatalf("unexpected changes with limit: %v (next %d)", changes, next)
+	}
+
+	if err := journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// leave a partial entry, as a crash while recording would
+	jf, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jf.WriteString(`{"seq":4,"time":"2018-06`); err != nil {
+		t.Fatal(err)
+	}
+	jf.Close()
+
+	// sequence numbers continue after reopening, and the partial entry is
+	// dropped
+	if journal, err = pto3.OpenChangeJournal(journalPath); err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	if err := journal.Record(pto3.JournalStoreObs, pto3.JournalCreate, "https://localhost/obs/2"); err != nil {
+		t.Fatal(err)
+	}
+
+	jb, err := ioutil.ReadFile(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(jb)), "\n") {
+		var entry pto3.JournalEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("bad journal entry %s after reopening: %v", line, err)
+		}
+	}
+
+	changes, next, _, err = journal.Since(2, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(changes) != 2 || changes[0].Seq != 3 || changes[1].Seq != 4 || next != 4 {
+		t.Fatalf("unexpected changes after reopen: %v (next %d)", changes, next)
+	}
+
+	// asking for changes from the future means the journal was replaced
+	if _, _, reset, _ = journal.Since(next+100, 10, 0); !reset {
+		t.Fatal("expected reset when asking for changes after last change")
+	}
+}
@@ -0,0 +1,297 @@
+package pto3
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// RegisteredCondition describes a condition in the condition registry: what
+// it means, the type and units of its values, and where to read more about
+// it. Analyzer authors can look up registered conditions before inventing
+// names of their own. Conditions need not be registered to be used, and
+// conditions may be registered before any observations of them exist.
+type RegisteredCondition struct {
+	// Full condition name, e.g. pto.ecn.negotiated
+	Name string `sql:",pk"`
+	// Human-readable description of what the condition means
+	Description string
+	// Expected type of observation values; see ConditionValueTypes
+	ValueType string
+	// Units of observation values, e.g. ms
+	Units string
+	// URL of a document describing the condition in detail
+	Reference string
+	// Registration timestamp
+	Created *time.Time
+	// Modification timestamp
+	Modified *time.Time
+	// system metadata
+	link string
+}
+
+// ConditionValueTypes lists the value types a registered condition may
+// declare. An empty value type accepts any value. Values are optional for all
+// types except "none", which forbids them. For compatibility with observation
+// files written before values were typed, strings containing numbers are
+// accepted as numbers and integers.
+var ConditionValueTypes = map[string]bool{
+	"none":    true,
+	"string":  true,
+	"number":  true,
+	"integer": true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+}
+
+// MarshalJSON serializes this RegisteredCondition into a JSON object suitable
+// for use with the PTO API.
+func (rc *RegisteredCondition) MarshalJSON() ([]byte, error) {
+	jmap := make(map[string]interface{})
+
+	jmap["name"] = rc.Name
+	jmap["description"] = rc.Description
+
+	if rc.ValueType != "" {
+		jmap["value_type"] = rc.ValueType
+	}
+
+	if rc.Units != "" {
+		jmap["units"] = rc.Units
+	}
+
+	if rc.Reference != "" {
+		jmap["reference"] = rc.Reference
+	}
+
+	if rc.link != "" {
+		jmap["__link"] = rc.link
+	}
+
+	if rc.Created != nil {
+		jmap["__created"] = rc.Created.Format(time.RFC3339)
+	}
+
+	if rc.Modified != nil {
+		jmap["__modified"] = rc.Modified.Format(time.RFC3339)
+	}
+
+	return json.Marshal(jmap)
+}
+
+// UnmarshalJSON fills in a RegisteredCondition from a JSON object suitable for
+// use with the PTO API. Virtual keys (starting with __) are ignored.
+func (rc *RegisteredCondition) UnmarshalJSON(b []byte) error {
+	var jobj struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		ValueType   string `json:"value_type"`
+		Units       string `json:"units"`
+		Reference   string `json:"reference"`
+	}
+
+	if err := json.Unmarshal(b, &jobj); err != nil {
+		return PTOWrapError(err)
+	}
+
+	rc.Name = jobj.Name
+	rc.Description = jobj.Description
+	rc.ValueType = jobj.ValueType
+	rc.Units = jobj.Units
+	rc.Reference = jobj.Reference
+
+	return nil
+}
+
+// LinkVia sets this RegisteredCondition's link given a configuration
+func (rc *RegisteredCondition) LinkVia(config *PTOConfiguration) {
+	rc.link, _ = config.LinkTo("obs/conditions/registry/" + rc.Name)
+}
+
+// Validate checks that this RegisteredCondition has a usable name, a
+// description, a known value type, and an absolute reference URL, if any.
+func (rc *RegisteredCondition) Validate() error {
+	if rc.Name == "" || IsConditionWildcard(rc.Name) {
+		return PTOErrorf("bad condition name %q", rc.Name).StatusIs(http.StatusBadRequest)
+	}
+
+	for _, component := range strings.Split(rc.Name, ".") {
+		if component == "" || strings.ContainsAny(component, " \t\r\n/") {
+			return PTOErrorf("bad condition name %q", rc.Name).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	if rc.Description == "" {
+		return PTOErrorf("registered condition %s requires a description", rc.Name).StatusIs(http.StatusBadRequest)
+	}
+
+	if rc.ValueType != "" && !ConditionValueTypes[rc.ValueType] {
+		return PTOErrorf("registered condition %s has unknown value type %s", rc.Name, rc.ValueType).StatusIs(http.StatusBadRequest)
+	}
+
+	if rc.Reference != "" {
+		u, err := url.Parse(rc.Reference)
+		if err != nil || !u.IsAbs() {
+			return PTOErrorf("registered condition %s has bad reference URL %s", rc.Name, rc.Reference).StatusIs(http.StatusBadRequest)
+		}
+	}
+
+	return nil
+}
+
+// CheckValue returns an error with status 400 if an observation value does
+// not have the type this RegisteredCondition declares.
+func (rc *RegisteredCondition) CheckValue(value json.RawMessage) error {
+	// any value is acceptable for untyped conditions, and values are optional
+	value = bytes.TrimSpace(value)
+	if rc.ValueType == "" || len(value) == 0 || bytes.Equal(value, []byte("null")) {
+		return nil
+	}
+
+	ok := false
+	switch rc.ValueType {
+	case "string":
+		ok = value[0] == '"'
+	case "number", "integer":
+		text := string(value)
+		if value[0] == '"' {
+			var s string
+			if err := json.Unmarshal(value, &s); err != nil {
+				break
+			}
+			text = s
+		}
+		if rc.ValueType == "integer" {
+			_, err := strconv.ParseInt(text, 10, 64)
+			ok = err == nil
+		} else {
+			_, err := strconv.ParseFloat(text, 64)
+			ok = err == nil
+		}
+	case "boolean":
+		ok = bytes.Equal(value, []byte("true")) || bytes.Equal(value, []byte("false"))
+	case "object":
+		ok = value[0] == '{'
+	case "array":
+		ok = value[0] == '['
+	}
+
+	if !ok {
+		return PTOErrorf("value %s of condition %s is not of type %s", value, rc.Name, rc.ValueType).StatusIs(http.StatusBadRequest)
+	}
+	return nil
+}
+
+// SelectRegisteredCondition retrieves a condition from the registry by name.
+// It returns an error with status 404 if the condition is not registered.
+func SelectRegisteredCondition(db orm.DB, name string) (*RegisteredCondition, error) {
+	rc := RegisteredCondition{Name: name}
+	if err := db.Select(&rc); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, PTONotFoundError("registered condition", name)
+		}
+		return nil, PTOWrapError(err)
+	}
+	return &rc, nil
+}
+
+// Put registers this condition, replacing any registration of the same name,
+// and returns true if it was not registered before. Call Put within a
+// transaction.
+func (rc *RegisteredCondition) Put(db orm.DB) (bool, error) {
+	if err := rc.Validate(); err != nil {
+		return false, err
+	}
+
+	mtime := time.Now().UTC()
+	rc.Modified = &mtime
+
+	existing, err := SelectRegisteredCondition(db, rc.Name)
+	if err != nil {
+		if perr, ok := err.(*PTOError); !ok || perr.Status() != http.StatusNotFound {
+			return false, err
+		}
+
+		rc.Created = &mtime
+		if err := db.Insert(rc); err != nil {
+			return false, PTOWrapError(err)
+		}
+		return true, nil
+	}
+
+	rc.Created = existing.Created
+	if err := db.Update(rc); err != nil {
+		return false, PTOWrapError(err)
+	}
+	return false, nil
+}
+
+// Delete removes this condition from the registry. Observations of the
+// condition are not affected. It returns an error with status 404 if the
+// condition is not registered.
+func (rc *RegisteredCondition) Delete(db orm.DB) error {
+	res, err := db.Model(rc).WherePK().Delete()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if res.RowsAffected() == 0 {
+		return PTONotFoundError("registered condition", rc.Name)
+	}
+	return nil
+}
+
+// likeEscaper escapes the wildcard characters of LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// ListRegisteredConditions returns registered conditions sorted by name. If
+// condition is not empty, it returns only the condition of that name and its
+// descendants; if search is not empty, it returns only conditions whose name
+// or description contain it, ignoring case.
+func ListRegisteredConditions(db orm.DB, condition string, search string) ([]RegisteredCondition, error) {
+	out := make([]RegisteredCondition, 0)
+
+	q := db.Model(&out).Order("name")
+
+	if condition != "" {
+		q = q.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
+			return qq.Where("name = ?", condition).
+				WhereOr("name LIKE ?", likeEscaper.Replace(condition)+".%"), nil
+		})
+	}
+
+	if search != "" {
+		pattern := "%" + likeEscaper.Replace(search) + "%"
+		q = q.WhereGroup(func(qq *orm.Query) (*orm.Query, error) {
+			return qq.Where("name ILIKE ?", pattern).
+				WhereOr("description ILIKE ?", pattern), nil
+		})
+	}
+
+	if err := q.Select(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	return out, nil
+}
+
+// LoadConditionRegistry returns all registered conditions, by name.
+func LoadConditionRegistry(db orm.DB) (map[string]*RegisteredCondition, error) {
+	var rcs []RegisteredCondition
+	if err := db.Model(&rcs).Select(); err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	out := make(map[string]*RegisteredCondition)
+	for i := range rcs {
+		out[rcs[i].Name] = &rcs[i]
+	}
+	return out, nil
+}
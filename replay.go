@@ -0,0 +1,556 @@
+package pto3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLogTimeFormat is the timestamp format written by loggers with
+// log.LstdFlags, as used for the access log.
+const accessLogTimeFormat = "2006/01/02 15:04:05"
+
+// AccessLogEntry is a request recorded in the PTO access log.
+type AccessLogEntry struct {
+	// Time the request was logged
+	Time time.Time
+	// Request method
+	Method string
+	// Request URL, as received by the server
+	URL string
+	// Length of the response body
+	Length int
+	// Response status
+	Status int
+	// Time taken to handle the request
+	Duration time.Duration
+}
+
+// ParseAccessLogLine parses a line written to the access log by the PTO API.
+// Lines may carry a prefix before the timestamp, as written when the access
+// log is a separate file.
+func ParseAccessLogLine(line string) (*AccessLogEntry, error) {
+	fields := strings.Fields(line)
+
+	// find the timestamp, skipping any prefix
+	for len(fields) > 0 {
+		if _, err := time.Parse("2006/01/02", fields[0]); err == nil {
+			break
+		}
+		fields = fields[1:]
+	}
+
+	if len(fields) != 7 {
+		return nil, PTOErrorf("malformed access log line %q", line)
+	}
+
+	var e AccessLogEntry
+	var err error
+
+	e.Time, err = time.ParseInLocation(accessLogTimeFormat, fields[0]+" "+fields[1], time.Local)
+	if err != nil {
+		return nil, PTOErrorf("bad timestamp in access log line %q", line)
+	}
+
+	e.Method = fields[2]
+	e.URL = fields[3]
+
+	if e.Length, err = strconv.Atoi(fields[4]); err != nil {
+		return nil, PTOErrorf("bad length in access log line %q", line)
+	}
+
+	if e.Status, err = strconv.Atoi(fields[5]); err != nil {
+		return nil, PTOErrorf("bad status in access log line %q", line)
+	}
+
+	// handlers which never call WriteHeader respond 200 implicitly
+	if e.Status == 0 {
+		e.Status = http.StatusOK
+	}
+
+	if e.Duration, err = time.ParseDuration(fields[6]); err != nil {
+		return nil, PTOErrorf("bad duration in access log line %q", line)
+	}
+
+	return &e, nil
+}
+
+// ReadAccessLog reads entries from an access log, in order. Lines which are
+// not access log entries, e.g. other server log output when the access log
+// goes to standard error, are skipped and counted.
+func ReadAccessLog(in io.Reader) ([]AccessLogEntry, int, error) {
+	out := make([]AccessLogEntry, 0)
+	skipped := 0
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		e, err := ParseAccessLogLine(scanner.Text())
+		if err != nil {
+			skipped++
+			continue
+		}
+		out = append(out, *e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, 0, PTOWrapError(err)
+	}
+
+	return out, skipped, nil
+}
+
+// ReplayResult is the outcome of replaying a single access log entry.
+type ReplayResult struct {
+	// Entry replayed
+	Entry AccessLogEntry
+	// Response status and body length from the replay target
+	Status int
+	Length int
+	// Time taken by the replay target to respond
+	Duration time.Duration
+	// Response status from the reference instance, if comparing with one
+	ReferenceStatus int
+	// How the response body differs from the reference instance's, if it
+	// does
+	BodyMismatch string
+	// Error sending the request or reading the response, if any
+	Err error
+}
+
+// Mismatch describes how this result differs from the recorded response, or
+// returns an empty string if it matches. Lengths are only compared if
+// checkLength is true, since responses listing data change as data is added.
+func (rr *ReplayResult) Mismatch(checkLength bool) string {
+	if rr.Err != nil {
+		return rr.Err.Error()
+	}
+	if rr.Status != rr.Entry.Status {
+		return fmt.Sprintf("status %d, recorded %d", rr.Status, rr.Entry.Status)
+	}
+	if checkLength && rr.Length != rr.Entry.Length {
+		return fmt.Sprintf("length %d, recorded %d", rr.Length, rr.Entry.Length)
+	}
+	if rr.ReferenceStatus != 0 && rr.Status != rr.ReferenceStatus {
+		return fmt.Sprintf("status %d, reference %d", rr.Status, rr.ReferenceStatus)
+	}
+	return rr.BodyMismatch
+}
+
+// ReplayVolatileKeys lists the keys of JSON objects in responses whose values
+// are expected to differ between instances answering the same request, as
+// they record when or at what cost the request was handled. They are left
+// out when comparing response bodies.
+var ReplayVolatileKeys = []string{
+	"__time_submitted", "__time_executed", "__time_completed", "__execution_time",
+	"__modified", "__usage", "__cpu_time", "__rows_scanned", "__bytes_returned",
+	"__plan", "request_id",
+}
+
+// maxReplayBodyBytes is the size above which response bodies are compared
+// byte for byte by digest, rather than normalized in memory.
+const maxReplayBodyBytes = 8 << 20
+
+// replayBody is a response body read for comparison: its content, unless it
+// is larger than maxReplayBodyBytes, its length, and its digest.
+type replayBody struct {
+	data   []byte
+	isJSON bool
+	length int64
+	digest [sha256.Size]byte
+}
+
+func readReplayBody(res *http.Response) (*replayBody, error) {
+	body := new(replayBody)
+	if mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err == nil {
+		body.isJSON = mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	}
+
+	h := sha256.New()
+	data, err := ioutil.ReadAll(io.LimitReader(io.TeeReader(res.Body, h), maxReplayBodyBytes+1))
+	body.length = int64(len(data))
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if body.length > maxReplayBodyBytes {
+		n, err := io.Copy(h, res.Body)
+		body.length += n
+		if err != nil {
+			return nil, PTOWrapError(err)
+		}
+	} else {
+		body.data = data
+	}
+
+	copy(body.digest[:], h.Sum(nil))
+	return body, nil
+}
+
+// Replayer replays requests recorded in the access log against a PTO
+// instance, e.g. a staging instance running an upgrade, to check that it
+// answers realistic load as the recorded instance did, and optionally with
+// the same responses as a reference instance. Only GET and HEAD
+// requests are replayed: the access log does not record request bodies, and
+// replaying writes would change the target's data.
+type Replayer struct {
+	// base URL of the replay target
+	target *url.URL
+
+	// API key to send with each request, or empty for none
+	apiKey string
+
+	// speedup relative to the recorded timing, or 0 to send requests as
+	// fast as allowed by the concurrency limit
+	speed float64
+
+	// maximum number of requests in flight
+	concurrency int
+
+	// base URL of an instance to compare response bodies with, or nil not
+	// to compare them, and the keys of JSON objects ignored when comparing
+	reference *url.URL
+	volatile  map[string]bool
+
+	client http.Client
+}
+
+// NewReplayer creates a replayer sending requests to the given base URL. A
+// speed of 1 replays requests with their recorded spacing, 2 twice as fast,
+// and so on; a speed of 0 ignores recorded timing. At most concurrency
+// requests are in flight at once.
+func NewReplayer(target string, apiKey string, speed float64, concurrency int, timeout time.Duration) (*Replayer, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	if !u.IsAbs() {
+		return nil, PTOErrorf("replay target %s is not an absolute URL", target)
+	}
+
+	if speed < 0 {
+		return nil, PTOErrorf("replay speed must not be negative")
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	return &Replayer{
+		target:      u,
+		apiKey:      apiKey,
+		speed:       speed,
+		concurrency: concurrency,
+		client:      http.Client{Timeout: timeout},
+	}, nil
+}
+
+// CompareWith makes the replayer send each request to a reference instance
+// as well, e.g. the production instance, or one running the version being
+// upgraded from with the same data as the target, and compare the bodies of
+// the target's responses with the reference's. Before comparing, links to
+// either instance are made relative to its base URL, and JSON bodies are
+// canonicalized, leaving out the values of keys listed in ReplayVolatileKeys
+// or in ignoreKeys.
+func (rp *Replayer) CompareWith(reference string, ignoreKeys []string) error {
+	u, err := url.Parse(reference)
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if !u.IsAbs() {
+		return PTOErrorf("replay reference %s is not an absolute URL", reference)
+	}
+
+	rp.reference = u
+	rp.volatile = make(map[string]bool)
+	for _, k := range append(ReplayVolatileKeys, ignoreKeys...) {
+		rp.volatile[k] = true
+	}
+	return nil
+}
+
+// Replayable returns true if an access log entry would be replayed.
+func (rp *Replayer) Replayable(e *AccessLogEntry) bool {
+	return e.Method == http.MethodGet || e.Method == http.MethodHead
+}
+
+// send sends a single recorded request to the instance at the given base
+// URL.
+func (rp *Replayer) send(base url.URL, e AccessLogEntry) (*http.Response, error) {
+	ref, err := url.Parse(e.URL)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	// recorded URLs are relative to the server root; resolve against the
+	// instance's path, so an instance behind a path prefix works
+	ref.Scheme = ""
+	ref.Host = ""
+	ref.Path = strings.TrimPrefix(ref.Path, "/")
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	req, err := http.NewRequest(e.Method, base.ResolveReference(ref).String(), nil)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if rp.apiKey != "" {
+		req.Header.Set("Authorization", "APIKEY "+rp.apiKey)
+	}
+
+	res, err := rp.client.Do(req)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return res, nil
+}
+
+// replayOne sends a single recorded request to the replay target, and to the
+// reference instance first if comparing with one.
+func (rp *Replayer) replayOne(e AccessLogEntry) ReplayResult {
+	rr := ReplayResult{Entry: e}
+
+	var refBody *replayBody
+	if rp.reference != nil {
+		res, err := rp.send(*rp.reference, e)
+		if err != nil {
+			rr.Err = err
+			return rr
+		}
+		refBody, err = readReplayBody(res)
+		res.Body.Close()
+		if err != nil {
+			rr.Err = err
+			return rr
+		}
+		rr.ReferenceStatus = res.StatusCode
+	}
+
+	start := time.Now()
+	res, err := rp.send(*rp.target, e)
+	if err != nil {
+		rr.Err = err
+		return rr
+	}
+	defer res.Body.Close()
+	rr.Status = res.StatusCode
+
+	if refBody == nil {
+		n, err := io.Copy(ioutil.Discard, res.Body)
+		rr.Duration = time.Since(start)
+		rr.Length = int(n)
+		if err != nil {
+			rr.Err = PTOWrapError(err)
+		}
+		return rr
+	}
+
+	body, err := readReplayBody(res)
+	rr.Duration = time.Since(start)
+	if err != nil {
+		rr.Err = err
+		return rr
+	}
+	rr.Length = int(body.length)
+	rr.BodyMismatch = rp.compareBodies(body, refBody)
+
+	return rr
+}
+
+// compareBodies describes how a response body from the target differs from
+// the reference's, or returns an empty string if they match.
+func (rp *Replayer) compareBodies(body *replayBody, refBody *replayBody) string {
+	if body.data == nil || refBody.data == nil {
+		if body.length != refBody.length || body.digest != refBody.digest {
+			return fmt.Sprintf("body of %d bytes differs from reference body of %d bytes", body.length, refBody.length)
+		}
+		return ""
+	}
+
+	a := rp.normalizeBody(body, rp.target)
+	b := rp.normalizeBody(refBody, rp.reference)
+	if bytes.Equal(a, b) {
+		return ""
+	}
+
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return fmt.Sprintf("body differs from reference at byte %d: %q, reference %q",
+		i, replayExcerpt(a, i), replayExcerpt(b, i))
+}
+
+// normalizeBody returns a response body from the instance at the given base
+// URL, with links to the instance made relative to it and, if the body is
+// JSON, in canonical form without the values of volatile keys.
+func (rp *Replayer) normalizeBody(body *replayBody, base *url.URL) []byte {
+	data := bytes.Replace(body.data, []byte(strings.TrimSuffix(base.String(), "/")), nil, -1)
+	if !body.isJSON {
+		return data
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return data
+	}
+
+	out, err := MarshalCanonicalJSON(rp.dropVolatile(v))
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// dropVolatile removes the volatile keys from the objects in a decoded JSON
+// value.
+func (rp *Replayer) dropVolatile(v interface{}) interface{} {
+	switch cv := v.(type) {
+	case map[string]interface{}:
+		for k, child := range cv {
+			if rp.volatile[k] {
+				delete(cv, k)
+			} else {
+				cv[k] = rp.dropVolatile(child)
+			}
+		}
+	case []interface{}:
+		for i := range cv {
+			cv[i] = rp.dropVolatile(cv[i])
+		}
+	}
+	return v
+}
+
+// replayExcerpt returns a few bytes of a body around the given offset, to
+// show where bodies differ.
+func replayExcerpt(b []byte, i int) string {
+	start, end := i-16, i+32
+	if start < 0 {
+		start = 0
+	}
+	if end > len(b) {
+		end = len(b)
+	}
+	return string(b[start:end])
+}
+
+// Replay sends the replayable entries to the replay target, with their
+// recorded spacing scaled by the replayer's speed, and passes each result to
+// the given function as it arrives. Results are passed from a single
+// goroutine, but not necessarily in log order. Replay returns the number of
+// entries skipped as not replayable once all requests have completed.
+func (rp *Replayer) Replay(entries []AccessLogEntry, result func(ReplayResult)) int {
+	skipped := 0
+
+	results := make(chan ReplayResult)
+	done := make(chan struct{})
+	go func() {
+		for rr := range results {
+			result(rr)
+		}
+		close(done)
+	}()
+
+	sem := make(chan struct{}, rp.concurrency)
+	var wg sync.WaitGroup
+
+	var first time.Time
+	start := time.Now()
+
+	for _, e := range entries {
+		if !rp.Replayable(&e) {
+			skipped++
+			continue
+		}
+
+		if first.IsZero() {
+			first = e.Time
+		}
+
+		if rp.speed > 0 {
+			due := start.Add(time.Duration(float64(e.Time.Sub(first)) / rp.speed))
+			if wait := time.Until(due); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(e AccessLogEntry) {
+			defer wg.Done()
+			rr := rp.replayOne(e)
+			<-sem
+			results <- rr
+		}(e)
+	}
+
+	wg.Wait()
+	close(results)
+	<-done
+
+	return skipped
+}
+
+// ReplaySummary summarizes the results of a replay.
+type ReplaySummary struct {
+	// Number of requests replayed
+	Requests int
+	// Number of requests whose response did not match the recording
+	Mismatches int
+	// Number of requests which failed outright
+	Errors int
+	// Response times recorded and observed during the replay
+	recorded []time.Duration
+	replayed []time.Duration
+}
+
+// Add counts a replay result in this summary.
+func (rs *ReplaySummary) Add(rr ReplayResult, checkLength bool) {
+	rs.Requests++
+	if rr.Err != nil {
+		rs.Errors++
+	} else if rr.Mismatch(checkLength) != "" {
+		rs.Mismatches++
+	}
+
+	if rr.Err == nil {
+		rs.recorded = append(rs.recorded, rr.Entry.Duration)
+		rs.replayed = append(rs.replayed, rr.Duration)
+	}
+}
+
+// durationPercentile returns the pth percentile of a list of durations,
+// sorting it in place.
+func durationPercentile(ds []time.Duration, p int) time.Duration {
+	if len(ds) == 0 {
+		return 0
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return ds[(len(ds)-1)*p/100]
+}
+
+// String describes this summary, comparing recorded and replayed response
+// times at the median and 99th percentile.
+func (rs *ReplaySummary) String() string {
+	return fmt.Sprintf("%d requests, %d mismatched, %d failed; "+
+		"median response %v (recorded %v), 99th percentile %v (recorded %v)",
+		rs.Requests, rs.Mismatches, rs.Errors,
+		durationPercentile(rs.replayed, 50), durationPercentile(rs.recorded, 50),
+		durationPercentile(rs.replayed, 99), durationPercentile(rs.recorded, 99))
+}
@@ -0,0 +1,244 @@
+package pto3
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Query results are stored as NDJSON, zstd-compressed if the query cache is
+// configured to compress results. Compressed result files have the suffix
+// .zst; results stored either way are read transparently, so compression can
+// be turned on and off without purging the cache. Results stored
+// gzip-compressed, with the suffix .gz, by earlier versions are read as well.
+
+// Content codings of stored result files
+const (
+	resultEncodingZstd = "zstd"
+	resultEncodingGzip = "gzip"
+)
+
+const compressedSuffix = ".zst"
+
+const gzipSuffix = ".gz"
+
+func compressedPath(filename string) string {
+	return filename + compressedSuffix
+}
+
+// storedPaths returns the paths a result file may be stored at: compressed,
+// gzip-compressed by an earlier version, or uncompressed.
+func storedPaths(filename string) []string {
+	return []string{compressedPath(filename), filename + gzipSuffix, filename}
+}
+
+// existingPath returns the path a result file is stored at, compressed or
+// not, if it exists, and the uncompressed path otherwise.
+func existingPath(filename string) string {
+	for _, stored := range storedPaths(filename) {
+		if _, err := os.Stat(stored); err == nil {
+			return stored
+		}
+	}
+	return filename
+}
+
+// storedEncoding returns the content coding of a result file at the given
+// path, or an empty string if it is not compressed.
+func storedEncoding(filename string) string {
+	switch {
+	case strings.HasSuffix(filename, compressedSuffix):
+		return resultEncodingZstd
+	case strings.HasSuffix(filename, gzipSuffix):
+		return resultEncodingGzip
+	}
+	return ""
+}
+
+func (qc *QueryCache) dataPath(identifier string) string {
+	return filepath.Join(qc.config.QueryCacheRoot, fmt.Sprintf("%s.ndjson", identifier))
+}
+
+// ResultFile reads a stored query result file, decompressing it if necessary.
+type ResultFile struct {
+	f *os.File
+
+	// decompressor reading from f, and function releasing it, if compressed
+	dec     io.Reader
+	release func()
+}
+
+// openResultFile opens a result file at the given path for reading,
+// decompressing it if its name has a compressed suffix.
+func openResultFile(filename string) (*ResultFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	rf := ResultFile{f: f}
+	switch storedEncoding(filename) {
+	case resultEncodingZstd:
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		rf.dec, rf.release = zr, zr.Close
+	case resultEncodingGzip:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		rf.dec, rf.release = gz, func() { gz.Close() }
+	}
+
+	return &rf, nil
+}
+
+func (rf *ResultFile) Read(p []byte) (int, error) {
+	if rf.dec != nil {
+		return rf.dec.Read(p)
+	}
+	return rf.f.Read(p)
+}
+
+// Name returns the name of the underlying file.
+func (rf *ResultFile) Name() string {
+	return rf.f.Name()
+}
+
+func (rf *ResultFile) Close() error {
+	if rf.release != nil {
+		rf.release()
+	}
+	return rf.f.Close()
+}
+
+// ReadResultFile opens this query's result file for reading, decompressing
+// it if it is stored compressed.
+func (q *Query) ReadResultFile() (*ResultFile, error) {
+	return openResultFile(existingPath(q.qc.dataPath(q.Identifier)))
+}
+
+// ReadStoredResultFile opens this query's result file as stored, returning
+// its content coding ("zstd", or "gzip" for results stored by earlier
+// versions) if it is compressed, so that it can be sent to clients accepting
+// that coding without decompressing it first.
+func (q *Query) ReadStoredResultFile() (*os.File, string, error) {
+	filename := existingPath(q.qc.dataPath(q.Identifier))
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, "", err
+	}
+	return f, storedEncoding(filename), nil
+}
+
+// resultWriter writes a query result file, compressing it if configured,
+// and counts the bytes written, before compression. Results are written to a
+// temporary file, moved into place on Close, so that readers of the previous
+// results are not disturbed while a query is executed again.
+type resultWriter struct {
+	f        *os.File
+	zw       *zstd.Encoder
+	closed   bool
+	written  *int64
+	filename string
+	stale    []string
+}
+
+// writeResultFile creates this query's result file, replacing any existing
+// results stored either compressed or uncompressed once it is closed.
+// Closing the returned writer flushes and syncs the file and moves it into
+// place; closing it again has no effect, so callers may defer Close and also
+// call it to check for errors.
+func (q *Query) writeResultFile() (*resultWriter, error) {
+	filename := q.qc.dataPath(q.Identifier)
+	if q.qc.config.CompressQueryCache {
+		filename = compressedPath(filename)
+	}
+
+	var stale []string
+	for _, stored := range storedPaths(q.qc.dataPath(q.Identifier)) {
+		if stored != filename {
+			stale = append(stale, stored)
+		}
+	}
+
+	f, err := ioutil.TempFile(q.qc.config.QueryCacheRoot, filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, PTOWrapError(err)
+	}
+
+	rw := resultWriter{f: f, written: &q.resultBytes, filename: filename, stale: stale}
+	if q.qc.config.CompressQueryCache {
+		if rw.zw, err = zstd.NewWriter(f); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, PTOWrapError(err)
+		}
+	}
+
+	return &rw, nil
+}
+
+func (rw *resultWriter) Write(p []byte) (n int, err error) {
+	if rw.zw != nil {
+		n, err = rw.zw.Write(p)
+	} else {
+		n, err = rw.f.Write(p)
+	}
+	*rw.written += int64(n)
+	return n, err
+}
+
+func (rw *resultWriter) Close() error {
+	if rw.closed {
+		return nil
+	}
+	rw.closed = true
+
+	if rw.zw != nil {
+		if err := rw.zw.Close(); err != nil {
+			rw.f.Close()
+			os.Remove(rw.f.Name())
+			return PTOWrapError(err)
+		}
+	}
+
+	if err := rw.f.Sync(); err != nil {
+		rw.f.Close()
+		os.Remove(rw.f.Name())
+		return PTOWrapError(err)
+	}
+
+	if err := rw.f.Close(); err != nil {
+		os.Remove(rw.f.Name())
+		return PTOWrapError(err)
+	}
+
+	if err := os.Rename(rw.f.Name(), rw.filename); err != nil {
+		os.Remove(rw.f.Name())
+		return PTOWrapError(err)
+	}
+
+	for _, stale := range rw.stale {
+		if err := os.Remove(stale); err != nil && !os.IsNotExist(err) {
+			return PTOWrapError(err)
+		}
+	}
+	return nil
+}
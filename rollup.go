@@ -0,0 +1,162 @@
+package pto3
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Counting observations by condition and time requires a scan of the
+// observations table, which takes far too long on large observatories to
+// serve dashboards. The observation_rollups table therefore keeps the number
+// of observations of each condition starting on each day (in UTC) in each
+// observation set. Rollups are refreshed for a set whenever observations are
+// loaded into it, in the same transaction, and removed with it, so they
+// never disagree with the observations table. Since rows are kept per set,
+// they can be summed by the campaigns the sets were derived from.
+
+// ConditionDayCount is the number of observations of a condition starting on
+// a given day, derived from raw data in a given campaign.
+type ConditionDayCount struct {
+	// Day, as YYYY-MM-DD in UTC
+	Day string `json:"day"`
+	// Condition name
+	Condition string `json:"condition"`
+	// Campaign of the raw data the observations were derived from; empty for
+	// sets not derived from raw data
+	Campaign string `json:"campaign"`
+	// Number of observations
+	Count int `json:"count"`
+}
+
+// createObservationRollupTable creates the table of observation counts per
+// set, condition, and day, and fills it in from the observations already in
+// the database.
+func createObservationRollupTable(t *pg.Tx) error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS observation_rollups (
+			set_id bigint NOT NULL REFERENCES observation_sets (id) ON DELETE CASCADE,
+			condition_id integer NOT NULL REFERENCES conditions (id) ON DELETE CASCADE,
+			day date NOT NULL,
+			count bigint NOT NULL,
+			PRIMARY KEY (set_id, condition_id, day))`,
+		"CREATE INDEX IF NOT EXISTS observation_rollups_condition_day ON observation_rollups (condition_id, day)",
+		`INSERT INTO observation_rollups (set_id, condition_id, day, count)
+			SELECT set_id, condition_id, (time_start AT TIME ZONE 'UTC')::date, count(*)
+			FROM observations GROUP BY 1, 2, 3
+			ON CONFLICT DO NOTHING`,
+	} {
+		if _, err := t.Exec(stmt); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+	return nil
+}
+
+// addObservationRollupTimeBounds adds the earliest start and latest end time
+// of the observations counted in each rollup, so that queries can tell which
+// rollups lie entirely within their time range, and fills them in from the
+// observations already in the database.
+func addObservationRollupTimeBounds(t *pg.Tx) error {
+	for _, stmt := range []string{
+		`ALTER TABLE observation_rollups
+			ADD COLUMN IF NOT EXISTS time_start_min timestamptz,
+			ADD COLUMN IF NOT EXISTS time_end_max timestamptz`,
+		`UPDATE observation_rollups AS r SET time_start_min = o.time_start_min, time_end_max = o.time_end_max
+			FROM (SELECT set_id, condition_id, (time_start AT TIME ZONE 'UTC')::date AS day,
+				min(time_start) AS time_start_min, max(time_end) AS time_end_max
+				FROM observations GROUP BY 1, 2, 3) AS o
+			WHERE r.set_id = o.set_id AND r.condition_id = o.condition_id AND r.day = o.day`,
+		// rollups without observations would be counted wrong by any query
+		"DELETE FROM observation_rollups WHERE time_start_min IS NULL OR time_end_max IS NULL",
+		`ALTER TABLE observation_rollups
+			ALTER COLUMN time_start_min SET NOT NULL,
+			ALTER COLUMN time_end_max SET NOT NULL`,
+	} {
+		if _, err := t.Exec(stmt); err != nil {
+			return PTOWrapError(err)
+		}
+	}
+	return nil
+}
+
+// refreshRollup recounts the observations in this observation set by
+// condition and day. It should be run in the transaction which changed the
+// set's observations.
+func (set *ObservationSet) refreshRollup(db orm.DB) error {
+	if _, err := db.Exec("DELETE FROM observation_rollups WHERE set_id = ?", set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	if _, err := db.Exec(`INSERT INTO observation_rollups (set_id, condition_id, day, count, time_start_min, time_end_max)
+		SELECT set_id, condition_id, (time_start AT TIME ZONE 'UTC')::date, count(*), min(time_start), max(time_end)
+		FROM observations WHERE set_id = ? GROUP BY 1, 2, 3`, set.ID); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// mergeConditionRollups moves the rollups of one condition to another, after
+// the condition's observations have been moved.
+func mergeConditionRollups(db orm.DB, from int, to int) error {
+	if _, err := db.Exec(`INSERT INTO observation_rollups (set_id, condition_id, day, count, time_start_min, time_end_max)
+		SELECT set_id, ?0, day, count, time_start_min, time_end_max FROM observation_rollups WHERE condition_id = ?1
+		ON CONFLICT (set_id, condition_id, day) DO UPDATE
+		SET count = observation_rollups.count + EXCLUDED.count,
+			time_start_min = least(observation_rollups.time_start_min, EXCLUDED.time_start_min),
+			time_end_max = greatest(observation_rollups.time_end_max, EXCLUDED.time_end_max)`, to, from); err != nil {
+		return PTOWrapError(err)
+	}
+	if _, err := db.Exec("DELETE FROM observation_rollups WHERE condition_id = ?", from); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// ConditionDayCounts returns the number of observations of the given
+// conditions per day and campaign, from the rollups, sorted by day,
+// condition, and campaign. As with query results, only observations in
+// public sets which have not been deleted are counted. If campaign is not empty, only observations in
+// sets derived from raw data in that campaign are counted. If start or end
+// is not nil, only days from start and before end are counted. Observations
+// in sets derived from several campaigns are counted for each of them.
+func ConditionDayCounts(db orm.DB, conditions []Condition, campaign string, start *time.Time, end *time.Time) ([]ConditionDayCount, error) {
+	if len(conditions) == 0 {
+		return nil, PTOErrorf("no conditions to count").StatusIs(http.StatusBadRequest)
+	}
+
+	cids := make([]int, len(conditions))
+	for i := range conditions {
+		cids[i] = conditions[i].ID
+	}
+
+	where := "r.set_id NOT IN (" + restrictedSetsClause + ") AND r.condition_id IN (?)"
+	params := []interface{}{pg.In(cids)}
+	if campaign != "" {
+		where += " AND s.campaign = ?"
+		params = append(params, campaign)
+	}
+	if start != nil {
+		where += " AND r.day >= (?::timestamptz AT TIME ZONE 'UTC')::date"
+		params = append(params, start.UTC())
+	}
+	if end != nil {
+		where += " AND r.day < (?::timestamptz AT TIME ZONE 'UTC')::date"
+		params = append(params, end.UTC())
+	}
+
+	out := make([]ConditionDayCount, 0)
+	if _, err := db.Query(&out, `SELECT to_char(r.day, 'YYYY-MM-DD') AS day, c.name AS condition,
+			coalesce(s.campaign, '') AS campaign, sum(r.count) AS count
+		FROM observation_rollups AS r
+		JOIN conditions AS c ON c.id = r.condition_id
+		LEFT JOIN (SELECT DISTINCT observation_set_id, campaign FROM observation_set_sources
+			WHERE campaign IS NOT NULL) AS s ON s.observation_set_id = r.set_id
+		WHERE `+where+`
+		GROUP BY r.day, c.name, s.campaign
+		ORDER BY r.day, c.name, campaign`, params...); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	return out, nil
+}
@@ -0,0 +1,330 @@
+package pto3
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Very large raw data files are stored compressed in the zstd seekable
+// format: a sequence of independently compressed zstd frames, each holding
+// SeekableFrameSize bytes of data, followed by a seek table in a skippable
+// frame giving the compressed and decompressed size of each frame. A reader
+// can then start at any offset by decompressing only the frame containing
+// it, so Range requests and excerpts are served without decompressing the
+// file from the start. Files in this format can be decompressed by any zstd
+// implementation, which ignores the seek table.
+
+// SeekableFrameSize is the amount of data compressed into each frame of a
+// file stored in the seekable format.
+const SeekableFrameSize = 1 << 20
+
+const (
+	seekableSkippableMagic = 0x184D2A5E
+	seekableFooterMagic    = 0x8F92EAB1
+	seekableFooterSize     = 9
+	seekableEntrySize      = 8
+)
+
+// seekableFrame locates one frame of a seekable file.
+type seekableFrame struct {
+	// offset and size of the frame in the compressed file
+	coff  int64
+	csize int64
+	// offset and size of the frame's data
+	doff  int64
+	dsize int64
+}
+
+// SeekableReader reads a file stored in the zstd seekable format. Reads and
+// seeks refer to the decompressed data.
+type SeekableReader struct {
+	f      *os.File
+	dec    *zstd.Decoder
+	frames []seekableFrame
+	size   int64
+	pos    int64
+
+	// the most recently decompressed frame, or -1
+	cur int
+	buf []byte
+}
+
+// OpenSeekable opens a file stored in the zstd seekable format for reading.
+func OpenSeekable(pathname string) (*SeekableReader, error) {
+	f, err := os.Open(pathname)
+	if err != nil {
+		return nil, err
+	}
+
+	sr := SeekableReader{f: f, cur: -1}
+	if err := sr.readSeekTable(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if sr.dec, err = zstd.NewReader(nil); err != nil {
+		f.Close()
+		return nil, PTOWrapError(err)
+	}
+
+	return &sr, nil
+}
+
+// readSeekTable reads the seek table from the end of the file, building the
+// frame index.
+func (sr *SeekableReader) readSeekTable() error {
+	fi, err := sr.f.Stat()
+	if err != nil {
+		return PTOWrapError(err)
+	}
+
+	if fi.Size() < seekableFooterSize {
+		return PTOErrorf("%s is too short to be a seekable zstd file", sr.f.Name())
+	}
+
+	footer := make([]byte, seekableFooterSize)
+	if _, err := sr.f.ReadAt(footer, fi.Size()-seekableFooterSize); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableFooterMagic {
+		return PTOErrorf("%s has no seekable zstd seek table", sr.f.Name())
+	}
+
+	// seek table entries carry checksums if the descriptor's top bit is set
+	nframes := int64(binary.LittleEndian.Uint32(footer[0:]))
+	entrySize := int64(seekableEntrySize)
+	if footer[4]&0x80 != 0 {
+		entrySize += 4
+	}
+
+	tableSize := nframes*entrySize + seekableFooterSize
+	if tableSize+8 > fi.Size() {
+		return PTOErrorf("%s has a truncated seek table", sr.f.Name())
+	}
+
+	table := make([]byte, tableSize-seekableFooterSize)
+	if _, err := sr.f.ReadAt(table, fi.Size()-tableSize); err != nil {
+		return PTOWrapError(err)
+	}
+
+	sr.frames = make([]seekableFrame, nframes)
+	var coff, doff int64
+	for i := range sr.frames {
+		entry := table[int64(i)*entrySize:]
+		sr.frames[i] = seekableFrame{
+			coff:  coff,
+			csize: int64(binary.LittleEndian.Uint32(entry[0:])),
+			doff:  doff,
+			dsize: int64(binary.LittleEndian.Uint32(entry[4:])),
+		}
+		coff += sr.frames[i].csize
+		doff += sr.frames[i].dsize
+	}
+
+	if coff+8+tableSize != fi.Size() {
+		return PTOErrorf("%s seek table does not match its frames", sr.f.Name())
+	}
+
+	sr.size = doff
+	return nil
+}
+
+// Size returns the size of the decompressed data.
+func (sr *SeekableReader) Size() int64 {
+	return sr.size
+}
+
+// loadFrame decompresses frame i into the frame buffer, unless it is there
+// already.
+func (sr *SeekableReader) loadFrame(i int) error {
+	if i == sr.cur {
+		return nil
+	}
+
+	frame := sr.frames[i]
+	compressed := make([]byte, frame.csize)
+	if _, err := sr.f.ReadAt(compressed, frame.coff); err != nil {
+		return PTOWrapError(err)
+	}
+
+	sr.cur = -1
+	buf, err := sr.dec.DecodeAll(compressed, sr.buf[:0])
+	if err != nil {
+		return PTOWrapError(err)
+	}
+	if int64(len(buf)) != frame.dsize {
+		return PTOErrorf("frame %d of %s decompressed to %d bytes, expected %d", i, sr.f.Name(), len(buf), frame.dsize)
+	}
+
+	sr.buf = buf
+	sr.cur = i
+	return nil
+}
+
+func (sr *SeekableReader) Read(p []byte) (int, error) {
+	if sr.pos >= sr.size {
+		return 0, io.EOF
+	}
+
+	// find the frame containing the current position
+	i := sort.Search(len(sr.frames), func(i int) bool {
+		return sr.frames[i].doff+sr.frames[i].dsize > sr.pos
+	})
+	if err := sr.loadFrame(i); err != nil {
+		return 0, err
+	}
+
+	n := copy(p, sr.buf[sr.pos-sr.frames[i].doff:])
+	sr.pos += int64(n)
+	return n, nil
+}
+
+func (sr *SeekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.pos
+	case io.SeekEnd:
+		offset += sr.size
+	default:
+		return sr.pos, PTOErrorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return sr.pos, PTOErrorf("negative position %d", offset)
+	}
+
+	sr.pos = offset
+	return sr.pos, nil
+}
+
+// Stat returns information about the underlying file, with the size of the
+// decompressed data.
+func (sr *SeekableReader) Stat() (os.FileInfo, error) {
+	fi, err := sr.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return seekableFileInfo{fi, sr.size}, nil
+}
+
+func (sr *SeekableReader) Close() error {
+	sr.dec.Close()
+	return sr.f.Close()
+}
+
+// seekableFileInfo describes a seekable file by the size of its decompressed
+// data.
+type seekableFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi seekableFileInfo) Size() int64 {
+	return fi.size
+}
+
+// SeekableWriter writes a file in the zstd seekable format. Data is buffered
+// and compressed a frame at a time; Close writes the final frame and the seek
+// table, and must be called for the file to be readable.
+type SeekableWriter struct {
+	f     *os.File
+	enc   *zstd.Encoder
+	buf   []byte
+	out   []byte
+	table []byte
+	n     uint32
+}
+
+// CreateSeekable creates a file in the zstd seekable format for writing.
+func CreateSeekable(pathname string) (*SeekableWriter, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	f, err := os.Create(pathname)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+
+	return &SeekableWriter{f: f, enc: enc, buf: make([]byte, 0, SeekableFrameSize)}, nil
+}
+
+func (sw *SeekableWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		p = p[n:]
+		written += n
+
+		if len(sw.buf) == cap(sw.buf) {
+			if err := sw.writeFrame(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writeFrame compresses the buffered data into a frame, and adds it to the
+// seek table.
+func (sw *SeekableWriter) writeFrame() error {
+	if len(sw.buf) == 0 {
+		return nil
+	}
+
+	sw.out = sw.enc.EncodeAll(sw.buf, sw.out[:0])
+	if _, err := sw.f.Write(sw.out); err != nil {
+		return PTOWrapError(err)
+	}
+
+	var entry [seekableEntrySize]byte
+	binary.LittleEndian.PutUint32(entry[0:], uint32(len(sw.out)))
+	binary.LittleEndian.PutUint32(entry[4:], uint32(len(sw.buf)))
+	sw.table = append(sw.table, entry[:]...)
+	sw.n++
+
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+// Close writes the final frame and the seek table, and closes the file.
+func (sw *SeekableWriter) Close() error {
+	defer sw.enc.Close()
+
+	if err := sw.writeFrame(); err != nil {
+		sw.f.Close()
+		return err
+	}
+
+	// seek table frame header, entries, and footer without checksums
+	header := make([]byte, 8)
+	binary.LittleEndian.PutUint32(header[0:], seekableSkippableMagic)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(sw.table)+seekableFooterSize))
+
+	footer := make([]byte, seekableFooterSize)
+	binary.LittleEndian.PutUint32(footer[0:], sw.n)
+	binary.LittleEndian.PutUint32(footer[5:], seekableFooterMagic)
+
+	for _, b := range [][]byte{header, sw.table, footer} {
+		if _, err := sw.f.Write(b); err != nil {
+			sw.f.Close()
+			return PTOWrapError(err)
+		}
+	}
+
+	if err := sw.f.Sync(); err != nil {
+		sw.f.Close()
+		return PTOWrapError(err)
+	}
+
+	return sw.f.Close()
+}
@@ -0,0 +1,270 @@
+package pto3
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/go-pg/pg"
+)
+
+// PublicMetadataKey is the metadata key marking an observation set as public
+// when its value is "true". Public sets are published in snapshots once they
+// are sealed.
+const PublicMetadataKey = "_public"
+
+// Names of the files describing a snapshot directory
+const (
+	SnapshotCatalogFilename   = "catalog.json"
+	SnapshotChecksumsFilename = "SHA256SUMS"
+)
+
+// SnapshotCatalog describes a snapshot of the public, sealed observation sets
+// of an observatory for a given period, as written to the snapshot's
+// catalog.json.
+type SnapshotCatalog struct {
+	// Observatory the snapshot was taken from
+	Observatory string `json:"observatory"`
+	// Time at which the snapshot was taken
+	Created time.Time `json:"created"`
+	// Start of the period covered by the snapshot, if bounded
+	TimeStart *time.Time `json:"time_start,omitempty"`
+	// End of the period covered by the snapshot, if bounded
+	TimeEnd *time.Time `json:"time_end,omitempty"`
+	// Observation sets in the snapshot, in order of set ID
+	Sets []SnapshotSet `json:"sets"`
+}
+
+// SnapshotSet describes a single observation set in a snapshot.
+type SnapshotSet struct {
+	// Globally unique identifier of the set
+	UUID string `json:"uuid"`
+	// Link to the set in the observatory the snapshot was taken from
+	Link string `json:"link"`
+	// Name of the observation set file holding the set's metadata and data
+	File string `json:"file"`
+	// Name of the file holding the set's metadata alone
+	MetadataFile string `json:"metadata_file"`
+	// Size of the observation set file in bytes
+	Size int64 `json:"size"`
+	// SHA-256 digest of the observation set file, as a hex string
+	SHA256 string `json:"sha256"`
+	// Number of observations in the set
+	Count int `json:"count"`
+	// Earliest start time of an observation in the set
+	TimeStart *time.Time `json:"time_start,omitempty"`
+	// Latest end time of an observation in the set
+	TimeEnd *time.Time `json:"time_end,omitempty"`
+}
+
+// ObservationSetIDsForSnapshot lists the IDs of all public, sealed observation
+// sets in the database with observations in the interval between the given
+// start and end times, except those with restricted visibility or marked
+// deleted. Either time may be nil, leaving that end of the interval open.
+func ObservationSetIDsForSnapshot(db *pg.DB, start *time.Time, end *time.Time) ([]int, error) {
+	publicSetIds, err := ObservationSetIDsWithMetadataValue(db, PublicMetadataKey, "true")
+	if err != nil {
+		return nil, err
+	}
+
+	sealedSetIds, err := ObservationSetIDsSealed(db, true)
+	if err != nil {
+		return nil, err
+	}
+
+	overlappingSetIds, err := ObservationSetIDsOverlapping(db, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	// all three lists are sorted, so intersect them in one pass
+	setIds := make([]int, 0)
+	i, j, k := 0, 0, 0
+	for i < len(publicSetIds) && j < len(sealedSetIds) && k < len(overlappingSetIds) {
+		a, b, c := publicSetIds[i], sealedSetIds[j], overlappingSetIds[k]
+		if a == b && b == c {
+			setIds = append(setIds, a)
+			i++
+			j++
+			k++
+		} else if a <= b && a <= c {
+			i++
+		} else if b <= a && b <= c {
+			j++
+		} else {
+			k++
+		}
+	}
+
+	// leave out sets which are not visible to everyone, or were deleted
+	restricted, err := RestrictedObservationSets(db)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int, 0, len(setIds))
+	for _, setid := range setIds {
+		if _, ok := restricted[setid]; !ok {
+			out = append(out, setid)
+		}
+	}
+
+	return out, nil
+}
+
+// writeSnapshotFile writes a file into a snapshot directory, returning its
+// size and SHA-256 digest.
+func writeSnapshotFile(dir string, filename string, write func(f *os.File) error) (int64, string, error) {
+	pathname := filepath.Join(dir, filename)
+
+	f, err := os.Create(pathname)
+	if err != nil {
+		return 0, "", PTOWrapError(err)
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		return 0, "", err
+	}
+
+	if err := f.Close(); err != nil {
+		return 0, "", PTOWrapError(err)
+	}
+
+	fi, err := os.Stat(pathname)
+	if err != nil {
+		return 0, "", PTOWrapError(err)
+	}
+
+	digest, err := digestFile(pathname)
+	if err != nil {
+		return 0, "", PTOWrapError(err)
+	}
+
+	return fi.Size(), digest, nil
+}
+
+// PublishSnapshot exports all public, sealed observation sets with
+// observations between the given start and end times into a snapshot
+// directory, which must not exist or be empty. For each set, the directory
+// receives an observation set file <id>.ndjson and its metadata alone as
+// <id>.json, where <id> is the set ID in hex. The directory also receives a
+// catalog.json describing the snapshot, and a SHA256SUMS file listing the
+// digests of all other files in the format of sha256sum(1), so that the
+// snapshot can be hosted on a plain web server or uploaded to an archive
+// and verified by its users. Observation set files are written within the
+// configured BackgroundBandwidth, as the snapshot directory may well be on
+// network storage.
+func PublishSnapshot(config *PTOConfiguration, db *pg.DB, dir string, start *time.Time, end *time.Time) (*SnapshotCatalog, error) {
+	// refuse to mix snapshots
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, PTOWrapError(err)
+	}
+	if direntries, err := ioutil.ReadDir(dir); err != nil {
+		return nil, PTOWrapError(err)
+	} else if len(direntries) > 0 {
+		return nil, PTOErrorf("snapshot directory %s is not empty", dir)
+	}
+
+	setIds, err := ObservationSetIDsForSnapshot(db, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := SnapshotCatalog{
+		Observatory: config.BaseURL,
+		Created:     time.Now().UTC(),
+		TimeStart:   start,
+		TimeEnd:     end,
+		Sets:        make([]SnapshotSet, 0, len(setIds)),
+	}
+
+	digests := make(map[string]string)
+
+	for _, setid := range setIds {
+		set := ObservationSet{ID: setid}
+		if err := set.SelectByID(db); err != nil {
+			return nil, PTOWrapError(err)
+		}
+		set.LinkVia(config)
+
+		// make sure the metadata carries the count and time interval
+		if _, err := set.CountObservations(db); err != nil {
+			return nil, err
+		}
+		if _, _, err := set.TimeInterval(db); err != nil {
+			return nil, err
+		}
+
+		ss := SnapshotSet{
+			UUID:         set.UUID(),
+			Link:         set.Link(),
+			File:         fmt.Sprintf("%x.ndjson", set.ID),
+			MetadataFile: fmt.Sprintf("%x.json", set.ID),
+			Count:        set.Count,
+			TimeStart:    set.TimeStart,
+			TimeEnd:      set.TimeEnd,
+		}
+
+		ss.Size, ss.SHA256, err = writeSnapshotFile(dir, ss.File, func(f *os.File) error {
+			return set.CopyFileToStream(db, config.BackgroundLimiter().Writer(f))
+		})
+		if err != nil {
+			return nil, err
+		}
+		digests[ss.File] = ss.SHA256
+
+		_, digests[ss.MetadataFile], err = writeSnapshotFile(dir, ss.MetadataFile, func(f *os.File) error {
+			b, err := json.Marshal(&set)
+			if err != nil {
+				return PTOWrapError(err)
+			}
+			if _, err := f.Write(b); err != nil {
+				return PTOWrapError(err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		catalog.Sets = append(catalog.Sets, ss)
+	}
+
+	_, digests[SnapshotCatalogFilename], err = writeSnapshotFile(dir, SnapshotCatalogFilename, func(f *os.File) error {
+		b, err := json.MarshalIndent(&catalog, "", "  ")
+		if err != nil {
+			return PTOWrapError(err)
+		}
+		if _, err := f.Write(b); err != nil {
+			return PTOWrapError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// write the checksums last, sorted by filename
+	filenames := make([]string, 0, len(digests))
+	for filename := range digests {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	if _, _, err := writeSnapshotFile(dir, SnapshotChecksumsFilename, func(f *os.File) error {
+		for _, filename := range filenames {
+			if _, err := fmt.Fprintf(f, "%s  %s\n", digests[filename], filename); err != nil {
+				return PTOWrapError(err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &catalog, nil
+}
@@ -0,0 +1,148 @@
+package pto3
+
+import (
+	"sort"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// ObservatoryStats summarizes the contents of the whole observatory, raw data
+// store and observation database, as on a public status page.
+type ObservatoryStats struct {
+	// Number of raw data campaigns
+	Campaigns int `json:"campaigns"`
+	// Number of raw data files in all campaigns
+	RawFiles int `json:"raw_files"`
+	// Total size of raw data files in bytes
+	RawBytes int64 `json:"raw_bytes"`
+	// Number of observation sets
+	ObservationSets int `json:"observation_sets"`
+	// Number of observations in all observation sets
+	Observations int `json:"observations"`
+	// Number of distinct conditions appearing in observations
+	Conditions int `json:"conditions"`
+	// Number of distinct paths appearing in observations
+	Paths int `json:"paths"`
+	// Additions to the observatory per month, sorted by month
+	Growth []*ObservatoryGrowth `json:"growth"`
+}
+
+// ObservatoryGrowth counts the raw data and observations added to the
+// observatory in a single month.
+type ObservatoryGrowth struct {
+	// Month, as YYYY-MM in UTC
+	Month string `json:"month"`
+	// Number of raw data files created in the month
+	RawFiles int `json:"raw_files"`
+	// Total size of raw data files created in the month
+	RawBytes int64 `json:"raw_bytes"`
+	// Number of observation sets created in the month
+	ObservationSets int `json:"observation_sets"`
+	// Number of observations in observation sets created in the month
+	Observations int `json:"observations"`
+}
+
+// NewObservatoryStats creates an empty summary, to be filled in with
+// AddRawDataStats and AddObservationStats for the stores the observatory has.
+func NewObservatoryStats() *ObservatoryStats {
+	return &ObservatoryStats{Growth: make([]*ObservatoryGrowth, 0)}
+}
+
+// growthFor returns the growth entry for the month containing the given
+// time, adding it if necessary.
+func (stats *ObservatoryStats) growthFor(t time.Time) *ObservatoryGrowth {
+	month := t.UTC().Format("2006-01")
+	for _, g := range stats.Growth {
+		if g.Month == month {
+			return g
+		}
+	}
+
+	g := &ObservatoryGrowth{Month: month}
+	stats.Growth = append(stats.Growth, g)
+	return g
+}
+
+func (stats *ObservatoryStats) sortGrowth() {
+	sort.Slice(stats.Growth, func(i, j int) bool { return stats.Growth[i].Month < stats.Growth[j].Month })
+}
+
+// AddRawDataStats adds the campaigns and files in a raw data store to this
+// summary. Files count toward growth in the month of their creation time.
+func (stats *ObservatoryStats) AddRawDataStats(rds *RawDataStore) error {
+	for _, camname := range rds.CampaignNames() {
+		cam, err := rds.CampaignForName(camname)
+		if err != nil {
+			return err
+		}
+
+		filenames, err := cam.FileNames()
+		if err != nil {
+			return err
+		}
+
+		stats.Campaigns++
+		for _, filename := range filenames {
+			md, err := cam.GetFileMetadata(filename)
+			if err != nil {
+				return err
+			}
+
+			stats.RawFiles++
+			stats.RawBytes += int64(md.datasize)
+
+			if creatime := md.CreationTime(); creatime != nil {
+				g := stats.growthFor(*creatime)
+				g.RawFiles++
+				g.RawBytes += int64(md.datasize)
+			}
+		}
+	}
+
+	stats.sortGrowth()
+	return nil
+}
+
+// AddObservationStats adds the observation sets and observations in an
+// observation database to this summary. Observations count toward growth in
+// the month their observation set was created.
+func (stats *ObservatoryStats) AddObservationStats(db orm.DB) error {
+	if _, err := db.QueryOne(pg.Scan(&stats.ObservationSets), "SELECT count(*) FROM observation_sets"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := db.QueryOne(pg.Scan(&stats.Observations, &stats.Conditions),
+		`SELECT coalesce(sum(count), 0), count(DISTINCT condition_id) FROM observation_rollups`); err != nil {
+		return PTOWrapError(err)
+	}
+
+	if _, err := db.QueryOne(pg.Scan(&stats.Paths), "SELECT count(DISTINCT path_id) FROM observations"); err != nil {
+		return PTOWrapError(err)
+	}
+
+	var monthCounts []struct {
+		Created         time.Time
+		ObservationSets int
+		Observations    int
+	}
+	if _, err := db.Query(&monthCounts,
+		`SELECT date_trunc('month', observation_sets.created AT TIME ZONE 'UTC') AS created,
+			count(DISTINCT observation_sets.id) AS observation_sets,
+			coalesce(sum(observation_rollups.count), 0) AS observations
+		FROM observation_sets LEFT JOIN observation_rollups ON observation_rollups.set_id = observation_sets.id
+		WHERE observation_sets.created IS NOT NULL
+		GROUP BY 1`); err != nil {
+		return PTOWrapError(err)
+	}
+
+	for _, mc := range monthCounts {
+		g := stats.growthFor(mc.Created)
+		g.ObservationSets += mc.ObservationSets
+		g.Observations += mc.Observations
+	}
+
+	stats.sortGrowth()
+	return nil
+}
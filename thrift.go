@@ -0,0 +1,112 @@
+package pto3
+
+// thriftWriter writes structures in the Thrift compact protocol, as used for
+// the metadata of Parquet files. Only what Parquet metadata needs is
+// supported: structs of integers, booleans, strings, structs, and lists.
+type thriftWriter struct {
+	buf []byte
+
+	// last field ID written in the current struct, and in enclosing ones
+	lastField  int16
+	fieldStack []int16
+}
+
+// Thrift compact protocol type codes
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+func (w *thriftWriter) varint(v uint64) {
+	for v >= 0x80 {
+		w.buf = append(w.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	w.buf = append(w.buf, byte(v))
+}
+
+func (w *thriftWriter) zigzag(v int64) {
+	w.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *thriftWriter) fieldHeader(id int16, typ byte) {
+	if delta := id - w.lastField; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|typ)
+	} else {
+		w.buf = append(w.buf, typ)
+		w.zigzag(int64(id))
+	}
+	w.lastField = id
+}
+
+func (w *thriftWriter) writeBool(id int16, v bool) {
+	if v {
+		w.fieldHeader(id, thriftTrue)
+	} else {
+		w.fieldHeader(id, thriftFalse)
+	}
+}
+
+func (w *thriftWriter) writeI32(id int16, v int32) {
+	w.fieldHeader(id, thriftI32)
+	w.zigzag(int64(v))
+}
+
+func (w *thriftWriter) writeI64(id int16, v int64) {
+	w.fieldHeader(id, thriftI64)
+	w.zigzag(v)
+}
+
+func (w *thriftWriter) writeString(id int16, s string) {
+	w.fieldHeader(id, thriftBinary)
+	w.varint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// beginStruct starts a struct, as a field with the given ID, or as a list
+// element if the ID is 0. It is finished with endStruct.
+func (w *thriftWriter) beginStruct(id int16) {
+	if id != 0 {
+		w.fieldHeader(id, thriftStruct)
+	}
+	w.fieldStack = append(w.fieldStack, w.lastField)
+	w.lastField = 0
+}
+
+func (w *thriftWriter) endStruct() {
+	w.buf = append(w.buf, 0)
+	w.lastField = w.fieldStack[len(w.fieldStack)-1]
+	w.fieldStack = w.fieldStack[:len(w.fieldStack)-1]
+}
+
+// beginList starts a list field of n elements of the given type, which are
+// then written in order: structs with beginStruct(0), others with the
+// element writers below.
+func (w *thriftWriter) beginList(id int16, elemType byte, n int) {
+	w.fieldHeader(id, thriftList)
+	if n < 15 {
+		w.buf = append(w.buf, byte(n)<<4|elemType)
+	} else {
+		w.buf = append(w.buf, 0xf0|elemType)
+		w.varint(uint64(n))
+	}
+}
+
+func (w *thriftWriter) elemI32(v int32) {
+	w.zigzag(int64(v))
+}
+
+func (w *thriftWriter) elemString(s string) {
+	w.varint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+// bytes finishes the top-level struct, and returns the encoded bytes.
+func (w *thriftWriter) bytes() []byte {
+	return append(w.buf, 0)
+}
@@ -0,0 +1,117 @@
+package pto3
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// BandwidthLimiter limits the rate of the data transfers sharing it to a
+// maximum number of bytes per second, so that background transfers do not
+// starve interactive traffic. Transfers may burst up to one second's worth
+// of data after being idle. A nil BandwidthLimiter does not limit transfers.
+type BandwidthLimiter struct {
+	rate  float64
+	avail float64
+	last  time.Time
+	lock  sync.Mutex
+}
+
+// NewBandwidthLimiter creates a limiter for the given rate in bytes per
+// second, or returns nil, not limiting transfers, if the rate is not
+// positive.
+func NewBandwidthLimiter(bytesPerSecond int64) *BandwidthLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	return &BandwidthLimiter{
+		rate:  float64(bytesPerSecond),
+		avail: float64(bytesPerSecond),
+		last:  time.Now(),
+	}
+}
+
+// Wait blocks until n more bytes may be transferred.
+func (bl *BandwidthLimiter) Wait(n int) {
+	if bl == nil || n <= 0 {
+		return
+	}
+
+	bl.lock.Lock()
+
+	// replenish the allowance for the time since the last transfer
+	now := time.Now()
+	bl.avail += now.Sub(bl.last).Seconds() * bl.rate
+	if bl.avail > bl.rate {
+		bl.avail = bl.rate
+	}
+	bl.last = now
+
+	// take this transfer out of the allowance, waiting off any debt
+	bl.avail -= float64(n)
+	var delay time.Duration
+	if bl.avail < 0 {
+		delay = time.Duration(-bl.avail / bl.rate * float64(time.Second))
+	}
+
+	bl.lock.Unlock()
+
+	time.Sleep(delay)
+}
+
+// chunk returns the largest number of bytes to transfer at once, so that
+// large reads and writes are paced rather than sent in bursts.
+func (bl *BandwidthLimiter) chunk(n int) int {
+	if max := int(bl.rate/10) + 1; n > max {
+		return max
+	}
+	return n
+}
+
+type limitedReader struct {
+	r  io.Reader
+	bl *BandwidthLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p[:lr.bl.chunk(len(p))])
+	lr.bl.Wait(n)
+	return n, err
+}
+
+type limitedWriter struct {
+	w  io.Writer
+	bl *BandwidthLimiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := lw.w.Write(p[written : written+lw.bl.chunk(len(p)-written)])
+		written += n
+		lw.bl.Wait(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Reader returns a reader reading from r at the limited rate, or r itself if
+// bl is nil.
+func (bl *BandwidthLimiter) Reader(r io.Reader) io.Reader {
+	if bl == nil {
+		return r
+	}
+	return &limitedReader{r: r, bl: bl}
+}
+
+// Writer returns a writer writing to w at the limited rate, or w itself if bl
+// is nil.
+func (bl *BandwidthLimiter) Writer(w io.Writer) io.Writer {
+	if bl == nil {
+		return w
+	}
+	return &limitedWriter{w: w, bl: bl}
+}
@@ -0,0 +1,133 @@
+package pto3
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// TimeCheck determines what happens to uploaded observations whose times lie
+// outside the time range of their set's raw data sources, which usually
+// means the analyzer that produced them got its clock or time parsing wrong.
+type TimeCheck string
+
+const (
+	// TimeCheckNone does not check observation times
+	TimeCheckNone TimeCheck = ""
+	// TimeCheckReject refuses the upload if any observation is out of range
+	TimeCheckReject TimeCheck = "reject"
+	// TimeCheckFlag loads all observations, but counts those out of range in
+	// the set's __time_outliers metadata
+	TimeCheckFlag TimeCheck = "flag"
+)
+
+// ParseTimeCheck parses a time check by name, returning an error with status
+// 400 for an unknown check.
+func ParseTimeCheck(s string) (TimeCheck, error) {
+	switch check := TimeCheck(s); check {
+	case TimeCheckNone, TimeCheckReject, TimeCheckFlag:
+		return check, nil
+	default:
+		return TimeCheckNone, PTOErrorf("unknown time check %s", s).StatusIs(http.StatusBadRequest)
+	}
+}
+
+// SourceTimeRange returns the earliest start time and the latest end time of
+// this ObservationSet's sources which are raw data files on this PTO, from
+// their _time_start and _time_end metadata in the given raw data store. It
+// returns an error with status 400 if the set has no such sources, or one of
+// them does not exist.
+func (set *ObservationSet) SourceTimeRange(config *PTOConfiguration, rds *RawDataStore) (time.Time, time.Time, error) {
+	var start, end time.Time
+
+	found := false
+	for _, link := range set.Sources {
+		camname, filename, ok := config.RawFileForLink(link)
+		if !ok || rds == nil {
+			continue
+		}
+
+		cam, err := rds.CampaignForName(camname)
+		if err != nil {
+			return start, end, PTOErrorf("source %s: %s", link, err.Error()).StatusIs(http.StatusBadRequest)
+		}
+		md, err := cam.GetFileMetadata(filename)
+		if err != nil {
+			return start, end, PTOErrorf("source %s: %s", link, err.Error()).StatusIs(http.StatusBadRequest)
+		}
+
+		ts, te := md.TimeStart(true), md.TimeEnd(true)
+		if ts == nil || te == nil {
+			continue
+		}
+
+		if !found || ts.Before(start) {
+			start = *ts
+		}
+		if !found || te.After(end) {
+			end = *te
+		}
+		found = true
+	}
+
+	if !found {
+		return start, end, PTOErrorf("observation set has no raw data sources on this PTO to check observation times against").StatusIs(http.StatusBadRequest)
+	}
+
+	return start, end, nil
+}
+
+// CheckTimes makes this ObservationReader check that each observation it
+// reads from now on starts no earlier than start and ends no later than end.
+// With TimeCheckReject, Next returns an error with status 400 for the first
+// observation out of range; with TimeCheckFlag, it counts them in
+// TimeOutliers.
+func (obsr *ObservationReader) CheckTimes(start time.Time, end time.Time, check TimeCheck) {
+	obsr.timeCheck = check
+	obsr.checkStart = start
+	obsr.checkEnd = end
+}
+
+// TimeOutliers returns the number of observations read out of the range given
+// to CheckTimes.
+func (obsr *ObservationReader) TimeOutliers() int {
+	return obsr.timeOutliers
+}
+
+// checkTime checks an observation read at the current line against the range
+// given to CheckTimes, if any.
+func (obsr *ObservationReader) checkTime(obs *Observation) error {
+	if obsr.timeCheck == TimeCheckNone {
+		return nil
+	}
+
+	if (obs.TimeStart == nil || !obs.TimeStart.Before(obsr.checkStart)) &&
+		(obs.TimeEnd == nil || !obs.TimeEnd.After(obsr.checkEnd)) {
+		return nil
+	}
+
+	if obsr.timeCheck == TimeCheckFlag {
+		obsr.timeOutliers++
+		return nil
+	}
+
+	return PTOErrorf("observation at line %d lies outside the time range of the set's sources, %s to %s",
+		obsr.lineno, obsr.checkStart.Format(time.RFC3339), obsr.checkEnd.Format(time.RFC3339)).StatusIs(http.StatusBadRequest)
+}
+
+// AddTimeOutliers adds to the number of observations in this ObservationSet
+// flagged as lying outside the time range of its sources when uploaded. Like
+// the submitter, the count is kept out of the set's metadata, so that it
+// survives metadata updates; it appears as __time_outliers.
+func (set *ObservationSet) AddTimeOutliers(db orm.DB, n int) error {
+	if _, err := db.QueryOne(pg.Scan(&set.timeOutliers),
+		"UPDATE observation_sets SET time_outliers = coalesce(time_outliers, 0) + ? WHERE id = ? RETURNING time_outliers", n, set.ID); err != nil {
+		if err == pg.ErrNoRows {
+			return PTOErrorf("observation set %x not found", set.ID).StatusIs(http.StatusNotFound)
+		}
+		return PTOWrapError(err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package pto3
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACMEOptions configures obtaining and renewing certificates automatically
+// from an ACME certificate authority such as Let's Encrypt, for deployments
+// serving the API directly rather than behind a reverse proxy terminating
+// TLS. By using ACME, the operator accepts the certificate authority's terms
+// of service.
+type ACMEOptions struct {
+	// Directory to cache account keys and certificates in, created if it does
+	// not exist; must be kept across restarts to avoid hitting the
+	// authority's rate limits
+	CacheDir string
+
+	// Contact address given to the certificate authority for notices about
+	// certificates; optional
+	Email string
+
+	// Host names to obtain certificates for; the host name of BaseURL if
+	// empty. Requests for other names are refused during the TLS handshake.
+	Hosts []string
+
+	// Address to serve ACME HTTP challenges on, and redirect other plain HTTP
+	// requests to HTTPS from; :80 if empty
+	ChallengeAddress string
+
+	// Directory URL of the ACME certificate authority; Let's Encrypt's
+	// production directory if empty
+	DirectoryURL string
+}
+
+// TLSConfig returns the TLS configuration to serve HTTPS with, or nil to
+// serve plain HTTP. With ACME, it also returns the certificate manager,
+// whose HTTPHandler must be served on ChallengeAddress for certificates to
+// be issued. It returns an error if the certificate and private key cannot
+// be loaded, if both files and ACME are configured, or if ACME has no cache
+// directory or host names.
+func (config *PTOConfiguration) TLSConfig() (*tls.Config, *autocert.Manager, error) {
+	if config.ACME == nil {
+		if config.CertificateFile == "" || config.PrivateKeyFile == "" {
+			return nil, nil, nil
+		}
+
+		cert, err := tls.LoadX509KeyPair(config.CertificateFile, config.PrivateKeyFile)
+		if err != nil {
+			return nil, nil, PTOErrorf("loading certificate and private key: %s", err.Error())
+		}
+		return &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}, nil, nil
+	}
+
+	if config.CertificateFile != "" || config.PrivateKeyFile != "" {
+		return nil, nil, PTOErrorf("configure either ACME or CertificateFile and PrivateKeyFile, not both")
+	}
+
+	opts := config.ACME
+	if opts.CacheDir == "" {
+		return nil, nil, PTOErrorf("ACME requires a CacheDir")
+	}
+	if err := os.MkdirAll(opts.CacheDir, 0700); err != nil {
+		return nil, nil, PTOWrapError(err)
+	}
+
+	hosts := opts.Hosts
+	if len(hosts) == 0 && config.baseURL != nil && config.baseURL.Hostname() != "" {
+		hosts = []string{config.baseURL.Hostname()}
+	}
+	if len(hosts) == 0 {
+		return nil, nil, PTOErrorf("ACME requires Hosts, or a BaseURL with a host name")
+	}
+	for _, host := range hosts {
+		if net.ParseIP(host) != nil {
+			return nil, nil, PTOErrorf("ACME cannot obtain a certificate for IP address %s", host)
+		}
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(opts.CacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      opts.Email,
+	}
+	if opts.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: opts.DirectoryURL}
+	}
+
+	tc := m.TLSConfig()
+	tc.MinVersion = tls.VersionTLS12
+	return tc, m, nil
+}
+
+// ACMEChallengeAddress returns the address to serve ACME HTTP challenges on.
+func (config *PTOConfiguration) ACMEChallengeAddress() string {
+	if config.ACME == nil || config.ACME.ChallengeAddress == "" {
+		return ":80"
+	}
+	return config.ACME.ChallengeAddress
+}
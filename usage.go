@@ -0,0 +1,300 @@
+package pto3
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/go-pg/pg/orm"
+)
+
+// Each execution of a query is accounted for the resources it uses: the CPU
+// time ptosrv spends executing it, the rows the database reads from its
+// tables to answer it, and the bytes of results it writes. If query limits
+// are configured, each query's usage is charged to the client which
+// submitted it, and a client whose usage reaches one of its ceilings in the
+// current limit period may submit no new queries until the next. Retrieving
+// cached results charges nothing.
+
+// QueryUsage describes the resources used by a query, or by the queries of a
+// client. Limits on usage are also described as QueryUsage, where 0 means
+// no limit.
+type QueryUsage struct {
+	// CPU time spent executing in ptosrv, not counting the database's, in
+	// seconds
+	CPUTime float64 `json:"cpu_time"`
+	// Rows read from tables in the observation database
+	RowsScanned int64 `json:"rows_scanned"`
+	// Bytes of results written, before compression
+	BytesReturned int64 `json:"bytes_returned"`
+}
+
+// Header returns this usage as the value of an HTTP header: comma-separated
+// key=value pairs with the keys of its JSON representation.
+func (u *QueryUsage) Header() string {
+	return fmt.Sprintf("cpu_time=%.3f, rows_scanned=%d, bytes_returned=%d", u.CPUTime, u.RowsScanned, u.BytesReturned)
+}
+
+// QueryLimit sets ceilings on the resources a client's queries may use per
+// limit period.
+type QueryLimit struct {
+	// CPU time, in seconds; 0 for no ceiling
+	CPUTime float64
+	// Rows scanned; 0 for no ceiling
+	RowsScanned int64
+	// Bytes of results; 0 for no ceiling
+	BytesReturned int64
+}
+
+// QueryLimitOptions configures limits on the resources used by the queries
+// of each client.
+type QueryLimitOptions struct {
+	// Ceilings for clients without ceilings of their own
+	Default QueryLimit
+
+	// Ceilings by client, identified by the ID of its API key, as in the
+	// access log and the __submitter of its queries
+	Keys map[string]QueryLimit
+
+	// Length of limit periods, in seconds; 0 for usage never to be reset
+	Period int
+}
+
+// limitFor returns the ceilings on the usage of a client.
+func (opts *QueryLimitOptions) limitFor(submitter string) QueryLimit {
+	if limit, ok := opts.Keys[submitter]; ok {
+		return limit
+	}
+	return opts.Default
+}
+
+// validate returns an error if any ceiling or the period is negative.
+func (opts *QueryLimitOptions) validate() error {
+	if opts.Period < 0 {
+		return PTOErrorf("QueryLimits Period may not be negative")
+	}
+	check := func(who string, limit QueryLimit) error {
+		if limit.CPUTime < 0 || limit.RowsScanned < 0 || limit.BytesReturned < 0 {
+			return PTOErrorf("QueryLimits for %s may not be negative", who)
+		}
+		return nil
+	}
+	if err := check("default", opts.Default); err != nil {
+		return err
+	}
+	for key, limit := range opts.Keys {
+		if err := check(key, limit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClientQueryUsage describes the resources used by a client's queries in the
+// current limit period.
+type ClientQueryUsage struct {
+	// Ceilings on the client's usage per period
+	Limit QueryUsage `json:"limit"`
+	// Usage so far in the current period
+	Used QueryUsage `json:"used"`
+	// Time the current period started, nil if the client has used nothing
+	PeriodStart *time.Time `json:"period_start,omitempty"`
+	// Time usage is reset, nil if never or if nothing was used
+	Reset *time.Time `json:"reset,omitempty"`
+}
+
+// Reached returns an error with status 429 Too Many Requests if the client's
+// usage has reached one of its ceilings.
+func (cu *ClientQueryUsage) Reached() error {
+	var what string
+	switch {
+	case cu.Limit.CPUTime > 0 && cu.Used.CPUTime >= cu.Limit.CPUTime:
+		what = fmt.Sprintf("CPU time of %g seconds", cu.Limit.CPUTime)
+	case cu.Limit.RowsScanned > 0 && cu.Used.RowsScanned >= cu.Limit.RowsScanned:
+		what = fmt.Sprintf("%d rows scanned", cu.Limit.RowsScanned)
+	case cu.Limit.BytesReturned > 0 && cu.Used.BytesReturned >= cu.Limit.BytesReturned:
+		what = fmt.Sprintf("%d bytes returned", cu.Limit.BytesReturned)
+	default:
+		return nil
+	}
+
+	return PTOErrorf("query limit of %s reached", what).StatusIs(http.StatusTooManyRequests).CodeIs(ErrorCodeQueryLimit)
+}
+
+// createQueryUsageTable creates the table recording the resources used by
+// each client's queries.
+func createQueryUsageTable(t *pg.Tx) error {
+	if _, err := t.Exec(`CREATE TABLE IF NOT EXISTS query_usage (
+		submitter text PRIMARY KEY,
+		cpu_time double precision NOT NULL,
+		rows_scanned bigint NOT NULL,
+		bytes_returned bigint NOT NULL,
+		period_start timestamptz NOT NULL)`); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// usagePeriodEndedClause is an SQL condition true if a row of the query
+// usage table belongs to a limit period which has ended, given the length of
+// limit periods as parameter 4.
+const usagePeriodEndedClause = "(?4 > 0 AND query_usage.period_start + make_interval(secs => ?4) <= now())"
+
+// ChargeQueryUsage adds the resources used by a query to the usage of the
+// client which submitted it, starting a new period if the current one has
+// ended.
+func ChargeQueryUsage(db orm.DB, opts *QueryLimitOptions, submitter string, usage *QueryUsage) error {
+	if _, err := db.Exec(`INSERT INTO query_usage (submitter, cpu_time, rows_scanned, bytes_returned, period_start)
+		VALUES (?0, ?1, ?2, ?3, now())
+		ON CONFLICT (submitter) DO UPDATE SET
+			cpu_time = CASE WHEN `+usagePeriodEndedClause+` THEN EXCLUDED.cpu_time ELSE query_usage.cpu_time + EXCLUDED.cpu_time END,
+			rows_scanned = CASE WHEN `+usagePeriodEndedClause+` THEN EXCLUDED.rows_scanned ELSE query_usage.rows_scanned + EXCLUDED.rows_scanned END,
+			bytes_returned = CASE WHEN `+usagePeriodEndedClause+` THEN EXCLUDED.bytes_returned ELSE query_usage.bytes_returned + EXCLUDED.bytes_returned END,
+			period_start = CASE WHEN `+usagePeriodEndedClause+` THEN EXCLUDED.period_start ELSE query_usage.period_start END`,
+		submitter, usage.CPUTime, usage.RowsScanned, usage.BytesReturned, opts.Period); err != nil {
+		return PTOWrapError(err)
+	}
+	return nil
+}
+
+// QueryUsageFor returns the resources used by a client's queries in the
+// current limit period.
+func QueryUsageFor(db orm.DB, opts *QueryLimitOptions, submitter string) (*ClientQueryUsage, error) {
+	limit := opts.limitFor(submitter)
+	out := ClientQueryUsage{Limit: QueryUsage{
+		CPUTime:       limit.CPUTime,
+		RowsScanned:   limit.RowsScanned,
+		BytesReturned: limit.BytesReturned,
+	}}
+
+	var used QueryUsage
+	var periodStart time.Time
+	if _, err := db.QueryOne(pg.Scan(&used.CPUTime, &used.RowsScanned, &used.BytesReturned, &periodStart),
+		"SELECT cpu_time, rows_scanned, bytes_returned, period_start FROM query_usage WHERE submitter = ?", submitter); err == pg.ErrNoRows {
+		return &out, nil
+	} else if err != nil {
+		return nil, PTOWrapError(err)
+	}
+
+	if opts.Period > 0 {
+		reset := periodStart.Add(time.Duration(opts.Period) * time.Second)
+		if !reset.After(time.Now()) {
+			return &out, nil
+		}
+		out.Reset = &reset
+	}
+
+	out.Used = used
+	out.PeriodStart = &periodStart
+	return &out, nil
+}
+
+// QueryUsage returns the resources used by the queries of a client
+// submitting queries to this cache in the current limit period, or a not
+// found error if query limits are not enabled.
+func (qc *QueryCache) QueryUsage(submitter string) (*ClientQueryUsage, error) {
+	opts := qc.config.QueryLimits
+	if opts == nil {
+		return nil, PTOErrorf("query limits are not enabled").StatusIs(http.StatusNotFound)
+	}
+	return QueryUsageFor(qc.db, opts, submitter)
+}
+
+// CheckQueryLimits returns an error with status 429 Too Many Requests, along
+// with its usage, if a client may not submit new queries to this cache
+// because its usage has reached one of its ceilings. It returns nil for both
+// if query limits are not enabled.
+func (qc *QueryCache) CheckQueryLimits(submitter string) (*ClientQueryUsage, error) {
+	opts := qc.config.QueryLimits
+	if opts == nil {
+		return nil, nil
+	}
+
+	usage, err := QueryUsageFor(qc.db, opts, submitter)
+	if err != nil {
+		return nil, err
+	}
+	return usage, usage.Reached()
+}
+
+// Usage returns the resources this query used at its last execution, or nil
+// if it has not been executed since usage was first accounted.
+func (q *Query) Usage() *QueryUsage {
+	return q.usage
+}
+
+// executeAccounted runs a function executing this query, accounting for the
+// resources it uses, and charges them to the query's submitter if query
+// limits are enabled. Failed executions are charged too.
+func (q *Query) executeAccounted(run func() error) error {
+	// CPU time is measured on the thread executing the query, so keep the
+	// query on it
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	q.resultBytes = 0
+	cpuStart := threadCPUTime()
+
+	rows, err := q.executeInTransaction(run)
+
+	q.usage = &QueryUsage{
+		CPUTime:       (threadCPUTime() - cpuStart).Seconds(),
+		RowsScanned:   rows,
+		BytesReturned: q.resultBytes,
+	}
+
+	if opts := q.qc.config.QueryLimits; opts != nil && q.Submitter != "" {
+		if cerr := ChargeQueryUsage(q.qc.db, opts, q.Submitter, q.usage); cerr != nil {
+			log.Printf("error charging usage of query %s to %s: %v", q.Identifier, q.Submitter, cerr)
+		}
+	}
+
+	return err
+}
+
+// rowsScanned returns the number of rows read from tables so far in the
+// given transaction, as counted by the database's statistics.
+func rowsScanned(t *pg.Tx) (int64, error) {
+	var rows int64
+	if _, err := t.QueryOne(pg.Scan(&rows),
+		"SELECT coalesce(sum(seq_tup_read + coalesce(idx_tup_fetch, 0)), 0) FROM pg_stat_xact_user_tables"); err != nil {
+		return 0, PTOWrapError(err)
+	}
+	return rows, nil
+}
+
+// usageMetadata returns this query's usage as metadata stored on disk,
+// which is read back as a string map.
+func (q *Query) usageMetadata() map[string]string {
+	return map[string]string{
+		"__cpu_time":       strconv.FormatFloat(q.usage.CPUTime, 'f', -1, 64),
+		"__rows_scanned":   strconv.FormatInt(q.usage.RowsScanned, 10),
+		"__bytes_returned": strconv.FormatInt(q.usage.BytesReturned, 10),
+	}
+}
+
+// setUsageFromMetadata reads this query's usage from metadata stored on
+// disk, if there is any.
+func (q *Query) setUsageFromMetadata(jmap map[string]string) error {
+	if jmap["__cpu_time"] == "" {
+		return nil
+	}
+
+	var usage QueryUsage
+	var err error
+	if usage.CPUTime, err = strconv.ParseFloat(jmap["__cpu_time"], 64); err != nil {
+		return PTOWrapError(err)
+	}
+	if usage.RowsScanned, err = strconv.ParseInt(jmap["__rows_scanned"], 10, 64); err != nil {
+		return PTOWrapError(err)
+	}
+	if usage.BytesReturned, err = strconv.ParseInt(jmap["__bytes_returned"], 10, 64); err != nil {
+		return PTOWrapError(err)
+	}
+	q.usage = &usage
+	return nil
+}
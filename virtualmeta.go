@@ -0,0 +1,257 @@
+package pto3
+
+import (
+	"bufio"
+	"compress/bzip2"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// VirtualMetadataProvider derives virtual metadata for raw data files: keys
+// beginning with __ which are computed by the raw data store from a file and
+// its metadata, rather than uploaded by clients. Providers are run whenever a
+// file's data or metadata changes, and when a campaign's metadata is reloaded.
+type VirtualMetadataProvider struct {
+	// Name of the provider, as given in the VirtualMetadata configuration key
+	Name string
+	// Update derives virtual metadata for the named file in the campaign,
+	// setting it on the file's metadata with SetVirtual. It is called with the
+	// campaign's lock held, so it must not call Campaign methods which read
+	// metadata; ReadFileData is safe. The data file may not exist yet.
+	Update func(cam *Campaign, filename string, md *RawMetadata) error
+}
+
+// Names of built-in virtual metadata providers
+const (
+	// File size and times, and data link; always run first, for every file
+	VirtualMetadataFile = "file"
+	// SHA-256 digest of the file's data, in __data_sha256
+	VirtualMetadataSHA256 = "sha256"
+	// Number of records (lines) in the file, in __record_count
+	VirtualMetadataRecords = "records"
+	// Number of packets in a pcap file, in __packet_count
+	VirtualMetadataPcap = "pcap"
+)
+
+var virtualMetadataProviders = make(map[string]*VirtualMetadataProvider)
+var virtualMetadataProviderLock sync.RWMutex
+
+// RegisterVirtualMetadataProvider registers a virtual metadata provider,
+// replacing any provider with the same name. Providers must be registered
+// before the configuration naming them is loaded; the file, sha256, records,
+// and pcap providers are registered by default.
+func RegisterVirtualMetadataProvider(provider *VirtualMetadataProvider) {
+	virtualMetadataProviderLock.Lock()
+	defer virtualMetadataProviderLock.Unlock()
+	virtualMetadataProviders[provider.Name] = provider
+}
+
+// VirtualMetadataProviderByName returns the registered provider with the
+// given name, or nil if there is none.
+func VirtualMetadataProviderByName(name string) *VirtualMetadataProvider {
+	virtualMetadataProviderLock.RLock()
+	defer virtualMetadataProviderLock.RUnlock()
+	return virtualMetadataProviders[name]
+}
+
+// VirtualMetadataProviderNames returns the names of all registered
+// providers, sorted.
+func VirtualMetadataProviderNames() []string {
+	virtualMetadataProviderLock.RLock()
+	defer virtualMetadataProviderLock.RUnlock()
+	out := make([]string, 0, len(virtualMetadataProviders))
+	for name := range virtualMetadataProviders {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// VirtualMetadataProvidersFor returns the providers to run for files of the
+// given filetype: the file provider, followed by the providers configured for
+// the filetype in the VirtualMetadata configuration key, in order.
+func (config *PTOConfiguration) VirtualMetadataProvidersFor(filetype string) []*VirtualMetadataProvider {
+	out := []*VirtualMetadataProvider{VirtualMetadataProviderByName(VirtualMetadataFile)}
+	for _, name := range config.VirtualMetadata[filetype] {
+		if provider := VirtualMetadataProviderByName(name); provider != nil {
+			out = append(out, provider)
+		}
+	}
+	return out
+}
+
+// updateFileMetadataVirtuals fills in the size and creation and modification
+// times of a file from its data and metadata files, and its data link.
+func updateFileMetadataVirtuals(cam *Campaign, filename string, md *RawMetadata) error {
+	// get file size and creation time
+	// file creation time is modification time of the datafile,
+	// since datafiles are immutable.
+	datafi, err := cam.statFileData(filename)
+	if err == nil {
+		md.datasize = int(datafi.Size())
+		modtime := datafi.ModTime()
+		md.creatime = &modtime
+	} else if os.IsNotExist(err) {
+		md.datasize = 0
+		md.creatime = nil
+	} else {
+		return err
+	}
+
+	// get modification time (from metadata file modification time)
+	metafi, err := os.Stat(filepath.Join(cam.path, filename+FileMetadataSuffix))
+	if err == nil {
+		modtime := metafi.ModTime()
+		md.modtime = &modtime
+
+		if md.creatime == nil {
+			// creation time is the same as modification time if there is no datafile yet
+			md.creatime = md.modtime
+		} else if md.creatime.Sub(*md.modtime) > 0 {
+			// modification time cannot be before creation time
+			md.modtime = md.creatime
+		}
+	} else {
+		return err
+	}
+
+	// generate data path
+	md.datalink, err = cam.config.LinkTo("raw/" + filepath.Base(cam.path) + "/" + filename + "/data")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// openVirtualData opens the data file for a virtual metadata provider,
+// decompressing files with filetypes ending in -bz2 as ReadFileExcerpt does.
+// It returns nil if there is no data file yet. The caller must close the
+// returned file.
+func openVirtualData(cam *Campaign, filename string, md *RawMetadata) (RawDataFile, io.Reader, error) {
+	f, err := cam.ReadFileData(filename)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, PTOWrapError(err)
+	}
+
+	if strings.HasSuffix(md.Filetype(true), "-bz2") {
+		return f, bzip2.NewReader(f), nil
+	}
+	return f, f, nil
+}
+
+// updateSHA256Virtuals fills in the SHA-256 digest of a file's data as
+// uploaded, as in campaign manifests.
+func updateSHA256Virtuals(cam *Campaign, filename string, md *RawMetadata) error {
+	digest, err := cam.digestFileData(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return PTOWrapError(err)
+	}
+
+	md.SetVirtual("__data_sha256", digest)
+	return nil
+}
+
+// updateRecordVirtuals fills in the number of records in a file, counting
+// lines as source references do.
+func updateRecordVirtuals(cam *Campaign, filename string, md *RawMetadata) error {
+	f, in, err := openVirtualData(cam, filename, md)
+	if f == nil {
+		return err
+	}
+	defer f.Close()
+
+	records := 0
+	lines := bufio.NewReader(in)
+	if _, err := lines.Peek(1); err == io.EOF {
+		md.SetVirtual("__record_count", records)
+		return nil
+	}
+	for {
+		_, eof, err := readExcerptLine(lines)
+		if err != nil {
+			return err
+		}
+		records++
+		if eof {
+			break
+		}
+	}
+
+	md.SetVirtual("__record_count", records)
+	return nil
+}
+
+// updatePcapVirtuals fills in the number of packets in a file in libpcap
+// format.
+func updatePcapVirtuals(cam *Campaign, filename string, md *RawMetadata) error {
+	f, in, err := openVirtualData(cam, filename, md)
+	if f == nil {
+		return err
+	}
+	defer f.Close()
+
+	// the magic number in the global header gives the byte order
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return PTOErrorf("%s is not a pcap file: %s", filename, err.Error())
+	}
+
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return PTOErrorf("%s is not a pcap file: bad magic number", filename)
+	}
+
+	// each packet record header gives the length of the captured data
+	packets := 0
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(in, record); err == io.EOF {
+			break
+		} else if err != nil {
+			return PTOErrorf("truncated packet record in %s: %s", filename, err.Error())
+		}
+
+		if _, err := io.CopyN(ioutil.Discard, in, int64(order.Uint32(record[8:12]))); err != nil {
+			return PTOErrorf("truncated packet in %s: %s", filename, err.Error())
+		}
+		packets++
+	}
+
+	md.SetVirtual("__packet_count", packets)
+	return nil
+}
+
+func init() {
+	RegisterVirtualMetadataProvider(&VirtualMetadataProvider{
+		Name:   VirtualMetadataFile,
+		Update: updateFileMetadataVirtuals,
+	})
+	RegisterVirtualMetadataProvider(&VirtualMetadataProvider{
+		Name:   VirtualMetadataSHA256,
+		Update: updateSHA256Virtuals,
+	})
+	RegisterVirtualMetadataProvider(&VirtualMetadataProvider{
+		Name:   VirtualMetadataRecords,
+		Update: updateRecordVirtuals,
+	})
+	RegisterVirtualMetadataProvider(&VirtualMetadataProvider{
+		Name:   VirtualMetadataPcap,
+		Update: updatePcapVirtuals,
+	})
+}